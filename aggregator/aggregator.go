@@ -25,8 +25,12 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"io"
 	"math"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/tgres/tgres/serde"
@@ -42,6 +46,7 @@ const (
 	aggKindValue aggKind = iota
 	aggKindGauge
 	aggKindList
+	aggKindSet
 )
 
 type aggregation struct {
@@ -49,6 +54,7 @@ type aggregation struct {
 	kind  aggKind
 	value float64
 	list  []float64
+	set   map[string]bool
 }
 
 // The Aggregator keeps the intermediate state for all data that is
@@ -57,29 +63,97 @@ type Aggregator interface {
 	// Process an aggregator command, which is a data point with insturctions on how to process it.
 	ProcessCmd(cmd *Command)
 	// Flush all aggregations to the undelying DataPointQueuer. If now is zero, time.Now() is used.
-	// All internal state is cleared after a flush.
+	// All internal state is cleared after a flush, except the last
+	// values of gauges set by CmdSetGauge or CmdDeltaGauge.
 	Flush(now time.Time)
 }
 
 type State struct {
 	t          DataPointQueuer
 	m          map[string]*aggregation
+	gauges     map[string]float64 // last values, kept across flushes for CmdDeltaGauge
 	lastFlush  time.Time
 	Thresholds []int // List of percentiles for CmdAppend
 	AppendAttr string
+	// Outputs flushed for CmdAppend when no Outputs prefix matches,
+	// and for every Thresholds percentile, named <output><ThresholdSep><threshold>
+	// (e.g. "upper_90"). Any output valid in an OutputSpec may be used.
+	TimerAggregates     []string
+	ThresholdAggregates []string
+	ThresholdSep        string
+	// Per prefix outputs for CmdAppend, first matching prefix
+	// wins. If none match, count/lower/upper/sum/mean and the
+	// Thresholds are flushed.
+	Outputs []OutputSpec
+	// Histograms for CmdAppend, first matching pattern wins.
+	Histograms []HistogramSpec
+}
+
+// HistogramSpec specifies bucket boundaries for CmdAppend
+// aggregations whose AppendAttr matches Pattern. On flush, the
+// number of values in each bucket is flushed as a separate series
+// with a ".histogram.bin_<upper bound>" suffix, where a bucket holds
+// values greater than the previous boundary and less than or equal
+// to its own. Buckets must be in ascending order, values above the
+// last boundary are counted in "bin_inf".
+type HistogramSpec struct {
+	Pattern *regexp.Regexp
+	Buckets []float64
+}
+
+// OutputSpec lists the values flushed for CmdAppend aggregations
+// whose AppendAttr (e.g. name) begins with Prefix. Every output is
+// flushed with its name appended as a suffix, e.g. "foo.p99". Valid
+// outputs are count, count_ps (count per second), sum, sum_squares,
+// mean, median, stddev (or std), min (or lower), max (or upper) and
+// pN where N is a percentile between 1 and 100, e.g. p50, p90, p99.
+type OutputSpec struct {
+	Prefix  string
+	Outputs []string
+}
+
+// ValidateOutput returns an error if name is not a valid OutputSpec
+// output.
+func ValidateOutput(name string) error {
+	switch name {
+	case "count", "count_ps", "sum", "sum_squares", "mean", "median", "stddev", "std", "min", "max", "lower", "upper":
+		return nil
+	}
+	if _, ok := parsePercentile(name); !ok {
+		return fmt.Errorf("Invalid aggregator output: %q", name)
+	}
+	return nil
+}
+
+// parsePercentile parses "pN" where N is an integer between 1 and 100.
+func parsePercentile(name string) (int, bool) {
+	if !strings.HasPrefix(name, "p") {
+		return 0, false
+	}
+	p, err := strconv.Atoi(name[1:])
+	if err != nil || p < 1 || p > 100 {
+		return 0, false
+	}
+	return p, true
 }
 
 // Returns a new aggregator. The only argument needs to provide a
 // QueueDataPoint() method which is what the aggregator will use to
 // queue the aggregated points. The returned aggregator state has
-// Thresholds set to {90}.
+// Thresholds set to {90}, TimerAggregates to count, lower, upper,
+// sum and mean and ThresholdAggregates to sum, mean and upper,
+// separated by "_".
 func NewAggregator(t DataPointQueuer) *State {
 	return &State{
-		t:          t,
-		m:          make(map[string]*aggregation),
-		lastFlush:  time.Now(),
-		Thresholds: []int{90},
-		AppendAttr: "value",
+		t:                   t,
+		m:                   make(map[string]*aggregation),
+		gauges:              make(map[string]float64),
+		lastFlush:           time.Now(),
+		Thresholds:          []int{90},
+		AppendAttr:          "value",
+		TimerAggregates:     []string{"count", "lower", "upper", "sum", "mean"},
+		ThresholdAggregates: []string{"sum", "mean", "upper"},
+		ThresholdSep:        "_",
 	}
 }
 
@@ -112,6 +186,18 @@ func (a *State) setGauge(ident serde.Ident, value float64) {
 	} else {
 		a.m[key].value = value
 	}
+	a.gauges[key] = value
+}
+
+// Add to the last value of the gauge at key ident, which is kept
+// across flushes, starting with 0.0 if it was never set.
+func (a *State) deltaGauge(ident serde.Ident, value float64) {
+	key := ident.String()
+	if a.m[key] == nil {
+		a.m[key] = &aggregation{ident: ident, kind: aggKindGauge, value: a.gauges[key]}
+	}
+	a.m[key].value += value
+	a.gauges[key] = a.m[key].value
 }
 
 // Append to values at key ident, created as aggKindList if not
@@ -126,6 +212,18 @@ func (a *State) append(ident serde.Ident, value float64) {
 	}
 }
 
+// Add member to the set at key ident, created as aggKindSet if not
+// existing.
+func (a *State) addToSet(ident serde.Ident, member string) {
+	key := ident.String()
+	if a.m[key] == nil {
+		a.m[key] = &aggregation{ident: ident, kind: aggKindSet, set: make(map[string]bool)}
+	}
+	if a.m[key].set != nil {
+		a.m[key].set[member] = true
+	}
+}
+
 func (a *State) ProcessCmd(cmd *Command) {
 	if !cmd.ts.IsZero() && cmd.ts.Before(a.lastFlush) {
 		return // this command is too old for this aggregator, ignore it
@@ -137,8 +235,12 @@ func (a *State) ProcessCmd(cmd *Command) {
 		a.addGauge(cmd.ident, cmd.value)
 	case CmdSetGauge:
 		a.setGauge(cmd.ident, cmd.value)
+	case CmdDeltaGauge:
+		a.deltaGauge(cmd.ident, cmd.value)
 	case CmdAppend:
 		a.append(cmd.ident, cmd.value)
+	case CmdAddToSet:
+		a.addToSet(cmd.ident, cmd.member)
 	}
 }
 
@@ -170,39 +272,23 @@ func (a *State) Flush(now time.Time) {
 			// store as is
 			a.t.QueueDataPoint(agg.ident, now, agg.value)
 
+		case aggKindSet:
+			// number of unique members
+			a.t.QueueDataPoint(appendIdent(agg.ident, a.AppendAttr, ".count"), now, float64(len(agg.set)))
+
 		case aggKindList:
 			list := agg.list
 
-			// count
-			a.t.QueueDataPoint(appendIdent(agg.ident, a.AppendAttr, ".count"), now, float64(len(list)))
-
-			// lower, upper, sum, mean
-			if len(list) > 0 {
-				sort.Float64s(list)
-
-				cumul := make([]float64, len(list))
-				for n, v := range list {
-					cumul[n] += v
-				}
-
-				a.t.QueueDataPoint(appendIdent(agg.ident, a.AppendAttr, ".lower"), now, list[0])
-				a.t.QueueDataPoint(appendIdent(agg.ident, a.AppendAttr, ".upper"), now, list[len(list)-1])
-				a.t.QueueDataPoint(appendIdent(agg.ident, a.AppendAttr, ".sum"), now, cumul[len(list)-1])
-				a.t.QueueDataPoint(appendIdent(agg.ident, a.AppendAttr, ".mean"), now, cumul[len(list)-1]/float64(len(list)))
-
-				// make a little round() since Go doesn't have one...
-				round := func(f float64) int {
-					return int(math.Floor(f + .5))
-				}
-
-				// TODO may be add "median" and "std"?
-				for _, threshold := range a.Thresholds {
-					idx := round(float64(threshold)/100*float64(len(list))) - 1
-					a.t.QueueDataPoint(appendIdent(agg.ident, a.AppendAttr, fmt.Sprintf(".sum_%02d", threshold)), now, cumul[idx])
-					a.t.QueueDataPoint(appendIdent(agg.ident, a.AppendAttr, fmt.Sprintf(".mean_%02d", threshold)), now, cumul[idx]/float64(idx+1))
-					a.t.QueueDataPoint(appendIdent(agg.ident, a.AppendAttr, fmt.Sprintf(".upper_%02d", threshold)), now, list[idx])
-				}
+			if hist := a.histogramFor(agg.ident); hist != nil {
+				a.flushHistogram(agg.ident, list, hist.Buckets, now)
+			}
+
+			if outputs := a.outputsFor(agg.ident); outputs != nil {
+				a.flushOutputs(agg.ident, list, outputs, now)
+				continue
 			}
+
+			a.flushTimer(agg.ident, list, now)
 		}
 	}
 
@@ -211,22 +297,176 @@ func (a *State) Flush(now time.Time) {
 	a.lastFlush = now
 }
 
+// outputsFor returns the outputs of the first OutputSpec whose
+// prefix matches, or nil.
+func (a *State) outputsFor(ident serde.Ident) []string {
+	name := ident[a.AppendAttr]
+	for _, spec := range a.Outputs {
+		if strings.HasPrefix(name, spec.Prefix) {
+			return spec.Outputs
+		}
+	}
+	return nil
+}
+
+// histogramFor returns the first HistogramSpec whose pattern
+// matches, or nil.
+func (a *State) histogramFor(ident serde.Ident) *HistogramSpec {
+	name := ident[a.AppendAttr]
+	for i, spec := range a.Histograms {
+		if spec.Pattern.MatchString(name) {
+			return &a.Histograms[i]
+		}
+	}
+	return nil
+}
+
+// flushHistogram queues the count of values in every bucket.
+func (a *State) flushHistogram(ident serde.Ident, list []float64, buckets []float64, now time.Time) {
+	counts := make([]int, len(buckets)+1) // last one is inf
+	for _, v := range list {
+		counts[sort.SearchFloat64s(buckets, v)]++
+	}
+	for i, count := range counts {
+		bound := "inf"
+		if i < len(buckets) {
+			bound = strings.Replace(strconv.FormatFloat(buckets[i], 'f', -1, 64), ".", "_", -1)
+		}
+		a.t.QueueDataPoint(appendIdent(ident, a.AppendAttr, ".histogram.bin_"+bound), now, float64(count))
+	}
+}
+
+// flushOutputs queues the requested outputs for a list. With an empty
+// list only count is flushed (as zero).
+func (a *State) flushOutputs(ident serde.Ident, list []float64, outputs []string, now time.Time) {
+	sort.Float64s(list)
+	for _, output := range outputs {
+		if value, ok := listOutput(list, output, now.Sub(a.lastFlush)); ok {
+			a.t.QueueDataPoint(appendIdent(ident, a.AppendAttr, "."+output), now, value)
+		}
+	}
+}
+
+// flushTimer queues the TimerAggregates for a list, as well as the
+// ThresholdAggregates for every threshold percentile, e.g. with a
+// threshold of 90 "upper_90" is the largest value once the top 10%
+// have been discarded.
+func (a *State) flushTimer(ident serde.Ident, list []float64, now time.Time) {
+	sort.Float64s(list)
+	interval := now.Sub(a.lastFlush)
+
+	for _, aggregate := range a.TimerAggregates {
+		if value, ok := listOutput(list, aggregate, interval); ok {
+			a.t.QueueDataPoint(appendIdent(ident, a.AppendAttr, "."+aggregate), now, value)
+		}
+	}
+
+	if len(list) == 0 {
+		return
+	}
+
+	// make a little round() since Go doesn't have one...
+	round := func(f float64) int {
+		return int(math.Floor(f + .5))
+	}
+
+	for _, threshold := range a.Thresholds {
+		idx := round(float64(threshold)/100*float64(len(list))) - 1
+		if idx < 0 {
+			idx = 0
+		}
+		for _, aggregate := range a.ThresholdAggregates {
+			if value, ok := listOutput(list[:idx+1], aggregate, interval); ok {
+				suffix := fmt.Sprintf(".%s%s%02d", aggregate, a.ThresholdSep, threshold)
+				a.t.QueueDataPoint(appendIdent(ident, a.AppendAttr, suffix), now, value)
+			}
+		}
+	}
+}
+
+// listOutput computes an output for a sorted list, interval is used
+// for count_ps. It returns false if the list is empty (except for
+// count) or the output is not valid.
+func listOutput(list []float64, output string, interval time.Duration) (float64, bool) {
+	n := len(list)
+	switch output {
+	case "count":
+		return float64(n), true
+	case "count_ps":
+		if interval <= 0 {
+			return 0, false
+		}
+		return float64(n) / interval.Seconds(), true
+	}
+	if n == 0 {
+		return 0, false
+	}
+
+	var sum float64
+	for _, v := range list {
+		sum += v
+	}
+	mean := sum / float64(n)
+
+	switch output {
+	case "sum":
+		return sum, true
+	case "mean":
+		return mean, true
+	case "median":
+		if n%2 == 0 {
+			return (list[n/2-1] + list[n/2]) / 2, true
+		}
+		return list[n/2], true
+	case "sum_squares":
+		var sumsq float64
+		for _, v := range list {
+			sumsq += v * v
+		}
+		return sumsq, true
+	case "stddev", "std":
+		var sqdiff float64
+		for _, v := range list {
+			sqdiff += (v - mean) * (v - mean)
+		}
+		return math.Sqrt(sqdiff / float64(n)), true
+	case "min", "lower":
+		return list[0], true
+	case "max", "upper":
+		return list[n-1], true
+	}
+
+	p, ok := parsePercentile(output)
+	if !ok {
+		return 0, false
+	}
+	// nearest rank
+	idx := int(math.Ceil(float64(p)/100*float64(n))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return list[idx], true
+}
+
 type AggCmd int
 
 const (
-	CmdAdd      AggCmd = iota // Add the value, the flushed value is a per second rate.
-	CmdAddGauge               // Add the value, the flushed value is the sum as is (e.g. total traffic for all routers).
-	CmdSetGauge               // Overwrite the value, the flushed value is the last value as is.
-	CmdAppend                 // Append the value to a slice. The flushed values will be upper/lower/sum/mean and Threshold percentiles.
+	CmdAdd        AggCmd = iota // Add the value, the flushed value is a per second rate.
+	CmdAddGauge                 // Add the value, the flushed value is the sum as is (e.g. total traffic for all routers).
+	CmdSetGauge                 // Overwrite the value, the flushed value is the last value as is.
+	CmdAppend                   // Append the value to a slice. The flushed values will be upper/lower/sum/mean and Threshold percentiles, or as specified by Outputs.
+	CmdAddToSet                 // Add the member to a set, the flushed value is the number of unique members. Use NewSetCommand().
+	CmdDeltaGauge               // Add the value to the last value of the gauge, which is kept across flushes (statsd "+N"/"-N").
 )
 
 // An aggregator command. Use NewCommand() to create one.
 type Command struct {
-	cmd   AggCmd
-	ident serde.Ident
-	value float64
-	ts    time.Time
-	Hops  int // For cluster forwarding
+	cmd    AggCmd
+	ident  serde.Ident
+	value  float64
+	ts     time.Time
+	member string // For CmdAddToSet
+	Hops   int    // For cluster forwarding
 }
 
 func (ac *Command) GobEncode() ([]byte, error) {
@@ -243,6 +483,7 @@ func (ac *Command) GobEncode() ([]byte, error) {
 	check(enc.Encode(ac.value))
 	check(enc.Encode(ac.ts))
 	check(enc.Encode(ac.Hops))
+	check(enc.Encode(ac.member))
 	if err != nil {
 		return nil, err
 	}
@@ -262,6 +503,13 @@ func (ac *Command) GobDecode(b []byte) error {
 	check(dec.Decode(&ac.value))
 	check(dec.Decode(&ac.ts))
 	check(dec.Decode(&ac.Hops))
+	if err == nil {
+		// Older nodes do not send the member, it is the empty
+		// string then.
+		if er := dec.Decode(&ac.member); er != io.EOF {
+			check(er)
+		}
+	}
 	return err
 }
 
@@ -270,3 +518,8 @@ func (ac *Command) GobDecode(b []byte) error {
 func NewCommand(cmd AggCmd, ident serde.Ident, value float64) *Command {
 	return &Command{cmd: cmd, ident: ident, value: value, ts: time.Now()}
 }
+
+// Create a CmdAddToSet aggregator command.
+func NewSetCommand(ident serde.Ident, member string) *Command {
+	return &Command{cmd: CmdAddToSet, ident: ident, member: member, ts: time.Now()}
+}
@@ -0,0 +1,247 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregator
+
+import (
+	"bytes"
+	"encoding/gob"
+	"math"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+type fakeQueuer map[string]float64
+
+func (q fakeQueuer) QueueDataPoint(ident serde.Ident, _ time.Time, v float64) {
+	q[ident["name"]] = v
+}
+
+func Test_State_FlushOutputs(t *testing.T) {
+	q := make(fakeQueuer)
+	a := NewAggregator(q)
+	a.AppendAttr = "name"
+	a.Outputs = []OutputSpec{
+		{Prefix: "api.", Outputs: []string{"count", "min", "max", "median", "stddev", "p50", "p90", "p99"}},
+	}
+
+	for i := 1; i <= 10; i++ {
+		a.ProcessCmd(NewCommand(CmdAppend, serde.Ident{"name": "api.foo"}, float64(i)))
+		a.ProcessCmd(NewCommand(CmdAppend, serde.Ident{"name": "other"}, float64(i)))
+	}
+	a.Flush(time.Now().Add(time.Second))
+
+	expect := map[string]float64{
+		"api.foo.count":  10,
+		"api.foo.min":    1,
+		"api.foo.max":    10,
+		"api.foo.median": 5.5,
+		"api.foo.stddev": math.Sqrt(8.25),
+		"api.foo.p50":    5,
+		"api.foo.p90":    9,
+		"api.foo.p99":    10,
+		// defaults
+		"other.count":    10,
+		"other.lower":    1,
+		"other.upper":    10,
+		"other.sum":      55,
+		"other.mean":     5.5,
+		"other.sum_90":   45,
+		"other.mean_90":  5,
+		"other.upper_90": 9,
+	}
+	if len(q) != len(expect) {
+		t.Errorf("Flush: expected %d points, got %d: %v", len(expect), len(q), q)
+	}
+	for k, v := range expect {
+		if got, ok := q[k]; !ok || math.Abs(got-v) > 1e-9 {
+			t.Errorf("Flush: %s: expected %v, got %v (present: %v)", k, v, got, ok)
+		}
+	}
+
+	// empty list only flushes count
+	q = make(fakeQueuer)
+	a.t = q
+	ident := serde.Ident{"name": "api.bar"}
+	a.m[ident.String()] = &aggregation{ident: ident, kind: aggKindList, list: []float64{}}
+	a.Flush(time.Now().Add(2 * time.Second))
+	if len(q) != 1 || q["api.bar.count"] != 0 {
+		t.Errorf("Flush: empty list should only flush count: %v", q)
+	}
+}
+
+func Test_State_FlushTimerAggregates(t *testing.T) {
+	q := make(fakeQueuer)
+	a := NewAggregator(q)
+	a.AppendAttr = "name"
+	a.Thresholds = []int{50, 90}
+	a.TimerAggregates = []string{"count", "count_ps", "median", "std", "sum_squares"}
+	a.ThresholdAggregates = []string{"count", "upper"}
+	a.ThresholdSep = "."
+
+	start := time.Now()
+	a.lastFlush = start
+	for i := 1; i <= 10; i++ {
+		a.ProcessCmd(NewCommand(CmdAppend, serde.Ident{"name": "foo"}, float64(i)))
+	}
+	a.Flush(start.Add(10 * time.Second))
+
+	expect := map[string]float64{
+		"foo.count":       10,
+		"foo.count_ps":    1,
+		"foo.median":      5.5,
+		"foo.std":         math.Sqrt(8.25),
+		"foo.sum_squares": 385,
+		"foo.count.50":    5,
+		"foo.upper.50":    5,
+		"foo.count.90":    9,
+		"foo.upper.90":    9,
+	}
+	if len(q) != len(expect) {
+		t.Errorf("Flush: expected %d points, got %d: %v", len(expect), len(q), q)
+	}
+	for k, v := range expect {
+		if got, ok := q[k]; !ok || math.Abs(got-v) > 1e-9 {
+			t.Errorf("Flush: %s: expected %v, got %v (present: %v)", k, v, got, ok)
+		}
+	}
+}
+
+func Test_State_FlushHistogram(t *testing.T) {
+	q := make(fakeQueuer)
+	a := NewAggregator(q)
+	a.AppendAttr = "name"
+	a.Outputs = []OutputSpec{{Prefix: "api.", Outputs: []string{"count"}}}
+	a.Histograms = []HistogramSpec{{Pattern: regexp.MustCompile("^api\\."), Buckets: []float64{1, 2.5, 10}}}
+
+	for _, v := range []float64{0, 1, 2, 2.5, 3, 10, 11, 100} {
+		a.ProcessCmd(NewCommand(CmdAppend, serde.Ident{"name": "api.foo"}, v))
+	}
+	a.ProcessCmd(NewCommand(CmdAppend, serde.Ident{"name": "other"}, 1))
+	a.Flush(time.Now().Add(time.Second))
+
+	expect := map[string]float64{
+		"api.foo.count":             8,
+		"api.foo.histogram.bin_1":   2,
+		"api.foo.histogram.bin_2_5": 2,
+		"api.foo.histogram.bin_10":  2,
+		"api.foo.histogram.bin_inf": 2,
+	}
+	for k, v := range expect {
+		if got, ok := q[k]; !ok || got != v {
+			t.Errorf("Flush: %s: expected %v, got %v (present: %v)", k, v, got, ok)
+		}
+	}
+	if _, ok := q["other.histogram.bin_inf"]; ok {
+		t.Errorf("Flush: histogram should not be flushed for non-matching names")
+	}
+}
+
+func Test_ValidateOutput(t *testing.T) {
+	for _, ok := range []string{"count", "sum", "mean", "median", "stddev", "min", "max", "lower", "upper", "p1", "p99", "p100"} {
+		if err := ValidateOutput(ok); err != nil {
+			t.Errorf("ValidateOutput(%q): unexpected error: %v", ok, err)
+		}
+	}
+	for _, bad := range []string{"", "p", "p0", "p101", "p9x", "avg"} {
+		if err := ValidateOutput(bad); err == nil {
+			t.Errorf("ValidateOutput(%q): expected an error", bad)
+		}
+	}
+}
+
+func Test_State_Set(t *testing.T) {
+	q := make(fakeQueuer)
+	a := NewAggregator(q)
+	a.AppendAttr = "name"
+
+	for _, m := range []string{"bob", "alice", "bob", "carol", "alice"} {
+		a.ProcessCmd(NewSetCommand(serde.Ident{"name": "users"}, m))
+	}
+	a.Flush(time.Now())
+	if q["users.count"] != 3 {
+		t.Errorf("Flush: set count should be 3, got %v", q["users.count"])
+	}
+
+	// sets are reset on flush
+	q = make(fakeQueuer)
+	a.t = q
+	a.ProcessCmd(NewSetCommand(serde.Ident{"name": "users"}, "bob"))
+	a.Flush(time.Now())
+	if q["users.count"] != 1 {
+		t.Errorf("Flush: set count after flush should be 1, got %v", q["users.count"])
+	}
+}
+
+func Test_State_DeltaGauge(t *testing.T) {
+	q := make(fakeQueuer)
+	a := NewAggregator(q)
+	ident := serde.Ident{"name": "gauge"}
+
+	a.ProcessCmd(NewCommand(CmdDeltaGauge, ident, 5))
+	a.ProcessCmd(NewCommand(CmdDeltaGauge, ident, -2))
+	a.Flush(time.Now())
+	if q["gauge"] != 3 {
+		t.Errorf("Flush: gauge should be 3, got %v", q["gauge"])
+	}
+
+	// the value is kept across flushes
+	a.ProcessCmd(NewCommand(CmdDeltaGauge, ident, 1))
+	a.Flush(time.Now())
+	if q["gauge"] != 4 {
+		t.Errorf("Flush: gauge after flush should be 4, got %v", q["gauge"])
+	}
+
+	a.ProcessCmd(NewCommand(CmdSetGauge, ident, 10))
+	a.Flush(time.Now())
+	a.ProcessCmd(NewCommand(CmdDeltaGauge, ident, -1))
+	a.Flush(time.Now())
+	if q["gauge"] != 9 {
+		t.Errorf("Flush: gauge after set and delta should be 9, got %v", q["gauge"])
+	}
+}
+
+func Test_Command_Gob(t *testing.T) {
+	ac := NewSetCommand(serde.Ident{"name": "users"}, "bob")
+	ac.Hops = 1
+	b, err := ac.GobEncode()
+	if err != nil {
+		t.Fatalf("GobEncode: %v", err)
+	}
+	var dec Command
+	if err := dec.GobDecode(b); err != nil {
+		t.Fatalf("GobDecode: %v", err)
+	}
+	if dec.cmd != CmdAddToSet || dec.member != "bob" || dec.Hops != 1 || dec.ident["name"] != "users" {
+		t.Errorf("GobDecode: decoded command does not match: %#v", dec)
+	}
+
+	// as encoded by a node which does not know about sets
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	for _, v := range []interface{}{CmdAdd, serde.Ident{"name": "foo"}, 1.5, time.Now(), 2} {
+		enc.Encode(v)
+	}
+	dec = Command{}
+	if err := dec.GobDecode(buf.Bytes()); err != nil {
+		t.Fatalf("GobDecode: command without a member should decode: %v", err)
+	}
+	if dec.cmd != CmdAdd || dec.value != 1.5 || dec.Hops != 2 || dec.member != "" {
+		t.Errorf("GobDecode: decoded old command does not match: %#v", dec)
+	}
+}
@@ -0,0 +1,178 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package batch decodes binary batches of data points, for bulk
+// loading where the cost of parsing a text protocol dominates.
+//
+// A batch is a sequence of protobuf encoded Point messages, each
+// preceded by its length as a varint (as written by protobuf's
+// writeDelimitedTo), optionally compressed with snappy (the block
+// format). The Point message is:
+//
+//	message Point {
+//	  string name = 1;
+//	  int64 timestamp_ms = 2;    // milliseconds since the epoch
+//	  double value = 3;
+//	  map<string, string> tags = 4;
+//	}
+package batch
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/serde"
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wire64Bit   = 1
+	wireBytes   = 2
+	wire32Bit   = 5
+	maxPointLen = 1 << 20 // a sanity limit
+)
+
+type Point struct {
+	Name  string
+	Time  time.Time
+	Value float64
+	Tags  map[string]string
+}
+
+// Ident returns the ident of the point: its name, sanitized, and its
+// tags. It is an error if the name or a tag is empty or if a tag is
+// "name".
+func (p *Point) Ident() (serde.Ident, error) {
+	ident := serde.Ident{"name": misc.SanitizeName(p.Name)}
+	if ident["name"] == "" {
+		return nil, fmt.Errorf("name missing or invalid")
+	}
+	for k, v := range p.Tags {
+		if k == "" || v == "" || k == "name" {
+			return nil, fmt.Errorf("invalid tag: %q=%q", k, v)
+		}
+		ident[k] = v
+	}
+	return ident, nil
+}
+
+// Decode decodes a batch, which must not be compressed (see
+// DecodeSnappy). An error means that the rest of the batch could not
+// be decoded, the points decoded until then are returned with it.
+func Decode(data []byte) ([]*Point, error) {
+	var points []*Point
+	for len(data) > 0 {
+		l, n := binary.Uvarint(data)
+		if n <= 0 || l > maxPointLen || l > uint64(len(data)-n) {
+			return points, fmt.Errorf("point %d: invalid length", len(points))
+		}
+		p, err := decodePoint(data[n : n+int(l)])
+		if err != nil {
+			return points, fmt.Errorf("point %d: %v", len(points), err)
+		}
+		points = append(points, p)
+		data = data[n+int(l):]
+	}
+	return points, nil
+}
+
+func decodePoint(b []byte) (*Point, error) {
+	p := &Point{}
+	var ms int64
+	err := eachField(b, func(num int, typ int, v uint64, field []byte) error {
+		switch {
+		case num == 1 && typ == wireBytes:
+			p.Name = string(field)
+		case num == 2 && typ == wireVarint:
+			ms = int64(v)
+		case num == 3 && typ == wire64Bit:
+			p.Value = math.Float64frombits(v)
+		case num == 4 && typ == wireBytes:
+			var k, tv string
+			if err := eachField(field, func(num int, typ int, _ uint64, field []byte) error {
+				if typ == wireBytes && num == 1 {
+					k = string(field)
+				} else if typ == wireBytes && num == 2 {
+					tv = string(field)
+				}
+				return nil
+			}); err != nil {
+				return fmt.Errorf("tags: %v", err)
+			}
+			if p.Tags == nil {
+				p.Tags = make(map[string]string)
+			}
+			p.Tags[k] = tv
+		}
+		return nil // unknown fields are skipped
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.Time = time.Unix(0, ms*int64(time.Millisecond))
+	return p, nil
+}
+
+// eachField calls f for every field of a protobuf message, v is the
+// value of varint and fixed size fields, field that of length
+// delimited ones.
+func eachField(b []byte, f func(num int, typ int, v uint64, field []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("invalid field key")
+		}
+		b = b[n:]
+		num, typ := int(key>>3), int(key&7)
+
+		var (
+			v     uint64
+			field []byte
+		)
+		switch typ {
+		case wireVarint:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return fmt.Errorf("field %d: invalid varint", num)
+			}
+			b = b[n:]
+		case wire64Bit:
+			if len(b) < 8 {
+				return fmt.Errorf("field %d: truncated", num)
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case wire32Bit:
+			if len(b) < 4 {
+				return fmt.Errorf("field %d: truncated", num)
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return fmt.Errorf("field %d: invalid length", num)
+			}
+			field, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return fmt.Errorf("field %d: unsupported wire type %d", num, typ)
+		}
+		if err := f(num, typ, v, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
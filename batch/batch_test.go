@@ -0,0 +1,114 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package batch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+type pb struct{ bytes.Buffer }
+
+func (b *pb) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (b *pb) bytesField(num int, v []byte) {
+	b.varint(uint64(num<<3 | wireBytes))
+	b.varint(uint64(len(v)))
+	b.Write(v)
+}
+
+func encodePoint(name string, ms int64, value float64, tags map[string]string) []byte {
+	var b pb
+	b.bytesField(1, []byte(name))
+	b.varint(2<<3 | wireVarint)
+	b.varint(uint64(ms))
+	b.varint(3<<3 | wire64Bit)
+	binary.Write(&b, binary.LittleEndian, math.Float64bits(value))
+	for k, v := range tags {
+		var e pb
+		e.bytesField(1, []byte(k))
+		e.bytesField(2, []byte(v))
+		b.bytesField(4, e.Bytes())
+	}
+	b.bytesField(99, []byte("unknown")) // skipped
+	return b.Bytes()
+}
+
+func Test_Decode(t *testing.T) {
+	var b pb
+	for _, p := range [][]byte{
+		encodePoint("foo.bar", 1500000000123, 1.5, nil),
+		encodePoint("foo baz", 1500000001000, -2, map[string]string{"env": "prod"}),
+	} {
+		b.varint(uint64(len(p)))
+		b.Write(p)
+	}
+
+	points, err := Decode(b.Bytes())
+	if err != nil || len(points) != 2 {
+		t.Fatalf("Decode: unexpected error or number of points: %v %d", err, len(points))
+	}
+	if p := points[0]; p.Name != "foo.bar" || p.Value != 1.5 || !p.Time.Equal(time.Unix(1500000000, 123000000)) {
+		t.Errorf("Decode: unexpected point: %#v", p)
+	}
+	ident, err := points[1].Ident()
+	if err != nil || ident["name"] != "foo_baz" || ident["env"] != "prod" || points[1].Value != -2 {
+		t.Errorf("Decode: unexpected ident: %v %v", ident, err)
+	}
+
+	// truncated, the first point is still returned
+	if points, err := Decode(b.Bytes()[:b.Len()-3]); err == nil || len(points) != 1 {
+		t.Errorf("Decode: expected an error and 1 point for a truncated batch: %v %d", err, len(points))
+	}
+	if _, err := (&Point{Name: "foo", Tags: map[string]string{"name": "x"}}).Ident(); err == nil {
+		t.Errorf("Ident: expected an error for a name tag")
+	}
+	if _, err := (&Point{Name: ""}).Ident(); err == nil {
+		t.Errorf("Ident: expected an error for an empty name")
+	}
+}
+
+func Test_DecodeSnappy(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	for expect, src := range map[string][]byte{
+		"abcabcabcabc": {12, 0x08, 'a', 'b', 'c', 0x15, 0x03},
+		"abcdabcd":     {8, 0x0c, 'a', 'b', 'c', 'd', 0x0e, 0x04, 0x00},
+		long:           append([]byte{100, 0xf0, 99}, long...),
+		"":             {0},
+	} {
+		dst, err := DecodeSnappy(src, 1024)
+		if err != nil || string(dst) != expect {
+			t.Errorf("DecodeSnappy(%v): %q %v, expected %q", src, dst, err, expect)
+		}
+	}
+	for _, src := range [][]byte{
+		{12, 0x08, 'a', 'b', 'c'},             // too short
+		{12, 0x08, 'a', 'b', 'c', 0x15, 0x04}, // offset past the start
+		{3, 0x0c, 'a', 'b'},                   // truncated literal
+		{0xff, 0xff, 0xff, 0xff, 0x0f},        // larger than max
+	} {
+		if _, err := DecodeSnappy(src, 1024); err == nil {
+			t.Errorf("DecodeSnappy(%v): expected an error", src)
+		}
+	}
+}
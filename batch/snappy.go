@@ -0,0 +1,93 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package batch
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// DecodeSnappy decompresses the snappy block format, which is what
+// e.g. the Prometheus remote write protocol uses, as opposed to the
+// framed (streaming) one. It is an error if the decompressed length
+// would be more than max.
+func DecodeSnappy(src []byte, max int) ([]byte, error) {
+	l, n := binary.Uvarint(src)
+	if n <= 0 || l > uint64(max) {
+		return nil, fmt.Errorf("snappy: invalid or too large decompressed length")
+	}
+	src = src[n:]
+	dst := make([]byte, 0, l)
+
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 3 {
+		case 0: // literal
+			length = int(tag>>2) + 1
+			src = src[1:]
+			if length > 60 { // the length is in the next 1 to 4 bytes
+				nb := length - 60
+				if len(src) < nb {
+					return nil, fmt.Errorf("snappy: truncated literal")
+				}
+				length = 0
+				for i := 0; i < nb; i++ {
+					length |= int(src[i]) << (8 * uint(i))
+				}
+				length++
+				src = src[nb:]
+			}
+			if length <= 0 || length > len(src) || len(dst)+length > int(l) {
+				return nil, fmt.Errorf("snappy: invalid literal length")
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1: // copy, 1 byte offset
+			if len(src) < 2 {
+				return nil, fmt.Errorf("snappy: truncated copy")
+			}
+			length = 4 + int(tag>>2)&7
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case 2: // copy, 2 byte offset
+			if len(src) < 3 {
+				return nil, fmt.Errorf("snappy: truncated copy")
+			}
+			length = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3: // copy, 4 byte offset
+			if len(src) < 5 {
+				return nil, fmt.Errorf("snappy: truncated copy")
+			}
+			length = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+length > int(l) {
+			return nil, fmt.Errorf("snappy: invalid copy")
+		}
+		for i := 0; i < length; i++ { // may overlap
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if len(dst) != int(l) {
+		return nil, fmt.Errorf("snappy: decompressed length %d, expected %d", len(dst), l)
+	}
+	return dst, nil
+}
@@ -0,0 +1,73 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/hashicorp/memberlist"
+)
+
+const authTagLen = sha256.Size
+
+// authTag is the HMAC of a node name with the join token, which every
+// node has in its metadata and the others check (see authenticate).
+// It proves that the node knows the token, but not that it is the
+// node it claims to be, anyone who can see the gossip can use it, so
+// on an untrusted network the gossip should be encrypted as well.
+// Without a token it is all zeros.
+func (c *Cluster) authTag(name string) []byte {
+	if c.joinToken == nil {
+		return make([]byte, authTagLen)
+	}
+	mac := hmac.New(sha256.New, c.joinToken)
+	mac.Write([]byte(name))
+	return mac.Sum(nil)
+}
+
+// authenticate checks the authTag of a node.
+func (c *Cluster) authenticate(n *memberlist.Node) error {
+	if c.joinToken == nil {
+		return nil
+	}
+	md, err := (&Node{Node: n}).extractMeta()
+	if err != nil {
+		return fmt.Errorf("rejecting node %s: %v", n.Name, err)
+	}
+	if !hmac.Equal(md.auth, c.authTag(n.Name)) {
+		return fmt.Errorf("rejecting node %s: not authenticated, is its cluster join token different?", n.Name)
+	}
+	return nil
+}
+
+// memberlist.AliveDelegate interface, the nodes which are not
+// authenticated are ignored.
+func (c *Cluster) NotifyAlive(n *memberlist.Node) error {
+	return c.authenticate(n)
+}
+
+// memberlist.MergeDelegate interface, a join (either way) with nodes
+// any of which is not authenticated is rejected.
+func (c *Cluster) NotifyMerge(peers []*memberlist.Node) error {
+	for _, n := range peers {
+		if err := c.authenticate(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
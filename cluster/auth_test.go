@@ -0,0 +1,55 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func TestCluster_authenticate(t *testing.T) {
+	node := func(token string) *memberlist.Node {
+		c := &Cluster{name: "foo"}
+		if token != "" {
+			c.joinToken = []byte(token)
+		}
+		c.saveMeta(&nodeMeta{ready: true})
+		return &memberlist.Node{Name: "foo", Meta: c.meta}
+	}
+	c := &Cluster{name: "local", joinToken: []byte("secret")}
+
+	if err := c.NotifyAlive(node("secret")); err != nil {
+		t.Errorf("NotifyAlive: a node with the same token should be accepted: %v", err)
+	}
+	for _, token := range []string{"", "wrong"} {
+		if err := c.NotifyAlive(node(token)); err == nil {
+			t.Errorf("NotifyAlive: a node with token %q should be rejected", token)
+		}
+	}
+	if err := c.NotifyAlive(&memberlist.Node{Name: "foo"}); err == nil {
+		t.Errorf("NotifyAlive: a node without metadata should be rejected")
+	}
+	renamed := node("secret")
+	renamed.Name = "bar"
+	if err := c.NotifyMerge([]*memberlist.Node{node("secret"), renamed}); err == nil {
+		t.Errorf("NotifyMerge: a node with the tag of another should be rejected")
+	}
+
+	if err := (&Cluster{}).NotifyAlive(node("")); err != nil {
+		t.Errorf("NotifyAlive: without a token any node should be accepted: %v", err)
+	}
+}
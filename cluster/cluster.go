@@ -36,6 +36,7 @@ package cluster
 import (
 	"bytes"
 	"compress/flate"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/gob"
 	"fmt"
@@ -63,6 +64,10 @@ func init() {
 
 const updateNodeTO = 30 * time.Second
 
+// How long after a node is dead its name can be taken by a node at
+// another address.
+const deadNodeReclaimTime = 30 * time.Second
+
 type ddEntry struct {
 	dd    DistDatum
 	nodes []*Node
@@ -79,10 +84,25 @@ type Cluster struct {
 	dds       map[string]*ddEntry
 	snd, rcv  chan *Msg // dds messages
 	copies    int
+	ring      *hashRing // as of the last LoadDistData or Transition
+	ts        transitionState
 	rpcPort   int
 	rpc       net.Listener
+	tlsConfig *tls.Config // of rpc connections, nil is plain TCP
+	joinToken []byte      // nil is no authentication
+	name      string      // of the local node
 	joined    bool
 	ncache    map[*memberlist.Node]*Node
+
+	sqMu          sync.Mutex
+	sendQs        map[string]*sendQueue // by node name
+	sendQueueSize int
+
+	hMu            sync.RWMutex
+	handlers       map[string]RequestHandler // see HandleRequests
+	streamHandlers map[string]StreamHandler  // see HandleStreams
+	streams        map[int64]*stream         // open, by id
+	streamSeq      int64
 }
 
 // NewCluster creates a new Cluster with reasonable defaults.
@@ -97,17 +117,32 @@ func NewCluster() (*Cluster, error) {
 // container where it is impossible to figure out the outside IP
 // addresses and the hostname can be the same).
 func NewClusterBind(baddr string, bport int, aaddr string, aport int, rpcport int, name string) (*Cluster, error) {
+	return NewClusterEncrypted(baddr, bport, aaddr, aport, rpcport, name, nil)
+}
+
+// NewClusterEncrypted is NewClusterBind with the traffic between
+// nodes encrypted as per enc, nil is no encryption. All nodes must
+// use the same.
+func NewClusterEncrypted(baddr string, bport int, aaddr string, aport int, rpcport int, name string, enc *Encryption) (*Cluster, error) {
 	c := &Cluster{
 		rcvChs:    make([]chan *Msg, 0),
 		chgNotify: make([]chan bool, 0),
 		dds:       make(map[string]*ddEntry),
 		copies:    1,
 		ncache:    make(map[*memberlist.Node]*Node),
+		sendQs:    make(map[string]*sendQueue),
+		handlers:  make(map[string]RequestHandler),
+
+		streamHandlers: make(map[string]StreamHandler),
+		streams:        make(map[int64]*stream),
 	}
 	cfg := memberlist.DefaultLANConfig()
 	cfg.TCPTimeout = 30 * time.Second
 	cfg.SuspicionMult = 6
 	cfg.PushPullInterval = 15 * time.Second
+	// A node restarted with a different address, e.g. a Kubernetes
+	// pod, can rejoin under its name once the old one is dead.
+	cfg.DeadNodeReclaimTime = deadNodeReclaimTime
 
 	if baddr != "" {
 		cfg.BindAddr = baddr
@@ -125,13 +160,26 @@ func NewClusterBind(baddr string, bport int, aaddr string, aport int, rpcport in
 		cfg.Name = name
 	}
 	cfg.LogOutput = &logger{}
+	if enc != nil {
+		if err := enc.check(); err != nil {
+			return nil, err
+		}
+		cfg.SecretKey = enc.SecretKey
+		c.tlsConfig = enc.TLSConfig
+		if enc.JoinToken != nil {
+			c.joinToken = enc.JoinToken
+			cfg.Alive, cfg.Merge = c, c
+		}
+	}
 	cfg.Delegate, cfg.Events = c, c
+	// The metadata must be there (and authenticated) from the start
+	c.name = cfg.Name
+	md := &nodeMeta{sortBy: startTime.UnixNano()}
+	c.saveMeta(md)
 	var err error
 	if c.Memberlist, err = memberlist.Create(cfg); err != nil {
 		return nil, err
 	}
-	md := &nodeMeta{sortBy: startTime.UnixNano()}
-	c.saveMeta(md)
 	if err = c.UpdateNode(updateNodeTO); err != nil {
 		log.Printf("NewClusterBind(): UpdateNode() failed: %v", err)
 		return nil, err
@@ -150,6 +198,9 @@ func NewClusterBind(baddr string, bport int, aaddr string, aport int, rpcport in
 		c.Memberlist.Shutdown()
 		return nil, err
 	}
+	if c.tlsConfig != nil {
+		c.rpc = tls.NewListener(c.rpc, c.tlsConfig)
+	}
 
 	// Serve RPC Requests
 	go func() {
@@ -178,8 +229,9 @@ func (rpc *ClusterRPC) Message(msg Msg, reply *Msg) error {
 }
 
 // Set the number of copies of DistDatims that the Cluster will
-// keep. The default is 1. You can only set it while the cluster is
-// empty.
+// keep, i.e. the number of nodes NodesForDistDatum returns, fewer if
+// there are not as many. The default is 1. You can only set it while
+// the cluster is empty.
 func (c *Cluster) Copies(n ...int) int {
 	if len(n) > 0 && len(c.dds) == 0 {
 		// only allow setting copies when the cluster is still empty
@@ -204,19 +256,6 @@ func (c *Cluster) readyNodes() ([]*Node, error) {
 	return readyNodes, nil
 }
 
-// selectNodes uses a simple module to assign a node given an integer
-// id.
-func selectNodes(nodes []*Node, id int64, n int) []*Node {
-	if len(nodes) == 0 {
-		return nil
-	}
-	result := make([]*Node, n)
-	for i := 0; i < n; i++ {
-		result[i] = nodes[(int(id)+i)%len(nodes)]
-	}
-	return result
-}
-
 // LoadDistData will trigger a load of DistDatum's. Its argument is a
 // function which performs the actual load and returns the list, while
 // also providing the data to the application in whatever way is
@@ -241,9 +280,11 @@ func (c *Cluster) LoadDistData(f func() ([]DistDatum, error)) error {
 		return err
 	}
 
+	ring := newHashRing(readyNodes)
+	c.ring = ring
 	for _, dd := range dds {
 		key := fmt.Sprintf("%s:%d", dd.Type(), dd.Id())
-		c.dds[key] = &ddEntry{dd: dd, nodes: selectNodes(readyNodes, dd.Id(), c.copies)}
+		c.dds[key] = &ddEntry{dd: dd, nodes: ring.selectNodes(dd.Id(), c.copies)}
 	}
 
 	return nil
@@ -321,7 +362,9 @@ func (sn sortableNodes) Swap(i, j int) {
 // exact same order because that is what determines the internal
 // message id and the channel to which it will be passed. The message
 // is sent to the destination specified in Msg.Dst. Messages are
-// compressed using flate.
+// compressed using flate. Every destination node has its own queue
+// (see SetSendQueueSize and SendQueueStats), a message is dropped if
+// the queue of its destination is full.
 func (c *Cluster) RegisterMsgType() (snd, rcv chan *Msg) {
 
 	snd, rcv = make(chan *Msg, 128), make(chan *Msg, 128)
@@ -338,25 +381,10 @@ func (c *Cluster) RegisterMsgType() (snd, rcv chan *Msg) {
 				continue
 			}
 
-			if msg.Dst.rpc == nil {
-				addr := fmt.Sprintf("%s:%d", msg.Dst.Addr, c.rpcPort)
-				log.Printf("Cluster: establishing RPC connection to node %s via %s", msg.Dst.Name(), addr)
-				conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
-				if err != nil {
-					log.Printf("Cluster: cannot establish connection to %s: %v, dropping this message.", addr, err)
-					continue
-				}
-				msg.Dst.rpc = rpc.NewClient(conn)
-			}
-
 			msg.Src = c.LocalNode()
 			msg.Id = id
 
-			var resp Msg
-			if err := msg.Dst.rpc.Call("ClusterRPC.Message", msg, &resp); err != nil {
-				log.Printf("Cluster: error sending message to %s", msg.Dst.Name())
-				msg.Dst.rpc = nil
-			}
+			c.sendQueue(msg.Dst).enqueue(msg)
 		}
 	}(id)
 
@@ -376,10 +404,17 @@ func (c *Cluster) NotifyClusterChanges() chan bool {
 type nodeMeta struct {
 	ready  bool
 	sortBy int64
+	weight int64  // thousandths, 0 is the default of 1
+	auth   []byte // see authTag
 	user   []byte
 }
 
-const minMdLen = 1 + binary.MaxVarintLen64
+const (
+	// The metadata of nodes which predate weights, without user data.
+	noWeightMdLen = 1 + binary.MaxVarintLen64
+	authOffset    = noWeightMdLen + binary.MaxVarintLen64
+	minMdLen      = authOffset + authTagLen
+)
 
 func (c *Cluster) extractMeta() (*nodeMeta, error) {
 	return c.LocalNode().extractMeta()
@@ -393,6 +428,8 @@ func (c *Cluster) saveMeta(md *nodeMeta) {
 		meta[0] = 0
 	}
 	binary.PutVarint(meta[1:], md.sortBy)
+	binary.PutVarint(meta[noWeightMdLen:], md.weight)
+	copy(meta[authOffset:], c.authTag(c.name))
 	meta = append(meta, md.user...)
 	c.meta = meta
 }
@@ -484,7 +521,6 @@ func (c *Cluster) notifyAll() {
 
 type Node struct {
 	*memberlist.Node
-	rpc           *rpc.Client
 	sanitizedAddr string
 }
 
@@ -497,18 +533,29 @@ func (n *Node) SanitizedAddr() string {
 
 func (n *Node) extractMeta() (*nodeMeta, error) {
 	md := &nodeMeta{}
-	if len(n.Node.Meta) < minMdLen {
+	meta := n.Node.Meta
+	if len(meta) == noWeightMdLen {
+		// An older node, it has the default weight and no auth
+		meta = append(meta[:len(meta):len(meta)], make([]byte, minMdLen-noWeightMdLen)...)
+	}
+	if len(meta) < minMdLen {
 		return nil, fmt.Errorf("Not enough bytes to extract metadata")
 	}
 	// ready
-	md.ready = n.Node.Meta[0] == 1
+	md.ready = meta[0] == 1
 	// sortBy
 	var err error
-	if md.sortBy, err = binary.ReadVarint(bytes.NewReader(n.Node.Meta[1:])); err != nil {
+	if md.sortBy, err = binary.ReadVarint(bytes.NewReader(meta[1:])); err != nil {
 		return nil, fmt.Errorf("extractMeta(): sortBy: %v", err)
 	}
+	// weight
+	if md.weight, err = binary.ReadVarint(bytes.NewReader(meta[noWeightMdLen:])); err != nil {
+		return nil, fmt.Errorf("extractMeta(): weight: %v", err)
+	}
+	// auth
+	md.auth = meta[authOffset:minMdLen]
 	// user
-	md.user = n.Node.Meta[minMdLen:]
+	md.user = meta[minMdLen:]
 	return md, nil
 }
 
@@ -528,6 +575,28 @@ func (c *Cluster) Ready(status bool) error {
 	return nil
 }
 
+// SetWeight sets the capacity of this node relative to the others,
+// in proportion to which DistDatums are placed on it (see hashRing),
+// and broadcasts it to the cluster. The default is 1. It is best set
+// before the node is Ready, a change only takes effect at the next
+// Transition.
+func (c *Cluster) SetWeight(w float64) error {
+	if w <= 0 {
+		return fmt.Errorf("SetWeight(): the weight must be positive: %v", w)
+	}
+	md, err := c.extractMeta()
+	if err != nil {
+		return err
+	}
+	md.weight = int64(w*weightScale + 0.5)
+	c.saveMeta(md)
+	if err = c.UpdateNode(updateNodeTO); err != nil {
+		log.Printf("SetWeight(): UpdateNode() failed: %v", err)
+		return err
+	}
+	return nil
+}
+
 func (c *Cluster) Shutdown() error {
 	//c.rpc.Close() // seems like Closing it only causes errors
 	return c.Memberlist.Shutdown()
@@ -542,6 +611,16 @@ func (n *Node) Ready() bool {
 	return md.ready
 }
 
+// Weight returns the capacity of a node relative to the others, see
+// SetWeight, 1 unless set.
+func (n *Node) Weight() float64 {
+	md, err := n.extractMeta()
+	if err != nil || md.weight <= 0 {
+		return 1
+	}
+	return float64(md.weight) / weightScale
+}
+
 // Msg is the structure that should be passed to channels returned by
 // c.RegisterMsgType().
 type Msg struct {
@@ -599,8 +678,8 @@ func (l *logger) Write(b []byte) (int, error) {
 // node.
 type DistDatum interface {
 	// Id returns an integer that uniquely identifies this datum for
-	// this type. Datum -> node designation is determined by id %
-	// numNodes, which means id distribution matters.
+	// this type. Datum -> node designation is determined by the hash
+	// of the id on a consistent hash ring of the nodes, see hashRing.
 	Id() int64
 
 	// Type returns a string that identifies the type. The value
@@ -641,6 +720,18 @@ func (c *Cluster) NodesForDistDatum(dd DistDatum) []*Node {
 	return nil
 }
 
+// NodesForId returns the nodes a DistDatum with this id is (or would
+// be) assigned to, without it having to be loaded, see LoadDistData.
+// It is nil before the first LoadDistData or Transition.
+func (c *Cluster) NodesForId(id int64) []*Node {
+	c.RLock()
+	defer c.RUnlock()
+	if c.ring == nil {
+		return nil
+	}
+	return c.ring.selectNodes(id, c.copies)
+}
+
 func (c *Cluster) List() map[string]*ddEntry {
 	return c.dds
 }
@@ -660,10 +751,12 @@ func (dde *ddEntry) DD() DistDatum {
 // changes. Transitions should be triggered by user-land after
 // receiving a cluster change event from a channel returned by
 // NotifyClusterChanges(). The transition will call Relinquish() on
-// all DistDatums that are transferring to other nodes and wait for
-// confirmation of Relinquish() from other nodes for DistDatums
-// transferring to this node. Generally a node should be buffering all
-// the data it receives during a transition.
+// all DistDatums that are transferring to other nodes (at the rate of
+// SetTransitionRate) and wait for confirmation of Relinquish() from
+// other nodes for DistDatums transferring to this node, for up to
+// timeout since the last one arrived. Generally a node should be
+// buffering all the data it receives during a transition. The
+// progress is available from TransitionStatus.
 func (c *Cluster) Transition(timeout time.Duration) error {
 	defer func() {
 		if e := recover(); e != nil {
@@ -682,6 +775,16 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 		return err
 	}
 
+	ring := newHashRing(readyNodes)
+	c.ring = ring
+
+	c.ts.update(func(st *TransitionStatus) {
+		*st = TransitionStatus{Running: true, Started: time.Now()}
+	})
+	defer c.ts.update(func(st *TransitionStatus) {
+		st.Running, st.Finished = false, time.Now()
+	})
+
 	var waitDdsLock sync.RWMutex
 	waitDds := make(map[string]DistDatum)
 	relCnt := 0
@@ -697,7 +800,7 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 			// "lead" responsible for saving the data. What happens
 			// with the rest is up to the userland to deal with.
 			var newNode, oldNode *Node
-			newNodes := selectNodes(readyNodes, dde.dd.Id(), c.copies)
+			newNodes := ring.selectNodes(dde.dd.Id(), c.copies)
 			if len(newNodes) > 0 {
 				newNode = newNodes[0]
 			}
@@ -707,6 +810,8 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 			if newNode == nil || oldNode.Name() != newNode.Name() {
 				ln := c.LocalNode()
 				if ln.Name() == oldNode.Name() { // we are the ex-node
+					c.ts.update(func(st *TransitionStatus) { st.Relinquishing++ })
+					c.ts.throttle()
 					if newNode != nil && debug {
 						log.Printf("Transition(): Id %s:%d (%s) is moving away to node %s", dde.dd.Type(), dde.dd.Id(), dde.dd.GetName(), newNode.Name())
 					}
@@ -723,6 +828,15 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 						c.snd <- m
 					}
 
+					var size int64
+					if s, ok := dde.dd.(DistDatumSizer); ok {
+						size = s.Size()
+					}
+					c.ts.update(func(st *TransitionStatus) {
+						st.Relinquished++
+						st.RelinquishedBytes += size
+					})
+
 					waitDdsLock.Lock()
 					relCnt++
 					if relCnt%1000 == 0 {
@@ -738,6 +852,7 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 					waitDdsLock.Lock()
 					if oldNode.Name() != "<nil>" {
 						waitDds[fmt.Sprintf("%s:%d", dde.dd.Type(), dde.dd.Id())] = dde.dd
+						c.ts.update(func(st *TransitionStatus) { st.Acquiring++ })
 					}
 					waitDdsLock.Unlock()
 				}
@@ -754,13 +869,12 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 	go func() {
 		defer wg.Done()
 
-		log.Printf("Transition(): Waiting on %d relinquish messages... (timeout %v) %v", len(waitDds), timeout, waitDds)
+		log.Printf("Transition(): Waiting on %d relinquish messages... (timeout %v since the last one) %v", len(waitDds), timeout, waitDds)
 
-		tmout := make(chan bool, 1)
-		go func() {
-			time.Sleep(timeout)
-			tmout <- true
-		}()
+		// The timeout is since the last message, as relinquishing
+		// may be throttled, see SetTransitionRate
+		tmout := time.NewTimer(timeout)
+		defer tmout.Stop()
 
 		for {
 			if len(waitDds) == 0 {
@@ -770,8 +884,9 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 			var m *Msg
 			select {
 			case m = <-c.rcv:
-			case <-tmout:
+			case <-tmout.C:
 				log.Printf("Transition(): WARNING: Relinquish wait timeout! Continuing. Some data is likely lost.")
+				c.ts.update(func(st *TransitionStatus) { st.TimedOut = len(waitDds) })
 				// We should still call Acquire on the ones we've been waiting for as we are ultimately taking them over
 				for _, dd := range waitDds {
 					log.Printf("Transition(): Calling Acquire for %s:%d (%s).", dd.Type(), dd.Id(), dd.GetName())
@@ -782,6 +897,8 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 				return
 			}
 
+			tmout.Reset(timeout)
+
 			key := string(m.Body)
 			log.Printf("Transition(): Got relinquish message for %s from %s.", key, m.Src.Name())
 			if waitDds[key] != nil {
@@ -790,6 +907,7 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 				if err := dd.Acquire(); err != nil {
 					log.Printf("Transition(): Warning: Acquire() failed for id %s:%d (%s) with: %v", dd.Type(), dd.Id(), dd.GetName(), err)
 				}
+				c.ts.update(func(st *TransitionStatus) { st.Acquired++ })
 			}
 			waitDdsLock.Lock()
 			delete(waitDds, key)
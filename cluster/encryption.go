@@ -0,0 +1,57 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Encryption is how the traffic between the nodes of a cluster is
+// encrypted, so that it can run across untrusted networks.
+type Encryption struct {
+	// SecretKey is the AES key, of 16, 24 or 32 bytes, with which
+	// memberlist encrypts the gossip. Nil is no encryption.
+	SecretKey []byte
+	// TLSConfig is used by the RPC connections, i.e. forwarded
+	// messages, requests and streams, as both the server and the
+	// client. It should verify the certificates of the peers
+	// (RootCAs, and ClientCAs with ClientAuth). Nil is plain TCP.
+	TLSConfig *tls.Config
+	// JoinToken is a secret shared by the nodes, those which do not
+	// know it cannot join (see authTag). Nil is no authentication.
+	JoinToken []byte
+}
+
+func (enc *Encryption) check() error {
+	switch len(enc.SecretKey) {
+	case 0, 16, 24, 32:
+	default:
+		return fmt.Errorf("the secret key must be of 16, 24 or 32 bytes, not %d", len(enc.SecretKey))
+	}
+	return nil
+}
+
+// dial connects to the RPC of another node, over TLS if the cluster
+// has a TLSConfig.
+func (c *Cluster) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	if c.tlsConfig == nil {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, c.tlsConfig)
+}
@@ -0,0 +1,103 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// testTLSConfig is the config of a node with a self-signed
+// certificate for 127.0.0.1 which it also requires of its peers.
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+func TestCluster_RequestTLS(t *testing.T) {
+	c := &Cluster{handlers: make(map[string]RequestHandler), tlsConfig: testTLSConfig(t)}
+	c.HandleRequests("echo", func(req *Msg) (interface{}, error) {
+		var s string
+		return s, req.Decode(&s)
+	})
+
+	srv := rpc.NewServer()
+	srv.Register(&ClusterRPC{c})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Accept(tls.NewListener(l, c.tlsConfig))
+	c.rpcPort = l.Addr().(*net.TCPAddr).Port
+	dst := &Node{Node: &memberlist.Node{Name: "dst", Addr: net.ParseIP("127.0.0.1")}}
+
+	var reply string
+	if err := c.Request(dst, "echo", "hello", &reply, time.Second); err != nil || reply != "hello" {
+		t.Errorf("Request: unexpected over TLS %v %q", err, reply)
+	}
+
+	plain := &Cluster{rpcPort: c.rpcPort}
+	if err := plain.Request(dst, "echo", "hello", &reply, time.Second); err == nil {
+		t.Errorf("Request: expected an error without TLS")
+	}
+}
+
+func TestEncryption_check(t *testing.T) {
+	for n, ok := range map[int]bool{0: true, 16: true, 24: true, 32: true, 8: false, 33: false} {
+		if err := (&Encryption{SecretKey: make([]byte, n)}).check(); (err == nil) != ok {
+			t.Errorf("check: unexpected %v for a key of %d bytes", err, n)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net/rpc"
+	"time"
+)
+
+// RequestHandler answers a request sent with Cluster.Request, the
+// reply must be gob-encodable.
+type RequestHandler func(req *Msg) (interface{}, error)
+
+// Request is the RPC argument of a request, see Cluster.Request.
+type Request struct {
+	Handler string
+	Body    []byte
+}
+
+// HandleRequests registers the handler of the requests to name, see
+// Request. Unlike messages, requests are answered, and so are
+// suitable for e.g. queries.
+func (c *Cluster) HandleRequests(name string, h RequestHandler) {
+	c.hMu.Lock()
+	defer c.hMu.Unlock()
+	c.handlers[name] = h
+}
+
+// Request sends a gob-encodable payload to the handler registered as
+// name on the dst node (see HandleRequests) and decodes its reply
+// into reply. Requests do not go through the send queue of the node,
+// each has its own connection and the timeout applies to all of it.
+func (c *Cluster) Request(dst *Node, name string, payload, reply interface{}, timeout time.Duration) error {
+	msg, err := NewMsg(dst, payload)
+	if err != nil {
+		return err
+	}
+	conn, err := c.dial(fmt.Sprintf("%s:%d", dst.Addr, c.rpcPort), timeout)
+	if err != nil {
+		return fmt.Errorf("Request(): cannot connect to node %s: %v", dst.Name(), err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	var body []byte
+	if err := client.Call("ClusterRPC.Request", Request{Handler: name, Body: msg.Body}, &body); err != nil {
+		return fmt.Errorf("Request(): %s to node %s: %v", name, dst.Name(), err)
+	}
+	return gob.NewDecoder(bytes.NewReader(body)).Decode(reply)
+}
+
+// Request answers a request with the handler it is for.
+func (rpc *ClusterRPC) Request(req Request, reply *[]byte) error {
+	rpc.c.hMu.RLock()
+	h := rpc.c.handlers[req.Handler]
+	rpc.c.hMu.RUnlock()
+	if h == nil {
+		return fmt.Errorf("no handler for %q requests", req.Handler)
+	}
+	result, err := h(&Msg{Body: req.Body})
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(result); err != nil {
+		return err
+	}
+	*reply = buf.Bytes()
+	return nil
+}
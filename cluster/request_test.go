@@ -0,0 +1,116 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// serveTestRPC serves the RPC of c on a local port and returns a node
+// to send requests to.
+func serveTestRPC(t *testing.T, c *Cluster) (*Node, func()) {
+	srv := rpc.NewServer()
+	srv.Register(&ClusterRPC{c})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Accept(l)
+	c.rpcPort = l.Addr().(*net.TCPAddr).Port
+	return &Node{Node: &memberlist.Node{Name: "dst", Addr: net.ParseIP("127.0.0.1")}}, func() { l.Close() }
+}
+
+func Test_Request(t *testing.T) {
+	c := &Cluster{handlers: make(map[string]RequestHandler)}
+	c.HandleRequests("double", func(req *Msg) (interface{}, error) {
+		var n int
+		if err := req.Decode(&n); err != nil {
+			return nil, err
+		}
+		return n * 2, nil
+	})
+	dst, stop := serveTestRPC(t, c)
+	defer stop()
+
+	var reply int
+	if err := c.Request(dst, "double", 21, &reply, time.Second); err != nil || reply != 42 {
+		t.Errorf("Request: unexpected %v %d", err, reply)
+	}
+	if err := c.Request(dst, "bogus", 21, &reply, time.Second); err == nil || !strings.Contains(err.Error(), "no handler") {
+		t.Errorf("Request: expected a no handler error, got %v", err)
+	}
+}
+
+func Test_RequestStream(t *testing.T) {
+	c := &Cluster{streamHandlers: make(map[string]StreamHandler), streams: make(map[int64]*stream)}
+	stopped := make(chan error, 1)
+	c.HandleStreams("count", func(req *Msg, send func(interface{}) error) error {
+		var n int
+		if err := req.Decode(&n); err != nil {
+			return err
+		}
+		for i := 1; i <= n; i++ {
+			if err := send(i); err != nil {
+				stopped <- err
+				return err
+			}
+		}
+		if n == 0 {
+			return fmt.Errorf("nothing to count")
+		}
+		return nil
+	})
+	dst, stop := serveTestRPC(t, c)
+	defer stop()
+
+	sum := 0
+	recv := func(chunk *Msg) error {
+		var i int
+		if err := chunk.Decode(&i); err != nil {
+			return err
+		}
+		if sum += i; i == 500 {
+			return fmt.Errorf("enough")
+		}
+		return nil
+	}
+	if err := c.RequestStream(dst, "count", 100, recv, time.Second); err != nil || sum != 5050 {
+		t.Errorf("RequestStream: unexpected %v %d", err, sum)
+	}
+	if err := c.RequestStream(dst, "count", 0, recv, time.Second); err == nil || !strings.Contains(err.Error(), "nothing to count") {
+		t.Errorf("RequestStream: expected the error of the handler, got %v", err)
+	}
+
+	// An error of recv stops the handler
+	if err := c.RequestStream(dst, "count", 1000000, recv, time.Second); err == nil || err.Error() != "enough" {
+		t.Errorf("RequestStream: expected the error of recv, got %v", err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Errorf("RequestStream: the handler was not stopped")
+	}
+	if len(c.streams) != 0 {
+		t.Errorf("RequestStream: %d streams left open", len(c.streams))
+	}
+}
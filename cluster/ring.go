@@ -0,0 +1,108 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// The number of points a node of weight 1 has on the ring. More
+// spread the DistDatums more evenly at the cost of a larger ring.
+const virtualNodes = 128
+
+// Node weights are kept in the metadata in thousandths.
+const weightScale = 1000
+
+// hashRing is a consistent hash ring of nodes, each of which is
+// there virtualNodes times its Weight, so that a node gets a share of
+// the DistDatums proportional to its weight. A DistDatum belongs to
+// the first node clockwise of the hash of its id, and so adding or
+// removing one of N nodes moves only about 1/N of the DistDatums,
+// those between the points of that node and their predecessors.
+type hashRing struct {
+	points []uint64 // sorted
+	nodes  []*Node  // of the points
+	count  int      // distinct nodes
+}
+
+func newHashRing(nodes []*Node) *hashRing {
+	r := &hashRing{
+		points: make([]uint64, 0, len(nodes)*virtualNodes),
+		count:  len(nodes),
+	}
+	byPoint := make(map[uint64]*Node, len(nodes)*virtualNodes)
+	for _, node := range nodes {
+		n := int(virtualNodes*node.Weight() + 0.5)
+		if n < 1 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			p := ringHash([]byte(node.Name() + "#" + strconv.Itoa(i)))
+			if other, ok := byPoint[p]; !ok {
+				r.points = append(r.points, p)
+			} else if other.Name() < node.Name() {
+				continue // a collision, the same node wins on every node
+			}
+			byPoint[p] = node
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	r.nodes = make([]*Node, len(r.points))
+	for i, p := range r.points {
+		r.nodes[i] = byPoint[p]
+	}
+	return r
+}
+
+// ringHash is FNV-1a, the high bits of which hardly vary with the
+// last bytes (e.g. those of a small id), finalized as in MurmurHash3.
+func ringHash(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// selectNodes returns n nodes for an id, the distinct nodes
+// clockwise of its hash, or all of them if there are not as many.
+func (r *hashRing) selectNodes(id int64, n int) []*Node {
+	if len(r.points) == 0 {
+		return nil
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(id))
+	h := ringHash(b[:])
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+
+	result := make([]*Node, 0, n)
+	seen := make(map[*Node]bool, n)
+	for i := 0; i < len(r.points) && len(result) < n && len(result) < r.count; i++ {
+		node := r.nodes[(start+i)%len(r.points)]
+		if !seen[node] {
+			seen[node] = true
+			result = append(result, node)
+		}
+	}
+	return result
+}
@@ -0,0 +1,92 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func ringNodes(names ...string) []*Node {
+	nodes := make([]*Node, len(names))
+	for i, name := range names {
+		nodes[i] = &Node{Node: &memberlist.Node{Name: name}}
+	}
+	return nodes
+}
+
+func Test_hashRing(t *testing.T) {
+	if nodes := newHashRing(nil).selectNodes(1, 1); nodes != nil {
+		t.Errorf("selectNodes: expected nil of an empty ring, got %v", nodes)
+	}
+
+	const ids = 10000
+	nodes := ringNodes("a", "b", "c", "d")
+	ring := newHashRing(nodes)
+	before := make(map[int64]string, ids)
+	counts := make(map[string]int)
+	for id := int64(0); id < ids; id++ {
+		before[id] = ring.selectNodes(id, 1)[0].Name()
+		counts[before[id]]++
+	}
+	for _, node := range nodes {
+		if n := counts[node.Name()]; n < ids/4*2/3 || n > ids/4*4/3 {
+			t.Errorf("selectNodes: node %s has %d of %d ids, expected about a quarter", node.Name(), n, ids)
+		}
+	}
+
+	// Adding a node moves (only) about a fifth, all of them to it
+	ring = newHashRing(append(nodes, ringNodes("e")...))
+	moved := 0
+	for id := int64(0); id < ids; id++ {
+		if name := ring.selectNodes(id, 1)[0].Name(); name != before[id] {
+			if name != "e" {
+				t.Fatalf("selectNodes: id %d moved from %s to %s, not the new node", id, before[id], name)
+			}
+			moved++
+		}
+	}
+	if moved < ids/5/2 || moved > ids/5*2 {
+		t.Errorf("selectNodes: %d of %d ids moved to a fifth node", moved, ids)
+	}
+
+	// Copies are distinct nodes, all of them if there are too few
+	copies := newHashRing(ringNodes("a", "b")).selectNodes(42, 3)
+	if len(copies) != 2 || copies[0].Name() == copies[1].Name() {
+		t.Errorf("selectNodes: unexpected copies %v", copies)
+	}
+}
+
+func Test_hashRing_weights(t *testing.T) {
+	nodes := ringNodes("a", "b")
+	c := &Cluster{}
+	c.saveMeta(&nodeMeta{weight: 3 * weightScale})
+	nodes[1].Node.Meta = c.meta
+	if nodes[0].Weight() != 1 || nodes[1].Weight() != 3 {
+		t.Errorf("Weight: expected 1 and 3, got %v %v", nodes[0].Weight(), nodes[1].Weight())
+	}
+
+	const ids = 10000
+	ring := newHashRing(nodes)
+	counts := make(map[string]int)
+	for id := int64(0); id < ids; id++ {
+		counts[ring.selectNodes(id, 1)[0].Name()]++
+	}
+	if n := counts["b"]; n < ids*3/4*4/5 || n > ids*3/4*6/5 {
+		t.Errorf("selectNodes: node b of weight 3 has %d of %d ids, expected about three quarters", n, ids)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// DefaultSendQueueSize is how many outgoing messages may be queued
+// for a node unless changed with SetSendQueueSize.
+const DefaultSendQueueSize = 1024
+
+// After a failure to connect or send to a node, messages to it are
+// dropped for a backoff period, which doubles with every consecutive
+// failure up to the maximum.
+const (
+	sendMinBackoff = 100 * time.Millisecond
+	sendMaxBackoff = 30 * time.Second
+)
+
+// sendQueue is the outgoing message queue of a node. Each has its
+// own connection and goroutine, so that a node which is slow or
+// down does not hold up messages to all the others.
+type sendQueue struct {
+	sync.Mutex
+	name, addr string
+	ch         chan *Msg
+	dial       func(addr string, timeout time.Duration) (net.Conn, error)
+	client     *rpc.Client
+	backoff    time.Duration
+	downUntil  time.Time
+
+	// stats, reset by stats()
+	sent, dropped int
+	latency       time.Duration // total
+}
+
+// SendQueueStats are the statistics of the outgoing message queue of
+// a node. All but Len are since the previous call to SendQueueStats.
+type SendQueueStats struct {
+	Node          string        // node name
+	Addr          string        // sanitized address, see Node.SanitizedAddr
+	Len           int           // messages queued
+	Sent, Dropped int           // dropped: queue full, node down or send error
+	Latency       time.Duration // average time to send a message
+}
+
+// SetSendQueueSize sets the size of the outgoing message queue of
+// every node, it only applies to queues created after the call, i.e.
+// it should be called before any messages are sent.
+func (c *Cluster) SetSendQueueSize(n int) {
+	c.sqMu.Lock()
+	defer c.sqMu.Unlock()
+	c.sendQueueSize = n
+}
+
+// sendQueue returns the queue of the destination node, creating it
+// as needed.
+func (c *Cluster) sendQueue(dst *Node) *sendQueue {
+	c.sqMu.Lock()
+	defer c.sqMu.Unlock()
+	if q, ok := c.sendQs[dst.Name()]; ok {
+		return q
+	}
+	size := c.sendQueueSize
+	if size <= 0 {
+		size = DefaultSendQueueSize
+	}
+	q := &sendQueue{
+		name:    dst.Name(),
+		addr:    dst.SanitizedAddr(),
+		ch:      make(chan *Msg, size),
+		dial:    c.dial,
+		backoff: sendMinBackoff,
+	}
+	c.sendQs[dst.Name()] = q
+	go q.run(fmt.Sprintf("%s:%d", dst.Addr, c.rpcPort))
+	return q
+}
+
+// enqueue queues msg without blocking, if the queue is full the
+// message is dropped.
+func (q *sendQueue) enqueue(msg *Msg) {
+	select {
+	case q.ch <- msg:
+	default:
+		q.Lock()
+		q.dropped++
+		q.Unlock()
+	}
+}
+
+func (q *sendQueue) run(addr string) {
+	for msg := range q.ch {
+		if time.Now().Before(q.downUntil) {
+			q.Lock()
+			q.dropped++
+			q.Unlock()
+			continue
+		}
+
+		start := time.Now()
+		if q.client == nil {
+			log.Printf("Cluster: establishing RPC connection to node %s via %s", q.name, addr)
+			conn, err := q.dial(addr, 3*time.Second)
+			if err != nil {
+				log.Printf("Cluster: cannot establish connection to %s: %v, dropping messages for %v.", addr, err, q.backoff)
+				q.fail()
+				continue
+			}
+			q.client = rpc.NewClient(conn)
+		}
+
+		var resp Msg
+		if err := q.client.Call("ClusterRPC.Message", msg, &resp); err != nil {
+			log.Printf("Cluster: error sending message to %s: %v, dropping messages for %v.", q.name, err, q.backoff)
+			q.client.Close()
+			q.client = nil
+			q.fail()
+			continue
+		}
+
+		q.Lock()
+		q.sent++
+		q.latency += time.Now().Sub(start)
+		q.Unlock()
+		q.backoff = sendMinBackoff
+	}
+}
+
+// fail counts the message which could not be sent and starts the
+// backoff period.
+func (q *sendQueue) fail() {
+	q.Lock()
+	defer q.Unlock()
+	q.dropped++
+	q.downUntil = time.Now().Add(q.backoff)
+	if q.backoff *= 2; q.backoff > sendMaxBackoff {
+		q.backoff = sendMaxBackoff
+	}
+}
+
+func (q *sendQueue) stats() SendQueueStats {
+	q.Lock()
+	defer q.Unlock()
+	st := SendQueueStats{Node: q.name, Addr: q.addr, Len: len(q.ch), Sent: q.sent, Dropped: q.dropped}
+	if q.sent > 0 {
+		st.Latency = q.latency / time.Duration(q.sent)
+	}
+	q.sent, q.dropped, q.latency = 0, 0, 0
+	return st
+}
+
+// SendQueueStats returns the statistics of the outgoing message queue
+// of every node a message was ever sent to.
+func (c *Cluster) SendQueueStats() []SendQueueStats {
+	c.sqMu.Lock()
+	defer c.sqMu.Unlock()
+	result := make([]SendQueueStats, 0, len(c.sendQs))
+	for _, q := range c.sendQs {
+		result = append(result, q.stats())
+	}
+	return result
+}
@@ -0,0 +1,38 @@
+package cluster
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func TestCluster_sendQueue(t *testing.T) {
+	// nothing listens on port 1, connecting fails
+	c := &Cluster{sendQs: make(map[string]*sendQueue), rpcPort: 1}
+	c.SetSendQueueSize(2)
+	dst := &Node{Node: &memberlist.Node{Name: "foo", Addr: net.ParseIP("127.0.0.1")}}
+
+	q := c.sendQueue(dst)
+	if c.sendQueue(dst) != q || cap(q.ch) != 2 {
+		t.Errorf("sendQueue: expected the same queue of size 2")
+	}
+	for i := 0; i < 3; i++ {
+		q.enqueue(&Msg{Dst: dst})
+	}
+
+	var st []SendQueueStats
+	dropped := 0
+	for i := 0; i < 100 && dropped < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		st = c.SendQueueStats()
+		dropped += st[0].Dropped
+	}
+	if dropped != 3 || st[0].Sent != 0 || st[0].Addr != "127_0_0_1" {
+		t.Errorf("SendQueueStats: expected 3 dropped (one queue full, two failed), got %d: %#v", dropped, st)
+	}
+	if q.backoff <= sendMinBackoff || !q.downUntil.After(time.Now()) {
+		t.Errorf("sendQueue: a failure should start the backoff: %v", q.backoff)
+	}
+}
@@ -0,0 +1,204 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"net/rpc"
+	"time"
+)
+
+// A StreamHandler answers a request sent with Cluster.RequestStream,
+// calling send with every (gob-encodable) chunk of the reply as soon
+// as it has it. The error of send is that of the requester having
+// gone away, the handler should then return it.
+type StreamHandler func(req *Msg, send func(chunk interface{}) error) error
+
+// How many chunks of a stream may be waiting for the requester, and
+// how long for, after which the stream is abandoned.
+const (
+	streamBuffer      = 16
+	streamIdleTimeout = 30 * time.Second
+)
+
+// StreamChunk is what the requester of a stream gets, Body is
+// flate-compressed. The last chunk is Done, with the error of the
+// handler, if any.
+type StreamChunk struct {
+	Body []byte
+	Done bool
+	Err  string
+}
+
+type stream struct {
+	ch   chan StreamChunk
+	done chan struct{} // closed by CloseStream
+}
+
+// HandleStreams registers the handler of the streamed requests to
+// name, see RequestStream.
+func (c *Cluster) HandleStreams(name string, h StreamHandler) {
+	c.hMu.Lock()
+	defer c.hMu.Unlock()
+	c.streamHandlers[name] = h
+}
+
+// RequestStream sends a gob-encodable payload to the stream handler
+// registered as name on the dst node (see HandleStreams) and calls
+// recv with every chunk of the reply as it arrives, so that a large
+// reply is neither held in memory nor sent in one piece. The chunks
+// are compressed. The timeout applies to every round trip to the
+// node. If recv returns an error the stream is closed and the error
+// is returned.
+func (c *Cluster) RequestStream(dst *Node, name string, payload interface{}, recv func(chunk *Msg) error, timeout time.Duration) error {
+	msg, err := NewMsg(dst, payload)
+	if err != nil {
+		return err
+	}
+	conn, err := c.dial(fmt.Sprintf("%s:%d", dst.Addr, c.rpcPort), timeout)
+	if err != nil {
+		return fmt.Errorf("RequestStream(): cannot connect to node %s: %v", dst.Name(), err)
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	var id int64
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := client.Call("ClusterRPC.OpenStream", Request{Handler: name, Body: msg.Body}, &id); err != nil {
+		return fmt.Errorf("RequestStream(): %s to node %s: %v", name, dst.Name(), err)
+	}
+	for {
+		var chunks []StreamChunk
+		conn.SetDeadline(time.Now().Add(timeout))
+		if err := client.Call("ClusterRPC.NextChunks", id, &chunks); err != nil {
+			return fmt.Errorf("RequestStream(): %s from node %s: %v", name, dst.Name(), err)
+		}
+		for _, chunk := range chunks {
+			if chunk.Done {
+				if chunk.Err != "" {
+					return fmt.Errorf("RequestStream(): %s from node %s: %s", name, dst.Name(), chunk.Err)
+				}
+				return nil
+			}
+			body, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(chunk.Body)))
+			if err != nil {
+				return fmt.Errorf("RequestStream(): %s from node %s: %v", name, dst.Name(), err)
+			}
+			if err := recv(&Msg{Src: dst, Body: body}); err != nil {
+				var closed bool
+				client.Call("ClusterRPC.CloseStream", id, &closed)
+				return err
+			}
+		}
+	}
+}
+
+// OpenStream starts the handler of a streamed request, the chunks of
+// the reply are then fetched with NextChunks.
+func (rpc *ClusterRPC) OpenStream(req Request, id *int64) error {
+	c := rpc.c
+	c.hMu.Lock()
+	h := c.streamHandlers[req.Handler]
+	if h == nil {
+		c.hMu.Unlock()
+		return fmt.Errorf("no handler for %q streams", req.Handler)
+	}
+	c.streamSeq++
+	s := &stream{ch: make(chan StreamChunk, streamBuffer), done: make(chan struct{})}
+	c.streams[c.streamSeq] = s
+	*id = c.streamSeq
+	c.hMu.Unlock()
+
+	go func(id int64) {
+		put := func(chunk StreamChunk) error {
+			select {
+			case s.ch <- chunk:
+				return nil
+			case <-s.done:
+				return fmt.Errorf("stream closed by the requester")
+			case <-time.After(streamIdleTimeout):
+				return fmt.Errorf("stream abandoned by the requester")
+			}
+		}
+		err := h(&Msg{Body: req.Body}, func(chunk interface{}) error {
+			var buf bytes.Buffer
+			z, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+			if err := gob.NewEncoder(z).Encode(chunk); err != nil {
+				return err
+			}
+			z.Close()
+			return put(StreamChunk{Body: buf.Bytes()})
+		})
+		last := StreamChunk{Done: true}
+		if err != nil {
+			last.Err = err.Error()
+		}
+		if put(last) != nil { // otherwise NextChunks removes it
+			c.removeStream(id)
+		}
+	}(*id)
+	return nil
+}
+
+// NextChunks waits for the next chunk of a stream and returns it
+// along with any others already there.
+func (rpc *ClusterRPC) NextChunks(id int64, chunks *[]StreamChunk) error {
+	c := rpc.c
+	c.hMu.RLock()
+	s := c.streams[id]
+	c.hMu.RUnlock()
+	if s == nil {
+		return fmt.Errorf("unknown stream %d", id)
+	}
+	var chunk StreamChunk
+	select {
+	case chunk = <-s.ch:
+	case <-time.After(streamIdleTimeout):
+		return fmt.Errorf("stream %d: no data in %v", id, streamIdleTimeout)
+	}
+	*chunks = append(*chunks, chunk)
+	for !chunk.Done && len(s.ch) > 0 {
+		chunk = <-s.ch
+		*chunks = append(*chunks, chunk)
+	}
+	if chunk.Done {
+		c.removeStream(id)
+	}
+	return nil
+}
+
+// CloseStream stops a stream before its handler is done.
+func (rpc *ClusterRPC) CloseStream(id int64, closed *bool) error {
+	rpc.c.hMu.Lock()
+	s := rpc.c.streams[id]
+	delete(rpc.c.streams, id)
+	rpc.c.hMu.Unlock()
+	if s != nil {
+		close(s.done)
+		*closed = true
+	}
+	return nil
+}
+
+func (c *Cluster) removeStream(id int64) {
+	c.hMu.Lock()
+	defer c.hMu.Unlock()
+	delete(c.streams, id)
+}
@@ -0,0 +1,102 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"sync"
+	"time"
+)
+
+// A DistDatumSizer is a DistDatum that knows (roughly) the size of
+// its state, which during a Transition is counted as the bytes moved.
+type DistDatumSizer interface {
+	Size() int64
+}
+
+// TransitionStatus is the progress of the current or the last
+// Transition (see Cluster.TransitionStatus). Relinquished of
+// Relinquishing DistDatums are moving away from this node, Acquired
+// of Acquiring are moving to it, TimedOut of those never arrived.
+type TransitionStatus struct {
+	Running           bool      `json:"running"`
+	Started           time.Time `json:"started"`
+	Finished          time.Time `json:"finished"`
+	Relinquishing     int       `json:"relinquishing"`
+	Relinquished      int       `json:"relinquished"`
+	RelinquishedBytes int64     `json:"relinquished_bytes"`
+	Acquiring         int       `json:"acquiring"`
+	Acquired          int       `json:"acquired"`
+	TimedOut          int       `json:"timed_out"`
+}
+
+// Remaining is the number of DistDatums yet to be relinquished or
+// acquired.
+func (ts TransitionStatus) Remaining() int {
+	if !ts.Running {
+		return 0
+	}
+	return ts.Relinquishing - ts.Relinquished + ts.Acquiring - ts.Acquired
+}
+
+// transitionState is the status of a transition and its throttle.
+type transitionState struct {
+	sync.Mutex
+	status TransitionStatus
+	rate   int // relinquishes per second, 0 is unlimited
+	next   time.Time
+}
+
+// SetTransitionRate limits how many DistDatums per second a
+// Transition relinquishes, so that moving many of them does not
+// starve their processing (or the database). The nodes receiving
+// them wait for as long as they keep arriving. 0 is unlimited (the
+// default).
+func (c *Cluster) SetTransitionRate(n int) {
+	c.ts.Lock()
+	defer c.ts.Unlock()
+	c.ts.rate = n
+}
+
+// TransitionStatus returns the progress of the current Transition, or
+// of the last one if none is running.
+func (c *Cluster) TransitionStatus() TransitionStatus {
+	c.ts.Lock()
+	defer c.ts.Unlock()
+	return c.ts.status
+}
+
+func (ts *transitionState) update(f func(*TransitionStatus)) {
+	ts.Lock()
+	defer ts.Unlock()
+	f(&ts.status)
+}
+
+// throttle waits for the turn of the next relinquish.
+func (ts *transitionState) throttle() {
+	ts.Lock()
+	if ts.rate <= 0 {
+		ts.Unlock()
+		return
+	}
+	now := time.Now()
+	if ts.next.Before(now) {
+		ts.next = now
+	}
+	wait := ts.next.Sub(now)
+	ts.next = ts.next.Add(time.Second / time.Duration(ts.rate))
+	ts.Unlock()
+	time.Sleep(wait)
+}
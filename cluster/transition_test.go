@@ -0,0 +1,58 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransitionStatus_Remaining(t *testing.T) {
+	ts := TransitionStatus{Relinquishing: 5, Relinquished: 2, Acquiring: 3, Acquired: 1}
+	if ts.Remaining() != 0 {
+		t.Errorf("Remaining: expected 0 when not running, got %d", ts.Remaining())
+	}
+	ts.Running = true
+	if ts.Remaining() != 5 {
+		t.Errorf("Remaining: expected 5, got %d", ts.Remaining())
+	}
+}
+
+func TestCluster_SetTransitionRate(t *testing.T) {
+	c := &Cluster{}
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		c.ts.throttle()
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Errorf("throttle: expected no wait when unlimited")
+	}
+
+	c.SetTransitionRate(100)
+	start = time.Now()
+	for i := 0; i < 6; i++ {
+		c.ts.throttle()
+	}
+	if elapsed := time.Since(start); elapsed < 45*time.Millisecond {
+		t.Errorf("throttle: expected 6 at 100/s to take at least 50ms, took %v", elapsed)
+	}
+
+	c.ts.update(func(s *TransitionStatus) { s.Running, s.Acquiring = true, 2 })
+	if st := c.TransitionStatus(); !st.Running || st.Acquiring != 2 {
+		t.Errorf("TransitionStatus: unexpected %#v", st)
+	}
+}
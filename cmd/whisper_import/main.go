@@ -25,6 +25,10 @@ import (
 	"github.com/tgres/tgres/serde"
 )
 
+// This importer only supports PostgreSQL and is meant for large
+// trees, "tgres -import-whisper" imports (more slowly) into any
+// database.
+//
 // Random notes on whisper files.
 //
 // This performs an operation that should never be done - it updates
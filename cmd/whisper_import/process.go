@@ -30,6 +30,7 @@ import (
 	"github.com/tgres/tgres/daemon"
 	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/whisper"
 )
 
 func fetchDataSources(db serde.SerDe) (map[string]serde.DbDataSourcer, error) {
@@ -213,7 +214,7 @@ func processSegment(db serde.SerDe, ch chan *verticalCache, seg int64, paths map
 
 		name := nameFromPath(path, cfg.whisperDir, cfg.namePrefix)
 
-		wsp, err := newWhisper(path)
+		wsp, err := whisper.Open(path)
 		if err != nil {
 			fmt.Printf("Skipping %v due to error: %v\n", path, err)
 			continue
@@ -232,7 +233,7 @@ func processSegment(db serde.SerDe, ch chan *verticalCache, seg int64, paths map
 		if cfg.dsSpec != nil {
 			spec = cfg.dsSpec
 		} else {
-			spec = specFromHeader(wsp.header, cfg.heartbeat)
+			spec = specFromHeader(wsp, cfg.heartbeat)
 		}
 
 		// NB: If the DS exists, our spec is ignored
@@ -333,17 +334,23 @@ func nameFromPath(path, whisperDir, prefix string) string {
 	return name
 }
 
-func findMostRecentTS(wsp *whisper) time.Time {
-	archs := wsp.header.archives
+type archive []whisper.Point
+
+func (a archive) Len() int           { return len(a) }
+func (a archive) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a archive) Less(i, j int) bool { return a[i].Timestamp < a[j].Timestamp }
+
+func findMostRecentTS(wsp *whisper.File) time.Time {
+	archs := wsp.Archives
 
 	latest := uint32(0)
 	for i, _ := range archs {
-		points, _ := wsp.dumpArchive(i)
+		points, _ := wsp.Points(i)
 
 		if len(points) > 0 {
 			sort.Sort(archive(points))
 
-			last := points[len(points)-1].TimeStamp
+			last := points[len(points)-1].Timestamp
 			if latest < last {
 				latest = last
 			}
@@ -352,10 +359,10 @@ func findMostRecentTS(wsp *whisper) time.Time {
 	return time.Unix(int64(latest), 0)
 }
 
-func processAllPoints(ds rrd.DataSourcer, wsp *whisper) {
+func processAllPoints(ds rrd.DataSourcer, wsp *whisper.File) {
 
 	var allPoints archive
-	archs := wsp.header.archives
+	archs := wsp.Archives
 
 	start, end := uint32(0), uint32(0)
 
@@ -365,15 +372,15 @@ func processAllPoints(ds rrd.DataSourcer, wsp *whisper) {
 		step := time.Duration(arch.Step) * time.Second
 		span := time.Duration(arch.Size) * step
 
-		msgs = append(msgs, fmt.Sprintf("(%d) step: %v span: %v CF: %d", i, step, span, wsp.header.metadata.CF))
+		msgs = append(msgs, fmt.Sprintf("(%d) step: %v span: %v CF: %d", i, step, span, wsp.AggregationMethod))
 
-		points, _ := wsp.dumpArchive(i)
+		points, _ := wsp.Points(i)
 
 		if len(points) > 0 {
 
 			sort.Sort(archive(points))
 
-			last := points[len(points)-1].TimeStamp
+			last := points[len(points)-1].Timestamp
 			if last == 0 {
 				continue // empty archive
 			}
@@ -388,8 +395,8 @@ func processAllPoints(ds rrd.DataSourcer, wsp *whisper) {
 
 			// select points > start
 			for _, p := range points {
-				p.TimeStamp += arch.Step // Tgres tracks end of slots
-				if p.TimeStamp >= start && p.TimeStamp < end {
+				p.Timestamp += arch.Step // Tgres tracks end of slots
+				if p.Timestamp >= start && p.Timestamp < end {
 					allPoints = append(allPoints, p)
 				}
 			}
@@ -405,8 +412,8 @@ func processArchivePoints(ds rrd.DataSourcer, points archive) {
 	sort.Sort(points)
 	var begin, end time.Time
 	for _, p := range points {
-		if p.TimeStamp != 0 {
-			ts := time.Unix(int64(p.TimeStamp), 0)
+		if p.Timestamp != 0 {
+			ts := time.Unix(int64(p.Timestamp), 0)
 			if ts.After(ds.LastUpdate()) {
 				ds.ProcessDataPoint(p.Value, ts)
 				n++
@@ -423,19 +430,19 @@ func processArchivePoints(ds rrd.DataSourcer, points archive) {
 	}
 }
 
-func specFromHeader(h *header, hb int) *rrd.DSSpec {
+func specFromHeader(h *whisper.File, hb int) *rrd.DSSpec {
 
 	// Archives are stored in order of precision, so first archive
 	// step is the DS step. (TODO: it should be gcd of all
 	// archives).
-	dsStep := h.archives[0].Step
+	dsStep := h.Archives[0].Step
 
 	spec := rrd.DSSpec{
 		Step:      time.Duration(dsStep) * time.Second,
 		Heartbeat: time.Duration(hb) * time.Second,
 	}
 
-	for _, arch := range h.archives {
+	for _, arch := range h.Archives {
 		spec.RRAs = append(spec.RRAs, rrd.RRASpec{
 			Function: rrd.WMEAN, // TODO: can we support others?
 			Step:     time.Duration(arch.Step) * time.Second,
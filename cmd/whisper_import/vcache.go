@@ -125,7 +125,7 @@ func (vc verticalCache) flush(db serde.Flusher) error {
 
 	fmt.Printf("[db] [%v] Flushing %d DS states ...\n", vc.ts, len(vc.dss))
 	for k, lu := range vc.dss {
-		ops, err := db.FlushDSStates(k, lu, nil, nil)
+		ops, err := db.FlushDSStates(k, lu, nil, nil, nil)
 		if err != nil {
 			fmt.Printf("[db] [%v] EROR flushing DS state: %v\n", vc.ts, err)
 		}
@@ -0,0 +1,429 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package collectd decodes the collectd binary network protocol.
+package collectd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/serde"
+)
+
+// Part types, see https://collectd.org/wiki/index.php/Binary_protocol
+const (
+	partHost           = 0x0000
+	partTime           = 0x0001
+	partPlugin         = 0x0002
+	partPluginInstance = 0x0003
+	partType           = 0x0004
+	partTypeInstance   = 0x0005
+	partValues         = 0x0006
+	partInterval       = 0x0007
+	partTimeHR         = 0x0008
+	partIntervalHR     = 0x0009
+	partSignature      = 0x0200
+	partEncryption     = 0x0210
+)
+
+// ValueType is the collectd data source type of a value.
+type ValueType uint8
+
+const (
+	Counter ValueType = iota
+	Gauge
+	Derive
+	Absolute
+)
+
+// Value is a single value of a ValueList.
+type Value struct {
+	Type  ValueType
+	Value float64
+}
+
+// ValueList is a collectd value list, i.e. the values of one
+// collectd type (e.g. "if_octets" has rx and tx) at a point in time.
+type ValueList struct {
+	Host, Plugin, PluginInstance, Type, TypeInstance string
+
+	Time     time.Time
+	Interval time.Duration
+	Values   []Value
+}
+
+// SecurityLevel is the required security of incoming packets, as the
+// collectd network plugin SecurityLevel option.
+type SecurityLevel int
+
+const (
+	// Accept all data, signed data is not verified, encrypted data
+	// is decrypted if the user is known.
+	SecurityNone SecurityLevel = iota
+	// Accept only signed or encrypted data.
+	SecuritySign
+	// Accept only encrypted data.
+	SecurityEncrypt
+)
+
+func (l SecurityLevel) String() string {
+	switch l {
+	case SecurityNone:
+		return "none"
+	case SecuritySign:
+		return "sign"
+	case SecurityEncrypt:
+		return "encrypt"
+	}
+	return fmt.Sprintf("SecurityLevel(%d)", int(l))
+}
+
+// ParseSecurityLevel converts "none", "sign" or "encrypt" into a
+// SecurityLevel.
+func ParseSecurityLevel(s string) (SecurityLevel, error) {
+	switch strings.ToLower(s) {
+	case "none", "":
+		return SecurityNone, nil
+	case "sign":
+		return SecuritySign, nil
+	case "encrypt":
+		return SecurityEncrypt, nil
+	}
+	return SecurityNone, fmt.Errorf("Invalid collectd security level: %q (valid: none, sign, encrypt)", s)
+}
+
+// Parser decodes collectd packets.
+type Parser struct {
+	SecurityLevel SecurityLevel
+	Passwords     map[string]string // by user name
+}
+
+// security of (part of) a packet
+const (
+	insecure = iota
+	signed
+	encrypted
+)
+
+// Parse decodes a packet into value lists. Values which do not meet
+// the SecurityLevel are skipped, which is reported as an error along
+// with whatever was decoded.
+func (p *Parser) Parse(b []byte) ([]*ValueList, error) {
+	var (
+		result []*ValueList
+		vl     ValueList
+	)
+	err := p.parse(b, insecure, &vl, &result)
+	return result, err
+}
+
+func (p *Parser) parse(b []byte, security int, vl *ValueList, result *[]*ValueList) error {
+	var skipped int
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return fmt.Errorf("collectd: truncated part header")
+		}
+		typ, length := binary.BigEndian.Uint16(b[0:2]), int(binary.BigEndian.Uint16(b[2:4]))
+		if length < 4 || length > len(b) {
+			return fmt.Errorf("collectd: invalid part length %d", length)
+		}
+		part, rest := b[4:length], b[length:]
+
+		switch typ {
+		case partSignature:
+			if len(part) < 32 {
+				return fmt.Errorf("collectd: truncated signature")
+			}
+			sig, user := part[:32], string(part[32:])
+			password, ok := p.Passwords[user]
+			if !ok {
+				if p.SecurityLevel == SecurityNone {
+					break // not verified, the rest is insecure
+				}
+				return fmt.Errorf("collectd: unknown user %q", user)
+			}
+			mac := hmac.New(sha256.New, []byte(password))
+			mac.Write(part[32:])
+			mac.Write(rest)
+			if !hmac.Equal(mac.Sum(nil), sig) {
+				return fmt.Errorf("collectd: invalid signature (user %q)", user)
+			}
+			if security < signed {
+				return p.parse(rest, signed, vl, result)
+			}
+		case partEncryption:
+			plain, err := p.decrypt(part)
+			if err != nil {
+				if p.SecurityLevel == SecurityNone {
+					break
+				}
+				return err
+			}
+			if err := p.parse(plain, encrypted, vl, result); err != nil {
+				return err
+			}
+		case partHost, partPlugin, partPluginInstance, partType, partTypeInstance:
+			s := string(bytes.TrimRight(part, "\x00"))
+			switch typ {
+			case partHost:
+				vl.Host = s
+			case partPlugin:
+				vl.Plugin = s
+			case partPluginInstance:
+				vl.PluginInstance = s
+			case partType:
+				vl.Type = s
+			case partTypeInstance:
+				vl.TypeInstance = s
+			}
+		case partTime, partTimeHR, partInterval, partIntervalHR:
+			if len(part) != 8 {
+				return fmt.Errorf("collectd: invalid time or interval part length %d", length)
+			}
+			n := binary.BigEndian.Uint64(part)
+			switch typ {
+			case partTime:
+				vl.Time = time.Unix(int64(n), 0)
+			case partTimeHR:
+				vl.Time = time.Unix(0, 0).Add(hrDuration(n))
+			case partInterval:
+				vl.Interval = time.Duration(n) * time.Second
+			case partIntervalHR:
+				vl.Interval = hrDuration(n)
+			}
+		case partValues:
+			if int(p.SecurityLevel) > security {
+				skipped++
+				break
+			}
+			values, err := parseValues(part)
+			if err != nil {
+				return err
+			}
+			cp := *vl
+			cp.Values = values
+			*result = append(*result, &cp)
+		}
+		// other parts (notifications etc.) are ignored
+		b = rest
+	}
+	if skipped > 0 {
+		return fmt.Errorf("collectd: skipped %d value lists not meeting security level %v", skipped, p.SecurityLevel)
+	}
+	return nil
+}
+
+// hrDuration converts a "high resolution" time, which is in units of
+// 2^-30 seconds.
+func hrDuration(n uint64) time.Duration {
+	return time.Duration(n>>30)*time.Second + time.Duration((n&(1<<30-1))*uint64(time.Second)>>30)
+}
+
+func parseValues(part []byte) ([]Value, error) {
+	if len(part) < 2 {
+		return nil, fmt.Errorf("collectd: truncated values part")
+	}
+	n := int(binary.BigEndian.Uint16(part[0:2]))
+	if len(part) != 2+n*9 {
+		return nil, fmt.Errorf("collectd: values part length %d does not match %d values", len(part), n)
+	}
+	types, data := part[2:2+n], part[2+n:]
+	values := make([]Value, n)
+	for i := 0; i < n; i++ {
+		raw := data[i*8 : i*8+8]
+		values[i].Type = ValueType(types[i])
+		switch values[i].Type {
+		case Counter, Absolute:
+			values[i].Value = float64(binary.BigEndian.Uint64(raw))
+		case Gauge: // little endian!
+			values[i].Value = math.Float64frombits(binary.LittleEndian.Uint64(raw))
+		case Derive:
+			values[i].Value = float64(int64(binary.BigEndian.Uint64(raw)))
+		default:
+			return nil, fmt.Errorf("collectd: unknown value type %d", types[i])
+		}
+	}
+	return values, nil
+}
+
+// decrypt decrypts an encryption part: user name length and name, a
+// 16 byte IV and AES-256 OFB encrypted data, keyed with the SHA-256
+// of the password, which begins with the SHA-1 of the rest.
+func (p *Parser) decrypt(part []byte) ([]byte, error) {
+	if len(part) < 2 {
+		return nil, fmt.Errorf("collectd: truncated encryption part")
+	}
+	ulen := int(binary.BigEndian.Uint16(part[0:2]))
+	if len(part) < 2+ulen+16+sha1.Size {
+		return nil, fmt.Errorf("collectd: truncated encryption part")
+	}
+	user := string(part[2 : 2+ulen])
+	password, ok := p.Passwords[user]
+	if !ok {
+		return nil, fmt.Errorf("collectd: unknown user %q", user)
+	}
+	iv, data := part[2+ulen:2+ulen+16], part[2+ulen+16:]
+
+	key := sha256.Sum256([]byte(password))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(data))
+	cipher.NewOFB(block, iv).XORKeyStream(plain, data)
+
+	sum := sha1.Sum(plain[sha1.Size:])
+	if !bytes.Equal(sum[:], plain[:sha1.Size]) {
+		return nil, fmt.Errorf("collectd: decryption failed (user %q)", user)
+	}
+	return plain[sha1.Size:], nil
+}
+
+// ReadAuthFile reads a collectd auth file, which has a "user:
+// password" per line.
+func ReadAuthFile(r io.Reader) (map[string]string, error) {
+	result := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("line %d: expected \"user: password\"", n)
+		}
+		result[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return result, scanner.Err()
+}
+
+// TypesDB is the data source names of collectd types, as in the
+// collectd types.db file.
+type TypesDB map[string][]string
+
+// ReadTypesDB reads a types.db, which has a type and its data sources
+// ("name:type:min:max", comma separated) per line.
+func ReadTypesDB(r io.Reader) (TypesDB, error) {
+	result := make(TypesDB)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: no data sources for type %q", n, fields[0])
+		}
+		var names []string
+		for _, ds := range strings.Split(strings.Join(fields[1:], ""), ",") {
+			if ds == "" {
+				continue
+			}
+			names = append(names, strings.SplitN(ds, ":", 2)[0])
+		}
+		result[fields[0]] = names
+	}
+	return result, scanner.Err()
+}
+
+// Naming is how value lists are named.
+type Naming int
+
+const (
+	// As the collectd write_graphite plugin:
+	// [prefix]host.plugin[-plugin_instance].type[-type_instance][.ds]
+	// with dots in the host and the instances replaced by "_".
+	NamingGraphite Naming = iota
+	// [prefix]plugin.type[.ds] with host, plugin_instance and
+	// type_instance as ident fields (if not empty).
+	NamingTags
+)
+
+func (n Naming) String() string {
+	switch n {
+	case NamingGraphite:
+		return "graphite"
+	case NamingTags:
+		return "tags"
+	}
+	return fmt.Sprintf("Naming(%d)", int(n))
+}
+
+// ParseNaming converts "graphite" or "tags" into a Naming.
+func ParseNaming(s string) (Naming, error) {
+	switch strings.ToLower(s) {
+	case "graphite", "":
+		return NamingGraphite, nil
+	case "tags":
+		return NamingTags, nil
+	}
+	return NamingGraphite, fmt.Errorf("Invalid collectd naming: %q (valid: graphite, tags)", s)
+}
+
+// Idents returns the ident of every value of vl. The data source
+// name is appended if there is more than one, it is looked up in
+// types, if not found, it is the index of the value.
+func (vl *ValueList) Idents(naming Naming, prefix string, types TypesDB) []serde.Ident {
+	clean := func(s string) string { return misc.SanitizeName(strings.Replace(s, ".", "_", -1)) }
+	withInstance := func(s, instance string) string {
+		if instance != "" {
+			return s + "-" + clean(instance)
+		}
+		return s
+	}
+
+	var base string
+	if naming == NamingTags {
+		base = prefix + clean(vl.Plugin) + "." + clean(vl.Type)
+	} else {
+		base = prefix + clean(vl.Host) + "." + withInstance(clean(vl.Plugin), vl.PluginInstance) + "." + withInstance(clean(vl.Type), vl.TypeInstance)
+	}
+
+	result := make([]serde.Ident, len(vl.Values))
+	for i := range vl.Values {
+		name := base
+		if len(vl.Values) > 1 {
+			if dss := types[vl.Type]; len(dss) == len(vl.Values) {
+				name += "." + clean(dss[i])
+			} else {
+				name += fmt.Sprintf(".%d", i)
+			}
+		}
+		ident := serde.Ident{"name": name}
+		if naming == NamingTags {
+			for k, v := range map[string]string{"host": vl.Host, "plugin_instance": vl.PluginInstance, "type_instance": vl.TypeInstance} {
+				if v != "" {
+					ident[k] = v
+				}
+			}
+		}
+		result[i] = ident
+	}
+	return result
+}
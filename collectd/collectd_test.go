@@ -0,0 +1,182 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collectd
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+func part(typ uint16, data []byte) []byte {
+	b := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint16(b[0:2], typ)
+	binary.BigEndian.PutUint16(b[2:4], uint16(4+len(data)))
+	return append(b, data...)
+}
+
+func stringPart(typ uint16, s string) []byte {
+	return part(typ, append([]byte(s), 0))
+}
+
+func numberPart(typ uint16, n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return part(typ, b)
+}
+
+func testPacket() []byte {
+	var b []byte
+	b = append(b, stringPart(partHost, "web1.example.com")...)
+	b = append(b, numberPart(partTimeHR, 1500000000<<30|1<<29)...) // .5 second
+	b = append(b, numberPart(partIntervalHR, 10<<30)...)
+	b = append(b, stringPart(partPlugin, "interface")...)
+	b = append(b, stringPart(partPluginInstance, "eth0")...)
+	b = append(b, stringPart(partType, "if_octets")...)
+
+	values := []byte{0, 2, byte(Derive), byte(Gauge)}
+	values = append(values, make([]byte, 16)...)
+	binary.BigEndian.PutUint64(values[4:], uint64(100))
+	binary.LittleEndian.PutUint64(values[12:], math.Float64bits(2.5))
+	return append(b, part(partValues, values)...)
+}
+
+func signedPacket(user, password string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write([]byte(user))
+	mac.Write(payload)
+	return append(part(partSignature, append(mac.Sum(nil), user...)), payload...)
+}
+
+func encryptedPacket(user, password string, payload []byte) []byte {
+	sum := sha1.Sum(payload)
+	plain := append(sum[:], payload...)
+	key := sha256.Sum256([]byte(password))
+	block, _ := aes.NewCipher(key[:])
+	iv := bytes.Repeat([]byte{7}, 16)
+	data := make([]byte, len(plain))
+	cipher.NewOFB(block, iv).XORKeyStream(data, plain)
+
+	b := []byte{0, byte(len(user))}
+	b = append(b, user...)
+	b = append(b, iv...)
+	return part(partEncryption, append(b, data...))
+}
+
+func Test_Parser_Parse(t *testing.T) {
+	expect := &ValueList{
+		Host: "web1.example.com", Plugin: "interface", PluginInstance: "eth0", Type: "if_octets",
+		Time:     time.Unix(1500000000, 500000000),
+		Interval: 10 * time.Second,
+		Values:   []Value{{Derive, 100}, {Gauge, 2.5}},
+	}
+	passwords := map[string]string{"alice": "secret"}
+
+	for _, c := range []struct {
+		desc   string
+		level  SecurityLevel
+		packet []byte
+		ok     bool
+	}{
+		{"plain", SecurityNone, testPacket(), true},
+		{"plain, sign required", SecuritySign, testPacket(), false},
+		{"signed", SecuritySign, signedPacket("alice", "secret", testPacket()), true},
+		{"signed, unknown user", SecuritySign, signedPacket("bob", "secret", testPacket()), false},
+		{"signed, unknown user, no security", SecurityNone, signedPacket("bob", "secret", testPacket()), true},
+		{"signed, wrong password", SecuritySign, signedPacket("alice", "wrong", testPacket()), false},
+		{"signed, encrypt required", SecurityEncrypt, signedPacket("alice", "secret", testPacket()), false},
+		{"encrypted", SecurityEncrypt, encryptedPacket("alice", "secret", testPacket()), true},
+		{"encrypted, wrong password", SecurityEncrypt, encryptedPacket("alice", "wrong", testPacket()), false},
+	} {
+		p := &Parser{SecurityLevel: c.level, Passwords: passwords}
+		vls, err := p.Parse(c.packet)
+		if !c.ok {
+			if err == nil || len(vls) != 0 {
+				t.Errorf("Parse(%s): expected an error and no values, got %v %v", c.desc, err, vls)
+			}
+			continue
+		}
+		if err != nil || len(vls) != 1 || !reflect.DeepEqual(vls[0], expect) {
+			t.Errorf("Parse(%s): got %v %v", c.desc, err, vls)
+		}
+	}
+
+	p := &Parser{}
+	if _, err := p.Parse([]byte{0, 1, 0, 99}); err == nil {
+		t.Errorf("Parse: invalid part length should be an error")
+	}
+}
+
+func Test_ReadTypesDB(t *testing.T) {
+	types, err := ReadTypesDB(strings.NewReader(`# comment
+if_octets               rx:DERIVE:0:U, tx:DERIVE:0:U
+load                    shortterm:GAUGE:0:5000, midterm:GAUGE:0:5000, longterm:GAUGE:0:5000
+`))
+	expect := TypesDB{"if_octets": {"rx", "tx"}, "load": {"shortterm", "midterm", "longterm"}}
+	if err != nil || !reflect.DeepEqual(types, expect) {
+		t.Errorf("ReadTypesDB: got %v %v", err, types)
+	}
+	if _, err := ReadTypesDB(strings.NewReader("foo\n")); err == nil {
+		t.Errorf("ReadTypesDB: a type without data sources should be an error")
+	}
+}
+
+func Test_ReadAuthFile(t *testing.T) {
+	pw, err := ReadAuthFile(strings.NewReader("alice: secret\n\n# comment\nbob:pass:word\n"))
+	if err != nil || !reflect.DeepEqual(pw, map[string]string{"alice": "secret", "bob": "pass:word"}) {
+		t.Errorf("ReadAuthFile: got %v %v", err, pw)
+	}
+	if _, err := ReadAuthFile(strings.NewReader("alice\n")); err == nil {
+		t.Errorf("ReadAuthFile: a line without a password should be an error")
+	}
+}
+
+func Test_ValueList_Idents(t *testing.T) {
+	vl := &ValueList{Host: "web1.example.com", Plugin: "interface", PluginInstance: "eth0", Type: "if_octets",
+		Values: []Value{{Derive, 1}, {Derive, 2}}}
+	types := TypesDB{"if_octets": {"rx", "tx"}}
+
+	got := vl.Idents(NamingGraphite, "collectd.", types)
+	expect := []serde.Ident{{"name": "collectd.web1_example_com.interface-eth0.if_octets.rx"}, {"name": "collectd.web1_example_com.interface-eth0.if_octets.tx"}}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Idents(graphite): got %v", got)
+	}
+
+	got = vl.Idents(NamingTags, "", nil)
+	expect = []serde.Ident{
+		{"name": "interface.if_octets.0", "host": "web1.example.com", "plugin_instance": "eth0"},
+		{"name": "interface.if_octets.1", "host": "web1.example.com", "plugin_instance": "eth0"},
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Idents(tags): got %v", got)
+	}
+
+	vl = &ValueList{Host: "h", Plugin: "cpu", Type: "percent", TypeInstance: "idle", Values: []Value{{Gauge, 99}}}
+	if got := vl.Idents(NamingGraphite, "", types); got[0]["name"] != "h.cpu.percent-idle" {
+		t.Errorf("Idents(graphite, single value): got %v", got)
+	}
+}
@@ -0,0 +1,584 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tgres/tgres/receiver"
+)
+
+// amqpServiceManager consumes messages from an AMQP 0-9-1 (RabbitMQ)
+// queue, which it declares and binds to an exchange, as carbon's AMQP
+// consumer does. It speaks just enough of the protocol for that,
+// messages are acknowledged once queued and reconnects whenever the
+// connection is lost. Like the other subscribers it is a client, there
+// is no file to hand over on graceful restart.
+type amqpServiceManager struct {
+	rcvr *receiver.Receiver
+	url  string
+	cfg  amqpConsumer
+	stop int32
+
+	sync.Mutex
+	conn net.Conn
+}
+
+// amqpConsumer is what to consume, see the amqp-* settings.
+type amqpConsumer struct {
+	exchange, exchangeType, queue string
+	routingKeys                   []string
+	format                        payloadFormat
+	routingKeyName                bool // the routing key is the name, the body is "value timestamp"
+	prefetch                      int
+}
+
+const (
+	amqpMinBackoff = time.Second
+	amqpMaxBackoff = 30 * time.Second
+	amqpFrameMax   = 131072
+)
+
+// AMQP frame types
+const (
+	amqpFrameMethod    = 1
+	amqpFrameHeader    = 2
+	amqpFrameBody      = 3
+	amqpFrameHeartbeat = 8
+	amqpFrameEnd       = 0xce
+)
+
+// AMQP class and method ids, as class<<16|method
+const (
+	amqpConnectionStart   = 10<<16 | 10
+	amqpConnectionStartOk = 10<<16 | 11
+	amqpConnectionTune    = 10<<16 | 30
+	amqpConnectionTuneOk  = 10<<16 | 31
+	amqpConnectionOpen    = 10<<16 | 40
+	amqpConnectionOpenOk  = 10<<16 | 41
+	amqpConnectionClose   = 10<<16 | 50
+	amqpConnectionCloseOk = 10<<16 | 51
+	amqpChannelOpen       = 20<<16 | 10
+	amqpChannelOpenOk     = 20<<16 | 11
+	amqpChannelClose      = 20<<16 | 40
+	amqpExchangeDeclare   = 40<<16 | 10
+	amqpExchangeDeclareOk = 40<<16 | 11
+	amqpQueueDeclare      = 50<<16 | 10
+	amqpQueueDeclareOk    = 50<<16 | 11
+	amqpQueueBind         = 50<<16 | 20
+	amqpQueueBindOk       = 50<<16 | 21
+	amqpBasicQos          = 60<<16 | 10
+	amqpBasicQosOk        = 60<<16 | 11
+	amqpBasicConsume      = 60<<16 | 20
+	amqpBasicConsumeOk    = 60<<16 | 21
+	amqpBasicDeliver      = 60<<16 | 60
+	amqpBasicAck          = 60<<16 | 80
+)
+
+func (g *amqpServiceManager) File() *os.File {
+	return nil
+}
+
+func (g *amqpServiceManager) Stop() {
+	if g.stopped() {
+		return
+	}
+	atomic.StoreInt32(&(g.stop), 1)
+	g.Lock()
+	defer g.Unlock()
+	if g.conn != nil {
+		log.Printf("Closing AMQP connection to %s", g.conn.RemoteAddr())
+		g.conn.Close() // unacknowledged messages are redelivered
+	}
+}
+
+func (g *amqpServiceManager) stopped() bool {
+	return atomic.LoadInt32(&(g.stop)) != 0
+}
+
+func (g *amqpServiceManager) Start(file *os.File) error {
+	if g.url == "" {
+		log.Printf("Not starting AMQP consumer because amqp-url is blank.")
+		return nil
+	}
+	u, err := parseAmqpURL(g.url)
+	if err != nil {
+		return err
+	}
+	log.Printf("AMQP consumer connecting to %s (exchange %q, queue %q)\n", u.Host, g.cfg.exchange, g.cfg.queue)
+	go g.amqpClient(u)
+	return nil
+}
+
+// amqpClient (re)connects until stopped.
+func (g *amqpServiceManager) amqpClient(u *url.URL) {
+	backoff := amqpMinBackoff
+	for !g.stopped() {
+		conn, err := net.DialTimeout("tcp", u.Host, 5*time.Second)
+		if err == nil {
+			g.Lock()
+			g.conn = conn
+			g.Unlock()
+			if g.stopped() { // Stop() may have missed it
+				conn.Close()
+				return
+			}
+			err = g.amqpSession(&amqpConn{r: bufio.NewReader(conn), w: conn, frameMax: amqpFrameMax}, conn, u)
+			conn.Close()
+			if g.stopped() {
+				return
+			}
+			backoff = amqpMinBackoff
+		}
+		log.Printf("amqpClient(): %v; reconnecting in %v", err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > amqpMaxBackoff {
+			backoff = amqpMaxBackoff
+		}
+	}
+}
+
+// amqpSession sets up the connection, channel, exchange, queue and
+// consumer, then consumes until the connection fails.
+func (g *amqpServiceManager) amqpSession(c *amqpConn, conn net.Conn, u *url.URL) error {
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	heartbeat, err := c.handshake(u)
+	if err != nil {
+		return err
+	}
+	queue, err := c.setup(g.cfg)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf("AMQP consumer connected to %s, consuming from queue %q", conn.RemoteAddr(), queue)
+
+	if heartbeat > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			tick := time.NewTicker(heartbeat / 2)
+			defer tick.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-tick.C:
+					if c.writeFrame(amqpFrameHeartbeat, 0, nil) != nil {
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	return c.consume(heartbeat, conn, func(routingKey string, body []byte) {
+		if g.cfg.routingKeyName {
+			var buf bytes.Buffer
+			for _, line := range strings.Split(string(body), "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					fmt.Fprintf(&buf, "%s %s\n", routingKey, line)
+				}
+			}
+			body = buf.Bytes()
+		}
+		queuePayload(g.rcvr, g.cfg.format, "amqp", "", body)
+	})
+}
+
+// amqpConn is an AMQP connection with a single channel.
+type amqpConn struct {
+	r        *bufio.Reader
+	w        io.Writer
+	wmu      sync.Mutex // heartbeats come from another goroutine
+	frameMax int
+}
+
+var errAmqpFrame = errors.New("malformed AMQP frame")
+
+func (c *amqpConn) writeFrame(typ byte, channel uint16, payload []byte) error {
+	frame := make([]byte, 7, 8+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint16(frame[1:3], channel)
+	binary.BigEndian.PutUint32(frame[3:7], uint32(len(payload)))
+	frame = append(append(frame, payload...), amqpFrameEnd)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.w.Write(frame)
+	return err
+}
+
+func (c *amqpConn) readFrame() (byte, uint16, []byte, error) {
+	var hdr [7]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[3:7])
+	if int(size) > c.frameMax {
+		return 0, 0, nil, fmt.Errorf("AMQP frame of %d bytes exceeds frame-max %d", size, c.frameMax)
+	}
+	payload := make([]byte, size+1)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	if payload[size] != amqpFrameEnd {
+		return 0, 0, nil, errAmqpFrame
+	}
+	return hdr[0], binary.BigEndian.Uint16(hdr[1:3]), payload[:size], nil
+}
+
+func (c *amqpConn) method(channel uint16, id uint32, args []byte) error {
+	payload := make([]byte, 4, 4+len(args))
+	binary.BigEndian.PutUint32(payload, id)
+	return c.writeFrame(amqpFrameMethod, channel, append(payload, args...))
+}
+
+// expect reads method frames, skipping heartbeats, until one arrives
+// and returns its arguments if it is the expected one. A close from
+// the broker is returned as an error.
+func (c *amqpConn) expect(id uint32) ([]byte, error) {
+	for {
+		typ, channel, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if typ == amqpFrameHeartbeat {
+			continue
+		}
+		if typ != amqpFrameMethod || len(payload) < 4 {
+			return nil, fmt.Errorf("unexpected AMQP frame type %d", typ)
+		}
+		got, args := binary.BigEndian.Uint32(payload), payload[4:]
+		if got == amqpConnectionClose || got == amqpChannelClose {
+			return nil, c.closed(got, channel, args)
+		}
+		if got != id {
+			return nil, fmt.Errorf("expected AMQP method %d.%d, got %d.%d", id>>16, id&0xffff, got>>16, got&0xffff)
+		}
+		return args, nil
+	}
+}
+
+// closed acknowledges a close from the broker and returns its reason.
+func (c *amqpConn) closed(id uint32, channel uint16, args []byte) error {
+	var (
+		code uint16
+		text string
+	)
+	if len(args) >= 3 {
+		code = binary.BigEndian.Uint16(args)
+		text, _ = amqpReadShortstr(args[2:])
+	}
+	c.method(channel, id+1, nil) // Close-Ok
+	return fmt.Errorf("AMQP broker closed the connection: %d %s", code, text)
+}
+
+// handshake opens the connection and channel 1, returning the
+// heartbeat interval.
+func (c *amqpConn) handshake(u *url.URL) (time.Duration, error) {
+	if _, err := c.w.Write([]byte("AMQP\x00\x00\x09\x01")); err != nil {
+		return 0, err
+	}
+	args, err := c.expect(amqpConnectionStart)
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Contains(args, []byte("PLAIN")) {
+		return 0, fmt.Errorf("AMQP broker does not support PLAIN authentication")
+	}
+
+	user, pass := "guest", "guest"
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+	var b amqpArgs
+	b.table(map[string]string{"product": "tgres"})
+	b.shortstr("PLAIN")
+	b.longstr("\x00" + user + "\x00" + pass)
+	b.shortstr("en_US")
+	if err := c.method(0, amqpConnectionStartOk, b.Bytes()); err != nil {
+		return 0, err
+	}
+
+	if args, err = c.expect(amqpConnectionTune); err != nil {
+		return 0, err
+	}
+	if len(args) < 8 {
+		return 0, errAmqpFrame
+	}
+	if fm := int(binary.BigEndian.Uint32(args[2:6])); fm != 0 && fm < c.frameMax {
+		c.frameMax = fm
+	}
+	heartbeat := binary.BigEndian.Uint16(args[6:8])
+	b.Reset()
+	b.short(1) // channel-max
+	b.long(uint32(c.frameMax))
+	b.short(heartbeat)
+	if err := c.method(0, amqpConnectionTuneOk, b.Bytes()); err != nil {
+		return 0, err
+	}
+
+	vhost := "/"
+	if p := strings.TrimPrefix(u.Path, "/"); p != "" {
+		vhost, _ = url.PathUnescape(p)
+	}
+	b.Reset()
+	b.shortstr(vhost)
+	b.shortstr("")
+	b.WriteByte(0)
+	if err := c.method(0, amqpConnectionOpen, b.Bytes()); err != nil {
+		return 0, err
+	}
+	if _, err := c.expect(amqpConnectionOpenOk); err != nil {
+		return 0, err
+	}
+
+	if err := c.method(1, amqpChannelOpen, []byte{0}); err != nil {
+		return 0, err
+	}
+	if _, err := c.expect(amqpChannelOpenOk); err != nil {
+		return 0, err
+	}
+	return time.Duration(heartbeat) * time.Second, nil
+}
+
+// setup declares the exchange and queue (both durable, a queue
+// without a name is a server named exclusive one), binds them and
+// starts consuming. It returns the queue name.
+func (c *amqpConn) setup(cfg amqpConsumer) (string, error) {
+	var b amqpArgs
+	if cfg.exchange != "" {
+		b.short(0)
+		b.shortstr(cfg.exchange)
+		b.shortstr(cfg.exchangeType)
+		b.WriteByte(0x02) // durable
+		b.table(nil)
+		if err := c.method(1, amqpExchangeDeclare, b.Bytes()); err != nil {
+			return "", err
+		}
+		if _, err := c.expect(amqpExchangeDeclareOk); err != nil {
+			return "", err
+		}
+	}
+
+	b.Reset()
+	b.short(0)
+	b.shortstr(cfg.queue)
+	if cfg.queue != "" {
+		b.WriteByte(0x02) // durable
+	} else {
+		b.WriteByte(0x0c) // exclusive, auto-delete
+	}
+	b.table(nil)
+	if err := c.method(1, amqpQueueDeclare, b.Bytes()); err != nil {
+		return "", err
+	}
+	args, err := c.expect(amqpQueueDeclareOk)
+	if err != nil {
+		return "", err
+	}
+	queue, err := amqpReadShortstr(args)
+	if err != nil {
+		return "", err
+	}
+
+	if cfg.exchange != "" {
+		for _, key := range cfg.routingKeys {
+			b.Reset()
+			b.short(0)
+			b.shortstr(queue)
+			b.shortstr(cfg.exchange)
+			b.shortstr(key)
+			b.WriteByte(0)
+			b.table(nil)
+			if err := c.method(1, amqpQueueBind, b.Bytes()); err != nil {
+				return "", err
+			}
+			if _, err := c.expect(amqpQueueBindOk); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	b.Reset()
+	b.long(0)
+	b.short(uint16(cfg.prefetch))
+	b.WriteByte(0)
+	if err := c.method(1, amqpBasicQos, b.Bytes()); err != nil {
+		return "", err
+	}
+	if _, err := c.expect(amqpBasicQosOk); err != nil {
+		return "", err
+	}
+
+	b.Reset()
+	b.short(0)
+	b.shortstr(queue)
+	b.shortstr("tgres")
+	b.WriteByte(0) // acknowledged
+	b.table(nil)
+	if err := c.method(1, amqpBasicConsume, b.Bytes()); err != nil {
+		return "", err
+	}
+	if _, err := c.expect(amqpBasicConsumeOk); err != nil {
+		return "", err
+	}
+	return queue, nil
+}
+
+// consume reads deliveries, passes them to handle by routing key and
+// acknowledges them. Missing two heartbeats is an error.
+func (c *amqpConn) consume(heartbeat time.Duration, conn net.Conn, handle func(routingKey string, body []byte)) error {
+	var (
+		deliveryTag uint64
+		routingKey  string
+		size        uint64
+		body        []byte
+		inMessage   bool
+	)
+	for {
+		if heartbeat > 0 && conn != nil {
+			conn.SetReadDeadline(time.Now().Add(2 * heartbeat))
+		}
+		typ, channel, payload, err := c.readFrame()
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case amqpFrameHeartbeat:
+			continue
+		case amqpFrameMethod:
+			if len(payload) < 4 {
+				return errAmqpFrame
+			}
+			id, args := binary.BigEndian.Uint32(payload), payload[4:]
+			switch id {
+			case amqpBasicDeliver:
+				// consumer-tag, delivery-tag, redelivered, exchange, routing-key
+				ctag, err := amqpReadShortstr(args)
+				if err != nil || len(args) < 1+len(ctag)+9 {
+					return errAmqpFrame
+				}
+				rest := args[1+len(ctag):]
+				deliveryTag, rest = binary.BigEndian.Uint64(rest), rest[9:]
+				exchange, err := amqpReadShortstr(rest)
+				if err != nil {
+					return err
+				}
+				if routingKey, err = amqpReadShortstr(rest[1+len(exchange):]); err != nil {
+					return err
+				}
+				inMessage, body = true, nil
+			case amqpConnectionClose, amqpChannelClose:
+				return c.closed(id, channel, args)
+			}
+		case amqpFrameHeader:
+			if !inMessage || len(payload) < 12 {
+				return errAmqpFrame
+			}
+			size = binary.BigEndian.Uint64(payload[4:12])
+			body = make([]byte, 0, size)
+		case amqpFrameBody:
+			if !inMessage {
+				return errAmqpFrame
+			}
+			body = append(body, payload...)
+		default:
+			return fmt.Errorf("unexpected AMQP frame type %d", typ)
+		}
+
+		if inMessage && body != nil && uint64(len(body)) >= size {
+			inMessage = false
+			handle(routingKey, body)
+			var b amqpArgs
+			b.longlong(deliveryTag)
+			b.WriteByte(0)
+			if err := c.method(1, amqpBasicAck, b.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// amqpArgs encodes method arguments.
+type amqpArgs struct{ bytes.Buffer }
+
+func (b *amqpArgs) short(n uint16)    { binary.Write(b, binary.BigEndian, n) }
+func (b *amqpArgs) long(n uint32)     { binary.Write(b, binary.BigEndian, n) }
+func (b *amqpArgs) longlong(n uint64) { binary.Write(b, binary.BigEndian, n) }
+
+func (b *amqpArgs) shortstr(s string) {
+	b.WriteByte(byte(len(s)))
+	b.WriteString(s)
+}
+
+func (b *amqpArgs) longstr(s string) {
+	b.long(uint32(len(s)))
+	b.WriteString(s)
+}
+
+// table encodes a field table of (long) strings.
+func (b *amqpArgs) table(fields map[string]string) {
+	var t amqpArgs
+	for k, v := range fields {
+		t.shortstr(k)
+		t.WriteByte('S')
+		t.longstr(v)
+	}
+	b.long(uint32(t.Len()))
+	b.Write(t.Bytes())
+}
+
+func amqpReadShortstr(b []byte) (string, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return "", errAmqpFrame
+	}
+	return string(b[1 : 1+int(b[0])]), nil
+}
+
+// parseAmqpURL parses an "amqp://[user[:password]@]host[:port][/vhost]"
+// URL, the port defaults to 5672 and the credentials to guest.
+func parseAmqpURL(s string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "amqp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid amqp-url: %v", err)
+	}
+	if u.Scheme != "amqp" || u.Host == "" {
+		return nil, fmt.Errorf("invalid amqp-url: %q (expected amqp://host:port/vhost)", s)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "5672")
+	}
+	return u, nil
+}
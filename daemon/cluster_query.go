@@ -0,0 +1,183 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/series"
+)
+
+// The cluster stream of the RRA data of DSs, see rraQuery.
+const rraStream = "rra"
+
+// How long the node of DSs has to answer (every part of) an RRA
+// stream request, after which the series come from the database.
+const rraStreamTimeout = 10 * time.Second
+
+// rraQuery is the request of the RRA data of DSs between From and To
+// at a Step, or, if Step is 0, of at most MaxPoints. The reply is a
+// stream of a remoteSeries for every ident, as the node has them.
+type rraQuery struct {
+	Idents    []serde.Ident
+	From, To  time.Time
+	Step      time.Duration
+	MaxPoints int64
+}
+
+// remoteSeries is a series as sent over the cluster, Start is the
+// time of the first point, N the position of its ident.
+type remoteSeries struct {
+	N      int
+	Start  time.Time
+	Step   time.Duration
+	Values []float64
+}
+
+type seriesClusterer interface {
+	NodesForId(id int64) []*cluster.Node
+	LocalNode() *cluster.Node
+	Members() []*cluster.Node
+	HandleStreams(name string, h cluster.StreamHandler)
+	RequestStream(dst *cluster.Node, name string, payload interface{}, recv func(*cluster.Msg) error, timeout time.Duration) error
+}
+
+type localSeriesFetcher interface {
+	FetchLocalDataSource(ident serde.Ident) (rrd.DataSourcer, error)
+	FetchLocalSeriesBatch(dss []rrd.DataSourcer, from, to time.Time, maxPoints int64) ([]series.Series, error)
+}
+
+// clusterSeriesFetcher is the dsl.RemoteFetcher of a cluster: the
+// series of a DS owned by another node are streamed from it (as it
+// has the points not yet flushed) and it streams the series of its
+// own DSs, see rraQuery.
+type clusterSeriesFetcher struct {
+	c     seriesClusterer
+	local localSeriesFetcher
+}
+
+func newClusterSeriesFetcher(c seriesClusterer, local localSeriesFetcher) *clusterSeriesFetcher {
+	f := &clusterSeriesFetcher{c: c, local: local}
+	c.HandleStreams(rraStream, f.serve)
+	return f
+}
+
+// Owner is the first of the nodes of the DS, unless this node is one
+// of them, i.e. a replica, see cluster-replicas.
+func (f *clusterSeriesFetcher) Owner(id int64) string {
+	nodes := f.c.NodesForId(id)
+	if len(nodes) == 0 {
+		return ""
+	}
+	ln := f.c.LocalNode()
+	for _, node := range nodes {
+		if node.Name() == ln.Name() {
+			return ""
+		}
+	}
+	return nodes[0].Name()
+}
+
+func (f *clusterSeriesFetcher) FetchRemoteSeries(node string, idents []serde.Ident, from, to time.Time, maxPoints int64) ([]series.Series, error) {
+	var dst *cluster.Node
+	for _, n := range f.c.Members() {
+		if n.Name() == node {
+			dst = n
+		}
+	}
+	if dst == nil || !dst.Ready() {
+		return nil, fmt.Errorf("node %s is not ready", node)
+	}
+
+	result := make([]series.Series, len(idents))
+	q := &rraQuery{Idents: idents, From: from, To: to, MaxPoints: maxPoints}
+	err := f.c.RequestStream(dst, rraStream, q, func(chunk *cluster.Msg) error {
+		var rs remoteSeries
+		if err := chunk.Decode(&rs); err != nil {
+			return err
+		}
+		if rs.N < 0 || rs.N >= len(result) {
+			return fmt.Errorf("series %d of %d", rs.N, len(result))
+		}
+		result[rs.N] = series.NewSliceSeries(rs.Values, rs.Start, rs.Step)
+		return nil
+	}, rraStreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range result {
+		if s == nil {
+			return nil, fmt.Errorf("no series for %s", idents[i])
+		}
+	}
+	return result, nil
+}
+
+// serve streams the RRA data of the DSs as this node has them, i.e.
+// from its cache or the database, a DS that does not exist is an
+// empty series.
+func (f *clusterSeriesFetcher) serve(req *cluster.Msg, send func(interface{}) error) error {
+	var q rraQuery
+	if err := req.Decode(&q); err != nil {
+		return err
+	}
+	maxPoints := q.MaxPoints
+	if q.Step > 0 {
+		maxPoints = int64(q.To.Sub(q.From)/q.Step) + 1
+	}
+	var (
+		dss []rrd.DataSourcer
+		idx []int
+	)
+	for i, ident := range q.Idents {
+		ds, err := f.local.FetchLocalDataSource(ident)
+		if err != nil {
+			return err
+		}
+		if ds != nil {
+			dss = append(dss, ds)
+			idx = append(idx, i)
+		} else if err := send(&remoteSeries{N: i}); err != nil {
+			return err
+		}
+	}
+	sers, err := f.local.FetchLocalSeriesBatch(dss, q.From, q.To, maxPoints)
+	if err != nil {
+		return err
+	}
+	for i, s := range sers {
+		if err := send(toRemoteSeries(idx[i], s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func toRemoteSeries(n int, s series.Series) *remoteSeries {
+	defer s.Close()
+	rs := &remoteSeries{N: n, Step: s.Step()}
+	for s.Next() {
+		if rs.Values == nil {
+			rs.Start = s.CurrentTime()
+		}
+		rs.Values = append(rs.Values, s.CurrentValue())
+	}
+	return rs
+}
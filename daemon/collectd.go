@@ -0,0 +1,135 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tgres/tgres/collectd"
+	"github.com/tgres/tgres/receiver"
+)
+
+// collectdServiceManager accepts data points in the collectd binary
+// network protocol over UDP.
+type collectdServiceManager struct {
+	rcvr       *receiver.Receiver
+	listenSpec string
+	parser     *collectd.Parser
+	naming     collectd.Naming
+	prefix     string
+	types      collectd.TypesDB
+	conn       net.Conn
+	stop       int32
+}
+
+func (g *collectdServiceManager) Stop() {
+	if g.stopped() {
+		return
+	}
+	if g.conn != nil {
+		log.Printf("Closing UDP listener %s", g.listenSpec)
+		g.conn.Close()
+	}
+	atomic.StoreInt32(&(g.stop), 1)
+}
+
+func (g *collectdServiceManager) stopped() bool {
+	return atomic.LoadInt32(&(g.stop)) != 0
+}
+
+func (g *collectdServiceManager) File() *os.File {
+	if g.conn != nil {
+		f, _ := g.conn.(*net.UDPConn).File()
+		return f
+	}
+	return nil
+}
+
+func (g *collectdServiceManager) Start(file *os.File) error {
+	var (
+		err     error
+		udpAddr *net.UDPAddr
+	)
+
+	if g.listenSpec != "" {
+		if file != nil {
+			g.conn, err = net.FileConn(file)
+		} else {
+			udpAddr, err = net.ResolveUDPAddr("udp", processListenSpec(g.listenSpec))
+			if err == nil {
+				g.conn, err = net.ListenUDP("udp", udpAddr)
+			}
+		}
+	} else {
+		log.Printf("Not starting collectd protocol because collectd-listen-spec is blank.")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error starting collectd protocol serviceManager: %v", err)
+	}
+
+	log.Printf("collectd protocol Listening on %s (security level: %v, naming: %v)\n", processListenSpec(g.listenSpec), g.parser.SecurityLevel, g.naming)
+
+	go g.handleCollectdProtocol(g.conn)
+
+	return nil
+}
+
+func (g *collectdServiceManager) handleCollectdProtocol(conn net.Conn) {
+	defer conn.Close()
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed") {
+				log.Printf("handleCollectdProtocol(): Error reading: %v", err)
+			}
+			return
+		}
+
+		vls, err := g.parser.Parse(buf[:n])
+		if err != nil {
+			log.Printf("handleCollectdProtocol(): %v", err)
+			g.rcvr.RecordDropped(receiver.DeadParse, fmt.Sprintf("collectd packet of %d bytes: %v", n, err))
+		}
+		for _, vl := range vls {
+			ts := vl.Time
+			if ts.IsZero() {
+				ts = time.Now()
+			}
+			ts, ok := g.rcvr.ListenerTime("collectd_udp", ts)
+			if !ok || !g.rcvr.AcquireListenerInput("collectd_udp", "", len(vl.Values)) {
+				continue
+			}
+			for i, ident := range vl.Idents(g.naming, g.prefix, g.types) {
+				ident["name"] = g.rcvr.ListenerName("collectd_udp", ident["name"])
+				g.rcvr.QueueDataPoint(ident, ts, vl.Values[i].Value)
+			}
+			g.rcvr.CountListenerInput("collectd_udp", len(vl.Values))
+		}
+
+		if g.stopped() {
+			return
+		}
+	}
+}
@@ -16,20 +16,34 @@
 package daemon
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/mem"
+	"github.com/tgres/tgres/aggregator"
+	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/collectd"
 	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/receiver"
 	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/tier"
 )
 
 type Config struct { // Needs to be exported for TOML to work
@@ -37,22 +51,166 @@ type Config struct { // Needs to be exported for TOML to work
 	LogPath                  string   `toml:"log-file"`
 	LogCycle                 duration `toml:"log-cycle-interval"`
 	DbConnectString          string   `toml:"db-connect-string"`
+	DbDriver                 string   `toml:"db-driver"`
 	PgSegmentWidth           int      `toml:"pg-segment-width"`
+	PgCoveringIndexes        bool     `toml:"pg-covering-indexes"`
+	PgBrinIndexes            bool     `toml:"pg-brin-indexes"`
+	PgTsCompression          string   `toml:"pg-ts-compression"`
+	PgSchemaCompat           bool     `toml:"pg-schema-compat"`
 	MinStep                  duration `toml:"min-step"`
 	MaxReceiverQueueSize     int      `toml:"max-receiver-queue-size"`
+	ReceiverQueueOverflow    string   `toml:"receiver-queue-overflow-policy"`
 	MaxMemoryBytes           int      `toml:"max-memory-bytes"`
+	BackfillWindow           duration `toml:"backfill-window"`
+	ClusterMaxHops           int      `toml:"cluster-max-hops"`
+	ClusterMaxForwards       int      `toml:"cluster-max-forwards"`
+	ClusterReplicas          int      `toml:"cluster-replicas"`
+	ClusterTransitionRate    int      `toml:"cluster-transition-rate"`
+	ClusterNodeWeight        string   `toml:"cluster-node-weight"`
+	ClusterSecretKeyFile     string   `toml:"cluster-secret-key-file"`
+	ClusterTLSCertFile       string   `toml:"cluster-tls-cert-file"`
+	ClusterTLSKeyFile        string   `toml:"cluster-tls-key-file"`
+	ClusterTLSCAFile         string   `toml:"cluster-tls-ca-file"`
+	ClusterJoinTokenFile     string   `toml:"cluster-join-token-file"`
+	ClusterSeeds             []string `toml:"cluster-seeds"`
+	ClusterSeedInterval      duration `toml:"cluster-seed-interval"`
+	ClusterForwardRetrySize  int      `toml:"cluster-forward-retry-size"`
+	ClusterSendQueueSize     int      `toml:"cluster-send-queue-size"`
+	ClusterSpoolDir          string   `toml:"cluster-spool-dir"`
+	ClusterSpoolMaxSize      int      `toml:"cluster-spool-max-size"`
+	ClusterSpoolMaxAge       duration `toml:"cluster-spool-max-age"`
+	ColdStorageURL           string   `toml:"cold-storage-url"`
+	ColdStorageEndpoint      string   `toml:"cold-storage-endpoint"`
+	ColdStorageRegion        string   `toml:"cold-storage-region"`
+	ColdStorageAccessKey     string   `toml:"cold-storage-access-key"`
+	ColdStorageSecretKey     string   `toml:"cold-storage-secret-key"`
+	ColdAge                  duration `toml:"cold-age"`
+	ColdInterval             duration `toml:"cold-interval"`
 	GraphiteTextListenSpec   string   `toml:"graphite-text-listen-spec"`
 	GraphiteUdpListenSpec    string   `toml:"graphite-udp-listen-spec"`
 	GraphitePickleListenSpec string   `toml:"graphite-pickle-listen-spec"`
 	StatsdTextListenSpec     string   `toml:"statsd-text-listen-spec"`
 	StatsdUdpListenSpec      string   `toml:"statsd-udp-listen-spec"`
+	OpentsdbTelnetListenSpec string   `toml:"opentsdb-telnet-listen-spec"`
+	CollectdListenSpec       string   `toml:"collectd-listen-spec"`
 	HttpListenSpec           string   `toml:"http-listen-spec"`
 	HttpAllowOrigin          string   `toml:"http-allow-origin"`
+	HttpAdminToken           string   `toml:"http-admin-token"`
 	QueryCacheSize           int      `toml:"query-cache-size"`
 	Workers                  int
 	DSs                      []ConfigDSSpec `toml:"ds"`
+	DSRulesFile              string         `toml:"ds-rules-file"`
 	StatFlush                duration       `toml:"stat-flush-interval"`
 	StatsNamePrefix          string         `toml:"stats-name-prefix"`
+	MaxNewDSs                int            `toml:"max-new-ds-per-interval"`
+	MaxNewDSsByPrefix        map[string]int `toml:"max-new-ds-by-prefix"`
+	NewDSInterval            duration       `toml:"new-ds-interval"`
+	Whitelist                []regex        `toml:"whitelist"`
+	Blacklist                []regex        `toml:"blacklist"`
+	Rewrites                 []rewrite      `toml:"rewrite"`
+	PreAggregates            []preAggregate `toml:"pre-aggregate"`
+	NameTemplates            []string       `toml:"name-templates"`
+	CreateBreakerMaxSeries   int            `toml:"ds-create-breaker-max-series"`
+	CreateBreakerMaxRate     int            `toml:"ds-create-breaker-max-rate"`
+	CreateBreakerInterval    duration       `toml:"ds-create-breaker-interval"`
+	CreateBreakerCooldown    duration       `toml:"ds-create-breaker-cooldown"`
+	LoadRetries              int            `toml:"db-load-retries"`
+	DBBreakerThreshold       int            `toml:"db-breaker-threshold"`
+	AggOutputs               []aggOutputs   `toml:"aggregator-outputs"`
+	AggHistograms            []aggHistogram `toml:"aggregator-histogram"`
+	StatsdThresholds         []int          `toml:"statsd-percent-thresholds"`
+	StatsdTimerAggregates    []string       `toml:"statsd-timer-aggregates"`
+	StatsdThresholdAggs      []string       `toml:"statsd-threshold-aggregates"`
+	StatsdThresholdSep       string         `toml:"statsd-threshold-separator"`
+	FlushWorkers             int            `toml:"flush-workers"`
+	FlushSharding            string         `toml:"flush-sharding"`
+	FlushBatchSize           int            `toml:"flush-batch-size"`
+	FlushBatchDelay          duration       `toml:"flush-batch-max-delay"`
+	PgFlushValuesWidth       int            `toml:"pg-flush-values-width"`
+	FlushTargetLatency       duration       `toml:"flush-target-latency"`
+	FlushMaxStretch          float64        `toml:"flush-max-stretch"`
+	DSCacheMaxMemory         int            `toml:"ds-cache-max-memory"`
+	DSCacheMinIdle           duration       `toml:"ds-cache-min-idle"`
+	DSStaleAfter             duration       `toml:"ds-stale-after"`
+	DSRetention              duration       `toml:"ds-retention"`
+	DSRetentionByPrefix      durationMap    `toml:"ds-retention-by-prefix"`
+	DSRetentionDryRun        bool           `toml:"ds-retention-dry-run"`
+	DSArchiveStale           bool           `toml:"ds-archive-stale"`
+	FsFindIncludeArchived    bool           `toml:"fs-find-include-archived"`
+	DeadLetterPath           string         `toml:"dead-letter-file"`
+	DeadLetterMaxSize        int            `toml:"dead-letter-max-size"`
+	ShutdownTimeout          duration       `toml:"shutdown-timeout"`
+	DbMaxConnections         int            `toml:"db-max-connections"`
+	DbQueryShare             float64        `toml:"db-query-share"`
+	DbMaxIdleConnections     int            `toml:"db-max-idle-connections"`
+	DbConnMaxLifetime        duration       `toml:"db-connection-max-lifetime"`
+	DbStatementTimeout       duration       `toml:"db-statement-timeout"`
+	DbReadReplicas           []string       `toml:"db-read-replicas"`
+	DbSSLMode                string         `toml:"db-ssl-mode"`
+	DbSSLCert                string         `toml:"db-ssl-cert"`
+	DbSSLKey                 string         `toml:"db-ssl-key"`
+	DbSSLRootCert            string         `toml:"db-ssl-root-cert"`
+	DbPasswordFile           string         `toml:"db-password-file"`
+	DbMaintenanceInterval    duration       `toml:"db-maintenance-interval"`
+	DuplicatePolicy          string         `toml:"duplicate-timestamp-policy"`
+	ListenerQuotas           map[string]int `toml:"listener-quotas"`
+	ListenerSourceQuota      int            `toml:"listener-source-quota"`
+	ListenerPrefixes         prefixMap      `toml:"listener-prefixes"`
+	ListenerTimestampPolicy  policyMap      `toml:"listener-timestamp-policy"`
+	ListenerMaxSkew          skewMap        `toml:"listener-max-skew"`
+	ListenerQuotaPolicy      string         `toml:"listener-quota-policy"`
+	CollectdSecurityLevel    string         `toml:"collectd-security-level"`
+	CollectdAuthFile         string         `toml:"collectd-auth-file"`
+	CollectdTypesDB          string         `toml:"collectd-typesdb"`
+	CollectdNaming           string         `toml:"collectd-naming"`
+	CollectdPrefix           string         `toml:"collectd-prefix"`
+	NatsURL                  string         `toml:"nats-url"`
+	NatsSubscriptions        []natsSub      `toml:"nats-subscription"`
+	MqttURL                  string         `toml:"mqtt-url"`
+	MqttClientID             string         `toml:"mqtt-client-id"`
+	MqttSubscriptions        []mqttSub      `toml:"mqtt-subscription"`
+	AmqpURL                  string         `toml:"amqp-url"`
+	AmqpExchange             string         `toml:"amqp-exchange"`
+	AmqpExchangeType         string         `toml:"amqp-exchange-type"`
+	AmqpQueue                string         `toml:"amqp-queue"`
+	AmqpRoutingKeys          []string       `toml:"amqp-routing-keys"`
+	AmqpFormat               string         `toml:"amqp-format"`
+	AmqpRoutingKeyName       bool           `toml:"amqp-routing-key-name"`
+	AmqpPrefetch             int            `toml:"amqp-prefetch"`
+	TLSCertFile              string         `toml:"tls-cert-file"`
+	TLSKeyFile               string         `toml:"tls-key-file"`
+	TLSClientCAFile          string         `toml:"tls-client-ca-file"`
+	TLSListeners             []string       `toml:"tls-listeners"`
+	UDPReaders               int            `toml:"udp-readers"`
+	UnixSocketMode           string         `toml:"unix-socket-mode"`
+	ProxyProtocolListeners   []string       `toml:"proxy-protocol-listeners"`
+	ProxyProtocolTrusted     []string       `toml:"proxy-protocol-trusted"`
+	ListenerMaxConns         map[string]int `toml:"listener-max-connections"`
+	ListenerIdleTimeout      duration       `toml:"listener-idle-timeout"`
+	ListenerReadTimeout      duration       `toml:"listener-read-timeout"`
+	BackpressureListeners    []string       `toml:"backpressure-listeners"`
+	BackpressureQueueSize    int            `toml:"backpressure-queue-size"`
+	StrictListeners          []string       `toml:"strict-listeners"`
+	ParseErrorLogSample      int            `toml:"parse-error-log-sample"`
+	SpecListeners            []specListener `toml:"graphite-listener"`
+	Pipelines                []pipeline     `toml:"pipeline"`
+
+	queueOverflowPolicy receiver.QueueOverflowPolicy
+	flushShardFunc      receiver.FlushShardFunc
+	duplicatePolicy     receiver.DuplicatePolicy
+	quotaPolicy         receiver.QuotaPolicy
+	listenerTimestamps  map[string]receiver.ListenerTimestamps
+	nameTemplates       []*receiver.NameTemplate
+	collectdParser      *collectd.Parser
+	collectdTypes       collectd.TypesDB
+	collectdNaming      collectd.Naming
+	amqp                amqpConsumer
+	tlsConfig           *tls.Config
+	unixSocketMode      os.FileMode
+	proxyProtocol       *proxyProtocol
+	coldStore           tier.ObjectStore
+	clusterNodeWeight   float64
+	clusterEncryption   *cluster.Encryption
 }
 
 type regex struct{ *regexp.Regexp }
@@ -64,6 +222,20 @@ func (r *regex) UnmarshalText(text []byte) (err error) {
 
 type duration struct{ time.Duration }
 
+// prefixMap is name prefixes by listener, see processListenerPrefixes.
+type prefixMap map[string]string
+
+// policyMap is timestamp policies by listener, see
+// processListenerTimestamps.
+type policyMap map[string]string
+
+// skewMap is maximum clock skews by listener, see
+// processListenerTimestamps.
+type skewMap map[string]duration
+
+// durationMap is durations by name prefix, e.g. ds-retention-by-prefix.
+type durationMap map[string]duration
+
 func (d *duration) UnmarshalText(text []byte) (err error) {
 	d.Duration, err = time.ParseDuration(string(text))
 	return err
@@ -74,13 +246,112 @@ type ConfigDSSpec struct {
 	Regexp    regex
 	Step      duration
 	Heartbeat duration
+	Type      dsType
 	RRAs      []ConfigRRASpec
+	Xff       *float64 // default for RRAs that do not specify one
+
+	// Valid range of values, points outside it are dropped or
+	// clamped according to OutOfBounds ("drop" or "clamp").
+	Min         *float64
+	Max         *float64
+	OutOfBounds string `toml:"out-of-bounds"`
+
+	// What to do with NaN and ±Inf values: "drop" (default),
+	// "zero", "last" or "gap".
+	NaN string `toml:"nan"`
+}
+
+type dsType struct{ rrd.DSType }
+
+func (t *dsType) UnmarshalText(text []byte) error {
+	var err error
+	t.DSType, err = rrd.ParseDSType(string(text))
+	return err
+}
+
+type aggOutputs struct {
+	Prefix  string
+	Outputs []string
+}
+
+type rewrite struct {
+	Regexp      regex
+	Replacement string
+}
+
+type preAggregate struct {
+	Regexp   regex
+	Output   string
+	Function string
+	Interval duration
+
+	function receiver.PreAggregateFunc // parsed Function
+}
+
+// natsSub is a NATS subscription ([[nats-subscription]]), messages
+// are load balanced among the subscribers of the same queue group.
+type natsSub struct {
+	Subject    string
+	QueueGroup string `toml:"queue-group"`
+	Format     string
+
+	format payloadFormat // parsed Format
+}
+
+// mqttSub is an MQTT subscription ([[mqtt-subscription]]).
+type mqttSub struct {
+	Topic  string
+	QoS    int `toml:"qos"`
+	Format string
+	Name   string
+
+	value  bool          // Format is "value"
+	format payloadFormat // parsed Format otherwise
+}
+
+// pipeline is an additional receiver pipeline ([[pipeline]]) with
+// its own listeners, DS specs and database table prefix, everything
+// else is as configured for the main one.
+type pipeline struct {
+	Name                     string
+	DbPrefix                 string         `toml:"db-prefix"`
+	GraphiteTextListenSpec   string         `toml:"graphite-text-listen-spec"`
+	GraphiteUdpListenSpec    string         `toml:"graphite-udp-listen-spec"`
+	GraphitePickleListenSpec string         `toml:"graphite-pickle-listen-spec"`
+	StatsdTextListenSpec     string         `toml:"statsd-text-listen-spec"`
+	StatsdUdpListenSpec      string         `toml:"statsd-udp-listen-spec"`
+	OpentsdbTelnetListenSpec string         `toml:"opentsdb-telnet-listen-spec"`
+	DSs                      []ConfigDSSpec `toml:"ds"`
+	DSRulesFile              string         `toml:"ds-rules-file"`
+	ListenerPrefixes         prefixMap      `toml:"listener-prefixes"`
+
+	cfg *Config // the main config with the above applied
+}
+
+// specListener is an additional graphite text listener (TCP and/or
+// UDP) with its own DS specs, which new DSs for the points it
+// receives get before the main ones, see receiver.SetDSSpecSet.
+type specListener struct {
+	Name           string
+	TextListenSpec string         `toml:"text-listen-spec"`
+	UdpListenSpec  string         `toml:"udp-listen-spec"`
+	DSs            []ConfigDSSpec `toml:"ds"`
+	DSRulesFile    string         `toml:"ds-rules-file"`
+
+	cfg *Config // the DS specs, as the DSSpecFinder
 }
+
+type aggHistogram struct {
+	Regexp  regex
+	Buckets []float64
+}
+
 type ConfigRRASpec struct {
 	Function rrd.Consolidation
 	Step     time.Duration
 	Span     time.Duration
 	Xff      float64
+	xffSet   bool
 }
 
 func (r *ConfigRRASpec) UnmarshalText(text []byte) error {
@@ -129,6 +400,7 @@ func (r *ConfigRRASpec) UnmarshalText(text []byte) error {
 		if r.Xff, err = strconv.ParseFloat(parts[3], 64); err != nil {
 			return fmt.Errorf("Invalid XFF: %q (%v)", parts[3], err)
 		}
+		r.xffSet = true
 	}
 	return nil
 }
@@ -139,9 +411,56 @@ var readConfig = func(cfgPath string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if cfg.DSRulesFile, cfg.DSs, err = withDSRules(cfgPath, cfg.DSRulesFile, cfg.DSs); err != nil {
+		return nil, err
+	}
+	for i := range cfg.Pipelines {
+		p := &cfg.Pipelines[i]
+		if p.DSRulesFile, p.DSs, err = withDSRules(cfgPath, p.DSRulesFile, p.DSs); err != nil {
+			return nil, err
+		}
+	}
+	for i := range cfg.SpecListeners {
+		l := &cfg.SpecListeners[i]
+		if l.DSRulesFile, l.DSs, err = withDSRules(cfgPath, l.DSRulesFile, l.DSs); err != nil {
+			return nil, err
+		}
+	}
 	return cfg, nil
 }
 
+// withDSRules prepends the rules in the ds-rules-file at path, if
+// any, to dss; rules from the file are consulted before the [[ds]]
+// specs in the config itself. A relative path is relative to the
+// directory of the config file.
+func withDSRules(cfgPath, path string, dss []ConfigDSSpec) (string, []ConfigDSSpec, error) {
+	if path == "" {
+		return path, dss, nil
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(cfgPath), path)
+	}
+	rules, err := readDSRules(path)
+	if err != nil {
+		return path, nil, err
+	}
+	return path, append(rules, dss...), nil
+}
+
+// readDSRules reads the DS rules file, which consists of [[ds]]
+// sections in the same format as the main config, matched in order
+// when a DS is created.
+var readDSRules = func(path string) ([]ConfigDSSpec, error) {
+	var rules struct {
+		DSs []ConfigDSSpec `toml:"ds"`
+	}
+	if _, err := toml.DecodeFile(path, &rules); err != nil {
+		return nil, fmt.Errorf("ds-rules-file %q: %v", path, err)
+	}
+	log.Printf("Read %d DS rules from %q (ds-rules-file).", len(rules.DSs), path)
+	return rules.DSs, nil
+}
+
 func (c *Config) processConfigPidFile(wd string) error {
 	if c.PidPath == "" {
 		return fmt.Errorf("pid-file setting empty")
@@ -205,6 +524,30 @@ func (c *Config) processDbConnectString() error {
 	return nil
 }
 
+// processDbDriver checks that db-driver, if set, is a registered
+// serde driver, see serde.Register. Blank is the driver the connect
+// string names, see dbDriver.
+func (c *Config) processDbDriver() error {
+	if c.DbDriver == "" {
+		return nil
+	}
+	for _, d := range serde.Drivers() {
+		if d == c.DbDriver {
+			return nil
+		}
+	}
+	return fmt.Errorf("db-driver: unknown driver %q (must be one of: %s)", c.DbDriver, strings.Join(serde.Drivers(), ", "))
+}
+
+// dbDriver is the serde driver of the database.
+func (c *Config) dbDriver() string {
+	if c.DbDriver != "" {
+		return c.DbDriver
+	}
+	driver, _ := serde.ParseConnectString(c.DbConnectString)
+	return driver
+}
+
 func (c *Config) processMinStep() error {
 	if c.MinStep.Duration == 0 {
 		return fmt.Errorf("min-step is missing")
@@ -225,155 +568,1877 @@ func (c *Config) processMaxReceiverQueueSize() error {
 	return nil
 }
 
-func (c *Config) processMaxMemoryBytes() error {
-	if c.MaxMemoryBytes == 0 {
-		log.Printf("max-memory-bytes unspecified, defaults to 0 (unlimited)")
-	} else if c.MaxMemoryBytes <= 0 {
-		log.Printf("Max Memory (heap allocation bytes) is unlimited (%d) (max-memory-bytes).", c.MaxMemoryBytes)
-	} else {
-		log.Printf("Max Memory (heap allocation bytes) is limited to %d (max-memory-bytes).", c.MaxMemoryBytes)
+func (c *Config) processBackfillWindow() error {
+	if c.BackfillWindow.Duration < 0 {
+		return fmt.Errorf("backfill-window cannot be negative")
+	}
+	if c.BackfillWindow.Duration > 0 {
+		log.Printf("Data points up to %v out of order will be backfilled (backfill-window).", c.BackfillWindow.Duration)
 	}
 	return nil
 }
 
-func (c *Config) processPgSegmentWidth() error {
-	if c.PgSegmentWidth == 0 {
-		// do nothing and keep quiet about it since this is an "advanced" setting
-	} else if c.PgSegmentWidth <= 0 {
-		return fmt.Errorf("Invalid pg-segment-width: %d", c.PgSegmentWidth)
-	} else {
-		log.Printf("PG Segment Width is %d (pg-segment-width).", c.PgSegmentWidth)
-		serde.PgSegmentWidth = c.PgSegmentWidth
+func (c *Config) processClusterHops() error {
+	if c.ClusterMaxHops == 0 {
+		c.ClusterMaxHops = 2
+	}
+	if c.ClusterMaxForwards == 0 {
+		c.ClusterMaxForwards = 1
+	}
+	if c.ClusterMaxForwards < 0 || c.ClusterMaxHops < 0 {
+		return fmt.Errorf("cluster-max-hops and cluster-max-forwards cannot be negative")
+	}
+	if c.ClusterMaxForwards > c.ClusterMaxHops {
+		return fmt.Errorf("cluster-max-forwards (%d) cannot exceed cluster-max-hops (%d)", c.ClusterMaxForwards, c.ClusterMaxHops)
+	}
+	log.Printf("Cluster: up to %d hops allowed, points forwarded up to %d times (cluster-max-hops, cluster-max-forwards).", c.ClusterMaxHops, c.ClusterMaxForwards)
+	if c.ClusterForwardRetrySize < 0 || c.ClusterSendQueueSize < 0 {
+		return fmt.Errorf("cluster-forward-retry-size and cluster-send-queue-size cannot be negative")
 	}
 	return nil
 }
 
-func (c *Config) processStatFlushInterval() error {
-	if c.StatFlush.Duration == 0 {
-		return fmt.Errorf("stat-flush-interval is missing")
-	} else {
-		log.Printf("Stats (a la statsd) will be flushed every %v (stat-flush-interval).", c.StatFlush.Duration)
+// processClusterReplicas defaults cluster-replicas to 1, i.e. each DS
+// is owned by one node.
+func (c *Config) processClusterReplicas() error {
+	if c.ClusterReplicas == 0 {
+		c.ClusterReplicas = 1
+	}
+	if c.ClusterReplicas < 0 {
+		return fmt.Errorf("cluster-replicas cannot be negative")
+	}
+	if c.ClusterReplicas > 1 {
+		log.Printf("Cluster: every DS is owned by %d nodes (cluster-replicas).", c.ClusterReplicas)
 	}
 	return nil
 }
 
-func (c *Config) processStatsNamePrefix() error {
-	if c.StatsNamePrefix == "" {
-		log.Printf("stats-name-prefix is empty, defaulting to 'stats'")
-		c.StatsNamePrefix = "stats"
+// processClusterTransitionRate checks cluster-transition-rate, 0 is
+// unlimited.
+func (c *Config) processClusterTransitionRate() error {
+	if c.ClusterTransitionRate < 0 {
+		return fmt.Errorf("cluster-transition-rate cannot be negative")
+	}
+	if c.ClusterTransitionRate > 0 {
+		log.Printf("Cluster: DSs move to other nodes at up to %d per second (cluster-transition-rate).", c.ClusterTransitionRate)
+	}
+	return nil
+}
 
+// processClusterNodeWeight parses cluster-node-weight, a number, or
+// "memory" or "disk" for the GiB of RAM or of the disk of the working
+// directory. Blank is the default of 1.
+func (c *Config) processClusterNodeWeight(wd string) error {
+	const gib = 1 << 30
+	switch c.ClusterNodeWeight {
+	case "":
+		c.clusterNodeWeight = 1
+		return nil
+	case "memory":
+		vm, err := mem.VirtualMemory()
+		if err != nil {
+			return fmt.Errorf("cluster-node-weight: unable to determine the memory size: %v", err)
+		}
+		c.clusterNodeWeight = float64(vm.Total) / gib
+	case "disk":
+		du, err := disk.Usage(wd)
+		if err != nil {
+			return fmt.Errorf("cluster-node-weight: unable to determine the size of the disk of %q: %v", wd, err)
+		}
+		c.clusterNodeWeight = float64(du.Total) / gib
+	default:
+		w, err := strconv.ParseFloat(c.ClusterNodeWeight, 64)
+		if err != nil {
+			return fmt.Errorf("cluster-node-weight must be a number, memory or disk: %q", c.ClusterNodeWeight)
+		}
+		c.clusterNodeWeight = w
 	}
+	if c.clusterNodeWeight <= 0 {
+		return fmt.Errorf("cluster-node-weight must be positive: %q", c.ClusterNodeWeight)
+	}
+	log.Printf("Cluster: this node has a weight of %.2f (cluster-node-weight).", c.clusterNodeWeight)
 	return nil
 }
 
-func (c *Config) processWorkers() error {
-	if c.Workers == 0 {
-		return fmt.Errorf("workers missing, must be an integer")
+// processClusterEncryption sets up the encryption of the cluster
+// traffic. The gossip is encrypted with the base64 AES key (of 16, 24
+// or 32 bytes) in cluster-secret-key-file, the connections between
+// nodes use TLS with the cluster-tls-cert-file and
+// cluster-tls-key-file, and require the certificates of the other
+// nodes to be signed by the cluster-tls-ca-file. All nodes must have
+// the same settings.
+func (c *Config) processClusterEncryption(wd string) error {
+	c.clusterEncryption = nil
+	if c.ClusterSecretKeyFile == "" && c.ClusterTLSCertFile == "" && c.ClusterTLSKeyFile == "" && c.ClusterTLSCAFile == "" {
+		return nil
 	}
-	log.Printf("Number of workers (and flushers) will be %d.", c.Workers)
+	path := func(p string) string {
+		if p != "" && !filepath.IsAbs(p) {
+			return filepath.Join(wd, p)
+		}
+		return p
+	}
+
+	enc := &cluster.Encryption{}
+	if c.ClusterSecretKeyFile != "" {
+		b, err := ioutil.ReadFile(path(c.ClusterSecretKeyFile))
+		if err != nil {
+			return fmt.Errorf("cluster-secret-key-file: %v", err)
+		}
+		if enc.SecretKey, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(b))); err != nil {
+			return fmt.Errorf("cluster-secret-key-file: not base64: %v", err)
+		}
+		if n := len(enc.SecretKey); n != 16 && n != 24 && n != 32 {
+			return fmt.Errorf("cluster-secret-key-file: the key must be of 16, 24 or 32 bytes, not %d", n)
+		}
+	}
+	if c.ClusterTLSCertFile != "" || c.ClusterTLSKeyFile != "" || c.ClusterTLSCAFile != "" {
+		if c.ClusterTLSCertFile == "" || c.ClusterTLSKeyFile == "" || c.ClusterTLSCAFile == "" {
+			return fmt.Errorf("cluster TLS requires a cluster-tls-cert-file, a cluster-tls-key-file and a cluster-tls-ca-file")
+		}
+		cert, err := tls.LoadX509KeyPair(path(c.ClusterTLSCertFile), path(c.ClusterTLSKeyFile))
+		if err != nil {
+			return fmt.Errorf("cluster-tls-cert-file, cluster-tls-key-file: %v", err)
+		}
+		pem, err := ioutil.ReadFile(path(c.ClusterTLSCAFile))
+		if err != nil {
+			return fmt.Errorf("cluster-tls-ca-file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("cluster-tls-ca-file: no certificates found in %q", c.ClusterTLSCAFile)
+		}
+		enc.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      pool,
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+	c.clusterEncryption = enc
+	log.Printf("Cluster: gossip encrypted: %v, TLS between nodes: %v (cluster-secret-key-file, cluster-tls-*).", enc.SecretKey != nil, enc.TLSConfig != nil)
 	return nil
 }
 
-func (c *Config) processDSSpec() error {
-	// TODO validate function, regular expression, all that
-	for _, ds := range c.DSs {
-		for _, rra := range ds.RRAs {
-			if (rra.Step.Nanoseconds() % c.MinStep.Nanoseconds()) != 0 {
-				return fmt.Errorf("DS %q: invalid Step (%v), must be one or multiple min-step (%v).", ds.Regexp.String(), rra.Step, c.MinStep)
-			}
-			if (rra.Step.Nanoseconds() % ds.Step.Duration.Nanoseconds()) != 0 {
-				newStep := time.Duration(rra.Step.Nanoseconds()/ds.Step.Duration.Nanoseconds()*ds.Step.Duration.Nanoseconds()) * time.Nanosecond
-				log.Printf("DS %q: RRA step (%v) is not a multiple of DS Step (%v), auto adjusting Step to %v.", ds.Regexp.String(), rra.Step, ds.Step.Duration, newStep)
-				if newStep.Nanoseconds() == 0 {
-					return fmt.Errorf("DS %q: invalid Step (%v)", ds.Regexp.String(), newStep)
-				}
-				rra.Step = newStep
-			}
+// processClusterJoinToken reads the token nodes must share to join
+// the cluster from cluster-join-token-file, leading and trailing
+// whitespace is ignored. It must follow processClusterEncryption.
+func (c *Config) processClusterJoinToken(wd string) error {
+	if c.ClusterJoinTokenFile == "" {
+		return nil
+	}
+	p := c.ClusterJoinTokenFile
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(wd, p)
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return fmt.Errorf("cluster-join-token-file: %v", err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return fmt.Errorf("cluster-join-token-file: %q is empty", c.ClusterJoinTokenFile)
+	}
+	if c.clusterEncryption == nil {
+		c.clusterEncryption = &cluster.Encryption{}
+	}
+	c.clusterEncryption.JoinToken = []byte(token)
+	log.Printf("Cluster: only nodes with the same token can join (cluster-join-token-file).")
+	return nil
+}
+
+// processClusterSeeds checks the cluster-seeds and defaults the
+// cluster-seed-interval at which they are re-resolved to a minute.
+func (c *Config) processClusterSeeds() error {
+	if c.ClusterSeedInterval.Duration < 0 {
+		return fmt.Errorf("cluster-seed-interval cannot be negative")
+	}
+	if len(c.ClusterSeeds) == 0 {
+		return nil
+	}
+	for _, seed := range c.ClusterSeeds {
+		if name := strings.TrimPrefix(strings.TrimPrefix(strings.TrimPrefix(seed, srvSeedPrefix), k8sServiceSeedPrefix), k8sPodsSeedPrefix); name == "" {
+			return fmt.Errorf("cluster-seeds: invalid seed %q", seed)
 		}
 	}
-	// TODO xff?
+	if c.ClusterSeedInterval.Duration == 0 {
+		c.ClusterSeedInterval.Duration = time.Minute
+	}
+	log.Printf("Cluster: joining %s, re-resolved every %v (cluster-seeds, cluster-seed-interval).", strings.Join(c.ClusterSeeds, ", "), c.ClusterSeedInterval.Duration)
 	return nil
 }
 
-func (c *Config) FindMatchingDSSpec(ident serde.Ident) *rrd.DSSpec {
-	for _, dsSpec := range c.DSs {
-		name := ident["name"]
-		if dsSpec.Regexp.Regexp.MatchString(name) {
-			return convertDSSpec(&dsSpec)
+func (c *Config) processNewDSLimits() error {
+	if c.MaxNewDSs < 0 {
+		return fmt.Errorf("max-new-ds-per-interval cannot be negative")
+	}
+	for prefix, limit := range c.MaxNewDSsByPrefix {
+		if limit < 0 {
+			return fmt.Errorf("max-new-ds-by-prefix for %q cannot be negative", prefix)
 		}
 	}
+	if c.NewDSInterval.Duration == 0 {
+		c.NewDSInterval.Duration = time.Minute
+	}
+	if c.MaxNewDSs > 0 {
+		log.Printf("At most %d new data sources per %v (max-new-ds-per-interval).", c.MaxNewDSs, c.NewDSInterval.Duration)
+	}
+	for prefix, limit := range c.MaxNewDSsByPrefix {
+		log.Printf("At most %d new data sources per %v with prefix %q (max-new-ds-by-prefix).", limit, c.NewDSInterval.Duration, prefix)
+	}
 	return nil
 }
 
-func convertDSSpec(dsSpec *ConfigDSSpec) *rrd.DSSpec {
-	serdeDSSpec := &rrd.DSSpec{
-		Step:      dsSpec.Step.Duration,
-		Heartbeat: dsSpec.Heartbeat.Duration,
-		RRAs:      make([]rrd.RRASpec, len(dsSpec.RRAs)),
+func (c *Config) processCreateBreaker() error {
+	if c.CreateBreakerMaxSeries < 0 || c.CreateBreakerMaxRate < 0 {
+		return fmt.Errorf("ds-create-breaker-max-series and ds-create-breaker-max-rate cannot be negative")
 	}
-	for i, r := range dsSpec.RRAs {
-		serdeDSSpec.RRAs[i] = rrd.RRASpec{
-			Function: r.Function,
-			Step:     r.Step,
-			Span:     r.Span,
-			Xff:      float32(r.Xff),
+	if c.CreateBreakerInterval.Duration < 0 || c.CreateBreakerCooldown.Duration < 0 {
+		return fmt.Errorf("ds-create-breaker-interval and ds-create-breaker-cooldown cannot be negative")
+	}
+	if c.CreateBreakerInterval.Duration == 0 {
+		c.CreateBreakerInterval.Duration = time.Minute
+	}
+	if c.CreateBreakerCooldown.Duration == 0 {
+		c.CreateBreakerCooldown.Duration = 5 * time.Minute
+	}
+	if c.CreateBreakerMaxSeries > 0 {
+		log.Printf("No new data sources will be created beyond %d series (ds-create-breaker-max-series).", c.CreateBreakerMaxSeries)
+	}
+	if c.CreateBreakerMaxRate > 0 {
+		log.Printf("No new data sources will be created for %v after more than %d per %v are created (ds-create-breaker-max-rate).",
+			c.CreateBreakerCooldown.Duration, c.CreateBreakerMaxRate, c.CreateBreakerInterval.Duration)
+	}
+	return nil
+}
+
+func (c *Config) processLoadRetries() error {
+	if c.LoadRetries == 0 {
+		c.LoadRetries = 3
+	}
+	if c.DBBreakerThreshold == 0 {
+		c.DBBreakerThreshold = 5
+	}
+	if c.LoadRetries > 0 {
+		log.Printf("Loading a data source will be retried up to %d times on database errors (db-load-retries).", c.LoadRetries)
+	}
+	if c.DBBreakerThreshold > 0 {
+		log.Printf("Loading data sources will pause after %d consecutive database errors (db-breaker-threshold).", c.DBBreakerThreshold)
+	}
+	return nil
+}
+
+func (c *Config) processFilters() error {
+	for _, re := range c.Whitelist {
+		log.Printf("Only data points matching %q will be accepted (whitelist).", re.String())
+	}
+	for n, re := range c.Blacklist {
+		log.Printf("Data points matching %q will be rejected (blacklist rule %d).", re.String(), n)
+	}
+	return nil
+}
+
+func (c *Config) processRewrites() error {
+	for n, rw := range c.Rewrites {
+		if rw.Regexp.Regexp == nil {
+			return fmt.Errorf("rewrite rule %d: regexp missing", n)
 		}
+		log.Printf("Data point names matching %q will be rewritten as %q (rewrite).", rw.Regexp.String(), rw.Replacement)
 	}
-	return serdeDSSpec
+	return nil
 }
 
-type configer interface {
-	processConfigPidFile(string) error
-	processConfigLogFile(string) error
-	processConfigLogCycleInterval() error
-	processDbConnectString() error
-	processMinStep() error
-	processMaxReceiverQueueSize() error
-	processMaxMemoryBytes() error
-	processPgSegmentWidth() error
-	processStatFlushInterval() error
-	processStatsNamePrefix() error
-	processWorkers() error
-	processDSSpec() error
+func (c *Config) processPreAggregates() error {
+	for n, pa := range c.PreAggregates {
+		if pa.Regexp.Regexp == nil {
+			return fmt.Errorf("pre-aggregate rule %d: regexp missing", n)
+		}
+		if pa.Output == "" {
+			return fmt.Errorf("pre-aggregate rule %d: output missing", n)
+		}
+		if pa.Function == "" {
+			pa.Function = "sum"
+		}
+		f, err := receiver.ParsePreAggregateFunc(pa.Function)
+		if err != nil {
+			return fmt.Errorf("pre-aggregate rule %d: %v", n, err)
+		}
+		if pa.Interval.Duration < 0 {
+			return fmt.Errorf("pre-aggregate rule %d: interval cannot be negative", n)
+		}
+		c.PreAggregates[n].function = f
+		log.Printf("Data points matching %q will be aggregated (%v) as %q (pre-aggregate).", pa.Regexp.String(), f, pa.Output)
+	}
+	return nil
 }
 
-var processConfig = func(c configer, wd string) error {
+func (c *Config) processNameTemplates() error {
+	c.nameTemplates = nil
+	for _, s := range c.NameTemplates {
+		t, err := receiver.ParseNameTemplate(s)
+		if err != nil {
+			return err
+		}
+		log.Printf("Fields will be extracted from data point names matching %q (name-templates).", s)
+		c.nameTemplates = append(c.nameTemplates, t)
+	}
+	return nil
+}
 
-	if err := c.processConfigPidFile(wd); err != nil {
-		return err
+func (c *Config) processAggOutputs() error {
+	for _, spec := range c.AggOutputs {
+		if len(spec.Outputs) == 0 {
+			return fmt.Errorf("aggregator-outputs for prefix %q: no outputs specified", spec.Prefix)
+		}
+		for _, output := range spec.Outputs {
+			if err := aggregator.ValidateOutput(output); err != nil {
+				return fmt.Errorf("aggregator-outputs for prefix %q: %v", spec.Prefix, err)
+			}
+		}
+		log.Printf("Timers with prefix %q will be flushed as %s (aggregator-outputs).", spec.Prefix, strings.Join(spec.Outputs, ", "))
 	}
-	if err := c.processConfigLogFile(wd); err != nil {
-		return err
+	return nil
+}
+
+func (c *Config) processAggHistograms() error {
+	for _, h := range c.AggHistograms {
+		if h.Regexp.Regexp == nil {
+			return fmt.Errorf("aggregator-histogram: regexp missing")
+		}
+		if len(h.Buckets) == 0 {
+			return fmt.Errorf("aggregator-histogram %q: no buckets specified", h.Regexp.String())
+		}
+		for i := 1; i < len(h.Buckets); i++ {
+			if h.Buckets[i] <= h.Buckets[i-1] {
+				return fmt.Errorf("aggregator-histogram %q: buckets must be in ascending order", h.Regexp.String())
+			}
+		}
+		log.Printf("Timers matching %q will have histogram buckets %v (aggregator-histogram).", h.Regexp.String(), h.Buckets)
 	}
-	if err := c.processConfigLogCycleInterval(); err != nil {
-		return err
+	return nil
+}
+
+func (c *Config) processStatsdTimers() error {
+	for _, threshold := range c.StatsdThresholds {
+		if threshold < 1 || threshold > 100 {
+			return fmt.Errorf("statsd-percent-thresholds: invalid threshold %d, must be between 1 and 100", threshold)
+		}
 	}
-	if err := c.processDbConnectString(); err != nil {
-		return err
+	for _, aggs := range [][]string{c.StatsdTimerAggregates, c.StatsdThresholdAggs} {
+		for _, agg := range aggs {
+			if err := aggregator.ValidateOutput(agg); err != nil {
+				return fmt.Errorf("statsd timer aggregates: %v", err)
+			}
+		}
 	}
-	if err := c.processMinStep(); err != nil {
-		return err
+	if len(c.StatsdThresholds) > 0 {
+		log.Printf("Statsd timer percent thresholds: %v (statsd-percent-thresholds).", c.StatsdThresholds)
 	}
-	if err := c.processMaxReceiverQueueSize(); err != nil {
-		return err
+	if len(c.StatsdTimerAggregates) > 0 {
+		log.Printf("Statsd timers will be flushed as %s (statsd-timer-aggregates).", strings.Join(c.StatsdTimerAggregates, ", "))
 	}
-	if err := c.processMaxMemoryBytes(); err != nil {
-		return err
+	if len(c.StatsdThresholdAggs) > 0 {
+		log.Printf("Statsd timer thresholds will be flushed as %s (statsd-threshold-aggregates).", strings.Join(c.StatsdThresholdAggs, ", "))
 	}
-	if err := c.processPgSegmentWidth(); err != nil {
-		return err
+	return nil
+}
+
+func aggHistogramSpecs(hs []aggHistogram) []aggregator.HistogramSpec {
+	result := make([]aggregator.HistogramSpec, len(hs))
+	for i, h := range hs {
+		result[i] = aggregator.HistogramSpec{Pattern: h.Regexp.Regexp, Buckets: h.Buckets}
 	}
-	if err := c.processStatFlushInterval(); err != nil {
-		return err
+	return result
+}
+
+func aggOutputSpecs(as []aggOutputs) []aggregator.OutputSpec {
+	result := make([]aggregator.OutputSpec, len(as))
+	for i, a := range as {
+		result[i] = aggregator.OutputSpec{Prefix: a.Prefix, Outputs: a.Outputs}
 	}
-	if err := c.processStatsNamePrefix(); err != nil {
-		return err
+	return result
+}
+
+func rewriteRules(rws []rewrite) []receiver.RewriteRule {
+	result := make([]receiver.RewriteRule, len(rws))
+	for i, rw := range rws {
+		result[i] = receiver.RewriteRule{Regexp: rw.Regexp.Regexp, Replacement: rw.Replacement}
 	}
-	if err := c.processWorkers(); err != nil {
-		return err
+	return result
+}
+
+func preAggregateRules(pas []preAggregate) []receiver.PreAggregateRule {
+	result := make([]receiver.PreAggregateRule, len(pas))
+	for i, pa := range pas {
+		result[i] = receiver.PreAggregateRule{Regexp: pa.Regexp.Regexp, Output: pa.Output, Function: pa.function, Interval: pa.Interval.Duration}
+	}
+	return result
+}
+
+func regexps(rs []regex) []*regexp.Regexp {
+	result := make([]*regexp.Regexp, len(rs))
+	for i, r := range rs {
+		result[i] = r.Regexp
+	}
+	return result
+}
+
+func (c *Config) processReceiverQueueOverflow() error {
+	if c.ReceiverQueueOverflow == "" {
+		c.queueOverflowPolicy = receiver.QueueDropNewest
+		return nil
+	}
+	var err error
+	if c.queueOverflowPolicy, err = receiver.ParseQueueOverflowPolicy(c.ReceiverQueueOverflow); err != nil {
+		return err
+	}
+	log.Printf("Receiver Queue overflow policy is %v (receiver-queue-overflow-policy).", c.queueOverflowPolicy)
+	return nil
+}
+
+func (c *Config) processDuplicatePolicy() error {
+	if c.DuplicatePolicy == "" {
+		c.duplicatePolicy = receiver.DuplicateKeepLast
+		return nil
+	}
+	var err error
+	if c.duplicatePolicy, err = receiver.ParseDuplicatePolicy(c.DuplicatePolicy); err != nil {
+		return err
+	}
+	log.Printf("Data points with the same time stamp are combined using %v (duplicate-timestamp-policy).", c.duplicatePolicy)
+	return nil
+}
+
+// The listeners that ListenerQuotas may refer to
+var quotaListeners = []string{"graphite_tcp", "graphite_udp", "graphite_pickle", "statsd_tcp", "statsd_udp", "opentsdb_tcp", "opentsdb_http", "http_batch", "collectd_udp", "nats", "mqtt", "amqp"}
+
+func (c *Config) processListenerQuotas() error {
+	for listener, n := range c.ListenerQuotas {
+		known := false
+		for _, l := range quotaListeners {
+			known = known || l == listener
+		}
+		if !known {
+			return fmt.Errorf("listener-quotas: unknown listener %q (valid: %s)", listener, strings.Join(quotaListeners, ", "))
+		}
+		if n < 0 {
+			return fmt.Errorf("listener-quotas: quota for %q cannot be negative", listener)
+		}
+	}
+	if c.ListenerSourceQuota < 0 {
+		return fmt.Errorf("listener-source-quota cannot be negative")
+	}
+	c.quotaPolicy = receiver.QuotaDrop
+	if c.ListenerQuotaPolicy != "" {
+		var err error
+		if c.quotaPolicy, err = receiver.ParseQuotaPolicy(c.ListenerQuotaPolicy); err != nil {
+			return err
+		}
+	}
+	if len(c.ListenerQuotas) > 0 || c.ListenerSourceQuota > 0 {
+		log.Printf("Listener quotas: %v points/s, per source: %d points/s, policy: %v (listener-quotas, listener-source-quota, listener-quota-policy).",
+			c.ListenerQuotas, c.ListenerSourceQuota, c.quotaPolicy)
+	}
+	return nil
+}
+
+// processListenerPrefixes checks the name prefixes of the listeners
+// (the same ones as for the quotas), e.g. "dc1.", which must be valid
+// names themselves.
+func (c *Config) processListenerPrefixes() error {
+	if err := c.ListenerPrefixes.validate(); err != nil {
+		return fmt.Errorf("listener-prefixes: %v", err)
+	}
+	if len(c.ListenerPrefixes) > 0 {
+		log.Printf("Listener name prefixes: %v (listener-prefixes).", map[string]string(c.ListenerPrefixes))
+	}
+	return nil
+}
+
+// processListenerTimestamps parses the listener-timestamp-policy of
+// the listeners, reject and clamp require their listener-max-skew.
+func (c *Config) processListenerTimestamps() error {
+	c.listenerTimestamps = nil
+	for listener, skew := range c.ListenerMaxSkew {
+		if _, ok := c.ListenerTimestampPolicy[listener]; !ok {
+			return fmt.Errorf("listener-max-skew: %q has no listener-timestamp-policy (reject or clamp)", listener)
+		}
+		if skew.Duration <= 0 {
+			return fmt.Errorf("listener-max-skew: the skew of %q must be positive", listener)
+		}
+	}
+	for listener, s := range c.ListenerTimestampPolicy {
+		known := false
+		for _, l := range quotaListeners {
+			known = known || l == listener
+		}
+		if !known {
+			return fmt.Errorf("listener-timestamp-policy: unknown listener %q (valid: %s)", listener, strings.Join(quotaListeners, ", "))
+		}
+		policy, err := receiver.ParseTimestampPolicy(s)
+		if err != nil {
+			return fmt.Errorf("listener-timestamp-policy: %v", err)
+		}
+		skew := c.ListenerMaxSkew[listener].Duration
+		if (policy == receiver.TimestampReject || policy == receiver.TimestampClamp) && skew == 0 {
+			return fmt.Errorf("listener-timestamp-policy: %s for %q requires its listener-max-skew", policy, listener)
+		}
+		if c.listenerTimestamps == nil {
+			c.listenerTimestamps = make(map[string]receiver.ListenerTimestamps)
+		}
+		c.listenerTimestamps[listener] = receiver.ListenerTimestamps{Policy: policy, MaxSkew: skew}
+		log.Printf("Listener %s: time stamps %v, max skew %v (listener-timestamp-policy, listener-max-skew).", listener, policy, skew)
+	}
+	return nil
+}
+
+func (m prefixMap) validate() error {
+	for listener, prefix := range m {
+		known := false
+		for _, l := range quotaListeners {
+			known = known || l == listener
+		}
+		if !known {
+			return fmt.Errorf("unknown listener %q (valid: %s)", listener, strings.Join(quotaListeners, ", "))
+		}
+		if prefix == "" || misc.SanitizeName(prefix) != prefix {
+			return fmt.Errorf("invalid prefix %q for %q", prefix, listener)
+		}
+	}
+	return nil
+}
+
+func (c *Config) processMaxMemoryBytes() error {
+	if c.MaxMemoryBytes == 0 {
+		log.Printf("max-memory-bytes unspecified, defaults to 0 (unlimited)")
+	} else if c.MaxMemoryBytes <= 0 {
+		log.Printf("Max Memory (heap allocation bytes) is unlimited (%d) (max-memory-bytes).", c.MaxMemoryBytes)
+	} else {
+		log.Printf("Max Memory (heap allocation bytes) is limited to %d (max-memory-bytes).", c.MaxMemoryBytes)
+	}
+	return nil
+}
+
+func (c *Config) processFlushWorkers() error {
+	if c.FlushWorkers < 0 {
+		return fmt.Errorf("flush-workers cannot be negative")
+	}
+	var err error
+	if c.flushShardFunc, err = receiver.ParseFlushSharding(c.FlushSharding); err != nil {
+		return err
+	}
+	n := c.FlushWorkers
+	if n == 0 {
+		n = c.Workers * 2
+	}
+	sharding := c.FlushSharding
+	if sharding == "" {
+		sharding = "shared"
+	}
+	log.Printf("Number of db flushers will be %d, sharding: %s (flush-workers, flush-sharding).", n, sharding)
+	return nil
+}
+
+func (c *Config) processFlushBatch() error {
+	if c.FlushBatchSize < 0 {
+		return fmt.Errorf("flush-batch-size cannot be negative")
+	}
+	if c.FlushBatchSize > 1 {
+		if c.FlushBatchDelay.Duration <= 0 {
+			c.FlushBatchDelay.Duration = 100 * time.Millisecond
+		}
+		log.Printf("Up to %d flushes per transaction, waiting at most %v (flush-batch-size, flush-batch-max-delay).", c.FlushBatchSize, c.FlushBatchDelay.Duration)
+	}
+	// 7 parameters per row, PostgreSQL allows 65535 per statement
+	if c.PgFlushValuesWidth < 0 || c.PgFlushValuesWidth > 9000 {
+		return fmt.Errorf("pg-flush-values-width must be between 0 and 9000")
+	}
+	if c.PgFlushValuesWidth > 1 {
+		if c.FlushBatchSize <= 1 {
+			log.Printf("WARNING: pg-flush-values-width has no effect without a flush-batch-size greater than 1.")
+		} else {
+			log.Printf("Up to %d data point rows per UPDATE statement (pg-flush-values-width).", c.PgFlushValuesWidth)
+		}
+		serde.PgFlushValuesWidth = c.PgFlushValuesWidth
+	}
+	if c.FlushTargetLatency.Duration < 0 {
+		return fmt.Errorf("flush-target-latency cannot be negative")
+	}
+	if c.FlushTargetLatency.Duration > 0 {
+		if c.FlushMaxStretch == 0 {
+			c.FlushMaxStretch = 8
+		} else if c.FlushMaxStretch < 1 {
+			return fmt.Errorf("flush-max-stretch must be 1 or greater")
+		}
+		log.Printf("Flush pace adapts to a target write latency of %v, stretching up to %v times (flush-target-latency, flush-max-stretch).", c.FlushTargetLatency.Duration, c.FlushMaxStretch)
+	}
+	return nil
+}
+
+func (c *Config) processDSCacheMemory() error {
+	if c.DSCacheMaxMemory < 0 {
+		return fmt.Errorf("ds-cache-max-memory cannot be negative")
+	}
+	if c.DSCacheMaxMemory > 0 {
+		if c.DSCacheMinIdle.Duration == 0 {
+			c.DSCacheMinIdle.Duration = 10 * time.Minute
+		}
+		if c.DSCacheMinIdle.Duration < c.MinStep.Duration*2 {
+			return fmt.Errorf("ds-cache-min-idle (%v) must be at least twice min-step (%v)", c.DSCacheMinIdle.Duration, c.MinStep.Duration)
+		}
+		log.Printf("DS cache is limited to roughly %d bytes, DSs idle for %v may be evicted (ds-cache-max-memory, ds-cache-min-idle).", c.DSCacheMaxMemory, c.DSCacheMinIdle.Duration)
+	}
+	return nil
+}
+
+func (c *Config) processDSStale() error {
+	if c.DSStaleAfter.Duration < 0 {
+		return fmt.Errorf("ds-stale-after cannot be negative")
+	}
+	if c.DSStaleAfter.Duration == 0 {
+		if c.DSArchiveStale {
+			return fmt.Errorf("ds-archive-stale requires ds-stale-after")
+		}
+		return nil
+	}
+	if c.DSStaleAfter.Duration < c.MinStep.Duration*2 {
+		return fmt.Errorf("ds-stale-after (%v) must be at least twice min-step (%v)", c.DSStaleAfter.Duration, c.MinStep.Duration)
+	}
+	log.Printf("DSs receiving no data for %v will be unloaded, archive: %v (ds-stale-after, ds-archive-stale).", c.DSStaleAfter.Duration, c.DSArchiveStale)
+	return nil
+}
+
+func (c *Config) processDSRetention() error {
+	if c.DSRetention.Duration < 0 {
+		return fmt.Errorf("ds-retention cannot be negative")
+	}
+	for prefix, r := range c.DSRetentionByPrefix {
+		if r.Duration < 0 {
+			return fmt.Errorf("ds-retention-by-prefix for %q cannot be negative", prefix)
+		}
+	}
+	if c.DSRetention.Duration > 0 {
+		log.Printf("DSs not updated for %v are deleted, dry run: %v (ds-retention, ds-retention-dry-run).", c.DSRetention.Duration, c.DSRetentionDryRun)
+	}
+	for prefix, r := range c.DSRetentionByPrefix {
+		log.Printf("DSs with prefix %q not updated for %v are deleted, 0 is never (ds-retention-by-prefix).", prefix, r.Duration)
+	}
+	return nil
+}
+
+// The shortest http-admin-token accepted.
+const minHttpAdminToken = 16
+
+func (c *Config) processHttpAdmin() error {
+	if c.HttpAdminToken == "" {
+		return nil
+	}
+	if len(c.HttpAdminToken) < minHttpAdminToken {
+		return fmt.Errorf("http-admin-token must be at least %d characters", minHttpAdminToken)
+	}
+	log.Printf("HTTP admin endpoints are enabled (http-admin-token).")
+	return nil
+}
+
+// dsRetentionByPrefix is ds-retention-by-prefix for the receiver.
+func (c *Config) dsRetentionByPrefix() map[string]time.Duration {
+	if len(c.DSRetentionByPrefix) == 0 {
+		return nil
+	}
+	result := make(map[string]time.Duration, len(c.DSRetentionByPrefix))
+	for prefix, r := range c.DSRetentionByPrefix {
+		result[prefix] = r.Duration
+	}
+	return result
+}
+
+func (c *Config) processClusterSpool(wd string) error {
+	if c.ClusterSpoolMaxSize < 0 || c.ClusterSpoolMaxAge.Duration < 0 {
+		return fmt.Errorf("cluster-spool-max-size and cluster-spool-max-age cannot be negative")
+	}
+	if c.ClusterSpoolDir == "" {
+		return nil
+	}
+	if !filepath.IsAbs(c.ClusterSpoolDir) {
+		if wd == "" {
+			return fmt.Errorf("cluster-spool-dir must be absolute path if working directory cannot be determined")
+		}
+		c.ClusterSpoolDir = filepath.Join(wd, c.ClusterSpoolDir)
+	}
+	if err := os.MkdirAll(c.ClusterSpoolDir, 0755); err != nil {
+		return fmt.Errorf("Unable to create directory: '%s' (%v).", c.ClusterSpoolDir, err)
+	}
+	log.Printf("Points for cluster nodes that are down will be spooled to '%s' (cluster-spool-dir).", c.ClusterSpoolDir)
+	return nil
+}
+
+// processColdStorage sets up the cold tier, see the tier package.
+// The keys can also be in the AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY environment variables.
+func (c *Config) processColdStorage(wd string) error {
+	if c.ColdAge.Duration < 0 || c.ColdInterval.Duration < 0 {
+		return fmt.Errorf("cold-age and cold-interval cannot be negative")
+	}
+	if c.ColdStorageURL == "" {
+		return nil
+	}
+	if c.ColdAge.Duration == 0 {
+		c.ColdAge.Duration = 24 * time.Hour
+	}
+	if c.ColdInterval.Duration == 0 {
+		c.ColdInterval.Duration = time.Hour
+	}
+	rawurl := c.ColdStorageURL
+	if path := strings.TrimPrefix(rawurl, "file://"); path != rawurl && !filepath.IsAbs(path) {
+		if wd == "" {
+			return fmt.Errorf("cold-storage-url must be an absolute path if working directory cannot be determined")
+		}
+		rawurl = "file://" + filepath.Join(wd, path)
+	}
+	opts := tier.S3Options{
+		Endpoint:  c.ColdStorageEndpoint,
+		Region:    c.ColdStorageRegion,
+		AccessKey: c.ColdStorageAccessKey,
+		SecretKey: c.ColdStorageSecretKey,
+	}
+	if opts.AccessKey == "" && opts.SecretKey == "" {
+		opts.AccessKey, opts.SecretKey = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	store, err := tier.NewObjectStore(rawurl, opts)
+	if err != nil {
+		return fmt.Errorf("cold-storage-url: %v", err)
+	}
+	c.coldStore = store
+	log.Printf("RRA data older than %v will be archived to %s every %v (cold-storage-url, cold-age, cold-interval).",
+		c.ColdAge.Duration, rawurl, c.ColdInterval.Duration)
+	return nil
+}
+
+func (c *Config) processDeadLetterFile(wd string) error {
+	if c.DeadLetterMaxSize < 0 {
+		return fmt.Errorf("dead-letter-max-size cannot be negative")
+	}
+	if c.DeadLetterPath == "" {
+		return nil
+	}
+	if !filepath.IsAbs(c.DeadLetterPath) {
+		if wd == "" {
+			return fmt.Errorf("dead-letter-file must be absolute path if working directory cannot be determined")
+		}
+		c.DeadLetterPath = filepath.Join(wd, c.DeadLetterPath)
+	}
+	dir, _ := filepath.Split(c.DeadLetterPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("Unable to create directory: '%s' (%v).", dir, err)
+	}
+	log.Printf("Dropped data points will be written to '%s' (dead-letter-file).", c.DeadLetterPath)
+	return nil
+}
+
+func (c *Config) processCollectd(wd string) error {
+	level, err := collectd.ParseSecurityLevel(c.CollectdSecurityLevel)
+	if err != nil {
+		return err
+	}
+	if c.collectdNaming, err = collectd.ParseNaming(c.CollectdNaming); err != nil {
+		return err
+	}
+	c.collectdParser = &collectd.Parser{SecurityLevel: level}
+	c.collectdTypes = nil
+	if c.CollectdListenSpec == "" {
+		return nil
+	}
+
+	path := func(p string) string {
+		if p != "" && !filepath.IsAbs(p) {
+			return filepath.Join(wd, p)
+		}
+		return p
+	}
+	if c.CollectdAuthFile != "" {
+		f, err := os.Open(path(c.CollectdAuthFile))
+		if err != nil {
+			return fmt.Errorf("collectd-auth-file: %v", err)
+		}
+		defer f.Close()
+		if c.collectdParser.Passwords, err = collectd.ReadAuthFile(f); err != nil {
+			return fmt.Errorf("collectd-auth-file %q: %v", c.CollectdAuthFile, err)
+		}
+	} else if level != collectd.SecurityNone {
+		return fmt.Errorf("collectd-security-level %v requires a collectd-auth-file", level)
+	}
+	if c.CollectdTypesDB != "" {
+		f, err := os.Open(path(c.CollectdTypesDB))
+		if err != nil {
+			return fmt.Errorf("collectd-typesdb: %v", err)
+		}
+		defer f.Close()
+		if c.collectdTypes, err = collectd.ReadTypesDB(f); err != nil {
+			return fmt.Errorf("collectd-typesdb %q: %v", c.CollectdTypesDB, err)
+		}
+	}
+	log.Printf("collectd: security level %v, %d users, %d types, naming %v, prefix %q.", level,
+		len(c.collectdParser.Passwords), len(c.collectdTypes), c.collectdNaming, c.CollectdPrefix)
+	return nil
+}
+
+func (c *Config) processNats() error {
+	if c.NatsURL == "" {
+		if len(c.NatsSubscriptions) > 0 {
+			return fmt.Errorf("nats-subscription requires a nats-url")
+		}
+		return nil
+	}
+	u, err := parseNatsURL(c.NatsURL)
+	if err != nil {
+		return err
+	}
+	if len(c.NatsSubscriptions) == 0 {
+		return fmt.Errorf("nats-url requires at least one [[nats-subscription]]")
+	}
+	for i := range c.NatsSubscriptions {
+		sub := &c.NatsSubscriptions[i]
+		if !validNatsSubject(sub.Subject) {
+			return fmt.Errorf("nats-subscription: invalid subject: %q", sub.Subject)
+		}
+		if strings.ContainsAny(sub.QueueGroup, " \t\r\n") {
+			return fmt.Errorf("nats-subscription: invalid queue-group: %q", sub.QueueGroup)
+		}
+		if sub.format, err = parsePayloadFormat(sub.Format); err != nil {
+			return fmt.Errorf("nats-subscription %q: %v", sub.Subject, err)
+		}
+		log.Printf("NATS: subscribing to %q at %s, format %v, queue group %q (nats-subscription).", sub.Subject, u.Host, sub.format, sub.QueueGroup)
+	}
+	return nil
+}
+
+func (c *Config) processMqtt() error {
+	if c.MqttURL == "" {
+		if len(c.MqttSubscriptions) > 0 {
+			return fmt.Errorf("mqtt-subscription requires an mqtt-url")
+		}
+		return nil
+	}
+	u, err := parseMqttURL(c.MqttURL)
+	if err != nil {
+		return err
+	}
+	if len(c.MqttSubscriptions) == 0 {
+		return fmt.Errorf("mqtt-url requires at least one [[mqtt-subscription]]")
+	}
+	if c.MqttClientID == "" {
+		host, _ := os.Hostname()
+		c.MqttClientID = "tgres-" + host
+	}
+	for i := range c.MqttSubscriptions {
+		sub := &c.MqttSubscriptions[i]
+		if !validMqttFilter(sub.Topic) {
+			return fmt.Errorf("mqtt-subscription: invalid topic: %q", sub.Topic)
+		}
+		if sub.QoS != 0 && sub.QoS != 1 {
+			return fmt.Errorf("mqtt-subscription %q: qos must be 0 or 1", sub.Topic)
+		}
+		if sub.value = sub.Format == "" || strings.ToLower(sub.Format) == "value"; !sub.value {
+			if sub.format, err = parsePayloadFormat(sub.Format); err != nil {
+				return fmt.Errorf("mqtt-subscription %q: %v (or value)", sub.Topic, err)
+			}
+			if sub.Name != "" {
+				return fmt.Errorf("mqtt-subscription %q: name only applies to the value format", sub.Topic)
+			}
+		} else if !validMqttName(sub.Name) {
+			return fmt.Errorf("mqtt-subscription %q: invalid name template: %q", sub.Topic, sub.Name)
+		}
+		format := "value"
+		if !sub.value {
+			format = sub.format.String()
+		}
+		log.Printf("MQTT: subscribing to %q at %s, qos %d, format %s (mqtt-subscription).", sub.Topic, u.Host, sub.QoS, format)
+	}
+	return nil
+}
+
+func (c *Config) processAmqp() error {
+	if c.AmqpURL == "" {
+		return nil
+	}
+	u, err := parseAmqpURL(c.AmqpURL)
+	if err != nil {
+		return err
+	}
+	if c.AmqpExchange == "" && c.AmqpQueue == "" {
+		return fmt.Errorf("amqp-url requires an amqp-exchange or an amqp-queue")
+	}
+	if c.AmqpExchangeType == "" {
+		c.AmqpExchangeType = "topic"
+	}
+	if len(c.AmqpRoutingKeys) == 0 {
+		c.AmqpRoutingKeys = []string{"#"}
+	}
+	for _, s := range append([]string{c.AmqpExchange, c.AmqpExchangeType, c.AmqpQueue}, c.AmqpRoutingKeys...) {
+		if len(s) > 255 {
+			return fmt.Errorf("amqp: names and routing keys cannot be longer than 255 bytes: %q", s)
+		}
+	}
+	if c.AmqpPrefetch == 0 {
+		c.AmqpPrefetch = 100
+	} else if c.AmqpPrefetch < 0 || c.AmqpPrefetch > 65535 {
+		return fmt.Errorf("amqp-prefetch must be between 1 and 65535")
+	}
+	format, err := parsePayloadFormat(c.AmqpFormat)
+	if err != nil {
+		return fmt.Errorf("amqp-format: %v", err)
+	}
+	if c.AmqpRoutingKeyName && format != payloadGraphite {
+		return fmt.Errorf("amqp-routing-key-name requires the graphite amqp-format")
+	}
+	c.amqp = amqpConsumer{exchange: c.AmqpExchange, exchangeType: c.AmqpExchangeType, queue: c.AmqpQueue,
+		routingKeys: c.AmqpRoutingKeys, format: format, routingKeyName: c.AmqpRoutingKeyName, prefetch: c.AmqpPrefetch}
+	log.Printf("AMQP: consuming at %s, exchange %q (%s), queue %q, routing keys %v, format %v (amqp-*).",
+		u.Host, c.AmqpExchange, c.AmqpExchangeType, c.AmqpQueue, c.AmqpRoutingKeys, format)
+	return nil
+}
+
+// The listeners that can use the PROXY protocol
+var proxyProtocolListeners = []string{"graphite_tcp", "graphite_pickle", "statsd_tcp", "opentsdb_tcp", "http"}
+
+func (c *Config) processProxyProtocol() error {
+	for _, listener := range c.ProxyProtocolListeners {
+		known := false
+		for _, l := range proxyProtocolListeners {
+			known = known || l == listener
+		}
+		if !known {
+			return fmt.Errorf("proxy-protocol-listeners: unknown listener %q (valid: %s)", listener, strings.Join(proxyProtocolListeners, ", "))
+		}
+	}
+	c.proxyProtocol = nil
+	if len(c.ProxyProtocolListeners) == 0 {
+		if len(c.ProxyProtocolTrusted) > 0 {
+			return fmt.Errorf("proxy-protocol-trusted requires proxy-protocol-listeners")
+		}
+		return nil
+	}
+
+	c.proxyProtocol = &proxyProtocol{}
+	for _, t := range c.ProxyProtocolTrusted {
+		if !strings.Contains(t, "/") { // a single address
+			if ip := net.ParseIP(t); ip != nil && ip.To4() != nil {
+				t += "/32"
+			} else {
+				t += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(t)
+		if err != nil {
+			return fmt.Errorf("proxy-protocol-trusted: %v", err)
+		}
+		c.proxyProtocol.trusted = append(c.proxyProtocol.trusted, n)
+	}
+	trusted := "anywhere"
+	if len(c.ProxyProtocolTrusted) > 0 {
+		trusted = strings.Join(c.ProxyProtocolTrusted, ", ")
+	}
+	log.Printf("PROXY protocol on %v, accepted from %s (proxy-protocol-listeners, proxy-protocol-trusted).", c.ProxyProtocolListeners, trusted)
+	return nil
+}
+
+// listenerProxy is the PROXY protocol of a listener, nil if it does
+// not use it.
+func (c *Config) listenerProxy(listener string) *proxyProtocol {
+	for _, l := range c.ProxyProtocolListeners {
+		if l == listener {
+			return c.proxyProtocol
+		}
+	}
+	return nil
+}
+
+// The listeners that ListenerMaxConns may refer to
+var connLimitListeners = []string{"graphite_tcp", "graphite_pickle", "statsd_tcp", "opentsdb_tcp"}
+
+func (c *Config) processConnLimits() error {
+	for listener, n := range c.ListenerMaxConns {
+		known := false
+		for _, l := range connLimitListeners {
+			known = known || l == listener
+		}
+		if !known {
+			return fmt.Errorf("listener-max-connections: unknown listener %q (valid: %s)", listener, strings.Join(connLimitListeners, ", "))
+		}
+		if n < 0 {
+			return fmt.Errorf("listener-max-connections: maximum for %q cannot be negative", listener)
+		}
+	}
+	if c.ListenerIdleTimeout.Duration < 0 || c.ListenerReadTimeout.Duration < 0 {
+		return fmt.Errorf("listener-idle-timeout and listener-read-timeout cannot be negative")
+	}
+	if c.ListenerIdleTimeout.Duration == 0 {
+		c.ListenerIdleTimeout.Duration = 30 * time.Second
+	}
+	log.Printf("TCP listeners: idle timeout %v, read timeout %v, maximum connections %v (listener-idle-timeout, listener-read-timeout, listener-max-connections).",
+		c.ListenerIdleTimeout.Duration, c.ListenerReadTimeout.Duration, c.ListenerMaxConns)
+	return nil
+}
+
+// processBackpressure checks the listeners that stop reading when
+// the receiver queue is too long (see connLimiter), which are those
+// with connection limits. The queue length defaults to 3/4 of
+// max-receiver-queue-size, so that they stop before anything is
+// dropped.
+func (c *Config) processBackpressure() error {
+	for _, listener := range c.BackpressureListeners {
+		known := false
+		for _, l := range connLimitListeners {
+			known = known || l == listener
+		}
+		if !known {
+			return fmt.Errorf("backpressure-listeners: unknown listener %q (valid: %s)", listener, strings.Join(connLimitListeners, ", "))
+		}
+	}
+	if c.BackpressureQueueSize < 0 {
+		return fmt.Errorf("backpressure-queue-size cannot be negative")
+	}
+	if len(c.BackpressureListeners) == 0 {
+		return nil
+	}
+	if c.BackpressureQueueSize == 0 {
+		if c.MaxReceiverQueueSize <= 0 {
+			return fmt.Errorf("backpressure-queue-size is required when max-receiver-queue-size is unlimited")
+		}
+		c.BackpressureQueueSize = c.MaxReceiverQueueSize * 3 / 4
+	}
+	log.Printf("Listeners %s stop reading while the receiver queue is over %d (backpressure-listeners, backpressure-queue-size).",
+		strings.Join(c.BackpressureListeners, ", "), c.BackpressureQueueSize)
+	return nil
+}
+
+// The line protocol listeners that have a strict parsing mode
+var strictListeners = []string{"graphite_tcp", "graphite_udp", "statsd_tcp", "statsd_udp"}
+
+func (c *Config) processStrictListeners() error {
+	for _, listener := range c.StrictListeners {
+		known := false
+		for _, l := range strictListeners {
+			known = known || l == listener
+		}
+		if !known {
+			return fmt.Errorf("strict-listeners: unknown listener %q (valid: %s)", listener, strings.Join(strictListeners, ", "))
+		}
+	}
+	if c.ParseErrorLogSample < 0 {
+		return fmt.Errorf("parse-error-log-sample cannot be negative")
+	}
+	if len(c.StrictListeners) > 0 {
+		log.Printf("Strict parsing on %s, logging 1 in %d parse errors (0 is none) (strict-listeners, parse-error-log-sample).",
+			strings.Join(c.StrictListeners, ", "), c.ParseErrorLogSample)
+	}
+	return nil
+}
+
+// The listeners that can use TLS
+var tlsListeners = []string{"graphite_tcp", "graphite_pickle", "statsd_tcp", "opentsdb_tcp"}
+
+func (c *Config) processTLS(wd string) error {
+	for _, listener := range c.TLSListeners {
+		known := false
+		for _, l := range tlsListeners {
+			known = known || l == listener
+		}
+		if !known {
+			return fmt.Errorf("tls-listeners: unknown listener %q (valid: %s)", listener, strings.Join(tlsListeners, ", "))
+		}
+	}
+	c.tlsConfig = nil
+	if len(c.TLSListeners) == 0 {
+		return nil
+	}
+	if c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return fmt.Errorf("tls-listeners requires a tls-cert-file and a tls-key-file")
+	}
+
+	path := func(p string) string {
+		if p != "" && !filepath.IsAbs(p) {
+			return filepath.Join(wd, p)
+		}
+		return p
+	}
+	cert, err := tls.LoadX509KeyPair(path(c.TLSCertFile), path(c.TLSKeyFile))
+	if err != nil {
+		return fmt.Errorf("tls-cert-file, tls-key-file: %v", err)
+	}
+	c.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if c.TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(path(c.TLSClientCAFile))
+		if err != nil {
+			return fmt.Errorf("tls-client-ca-file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("tls-client-ca-file: no certificates found in %q", c.TLSClientCAFile)
+		}
+		c.tlsConfig.ClientCAs, c.tlsConfig.ClientAuth = pool, tls.RequireAndVerifyClientCert
+	}
+	log.Printf("TLS on %v, client certificates required: %v (tls-listeners, tls-client-ca-file).", c.TLSListeners, c.TLSClientCAFile != "")
+	return nil
+}
+
+// listenerTLS is the TLS config of a listener, nil if it does not use
+// TLS.
+func (c *Config) listenerTLS(listener string) *tls.Config {
+	for _, l := range c.TLSListeners {
+		if l == listener {
+			return c.tlsConfig
+		}
+	}
+	return nil
+}
+
+func (c *Config) processUDPReaders() error {
+	if c.UDPReaders == 0 {
+		c.UDPReaders = 1
+	} else if c.UDPReaders < 0 {
+		return fmt.Errorf("udp-readers cannot be negative")
+	}
+	if c.UDPReaders > 1 {
+		log.Printf("Graphite and statsd UDP listeners will have %d sockets and readers each (udp-readers).", c.UDPReaders)
+	}
+	return nil
+}
+
+func (c *Config) processUnixSocketMode() error {
+	c.unixSocketMode = 0
+	if c.UnixSocketMode == "" {
+		return nil
+	}
+	mode, err := strconv.ParseUint(c.UnixSocketMode, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return fmt.Errorf("unix-socket-mode: invalid mode %q (expected octal, e.g. \"0660\")", c.UnixSocketMode)
+	}
+	c.unixSocketMode = os.FileMode(mode)
+	log.Printf("Unix socket listeners will have mode %v (unix-socket-mode).", c.unixSocketMode)
+	return nil
+}
+
+func (c *Config) processShutdownTimeout() error {
+	if c.ShutdownTimeout.Duration < 0 {
+		return fmt.Errorf("shutdown-timeout cannot be negative")
+	}
+	if c.ShutdownTimeout.Duration > 0 {
+		log.Printf("Data not flushed within %v of shutdown will be lost (shutdown-timeout).", c.ShutdownTimeout.Duration)
+	}
+	return nil
+}
+
+func (c *Config) processDbConnections() error {
+	if c.DbMaxConnections < 0 {
+		return fmt.Errorf("db-max-connections cannot be negative")
+	}
+	if c.DbQueryShare < 0 || c.DbQueryShare >= 1 {
+		return fmt.Errorf("db-query-share must be between 0 and 1")
+	}
+	if c.DbMaxIdleConnections < 0 || c.DbConnMaxLifetime.Duration < 0 || c.DbStatementTimeout.Duration < 0 {
+		return fmt.Errorf("db-max-idle-connections, db-connection-max-lifetime and db-statement-timeout cannot be negative")
+	}
+	if c.DbMaxIdleConnections > 0 {
+		log.Printf("At most %d idle database connections per pool (db-max-idle-connections).", c.DbMaxIdleConnections)
+	}
+	if c.DbConnMaxLifetime.Duration > 0 {
+		log.Printf("Database connections are closed after %v (db-connection-max-lifetime).", c.DbConnMaxLifetime.Duration)
+	}
+	if c.DbStatementTimeout.Duration > 0 {
+		log.Printf("Database statements time out after %v (db-statement-timeout).", c.DbStatementTimeout.Duration)
+	}
+	serde.PgMaxIdleConnections = c.DbMaxIdleConnections
+	serde.PgConnMaxLifetime = c.DbConnMaxLifetime.Duration
+	serde.PgStatementTimeout = c.DbStatementTimeout.Duration
+	if c.DbMaxConnections == 0 {
+		return nil
+	}
+	if c.DbMaxConnections < 2 {
+		return fmt.Errorf("db-max-connections must be at least 2 (one for queries, one for flushing)")
+	}
+	if c.DbQueryShare == 0 {
+		c.DbQueryShare = 0.25
+	}
+	log.Printf("At most %d database connections, %v of them for queries (db-max-connections, db-query-share).", c.DbMaxConnections, c.DbQueryShare)
+	serde.PgMaxConnections = c.DbMaxConnections
+	serde.PgQueryShare = c.DbQueryShare
+	return nil
+}
+
+// The sslmode values of PostgreSQL
+var pgSSLModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// processDbTLS adds the TLS options to the connect strings of the
+// database and the read replicas and sets up the password file,
+// paths are relative to wd.
+func (c *Config) processDbTLS(wd string) error {
+	if c.DbSSLMode == "" && c.DbSSLCert == "" && c.DbSSLKey == "" && c.DbSSLRootCert == "" && c.DbPasswordFile == "" {
+		return nil
+	}
+	if c.dbDriver() != "postgres" {
+		return fmt.Errorf("db-ssl-* and db-password-file are only supported with PostgreSQL")
+	}
+
+	options := make(map[string]string)
+	if c.DbSSLMode != "" {
+		known := false
+		for _, m := range pgSSLModes {
+			known = known || m == c.DbSSLMode
+		}
+		if !known {
+			return fmt.Errorf("db-ssl-mode: unknown mode %q (valid: %s)", c.DbSSLMode, strings.Join(pgSSLModes, ", "))
+		}
+		options["sslmode"] = c.DbSSLMode
+	}
+	if (c.DbSSLCert == "") != (c.DbSSLKey == "") {
+		return fmt.Errorf("db-ssl-cert and db-ssl-key go together")
+	}
+	path := func(p string) string {
+		if p != "" && !filepath.IsAbs(p) {
+			return filepath.Join(wd, p)
+		}
+		return p
+	}
+	for _, f := range []struct{ name, path, option string }{
+		{"db-ssl-cert", c.DbSSLCert, "sslcert"},
+		{"db-ssl-key", c.DbSSLKey, "sslkey"},
+		{"db-ssl-root-cert", c.DbSSLRootCert, "sslrootcert"},
+		{"db-password-file", c.DbPasswordFile, ""},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(path(f.path)); err != nil {
+			return fmt.Errorf("%s: %v", f.name, err)
+		}
+		if f.option != "" {
+			options[f.option] = path(f.path)
+		}
+	}
+
+	if len(options) > 0 {
+		c.DbConnectString = serde.PgConnectString(c.DbConnectString, options)
+		for i, r := range c.DbReadReplicas {
+			c.DbReadReplicas[i] = serde.PgConnectString(r, options)
+		}
+	}
+	serde.PgPasswordFile = path(c.DbPasswordFile)
+	log.Printf("Database TLS mode %q, client certificate: %v, password file: %v (db-ssl-*, db-password-file).",
+		options["sslmode"], c.DbSSLCert != "", c.DbPasswordFile != "")
+	return nil
+}
+
+// processDbReadReplicas checks the read replicas, which only
+// PostgreSQL has, see serde.PgReadReplicas.
+func (c *Config) processDbReadReplicas() error {
+	if len(c.DbReadReplicas) == 0 {
+		return nil
+	}
+	if c.dbDriver() != "postgres" {
+		return fmt.Errorf("db-read-replicas is only supported with PostgreSQL")
+	}
+	for _, r := range c.DbReadReplicas {
+		if strings.TrimSpace(r) == "" {
+			return fmt.Errorf("db-read-replicas: empty connect string")
+		}
+	}
+	log.Printf("Querying %d read replica(s) in turn (db-read-replicas).", len(c.DbReadReplicas))
+	serde.PgReadReplicas = c.DbReadReplicas
+	return nil
+}
+
+func (c *Config) processDbMaintenance() error {
+	if c.DbMaintenanceInterval.Duration < 0 {
+		return fmt.Errorf("db-maintenance-interval cannot be negative")
+	}
+	if c.DbMaintenanceInterval.Duration > 0 && c.DbMaintenanceInterval.Duration < time.Minute {
+		return fmt.Errorf("db-maintenance-interval must be at least 1m")
+	}
+	if c.DbMaintenanceInterval.Duration > 0 {
+		log.Printf("The database is maintained every %v (db-maintenance-interval).", c.DbMaintenanceInterval.Duration)
+	}
+	return nil
+}
+
+func (c *Config) processPgSegmentWidth() error {
+	if c.PgSegmentWidth == 0 {
+		// do nothing and keep quiet about it since this is an "advanced" setting
+	} else if c.PgSegmentWidth <= 0 {
+		return fmt.Errorf("Invalid pg-segment-width: %d", c.PgSegmentWidth)
+	} else {
+		log.Printf("PG Segment Width is %d (pg-segment-width).", c.PgSegmentWidth)
+		serde.PgSegmentWidth = c.PgSegmentWidth
+	}
+	return nil
+}
+
+func (c *Config) processPgIndexes() error {
+	serde.PgCoveringIndexes, serde.PgBrinIndexes = c.PgCoveringIndexes, c.PgBrinIndexes
+	if c.PgCoveringIndexes {
+		log.Printf("The RRA lookup index will be a covering one (pg-covering-indexes).")
+	}
+	if c.PgBrinIndexes {
+		log.Printf("BRIN indexes will be created on the ts and rra tables (pg-brin-indexes).")
+	}
+	return nil
+}
+
+func (c *Config) processPgSchemaCompat() error {
+	serde.PgSchemaCompat = c.PgSchemaCompat
+	if c.PgSchemaCompat {
+		log.Printf("The database schema will be kept usable by the previous version of tgres (pg-schema-compat).")
+	}
+	return nil
+}
+
+func (c *Config) processPgTsCompression() error {
+	switch c.PgTsCompression {
+	case "":
+	case "pglz", "lz4":
+		log.Printf("The data points of the ts table will be compressed with %s (pg-ts-compression).", c.PgTsCompression)
+	default:
+		return fmt.Errorf("Invalid pg-ts-compression: %q (valid: pglz, lz4)", c.PgTsCompression)
+	}
+	serde.PgTsCompression = c.PgTsCompression
+	return nil
+}
+
+func (c *Config) processStatFlushInterval() error {
+	if c.StatFlush.Duration == 0 {
+		return fmt.Errorf("stat-flush-interval is missing")
+	} else {
+		log.Printf("Stats (a la statsd) will be flushed every %v (stat-flush-interval).", c.StatFlush.Duration)
+	}
+	return nil
+}
+
+func (c *Config) processStatsNamePrefix() error {
+	if c.StatsNamePrefix == "" {
+		log.Printf("stats-name-prefix is empty, defaulting to 'stats'")
+		c.StatsNamePrefix = "stats"
+
+	}
+	return nil
+}
+
+func (c *Config) processWorkers() error {
+	if c.Workers == 0 {
+		return fmt.Errorf("workers missing, must be an integer")
+	}
+	log.Printf("Number of workers (and flushers) will be %d.", c.Workers)
+	return nil
+}
+
+func (c *Config) processDSSpec() error {
+	// TODO validate function, regular expression, all that
+	for _, ds := range c.DSs {
+		if ds.Regexp.Regexp == nil {
+			return fmt.Errorf("ds: regexp missing")
+		}
+		if ds.Xff != nil && (*ds.Xff < 0 || *ds.Xff > 1) {
+			return fmt.Errorf("DS %q: invalid xff (%v), must be between 0 and 1.", ds.Regexp.String(), *ds.Xff)
+		}
+		if ds.Min != nil && ds.Max != nil && *ds.Min > *ds.Max {
+			return fmt.Errorf("DS %q: min (%v) is greater than max (%v).", ds.Regexp.String(), *ds.Min, *ds.Max)
+		}
+		switch strings.ToLower(ds.OutOfBounds) {
+		case "", "drop", "clamp":
+		default:
+			return fmt.Errorf("DS %q: invalid out-of-bounds (%q), must be drop or clamp.", ds.Regexp.String(), ds.OutOfBounds)
+		}
+		if ds.NaN != "" {
+			if _, err := rrd.ParseNaNPolicy(ds.NaN); err != nil {
+				return fmt.Errorf("DS %q: %v", ds.Regexp.String(), err)
+			}
+		}
+		for _, rra := range ds.RRAs {
+			if rra.Xff < 0 || rra.Xff > 1 {
+				return fmt.Errorf("DS %q: invalid RRA xff (%v), must be between 0 and 1.", ds.Regexp.String(), rra.Xff)
+			}
+			if (rra.Step.Nanoseconds() % c.MinStep.Nanoseconds()) != 0 {
+				return fmt.Errorf("DS %q: invalid Step (%v), must be one or multiple min-step (%v).", ds.Regexp.String(), rra.Step, c.MinStep)
+			}
+			if (rra.Step.Nanoseconds() % ds.Step.Duration.Nanoseconds()) != 0 {
+				newStep := time.Duration(rra.Step.Nanoseconds()/ds.Step.Duration.Nanoseconds()*ds.Step.Duration.Nanoseconds()) * time.Nanosecond
+				log.Printf("DS %q: RRA step (%v) is not a multiple of DS Step (%v), auto adjusting Step to %v.", ds.Regexp.String(), rra.Step, ds.Step.Duration, newStep)
+				if newStep.Nanoseconds() == 0 {
+					return fmt.Errorf("DS %q: invalid Step (%v)", ds.Regexp.String(), newStep)
+				}
+				rra.Step = newStep
+			}
+		}
+	}
+	return nil
+}
+
+var validPipelineName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// processSpecListeners checks the additional graphite listeners, the
+// names are as for pipelines.
+func (c *Config) processSpecListeners() error {
+	names := make(map[string]bool)
+	for n, l := range c.SpecListeners {
+		if !validPipelineName.MatchString(l.Name) {
+			return fmt.Errorf("graphite-listener %d: invalid or missing name %q (letters, digits, _ and - only)", n, l.Name)
+		}
+		if names[l.Name] {
+			return fmt.Errorf("graphite-listener %q: duplicate name", l.Name)
+		}
+		names[l.Name] = true
+		if l.TextListenSpec == "" && l.UdpListenSpec == "" {
+			return fmt.Errorf("graphite-listener %q: text-listen-spec and/or udp-listen-spec required", l.Name)
+		}
+		if len(l.DSs) == 0 {
+			return fmt.Errorf("graphite-listener %q: no DS specs ([[graphite-listener.ds]] or ds-rules-file)", l.Name)
+		}
+
+		lc := &Config{MinStep: c.MinStep, DSs: l.DSs}
+		if err := lc.processDSSpec(); err != nil {
+			return fmt.Errorf("graphite-listener %q: %v", l.Name, err)
+		}
+		c.SpecListeners[n].cfg = lc
+		log.Printf("Graphite listener %q on %q (TCP) %q (UDP): %d DS specs (graphite-listener).", l.Name, l.TextListenSpec, l.UdpListenSpec, len(l.DSs))
+	}
+	return nil
+}
+
+func (c *Config) processPipelines() error {
+	names, prefixes := make(map[string]bool), make(map[string]bool)
+	listening := make(map[string]string) // "proto spec" -> pipeline
+	listen := func(name, proto, spec string) error {
+		if spec == "" {
+			return nil
+		}
+		if other, ok := listening[proto+" "+spec]; ok {
+			return fmt.Errorf("pipeline %q: %s listen spec %q is already used by %s", name, proto, spec, other)
+		}
+		listening[proto+" "+spec] = fmt.Sprintf("pipeline %q", name)
+		return nil
+	}
+	main := [][2]string{{"tcp", c.GraphiteTextListenSpec}, {"udp", c.GraphiteUdpListenSpec}, {"tcp", c.GraphitePickleListenSpec},
+		{"tcp", c.StatsdTextListenSpec}, {"udp", c.StatsdUdpListenSpec}, {"tcp", c.OpentsdbTelnetListenSpec}, {"udp", c.CollectdListenSpec},
+		{"tcp", c.HttpListenSpec}}
+	for _, l := range c.SpecListeners {
+		main = append(main, [2]string{"tcp", l.TextListenSpec}, [2]string{"udp", l.UdpListenSpec})
+	}
+	for _, l := range main {
+		if l[1] != "" {
+			listening[l[0]+" "+l[1]] = "the main pipeline"
+		}
+	}
+
+	for n, p := range c.Pipelines {
+		if !validPipelineName.MatchString(p.Name) {
+			return fmt.Errorf("pipeline %d: invalid or missing name %q (letters, digits, _ and - only)", n, p.Name)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("pipeline %q: duplicate name", p.Name)
+		}
+		names[p.Name] = true
+		if p.DbPrefix == "" || p.DbPrefix == os.Getenv("TGRES_DB_PREFIX") || prefixes[p.DbPrefix] {
+			return fmt.Errorf("pipeline %q: db-prefix %q must be set and differ from that of every other pipeline", p.Name, p.DbPrefix)
+		}
+		prefixes[p.DbPrefix] = true
+		for _, l := range [][2]string{{"tcp", p.GraphiteTextListenSpec}, {"udp", p.GraphiteUdpListenSpec}, {"tcp", p.GraphitePickleListenSpec},
+			{"tcp", p.StatsdTextListenSpec}, {"udp", p.StatsdUdpListenSpec}, {"tcp", p.OpentsdbTelnetListenSpec}} {
+			if err := listen(p.Name, l[0], l[1]); err != nil {
+				return err
+			}
+		}
+
+		pc := *c
+		pc.Pipelines, pc.SpecListeners = nil, nil
+		pc.GraphiteTextListenSpec, pc.GraphiteUdpListenSpec = p.GraphiteTextListenSpec, p.GraphiteUdpListenSpec
+		pc.GraphitePickleListenSpec = p.GraphitePickleListenSpec
+		pc.StatsdTextListenSpec, pc.StatsdUdpListenSpec = p.StatsdTextListenSpec, p.StatsdUdpListenSpec
+		pc.OpentsdbTelnetListenSpec = p.OpentsdbTelnetListenSpec
+		pc.HttpListenSpec, pc.CollectdListenSpec = "", ""
+		pc.NatsURL, pc.NatsSubscriptions = "", nil
+		pc.MqttURL, pc.MqttSubscriptions = "", nil
+		pc.AmqpURL = ""
+		pc.DSs, pc.DSRulesFile = p.DSs, p.DSRulesFile
+		if p.ListenerPrefixes != nil {
+			if err := p.ListenerPrefixes.validate(); err != nil {
+				return fmt.Errorf("pipeline %q: listener-prefixes: %v", p.Name, err)
+			}
+			pc.ListenerPrefixes = p.ListenerPrefixes
+		}
+		pc.ClusterSpoolDir = ""
+		pc.ColdStorageURL, pc.coldStore = "", nil
+		if c.DeadLetterPath != "" { // every pipeline has its own
+			pc.DeadLetterPath = c.DeadLetterPath + "." + p.Name
+		}
+		if err := pc.processDSSpec(); err != nil {
+			return fmt.Errorf("pipeline %q: %v", p.Name, err)
+		}
+		c.Pipelines[n].cfg = &pc
+		log.Printf("Pipeline %q: %d DS specs, db prefix %q (pipeline).", p.Name, len(p.DSs), p.DbPrefix)
+	}
+	return nil
+}
+
+func (c *Config) FindMatchingDSSpec(ident serde.Ident) *rrd.DSSpec {
+	for _, dsSpec := range c.DSs {
+		name := ident["name"]
+		if dsSpec.Regexp.Regexp.MatchString(name) {
+			return convertDSSpec(&dsSpec)
+		}
+	}
+	return nil
+}
+
+// dsSpecChanges compares two lists of DS specs and returns a
+// description of every rule that was added, removed or changed. Rules
+// are identified by their regular expression.
+func dsSpecChanges(before, after []ConfigDSSpec) []string {
+	var result []string
+
+	oldByRe := make(map[string]*rrd.DSSpec, len(before))
+	var oldOrder []string
+	for i := range before {
+		re := before[i].Regexp.String()
+		oldByRe[re] = convertDSSpec(&before[i])
+		oldOrder = append(oldOrder, re)
+	}
+
+	newByRe := make(map[string]bool, len(after))
+	var newOrder []string
+	for i := range after {
+		re := after[i].Regexp.String()
+		newByRe[re] = true
+		if oldSpec, ok := oldByRe[re]; !ok {
+			result = append(result, fmt.Sprintf("added: %q", re))
+		} else {
+			if !reflect.DeepEqual(oldSpec, convertDSSpec(&after[i])) {
+				result = append(result, fmt.Sprintf("changed: %q", re))
+			}
+			newOrder = append(newOrder, re)
+		}
+	}
+
+	var common []string
+	for _, re := range oldOrder {
+		if !newByRe[re] {
+			result = append(result, fmt.Sprintf("removed: %q", re))
+		} else {
+			common = append(common, re)
+		}
+	}
+
+	// The first matching rule wins, so order matters too
+	if !reflect.DeepEqual(common, newOrder) {
+		result = append(result, "rule order changed")
+	}
+
+	return result
+}
+
+func convertDSSpec(dsSpec *ConfigDSSpec) *rrd.DSSpec {
+	serdeDSSpec := &rrd.DSSpec{
+		Step:      dsSpec.Step.Duration,
+		Heartbeat: dsSpec.Heartbeat.Duration,
+		Type:      dsSpec.Type.DSType,
+		RRAs:      make([]rrd.RRASpec, len(dsSpec.RRAs)),
+	}
+	if dsSpec.Min != nil || dsSpec.Max != nil {
+		bounds := &rrd.Bounds{Min: math.Inf(-1), Max: math.Inf(1), Clamp: strings.ToLower(dsSpec.OutOfBounds) == "clamp"}
+		if dsSpec.Min != nil {
+			bounds.Min = *dsSpec.Min
+		}
+		if dsSpec.Max != nil {
+			bounds.Max = *dsSpec.Max
+		}
+		serdeDSSpec.Bounds = bounds
+	}
+	if dsSpec.NaN != "" {
+		// validated in processDSSpec
+		serdeDSSpec.NaN, _ = rrd.ParseNaNPolicy(dsSpec.NaN)
+	}
+	for i, r := range dsSpec.RRAs {
+		xff := r.Xff
+		if !r.xffSet && dsSpec.Xff != nil {
+			xff = *dsSpec.Xff
+		}
+		serdeDSSpec.RRAs[i] = rrd.RRASpec{
+			Function: r.Function,
+			Step:     r.Step,
+			Span:     r.Span,
+			Xff:      float32(xff),
+		}
+	}
+	return serdeDSSpec
+}
+
+type configer interface {
+	processConfigPidFile(string) error
+	processConfigLogFile(string) error
+	processConfigLogCycleInterval() error
+	processDbConnectString() error
+	processDbDriver() error
+	processMinStep() error
+	processMaxReceiverQueueSize() error
+	processReceiverQueueOverflow() error
+	processBackfillWindow() error
+	processDuplicatePolicy() error
+	processListenerQuotas() error
+	processListenerPrefixes() error
+	processListenerTimestamps() error
+	processClusterHops() error
+	processClusterReplicas() error
+	processClusterTransitionRate() error
+	processClusterNodeWeight(string) error
+	processClusterEncryption(string) error
+	processClusterJoinToken(string) error
+	processClusterSeeds() error
+	processNewDSLimits() error
+	processCreateBreaker() error
+	processLoadRetries() error
+	processFilters() error
+	processRewrites() error
+	processPreAggregates() error
+	processNameTemplates() error
+	processAggOutputs() error
+	processAggHistograms() error
+	processStatsdTimers() error
+	processMaxMemoryBytes() error
+	processFlushWorkers() error
+	processFlushBatch() error
+	processDSCacheMemory() error
+	processDSStale() error
+	processDeadLetterFile(string) error
+	processClusterSpool(string) error
+	processColdStorage(string) error
+	processCollectd(string) error
+	processNats() error
+	processMqtt() error
+	processAmqp() error
+	processTLS(string) error
+	processUDPReaders() error
+	processUnixSocketMode() error
+	processProxyProtocol() error
+	processConnLimits() error
+	processBackpressure() error
+	processStrictListeners() error
+	processShutdownTimeout() error
+	processDbConnections() error
+	processDbTLS(string) error
+	processDbReadReplicas() error
+	processDbMaintenance() error
+	processDSRetention() error
+	processHttpAdmin() error
+	processPgSegmentWidth() error
+	processPgIndexes() error
+	processPgTsCompression() error
+	processPgSchemaCompat() error
+	processStatFlushInterval() error
+	processStatsNamePrefix() error
+	processWorkers() error
+	processDSSpec() error
+	processSpecListeners() error
+	processPipelines() error
+}
+
+var processConfig = func(c configer, wd string) error {
+
+	if err := c.processConfigPidFile(wd); err != nil {
+		return err
+	}
+	if err := c.processConfigLogFile(wd); err != nil {
+		return err
+	}
+	if err := c.processConfigLogCycleInterval(); err != nil {
+		return err
+	}
+	if err := c.processDbConnectString(); err != nil {
+		return err
+	}
+	if err := c.processDbDriver(); err != nil {
+		return err
+	}
+	if err := c.processMinStep(); err != nil {
+		return err
+	}
+	if err := c.processMaxReceiverQueueSize(); err != nil {
+		return err
+	}
+	if err := c.processReceiverQueueOverflow(); err != nil {
+		return err
+	}
+	if err := c.processBackfillWindow(); err != nil {
+		return err
+	}
+	if err := c.processDuplicatePolicy(); err != nil {
+		return err
+	}
+	if err := c.processListenerQuotas(); err != nil {
+		return err
+	}
+	if err := c.processListenerPrefixes(); err != nil {
+		return err
+	}
+	if err := c.processListenerTimestamps(); err != nil {
+		return err
+	}
+	if err := c.processClusterHops(); err != nil {
+		return err
+	}
+	if err := c.processClusterReplicas(); err != nil {
+		return err
+	}
+	if err := c.processClusterTransitionRate(); err != nil {
+		return err
+	}
+	if err := c.processClusterNodeWeight(wd); err != nil {
+		return err
+	}
+	if err := c.processClusterEncryption(wd); err != nil {
+		return err
+	}
+	if err := c.processClusterJoinToken(wd); err != nil {
+		return err
+	}
+	if err := c.processClusterSeeds(); err != nil {
+		return err
+	}
+	if err := c.processNewDSLimits(); err != nil {
+		return err
+	}
+	if err := c.processCreateBreaker(); err != nil {
+		return err
+	}
+	if err := c.processLoadRetries(); err != nil {
+		return err
+	}
+	if err := c.processFilters(); err != nil {
+		return err
+	}
+	if err := c.processRewrites(); err != nil {
+		return err
+	}
+	if err := c.processPreAggregates(); err != nil {
+		return err
+	}
+	if err := c.processNameTemplates(); err != nil {
+		return err
+	}
+	if err := c.processAggOutputs(); err != nil {
+		return err
+	}
+	if err := c.processAggHistograms(); err != nil {
+		return err
+	}
+	if err := c.processStatsdTimers(); err != nil {
+		return err
+	}
+	if err := c.processMaxMemoryBytes(); err != nil {
+		return err
+	}
+	if err := c.processFlushWorkers(); err != nil {
+		return err
+	}
+	if err := c.processFlushBatch(); err != nil {
+		return err
+	}
+	if err := c.processDSCacheMemory(); err != nil {
+		return err
+	}
+	if err := c.processDSStale(); err != nil {
+		return err
+	}
+	if err := c.processDeadLetterFile(wd); err != nil {
+		return err
+	}
+	if err := c.processClusterSpool(wd); err != nil {
+		return err
+	}
+	if err := c.processColdStorage(wd); err != nil {
+		return err
+	}
+	if err := c.processCollectd(wd); err != nil {
+		return err
+	}
+	if err := c.processNats(); err != nil {
+		return err
+	}
+	if err := c.processMqtt(); err != nil {
+		return err
+	}
+	if err := c.processAmqp(); err != nil {
+		return err
+	}
+	if err := c.processTLS(wd); err != nil {
+		return err
+	}
+	if err := c.processUDPReaders(); err != nil {
+		return err
+	}
+	if err := c.processUnixSocketMode(); err != nil {
+		return err
+	}
+	if err := c.processProxyProtocol(); err != nil {
+		return err
+	}
+	if err := c.processConnLimits(); err != nil {
+		return err
+	}
+	if err := c.processBackpressure(); err != nil {
+		return err
+	}
+	if err := c.processStrictListeners(); err != nil {
+		return err
+	}
+	if err := c.processShutdownTimeout(); err != nil {
+		return err
+	}
+	if err := c.processDbConnections(); err != nil {
+		return err
+	}
+	if err := c.processDbTLS(wd); err != nil {
+		return err
+	}
+	if err := c.processDbReadReplicas(); err != nil {
+		return err
+	}
+	if err := c.processDbMaintenance(); err != nil {
+		return err
+	}
+	if err := c.processDSRetention(); err != nil {
+		return err
+	}
+	if err := c.processHttpAdmin(); err != nil {
+		return err
+	}
+	if err := c.processPgSegmentWidth(); err != nil {
+		return err
+	}
+	if err := c.processPgIndexes(); err != nil {
+		return err
+	}
+	if err := c.processPgSchemaCompat(); err != nil {
+		return err
+	}
+	if err := c.processPgTsCompression(); err != nil {
+		return err
+	}
+	if err := c.processStatFlushInterval(); err != nil {
+		return err
+	}
+	if err := c.processStatsNamePrefix(); err != nil {
+		return err
+	}
+	if err := c.processWorkers(); err != nil {
+		return err
 	}
 	if err := c.processDSSpec(); err != nil {
 		return err
 	}
+	if err := c.processSpecListeners(); err != nil {
+		return err
+	}
+	if err := c.processPipelines(); err != nil {
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,164 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tgres/tgres/receiver"
+)
+
+// connLimiter limits the number of connections to a TCP listener and
+// the time a line may take to arrive, see listener-max-connections
+// and listener-read-timeout, and stops reading while the receiver
+// queue is too long, see backpressure-listeners. Connections,
+// rejected connections, timeouts and backpressure pauses are counted
+// as receiver.listener.<listener>.connections, conns_rejected,
+// timeouts and paused.
+type connLimiter struct {
+	rcvr     *receiver.Receiver
+	listener string
+	slots    chan struct{} // nil is unlimited
+	read     time.Duration // 0 is none
+	backlog  int           // receiver queue length to pause at, 0 is never
+}
+
+// How often a paused connection checks the receiver queue
+const backpressurePoll = 50 * time.Millisecond
+
+// newConnLimiter returns the limits of a listener, lines is whether
+// its protocol is line based, the read timeout only applies then.
+func newConnLimiter(rcvr *receiver.Receiver, listener string, cfg *Config, lines bool) *connLimiter {
+	l := &connLimiter{rcvr: rcvr, listener: listener}
+	if n := cfg.ListenerMaxConns[listener]; n > 0 {
+		l.slots = make(chan struct{}, n)
+	}
+	if lines {
+		l.read = cfg.ListenerReadTimeout.Duration
+	}
+	for _, bl := range cfg.BackpressureListeners {
+		if bl == listener {
+			l.backlog = cfg.BackpressureQueueSize
+		}
+	}
+	return l
+}
+
+// accept returns the conn wrapped, or closes it and returns nil if
+// the listener is at its maximum number of connections. It should be
+// called after any TLS wrapping so that the lines can be seen. A nil
+// connLimiter returns conn as is.
+func (l *connLimiter) accept(conn net.Conn) net.Conn {
+	if l == nil {
+		return conn
+	}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			l.rcvr.CountListenerEvent(l.listener, "conns_rejected")
+			conn.Close()
+			return nil
+		}
+	}
+	l.rcvr.CountListenerEvent(l.listener, "connections")
+	return &limitConn{Conn: conn, l: l}
+}
+
+// limitConn frees the connection slot on Close and counts read
+// timeouts. If there is a read timeout, from the first byte of a
+// line the rest of it must arrive within it, regardless of the
+// deadline set, which then only applies between lines (the idle
+// timeout).
+type limitConn struct {
+	net.Conn
+	l         *connLimiter
+	deadline  time.Time // as set by SetDeadline or SetReadDeadline
+	lineStart time.Time // zero is between lines
+	closed    int32
+	closeOnce sync.Once
+}
+
+func (c *limitConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *limitConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *limitConn) Read(b []byte) (int, error) {
+	c.pause()
+	if c.l.read > 0 && !c.lineStart.IsZero() {
+		dl := c.lineStart.Add(c.l.read)
+		if !c.deadline.IsZero() && c.deadline.Before(dl) {
+			dl = c.deadline
+		}
+		c.Conn.SetReadDeadline(dl)
+	}
+	n, err := c.Conn.Read(b)
+	if c.l.read > 0 && n > 0 {
+		if b[n-1] == '\n' {
+			c.lineStart = time.Time{}
+			c.Conn.SetReadDeadline(c.deadline)
+		} else if c.lineStart.IsZero() || bytes.IndexByte(b[:n], '\n') >= 0 {
+			c.lineStart = time.Now() // a new line began
+		}
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.l.rcvr.CountListenerEvent(c.l.listener, "timeouts")
+	}
+	return n, err
+}
+
+// pause waits while the receiver queue is over the backlog, leaving
+// the data in the socket buffers so that TCP flow control makes the
+// sender wait (and buffer) rather than us accepting it only to drop
+// it. The time paused does not count towards the deadlines.
+func (c *limitConn) pause() {
+	if c.l.backlog <= 0 || c.l.rcvr.QueueLen() < c.l.backlog {
+		return
+	}
+	c.l.rcvr.CountListenerEvent(c.l.listener, "paused")
+	start := time.Now()
+	for c.l.rcvr.QueueLen() >= c.l.backlog && atomic.LoadInt32(&(c.closed)) == 0 {
+		time.Sleep(backpressurePoll)
+	}
+	paused := time.Since(start)
+	if !c.lineStart.IsZero() {
+		c.lineStart = c.lineStart.Add(paused)
+	}
+	if !c.deadline.IsZero() {
+		c.SetReadDeadline(c.deadline.Add(paused))
+	}
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	atomic.StoreInt32(&(c.closed), 1)
+	c.closeOnce.Do(func() {
+		if c.l.slots != nil {
+			<-c.l.slots
+		}
+	})
+	return err
+}
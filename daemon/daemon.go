@@ -18,12 +18,14 @@ package daemon
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -34,6 +36,7 @@ import (
 	"github.com/tgres/tgres/dsl"
 	"github.com/tgres/tgres/receiver"
 	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/tier"
 )
 
 var (
@@ -58,9 +61,16 @@ var savePid = func(pidPath string) error {
 	return err
 }
 
-var initDb = func(connectString string) (serde.DbSerDe, error) {
+var initDb = func(driver, connectString string) (serde.DbSerDe, error) {
 	prefix := os.Getenv("TGRES_DB_PREFIX")
-	return serde.InitDb(connectString, prefix)
+	return openDb(driver, connectString, prefix)
+}
+
+// openDb opens the database with the serde driver registered as
+// driver, see db-driver. A blank driver is the one the connect string
+// names, e.g. "sqlite:<path>", or else PostgreSQL.
+func openDb(driver, connectString, prefix string) (serde.DbSerDe, error) {
+	return serde.Open(driver, connectString, prefix)
 }
 
 // Figure out which address to bind to and which to advertize for the
@@ -83,9 +93,11 @@ var determineClusterBindAddress = func(db serde.DbAddresser) (bindAddr, advAddr
 	return
 }
 
-var determineClusterJoinAddress = func(join string, db serde.DbAddresser) (ips []string, err error) {
+var determineClusterJoinAddress = func(join string, seeds []string, db serde.DbAddresser) (ips []string, err error) {
 	if join != "" {
 		ips = strings.Split(join, ",")
+	} else if len(seeds) > 0 {
+		return resolveSeeds(seeds)
 	} else if os.Getenv("TGRES_ADDRFROMDB") != "" {
 		if ips, err = db.ListDbClientIps(); err != nil {
 			return nil, err
@@ -94,8 +106,16 @@ var determineClusterJoinAddress = func(join string, db serde.DbAddresser) (ips [
 	return ips, err
 }
 
-var initCluster = func(bindAddr, advAddr string, joinIps []string) (c *cluster.Cluster, err error) {
-	c, err = cluster.NewClusterBind(bindAddr, 0, advAddr, 0, 0, bindAddr)
+// The node name is the bind address unless TGRES_NODE_NAME is set,
+// e.g. to the name of a Kubernetes pod of a StatefulSet, which,
+// unlike its address, is the same after a restart, and so the node
+// rejoins with the same DSs.
+var initCluster = func(bindAddr, advAddr string, joinIps []string, enc *cluster.Encryption) (c *cluster.Cluster, err error) {
+	name := os.Getenv("TGRES_NODE_NAME")
+	if name == "" {
+		name = bindAddr
+	}
+	c, err = cluster.NewClusterEncrypted(bindAddr, 0, advAddr, 0, 0, name, enc)
 	if err != nil {
 		return nil, err
 	}
@@ -113,10 +133,66 @@ var createReceiver = func(cfg *Config, c *cluster.Cluster, db serde.SerDe) *rece
 	r.StatFlushDuration = cfg.StatFlush.Duration
 	r.StatsNamePrefix = cfg.StatsNamePrefix
 	r.MaxReceiverQueueSize = cfg.MaxReceiverQueueSize
+	r.QueueOverflowPolicy = cfg.queueOverflowPolicy
 	r.MaxMemoryBytes = uint64(cfg.MaxMemoryBytes)
+	r.BackfillWindow = cfg.BackfillWindow.Duration
+	r.DuplicatePolicy = cfg.duplicatePolicy
+	r.ListenerQuotas = cfg.ListenerQuotas
+	r.ListenerSourceQuota = cfg.ListenerSourceQuota
+	r.QuotaPolicy = cfg.quotaPolicy
+	for _, l := range cfg.SpecListeners {
+		r.SetDSSpecSet(l.Name, l.cfg)
+	}
+	r.ListenerPrefixes = cfg.ListenerPrefixes
+	r.ListenerTimestamps = cfg.listenerTimestamps
+	r.MaxHops = cfg.ClusterMaxHops
+	r.MaxForwards = cfg.ClusterMaxForwards
+	r.ForwardRetrySize = cfg.ClusterForwardRetrySize
+	r.ForwardSpoolDir = cfg.ClusterSpoolDir
+	r.ForwardSpoolMaxSize = int64(cfg.ClusterSpoolMaxSize)
+	r.ForwardSpoolMaxAge = cfg.ClusterSpoolMaxAge.Duration
+	r.MaxNewDSs = cfg.MaxNewDSs
+	r.MaxNewDSsByPrefix = cfg.MaxNewDSsByPrefix
+	r.NewDSInterval = cfg.NewDSInterval.Duration
+	r.CreateBreakerMaxSeries = cfg.CreateBreakerMaxSeries
+	r.CreateBreakerMaxRate = cfg.CreateBreakerMaxRate
+	r.CreateBreakerInterval = cfg.CreateBreakerInterval.Duration
+	r.CreateBreakerCooldown = cfg.CreateBreakerCooldown.Duration
+	r.LoadRetries = cfg.LoadRetries
+	r.DBBreakerThreshold = cfg.DBBreakerThreshold
+	r.Whitelist = regexps(cfg.Whitelist)
+	r.Blacklist = regexps(cfg.Blacklist)
+	r.Rewrites = rewriteRules(cfg.Rewrites)
+	r.PreAggregates = preAggregateRules(cfg.PreAggregates)
+	r.NameTemplates = cfg.nameTemplates
+	r.AggOutputs = aggOutputSpecs(cfg.AggOutputs)
+	r.AggHistograms = aggHistogramSpecs(cfg.AggHistograms)
+	r.AggThresholds = cfg.StatsdThresholds
+	r.AggTimerAggregates = cfg.StatsdTimerAggregates
+	r.AggThresholdAggregates = cfg.StatsdThresholdAggs
+	r.AggThresholdSep = cfg.StatsdThresholdSep
 	r.ReportStats = true
 	r.NWorkers = cfg.Workers
-	r.SetCluster(c)
+	r.FlushWorkers = cfg.FlushWorkers
+	r.FlushSharding = cfg.flushShardFunc
+	r.FlushBatchSize = cfg.FlushBatchSize
+	r.FlushBatchDelay = cfg.FlushBatchDelay.Duration
+	r.FlushTargetLatency = cfg.FlushTargetLatency.Duration
+	r.FlushMaxStretch = cfg.FlushMaxStretch
+	r.DSCacheMaxMemory = uint64(cfg.DSCacheMaxMemory)
+	r.DSCacheMinIdle = cfg.DSCacheMinIdle.Duration
+	r.DSStaleAfter = cfg.DSStaleAfter.Duration
+	r.DSArchiveStale = cfg.DSArchiveStale
+	r.Retention = cfg.DSRetention.Duration
+	r.RetentionByPrefix = cfg.dsRetentionByPrefix()
+	r.RetentionDryRun = cfg.DSRetentionDryRun
+	r.DeadLetterFile = cfg.DeadLetterPath
+	r.DeadLetterMaxSize = int64(cfg.DeadLetterMaxSize)
+	r.ShutdownTimeout = cfg.ShutdownTimeout.Duration
+	r.DbMaintenanceInterval = cfg.DbMaintenanceInterval.Duration
+	if c != nil {
+		r.SetCluster(c)
+	}
 	return r
 }
 
@@ -124,17 +200,58 @@ var startReceiver = func(r *receiver.Receiver) {
 	r.Start()
 }
 
+// reloadDSSpecs re-reads the DS specs ([[ds]] sections) from the
+// config file and the ds-rules-file, if any, and makes the receiver
+// use them for DSs created from now on. Existing DSs are not affected. Other settings require a
+// (graceful) restart to take effect.
+var reloadDSSpecs = func(r *receiver.Receiver, cfgPath string) error {
+	cfg, err := readConfig(cfgPath)
+	if err != nil {
+		return err
+	}
+
+	old, _ := r.DSSpecFinder().(*Config)
+	if old != nil && old.MinStep != cfg.MinStep {
+		log.Printf("reloadDSSpecs: min-step change (%v to %v) requires a restart, ignoring.", old.MinStep.Duration, cfg.MinStep.Duration)
+		cfg.MinStep = old.MinStep
+	}
+	if err := cfg.processMinStep(); err != nil {
+		return err
+	}
+	if err := cfg.processDSSpec(); err != nil {
+		return err
+	}
+
+	if old != nil {
+		changes := dsSpecChanges(old.DSs, cfg.DSs)
+		if len(changes) == 0 {
+			log.Printf("reloadDSSpecs: no DS spec changes.")
+		}
+		for _, change := range changes {
+			log.Printf("reloadDSSpecs: DS spec %s", change)
+		}
+	}
+
+	r.SetDSSpecFinder(cfg)
+	return nil
+}
+
 var waitForSignal = func(r *receiver.Receiver, sm *serviceManager, cfgPath, join string) {
 	for {
 		// Wait for a SIGINT or SIGTERM.
 		ch := make(chan os.Signal)
-		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
 		s := <-ch
 		log.Printf("Got signal: %v", s)
 		if s == syscall.SIGHUP {
 			if gracefulChildPid == 0 {
 				gracefulRestart(r, sm, cfgPath, join)
 			}
+		} else if s == syscall.SIGUSR2 {
+			log.Printf("Reloading DS specs from %q", cfgPath)
+			if err := reloadDSSpecs(r, cfgPath); err != nil {
+				log.Printf("Error reloading DS specs, keeping the old ones: %v", err)
+			}
 		} else {
 			gracefulExit(r, sm)
 			break
@@ -142,7 +259,37 @@ var waitForSignal = func(r *receiver.Receiver, sm *serviceManager, cfgPath, join
 	}
 }
 
-func Init(cfgPath, gracefulProtos, join string) (cfg *Config) { // not to be confused with init()
+// replayDeadLetters queues the data points recorded in a dead letter
+// file for processing again, see receiver.ReplayDeadLetters. Only
+// what is in the file when it is opened is replayed, so that points
+// dropped again while replaying (and appended to it if this is the
+// dead letter file in use) are not replayed in an endless loop.
+var replayDeadLetters = func(r *receiver.Receiver, path string, rate int) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Replay: unable to open %q: %v", path, err)
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		log.Printf("Replay: unable to stat %q: %v", path, err)
+		return
+	}
+
+	log.Printf("Replay: replaying dead letters from %q (%d bytes, rate: %d/s, 0 is unlimited)...", path, fi.Size(), rate)
+	queued, skipped, err := r.ReplayDeadLetters(io.LimitReader(f, fi.Size()), rate)
+	if err != nil {
+		log.Printf("Replay: %q: %v", path, err)
+	}
+	log.Printf("Replay: done, %d data points queued, %d lines skipped.", queued, skipped)
+}
+
+// Init starts tgres and returns when it exits. If replayPath is not
+// empty, the data points in that dead letter file are replayed at up
+// to replayRate points per second once the receiver is started.
+func Init(cfgPath, gracefulProtos, join, replayPath string, replayRate int) (cfg *Config) { // not to be confused with init()
 
 	log.Printf("Tgres starting.")
 
@@ -167,7 +314,7 @@ func Init(cfgPath, gracefulProtos, join string) (cfg *Config) { // not to be con
 	}
 
 	// Connect to the DB (and create tables if needed, etc)
-	db, err := initDb(cfg.DbConnectString)
+	db, err := initDb(cfg.DbDriver, cfg.DbConnectString)
 	if err != nil {
 		log.Printf("Error connecting to the DB, exiting: %v", err)
 		return
@@ -184,7 +331,7 @@ func Init(cfgPath, gracefulProtos, join string) (cfg *Config) { // not to be con
 
 	// Determine ips of other nodes to join
 	var joinIps []string
-	joinIps, err = determineClusterJoinAddress(join, db.DbAddresser())
+	joinIps, err = determineClusterJoinAddress(join, cfg.ClusterSeeds, db.DbAddresser())
 	if err != nil {
 		log.Printf("Cannot determine cluster node addresses to join, exiting: %v", err)
 		return
@@ -204,9 +351,20 @@ func Init(cfgPath, gracefulProtos, join string) (cfg *Config) { // not to be con
 		rcvr.Blaster = blaster.New(rcvr)
 	}
 
+	dsl.FsFindIncludeArchived = cfg.FsFindIncludeArchived
+
 	// Create and run the Service Manager
-	rcache := dsl.NewNamedDSFetcher(db.Fetcher(), rcvr.DsCache(), cfg.QueryCacheSize)
+	fetcher := db.Fetcher()
+	if cfg.coldStore != nil && fetcher != nil {
+		fetcher = tier.NewFetcher(fetcher, cfg.coldStore)
+	}
+	rcache := dsl.NewNamedDSFetcher(fetcher, rcvr.DsCache(), cfg.QueryCacheSize)
+	rcache.Listen(db.EventListener()) // learn of DSs created by other nodes
 	serviceMgr := newServiceManager(rcvr, rcache, cfg)
+	if err := createPipelines(cfg, serviceMgr); err != nil {
+		log.Printf("Could not create the pipelines, exiting: %v", err)
+		return
+	}
 	if err := serviceMgr.run(gracefulProtos); err != nil {
 		log.Printf("Could not run the service manager: %v", err)
 		return
@@ -250,7 +408,7 @@ func Init(cfgPath, gracefulProtos, join string) (cfg *Config) { // not to be con
 		attempts     = 30
 	)
 	for i := 0; i < attempts; i++ {
-		c, err = initCluster(bindAddr, advAddr, joinIps)
+		c, err = initCluster(bindAddr, advAddr, joinIps, cfg.clusterEncryption)
 		if err != nil {
 			if i > 1 { // silence the first message
 				log.Printf("Error initializing cluster, will try again in %v (up to %v times): %v", clusterPause, attempts, err)
@@ -266,7 +424,28 @@ func Init(cfgPath, gracefulProtos, join string) (cfg *Config) { // not to be con
 	} else {
 		log.Printf("Cluster initialized")
 	}
+	if c != nil && cfg.ClusterSendQueueSize > 0 {
+		c.SetSendQueueSize(cfg.ClusterSendQueueSize)
+	}
+	if c != nil && cfg.ClusterReplicas > 1 {
+		c.Copies(cfg.ClusterReplicas)
+	}
+	if c != nil && cfg.ClusterTransitionRate > 0 {
+		c.SetTransitionRate(cfg.ClusterTransitionRate)
+	}
+	if c != nil && cfg.clusterNodeWeight != 1 {
+		if err := c.SetWeight(cfg.clusterNodeWeight); err != nil {
+			log.Printf("Unable to set the cluster node weight: %v", err)
+		}
+	}
 	rcvr.SetCluster(c)
+	if c != nil {
+		// Any node can answer any query
+		rcache.SetRemote(newClusterSeriesFetcher(c, rcache))
+	}
+	if c != nil && join == "" && len(cfg.ClusterSeeds) > 0 {
+		go rejoinSeeds(c, cfg.ClusterSeeds, cfg.ClusterSeedInterval.Duration)
+	}
 
 	// Save PID (by now the graceful parent pid can be overwritten)
 	if err := savePid(cfg.PidPath); err != nil {
@@ -278,8 +457,19 @@ func Init(cfgPath, gracefulProtos, join string) (cfg *Config) { // not to be con
 
 	// *finally* start the receiver (because graceful restart, parent must save data first)
 	startReceiver(rcvr)
+	for _, pr := range serviceMgr.pipelines {
+		startReceiver(pr)
+	}
 	log.Printf("Receiver started, Tgres is ready.")
 
+	if replayPath != "" {
+		go replayDeadLetters(rcvr, replayPath, replayRate)
+	}
+
+	if cfg.coldStore != nil && db.Fetcher() != nil {
+		tier.NewArchiver(db.Fetcher(), cfg.coldStore, cfg.ColdAge.Duration, cfg.ColdInterval.Duration).Start()
+	}
+
 	// start the rcache warmup
 	if cfg.QueryCacheSize > 0 {
 		go func() {
@@ -336,6 +526,172 @@ func Finish(cfg *Config) {
 	}
 }
 
+// Delete deletes the DSs whose names match glob (see
+// serde.DeleteDataSources) from the database of the config and
+// writes them to out, one per line, or with dryRun only writes them.
+// Running tgres instances with a PostgreSQL database drop them from
+// their caches when notified, others need to be restarted.
+func Delete(cfgPath, glob string, dryRun bool, out io.Writer) error {
+	_, db, err := initCliDb(cfgPath)
+	if err != nil {
+		return err
+	}
+	remover, ok := db.Fetcher().(serde.DataSourceRemover)
+	if !ok {
+		return fmt.Errorf("Deleting DSs is not supported by this database")
+	}
+
+	deleted, err := serde.DeleteDataSources(remover, serde.DeleteQuery{Glob: glob}, dryRun)
+	ids := make([]int64, 0, len(deleted))
+	for id := range deleted {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		fmt.Fprintf(out, "%d %s\n", id, deleted[id])
+	}
+	if dryRun {
+		fmt.Fprintf(out, "%d DSs would be deleted (dry run).\n", len(deleted))
+	} else {
+		fmt.Fprintf(out, "%d DSs deleted.\n", len(deleted))
+	}
+	return err
+}
+
+// Rename renames the DS named from to the name to, or the subtree if
+// both end in ".*" (see serde.RenameDataSources), in the database of
+// the config and writes the renames to out, one per line, or with
+// dryRun only writes them. As with Delete, only running tgres
+// instances with a PostgreSQL database are notified.
+func Rename(cfgPath, from, to string, dryRun bool, out io.Writer) error {
+	_, db, err := initCliDb(cfgPath)
+	if err != nil {
+		return err
+	}
+	mover, ok := db.Fetcher().(serde.DataSourceMover)
+	if !ok {
+		return fmt.Errorf("Renaming DSs is not supported by this database")
+	}
+
+	renames, err := serde.RenameDataSources(mover, from, to, dryRun)
+	for _, rn := range renames {
+		fmt.Fprintf(out, "%d %s -> %s\n", rn.Id, rn.From, rn.To)
+	}
+	if dryRun {
+		fmt.Fprintf(out, "%d DSs would be renamed (dry run).\n", len(renames))
+	} else {
+		fmt.Fprintf(out, "%d DSs renamed.\n", len(renames))
+	}
+	return err
+}
+
+// Dump writes the DSs whose names match glob, with their data
+// points from after from up to until (as RFC 3339 or seconds since
+// the epoch, either empty is unbounded), from the database of the
+// config to out in the portable format of serde.Dump.
+func Dump(cfgPath, glob, from, until string, out io.Writer) error {
+	f, err := parseDumpTime(from)
+	if err != nil {
+		return err
+	}
+	u, err := parseDumpTime(until)
+	if err != nil {
+		return err
+	}
+	_, db, err := initCliDb(cfgPath)
+	if err != nil {
+		return err
+	}
+	dumper, ok := db.Fetcher().(serde.DataSourceDumper)
+	if !ok {
+		return fmt.Errorf("Dumping DSs is not supported by this database")
+	}
+
+	n, err := serde.Dump(dumper, out, glob, f, u)
+	log.Printf("%d DSs dumped.", n)
+	return err
+}
+
+// Restore reads a dump written by Dump (see serde.Restore) from in
+// into the database of the config and writes the number of DSs
+// restored to out. Running tgres instances do not know about the
+// restored data points and may overwrite the state of the DSs they
+// have cached, they are best restored into while none is running.
+func Restore(cfgPath string, in io.Reader, out io.Writer) error {
+	_, db, err := initCliDb(cfgPath)
+	if err != nil {
+		return err
+	}
+	restorer, ok := db.Fetcher().(serde.DataSourceRestorer)
+	if !ok {
+		return fmt.Errorf("Restoring DSs is not supported by this database")
+	}
+
+	n, err := serde.Restore(restorer, in)
+	fmt.Fprintf(out, "%d DSs restored.\n", n)
+	return err
+}
+
+// Fsck checks the DSs and RRAs in the database of the config for
+// impossible state, with repair also repairing what it can (see
+// serde.Checker), and writes the problems to out, one per line. It
+// is an error if any are left unrepaired.
+func Fsck(cfgPath string, repair bool, out io.Writer) error {
+	_, db, err := initCliDb(cfgPath)
+	if err != nil {
+		return err
+	}
+	checker, ok := db.Fetcher().(serde.Checker)
+	if !ok {
+		return fmt.Errorf("Checking DSs is not supported by this database")
+	}
+
+	report, err := checker.Check(repair)
+	if report != nil {
+		for _, p := range report.Problems {
+			fmt.Fprintln(out, p)
+		}
+		fmt.Fprintf(out, "%d problems found, %d repaired.\n", len(report.Problems), len(report.Problems)-report.Unrepaired())
+		if n := report.Unrepaired(); err == nil && n > 0 {
+			err = fmt.Errorf("%d problems not repaired", n)
+		}
+	}
+	return err
+}
+
+// initCliDb reads the config and connects to its database, for the
+// command line operations such as the above.
+func initCliDb(cfgPath string) (*Config, serde.SerDe, error) {
+	cfg, err := readConfig(cfgPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to read config %q: %v", cfgPath, err)
+	}
+	if err := processConfig(cfg, getCwd()); err != nil {
+		return nil, nil, fmt.Errorf("Error in config file %s: %v", cfgPath, err)
+	}
+	db, err := initDb(cfg.DbDriver, cfg.DbConnectString)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error connecting to the DB: %v", err)
+	}
+	return cfg, db, nil
+}
+
+// parseDumpTime parses a time as RFC 3339 or seconds since the
+// epoch, empty is the zero time.
+func parseDumpTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid time %q, expected RFC 3339 or seconds since the epoch", s)
+	}
+	return t, nil
+}
+
 func gracefulRestart(rcvr *receiver.Receiver, serviceMgr *serviceManager, cfgPath, join string) {
 
 	if !filepath.IsAbs(os.Args[0]) {
@@ -392,6 +748,9 @@ func gracefulExit(rcvr *receiver.Receiver, serviceMgr *serviceManager) {
 	// Wait for receiver to be drained.
 	log.Printf("Draining receiver channel...")
 	rcvr.Drain()
+	for _, pr := range serviceMgr.pipelines {
+		pr.Drain()
+	}
 	log.Printf("Receiver channel drained.")
 
 	// Triggers a transition and flush to vcache
@@ -403,6 +762,9 @@ func gracefulExit(rcvr *receiver.Receiver, serviceMgr *serviceManager) {
 	// will wait for transition to finish since it happens in the
 	// director loop.
 	rcvr.Stop()
+	for _, pr := range serviceMgr.pipelines {
+		pr.Stop()
+	}
 
 	if gracefulChildPid != 0 {
 		// let the child know the data is flushed
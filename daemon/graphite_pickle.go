@@ -17,8 +17,10 @@ package daemon
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -29,13 +31,21 @@ import (
 	pickle "github.com/hydrogen18/stalecucumber"
 	"github.com/tgres/tgres/graceful"
 	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/serde"
 )
 
+// The most data points in a pickle message sent by ExportPickle.
+const exportPickleBatch = 500
+
 type graphitePickleServiceManager struct {
 	rcvr       *receiver.Receiver
 	listener   *graceful.Listener
 	listenSpec string
+	timeout    time.Duration
+	tlsConfig  *tls.Config    // nil is no TLS
+	proxy      *proxyProtocol // nil is no PROXY protocol
+	limits     *connLimiter
 	stop       int32
 }
 
@@ -84,7 +94,7 @@ func (g *graphitePickleServiceManager) Start(file *os.File) error {
 
 	g.listener = graceful.NewListener(gl)
 
-	log.Printf("Graphite Pickle protocol Listening on %s\n", processListenSpec(g.listenSpec))
+	log.Printf("Graphite Pickle protocol Listening on %s%s\n", processListenSpec(g.listenSpec), tlsNote(g.tlsConfig))
 
 	go g.graphitePickleServer()
 
@@ -118,7 +128,14 @@ func (g *graphitePickleServiceManager) graphitePickleServer() error {
 		}
 		tempDelay = 0
 
-		go g.handleGraphitePickleProtocol(conn, 30)
+		conn = g.proxy.wrap(conn) // the PROXY header precedes TLS
+		if g.tlsConfig != nil {
+			conn = tls.Server(conn, g.tlsConfig)
+		}
+		if conn = g.limits.accept(conn); conn == nil {
+			continue // too many connections
+		}
+		go g.handleGraphitePickleProtocol(conn, int(g.timeout.Seconds()))
 	}
 }
 
@@ -141,6 +158,7 @@ func (g *graphitePickleServiceManager) handleGraphitePickleProtocol(conn net.Con
 		item                 interface{}
 		items, itemSlice, dp []interface{}
 	)
+	source := sourceAddr(conn)
 
 	for {
 		var (
@@ -183,7 +201,10 @@ func (g *graphitePickleServiceManager) handleGraphitePickleProtocol(conn net.Con
 							}
 						}
 					}
-					g.rcvr.QueueDataPoint(serde.Ident{"name": name}, time.Unix(tstamp, 0), value)
+					if ts, ok := g.rcvr.ListenerTime("graphite_pickle", time.Unix(tstamp, 0)); ok && g.rcvr.AcquireListenerInput("graphite_pickle", source, 1) {
+						g.rcvr.QueueDataPoint(serde.Ident{"name": g.rcvr.ListenerName("graphite_pickle", name)}, ts, value)
+						g.rcvr.CountListenerInput("graphite_pickle", 1)
+					}
 				} else {
 					err = fmt.Errorf("dp wrong length: %d", len(dp))
 					break
@@ -208,3 +229,61 @@ func (g *graphitePickleServiceManager) handleGraphitePickleProtocol(conn net.Con
 		}
 	}
 }
+
+// ExportPickle sends the data points of the DSs whose names match
+// glob in the database of the config, from after from up to until
+// (see Dump), to a carbon pickle receiver at addr (see
+// graphitePoints), and writes the number of DSs and points sent to
+// out. As with ExportWhisper, only the name of an ident is kept.
+func ExportPickle(cfgPath, glob, addr, from, until string, out io.Writer) error {
+	f, err := parseDumpTime(from)
+	if err != nil {
+		return err
+	}
+	u, err := parseDumpTime(until)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var batch []interface{}
+	count := 0
+	send := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		var buf bytes.Buffer
+		if _, err := pickle.NewPickler(&buf).Pickle(batch); err != nil {
+			return err
+		}
+		if err := binary.Write(conn, binary.BigEndian, uint32(buf.Len())); err != nil {
+			return err
+		}
+		if _, err := conn.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		count += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	n, err := exportDataSources(cfgPath, glob, func(ident serde.Ident, rras []rrd.RoundRobinArchiver) error {
+		for _, p := range graphitePoints(rras, f, u) {
+			batch = append(batch, []interface{}{ident["name"], []interface{}{int64(p.Timestamp), p.Value}})
+			if len(batch) == exportPickleBatch {
+				if err := send(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = send()
+	}
+	fmt.Fprintf(out, "%d DSs, %d data points sent.\n", n, count)
+	return err
+}
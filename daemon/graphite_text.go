@@ -17,10 +17,13 @@ package daemon
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -35,14 +38,22 @@ type graphiteTextServiceManager struct {
 	rcvr       *receiver.Receiver
 	listenSpec string
 	udp        bool
+	socketMode os.FileMode    // of a unix socket, 0 is as per umask
+	specSet    string         // DS spec set of new DSs, see addSpecListener
+	strict     *lineValidator // nil is lenient parsing
 	stop       int32
 
 	// TCP
-	listener *graceful.Listener
-	timeout  time.Duration
+	listener  *graceful.Listener
+	timeout   time.Duration
+	tlsConfig *tls.Config    // nil is no TLS
+	proxy     *proxyProtocol // nil is no PROXY protocol
+	limits    *connLimiter
 
 	// UDP
-	conn net.Conn
+	conn    net.Conn   // the first of conns, see File()
+	conns   []net.Conn // one per reader
+	readers int
 }
 
 func (g *graphiteTextServiceManager) Stop() {
@@ -51,7 +62,9 @@ func (g *graphiteTextServiceManager) Stop() {
 	}
 	if g.conn != nil {
 		log.Printf("Closing UDP listener %s", g.listenSpec)
-		g.conn.Close()
+		for _, conn := range g.conns {
+			conn.Close()
+		}
 	}
 	if g.listener != nil {
 		log.Printf("Closing TCP listener %s", g.listenSpec)
@@ -62,7 +75,9 @@ func (g *graphiteTextServiceManager) Stop() {
 
 func (g *graphiteTextServiceManager) File() *os.File {
 	if g.conn != nil {
-		f, _ := g.conn.(*net.UDPConn).File()
+		f, _ := g.conn.(interface {
+			File() (*os.File, error)
+		}).File() // UDP or unix datagram
 		return f
 	}
 	if g.listener != nil {
@@ -84,19 +99,11 @@ func (g *graphiteTextServiceManager) stopped() bool {
 }
 
 func (g *graphiteTextServiceManager) startUDP(file *os.File) error {
-	var (
-		err     error
-		udpAddr *net.UDPAddr
-	)
+	var err error
 
 	if g.listenSpec != "" {
-		if file != nil {
-			g.conn, err = net.FileConn(file)
-		} else {
-			udpAddr, err = net.ResolveUDPAddr("udp", processListenSpec(g.listenSpec))
-			if err == nil {
-				g.conn, err = net.ListenUDP("udp", udpAddr)
-			}
+		if g.conns, err = listenUDPReaders(g.listenSpec, file, g.readers, g.socketMode); err == nil {
+			g.conn = g.conns[0]
 		}
 	} else {
 		log.Printf("Not starting Graphite UDP protocol because graphite-udp-listen-spec is blank.")
@@ -106,10 +113,12 @@ func (g *graphiteTextServiceManager) startUDP(file *os.File) error {
 		return fmt.Errorf("Error starting Graphite UDP Text Protocol serviceManager: %v", err)
 	}
 
-	fmt.Printf("Graphite UDP protocol Listening on %s\n", processListenSpec(g.listenSpec))
+	fmt.Printf("Graphite UDP protocol Listening on %s (%d readers)\n", processListenSpec(g.listenSpec), len(g.conns))
 
-	// UDP only has one connection, unlike TCP
-	go g.handleGraphiteTextProtocol(g.conn)
+	// UDP only has one connection (per reader), unlike TCP
+	for _, conn := range g.conns {
+		go g.handleGraphiteUDP(conn)
+	}
 
 	return nil
 }
@@ -121,11 +130,7 @@ func (g *graphiteTextServiceManager) startTCP(file *os.File) error {
 	)
 
 	if g.listenSpec != "" {
-		if file != nil {
-			gl, err = net.FileListener(file)
-		} else {
-			gl, err = net.Listen("tcp", processListenSpec(g.listenSpec))
-		}
+		gl, err = listenStream(g.listenSpec, file, g.socketMode)
 	} else {
 		log.Printf("Not starting Graphite Text protocol because graphite-text-listen-spec is blank")
 		return nil
@@ -137,7 +142,7 @@ func (g *graphiteTextServiceManager) startTCP(file *os.File) error {
 
 	g.listener = graceful.NewListener(gl)
 
-	fmt.Println("Graphite text protocol Listening on " + processListenSpec(g.listenSpec))
+	fmt.Println("Graphite text protocol Listening on " + processListenSpec(g.listenSpec) + tlsNote(g.tlsConfig))
 
 	go g.graphiteTCPTextServer()
 
@@ -172,11 +177,18 @@ func (g *graphiteTextServiceManager) graphiteTCPTextServer() error {
 		}
 		tempDelay = 0
 
+		conn = g.proxy.wrap(conn) // the PROXY header precedes TLS
+		if g.tlsConfig != nil {
+			conn = tls.Server(conn, g.tlsConfig)
+		}
+		if conn = g.limits.accept(conn); conn == nil {
+			continue // too many connections
+		}
 		go g.handleGraphiteTextProtocol(conn)
 	}
 }
 
-// Handles incoming requests for both TCP and UDP
+// Handles incoming TCP connections
 func (g *graphiteTextServiceManager) handleGraphiteTextProtocol(conn net.Conn) {
 	defer conn.Close() // decrements graceful.TcpWg
 
@@ -184,17 +196,13 @@ func (g *graphiteTextServiceManager) handleGraphiteTextProtocol(conn net.Conn) {
 		conn.SetDeadline(time.Now().Add(g.timeout))
 	}
 
+	source := sourceAddr(conn)
+
 	// We use Scanner, becase it has a MaxScanTokenSize of 64K
 	connbuf := bufio.NewScanner(conn)
 
 	for connbuf.Scan() {
-		packetStr := connbuf.Text()
-
-		if name, ts, v, err := parseGraphitePacket(packetStr); err != nil {
-			log.Printf("handleGraphiteTextProtocol(): bad packet: %v", packetStr)
-		} else {
-			g.rcvr.QueueDataPoint(serde.Ident{"name": name}, ts, v)
-		}
+		g.handleGraphiteLine("graphite_tcp", source, connbuf.Text())
 
 		if g.timeout != 0 {
 			conn.SetDeadline(time.Now().Add(g.timeout))
@@ -212,7 +220,48 @@ func (g *graphiteTextServiceManager) handleGraphiteTextProtocol(conn net.Conn) {
 	}
 }
 
-func parseGraphitePacket(packetStr string) (string, time.Time, float64, error) {
+// Handles incoming UDP datagrams, which are read in batches and may
+// have several lines each
+func (g *graphiteTextServiceManager) handleGraphiteUDP(conn net.Conn) {
+	defer conn.Close()
+
+	err := readUDPBatches(conn, func(b []byte) {
+		eachLine(b, func(line string) {
+			g.handleGraphiteLine("graphite_udp", "", line)
+		})
+	})
+	if !strings.Contains(err.Error(), "use of closed") {
+		log.Printf("handleGraphiteUDP(): Error reading: %v", err)
+	}
+}
+
+func (g *graphiteTextServiceManager) handleGraphiteLine(listener, source, packetStr string) {
+	ident, ts, v, err := parseGraphitePacket(packetStr)
+	if err == nil && g.strict != nil {
+		err = validateGraphiteLine(packetStr)
+	}
+	if err != nil {
+		if g.strict != nil {
+			g.strict.reject(source, packetStr, err)
+		} else {
+			log.Printf("handleGraphiteTextProtocol(): bad packet: %v", packetStr)
+			g.rcvr.RecordDropped(receiver.DeadParse, packetStr)
+		}
+	} else if ts, ok := g.rcvr.ListenerTime(listener, ts); ok && g.rcvr.AcquireListenerInput(listener, source, 1) {
+		ident["name"] = g.rcvr.ListenerName(listener, ident["name"])
+		g.rcvr.QueueDataPointSpecSet(ident, ts, v, g.specSet)
+		g.rcvr.CountListenerInput(listener, 1)
+	}
+}
+
+// parseGraphitePacket parses a "name value timestamp" line, the name
+// may be tagged as in Graphite 1.1, i.e. "name;tag1=val1;tag2=val2",
+// the tags become fields of the ident. Lines in the carbon2 format
+// are recognized by a "=" in the first field, see parseCarbon2Packet.
+func parseGraphitePacket(packetStr string) (serde.Ident, time.Time, float64, error) {
+	if first := strings.SplitN(strings.TrimSpace(packetStr), " ", 2)[0]; strings.Contains(first, "=") && !strings.Contains(first, ";") {
+		return parseCarbon2Packet(packetStr)
+	}
 
 	var (
 		name   string
@@ -221,7 +270,12 @@ func parseGraphitePacket(packetStr string) (string, time.Time, float64, error) {
 	)
 
 	if n, err := fmt.Sscanf(packetStr, "%s %f %d", &name, &value, &tstamp); n != 3 || err != nil {
-		return "", time.Time{}, 0, fmt.Errorf("error %v scanning input: %q", err, packetStr)
+		return nil, time.Time{}, 0, fmt.Errorf("error %v scanning input: %q", err, packetStr)
+	}
+
+	ident, err := parseGraphiteTags(name)
+	if err != nil {
+		return nil, time.Time{}, 0, fmt.Errorf("%v: %q", err, packetStr)
 	}
 
 	var t time.Time
@@ -230,5 +284,91 @@ func parseGraphitePacket(packetStr string) (string, time.Time, float64, error) {
 	} else {
 		t = time.Unix(tstamp, 0)
 	}
-	return misc.SanitizeName(name), t, value, nil
+	return ident, t, value, nil
+}
+
+// parseGraphiteTags converts a possibly tagged Graphite name into an
+// ident. As in Graphite, tag names cannot be empty or contain any of
+// "!^=", values cannot be empty or begin with "~", and "name" is not
+// a valid tag name.
+func parseGraphiteTags(tagged string) (serde.Ident, error) {
+	parts := strings.Split(tagged, ";")
+	ident := serde.Ident{"name": misc.SanitizeName(parts[0])}
+	if ident["name"] == "" {
+		return nil, fmt.Errorf("empty name")
+	}
+	for _, tag := range parts[1:] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[0] == "name" || strings.ContainsAny(kv[0], "!^") ||
+			kv[1] == "" || strings.HasPrefix(kv[1], "~") {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		ident[kv[0]] = kv[1]
+	}
+	return ident, nil
+}
+
+// parseCarbon2Packet parses a carbon2 (metrics 2.0) line, "intrinsic
+// tags  meta tags value timestamp", in which tags are "key=value" and
+// the intrinsic and meta tags are separated by two spaces. The
+// intrinsic tags become fields of the ident, the name is the metric
+// or what tag, or, if there is neither, the tags as key_value in
+// order of the keys, dot separated. Meta tags do not identify the
+// series and are ignored.
+func parseCarbon2Packet(packetStr string) (serde.Ident, time.Time, float64, error) {
+	packetStr = strings.TrimSpace(packetStr)
+	intrinsic, rest := packetStr, ""
+	if i := strings.Index(packetStr, "  "); i >= 0 {
+		intrinsic, rest = packetStr[:i], packetStr[i+2:]
+	}
+	tags, fields := strings.Fields(intrinsic), strings.Fields(rest)
+	if len(fields) < 2 { // value and timestamp are last
+		if n := len(tags); n >= 3 && len(fields) == 0 {
+			tags, fields = tags[:n-2], tags[n-2:]
+		} else {
+			return nil, time.Time{}, 0, fmt.Errorf("missing value or timestamp: %q", packetStr)
+		}
+	}
+
+	ident := serde.Ident{}
+	for _, tag := range tags {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" || kv[0] == "name" {
+			return nil, time.Time{}, 0, fmt.Errorf("invalid tag %q: %q", tag, packetStr)
+		}
+		ident[kv[0]] = kv[1]
+	}
+	for _, k := range []string{"metric", "what"} {
+		if ident[k] != "" {
+			ident["name"] = misc.SanitizeName(ident[k])
+			delete(ident, k)
+			break
+		}
+	}
+	if ident["name"] == "" {
+		keys := make([]string, 0, len(ident))
+		for k := range ident {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		parts := make([]string, len(keys))
+		for i, k := range keys {
+			parts[i] = k + "_" + ident[k]
+		}
+		ident["name"] = misc.SanitizeName(strings.Join(parts, "."))
+	}
+	if ident["name"] == "" {
+		return nil, time.Time{}, 0, fmt.Errorf("empty name: %q", packetStr)
+	}
+
+	n := len(fields)
+	value, err := strconv.ParseFloat(fields[n-2], 64)
+	if err != nil {
+		return nil, time.Time{}, 0, fmt.Errorf("invalid value %q: %q", fields[n-2], packetStr)
+	}
+	tstamp, err := strconv.ParseInt(fields[n-1], 10, 64)
+	if err != nil {
+		return nil, time.Time{}, 0, fmt.Errorf("invalid timestamp %q: %q", fields[n-1], packetStr)
+	}
+	return ident, time.Unix(tstamp, 0), value, nil
 }
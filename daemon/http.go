@@ -31,18 +31,19 @@ import (
 	"github.com/tgres/tgres/receiver"
 )
 
-func httpServer(addr string, l net.Listener, rcvr *receiver.Receiver, rcache dsl.NamedDSFetcher, origHdr string) {
+func httpServer(addr string, l net.Listener, rcvr *receiver.Receiver, rcache dsl.NamedDSFetcher, origHdr, adminToken string) {
 
 	// Not sure why, but we need both trailing slash and not versions. It has
 	// something to do with whether you use Grafana direct or proxy modes.
-	http.HandleFunc("/metrics/find", setOriginHdr(h.GraphiteMetricsFindHandler(rcache), origHdr))
-	http.HandleFunc("/metrics/find/", setOriginHdr(h.GraphiteMetricsFindHandler(rcache), origHdr))
+	http.HandleFunc("/metrics/find", setOriginHdr(h.GraphiteMetricsFindHandler(rcache, rcvr), origHdr))
+	http.HandleFunc("/metrics/find/", setOriginHdr(h.GraphiteMetricsFindHandler(rcache, rcvr), origHdr))
 	http.HandleFunc("/render", setOriginHdr(h.GraphiteRenderHandler(rcache), origHdr))
 	http.HandleFunc("/render/", setOriginHdr(h.GraphiteRenderHandler(rcache), origHdr))
 	http.HandleFunc("/events/get_data", setOriginHdr(h.GraphiteAnnotationsHandler(rcache), origHdr))
 	http.HandleFunc("/events/get_data/", setOriginHdr(h.GraphiteAnnotationsHandler(rcache), origHdr))
 
 	http.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) { fmt.Fprintf(w, "OK\n") })
+	http.HandleFunc("/cluster/status", h.ClusterStatusHandler(rcvr))
 
 	http.HandleFunc("/pixel", h.PixelHandler(rcvr))
 	http.HandleFunc("/pixel/add", h.PixelAddHandler(rcvr))
@@ -50,10 +51,22 @@ func httpServer(addr string, l net.Listener, rcvr *receiver.Receiver, rcache dsl
 	http.HandleFunc("/pixel/setgauge", h.PixelSetGaugeHandler(rcvr))
 	http.HandleFunc("/pixel/append", h.PixelAppendHandler(rcvr))
 
+	http.HandleFunc("/api/put", h.OpentsdbPutHandler(rcvr))
+	http.HandleFunc("/api/batch", h.BatchPutHandler(rcvr))
+
 	if rcvr.Blaster != nil {
 		http.HandleFunc("/blaster/set", h.BlasterSetHandler(rcvr.Blaster))
 	}
 
+	if adminToken != "" {
+		http.HandleFunc("/admin/delete", h.AdminDeleteHandler(rcvr, rcache, adminToken))
+		http.HandleFunc("/admin/rename", h.AdminRenameHandler(rcvr, rcache, adminToken))
+		http.HandleFunc("/admin/migrate", h.AdminMigrateHandler(rcvr, rcache, adminToken))
+		http.HandleFunc("/admin/metadata", h.AdminMetadataHandler(rcvr, adminToken))
+		http.HandleFunc("/admin/snapshot", h.AdminSnapshotHandler(rcvr, adminToken))
+		http.HandleFunc("/admin/liveness", h.AdminLivenessHandler(rcvr, adminToken))
+	}
+
 	server := &http.Server{
 		Addr:           addr,
 		ReadTimeout:    10 * time.Second,
@@ -69,6 +82,8 @@ type wwwServer struct {
 	listener   *graceful.Listener
 	listenSpec string
 	originHdr  string
+	adminToken string         // blank disables the admin endpoints
+	proxy      *proxyProtocol // nil is no PROXY protocol
 	stop       int32
 }
 
@@ -120,7 +135,7 @@ func (g *wwwServer) Start(file *os.File) error {
 
 	log.Printf("HTTP protocol Listening on %s\n", processListenSpec(g.listenSpec))
 
-	go httpServer(g.listenSpec, g.listener, g.rcvr, g.rcache, g.originHdr)
+	go httpServer(g.listenSpec, g.proxy.listener(g.listener), g.rcvr, g.rcache, g.originHdr, g.adminToken)
 
 	return nil
 }
@@ -0,0 +1,232 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cluster-seeds entries with these prefixes are found via the
+// Kubernetes API: the ready endpoints of a (headless) service, or the
+// running pods matching a label selector, of the namespace of this
+// pod unless given as <namespace>/<name or selector>. (A namespace
+// has neither dots nor "=", unlike the prefix of a label key.)
+const (
+	k8sServiceSeedPrefix = "k8s-service:"
+	k8sPodsSeedPrefix    = "k8s-pods:"
+
+	// The port of an endpoint with this name is the memberlist port,
+	// without one it is the default.
+	k8sGossipPortName = "gossip"
+)
+
+// The in-cluster credentials, a variable for testing.
+var k8sServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+func isK8sSeed(seed string) bool {
+	return strings.HasPrefix(seed, k8sServiceSeedPrefix) || strings.HasPrefix(seed, k8sPodsSeedPrefix)
+}
+
+// k8sClient is the bare minimum of a Kubernetes API client.
+type k8sClient struct {
+	base      string // e.g. https://10.0.0.1:443
+	token     string
+	namespace string // of this pod
+	client    *http.Client
+}
+
+// The HTTP client of the API server is made once, on first use, and
+// reused, so that the seeds looked up every cluster-seed-interval do
+// not each leave a connection behind.
+var (
+	k8sHTTPClientMu sync.Mutex
+	k8sHTTPClient   *http.Client
+)
+
+// newK8sClient returns a client of the API of the cluster this pod
+// runs in. The service account token is read anew every time, it can
+// be rotated.
+var newK8sClient = func() (*k8sClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in Kubernetes, KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT not set")
+	}
+	token, err := ioutil.ReadFile(filepath.Join(k8sServiceAccountDir, "token"))
+	if err != nil {
+		return nil, err
+	}
+	ns, err := ioutil.ReadFile(filepath.Join(k8sServiceAccountDir, "namespace"))
+	if err != nil {
+		return nil, err
+	}
+	client, err := k8sHTTP()
+	if err != nil {
+		return nil, err
+	}
+	return &k8sClient{
+		base:      "https://" + net.JoinHostPort(host, port),
+		token:     strings.TrimSpace(string(token)),
+		namespace: strings.TrimSpace(string(ns)),
+		client:    client,
+	}, nil
+}
+
+// k8sHTTP returns the HTTP client of the API server, trusting the
+// service account ca.crt.
+func k8sHTTP() (*http.Client, error) {
+	k8sHTTPClientMu.Lock()
+	defer k8sHTTPClientMu.Unlock()
+	if k8sHTTPClient != nil {
+		return k8sHTTPClient, nil
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(k8sServiceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in the service account ca.crt")
+	}
+	k8sHTTPClient = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+			MaxIdleConns:    1,
+			IdleConnTimeout: 90 * time.Second,
+		},
+	}
+	return k8sHTTPClient, nil
+}
+
+func (k *k8sClient) get(path string, v interface{}) error {
+	req, err := http.NewRequest("GET", k.base+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("kubernetes API %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type k8sEndpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"` // only the ready ones
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+// serviceAddrs returns the addresses of the ready endpoints of a
+// service, with the gossip port if it has one.
+func (k *k8sClient) serviceAddrs(namespace, name string) ([]string, error) {
+	var eps k8sEndpoints
+	if err := k.get(fmt.Sprintf("/api/v1/namespaces/%s/endpoints/%s", url.PathEscape(namespace), url.PathEscape(name)), &eps); err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, ss := range eps.Subsets {
+		port := ""
+		for _, p := range ss.Ports {
+			if p.Name == k8sGossipPortName {
+				port = strconv.Itoa(p.Port)
+			}
+		}
+		for _, a := range ss.Addresses {
+			if port != "" {
+				addrs = append(addrs, net.JoinHostPort(a.IP, port))
+			} else {
+				addrs = append(addrs, a.IP)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+type k8sPodList struct {
+	Items []struct {
+		Metadata struct {
+			DeletionTimestamp *time.Time `json:"deletionTimestamp"`
+		} `json:"metadata"`
+		Status struct {
+			Phase string `json:"phase"`
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// podAddrs returns the addresses of the running pods matching a label
+// selector, other than those being deleted.
+func (k *k8sClient) podAddrs(namespace, selector string) ([]string, error) {
+	var pods k8sPodList
+	if err := k.get(fmt.Sprintf("/api/v1/namespaces/%s/pods?labelSelector=%s", url.PathEscape(namespace), url.QueryEscape(selector)), &pods); err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == "Running" && pod.Status.PodIP != "" && pod.Metadata.DeletionTimestamp == nil {
+			addrs = append(addrs, pod.Status.PodIP)
+		}
+	}
+	return addrs, nil
+}
+
+// k8sSeedAddrs returns the addresses of a Kubernetes seed. As they
+// are looked up anew every cluster-seed-interval, pods which were
+// restarted with a different address are joined again.
+func k8sSeedAddrs(seed string) ([]string, error) {
+	k, err := newK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	prefix := k8sServiceSeedPrefix
+	if strings.HasPrefix(seed, k8sPodsSeedPrefix) {
+		prefix = k8sPodsSeedPrefix
+	}
+	namespace, what := k.namespace, strings.TrimPrefix(seed, prefix)
+	if i := strings.Index(what, "/"); i >= 0 && !strings.ContainsAny(what[:i], ".=") {
+		namespace, what = what[:i], what[i+1:]
+	}
+	if prefix == k8sPodsSeedPrefix {
+		return k.podAddrs(namespace, what)
+	}
+	return k.serviceAddrs(namespace, what)
+}
@@ -0,0 +1,475 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/serde"
+)
+
+// mqttServiceManager subscribes to MQTT (3.1.1) topics. It speaks
+// just enough of the protocol to subscribe with QoS 0 or 1 and
+// reconnects whenever the connection is lost. Like the NATS
+// subscriber it is a client, there is no file to hand over on
+// graceful restart.
+type mqttServiceManager struct {
+	rcvr     *receiver.Receiver
+	url      string
+	clientID string
+	subs     []mqttSub
+	stop     int32
+
+	sync.Mutex
+	conn net.Conn
+}
+
+const (
+	mqttKeepAlive  = 60 * time.Second
+	mqttMinBackoff = time.Second
+	mqttMaxBackoff = 30 * time.Second
+)
+
+// MQTT control packet types (the high nibble of the first byte)
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+func (g *mqttServiceManager) File() *os.File {
+	return nil
+}
+
+func (g *mqttServiceManager) Stop() {
+	if g.stopped() {
+		return
+	}
+	atomic.StoreInt32(&(g.stop), 1)
+	g.Lock()
+	defer g.Unlock()
+	if g.conn != nil {
+		log.Printf("Closing MQTT connection to %s", g.conn.RemoteAddr())
+		g.conn.Write([]byte{mqttDisconnect << 4, 0})
+		g.conn.Close()
+	}
+}
+
+func (g *mqttServiceManager) stopped() bool {
+	return atomic.LoadInt32(&(g.stop)) != 0
+}
+
+func (g *mqttServiceManager) Start(file *os.File) error {
+	if g.url == "" || len(g.subs) == 0 {
+		log.Printf("Not starting MQTT subscriber because mqtt-url is blank or there are no mqtt-subscriptions.")
+		return nil
+	}
+	u, err := parseMqttURL(g.url)
+	if err != nil {
+		return err
+	}
+	log.Printf("MQTT subscriber connecting to %s as %q (%d subscriptions)\n", u.Host, g.clientID, len(g.subs))
+	go g.mqttClient(u)
+	return nil
+}
+
+// mqttClient (re)connects until stopped.
+func (g *mqttServiceManager) mqttClient(u *url.URL) {
+	backoff := mqttMinBackoff
+	for !g.stopped() {
+		conn, err := net.DialTimeout("tcp", u.Host, 5*time.Second)
+		if err == nil {
+			g.Lock()
+			g.conn = conn
+			g.Unlock()
+			if g.stopped() { // Stop() may have missed it
+				conn.Close()
+				return
+			}
+			err = g.mqttSession(conn, u)
+			conn.Close()
+			if g.stopped() {
+				return
+			}
+			backoff = mqttMinBackoff
+		}
+		log.Printf("mqttClient(): %v; reconnecting in %v", err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > mqttMaxBackoff {
+			backoff = mqttMaxBackoff
+		}
+	}
+}
+
+// mqttSession connects, subscribes and reads messages until the
+// connection fails.
+func (g *mqttServiceManager) mqttSession(conn net.Conn, u *url.URL) error {
+	var user, pass string
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+	r := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(mqttKeepAlive))
+	if _, err := conn.Write(mqttConnectPacket(g.clientID, user, pass, mqttKeepAlive)); err != nil {
+		return err
+	}
+	typ, body, err := mqttReadPacket(r)
+	if err != nil {
+		return err
+	}
+	if typ>>4 != mqttConnack || len(body) != 2 {
+		return fmt.Errorf("expected CONNACK from MQTT broker, got packet type %d", typ>>4)
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("MQTT broker refused connection (return code %d)", body[1])
+	}
+	if _, err := conn.Write(mqttSubscribePacket(1, g.subs)); err != nil {
+		return err
+	}
+	log.Printf("MQTT subscriber connected to %s", conn.RemoteAddr())
+
+	// Writes (pings and acks) come from two goroutines
+	var wmu sync.Mutex
+	write := func(b []byte) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		_, err := conn.Write(b)
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		tick := time.NewTicker(mqttKeepAlive / 2)
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+				if write([]byte{mqttPingreq << 4, 0}) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 3 / 2))
+		typ, body, err := mqttReadPacket(r)
+		if err != nil {
+			return err
+		}
+		switch typ >> 4 {
+		case mqttPublish:
+			topic, id, payload, err := mqttParsePublish(typ, body)
+			if err != nil {
+				return err
+			}
+			if sub := matchMqttSub(g.subs, topic); sub != nil {
+				sub.queue(g.rcvr, topic, payload)
+			}
+			if id != 0 { // QoS 1
+				if err := write([]byte{mqttPuback << 4, 2, byte(id >> 8), byte(id)}); err != nil {
+					return err
+				}
+			}
+		case mqttSuback:
+			if len(body) < 2 {
+				return errMqttPacket
+			}
+			for i, rc := range body[2:] {
+				if rc == 0x80 && i < len(g.subs) {
+					log.Printf("mqttSession(): MQTT broker refused subscription to %q", g.subs[i].Topic)
+				}
+			}
+		case mqttPingresp:
+		default:
+			return fmt.Errorf("unexpected MQTT packet type %d", typ>>4)
+		}
+	}
+}
+
+// queue decodes a message of this subscription. With the "value"
+// format the payload is a single number and the name is the topic
+// with "/" replaced by "." or, if set, the name template.
+func (s *mqttSub) queue(rcvr *receiver.Receiver, topic string, payload []byte) {
+	if !s.value {
+		queuePayload(rcvr, s.format, "mqtt", "", payload)
+		return
+	}
+	name := mqttName(s.Name, topic)
+	v, err := strconv.ParseFloat(string(bytes.TrimSpace(payload)), 64)
+	if err != nil || name == "" {
+		rcvr.RecordDropped(receiver.DeadParse, fmt.Sprintf("%s %s", topic, payload))
+		return
+	}
+	if rcvr.AcquireListenerInput("mqtt", "", 1) {
+		rcvr.QueueDataPoint(serde.Ident{"name": rcvr.ListenerName("mqtt", name)}, time.Now(), v)
+		rcvr.CountListenerInput("mqtt", 1)
+	}
+}
+
+// mqttName expands a name template: {N} is the Nth level of the
+// topic (counting from 1) and {topic} all of them, dot separated.
+// An empty template is the same as "{topic}". Levels are sanitized
+// and their dots replaced by "_".
+func mqttName(template, topic string) string {
+	levels := strings.Split(topic, "/")
+	for i, l := range levels {
+		levels[i] = misc.SanitizeName(strings.Replace(l, ".", "_", -1))
+	}
+	if template == "" {
+		template = "{topic}"
+	}
+	var (
+		buf bytes.Buffer
+		s   = template
+	)
+	for {
+		i := strings.IndexByte(s, '{')
+		if i < 0 {
+			buf.WriteString(s)
+			break
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			buf.WriteString(s)
+			break
+		}
+		buf.WriteString(s[:i])
+		if ref := s[i+1 : i+j]; ref == "topic" {
+			buf.WriteString(strings.Join(levels, "."))
+		} else if n, err := strconv.Atoi(ref); err == nil && n > 0 && n <= len(levels) {
+			buf.WriteString(levels[n-1])
+		} else {
+			return "" // a level the topic does not have
+		}
+		s = s[i+j+1:]
+	}
+	return misc.SanitizeName(buf.String())
+}
+
+// validMqttName is whether all {} references in the name template
+// are valid.
+func validMqttName(template string) bool {
+	for s := template; strings.Contains(s, "{"); {
+		i := strings.IndexByte(s, '{')
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			return false
+		}
+		if ref := s[i+1 : i+j]; ref != "topic" {
+			if n, err := strconv.Atoi(ref); err != nil || n < 1 {
+				return false
+			}
+		}
+		s = s[i+j+1:]
+	}
+	return true
+}
+
+// matchMqttSub returns the first subscription whose topic filter
+// matches topic.
+func matchMqttSub(subs []mqttSub, topic string) *mqttSub {
+	for i := range subs {
+		if mqttTopicMatch(subs[i].Topic, topic) {
+			return &subs[i]
+		}
+	}
+	return nil
+}
+
+// mqttTopicMatch matches a topic against a filter, in which "+"
+// matches one level and "#" (last) any remaining levels. The
+// "$share/<group>/" prefix of shared subscriptions is ignored.
+func mqttTopicMatch(filter, topic string) bool {
+	fl, tl := strings.Split(filter, "/"), strings.Split(topic, "/")
+	if len(fl) > 2 && fl[0] == "$share" {
+		fl = fl[2:]
+	}
+	for i, f := range fl {
+		if f == "#" {
+			return true
+		}
+		if i >= len(tl) || (f != "+" && f != tl[i]) {
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
+
+// validMqttFilter checks a topic filter: "+" and "#" must be whole
+// levels, "#" can only be last.
+func validMqttFilter(filter string) bool {
+	if filter == "" || len(filter) > 65535 {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, l := range levels {
+		if (l == "#" && i != len(levels)-1) || (len(l) > 1 && strings.ContainsAny(l, "+#")) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseMqttURL parses a "tcp://[user[:password]@]host[:port]" URL
+// (mqtt:// is the same), the port defaults to 1883.
+func parseMqttURL(s string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "tcp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mqtt-url: %v", err)
+	}
+	if (u.Scheme != "tcp" && u.Scheme != "mqtt") || u.Host == "" {
+		return nil, fmt.Errorf("invalid mqtt-url: %q (expected tcp://host:port)", s)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "1883")
+	}
+	return u, nil
+}
+
+func mqttString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+// mqttPacket prepends the fixed header to body.
+func mqttPacket(typ byte, body []byte) []byte {
+	p := []byte{typ}
+	n := len(body)
+	for { // "remaining length", 7 bits at a time
+		b := byte(n % 128)
+		if n /= 128; n > 0 {
+			b |= 0x80
+		}
+		p = append(p, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(p, body...)
+}
+
+func mqttConnectPacket(clientID, user, pass string, keepAlive time.Duration) []byte {
+	var buf bytes.Buffer
+	mqttString(&buf, "MQTT")
+	flags := byte(0x02) // clean session
+	if user != "" {
+		flags |= 0x80
+		if pass != "" {
+			flags |= 0x40
+		}
+	}
+	buf.Write([]byte{4, flags}) // protocol level 4 is 3.1.1
+	binary.Write(&buf, binary.BigEndian, uint16(keepAlive/time.Second))
+	mqttString(&buf, clientID)
+	if user != "" {
+		mqttString(&buf, user)
+		if pass != "" {
+			mqttString(&buf, pass)
+		}
+	}
+	return mqttPacket(mqttConnect<<4, buf.Bytes())
+}
+
+func mqttSubscribePacket(id uint16, subs []mqttSub) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, id)
+	for _, s := range subs {
+		mqttString(&buf, s.Topic)
+		buf.WriteByte(byte(s.QoS))
+	}
+	return mqttPacket(mqttSubscribe<<4|0x02, buf.Bytes())
+}
+
+var errMqttPacket = errors.New("malformed MQTT packet")
+
+// mqttReadPacket reads a packet, returning the first byte (type
+// and flags) and the rest after the fixed header.
+func mqttReadPacket(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var n, shift uint
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		if i == 4 {
+			return 0, nil, errMqttPacket
+		}
+		n |= uint(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return typ, body, nil
+}
+
+// mqttParsePublish returns the topic, packet id (0 for QoS 0) and
+// payload of a PUBLISH packet.
+func mqttParsePublish(typ byte, body []byte) (string, uint16, []byte, error) {
+	if len(body) < 2 {
+		return "", 0, nil, errMqttPacket
+	}
+	tlen := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+tlen {
+		return "", 0, nil, errMqttPacket
+	}
+	topic, rest := string(body[2:2+tlen]), body[2+tlen:]
+	var id uint16
+	if (typ>>1)&0x03 > 0 { // QoS 1 or 2
+		if len(rest) < 2 {
+			return "", 0, nil, errMqttPacket
+		}
+		id, rest = binary.BigEndian.Uint16(rest), rest[2:]
+	}
+	return topic, id, rest, nil
+}
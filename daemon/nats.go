@@ -0,0 +1,261 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tgres/tgres/receiver"
+)
+
+// natsServiceManager subscribes to NATS subjects and decodes the
+// messages as configured per subscription. It speaks just enough of
+// the NATS client protocol to subscribe, and reconnects whenever the
+// connection is lost. It is a client, there is no file to hand over
+// on graceful restart.
+type natsServiceManager struct {
+	rcvr *receiver.Receiver
+	url  string
+	subs []natsSub
+	stop int32
+
+	sync.Mutex
+	conn net.Conn
+}
+
+const (
+	natsDialTimeout = 5 * time.Second
+	natsMinBackoff  = time.Second
+	natsMaxBackoff  = 30 * time.Second
+)
+
+func (g *natsServiceManager) File() *os.File {
+	return nil
+}
+
+func (g *natsServiceManager) Stop() {
+	if g.stopped() {
+		return
+	}
+	atomic.StoreInt32(&(g.stop), 1)
+	g.Lock()
+	defer g.Unlock()
+	if g.conn != nil {
+		log.Printf("Closing NATS connection to %s", g.conn.RemoteAddr())
+		g.conn.Close()
+	}
+}
+
+func (g *natsServiceManager) stopped() bool {
+	return atomic.LoadInt32(&(g.stop)) != 0
+}
+
+func (g *natsServiceManager) Start(file *os.File) error {
+	if g.url == "" || len(g.subs) == 0 {
+		log.Printf("Not starting NATS subscriber because nats-url is blank or there are no nats-subscriptions.")
+		return nil
+	}
+	u, err := parseNatsURL(g.url)
+	if err != nil {
+		return err
+	}
+	log.Printf("NATS subscriber connecting to %s (%d subscriptions)\n", u.Host, len(g.subs))
+	go g.natsClient(u)
+	return nil
+}
+
+// natsClient (re)connects until stopped.
+func (g *natsServiceManager) natsClient(u *url.URL) {
+	backoff := natsMinBackoff
+	for !g.stopped() {
+		conn, err := net.DialTimeout("tcp", u.Host, natsDialTimeout)
+		if err == nil {
+			g.Lock()
+			g.conn = conn
+			g.Unlock()
+			if g.stopped() { // Stop() may have missed it
+				conn.Close()
+				return
+			}
+			err = g.natsSession(conn, u)
+			conn.Close()
+			if g.stopped() {
+				return
+			}
+			backoff = natsMinBackoff
+		}
+		log.Printf("natsClient(): %v; reconnecting in %v", err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > natsMaxBackoff {
+			backoff = natsMaxBackoff
+		}
+	}
+}
+
+// natsSession subscribes and reads messages until the connection
+// fails.
+func (g *natsServiceManager) natsSession(conn net.Conn, u *url.URL) error {
+	r := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(natsDialTimeout))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if !strings.HasPrefix(line, "INFO ") || json.Unmarshal([]byte(line[5:]), &info) != nil {
+		return fmt.Errorf("unexpected greeting from NATS server: %q", strings.TrimSpace(line))
+	}
+	if info.TLSRequired {
+		return fmt.Errorf("NATS server requires TLS, which is not supported")
+	}
+	if _, err := io.WriteString(conn, natsConnect(u)); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	sids := make(map[int]*natsSub, len(g.subs))
+	for i := range g.subs {
+		sub := &g.subs[i]
+		sids[i+1] = sub
+		args := sub.Subject
+		if sub.QueueGroup != "" { // messages are load balanced among the group
+			args += " " + sub.QueueGroup
+		}
+		if _, err := fmt.Fprintf(conn, "SUB %s %d\r\n", args, i+1); err != nil {
+			return err
+		}
+	}
+	log.Printf("NATS subscriber connected to %s", conn.RemoteAddr())
+
+	return natsReadLoop(r, conn, func(sid int, payload []byte) {
+		if sub := sids[sid]; sub != nil {
+			queuePayload(g.rcvr, sub.format, "nats", "", payload)
+		}
+	})
+}
+
+// natsConnect is the CONNECT command, with the credentials from the
+// URL: a user and password, or a token if there is only a user.
+func natsConnect(u *url.URL) string {
+	opts := map[string]interface{}{
+		"verbose": false, "pedantic": false, "name": "tgres", "lang": "go", "version": "0", "protocol": 0,
+	}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			opts["user"], opts["pass"] = u.User.Username(), pass
+		} else {
+			opts["auth_token"] = u.User.Username()
+		}
+	}
+	js, _ := json.Marshal(opts)
+	return "CONNECT " + string(js) + "\r\n"
+}
+
+// natsReadLoop handles the server side of the protocol: messages are
+// passed to handle by subscription id, pings are answered. It
+// returns on the first read error or on an -ERR from the server.
+func natsReadLoop(r *bufio.Reader, w io.Writer, handle func(sid int, payload []byte)) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		op := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch op {
+		case "MSG": // MSG <subject> <sid> [reply-to] <#bytes>
+			args := strings.Fields(line)
+			if len(args) != 4 && len(args) != 5 {
+				return fmt.Errorf("invalid NATS message: %q", line)
+			}
+			sid, err := strconv.Atoi(args[2])
+			if err != nil {
+				return fmt.Errorf("invalid NATS message: %q", line)
+			}
+			n, err := strconv.Atoi(args[len(args)-1])
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid NATS message: %q", line)
+			}
+			payload := make([]byte, n+2) // followed by \r\n
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return err
+			}
+			handle(sid, payload[:n])
+		case "PING":
+			if _, err := io.WriteString(w, "PONG\r\n"); err != nil {
+				return err
+			}
+		case "-ERR":
+			return fmt.Errorf("NATS server error: %s", strings.TrimSpace(line[4:]))
+		case "PONG", "+OK", "INFO", "":
+		default:
+			return fmt.Errorf("unexpected NATS protocol line: %q", line)
+		}
+	}
+}
+
+// parseNatsURL parses a "nats://[user[:password]@]host[:port]" URL,
+// the port defaults to 4222.
+func parseNatsURL(s string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "nats://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nats-url: %v", err)
+	}
+	if u.Scheme != "nats" || u.Host == "" {
+		return nil, fmt.Errorf("invalid nats-url: %q (expected nats://host:port)", s)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	return u, nil
+}
+
+// validNatsSubject checks a subscription subject: dot separated
+// non-empty tokens without whitespace, "*" matches a token, ">" all
+// remaining tokens and can only be last.
+func validNatsSubject(subject string) bool {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return false
+	}
+	tokens := strings.Split(subject, ".")
+	for i, t := range tokens {
+		if t == "" || (t == ">" && i != len(tokens)-1) {
+			return false
+		}
+		if len(t) > 1 && strings.ContainsAny(t, "*>") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,229 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tgres/tgres/graceful"
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/serde"
+)
+
+// opentsdbTelnetServiceManager accepts data points in the OpenTSDB
+// telnet protocol ("put <metric> <timestamp> <value> <tagk=tagv>..."),
+// e.g. from tcollector.
+type opentsdbTelnetServiceManager struct {
+	rcvr       *receiver.Receiver
+	listener   *graceful.Listener
+	listenSpec string
+	timeout    time.Duration
+	tlsConfig  *tls.Config    // nil is no TLS
+	proxy      *proxyProtocol // nil is no PROXY protocol
+	limits     *connLimiter
+	stop       int32
+}
+
+func (g *opentsdbTelnetServiceManager) File() *os.File {
+	if g.listener != nil {
+		return g.listener.File()
+	}
+	return nil
+}
+
+func (g *opentsdbTelnetServiceManager) Stop() {
+	if g.stopped() {
+		return
+	}
+	if g.listener != nil {
+		log.Printf("Closing listener %s\n", g.listenSpec)
+		g.listener.Close()
+	}
+	atomic.StoreInt32(&(g.stop), 1)
+}
+
+func (g *opentsdbTelnetServiceManager) stopped() bool {
+	return atomic.LoadInt32(&(g.stop)) != 0
+}
+
+func (g *opentsdbTelnetServiceManager) Start(file *os.File) error {
+	var (
+		gl  net.Listener
+		err error
+	)
+
+	if g.listenSpec != "" {
+		if file != nil {
+			gl, err = net.FileListener(file)
+		} else {
+			gl, err = net.Listen("tcp", processListenSpec(g.listenSpec))
+		}
+	} else {
+		log.Printf("Not starting OpenTSDB telnet protocol because opentsdb-telnet-listen-spec is blank.")
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("Error starting OpenTSDB telnet protocol serviceManager: %v", err)
+	}
+
+	g.listener = graceful.NewListener(gl)
+
+	log.Printf("OpenTSDB telnet protocol Listening on %s%s\n", processListenSpec(g.listenSpec), tlsNote(g.tlsConfig))
+
+	go g.opentsdbTelnetServer()
+
+	return nil
+}
+
+func (g *opentsdbTelnetServiceManager) opentsdbTelnetServer() error {
+
+	var tempDelay time.Duration
+	for {
+		if g.stopped() {
+			return nil
+		}
+		conn, err := g.listener.Accept()
+
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				log.Printf("opentsdbTelnetServer(): Accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+
+		conn = g.proxy.wrap(conn) // the PROXY header precedes TLS
+		if g.tlsConfig != nil {
+			conn = tls.Server(conn, g.tlsConfig)
+		}
+		if conn = g.limits.accept(conn); conn == nil {
+			continue // too many connections
+		}
+		go g.handleOpentsdbTelnetProtocol(conn)
+	}
+}
+
+func (g *opentsdbTelnetServiceManager) handleOpentsdbTelnetProtocol(conn net.Conn) {
+	defer conn.Close() // decrements graceful.TcpWg
+
+	if g.timeout != 0 {
+		conn.SetDeadline(time.Now().Add(g.timeout))
+	}
+
+	source := sourceAddr(conn)
+	connbuf := bufio.NewScanner(conn)
+
+	for connbuf.Scan() {
+		line := strings.TrimSpace(connbuf.Text())
+		cmd := strings.SplitN(line, " ", 2)[0]
+
+		switch cmd {
+		case "put":
+			if ident, ts, v, err := parseOpentsdbPut(line); err != nil {
+				// OpenTSDB reports errors back to the sender
+				fmt.Fprintf(conn, "put: %v\n", err)
+				g.rcvr.RecordDropped(receiver.DeadParse, line)
+			} else if ts, ok := g.rcvr.ListenerTime("opentsdb_tcp", ts); ok && g.rcvr.AcquireListenerInput("opentsdb_tcp", source, 1) {
+				ident["name"] = g.rcvr.ListenerName("opentsdb_tcp", ident["name"])
+				g.rcvr.QueueDataPoint(ident, ts, v)
+				g.rcvr.CountListenerInput("opentsdb_tcp", 1)
+			}
+		case "version": // tcollector uses this to check the connection
+			fmt.Fprintf(conn, "tgres OpenTSDB telnet protocol\n")
+		case "exit":
+			return
+		case "":
+		default:
+			fmt.Fprintf(conn, "unknown command: %s\n", cmd)
+		}
+
+		if g.timeout != 0 {
+			conn.SetDeadline(time.Now().Add(g.timeout))
+		}
+
+		if g.stopped() {
+			return
+		}
+	}
+
+	if err := connbuf.Err(); err != nil {
+		if !strings.Contains(err.Error(), "use of closed") {
+			log.Printf("handleOpentsdbTelnetProtocol(): Error reading: %v", err)
+		}
+	}
+}
+
+// parseOpentsdbPut parses a "put <metric> <timestamp> <value>
+// <tagk1=tagv1>..." line, the tags become fields of the ident. The
+// timestamp is in seconds or, if it has more than 10 digits, in
+// milliseconds.
+func parseOpentsdbPut(line string) (serde.Ident, time.Time, float64, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || fields[0] != "put" {
+		return nil, time.Time{}, 0, fmt.Errorf("illegal argument: not enough arguments (need at least 4, got %d)", len(fields))
+	}
+
+	ident := serde.Ident{"name": misc.SanitizeName(fields[1])}
+	if ident["name"] == "" {
+		return nil, time.Time{}, 0, fmt.Errorf("illegal argument: invalid metric name %q", fields[1])
+	}
+
+	tstamp, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || tstamp <= 0 {
+		return nil, time.Time{}, 0, fmt.Errorf("illegal argument: invalid timestamp %q", fields[2])
+	}
+	var ts time.Time
+	if len(fields[2]) > 10 {
+		ts = time.Unix(0, tstamp*int64(time.Millisecond))
+	} else {
+		ts = time.Unix(tstamp, 0)
+	}
+
+	v, err := strconv.ParseFloat(fields[3], 64)
+	if err != nil {
+		return nil, time.Time{}, 0, fmt.Errorf("illegal argument: invalid value %q", fields[3])
+	}
+
+	for _, tag := range fields[4:] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" || kv[0] == "name" {
+			return nil, time.Time{}, 0, fmt.Errorf("illegal argument: invalid tag %q", tag)
+		}
+		ident[kv[0]] = kv[1]
+	}
+	return ident, ts, v, nil
+}
@@ -0,0 +1,180 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/statsd"
+)
+
+// payloadFormat is the format of the messages received from a
+// message bus, they are decoded as by the listener of the same
+// protocol, one data point per line, or as JSON.
+type payloadFormat int
+
+const (
+	payloadGraphite payloadFormat = iota // "name value timestamp"
+	payloadStatsd                        // "name:value|type"
+	payloadOpentsdb                      // "put metric timestamp value tags"
+	payloadJSON                          // see parseJSONPayload
+)
+
+func (f payloadFormat) String() string {
+	switch f {
+	case payloadGraphite:
+		return "graphite"
+	case payloadStatsd:
+		return "statsd"
+	case payloadOpentsdb:
+		return "opentsdb"
+	case payloadJSON:
+		return "json"
+	}
+	return fmt.Sprintf("payloadFormat(%d)", int(f))
+}
+
+func parsePayloadFormat(s string) (payloadFormat, error) {
+	switch strings.ToLower(s) {
+	case "graphite", "":
+		return payloadGraphite, nil
+	case "statsd":
+		return payloadStatsd, nil
+	case "opentsdb":
+		return payloadOpentsdb, nil
+	case "json":
+		return payloadJSON, nil
+	}
+	return payloadGraphite, fmt.Errorf("Invalid payload format: %q (valid: graphite, statsd, opentsdb, json)", s)
+}
+
+// queuePayload decodes every line of a message and queues it, lines
+// that cannot be parsed go to the dead letter file. The listener and
+// source are for the listener quotas.
+func queuePayload(rcvr *receiver.Receiver, format payloadFormat, listener, source string, payload []byte) {
+	if format == payloadJSON {
+		points, err := parseJSONPayload(payload)
+		if err != nil {
+			rcvr.RecordDropped(receiver.DeadParse, string(payload))
+		}
+		for _, p := range points {
+			if p.ident == nil {
+				rcvr.RecordDropped(receiver.DeadParse, string(p.raw))
+			} else if ts, ok := rcvr.ListenerTime(listener, p.ts); ok && rcvr.AcquireListenerInput(listener, source, 1) {
+				p.ident["name"] = rcvr.ListenerName(listener, p.ident["name"])
+				rcvr.QueueDataPoint(p.ident, ts, p.v)
+				rcvr.CountListenerInput(listener, 1)
+			}
+		}
+		return
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(payload))
+	scanner.Buffer(nil, len(payload)+1)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		switch format {
+		case payloadStatsd:
+			if stat, err := statsd.ParseStatsdPacket(line); err != nil {
+				rcvr.RecordDropped(receiver.DeadParse, line)
+			} else if rcvr.AcquireListenerInput(listener, source, 1) {
+				stat.Name = rcvr.ListenerName(listener, stat.Name)
+				rcvr.QueueAggregatorCommand(stat.AggregatorCmd())
+				rcvr.CountListenerInput(listener, 1)
+			}
+		default:
+			parse := parseGraphitePacket
+			if format == payloadOpentsdb {
+				parse = parseOpentsdbPut
+			}
+			if ident, ts, v, err := parse(line); err != nil {
+				rcvr.RecordDropped(receiver.DeadParse, line)
+			} else if ts, ok := rcvr.ListenerTime(listener, ts); ok && rcvr.AcquireListenerInput(listener, source, 1) {
+				ident["name"] = rcvr.ListenerName(listener, ident["name"])
+				rcvr.QueueDataPoint(ident, ts, v)
+				rcvr.CountListenerInput(listener, 1)
+			}
+		}
+	}
+}
+
+type jsonDataPoint struct {
+	Name      string            `json:"name"`
+	Value     *float64          `json:"value"`
+	Timestamp float64           `json:"timestamp"`
+	Tags      map[string]string `json:"tags"`
+}
+
+type payloadPoint struct {
+	raw   json.RawMessage
+	ident serde.Ident // nil if invalid
+	ts    time.Time
+	v     float64
+}
+
+// parseJSONPayload decodes a {"name": "foo.bar", "value": 1,
+// "timestamp": 1500000000, "tags": {"host": "x"}} data point, or an
+// array of them. The timestamp is in seconds and defaults to now,
+// tags become fields of the ident. The points that are not valid
+// are returned with a nil ident.
+func parseJSONPayload(payload []byte) ([]payloadPoint, error) {
+	var raw []json.RawMessage
+	if payload = bytes.TrimSpace(payload); len(payload) > 0 && payload[0] == '{' {
+		raw = []json.RawMessage{payload}
+	} else if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil, err
+	}
+
+	points := make([]payloadPoint, len(raw))
+	for i, r := range raw {
+		points[i].raw = r
+		var dp jsonDataPoint
+		if json.Unmarshal(r, &dp) != nil || dp.Value == nil || dp.Timestamp < 0 {
+			continue
+		}
+		ident := serde.Ident{"name": misc.SanitizeName(dp.Name)}
+		for k, v := range dp.Tags {
+			if k == "" || v == "" || k == "name" {
+				ident = nil
+				break
+			}
+			ident[k] = v
+		}
+		if ident == nil || ident["name"] == "" {
+			continue
+		}
+		points[i].ident, points[i].v = ident, *dp.Value
+		if dp.Timestamp == 0 {
+			points[i].ts = time.Now()
+		} else {
+			sec, frac := math.Modf(dp.Timestamp)
+			points[i].ts = time.Unix(int64(sec), int64(frac*1e9))
+		}
+	}
+	return points, nil
+}
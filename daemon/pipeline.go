@@ -0,0 +1,44 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/tgres/tgres/serde"
+)
+
+var initPipelineDb = func(driver, connectString, prefix string) (serde.DbSerDe, error) {
+	return openDb(driver, connectString, prefix)
+}
+
+// createPipelines creates a receiver for every [[pipeline]] and adds
+// it and its listeners to the service manager. Pipelines share the
+// process and nothing else: they do not take part in the cluster,
+// are not queried via HTTP and their DS specs are not reloaded on
+// SIGUSR2.
+var createPipelines = func(cfg *Config, sm *serviceManager) error {
+	for _, p := range cfg.Pipelines {
+		db, err := initPipelineDb(cfg.DbDriver, cfg.DbConnectString, p.DbPrefix)
+		if err != nil {
+			return fmt.Errorf("pipeline %q: error connecting to the DB: %v", p.Name, err)
+		}
+		sm.addPipeline(p.Name, createReceiver(p.cfg, nil, db), p.cfg)
+		log.Printf("Pipeline %q: receiver created.", p.Name)
+	}
+	return nil
+}
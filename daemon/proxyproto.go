@@ -0,0 +1,207 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The PROXY protocol v2 signature, v1 headers begin with "PROXY ".
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// The longest v1 header, as per the specification.
+const proxyV1MaxLen = 107
+
+// proxyProtocol is the HAProxy PROXY protocol (v1 or v2) on a TCP
+// listener. Every connection must begin with a header, which then
+// provides the remote address. An empty trusted list accepts headers
+// from anywhere, otherwise connections from elsewhere fail.
+type proxyProtocol struct {
+	trusted []*net.IPNet
+}
+
+// wrap returns conn with the PROXY header read lazily, on the first
+// Read or RemoteAddr, so that a slow client does not hold up the
+// accept loop. A nil proxyProtocol returns conn as is.
+func (p *proxyProtocol) wrap(conn net.Conn) net.Conn {
+	if p == nil {
+		return conn
+	}
+	return &proxyConn{Conn: conn, p: p, r: bufio.NewReader(conn)}
+}
+
+// listener wraps every connection accepted by l, for http.Server.
+func (p *proxyProtocol) listener(l net.Listener) net.Listener {
+	if p == nil {
+		return l
+	}
+	return &proxyListener{Listener: l, p: p}
+}
+
+func (p *proxyProtocol) isTrusted(addr net.Addr) bool {
+	if len(p.trusted) == 0 {
+		return true
+	}
+	ta, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true // a unix socket is local
+	}
+	for _, n := range p.trusted {
+		if n.Contains(ta.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+type proxyListener struct {
+	net.Listener
+	p *proxyProtocol
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.p.wrap(conn), nil
+}
+
+type proxyConn struct {
+	net.Conn
+	p      *proxyProtocol
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr // nil is the address of the connection itself
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		if !c.p.isTrusted(c.Conn.RemoteAddr()) {
+			c.err = fmt.Errorf("PROXY protocol: untrusted source %v", c.Conn.RemoteAddr())
+			return
+		}
+		c.remote, c.err = readProxyHeader(c.r)
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init(); c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a v1 or v2 header and returns the source
+// address in it, or nil for the UNKNOWN (v1) or LOCAL (v2) ones,
+// e.g. health checks, and address families other than IPv4 and IPv6.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, fmt.Errorf("PROXY protocol: reading header: %v", err)
+	}
+	if bytes.Equal(sig, proxyV2Sig) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+	return nil, fmt.Errorf("PROXY protocol: missing header")
+}
+
+// "PROXY TCP4 <src> <dst> <sport> <dport>\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) <= proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("PROXY protocol: reading v1 header: %v", err)
+		}
+		if line = append(line, b); b == '\n' {
+			break
+		}
+	}
+	if len(line) > proxyV1MaxLen || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("PROXY protocol: v1 header too long or not terminated by CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("PROXY protocol: invalid v1 header: %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("PROXY protocol: invalid v1 source address: %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// A 16 byte header (signature, version/command, family, length)
+// followed by the addresses.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("PROXY protocol: reading v2 header: %v", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("PROXY protocol: unsupported version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("PROXY protocol: reading v2 addresses: %v", err)
+	}
+
+	switch hdr[12] & 0xf {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("PROXY protocol: unsupported v2 command %d", hdr[12]&0xf)
+	}
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET: src, dst, sport, dport
+		if len(body) < 12 {
+			return nil, fmt.Errorf("PROXY protocol: v2 IPv4 addresses too short")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("PROXY protocol: v2 IPv6 addresses too short")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
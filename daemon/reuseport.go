@@ -0,0 +1,101 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenUDPReaders opens the UDP socket for listenSpec, or uses file
+// (inherited on graceful restart), and, if readers > 1, readers-1
+// more on the same address with SO_REUSEPORT, so that the kernel
+// spreads the packets among them and each can have its own reader.
+// An inherited socket without SO_REUSEPORT (the previous process had
+// one reader) cannot be shared, it is then the only one. A unix
+// datagram socket ("unix:/path") always has one reader.
+func listenUDPReaders(listenSpec string, file *os.File, readers int, mode os.FileMode) ([]net.Conn, error) {
+	if path := unixSocketPath(listenSpec); path != "" { // only one reader
+		if file != nil {
+			conn, err := net.FileConn(file)
+			if err != nil {
+				return nil, err
+			}
+			return []net.Conn{conn}, nil
+		}
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+		if err != nil {
+			return nil, err
+		}
+		if err := chmodSocket(path, mode); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return []net.Conn{conn}, nil
+	}
+
+	lc := net.ListenConfig{}
+	if readers > 1 {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			}); err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+
+	var (
+		first net.Conn
+		err   error
+	)
+	if file != nil {
+		first, err = net.FileConn(file)
+	} else {
+		var pc net.PacketConn
+		if pc, err = lc.ListenPacket(context.Background(), "udp", processListenSpec(listenSpec)); err == nil {
+			first = pc.(*net.UDPConn)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conns := []net.Conn{first}
+	for len(conns) < readers {
+		pc, err := lc.ListenPacket(context.Background(), "udp", first.LocalAddr().String())
+		if err != nil {
+			if file != nil && len(conns) == 1 {
+				log.Printf("Cannot add UDP readers to inherited socket %s (%v), using one.", first.LocalAddr(), err)
+				break
+			}
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, pc.(*net.UDPConn))
+	}
+	return conns, nil
+}
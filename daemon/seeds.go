@@ -0,0 +1,144 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgres/tgres/cluster"
+)
+
+// A cluster-seeds entry with this prefix is the name of DNS SRV
+// records, e.g. srv:_tgres._tcp.example.com, the targets and ports
+// of which are the nodes.
+const srvSeedPrefix = "srv:"
+
+// The DNS lookups, variables for testing.
+var (
+	lookupSRV  = net.LookupSRV
+	lookupHost = net.LookupHost
+)
+
+// resolveSeeds returns the addresses of the cluster-seeds, those of
+// a host name are all of its addresses, with its port if any, those
+// of SRV records are the addresses of their targets with their ports,
+// those of Kubernetes services and pods are as per k8sSeedAddrs.
+// Seeds which do not resolve are logged and skipped, it is an error
+// only if none do.
+func resolveSeeds(seeds []string) ([]string, error) {
+	var (
+		addrs   []string
+		lastErr error
+	)
+	seen := make(map[string]bool)
+	addAddrs := func(as []string) {
+		for _, addr := range as {
+			if !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	add := func(host, port string) error {
+		ips, err := lookupHost(host)
+		if err != nil {
+			return err
+		}
+		for _, ip := range ips {
+			if port != "" {
+				ip = net.JoinHostPort(ip, port)
+			}
+			addAddrs([]string{ip})
+		}
+		return nil
+	}
+
+	for _, seed := range seeds {
+		var err error
+		if isK8sSeed(seed) {
+			var as []string
+			if as, err = k8sSeedAddrs(seed); err == nil {
+				addAddrs(as)
+			}
+		} else if strings.HasPrefix(seed, srvSeedPrefix) {
+			var srvs []*net.SRV
+			if _, srvs, err = lookupSRV("", "", strings.TrimPrefix(seed, srvSeedPrefix)); err == nil {
+				for _, srv := range srvs {
+					if err = add(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))); err != nil {
+						break
+					}
+				}
+			}
+		} else if host, port, serr := net.SplitHostPort(seed); serr == nil {
+			err = add(host, port)
+		} else {
+			err = add(seed, "")
+		}
+		if err != nil {
+			log.Printf("Cluster: unable to resolve seed %q: %v", seed, err)
+			lastErr = err
+		}
+	}
+	if len(addrs) == 0 && lastErr != nil {
+		return nil, fmt.Errorf("none of the cluster-seeds resolved: %v", lastErr)
+	}
+	return addrs, nil
+}
+
+type seedJoiner interface {
+	Members() []*cluster.Node
+	Join([]string) error
+}
+
+// rejoinSeeds periodically re-resolves the cluster-seeds and joins
+// the addresses which are not (yet) members, e.g. of nodes added
+// since, or all of them after a partition.
+func rejoinSeeds(c seedJoiner, seeds []string, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := joinNewSeeds(c, seeds); err != nil {
+			log.Printf("Cluster: %v", err)
+		}
+	}
+}
+
+func joinNewSeeds(c seedJoiner, seeds []string) error {
+	addrs, err := resolveSeeds(seeds)
+	if err != nil {
+		return err
+	}
+	members := make(map[string]bool)
+	for _, n := range c.Members() {
+		members[n.Addr.String()] = true
+		members[net.JoinHostPort(n.Addr.String(), strconv.Itoa(int(n.Port)))] = true
+	}
+	var join []string
+	for _, addr := range addrs {
+		if !members[addr] {
+			join = append(join, addr)
+		}
+	}
+	if len(join) == 0 {
+		return nil
+	}
+	log.Printf("Cluster: joining cluster-seeds which are not members: %s", strings.Join(join, ", "))
+	return c.Join(join)
+}
@@ -16,10 +16,12 @@
 package daemon
 
 import (
+	"crypto/tls"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"strings"
-	"time"
 
 	"github.com/tgres/tgres/dsl"
 	"github.com/tgres/tgres/graceful"
@@ -34,21 +36,168 @@ type trService interface {
 
 type serviceMap map[string]trService
 type serviceManager struct {
-	rcvr     *receiver.Receiver
-	services serviceMap
+	rcvr      *receiver.Receiver
+	services  serviceMap
+	pipelines []*receiver.Receiver // see addPipeline
 }
 
 func newServiceManager(rcvr *receiver.Receiver, rcache dsl.NamedDSFetcher, cfg *Config) *serviceManager {
-	return &serviceManager{rcvr: rcvr,
+	sm := &serviceManager{rcvr: rcvr,
 		services: serviceMap{
-			"gt":  &graphiteTextServiceManager{rcvr: rcvr, listenSpec: cfg.GraphiteTextListenSpec, timeout: 30 * time.Second},
-			"gu":  &graphiteTextServiceManager{rcvr: rcvr, listenSpec: cfg.GraphiteUdpListenSpec, udp: true},
-			"gp":  &graphitePickleServiceManager{rcvr: rcvr, listenSpec: cfg.GraphitePickleListenSpec},
-			"st":  &statsdTextServiceManager{rcvr: rcvr, listenSpec: cfg.StatsdTextListenSpec, timeout: 30 * time.Second},
-			"su":  &statsdTextServiceManager{rcvr: rcvr, listenSpec: cfg.StatsdUdpListenSpec, udp: true},
-			"www": &wwwServer{rcvr: rcvr, rcache: rcache, listenSpec: cfg.HttpListenSpec, originHdr: cfg.HttpAllowOrigin},
+			"gt": &graphiteTextServiceManager{rcvr: rcvr, listenSpec: cfg.GraphiteTextListenSpec, timeout: cfg.ListenerIdleTimeout.Duration,
+				socketMode: cfg.unixSocketMode, tlsConfig: cfg.listenerTLS("graphite_tcp"), proxy: cfg.listenerProxy("graphite_tcp"),
+				limits: newConnLimiter(rcvr, "graphite_tcp", cfg, true), strict: newLineValidator(rcvr, "graphite_tcp", cfg)},
+			"gu": &graphiteTextServiceManager{rcvr: rcvr, listenSpec: cfg.GraphiteUdpListenSpec, udp: true, readers: cfg.UDPReaders,
+				socketMode: cfg.unixSocketMode, strict: newLineValidator(rcvr, "graphite_udp", cfg)},
+			"gp": &graphitePickleServiceManager{rcvr: rcvr, listenSpec: cfg.GraphitePickleListenSpec, timeout: cfg.ListenerIdleTimeout.Duration,
+				tlsConfig: cfg.listenerTLS("graphite_pickle"), proxy: cfg.listenerProxy("graphite_pickle"),
+				limits: newConnLimiter(rcvr, "graphite_pickle", cfg, false)},
+			"st": &statsdTextServiceManager{rcvr: rcvr, listenSpec: cfg.StatsdTextListenSpec, timeout: cfg.ListenerIdleTimeout.Duration,
+				socketMode: cfg.unixSocketMode, tlsConfig: cfg.listenerTLS("statsd_tcp"), proxy: cfg.listenerProxy("statsd_tcp"),
+				limits: newConnLimiter(rcvr, "statsd_tcp", cfg, true), strict: newLineValidator(rcvr, "statsd_tcp", cfg)},
+			"su": &statsdTextServiceManager{rcvr: rcvr, listenSpec: cfg.StatsdUdpListenSpec, udp: true, readers: cfg.UDPReaders,
+				socketMode: cfg.unixSocketMode, strict: newLineValidator(rcvr, "statsd_udp", cfg)},
+			"ot": &opentsdbTelnetServiceManager{rcvr: rcvr, listenSpec: cfg.OpentsdbTelnetListenSpec, timeout: cfg.ListenerIdleTimeout.Duration,
+				tlsConfig: cfg.listenerTLS("opentsdb_tcp"), proxy: cfg.listenerProxy("opentsdb_tcp"),
+				limits: newConnLimiter(rcvr, "opentsdb_tcp", cfg, true)},
+			"cd": &collectdServiceManager{rcvr: rcvr, listenSpec: cfg.CollectdListenSpec, parser: cfg.collectdParser,
+				naming: cfg.collectdNaming, prefix: cfg.CollectdPrefix, types: cfg.collectdTypes},
+			"nats": &natsServiceManager{rcvr: rcvr, url: cfg.NatsURL, subs: cfg.NatsSubscriptions},
+			"amqp": &amqpServiceManager{rcvr: rcvr, url: cfg.AmqpURL, cfg: cfg.amqp},
+			"mqtt": &mqttServiceManager{rcvr: rcvr, url: cfg.MqttURL, clientID: cfg.MqttClientID, subs: cfg.MqttSubscriptions},
+			"www": &wwwServer{rcvr: rcvr, rcache: rcache, listenSpec: cfg.HttpListenSpec, originHdr: cfg.HttpAllowOrigin,
+				adminToken: cfg.HttpAdminToken, proxy: cfg.listenerProxy("http")},
 		},
 	}
+	for _, l := range cfg.SpecListeners {
+		sm.addSpecListener(l, cfg)
+	}
+	return sm
+}
+
+// addSpecListener adds the listeners of a graphite-listener, named
+// "gt:" and "gu:" with its name appended. New DSs for the points
+// they receive get the DS spec set of the same name, which
+// createReceiver sets.
+func (r *serviceManager) addSpecListener(l specListener, cfg *Config) {
+	r.services["gt:"+l.Name] = &graphiteTextServiceManager{rcvr: r.rcvr, listenSpec: l.TextListenSpec, timeout: cfg.ListenerIdleTimeout.Duration,
+		socketMode: cfg.unixSocketMode, specSet: l.Name, tlsConfig: cfg.listenerTLS("graphite_tcp"), proxy: cfg.listenerProxy("graphite_tcp"),
+		limits: newConnLimiter(r.rcvr, "graphite_tcp", cfg, true), strict: newLineValidator(r.rcvr, "graphite_tcp", cfg)}
+	r.services["gu:"+l.Name] = &graphiteTextServiceManager{rcvr: r.rcvr, listenSpec: l.UdpListenSpec, udp: true, readers: cfg.UDPReaders,
+		socketMode: cfg.unixSocketMode, specSet: l.Name, strict: newLineValidator(r.rcvr, "graphite_udp", cfg)}
+}
+
+// addPipeline adds the listeners of an additional pipeline, they are
+// named as the main ones with a "." and the pipeline name appended,
+// e.g. "gt.staging". Its receiver is drained and stopped along with
+// the main one.
+func (r *serviceManager) addPipeline(name string, rcvr *receiver.Receiver, cfg *Config) {
+	r.services["gt."+name] = &graphiteTextServiceManager{rcvr: rcvr, listenSpec: cfg.GraphiteTextListenSpec, timeout: cfg.ListenerIdleTimeout.Duration,
+		socketMode: cfg.unixSocketMode, tlsConfig: cfg.listenerTLS("graphite_tcp"), proxy: cfg.listenerProxy("graphite_tcp"),
+		limits: newConnLimiter(rcvr, "graphite_tcp", cfg, true), strict: newLineValidator(rcvr, "graphite_tcp", cfg)}
+	r.services["gu."+name] = &graphiteTextServiceManager{rcvr: rcvr, listenSpec: cfg.GraphiteUdpListenSpec, udp: true, readers: cfg.UDPReaders,
+		socketMode: cfg.unixSocketMode, strict: newLineValidator(rcvr, "graphite_udp", cfg)}
+	r.services["gp."+name] = &graphitePickleServiceManager{rcvr: rcvr, listenSpec: cfg.GraphitePickleListenSpec, timeout: cfg.ListenerIdleTimeout.Duration,
+		tlsConfig: cfg.listenerTLS("graphite_pickle"), proxy: cfg.listenerProxy("graphite_pickle"),
+		limits: newConnLimiter(rcvr, "graphite_pickle", cfg, false)}
+	r.services["st."+name] = &statsdTextServiceManager{rcvr: rcvr, listenSpec: cfg.StatsdTextListenSpec, timeout: cfg.ListenerIdleTimeout.Duration,
+		socketMode: cfg.unixSocketMode, tlsConfig: cfg.listenerTLS("statsd_tcp"), proxy: cfg.listenerProxy("statsd_tcp"),
+		limits: newConnLimiter(rcvr, "statsd_tcp", cfg, true), strict: newLineValidator(rcvr, "statsd_tcp", cfg)}
+	r.services["su."+name] = &statsdTextServiceManager{rcvr: rcvr, listenSpec: cfg.StatsdUdpListenSpec, udp: true, readers: cfg.UDPReaders,
+		socketMode: cfg.unixSocketMode, strict: newLineValidator(rcvr, "statsd_udp", cfg)}
+	r.services["ot."+name] = &opentsdbTelnetServiceManager{rcvr: rcvr, listenSpec: cfg.OpentsdbTelnetListenSpec, timeout: cfg.ListenerIdleTimeout.Duration,
+		tlsConfig: cfg.listenerTLS("opentsdb_tcp"), proxy: cfg.listenerProxy("opentsdb_tcp"),
+		limits: newConnLimiter(rcvr, "opentsdb_tcp", cfg, true)}
+	r.pipelines = append(r.pipelines, rcvr)
+}
+
+// sourceAddr returns the host of the remote address of conn, for
+// the listener quotas, or "" if there is none (UDP).
+func sourceAddr(conn net.Conn) string {
+	if conn.RemoteAddr() == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// tlsNote is for logging whether a listener uses TLS.
+func tlsNote(config *tls.Config) string {
+	if config == nil {
+		return ""
+	}
+	if config.ClientAuth == tls.RequireAndVerifyClientCert {
+		return " (TLS, client certificates required)"
+	}
+	return " (TLS)"
+}
+
+// unixSocketPath is the path of a "unix:/path" listen spec, "" if it
+// is not one.
+func unixSocketPath(listenSpec string) string {
+	if strings.HasPrefix(listenSpec, "unix:") {
+		return listenSpec[len("unix:"):]
+	}
+	return ""
+}
+
+// removeStaleSocket removes a unix socket left behind by a previous
+// process, anything else at path is an error.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+// chmodSocket sets the permissions of a unix socket, 0 leaves them
+// as per umask.
+func chmodSocket(path string, mode os.FileMode) error {
+	if mode == 0 {
+		return nil
+	}
+	return os.Chmod(path, mode)
+}
+
+// listenStream listens on TCP or, for a "unix:/path" listen spec, a
+// unix socket, or uses file (inherited on graceful restart). The unix
+// socket is not removed on close, as the next process may have
+// inherited it, but when the next one starts afresh.
+func listenStream(listenSpec string, file *os.File, mode os.FileMode) (net.Listener, error) {
+	var (
+		l   net.Listener
+		err error
+	)
+	path := unixSocketPath(listenSpec)
+	if file != nil {
+		l, err = net.FileListener(file)
+	} else if path != "" {
+		if err = removeStaleSocket(path); err == nil {
+			if l, err = net.Listen("unix", path); err == nil {
+				if err = chmodSocket(path, mode); err != nil {
+					l.Close()
+				}
+			}
+		}
+	} else {
+		l, err = net.Listen("tcp", processListenSpec(listenSpec))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	return l, nil
 }
 
 func processListenSpec(listenSpec string) string {
@@ -17,6 +17,7 @@ package daemon
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
@@ -34,14 +35,21 @@ type statsdTextServiceManager struct {
 	rcvr       *receiver.Receiver
 	listenSpec string
 	udp        bool
+	socketMode os.FileMode    // of a unix socket, 0 is as per umask
+	strict     *lineValidator // nil is lenient parsing
 	stop       int32
 
 	// TCP
-	listener *graceful.Listener
-	timeout  time.Duration
+	listener  *graceful.Listener
+	timeout   time.Duration
+	tlsConfig *tls.Config    // nil is no TLS
+	proxy     *proxyProtocol // nil is no PROXY protocol
+	limits    *connLimiter
 
 	// UDP
-	conn net.Conn
+	conn    net.Conn   // the first of conns, see File()
+	conns   []net.Conn // one per reader
+	readers int
 }
 
 func (g *statsdTextServiceManager) Stop() {
@@ -50,7 +58,9 @@ func (g *statsdTextServiceManager) Stop() {
 	}
 	if g.conn != nil {
 		log.Printf("Closing UDP listener %s", g.listenSpec)
-		g.conn.Close()
+		for _, conn := range g.conns {
+			conn.Close()
+		}
 	}
 	if g.listener != nil {
 		log.Printf("Closing TCP listener %s", g.listenSpec)
@@ -65,7 +75,9 @@ func (g *statsdTextServiceManager) stopped() bool {
 
 func (g *statsdTextServiceManager) File() *os.File {
 	if g.conn != nil {
-		f, _ := g.conn.(*net.UDPConn).File()
+		f, _ := g.conn.(interface {
+			File() (*os.File, error)
+		}).File() // UDP or unix datagram
 		return f
 	}
 	if g.listener != nil {
@@ -83,19 +95,11 @@ func (g *statsdTextServiceManager) Start(file *os.File) error {
 }
 
 func (g *statsdTextServiceManager) startUDP(file *os.File) error {
-	var (
-		err     error
-		udpAddr *net.UDPAddr
-	)
+	var err error
 
 	if g.listenSpec != "" {
-		if file != nil {
-			g.conn, err = net.FileConn(file)
-		} else {
-			udpAddr, err = net.ResolveUDPAddr("udp", processListenSpec(g.listenSpec))
-			if err == nil {
-				g.conn, err = net.ListenUDP("udp", udpAddr)
-			}
+		if g.conns, err = listenUDPReaders(g.listenSpec, file, g.readers, g.socketMode); err == nil {
+			g.conn = g.conns[0]
 		}
 	} else {
 		log.Printf("Not starting Statsd UDP protocol because statsd-udp-listen-spec is blank.")
@@ -105,10 +109,11 @@ func (g *statsdTextServiceManager) startUDP(file *os.File) error {
 		return fmt.Errorf("Error starting Statsd UDP Text Protocol serviceManager: %v", err)
 	}
 
-	log.Printf("Statsd UDP protocol Listening on %s\n", processListenSpec(g.listenSpec))
+	log.Printf("Statsd UDP protocol Listening on %s (%d readers)\n", processListenSpec(g.listenSpec), len(g.conns))
 
-	// for UDP timeout must be 0
-	go g.handleStatsdTextProtocol(g.conn)
+	for _, conn := range g.conns {
+		go g.handleStatsdUDP(conn)
+	}
 
 	return nil
 }
@@ -120,11 +125,7 @@ func (g *statsdTextServiceManager) startTCP(file *os.File) error {
 	)
 
 	if g.listenSpec != "" {
-		if file != nil {
-			gl, err = net.FileListener(file)
-		} else {
-			gl, err = net.Listen("tcp", processListenSpec(g.listenSpec))
-		}
+		gl, err = listenStream(g.listenSpec, file, g.socketMode)
 	} else {
 		log.Printf("Not starting Statsd TCP protocol because statsd-text-listen-spec is blank")
 		return nil
@@ -136,7 +137,7 @@ func (g *statsdTextServiceManager) startTCP(file *os.File) error {
 
 	g.listener = graceful.NewListener(gl)
 
-	fmt.Println("Statsd TCP protocol Listening on " + processListenSpec(g.listenSpec))
+	fmt.Println("Statsd TCP protocol Listening on " + processListenSpec(g.listenSpec) + tlsNote(g.tlsConfig))
 
 	go g.statsdTCPTextServer()
 
@@ -168,6 +169,13 @@ func (g *statsdTextServiceManager) statsdTCPTextServer() error {
 		}
 		tempDelay = 0
 
+		conn = g.proxy.wrap(conn) // the PROXY header precedes TLS
+		if g.tlsConfig != nil {
+			conn = tls.Server(conn, g.tlsConfig)
+		}
+		if conn = g.limits.accept(conn); conn == nil {
+			continue // too many connections
+		}
 		go g.handleStatsdTextProtocol(conn)
 	}
 }
@@ -179,15 +187,13 @@ func (g *statsdTextServiceManager) handleStatsdTextProtocol(conn net.Conn) {
 		conn.SetDeadline(time.Now().Add(g.timeout))
 	}
 
+	source := sourceAddr(conn)
+
 	// We use Scanner, becase it has a MaxScanTokenSize of 64K
 	connbuf := bufio.NewScanner(conn)
 
 	for connbuf.Scan() {
-		if stat, err := statsd.ParseStatsdPacket(connbuf.Text()); err == nil {
-			g.rcvr.QueueAggregatorCommand(stat.AggregatorCmd())
-		} else {
-			log.Printf("parseStatsdPacket(): %v", err)
-		}
+		g.handleStatsdLine("statsd_tcp", source, connbuf.Text())
 
 		if g.timeout != 0 {
 			conn.SetDeadline(time.Now().Add(g.timeout))
@@ -204,3 +210,37 @@ func (g *statsdTextServiceManager) handleStatsdTextProtocol(conn net.Conn) {
 		}
 	}
 }
+
+// handleStatsdUDP reads datagrams in batches, every one of which may
+// have several lines.
+func (g *statsdTextServiceManager) handleStatsdUDP(conn net.Conn) {
+	defer conn.Close()
+
+	err := readUDPBatches(conn, func(b []byte) {
+		eachLine(b, func(line string) {
+			g.handleStatsdLine("statsd_udp", "", line)
+		})
+	})
+	if !strings.Contains(err.Error(), "use of closed") {
+		log.Printf("handleStatsdUDP(): Error reading: %v", err)
+	}
+}
+
+func (g *statsdTextServiceManager) handleStatsdLine(listener, source, line string) {
+	stat, err := statsd.ParseStatsdPacket(line)
+	if err == nil && g.strict != nil {
+		err = validateStatsdLine(line)
+	}
+	if err == nil {
+		if g.rcvr.AcquireListenerInput(listener, source, 1) {
+			stat.Name = g.rcvr.ListenerName(listener, stat.Name)
+			g.rcvr.QueueAggregatorCommand(stat.AggregatorCmd())
+			g.rcvr.CountListenerInput(listener, 1)
+		}
+	} else if g.strict != nil {
+		g.strict.reject(source, line, err)
+	} else {
+		log.Printf("parseStatsdPacket(): %v", err)
+		g.rcvr.RecordDropped(receiver.DeadParse, line)
+	}
+}
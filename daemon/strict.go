@@ -0,0 +1,124 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/receiver"
+)
+
+// lineValidator is the strict parsing mode of a line protocol
+// listener, see strict-listeners. Lines the lenient parsers would
+// accept, e.g. with trailing garbage, are rejected, and rejected
+// lines are counted as receiver.listener.<listener>.parse_errors and
+// every parse-error-log-sample-th one is logged with the error and
+// the source address, so that broken emitters can be found.
+type lineValidator struct {
+	rcvr     *receiver.Receiver
+	listener string
+	sample   uint64 // log every sample-th error, 0 is never
+	errors   uint64 // atomic, so far
+}
+
+// newLineValidator returns the strict mode of a listener, or nil if
+// it is not in strict-listeners.
+func newLineValidator(rcvr *receiver.Receiver, listener string, cfg *Config) *lineValidator {
+	for _, l := range cfg.StrictListeners {
+		if l == listener {
+			return &lineValidator{rcvr: rcvr, listener: listener, sample: uint64(cfg.ParseErrorLogSample)}
+		}
+	}
+	return nil
+}
+
+// reject counts and possibly logs a malformed line and records it as
+// a dead letter. The source of UDP lines is not known.
+func (v *lineValidator) reject(source, line string, err error) {
+	v.rcvr.CountListenerEvent(v.listener, "parse_errors")
+	if n := atomic.AddUint64(&(v.errors), 1); v.sample > 0 && (n-1)%v.sample == 0 {
+		if source == "" {
+			source = "unknown source"
+		}
+		log.Printf("%s: malformed line from %s (%d so far, logging 1 in %d): %v", v.listener, source, n, v.sample, err)
+	}
+	v.rcvr.RecordDropped(receiver.DeadParse, line)
+}
+
+// validateGraphiteLine is the strict check of a line that
+// parseGraphitePacket accepted. A plain line must be exactly a name,
+// a value and a timestamp, the name (not counting tags) must not need
+// sanitizing and the value and the timestamp must be numbers in their
+// entirety. Carbon2 lines are parsed strictly as is.
+func validateGraphiteLine(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) > 0 && strings.Contains(fields[0], "=") && !strings.Contains(fields[0], ";") {
+		return nil // carbon2
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf("expected name, value and timestamp, got %d fields: %q", len(fields), line)
+	}
+	if name := strings.SplitN(fields[0], ";", 2)[0]; misc.SanitizeName(name) != name {
+		return fmt.Errorf("invalid characters in name %q: %q", name, line)
+	}
+	if _, err := strconv.ParseFloat(fields[1], 64); err != nil {
+		return fmt.Errorf("invalid value %q: %q", fields[1], line)
+	}
+	if ts, err := strconv.ParseInt(fields[2], 10, 64); err != nil || (ts < 0 && ts != -1) {
+		return fmt.Errorf("invalid timestamp %q: %q", fields[2], line)
+	}
+	return nil
+}
+
+// validateStatsdLine is the strict check of a line that
+// statsd.ParseStatsdPacket accepted. The line must have exactly one
+// value and a type, i.e. neither a bare name (a count of 1) nor
+// several values, the name must not need sanitizing and the value
+// (unless of a set) and the sample rate must be numbers in their
+// entirety. DogStatsD tags are checked by the parser.
+func validateStatsdLine(line string) error {
+	packet := line
+	if i := strings.Index(packet, "|#"); i >= 0 {
+		packet = packet[:i]
+	}
+	parts := strings.Split(packet, ":")
+	if len(parts) != 2 {
+		return fmt.Errorf("expected name:value|type, got %d values: %q", len(parts)-1, line)
+	}
+	if misc.SanitizeName(parts[0]) != parts[0] {
+		return fmt.Errorf("invalid characters in name %q: %q", parts[0], line)
+	}
+	fields := strings.Split(parts[1], "|")
+	if len(fields) > 3 {
+		return fmt.Errorf("unexpected fields after the sample rate: %q", line)
+	}
+	if fields[1] != "s" {
+		if _, err := strconv.ParseFloat(fields[0], 64); err != nil {
+			return fmt.Errorf("invalid value %q: %q", fields[0], line)
+		}
+	}
+	if len(fields) == 3 {
+		if _, err := strconv.ParseFloat(strings.TrimPrefix(fields[2], "@"), 64); err != nil || !strings.HasPrefix(fields[2], "@") {
+			return fmt.Errorf("invalid sample rate %q: %q", fields[2], line)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bytes"
+	"net"
+)
+
+const (
+	udpBatchSize   = 16    // datagrams per read
+	udpMaxDatagram = 65535 // the largest possible
+)
+
+// readUDPBatches reads datagrams from conn, in batches where the
+// platform supports it (recvmmsg on Linux), and calls handle for
+// every one of them until a read fails. The buffers are reused,
+// handle must not keep them.
+func readUDPBatches(conn net.Conn, handle func([]byte)) error {
+	bufs := make([][]byte, udpBatchSize)
+	for i := range bufs {
+		bufs[i] = make([]byte, udpMaxDatagram)
+	}
+	sizes := make([]int, udpBatchSize)
+	read := newBatchReader(conn, bufs)
+	for {
+		n, err := read(sizes)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			handle(bufs[i][:sizes[i]])
+		}
+	}
+}
+
+// singleReader reads one datagram at a time, for where there is no
+// batched read.
+func singleReader(conn net.Conn, bufs [][]byte) func([]int) (int, error) {
+	return func(sizes []int) (int, error) {
+		n, err := conn.Read(bufs[0])
+		if err != nil {
+			return 0, err
+		}
+		sizes[0] = n
+		return 1, nil
+	}
+}
+
+// eachLine calls f for every non-empty line of a datagram.
+func eachLine(b []byte, f func(string)) {
+	for len(b) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line, b = b[:i], b[i+1:]
+		} else {
+			line, b = b, nil
+		}
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+		if len(line) > 0 {
+			f(string(line))
+		}
+	}
+}
@@ -0,0 +1,77 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr is struct mmsghdr of recvmmsg(2).
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// newBatchReader returns a function which reads up to len(bufs)
+// datagrams with one recvmmsg(2) call, waiting (in the runtime
+// poller) until at least one is available.
+func newBatchReader(conn net.Conn, bufs [][]byte) func([]int) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return singleReader(conn, bufs)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return singleReader(conn, bufs)
+	}
+
+	iovs := make([]syscall.Iovec, len(bufs))
+	msgs := make([]mmsghdr, len(bufs))
+	for i := range bufs {
+		iovs[i].Base = &bufs[i][0]
+		iovs[i].SetLen(len(bufs[i]))
+		msgs[i].hdr.Iov = &iovs[i]
+		msgs[i].hdr.Iovlen = 1
+	}
+
+	return func(sizes []int) (int, error) {
+		var (
+			n     uintptr
+			errno syscall.Errno
+		)
+		err := rc.Read(func(fd uintptr) bool {
+			for {
+				n, _, errno = syscall.Syscall6(syscall.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), 0, 0, 0)
+				if errno != syscall.EINTR {
+					break
+				}
+			}
+			return errno != syscall.EAGAIN && errno != syscall.EWOULDBLOCK // false waits
+		})
+		if err != nil {
+			return 0, err
+		}
+		if errno != 0 {
+			return 0, &net.OpError{Op: "recvmmsg", Net: conn.LocalAddr().Network(), Addr: conn.LocalAddr(), Err: errno}
+		}
+		for i := 0; i < int(n); i++ {
+			sizes[i] = int(msgs[i].len)
+		}
+		return int(n), nil
+	}
+}
@@ -0,0 +1,221 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/whisper"
+)
+
+// ImportWhisper walks a carbon whisper tree and imports every file
+// in it into the database of the config (see importWhisperFile),
+// writing the files that could not be imported and the totals to out.
+func ImportWhisper(cfgPath, dir, prefix string, out io.Writer) error {
+	cfg, db, err := initCliDb(cfgPath)
+	if err != nil {
+		return err
+	}
+	restorer, ok := db.Fetcher().(serde.DataSourceRestorer)
+	if !ok {
+		return fmt.Errorf("Importing DSs is not supported by this database")
+	}
+
+	imported, failed := 0, 0
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".wsp") {
+			return nil
+		}
+		if err := importWhisperFile(restorer, cfg, path, whisperName(dir, path, prefix)); err != nil {
+			fmt.Fprintf(out, "%s: %v\n", path, err)
+			failed++
+			return nil
+		}
+		imported++
+		if imported%1000 == 0 {
+			log.Printf("ImportWhisper(): %d files imported so far...", imported)
+		}
+		return nil
+	})
+	fmt.Fprintf(out, "%d DSs imported, %d files failed.\n", imported, failed)
+	return err
+}
+
+// whisperName is the DS name of a whisper file, its path within the
+// tree with dots rather than slashes, e.g. "foo/bar.wsp" is
+// "foo.bar", with the prefix, if any.
+func whisperName(dir, path, prefix string) string {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		rel = path
+	}
+	name := strings.Replace(strings.TrimSuffix(rel, ".wsp"), string(filepath.Separator), ".", -1)
+	if prefix != "" {
+		name = strings.TrimSuffix(prefix, ".") + "." + name
+	}
+	return name
+}
+
+// importWhisperFile imports a whisper file into the DS of name,
+// creating it with RRAs equivalent to the archives of the file and
+// the heartbeat and type of the ds spec of the config matching the
+// name, if any. Data points of an existing DS are kept, the import
+// only fills the slots without one, so that a DS can be fed by tgres
+// before its history is imported.
+func importWhisperFile(db serde.DataSourceRestorer, cfg *Config, path, name string) error {
+	wsp, err := whisper.Open(path)
+	if err != nil {
+		return err
+	}
+	defer wsp.Close()
+
+	ident := serde.Ident{"name": name}
+	dft := cfg.FindMatchingDSSpec(ident)
+	if dft == nil {
+		dft = receiver.DftDSSPec
+	}
+	spec, err := wsp.Spec(dft.Heartbeat)
+	if err != nil {
+		return err
+	}
+	spec.Type = dft.Type
+	srcs, last, err := wsp.RRAs(spec)
+	if err != nil {
+		return err
+	}
+	spec.LastUpdate = last
+	return serde.ImportDataSource(db, ident, spec, srcs, false)
+}
+
+// ExportWhisper writes the DSs whose names match glob from the
+// database of the config to whisper files in a tree under dir (see
+// whisper.Create), e.g. "foo.bar" to dir/foo/bar.wsp, and writes the
+// files to out. Only the name of an ident is kept, DSs which differ
+// only by other fields end up in the same file, the last one wins.
+func ExportWhisper(cfgPath, glob, dir string, out io.Writer) error {
+	n, err := exportDataSources(cfgPath, glob, func(ident serde.Ident, rras []rrd.RoundRobinArchiver) error {
+		name := ident["name"]
+		if strings.Contains(name, "..") || strings.ContainsRune(name, filepath.Separator) {
+			return fmt.Errorf("%q cannot be a whisper path", name)
+		}
+		path := filepath.Join(dir, strings.Replace(name, ".", string(filepath.Separator), -1)+".wsp")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := whisper.Create(path, rras); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		fmt.Fprintf(out, "%s\n", path)
+		return nil
+	})
+	fmt.Fprintf(out, "%d DSs exported.\n", n)
+	return err
+}
+
+// exportDataSources calls fn with every DS whose name matches glob in
+// the database of the config and its RRAs with their data points,
+// and returns how many there were.
+func exportDataSources(cfgPath, glob string, fn func(serde.Ident, []rrd.RoundRobinArchiver) error) (int, error) {
+	if glob == "" {
+		return 0, fmt.Errorf("A glob is required")
+	}
+	_, db, err := initCliDb(cfgPath)
+	if err != nil {
+		return 0, err
+	}
+	dumper, ok := db.Fetcher().(serde.DataSourceDumper)
+	if !ok {
+		return 0, fmt.Errorf("Exporting DSs is not supported by this database")
+	}
+	selected, err := serde.SelectDataSources(dumper, serde.DeleteQuery{Glob: glob})
+	if err != nil {
+		return 0, err
+	}
+	ids := make([]int64, 0, len(selected))
+	for id := range selected {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	n := 0
+	for _, id := range ids {
+		ds, err := dumper.FetchOrCreateDataSource(selected[id], nil)
+		if err != nil {
+			return n, err
+		}
+		if ds == nil {
+			continue // deleted since
+		}
+		rras := make([]rrd.RoundRobinArchiver, 0, len(ds.RRAs()))
+		for _, rra := range ds.RRAs() {
+			loaded, err := dumper.LoadRRAData(rra)
+			if err != nil {
+				return n, err
+			}
+			rras = append(rras, loaded)
+		}
+		if err := fn(selected[id], rras); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// graphitePoints returns the data points of the RRAs from after from
+// up to until (either zero is unbounded) as Graphite would have them,
+// i.e. timestamped with the beginning of the slot, in time order. The
+// points of the finest RRA come first, those of a coarser one only
+// where the finer ones do not reach.
+func graphitePoints(rras []rrd.RoundRobinArchiver, from, until time.Time) []whisper.Point {
+	rras = append([]rrd.RoundRobinArchiver(nil), rras...)
+	sort.SliceStable(rras, func(i, j int) bool { return rras[i].Step() < rras[j].Step() })
+
+	var (
+		result  []whisper.Point
+		covered time.Time // the finer RRAs have what is after it
+	)
+	for _, rra := range rras {
+		if rra.Latest().IsZero() {
+			continue
+		}
+		for i, v := range rra.DPs() {
+			end := rrd.SlotTime(i, rra.Latest(), rra.Step(), rra.Size())
+			if (!from.IsZero() && !end.After(from)) || (!until.IsZero() && end.After(until)) || (!covered.IsZero() && end.After(covered)) {
+				continue
+			}
+			result = append(result, whisper.Point{Timestamp: uint32(end.Add(-rra.Step()).Unix()), Value: v})
+		}
+		if begins := rra.Latest().Add(-time.Duration(rra.Size()) * rra.Step()); covered.IsZero() || begins.Before(covered) {
+			covered = begins
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Timestamp < result[j].Timestamp })
+	return result
+}
@@ -284,6 +284,38 @@ func (d *dsLRU) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints in
 	return s, nil
 }
 
+// FetchSeriesBatch is FetchSeries of many DSs, the ones not in the
+// cache are fetched from the db in one batch.
+func (d *dsLRU) FetchSeriesBatch(dss []rrd.DataSourcer, from, to time.Time, maxPoints int64) ([]series.Series, error) {
+	var (
+		result = make([]series.Series, len(dss))
+		dbDss  []rrd.DataSourcer
+		dbIdx  []int
+	)
+	for i, ds := range dss {
+		if _, ok := ds.(*watchedDs); ok {
+			s, err := d.FetchSeries(ds, from, to, maxPoints)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = s
+			continue
+		}
+		dbDss = append(dbDss, ds)
+		dbIdx = append(dbIdx, i)
+	}
+	if len(dbDss) > 0 {
+		sers, err := serde.FetchSeriesBatch(d.db, dbDss, from, to, maxPoints)
+		if err != nil {
+			return nil, err
+		}
+		for i, s := range sers {
+			result[dbIdx[i]] = s
+		}
+	}
+	return result, nil
+}
+
 type watchedDs struct {
 	rrd.DataSourcer
 	*sync.RWMutex
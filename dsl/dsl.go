@@ -55,6 +55,9 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
 )
 
 type dslCtx struct {
@@ -62,21 +65,30 @@ type dslCtx struct {
 	escSrc    string
 	from, to  time.Time
 	maxPoints int64
+	loc       *time.Location // render-level timezone, nil if not specified
 	ctxDSFetcher
 }
 
 // Parse a DSL expression given by src and other params.
 func ParseDsl(db ctxDSFetcher, src string, from, to time.Time, maxPoints int64) (SeriesMap, error) {
-	return newDslCtx(db, src, from, to, maxPoints).parse()
+	return newDslCtx(db, src, from, to, maxPoints, nil).parse()
+}
+
+// Same as ParseDsl, but with a timezone which time-based functions
+// such as summarize() will use to align their buckets. A nil loc is
+// the same as ParseDsl().
+func ParseDslTz(db ctxDSFetcher, src string, from, to time.Time, maxPoints int64, loc *time.Location) (SeriesMap, error) {
+	return newDslCtx(db, src, from, to, maxPoints, loc).parse()
 }
 
-func newDslCtx(db ctxDSFetcher, src string, from, to time.Time, maxPoints int64) *dslCtx {
+func newDslCtx(db ctxDSFetcher, src string, from, to time.Time, maxPoints int64, loc *time.Location) *dslCtx {
 	return &dslCtx{
 		src:          src,
 		escSrc:       fixBackSlashes(fixQuotes(escapeBadChars(src))),
 		from:         from,
 		to:           to,
 		maxPoints:    maxPoints,
+		loc:          loc,
 		ctxDSFetcher: db}
 }
 
@@ -113,7 +125,10 @@ func (dc *dslCtx) seriesFromSeriesOrIdent(what interface{}) (SeriesMap, error) {
 
 func (dc *dslCtx) seriesFromPattern(pattern string, from, to time.Time) (SeriesMap, error) {
 	idents := dc.identsFromPattern(pattern)
-	result := make(SeriesMap)
+	var (
+		names []string
+		dss   []rrd.DataSourcer
+	)
 	for name, ident := range idents {
 		ds, err := dc.FetchOrCreateDataSource(ident, nil)
 		if err != nil {
@@ -124,11 +139,17 @@ func (dc *dslCtx) seriesFromPattern(pattern string, from, to time.Time) (SeriesM
 			// TODO: The DSL should support warnings, this is a good case for it
 			continue
 		}
-		dps, err := dc.FetchSeries(ds, from, to, dc.maxPoints)
-		if err != nil {
-			return nil, fmt.Errorf("seriesFromPattern(): Error %v", err)
-		}
-		result[name] = &aliasSeries{Series: dps}
+		names = append(names, name)
+		dss = append(dss, ds)
+	}
+	// A wildcard can be hundreds of series, fetch them in one batch
+	sers, err := serde.FetchSeriesBatch(dc.ctxDSFetcher, dss, from, to, dc.maxPoints)
+	if err != nil {
+		return nil, fmt.Errorf("seriesFromPattern(): Error %v", err)
+	}
+	result := make(SeriesMap, len(sers))
+	for i, dps := range sers {
+		result[names[i]] = &aliasSeries{Series: dps}
 	}
 	return result, nil
 }
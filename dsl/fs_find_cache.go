@@ -36,13 +36,18 @@ type fsFindCache struct {
 	*fsFindNode
 }
 
+// FsFindIncludeArchived makes wildcards match archived DSs. Archived
+// DSs are always found by their exact name.
+var FsFindIncludeArchived bool
+
 type fsFindNode struct {
-	ident serde.Ident // leaf node
-	name  string      // my dot.name
-	names map[string]*fsFindNode
+	ident    serde.Ident // leaf node
+	archived bool        // leaf DS is archived
+	name     string      // my dot.name
+	names    map[string]*fsFindNode
 }
 
-func (n *fsFindNode) insert(parts []string, pos int, ident serde.Ident) {
+func (n *fsFindNode) insert(parts []string, pos int, ident serde.Ident, archived bool) {
 	if pos >= len(parts) {
 		return
 	}
@@ -61,10 +66,38 @@ func (n *fsFindNode) insert(parts []string, pos int, ident serde.Ident) {
 	// in theory there shouldn't be anyhting wrong with that, though
 	// Grafana doesn't deal with it very well..
 	if pos < len(parts)-1 {
-		node.insert(parts, pos+1, ident)
+		node.insert(parts, pos+1, ident, archived)
 	} else {
 		node.ident = ident
+		node.archived = archived
+	}
+}
+
+// remove clears the leaf of the name parts and prunes the nodes left
+// with neither a leaf nor children. It returns true if this node is
+// to be pruned.
+func (n *fsFindNode) remove(parts []string, pos int) bool {
+	if pos >= len(parts) {
+		n.ident = nil
+		n.archived = false
+	} else if node, ok := n.names[parts[pos]]; ok && node.remove(parts, pos+1) {
+		delete(n.names, parts[pos])
+	}
+	return n.ident == nil && len(n.names) == 0
+}
+
+// live returns true if this node or any of its descendants is a leaf
+// that is not archived.
+func (n *fsFindNode) live() bool {
+	if n.ident != nil && !n.archived {
+		return true
+	}
+	for _, child := range n.names {
+		if child.live() {
+			return true
+		}
 	}
+	return false
 }
 
 func (n *fsFindNode) empty() bool {
@@ -75,12 +108,18 @@ func (n *fsFindNode) search(pattern, key string, result map[string]*FsFindNode)
 
 	parts := strings.SplitN(pattern, ".", 2)
 	prefix := parts[0]
+	wild := !FsFindIncludeArchived && strings.ContainsAny(prefix, "*?[")
 
 	for k, child := range n.names {
 		if yes, _ := filepath.Match(prefix, k); yes {
 
 			parent := len(child.names) > 0
 			leaf := child.ident != nil
+			if wild {
+				// archived DSs are left out of wildcard expansion
+				parent = parent && child.live()
+				leaf = leaf && !child.archived
+			}
 
 			if parent {
 				if len(parts) > 1 {
@@ -97,16 +136,32 @@ func (n *fsFindNode) search(pattern, key string, result map[string]*FsFindNode)
 	}
 }
 
-func (f *fsFindCache) insert(ident serde.Ident) error {
+func (f *fsFindCache) insert(ident serde.Ident, archived bool) error {
 	if name := ident[f.key]; name != "" {
 		parts := strings.Split(name, ".")
-		f.fsFindNode.insert(parts, 0, ident)
+		f.fsFindNode.insert(parts, 0, ident, archived)
 	} else {
 		return fmt.Errorf("insert: '%s' tag missing for DS ident: %s", f.key, ident.String())
 	}
 	return nil
 }
 
+// add inserts a single DS, e.g. one just created.
+func (dsns *fsFindCache) add(ident serde.Ident) error {
+	dsns.Lock()
+	defer dsns.Unlock()
+	return dsns.insert(ident, false)
+}
+
+// remove removes a single DS, e.g. one just deleted.
+func (dsns *fsFindCache) remove(ident serde.Ident) {
+	if name := ident[dsns.key]; name != "" {
+		dsns.Lock()
+		defer dsns.Unlock()
+		dsns.fsFindNode.remove(strings.Split(name, "."), 0)
+	}
+}
+
 type FsFindNode struct {
 	Name       string
 	Leaf       bool
@@ -114,6 +169,9 @@ type FsFindNode struct {
 	ident      serde.Ident
 }
 
+// Ident is the ident of a leaf node, nil otherwise.
+func (n *FsFindNode) Ident() serde.Ident { return n.ident }
+
 type fsNodes []*FsFindNode
 
 // sort.Interface
@@ -149,8 +207,10 @@ func (dsns *fsFindCache) reload() error {
 	dsns.Lock()
 	defer dsns.Unlock()
 
+	asr, _ := sr.(serde.ArchivedSearchResult)
 	for sr.Next() {
-		if err := dsns.insert(sr.Ident()); err != nil {
+		archived := asr != nil && asr.Archived()
+		if err := dsns.insert(sr.Ident(), archived); err != nil {
 			return err
 		}
 	}
@@ -109,6 +109,10 @@ var preprocessArgFuncs = funcMap{
 		argDef{"maxValue", argNumber, math.NaN()}}},
 	"integral": dslFuncType{dslIntegral, false, []argDef{
 		argDef{"seriesList", argSeries, nil}}},
+	"integralByInterval": dslFuncType{dslIntegralByInterval, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"intervalUnit", argString, nil},
+		argDef{"tz", argString, ""}}},
 	"logarithm": dslFuncType{dslLogarithm, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"base", argNumber, 10.0}}},
@@ -205,10 +209,11 @@ var preprocessArgFuncs = funcMap{
 		argDef{"value", argNumber, nil}}},
 	"countSeries": dslFuncType{dslCountSeries, true, []argDef{
 		argDef{"seriesList", argSeries, nil}}},
-	"hitcount": dslFuncType{dslHitcount, true, []argDef{
+	"hitcount": dslFuncType{dslHitcount, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"intervalString", argString, nil},
-		argDef{"alignToInterval", argBool, "false"}}},
+		argDef{"alignToInterval", argBool, "false"},
+		argDef{"tz", argString, ""}}},
 	"keepLastValue": dslFuncType{dslKeepLastValue, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"limit", argNumber, 0.0}}},
@@ -229,11 +234,12 @@ var preprocessArgFuncs = funcMap{
 	"consolidateBy": dslFuncType{dslConsolidateBy, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"consolidationFunc", argString, nil}}},
-	"summarize": dslFuncType{dslSummarize, true, []argDef{
+	"summarize": dslFuncType{dslSummarize, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"intervalString", argString, nil},
 		argDef{"func", argString, "sum"},
-		argDef{"alignToFrom", argBool, "false"}}},
+		argDef{"alignToFrom", argBool, "false"},
+		argDef{"tz", argString, ""}}},
 	"holtWintersForecast": dslFuncType{dslHoltWintersForecast, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"seasonLen", argString, "1d"},
@@ -272,6 +278,7 @@ var preprocessArgFuncs = funcMap{
 	// ++ derivative()
 	// ++ hitcount()
 	// ++ integral()
+	// ++ integralByInterval()
 	// ++ log()
 	// ++ nonNegativeDerivative
 	// ++ offset
@@ -507,6 +514,7 @@ func callPreprocessArgFunc(dc *dslCtx, name string, argFunc *dslFuncType,
 	argMap["_from_"] = dc.from
 	argMap["_to_"] = dc.to
 	argMap["_maxPoints_"] = dc.maxPoints
+	argMap["_tz_"] = dc.loc
 	if series, err := argFunc.call(argMap); err == nil {
 		return series, nil
 	} else {
@@ -2132,7 +2140,9 @@ func dslCountSeries(args map[string]interface{}) (SeriesMap, error) {
 
 // hitCount()
 // This really boils down to Sum(Scale())
-// alignToInterval is ignored because I think we sort of do that anyway
+// alignToInterval is ignored because I think we sort of do that anyway.
+// If a timezone is given (or set at render level), the points are
+// actually summed into buckets aligned to that timezone's midnight.
 
 type seriesHitcount struct {
 	AliasSeries
@@ -2153,9 +2163,18 @@ func dslHitcount(args map[string]interface{}) (SeriesMap, error) {
 	}
 	factor := dur.Seconds()
 
+	loc, err := argLocation(args)
+	if err != nil {
+		return nil, err
+	}
+
 	for name, s := range series {
 		s.Alias(fmt.Sprintf("hitcount(%v,%v)", name, factor))
-		series[name] = &seriesHitcount{s, factor}
+		if loc != nil {
+			series[name] = newSeriesBuckets(s, dur, loc, "sum", true)
+		} else {
+			series[name] = &seriesHitcount{s, factor}
+		}
 	}
 	return series, nil
 }
@@ -2301,6 +2320,29 @@ func dslSummarize(args map[string]interface{}) (SeriesMap, error) {
 	is := args["intervalString"].(string)
 	fname := args["func"].(string)
 
+	loc, err := argLocation(args)
+	if err != nil {
+		return nil, err
+	}
+	if loc != nil {
+		// With a timezone we do real bucketing, the alignToFrom
+		// argument is ignored since buckets align on the midnight.
+		dur, err := misc.BetterParseDuration(is)
+		if err != nil {
+			return nil, err
+		}
+		switch fname {
+		case "sum", "avg", "max", "min", "last":
+		default:
+			return nil, fmt.Errorf("unsupported func: %q", fname)
+		}
+		for name, s := range series {
+			s.Alias(fmt.Sprintf("summarize(%v,%v,%v)", name, is, fname))
+			series[name] = newSeriesBuckets(s, dur, loc, fname, fname == "sum")
+		}
+		return series, nil
+	}
+
 	var factor float64
 	if fname == "sum" {
 		dur, err := misc.BetterParseDuration(is)
@@ -2323,6 +2365,215 @@ func dslSummarize(args map[string]interface{}) (SeriesMap, error) {
 	return series, nil
 }
 
+// integralByInterval()
+// Like integral(), but the total is reset at the beginning of every
+// intervalUnit, aligned to the timezone midnight (UTC by default).
+
+type seriesIntegralByInterval struct {
+	AliasSeries
+	interval time.Duration
+	loc      *time.Location
+	bucket   time.Time
+	total    float64
+}
+
+func (f *seriesIntegralByInterval) Next() bool {
+	if !f.AliasSeries.Next() {
+		return false
+	}
+	start := bucketStart(f.AliasSeries.CurrentTime().Add(-f.AliasSeries.Step()), f.interval, f.loc)
+	if !start.Equal(f.bucket) {
+		f.bucket, f.total = start, 0
+	}
+	if value := f.AliasSeries.CurrentValue(); !math.IsNaN(value) {
+		f.total += value
+	}
+	return true
+}
+
+func (f *seriesIntegralByInterval) CurrentValue() float64 {
+	return f.total
+}
+
+func (f *seriesIntegralByInterval) Close() error {
+	f.bucket, f.total = time.Time{}, 0
+	return f.AliasSeries.Close()
+}
+
+func dslIntegralByInterval(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	is := args["intervalUnit"].(string)
+
+	dur, err := misc.BetterParseDuration(is)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := argLocation(args)
+	if err != nil {
+		return nil, err
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	for name, s := range series {
+		s.Alias(fmt.Sprintf("integralByInterval(%v,%v)", name, is))
+		series[name] = &seriesIntegralByInterval{AliasSeries: s, interval: dur, loc: loc}
+	}
+	return series, nil
+}
+
+// Timezone-aware bucketing used by summarize(), hitcount() and
+// integralByInterval().
+
+// argLocation returns the location specified by the "tz" argument,
+// or, if that is blank, the render-level timezone. Returns nil if
+// neither was specified.
+func argLocation(args map[string]interface{}) (*time.Location, error) {
+	if tz, _ := args["tz"].(string); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tz: %v", err)
+		}
+		return loc, nil
+	}
+	loc, _ := args["_tz_"].(*time.Location)
+	return loc, nil
+}
+
+const day = 24 * time.Hour
+
+// bucketStart returns the beginning of the bucket to which t
+// belongs. Buckets are aligned on the midnight in loc. Intervals that
+// are a multiple of a day are counted in calendar days (which is
+// what makes DST transitions work: such a day is 23 or 25 hours),
+// smaller intervals are counted from the midnight of the day
+// containing t, with the last bucket of a day cut short by the next
+// midnight if the interval does not divide the day evenly.
+func bucketStart(t time.Time, interval time.Duration, loc *time.Location) time.Time {
+	t = t.In(loc)
+	y, m, d := t.Date()
+	if interval >= day && interval%day == 0 {
+		ndays := int64(interval / day)
+		// days since epoch are counted in UTC so as to avoid DST
+		days := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400
+		off := days % ndays
+		if off < 0 {
+			off += ndays
+		}
+		return time.Date(y, m, d-int(off), 0, 0, 0, 0, loc)
+	}
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	return midnight.Add(t.Sub(midnight) / interval * interval)
+}
+
+// bucketEnd returns the end of the bucket that begins at start (as
+// returned by bucketStart()).
+func bucketEnd(start time.Time, interval time.Duration, loc *time.Location) time.Time {
+	start = start.In(loc)
+	y, m, d := start.Date()
+	if interval >= day && interval%day == 0 {
+		return time.Date(y, m, d+int(interval/day), 0, 0, 0, 0, loc)
+	}
+	end := start.Add(interval)
+	if next := time.Date(y, m, d+1, 0, 0, 0, 0, loc); end.After(next) {
+		end = next
+	}
+	return end
+}
+
+type seriesBuckets struct {
+	AliasSeries
+	interval time.Duration
+	loc      *time.Location
+	fn       string
+	perSec   bool // values are rates, multiply by step
+	value    float64
+	end      time.Time
+	pending  bool // underlying series is on the first point of the next bucket
+	done     bool
+}
+
+func newSeriesBuckets(s AliasSeries, interval time.Duration, loc *time.Location, fn string, perSec bool) *seriesBuckets {
+	return &seriesBuckets{AliasSeries: s, interval: interval, loc: loc, fn: fn, perSec: perSec, value: math.NaN()}
+}
+
+func (f *seriesBuckets) Next() bool {
+	if f.done {
+		return false
+	}
+	if !f.pending {
+		if !f.AliasSeries.Next() {
+			f.done = true
+			return false
+		}
+	}
+	f.pending = false
+
+	step := f.AliasSeries.Step()
+	start := bucketStart(f.AliasSeries.CurrentTime().Add(-step), f.interval, f.loc)
+	f.end = bucketEnd(start, f.interval, f.loc)
+
+	var (
+		sum, count float64
+		min, max   = math.Inf(1), math.Inf(-1)
+		last       = math.NaN()
+	)
+	for {
+		if v := f.AliasSeries.CurrentValue(); !math.IsNaN(v) {
+			if f.perSec {
+				v *= step.Seconds()
+			}
+			sum += v
+			count++
+			min, max, last = math.Min(min, v), math.Max(max, v), v
+		}
+		if !f.AliasSeries.Next() {
+			f.done = true
+			break
+		}
+		if !f.AliasSeries.CurrentTime().Add(-step).Before(f.end) {
+			f.pending = true
+			break
+		}
+	}
+
+	f.value = math.NaN()
+	if count > 0 {
+		switch f.fn {
+		case "sum":
+			f.value = sum
+		case "avg":
+			f.value = sum / count
+		case "max":
+			f.value = max
+		case "min":
+			f.value = min
+		case "last":
+			f.value = last
+		}
+	}
+	return true
+}
+
+func (f *seriesBuckets) CurrentValue() float64 {
+	return f.value
+}
+
+// Internally we mark ends of slots, not beginnings
+func (f *seriesBuckets) CurrentTime() time.Time {
+	return f.end
+}
+
+func (f *seriesBuckets) Step() time.Duration {
+	return f.interval
+}
+
+func (f *seriesBuckets) Close() error {
+	f.value, f.end, f.pending, f.done = math.NaN(), time.Time{}, false, false
+	return f.AliasSeries.Close()
+}
+
 // timeStack
 func dslTimeStack(dc *dslCtx, args []interface{}) (SeriesMap, error) {
 
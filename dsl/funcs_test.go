@@ -1022,3 +1022,118 @@ func Test_dsl_summarize(t *testing.T) {
 		t.Errorf("Unexpected value: %v", unexpected)
 	}
 }
+
+// bucketStart, bucketEnd
+func Test_dsl_bucketStartEnd(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	// 2017-03-12 is a 23 hour day in New York (DST begins)
+	dst := time.Date(2017, 3, 12, 15, 30, 0, 0, loc)
+	start := bucketStart(dst, 24*time.Hour, loc)
+	if !start.Equal(time.Date(2017, 3, 12, 0, 0, 0, 0, loc)) {
+		t.Errorf("bucketStart: unexpected start: %v", start)
+	}
+	end := bucketEnd(start, 24*time.Hour, loc)
+	if !end.Equal(time.Date(2017, 3, 13, 0, 0, 0, 0, loc)) {
+		t.Errorf("bucketEnd: unexpected end: %v", end)
+	}
+	if end.Sub(start) != 23*time.Hour {
+		t.Errorf("bucketEnd: expected a 23h bucket, got %v", end.Sub(start))
+	}
+
+	// 5h does not divide the day evenly, the last bucket of the
+	// day is cut short by the midnight
+	start = bucketStart(time.Date(2017, 3, 16, 22, 0, 0, 0, loc), 5*time.Hour, loc)
+	if !start.Equal(time.Date(2017, 3, 16, 20, 0, 0, 0, loc)) {
+		t.Errorf("bucketStart: unexpected start: %v", start)
+	}
+	end = bucketEnd(start, 5*time.Hour, loc)
+	if !end.Equal(time.Date(2017, 3, 17, 0, 0, 0, 0, loc)) {
+		t.Errorf("bucketEnd: unexpected end: %v", end)
+	}
+}
+
+// summarize, hitcount, integralByInterval with tz
+func Test_dsl_tzBuckets(t *testing.T) {
+	td := setupTestData()
+
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	latest := time.Date(2017, 3, 17, 0, 0, 0, 0, loc)
+	rspec := rrd.RRASpec{
+		Function: rrd.WMEAN,
+		Step:     time.Hour,
+		Span:     72 * time.Hour,
+		Latest:   latest,
+	}
+	size := rspec.Span.Nanoseconds() / rspec.Step.Nanoseconds()
+
+	spec := &rrd.DSSpec{
+		Step: time.Second,
+		RRAs: []rrd.RRASpec{rspec},
+	}
+
+	spec.RRAs[0].DPs = make(map[int64]float64)
+	for i := int64(0); i < size; i++ {
+		spec.RRAs[0].DPs[i] = 1
+	}
+
+	if _, err = td.db.FetchOrCreateDataSource(serde.Ident{"name": "foo.bar.tz"}, spec); err != nil {
+		t.Error(err)
+	}
+
+	from, to := latest.Add(-48*time.Hour), latest
+
+	for _, expr := range []string{
+		`summarize("foo.bar.tz", "24h", "sum")`,
+		`hitcount("foo.bar.tz", "24h")`,
+	} {
+		sm, err := ParseDslTz(td.rcache, expr, from, to, 100, loc)
+		if err != nil {
+			t.Error(err)
+		}
+		for _, s := range sm {
+			n := 0
+			for s.Next() {
+				if !s.CurrentTime().Equal(bucketEnd(bucketStart(s.CurrentTime().Add(-time.Nanosecond), 24*time.Hour, loc), 24*time.Hour, loc)) {
+					t.Errorf("%s: bucket not aligned on midnight: %v", expr, s.CurrentTime().In(loc))
+				}
+				if v := s.CurrentValue(); !math.IsNaN(v) && v != 86400 && n > 0 {
+					t.Errorf("%s: unexpected value: %v (expected 86400)", expr, v)
+				}
+				n++
+			}
+			if n == 0 {
+				t.Errorf("%s: no buckets", expr)
+			}
+		}
+	}
+
+	// per-function tz overrides render-level (none here)
+	sm, err := ParseDsl(td.rcache, `integralByInterval("foo.bar.tz", "24h", "tz=America/New_York")`, from, to, 100)
+	if err != nil {
+		t.Error(err)
+	}
+	for _, s := range sm {
+		last := 0.0
+		for s.Next() {
+			v := s.CurrentValue()
+			if s.CurrentTime().In(loc).Hour() == 1 && v != 1 {
+				t.Errorf("integralByInterval: expected reset at midnight, got %v at %v", v, s.CurrentTime().In(loc))
+			} else if s.CurrentTime().In(loc).Hour() != 1 && v != last+1 {
+				t.Errorf("integralByInterval: unexpected value %v at %v (last %v)", v, s.CurrentTime().In(loc), last)
+			}
+			last = v
+		}
+	}
+
+	if _, err := ParseDsl(nil, "summarize(constantLine(10), '1min', sum, 'tz=Nowhere/Special')", td.from, td.to, 100); err == nil {
+		t.Errorf("summarize: expected an error for an invalid tz")
+	}
+}
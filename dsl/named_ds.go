@@ -16,6 +16,7 @@
 package dsl
 
 import (
+	"log"
 	"sync"
 	"time"
 
@@ -30,6 +31,7 @@ import (
 type NamedDSFetcher interface {
 	dsFetcher
 	fsFinder
+	Forget(idents []serde.Ident)
 }
 
 type fsFinder interface {
@@ -69,6 +71,8 @@ type namedDsFetcher struct {
 	dsns       *fsFindCache
 	lastReload time.Time
 	minAge     time.Duration
+	remoteMu   sync.RWMutex
+	remote     RemoteFetcher // nil is none, see SetRemote
 }
 
 type watcher interface {
@@ -131,6 +135,70 @@ func (r *namedDsFetcher) FsFind(pattern string) []*FsFindNode {
 	return result
 }
 
+// How often the names are reloaded if the db notifies of created
+// DSs, a safety net for notifications lost, e.g. while reconnecting.
+const notifiedMinAge = 15 * time.Minute
+
+// Listen registers with the db to learn of DSs created, deleted and
+// renamed by any client of the database, e.g. other cluster nodes, as
+// they happen. With notifications of created DSs the names are
+// reloaded far less often. It is fine to call with a db which
+// notifies of nothing.
+func (r *namedDsFetcher) Listen(el serde.EventListener) {
+	if el == nil {
+		return
+	}
+	gone := func(ident serde.Ident) {
+		if r.dsLRU.Cache != nil {
+			r.dsLRU.Remove(ident.String())
+		}
+		r.dsns.remove(ident)
+	}
+	if err := el.RegisterDeleteListener(gone); err != nil {
+		log.Printf("namedDsFetcher: error registering the delete listener: %v", err)
+	}
+	if rl, ok := el.(serde.RenameEventListener); ok {
+		if err := rl.RegisterRenameListener(func(ident serde.Ident) {
+			gone(ident)
+			go r.reloadNames() // only the old ident is known
+		}); err != nil {
+			log.Printf("namedDsFetcher: error registering the rename listener: %v", err)
+		}
+	}
+	if cl, ok := el.(serde.CreateEventListener); ok {
+		if err := cl.RegisterCreateListener(func(ident serde.Ident) {
+			if err := r.dsns.add(ident); err != nil {
+				log.Printf("namedDsFetcher: %v", err)
+			}
+		}); err != nil {
+			log.Printf("namedDsFetcher: error registering the create listener: %v", err)
+			return
+		}
+		r.Lock()
+		r.minAge = notifiedMinAge
+		r.Unlock()
+	}
+}
+
+// Forget drops deleted DSs from the LRU and the names and reloads the
+// names so that they are no longer found.
+func (r *namedDsFetcher) Forget(idents []serde.Ident) {
+	for _, ident := range idents {
+		if r.dsLRU.Cache != nil {
+			r.dsLRU.Remove(ident.String())
+		}
+		r.dsns.remove(ident)
+	}
+	r.reloadNames()
+}
+
+func (r *namedDsFetcher) reloadNames() {
+	r.Lock()
+	r.dsns.reload()
+	r.lastReload = time.Now()
+	r.Unlock()
+}
+
 type NamedDsFetcherStats struct {
 	LruEvictions int
 	LruSize      int
@@ -0,0 +1,164 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/series"
+)
+
+type fakeEventListener struct {
+	deleted, renamed, created func(serde.Ident)
+}
+
+func (f *fakeEventListener) RegisterDeleteListener(h func(serde.Ident)) error {
+	f.deleted = h
+	return nil
+}
+
+func (f *fakeEventListener) RegisterRenameListener(h func(serde.Ident)) error {
+	f.renamed = h
+	return nil
+}
+
+func (f *fakeEventListener) RegisterCreateListener(h func(serde.Ident)) error {
+	f.created = h
+	return nil
+}
+
+func Test_namedDsFetcher_Listen(t *testing.T) {
+	rcache := NewNamedDSFetcherMap(map[string]rrd.DataSourcer{"foo.bar": nil})
+	rcache.Preload()
+
+	el := &fakeEventListener{}
+	rcache.Listen(el)
+	if el.deleted == nil || el.renamed == nil || el.created == nil {
+		t.Fatalf("Listen: expected all listeners registered")
+	}
+	if rcache.minAge != notifiedMinAge {
+		t.Errorf("Listen: expected minAge %v, got %v", notifiedMinAge, rcache.minAge)
+	}
+
+	// created by another node
+	el.created(serde.Ident{"name": "foo.baz.qux"})
+	if idents := rcache.identsFromPattern("foo.baz.qux"); len(idents) != 1 {
+		t.Errorf("created: expected foo.baz.qux to be found, got %v", idents)
+	}
+
+	// deleted, the now empty foo.baz is pruned
+	el.deleted(serde.Ident{"name": "foo.baz.qux"})
+	if idents := rcache.identsFromPattern("foo.baz.qux"); len(idents) != 0 {
+		t.Errorf("deleted: expected foo.baz.qux to be gone, got %v", idents)
+	}
+	if nodes := rcache.FsFind("foo.*"); len(nodes) != 1 || nodes[0].Name != "foo.bar" {
+		t.Errorf("deleted: expected only foo.bar, got %v", nodes)
+	}
+
+	// a nil listener is fine
+	rcache = NewNamedDSFetcherMap(nil)
+	rcache.Listen(nil)
+	if rcache.minAge != time.Minute {
+		t.Errorf("Listen(nil): expected the default minAge, got %v", rcache.minAge)
+	}
+}
+
+func Test_fsFindNode_remove(t *testing.T) {
+	root := &fsFindNode{}
+	root.insert([]string{"a", "b", "c"}, 0, serde.Ident{"name": "a.b.c"}, false)
+	root.insert([]string{"a", "b"}, 0, serde.Ident{"name": "a.b"}, false)
+
+	root.remove([]string{"a", "b", "c"}, 0)
+	if b := root.names["a"].names["b"]; b == nil || b.ident == nil || len(b.names) != 0 {
+		t.Errorf("remove: expected the leaf a.b to stay without children, got %#v", b)
+	}
+	root.remove([]string{"x", "y"}, 0) // not there
+	root.remove([]string{"a", "b"}, 0)
+	if !root.empty() {
+		t.Errorf("remove: expected an empty tree, got %v", root.names)
+	}
+}
+
+// remoteDb has DSs foo.a (id 1) and foo.b (id 2), the value of the
+// points of which is 1.
+type remoteDb struct{ mapCache }
+
+func (remoteDb) FetchOrCreateDataSource(ident serde.Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	spec := rrd.DSSpec{Step: time.Second, RRAs: []rrd.RRASpec{{Function: rrd.WMEAN, Step: time.Second, Span: time.Minute}}}
+	return serde.NewDbDataSource(map[string]int64{"foo.a": 1, "foo.b": 2}[ident["name"]], ident, 0, 0, rrd.NewDataSource(spec)), nil
+}
+
+func (remoteDb) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	return series.NewSliceSeries([]float64{1}, from, time.Second), nil
+}
+
+// fakeRemote says node b owns id 2, the value of its points is 2.
+type fakeRemote struct {
+	fail   bool
+	idents []serde.Ident
+}
+
+func (f *fakeRemote) Owner(id int64) string {
+	if id == 2 {
+		return "b"
+	}
+	return ""
+}
+
+func (f *fakeRemote) FetchRemoteSeries(node string, idents []serde.Ident, from, to time.Time, maxPoints int64) ([]series.Series, error) {
+	f.idents = append(f.idents, idents...)
+	if f.fail {
+		return nil, fmt.Errorf("node %s is down", node)
+	}
+	return []series.Series{series.NewSliceSeries([]float64{2}, from, time.Second)}, nil
+}
+
+func Test_namedDsFetcher_SetRemote(t *testing.T) {
+	rcache := NewNamedDSFetcher(remoteDb{make(mapCache)}, nil, 0)
+	remote := &fakeRemote{}
+	rcache.SetRemote(remote)
+
+	values := func() string {
+		var dss []rrd.DataSourcer
+		for _, name := range []string{"foo.a", "foo.b"} {
+			ds, _ := rcache.FetchOrCreateDataSource(serde.Ident{"name": name}, nil)
+			dss = append(dss, ds)
+		}
+		sers, err := serde.FetchSeriesBatch(rcache, dss, time.Unix(1000, 0), time.Unix(2000, 0), 10)
+		if err != nil {
+			t.Fatalf("FetchSeriesBatch: %v", err)
+		}
+		var result []string
+		for _, s := range sers {
+			s.Next()
+			result = append(result, fmt.Sprint(s.CurrentValue()))
+		}
+		return strings.Join(result, " ")
+	}
+
+	if got := values(); got != "1 2" || len(remote.idents) != 1 || remote.idents[0]["name"] != "foo.b" {
+		t.Errorf("FetchSeriesBatch: expected foo.b from the remote, got %q %v", got, remote.idents)
+	}
+	remote.fail = true
+	if got := values(); got != "1 1" {
+		t.Errorf("FetchSeriesBatch: expected foo.b from the db if the remote fails, got %q", got)
+	}
+}
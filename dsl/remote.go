@@ -0,0 +1,164 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/series"
+)
+
+// A RemoteFetcher fetches the series of DSs owned by other nodes of
+// a cluster from those nodes, which have their most recent data
+// points, not yet in the database. See namedDsFetcher.SetRemote.
+type RemoteFetcher interface {
+	// Owner returns the name of the node owning the DS with this
+	// id, or "" if it is this node or not known.
+	Owner(id int64) string
+	// FetchRemoteSeries fetches the series of the DSs, all owned
+	// by node, in the order of idents.
+	FetchRemoteSeries(node string, idents []serde.Ident, from, to time.Time, maxPoints int64) ([]series.Series, error)
+}
+
+// SetRemote makes the series of DSs owned by other nodes be fetched
+// from them, so that any node can answer any query. The series of a
+// node that cannot be reached come from the database.
+func (r *namedDsFetcher) SetRemote(rf RemoteFetcher) {
+	r.remoteMu.Lock()
+	defer r.remoteMu.Unlock()
+	r.remote = rf
+}
+
+func (r *namedDsFetcher) getRemote() RemoteFetcher {
+	r.remoteMu.RLock()
+	defer r.remoteMu.RUnlock()
+	return r.remote
+}
+
+// FetchOrCreateDataSource is that of the LRU, except that with a
+// RemoteFetcher a DS that this node does not have in its cache (as
+// it is owned by another node) comes from the database.
+func (r *namedDsFetcher) FetchOrCreateDataSource(ident serde.Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	if r.getRemote() != nil {
+		return r.FetchLocalDataSource(ident)
+	}
+	return r.dsLRU.FetchOrCreateDataSource(ident, dsSpec)
+}
+
+func (r *namedDsFetcher) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	sers, err := r.FetchSeriesBatch([]rrd.DataSourcer{ds}, from, to, maxPoints)
+	if err != nil {
+		return nil, err
+	}
+	return sers[0], nil
+}
+
+// FetchSeriesBatch fetches the series of the DSs owned by other nodes
+// from them, one request per node, and the rest locally, all at the
+// same time.
+func (r *namedDsFetcher) FetchSeriesBatch(dss []rrd.DataSourcer, from, to time.Time, maxPoints int64) ([]series.Series, error) {
+	rf := r.getRemote()
+	if rf == nil {
+		return r.dsLRU.FetchSeriesBatch(dss, from, to, maxPoints)
+	}
+
+	var (
+		result = make([]series.Series, len(dss))
+		local  []int
+		byNode = make(map[string][]int)
+	)
+	for i, ds := range dss {
+		if dbds := dbDataSourcer(ds); dbds != nil {
+			if node := rf.Owner(dbds.Id()); node != "" {
+				byNode[node] = append(byNode[node], i)
+				continue
+			}
+		}
+		local = append(local, i)
+	}
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for node, idx := range byNode {
+		wg.Add(1)
+		go func(node string, idx []int) {
+			defer wg.Done()
+			idents := make([]serde.Ident, len(idx))
+			for i, n := range idx {
+				idents[i] = dbDataSourcer(dss[n]).Ident()
+			}
+			sers, err := rf.FetchRemoteSeries(node, idents, from, to, maxPoints)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("namedDsFetcher: %d series from the database, as fetching them from node %s failed: %v", len(idx), node, err)
+				local = append(local, idx...)
+				return
+			}
+			for i, n := range idx {
+				result[n] = sers[i]
+			}
+		}(node, idx)
+	}
+	wg.Wait()
+
+	if len(local) > 0 {
+		localDss := make([]rrd.DataSourcer, len(local))
+		for i, n := range local {
+			localDss[i] = dss[n]
+		}
+		sers, err := r.FetchLocalSeriesBatch(localDss, from, to, maxPoints)
+		if err != nil {
+			return nil, err
+		}
+		for i, n := range local {
+			result[n] = sers[i]
+		}
+	}
+	return result, nil
+}
+
+// FetchLocalSeriesBatch is FetchSeriesBatch of this node only, i.e.
+// from the LRU and the database, e.g. to answer another node.
+func (r *namedDsFetcher) FetchLocalSeriesBatch(dss []rrd.DataSourcer, from, to time.Time, maxPoints int64) ([]series.Series, error) {
+	return r.dsLRU.FetchSeriesBatch(dss, from, to, maxPoints)
+}
+
+// FetchLocalDataSource is FetchOrCreateDataSource of this node only,
+// a DS not in its cache comes from the database.
+func (r *namedDsFetcher) FetchLocalDataSource(ident serde.Ident) (rrd.DataSourcer, error) {
+	ds, err := r.dsLRU.FetchOrCreateDataSource(ident, nil)
+	if ds == nil && err == nil {
+		return r.dsLRU.db.FetchOrCreateDataSource(ident, nil)
+	}
+	return ds, err
+}
+
+// dbDataSourcer returns the serde DS of a DS, which may be watched,
+// or nil if it is not one.
+func dbDataSourcer(ds rrd.DataSourcer) serde.DbDataSourcer {
+	if wds, ok := ds.(*watchedDs); ok {
+		ds = wds.DataSourcer
+	}
+	dbds, _ := ds.(serde.DbDataSourcer)
+	return dbds
+}
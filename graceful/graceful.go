@@ -69,7 +69,12 @@ func (gl *Listener) Accept() (c net.Conn, err error) {
 }
 
 func (gl *Listener) File() *os.File {
-	tl := gl.Listener.(*net.TCPListener)
+	tl, ok := gl.Listener.(interface {
+		File() (*os.File, error)
+	}) // a TCP or unix socket listener
+	if !ok {
+		return nil
+	}
 	fl, _ := tl.File()
 	return fl
 }
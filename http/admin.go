@@ -0,0 +1,380 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgres/tgres/dsl"
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/serde"
+)
+
+type adminDeleted struct {
+	Id    int64       `json:"id"`
+	Ident serde.Ident `json:"ident"` // null if only the id is known
+}
+
+type adminDeleteResult struct {
+	Deleted []adminDeleted `json:"deleted"`
+	DryRun  bool           `json:"dry_run"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// AdminDeleteHandler deletes DSs, see Receiver.DeleteDataSources. It
+// only accepts a POST with an "Authorization: Bearer <token>" header.
+// The DSs are selected by the "id" (which may repeat), "glob" and
+// "match" (key:regex, which may repeat) parameters, with "dry_run"
+// they are only listed. The response is the JSON list of the DSs
+// deleted, and the error, if any, with a 500.
+func AdminDeleteHandler(rcvr *receiver.Receiver, rcache dsl.NamedDSFetcher, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(w, r, token) {
+			return
+		}
+
+		q := serde.DeleteQuery{Glob: r.Form.Get("glob")}
+		for _, s := range r.Form["id"] {
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid id: %q", s), http.StatusBadRequest)
+				return
+			}
+			q.Ids = append(q.Ids, id)
+		}
+		for _, s := range r.Form["match"] {
+			kv := strings.SplitN(s, ":", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				http.Error(w, fmt.Sprintf("invalid match, expected key:regex: %q", s), http.StatusBadRequest)
+				return
+			}
+			if q.Match == nil {
+				q.Match = make(serde.SearchQuery)
+			}
+			q.Match[kv[0]] = kv[1]
+		}
+		if len(q.Ids) == 0 && len(q.Match) == 0 && q.Glob == "" {
+			http.Error(w, "no id, glob or match given", http.StatusBadRequest)
+			return
+		}
+		_, dryRun := r.Form["dry_run"]
+
+		deleted, err := rcvr.DeleteDataSources(q, dryRun)
+		result := adminDeleteResult{Deleted: []adminDeleted{}, DryRun: dryRun}
+		idents := make([]serde.Ident, 0, len(deleted))
+		for id, ident := range deleted {
+			result.Deleted = append(result.Deleted, adminDeleted{Id: id, Ident: ident})
+			if ident != nil {
+				idents = append(idents, ident)
+			}
+		}
+		if !dryRun && len(deleted) > 0 {
+			rcache.Forget(idents)
+		}
+		status := http.StatusOK
+		if err != nil {
+			log.Printf("AdminDeleteHandler: %v", err)
+			result.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(&result); err != nil {
+			log.Printf("AdminDeleteHandler: error writing response: %v", err)
+		}
+	}
+}
+
+type adminRenameResult struct {
+	Renamed []serde.Rename `json:"renamed"`
+	DryRun  bool           `json:"dry_run"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// AdminRenameHandler renames DSs, see Receiver.RenameDataSources, it
+// is authorized as AdminDeleteHandler. The "from" and "to" parameters
+// are the names, or the subtrees if they end in ".*", and with
+// "dry_run" the renames are only listed. The response is the JSON list
+// of the renames, and the error, if any, with a 500.
+func AdminRenameHandler(rcvr *receiver.Receiver, rcache dsl.NamedDSFetcher, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(w, r, token) {
+			return
+		}
+		from, to := r.Form.Get("from"), r.Form.Get("to")
+		if from == "" || to == "" {
+			http.Error(w, "from and to are required", http.StatusBadRequest)
+			return
+		}
+		_, dryRun := r.Form["dry_run"]
+
+		renames, err := rcvr.RenameDataSources(from, to, dryRun)
+		result := adminRenameResult{Renamed: renames, DryRun: dryRun}
+		if result.Renamed == nil {
+			result.Renamed = []serde.Rename{}
+		}
+		if !dryRun && len(renames) > 0 {
+			idents := make([]serde.Ident, 0, 2*len(renames))
+			for _, rn := range renames {
+				idents = append(idents, rn.From, rn.To)
+			}
+			rcache.Forget(idents)
+		}
+		status := http.StatusOK
+		if err != nil {
+			log.Printf("AdminRenameHandler: %v", err)
+			result.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(&result); err != nil {
+			log.Printf("AdminRenameHandler: error writing response: %v", err)
+		}
+	}
+}
+
+type adminMigrateResult struct {
+	Migrating []serde.Ident `json:"migrating"`
+	DryRun    bool          `json:"dry_run"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// AdminMigrateHandler changes the RRAs of the DSs whose name matches
+// the "glob" parameter to those of their current spec, see
+// Receiver.MigrateDataSources, it is authorized as
+// AdminDeleteHandler. The migration runs in the background, the
+// response is the JSON list of the DSs being migrated (or with
+// "dry_run" those that would be), and the error, if any, with a 500.
+func AdminMigrateHandler(rcvr *receiver.Receiver, rcache dsl.NamedDSFetcher, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(w, r, token) {
+			return
+		}
+		glob := r.Form.Get("glob")
+		if glob == "" {
+			http.Error(w, "glob is required", http.StatusBadRequest)
+			return
+		}
+		_, dryRun := r.Form["dry_run"]
+
+		idents, err := rcvr.MigrateDataSources(glob, dryRun, func(ident serde.Ident) {
+			rcache.Forget([]serde.Ident{ident})
+		})
+		result := adminMigrateResult{Migrating: idents, DryRun: dryRun}
+		if result.Migrating == nil {
+			result.Migrating = []serde.Ident{}
+		}
+		status := http.StatusOK
+		if err != nil {
+			log.Printf("AdminMigrateHandler: %v", err)
+			result.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(&result); err != nil {
+			log.Printf("AdminMigrateHandler: error writing response: %v", err)
+		}
+	}
+}
+
+type adminMetadataResult struct {
+	Ident    serde.Ident      `json:"ident"`
+	Metadata serde.DSMetadata `json:"metadata"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// AdminMetadataHandler returns and sets the metadata of the DS named
+// by the "name" parameter, see Receiver.SetMetadata, it is authorized
+// as AdminDeleteHandler. If any of the "units", "description" and
+// "owner" parameters is given, those given replace the current ones,
+// a blank one clears it. The response is the JSON ident and metadata
+// of the DS, and the error, if any, with a 500.
+func AdminMetadataHandler(rcvr *receiver.Receiver, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(w, r, token) {
+			return
+		}
+		name := r.Form.Get("name")
+		if name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+
+		ident, md, err := rcvr.Metadata(name)
+		if err == nil {
+			set := false
+			for param, field := range map[string]*string{"units": &md.Units, "description": &md.Description, "owner": &md.Owner} {
+				if v, ok := r.Form[param]; ok {
+					*field, set = v[0], true
+				}
+			}
+			if set {
+				ident, err = rcvr.SetMetadata(name, md)
+			}
+		}
+		result := adminMetadataResult{Ident: ident, Metadata: md}
+		status := http.StatusOK
+		if err != nil {
+			log.Printf("AdminMetadataHandler: %v", err)
+			result.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(&result); err != nil {
+			log.Printf("AdminMetadataHandler: error writing response: %v", err)
+		}
+	}
+}
+
+type adminSnapshotResult struct {
+	Marker *serde.SnapshotMarker `json:"marker"`
+	Error  string                `json:"error,omitempty"`
+}
+
+// AdminSnapshotHandler coordinates a consistent snapshot of the
+// database for a backup, see Receiver.Snapshot, it is authorized as
+// AdminDeleteHandler. The writes stay quiesced for the "hold"
+// parameter (a duration, e.g. 10s, at most receiver.MaxSnapshotHold)
+// and the response, sent once they resume, is the JSON marker of the
+// snapshot, and the error, if any, with a 500.
+func AdminSnapshotHandler(rcvr *receiver.Receiver, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(w, r, token) {
+			return
+		}
+		var hold time.Duration
+		if s := r.Form.Get("hold"); s != "" {
+			var err error
+			if hold, err = time.ParseDuration(s); err != nil || hold < 0 || hold > receiver.MaxSnapshotHold {
+				http.Error(w, fmt.Sprintf("invalid hold, expected a duration of at most %v: %q", receiver.MaxSnapshotHold, s), http.StatusBadRequest)
+				return
+			}
+		}
+
+		marker, err := rcvr.Snapshot(hold)
+		result := adminSnapshotResult{Marker: marker}
+		status := http.StatusOK
+		if err != nil {
+			log.Printf("AdminSnapshotHandler: %v", err)
+			result.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(&result); err != nil {
+			log.Printf("AdminSnapshotHandler: error writing response: %v", err)
+		}
+	}
+}
+
+type adminLiveDS struct {
+	Id         int64       `json:"id"`
+	Ident      serde.Ident `json:"ident"`
+	LastUpdate time.Time   `json:"last_update"`
+}
+
+type adminLivenessResult struct {
+	DataSources []adminLiveDS `json:"data_sources"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// AdminLivenessHandler lists the DSs by when they were last updated,
+// see Receiver.DataSourcesByLastUpdate, it is authorized as
+// AdminDeleteHandler. The "min_age" and "max_age" parameters
+// (durations, e.g. 5m and 1h for those which stopped receiving data
+// in the last hour) bound how long ago, and "limit" how many, with
+// "archived" archived DSs are included. The response is the JSON list
+// of the DSs, least recently updated first, and the error, if any,
+// with a 500.
+func AdminLivenessHandler(rcvr *receiver.Receiver, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(w, r, token) {
+			return
+		}
+		now := time.Now()
+		q := serde.LivenessQuery{}
+		for param, t := range map[string]*time.Time{"min_age": &q.Before, "max_age": &q.After} {
+			if s := r.Form.Get(param); s != "" {
+				age, err := time.ParseDuration(s)
+				if err != nil || age < 0 {
+					http.Error(w, fmt.Sprintf("invalid %s, expected a duration: %q", param, s), http.StatusBadRequest)
+					return
+				}
+				*t = now.Add(-age)
+			}
+		}
+		if s := r.Form.Get("limit"); s != "" {
+			var err error
+			if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 {
+				http.Error(w, fmt.Sprintf("invalid limit: %q", s), http.StatusBadRequest)
+				return
+			}
+		}
+		_, q.Archived = r.Form["archived"]
+
+		dss, err := rcvr.DataSourcesByLastUpdate(q)
+		result := adminLivenessResult{DataSources: make([]adminLiveDS, 0, len(dss))}
+		for _, ds := range dss {
+			result.DataSources = append(result.DataSources, adminLiveDS{Id: ds.Id, Ident: ds.Ident, LastUpdate: ds.LastUpdate})
+		}
+		status := http.StatusOK
+		if err != nil {
+			log.Printf("AdminLivenessHandler: %v", err)
+			result.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(&result); err != nil {
+			log.Printf("AdminLivenessHandler: error writing response: %v", err)
+		}
+	}
+}
+
+// adminAuthorized checks that the request is a POST with the token
+// and parses its parameters, otherwise it responds with an error.
+func adminAuthorized(w http.ResponseWriter, r *http.Request, token string) bool {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return false
+	}
+	auth := []byte(r.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, fmt.Sprintf("invalid parameters: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/tgres/tgres/batch"
+	"github.com/tgres/tgres/receiver"
+)
+
+// The largest /api/batch request body accepted, compressed or not.
+const maxBatchBody = 64 * 1024 * 1024
+
+// BatchPutHandler accepts a binary batch of data points (see package
+// batch), snappy compressed if the Content-Encoding is "snappy". The
+// response is a 204, or a 400 with the number of points that failed
+// if any did. A batch that cannot be decoded to the end is a 400,
+// the points before the error are still accepted.
+func BatchPutHandler(rcvr *receiver.Receiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBody))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error reading body: %v", err), http.StatusBadRequest)
+			return
+		}
+		switch r.Header.Get("Content-Encoding") {
+		case "snappy":
+			if data, err = batch.DecodeSnappy(data, maxBatchBody); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case "", "identity":
+		default:
+			http.Error(w, "unsupported Content-Encoding, only snappy is", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		points, decodeErr := batch.Decode(data)
+
+		source, _, _ := net.SplitHostPort(r.RemoteAddr)
+		failed := 0
+		for _, p := range points {
+			ident, err := p.Ident()
+			if err != nil {
+				failed++
+				rcvr.RecordDropped(receiver.DeadParse, fmt.Sprintf("batch point %q: %v", p.Name, err))
+				continue
+			}
+			ts, ok := rcvr.ListenerTime("http_batch", p.Time)
+			if !ok || !rcvr.AcquireListenerInput("http_batch", source, 1) {
+				failed++
+				continue
+			}
+			ident["name"] = rcvr.ListenerName("http_batch", ident["name"])
+			rcvr.QueueDataPoint(ident, ts, p.Value)
+			rcvr.CountListenerInput("http_batch", 1)
+		}
+
+		if decodeErr != nil {
+			log.Printf("BatchPutHandler: %v", decodeErr)
+			rcvr.RecordDropped(receiver.DeadParse, fmt.Sprintf("batch: %v", decodeErr))
+			http.Error(w, fmt.Sprintf("%d points accepted, %d failed, then: %v", len(points)-failed, failed, decodeErr), http.StatusBadRequest)
+			return
+		}
+		if failed > 0 {
+			http.Error(w, fmt.Sprintf("%d of %d points failed", failed, len(points)), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
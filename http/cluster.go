@@ -0,0 +1,42 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/tgres/tgres/receiver"
+)
+
+// ClusterStatusHandler responds with the JSON of
+// Receiver.ClusterStatus: the members of the cluster and the progress
+// of the rebalancing of DSs between them. It is a 404 if this node is
+// not clustered.
+func ClusterStatusHandler(rcvr *receiver.Receiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := rcvr.ClusterStatus()
+		if status == nil {
+			http.Error(w, "not a cluster", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Printf("ClusterStatusHandler: error writing response: %v", err)
+		}
+	}
+}
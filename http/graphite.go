@@ -19,6 +19,7 @@ package http
 
 import (
 	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -32,11 +33,16 @@ import (
 
 	"github.com/tgres/tgres/dsl"
 	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/serde"
 )
 
 const BATCH_LIMIT = 64
 
-func GraphiteMetricsFindHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
+// GraphiteMetricsFindHandler is the Graphite /metrics/find, the
+// context of a leaf is its DS metadata (see Receiver.SetMetadata), if
+// any. A nil rcvr leaves the contexts empty.
+func GraphiteMetricsFindHandler(rcache dsl.NamedDSFetcher, rcvr *receiver.Receiver) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		fmt.Fprintf(w, "[\n")
@@ -51,6 +57,7 @@ func GraphiteMetricsFindHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 			}
 			dupe[suffix] = true
 		}
+		mds := findMetadata(rcvr, uniq)
 		for n, node := range uniq {
 			parts := strings.Split(node.Name, ".")
 			suffix := parts[len(parts)-1]
@@ -63,8 +70,13 @@ func GraphiteMetricsFindHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 				iexp = 1
 			}
 			// not very clear on how we can be expandable and not allow children...
-			fmt.Fprintf(w, `{"leaf": %d, "context": {}, "text": "%s", "expandable": %d, "id": "%s", "allowChildren": %d}`,
-				ileaf, suffix, iexp, node.Name, iexp)
+			context := "{}"
+			if md, ok := mds[node.Name]; ok {
+				b, _ := json.Marshal(md)
+				context = string(b)
+			}
+			fmt.Fprintf(w, `{"leaf": %d, "context": %s, "text": "%s", "expandable": %d, "id": "%s", "allowChildren": %d}`,
+				ileaf, context, suffix, iexp, node.Name, iexp)
 			if n < len(uniq)-1 {
 				fmt.Fprintf(w, ",\n")
 			}
@@ -74,6 +86,34 @@ func GraphiteMetricsFindHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 	}
 }
 
+// findMetadata returns the metadata of the leaf nodes, by name.
+func findMetadata(rcvr *receiver.Receiver, nodes []*dsl.FsFindNode) map[string]serde.DSMetadata {
+	result := make(map[string]serde.DSMetadata)
+	if rcvr == nil {
+		return result
+	}
+	var idents []serde.Ident
+	names := make(map[string]string)
+	for _, node := range nodes {
+		if ident := node.Ident(); node.Leaf && ident != nil {
+			idents = append(idents, ident)
+			names[ident.String()] = node.Name
+		}
+	}
+	if len(idents) == 0 {
+		return result
+	}
+	mds, err := rcvr.LoadMetadata(idents)
+	if err != nil {
+		log.Printf("GraphiteMetricsFindHandler: error loading metadata: %v", err)
+		return result
+	}
+	for k, md := range mds {
+		result[names[k]] = md
+	}
+	return result
+}
+
 func GraphiteRenderHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 
 	return makeGzipHandler(
@@ -111,6 +151,17 @@ func GraphiteRenderHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 				}
 			}
 
+			// Timezone for time-based functions such as summarize()
+			var loc *time.Location
+			if tz := r.FormValue("tz"); tz != "" {
+				if loc, err = time.LoadLocation(tz); err != nil {
+					log.Printf("RenderHandler(): (tz) %v", err)
+					w.Header().Set("X-Tgres-DSL-Error", fmt.Sprintf("tz: %v", err))
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+
 			var wg sync.WaitGroup
 
 			targets := make([][]*graphiteSeries, len(r.Form["target"]))
@@ -119,7 +170,7 @@ func GraphiteRenderHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 				wg.Add(1)
 				batchSize++
 				go func(wg *sync.WaitGroup, target string, targets [][]*graphiteSeries, n int) {
-					if sm, err := processTarget(rcache, target, from.Unix(), to.Unix(), int64(points)); err == nil {
+					if sm, err := processTarget(rcache, target, from.Unix(), to.Unix(), int64(points), loc); err == nil {
 						// sm may contain locked watched RRAs,
 						// readDataPoints unlocks them in
 						// series.Close() It's important to not do
@@ -170,6 +221,8 @@ func GraphiteRenderHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 						}
 					}
 
+					series.release()
+
 					if nn < len(target)-1 || tn < len(targets)-1 {
 						fmt.Fprintf(w, "]},\n")
 					} else {
@@ -256,11 +309,11 @@ func quoteIdentifiers(target string) string {
 	return result
 }
 
-func processTarget(rcache dsl.NamedDSFetcher, target string, from, to, maxPoints int64) (dsl.SeriesMap, error) {
+func processTarget(rcache dsl.NamedDSFetcher, target string, from, to, maxPoints int64, loc *time.Location) (dsl.SeriesMap, error) {
 	target = quoteIdentifiers(target)
 	// In our DSL everything must be a function call, so we wrap everything in group()
 	query := fmt.Sprintf("group(%s)", target)
-	return dsl.ParseDsl(rcache, query, time.Unix(from, 0), time.Unix(to, 0), maxPoints)
+	return dsl.ParseDslTz(rcache, query, time.Unix(from, 0), time.Unix(to, 0), maxPoints, loc)
 }
 
 // Graphite data points
@@ -269,10 +322,21 @@ type dataPoint struct {
 	v float64
 }
 type graphiteSeries struct {
-	dps  []*dataPoint
+	dps  []dataPoint
 	name string
 }
 
+// dataPoint slices are reused across renders, a render of many
+// series at many points would otherwise create a lot of garbage.
+var dataPointsPool = sync.Pool{New: func() interface{} { return make([]dataPoint, 0, 1024) }}
+
+// release returns the data points to the pool, gs must not be used
+// after this.
+func (gs *graphiteSeries) release() {
+	dataPointsPool.Put(gs.dps[:0])
+	gs.dps = nil
+}
+
 func readDataPoints(sm dsl.SeriesMap) []*graphiteSeries {
 	names := sm.SortedKeys()
 	result := make([]*graphiteSeries, len(names))
@@ -289,9 +353,9 @@ func readDataPoints(sm dsl.SeriesMap) []*graphiteSeries {
 		wg.Add(1)
 		batchSize++
 		go func(wg *sync.WaitGroup, result []*graphiteSeries, n int, name string) {
-			gs := &graphiteSeries{make([]*dataPoint, 0), name}
+			gs := &graphiteSeries{dataPointsPool.Get().([]dataPoint), name}
 			for series.Next() {
-				gs.dps = append(gs.dps, &dataPoint{series.CurrentTime().Unix(), series.CurrentValue()})
+				gs.dps = append(gs.dps, dataPoint{series.CurrentTime().Unix(), series.CurrentValue()})
 			}
 			result[n] = gs
 			series.Close()
@@ -0,0 +1,185 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/serde"
+)
+
+// The largest /api/put request body accepted.
+const maxOpentsdbPutBody = 64 * 1024 * 1024
+
+type opentsdbDataPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp json.Number       `json:"timestamp"`
+	Value     json.Number       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+type opentsdbPutError struct {
+	DataPoint json.RawMessage `json:"datapoint"`
+	Error     string          `json:"error"`
+}
+
+type opentsdbPutResult struct {
+	Errors  []opentsdbPutError `json:"errors,omitempty"`
+	Failed  int                `json:"failed"`
+	Success int                `json:"success"`
+}
+
+// OpentsdbPutHandler implements the OpenTSDB /api/put endpoint: a
+// JSON data point object or an array of them, optionally gzipped.
+// As in OpenTSDB, the response is a 204 unless the "summary" or
+// "details" query parameter is present, in which case it is the
+// number of data points that failed and succeeded and, for "details",
+// why they failed. Any failure makes it a 400.
+func OpentsdbPutHandler(rcvr *receiver.Receiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var body io.Reader = http.MaxBytesReader(w, r.Body, maxOpentsdbPutBody)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(body)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid gzip body: %v", err), http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			body = gz
+		}
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error reading body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		// A single object or an array of them
+		var raw []json.RawMessage
+		if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '{' {
+			raw = []json.RawMessage{data}
+		} else if err := json.Unmarshal(data, &raw); err != nil {
+			http.Error(w, fmt.Sprintf("unable to parse the request body: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		source, _, _ := net.SplitHostPort(r.RemoteAddr)
+		var result opentsdbPutResult
+		for _, rdp := range raw {
+			ident, ts, v, err := parseOpentsdbDataPoint(rdp)
+			if err != nil {
+				result.Failed++
+				result.Errors = append(result.Errors, opentsdbPutError{DataPoint: rdp, Error: err.Error()})
+				rcvr.RecordDropped(receiver.DeadParse, string(rdp))
+				continue
+			}
+			ts, ok := rcvr.ListenerTime("opentsdb_http", ts)
+			if !ok {
+				result.Failed++
+				result.Errors = append(result.Errors, opentsdbPutError{DataPoint: rdp, Error: "timestamp too far from the server time"})
+				continue
+			}
+			if !rcvr.AcquireListenerInput("opentsdb_http", source, 1) {
+				result.Failed++
+				result.Errors = append(result.Errors, opentsdbPutError{DataPoint: rdp, Error: "over quota"})
+				continue
+			}
+			ident["name"] = rcvr.ListenerName("opentsdb_http", ident["name"])
+			rcvr.QueueDataPoint(ident, ts, v)
+			rcvr.CountListenerInput("opentsdb_http", 1)
+			result.Success++
+		}
+
+		status := http.StatusNoContent
+		if result.Failed > 0 {
+			status = http.StatusBadRequest
+		}
+		_, details := r.URL.Query()["details"]
+		_, summary := r.URL.Query()["summary"]
+		if !details && !summary {
+			if status != http.StatusNoContent {
+				http.Error(w, fmt.Sprintf("%d of %d data points failed, use ?details for more", result.Failed, len(raw)), status)
+			} else {
+				w.WriteHeader(status)
+			}
+			return
+		}
+		if !details {
+			result.Errors = nil
+		} else if result.Errors == nil {
+			result.Errors = []opentsdbPutError{}
+		}
+		if status == http.StatusNoContent {
+			status = http.StatusOK // there is content
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(&result); err != nil {
+			log.Printf("OpentsdbPutHandler: error writing response: %v", err)
+		}
+	}
+}
+
+// parseOpentsdbDataPoint validates an OpenTSDB JSON data point. The
+// value may be a number or a string, the timestamp is in seconds or,
+// if it has more than 10 digits, in milliseconds. The tags become
+// fields of the ident.
+func parseOpentsdbDataPoint(rdp json.RawMessage) (serde.Ident, time.Time, float64, error) {
+	var dp opentsdbDataPoint
+	if err := json.Unmarshal(rdp, &dp); err != nil { // a json.Number can also be a string
+		return nil, time.Time{}, 0, fmt.Errorf("invalid data point: %v", err)
+	}
+
+	ident := serde.Ident{"name": misc.SanitizeName(dp.Metric)}
+	if ident["name"] == "" {
+		return nil, time.Time{}, 0, fmt.Errorf("metric name missing or invalid")
+	}
+	tstamp, err := strconv.ParseInt(dp.Timestamp.String(), 10, 64)
+	if err != nil || tstamp <= 0 {
+		return nil, time.Time{}, 0, fmt.Errorf("invalid timestamp: %q", dp.Timestamp.String())
+	}
+	ts := time.Unix(tstamp, 0)
+	if len(dp.Timestamp.String()) > 10 {
+		ts = time.Unix(0, tstamp*int64(time.Millisecond))
+	}
+	v, err := strconv.ParseFloat(dp.Value.String(), 64)
+	if err != nil {
+		return nil, time.Time{}, 0, fmt.Errorf("invalid value: %q", dp.Value.String())
+	}
+	for k, tv := range dp.Tags {
+		if k == "" || tv == "" || k == "name" {
+			return nil, time.Time{}, 0, fmt.Errorf("invalid tag: %q=%q", k, tv)
+		}
+		ident[k] = tv
+	}
+	return ident, ts, v, nil
+}
@@ -24,6 +24,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"syscall"
 
 	"github.com/tgres/tgres/daemon"
@@ -33,17 +34,51 @@ var (
 	buildTime, gitRevision string
 )
 
-func parseFlags() (textCfgPath, gracefulProtos, join string, bg bool, version bool) {
+// flags are the command line flags, see parseFlags.
+type flags struct {
+	textCfgPath, gracefulProtos, join string // TODO remove gracefulProtos
+	replay                            string
+	replayRate                        int
+	bg, version                       bool
+
+	// The operations which exit when done, see daemon.Delete etc.
+	deleteGlob, renameFrom, renameTo    string
+	dryRun                              bool
+	dumpGlob, restore, from, until      string
+	importWhisper, importPrefix         string
+	export, exportWhisper, exportPickle string
+	fsck, repair                        bool
+}
+
+func parseFlags() *flags {
+	f := &flags{}
 
 	// Parse the flags, if any
-	flag.StringVar(&textCfgPath, "c", "./etc/tgres.conf", "path to config file")
-	flag.StringVar(&join, "join", "", "List of add:port,addr:port,... of nodes to join")
-	flag.StringVar(&gracefulProtos, "graceful", "", "list of fds (DEPRECATED)") // TODO Remove me
-	flag.BoolVar(&bg, "bg", false, "Immediately background itself")
-	flag.BoolVar(&version, "version", false, "Print version and exit")
+	flag.StringVar(&f.textCfgPath, "c", "./etc/tgres.conf", "path to config file")
+	flag.StringVar(&f.join, "join", "", "List of add:port,addr:port,... of nodes to join")
+	flag.StringVar(&f.gracefulProtos, "graceful", "", "list of fds (DEPRECATED)") // TODO Remove me
+	flag.StringVar(&f.replay, "replay", "", "Dead letter file whose data points to process again once started")
+	flag.IntVar(&f.replayRate, "replay-rate", 10000, "Maximum data points per second to replay, 0 is unlimited")
+	flag.BoolVar(&f.bg, "bg", false, "Immediately background itself")
+	flag.BoolVar(&f.version, "version", false, "Print version and exit")
+	flag.StringVar(&f.deleteGlob, "delete", "", "Delete the DSs whose names match this glob, e.g. \"foo.*.{bar,baz}\", and exit")
+	flag.StringVar(&f.renameFrom, "rename", "", "Rename the DS with this name, or the subtree if it ends in \".*\", to -to and exit")
+	flag.StringVar(&f.renameTo, "to", "", "With -rename, the new name, e.g. \"servers.new.*\" for -rename \"servers.old.*\"")
+	flag.BoolVar(&f.dryRun, "dry-run", false, "With -delete or -rename, only list the DSs that would be affected")
+	flag.StringVar(&f.dumpGlob, "dump", "", "Dump the DSs whose names match this glob to stdout in a portable format and exit")
+	flag.StringVar(&f.restore, "restore", "", "Restore the DSs in this dump file (\"-\" is stdin) and exit")
+	flag.StringVar(&f.from, "from", "", "With -dump or -export-pickle, only the data points after this time (RFC 3339 or seconds since the epoch)")
+	flag.StringVar(&f.until, "until", "", "With -dump or -export-pickle, only the data points up to this time (RFC 3339 or seconds since the epoch)")
+	flag.StringVar(&f.importWhisper, "import-whisper", "", "Import the whisper files in this directory tree, e.g. /opt/graphite/storage/whisper, and exit")
+	flag.StringVar(&f.importPrefix, "import-prefix", "", "With -import-whisper, a prefix for the names of the DSs")
+	flag.StringVar(&f.export, "export", "", "Export the DSs whose names match this glob to Graphite, see -export-whisper and -export-pickle, and exit")
+	flag.StringVar(&f.exportWhisper, "export-whisper", "", "With -export, the directory of the whisper tree to write")
+	flag.StringVar(&f.exportPickle, "export-pickle", "", "With -export, the address (host:port) of the carbon pickle receiver to send the data points to")
+	flag.BoolVar(&f.fsck, "fsck", false, "Check the stored DSs and RRAs for impossible state, e.g. after a crash, and exit")
+	flag.BoolVar(&f.repair, "repair", false, "With -fsck, also repair the problems which can be")
 	flag.Parse()
 
-	return
+	return f
 }
 
 func printVersion() {
@@ -59,19 +94,88 @@ func printVersion() {
 
 func main() {
 
-	textCfgPath, gracefulProtos, join, bg, version := parseFlags() // TODO remove gracefulProtos from this line
+	f := parseFlags()
 	if gp := os.Getenv("TGRES_PROTOS"); gp != "" {
-		gracefulProtos = gp
+		f.gracefulProtos = gp
 	}
 
-	if version {
+	if f.version {
 		printVersion()
 		return
 	}
 
-	if bg {
-		if !filepath.IsAbs(textCfgPath) {
-			log.Fatalf("ERROR: Background only possible when config path is absolute (cfg path: %q).", textCfgPath)
+	if f.deleteGlob != "" {
+		if err := daemon.Delete(f.textCfgPath, f.deleteGlob, f.dryRun, os.Stdout); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		return
+	}
+	if f.renameFrom != "" {
+		if err := daemon.Rename(f.textCfgPath, f.renameFrom, f.renameTo, f.dryRun, os.Stdout); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		return
+	}
+
+	if f.dumpGlob != "" {
+		if err := daemon.Dump(f.textCfgPath, f.dumpGlob, f.from, f.until, os.Stdout); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		return
+	}
+	if f.restore != "" {
+		in := os.Stdin
+		if f.restore != "-" {
+			rf, err := os.Open(f.restore)
+			if err != nil {
+				log.Fatalf("ERROR: %v", err)
+			}
+			defer rf.Close()
+			in = rf
+		}
+		if err := daemon.Restore(f.textCfgPath, in, os.Stdout); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		return
+	}
+
+	if f.fsck {
+		if err := daemon.Fsck(f.textCfgPath, f.repair, os.Stdout); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		return
+	}
+
+	if f.importWhisper != "" {
+		if err := daemon.ImportWhisper(f.textCfgPath, f.importWhisper, f.importPrefix, os.Stdout); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		return
+	}
+
+	if f.export != "" {
+		var err error
+		switch {
+		case f.exportWhisper != "":
+			err = daemon.ExportWhisper(f.textCfgPath, f.export, f.exportWhisper, os.Stdout)
+		case f.exportPickle != "":
+			err = daemon.ExportPickle(f.textCfgPath, f.export, f.exportPickle, f.from, f.until, os.Stdout)
+		default:
+			err = fmt.Errorf("-export requires -export-whisper or -export-pickle")
+		}
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		return
+	}
+
+	if f.replay != "" {
+		f.replay, _ = filepath.Abs(f.replay)
+	}
+
+	if f.bg {
+		if !filepath.IsAbs(f.textCfgPath) {
+			log.Fatalf("ERROR: Background only possible when config path is absolute (cfg path: %q).", f.textCfgPath)
 		}
 		if !filepath.IsAbs(os.Args[0]) {
 			log.Fatalf("ERROR: Background only possible when %q started with absolute path.", os.Args[0])
@@ -81,21 +185,24 @@ func main() {
 			log.Fatalf("Error: %v", err)
 		}
 		os.Chdir("/")
-		background(textCfgPath, join)
+		background(f.textCfgPath, f.join, f.replay, f.replayRate)
 		return
 	}
 
-	if cfg := daemon.Init(textCfgPath, gracefulProtos, join); cfg != nil {
+	if cfg := daemon.Init(f.textCfgPath, f.gracefulProtos, f.join, f.replay, f.replayRate); cfg != nil {
 		daemon.Finish(cfg)
 	}
 }
 
-func background(cp, join string) {
+func background(cp, join, replay string, replayRate int) {
 	mypath, _ := filepath.Abs(os.Args[0])
 	args := []string{"-c", cp}
 	if join != "" {
 		args = append(args, "-join", join)
 	}
+	if replay != "" {
+		args = append(args, "-replay", replay, "-replay-rate", strconv.Itoa(replayRate))
+	}
 	cmd := exec.Command(mypath, args...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
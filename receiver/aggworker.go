@@ -25,7 +25,7 @@ import (
 	"github.com/tgres/tgres/statsd"
 )
 
-var aggWorkerIncomingAggCmds = func(ident string, rcv chan *cluster.Msg, aggCh chan *aggregator.Command) {
+var aggWorkerIncomingAggCmds = func(ident string, rcv chan *cluster.Msg, aggCh chan *aggregator.Command, maxHops int) {
 	defer func() { recover() }() // if we're writing to a closed channel below
 
 	for {
@@ -41,7 +41,6 @@ var aggWorkerIncomingAggCmds = func(ident string, rcv chan *cluster.Msg, aggCh c
 			continue
 		}
 
-		maxHops := 2
 		if ac.Hops > maxHops {
 			log.Printf("%s: dropping command, max hops (%d) reached", ident, maxHops)
 			continue
@@ -68,8 +67,8 @@ var aggWorkerPeriodicFlushSignal = func(ident string, flushCh chan time.Time, du
 	}
 }
 
-var aggWorkerForwardACToNode = func(ac *aggregator.Command, node *cluster.Node, snd chan *cluster.Msg) error {
-	if ac.Hops == 0 { // we do not forward more than once
+var aggWorkerForwardACToNode = func(ac *aggregator.Command, node *cluster.Node, snd chan *cluster.Msg, maxForwards int) error {
+	if ac.Hops < maxForwards { // we do not forward more than maxForwards times
 		if node.Ready() {
 			ac.Hops++
 			msg, _ := cluster.NewMsg(node, ac) // can't possibly error
@@ -81,12 +80,19 @@ var aggWorkerForwardACToNode = func(ac *aggregator.Command, node *cluster.Node,
 	return nil
 }
 
-var aggWorkerProcessOrForward = func(ac *aggregator.Command, aggDd *distDatumAggregator, clstr clusterer, snd chan *cluster.Msg) (forwarded int) {
-	for _, node := range clstr.NodesForDistDatum(aggDd) {
+// aggWorkerProcessOrForward processes an aggregator command on, or
+// forwards it to, the first of the nodes of the aggregator only, as
+// the replicas of the DSs it flushes to get its points anyway.
+var aggWorkerProcessOrForward = func(ac *aggregator.Command, aggDd *distDatumAggregator, clstr clusterer, snd chan *cluster.Msg, maxForwards int) (forwarded int) {
+	nodes := clstr.NodesForDistDatum(aggDd)
+	if len(nodes) > 1 {
+		nodes = nodes[:1]
+	}
+	for _, node := range nodes {
 		if node.Name() == clstr.LocalNode().Name() {
 			aggDd.ProcessCmd(ac)
 		} else {
-			if err := aggWorkerForwardACToNode(ac, node, snd); err != nil {
+			if err := aggWorkerForwardACToNode(ac, node, snd, maxForwards); err != nil {
 				log.Printf("aggworker: Error forwarding aggregator command: %v", err)
 				continue
 			}
@@ -108,7 +114,7 @@ var aggWorker = func(wc wController, aggCh chan *aggregator.Command, clstr clust
 	if clstr != nil {
 		// Channel for event forwards to other nodes and us
 		snd, rcv = clstr.RegisterMsgType()
-		go aggWorkerIncomingAggCmds(wc.ident(), rcv, aggCh)
+		go aggWorkerIncomingAggCmds(wc.ident(), rcv, aggCh, dpq.MaxHops)
 	}
 
 	flushCh := make(chan time.Time, 1)
@@ -121,6 +127,20 @@ var aggWorker = func(wc wController, aggCh chan *aggregator.Command, clstr clust
 
 	agg := aggregator.NewAggregator(dpq) // aggregator.dataPointQueuer
 	agg.AppendAttr = "name"
+	agg.Outputs = dpq.AggOutputs
+	agg.Histograms = dpq.AggHistograms
+	if len(dpq.AggThresholds) > 0 {
+		agg.Thresholds = dpq.AggThresholds
+	}
+	if len(dpq.AggTimerAggregates) > 0 {
+		agg.TimerAggregates = dpq.AggTimerAggregates
+	}
+	if len(dpq.AggThresholdAggregates) > 0 {
+		agg.ThresholdAggregates = dpq.AggThresholdAggregates
+	}
+	if dpq.AggThresholdSep != "" {
+		agg.ThresholdSep = dpq.AggThresholdSep
+	}
 	aggDd := &distDatumAggregator{agg}
 	if clstr != nil {
 		clstr.LoadDistData(func() ([]cluster.DistDatum, error) {
@@ -153,7 +173,7 @@ var aggWorker = func(wc wController, aggCh chan *aggregator.Command, clstr clust
 			if clstr == nil {
 				aggDd.ProcessCmd(ac)
 			} else {
-				forwarded := aggWorkerProcessOrForward(ac, aggDd, clstr, snd)
+				forwarded := aggWorkerProcessOrForward(ac, aggDd, clstr, snd, dpq.MaxForwards)
 				sr.reportStatCount("receiver.aggworker.agg.forwarded", float64(forwarded))
 			}
 		}
@@ -21,6 +21,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -43,23 +44,23 @@ func Test_aggworkerIncomingAggCmds(t *testing.T) {
 	rcv := make(chan *cluster.Msg)
 	aggCh := make(chan *aggregator.Command)
 
-	count := 0
+	var count int32
 	go func() {
 		for {
 			if _, ok := <-aggCh; !ok {
 				break
 			}
-			count++
+			atomic.AddInt32(&count, 1)
 		}
 	}()
 
-	go aggWorkerIncomingAggCmds(ident, rcv, aggCh)
+	go aggWorkerIncomingAggCmds(ident, rcv, aggCh, 2)
 
 	// Sending a bogus message should not cause anything be written to cmdCh
 	rcv <- &cluster.Msg{}
 	rcv <- &cluster.Msg{}
-	if count > 0 {
-		t.Errorf("aggworkerIncomingAggCmds: Malformed messages should not cause data points, count: %d", count)
+	if atomic.LoadInt32(&count) > 0 {
+		t.Errorf("aggworkerIncomingAggCmds: Malformed messages should not cause data points, count: %d", atomic.LoadInt32(&count))
 	}
 	if !strings.Contains(string(fl.last), "decoding FAILED") {
 		t.Errorf("aggworkerIncomingAggCmds: Malformed messages should log 'decoding FAILED'")
@@ -71,18 +72,18 @@ func Test_aggworkerIncomingAggCmds(t *testing.T) {
 	rcv <- m
 	rcv <- m
 
-	if count < 1 {
+	if atomic.LoadInt32(&count) < 1 {
 		t.Errorf("aggworkerIncomingAggCmds: At least 1 data point should have been sent to dpCh")
 	}
 
 	cmd.Hops = 1000 // exceed maxhops
 	m, _ = cluster.NewMsg(&cluster.Node{}, cmd)
 	rcv <- m // "clear" the loop
-	count = 0
+	atomic.StoreInt32(&count, 0)
 	rcv <- m
 	rcv <- m
-	if count > 1 { // TODO Why 1, shouldn't it be zero?
-		t.Errorf("aggworkerIncomingAggCmds: Hops exceeded should not cause data points, count: %d", count)
+	if atomic.LoadInt32(&count) > 1 { // TODO Why 1, shouldn't it be zero?
+		t.Errorf("aggworkerIncomingAggCmds: Hops exceeded should not cause data points, count: %d", atomic.LoadInt32(&count))
 	}
 	if !strings.Contains(string(fl.last), "max hops") {
 		t.Errorf("aggworkerIncomingAggCmds: Hops exceeded messages should log 'max hops'")
@@ -96,7 +97,7 @@ func Test_aggworkerIncomingAggCmds(t *testing.T) {
 	rcv <- m
 
 	// Closing the channel exists (not sure how to really test for that)
-	go aggWorkerIncomingAggCmds(ident, rcv, aggCh)
+	go aggWorkerIncomingAggCmds(ident, rcv, aggCh, 2)
 	close(rcv)
 }
 
@@ -139,44 +140,54 @@ func Test_aggworkerPeriodicFlushSignal(t *testing.T) {
 
 func Test_aggworkerForwardACToNode(t *testing.T) {
 	ac := aggregator.NewCommand(aggregator.CmdAdd, serde.Ident{"name": "foo"}, 123)
-	md := make([]byte, 20)
+	md := make([]byte, 64)
 	md[0] = 1 // Ready
 	node := &cluster.Node{Node: &memberlist.Node{Meta: md}}
 	snd := make(chan *cluster.Msg)
 
-	count := 0
+	var count int32
 	go func() {
 		for {
 			if _, ok := <-snd; !ok {
 				break
 			}
-			count++
+			atomic.AddInt32(&count, 1)
 		}
 	}()
 
 	// if hops is > 0, nothing happens
 	ac.Hops = 1
-	aggWorkerForwardACToNode(ac, node, snd)
-	aggWorkerForwardACToNode(ac, node, snd)
+	aggWorkerForwardACToNode(ac, node, snd, 1)
+	aggWorkerForwardACToNode(ac, node, snd, 1)
 
-	if count > 0 {
+	if atomic.LoadInt32(&count) > 0 {
 		t.Errorf("aggWorkerForwardACToNode: Agg command with hops > 0 should not be forwarded")
 	}
 
 	// otherwise it should work
 	ac.Hops = 0
-	aggWorkerForwardACToNode(ac, node, snd)
+	aggWorkerForwardACToNode(ac, node, snd, 1)
 	ac.Hops = 0 // because it just got incremented
-	aggWorkerForwardACToNode(ac, node, snd)
+	aggWorkerForwardACToNode(ac, node, snd, 1)
 
-	if count < 1 {
+	if atomic.LoadInt32(&count) < 1 {
 		t.Errorf("aggWorkerForwardACToNode: Agg command not sent to channel?")
 	}
 
+	// with maxForwards > 1 a forwarded command can be forwarded again
+	atomic.StoreInt32(&count, 0)
+	ac.Hops = 1
+	aggWorkerForwardACToNode(ac, node, snd, 2)
+	ac.Hops = 1
+	aggWorkerForwardACToNode(ac, node, snd, 2)
+	if atomic.LoadInt32(&count) < 1 {
+		t.Errorf("aggWorkerForwardACToNode: Agg command with hops < maxForwards not forwarded")
+	}
+
 	// mark node not Ready
 	md[0] = 0
 	ac.Hops = 0 // because it just got incremented
-	if err := aggWorkerForwardACToNode(ac, node, snd); err == nil {
+	if err := aggWorkerForwardACToNode(ac, node, snd, 1); err == nil {
 		t.Errorf("aggWorkerForwardACToNode: not ready node should cause an error")
 	}
 
@@ -193,7 +204,7 @@ func Test_aggworkerProcessOrForward(t *testing.T) {
 
 	saveFn := aggWorkerForwardACToNode
 	forward, fwErr := 0, error(nil)
-	aggWorkerForwardACToNode = func(ac *aggregator.Command, node *cluster.Node, snd chan *cluster.Msg) error {
+	aggWorkerForwardACToNode = func(ac *aggregator.Command, node *cluster.Node, snd chan *cluster.Msg, maxForwards int) error {
 		forward++
 		return fwErr
 	}
@@ -204,15 +215,15 @@ func Test_aggworkerProcessOrForward(t *testing.T) {
 
 	// cluster
 	clstr := &fakeCluster{}
-	md := make([]byte, 20)
+	md := make([]byte, 64)
 	md[0] = 1 // Ready
 	node := &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "local"}}
 	clstr.nodesForDd = []*cluster.Node{node}
 	clstr.ln = node
 
 	// Test if we are LocalNode
-	aggWorkerProcessOrForward(ac, aggDd, clstr, nil)
-	aggWorkerProcessOrForward(ac, aggDd, clstr, nil)
+	aggWorkerProcessOrForward(ac, aggDd, clstr, nil, 1)
+	aggWorkerProcessOrForward(ac, aggDd, clstr, nil, 1)
 	if agg.pcCalled < 1 {
 		t.Errorf("aggWorkerProcessOrForward: agg.ProcessCmd() not called")
 	}
@@ -221,7 +232,7 @@ func Test_aggworkerProcessOrForward(t *testing.T) {
 	remote := &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "remote"}}
 	clstr.nodesForDd = []*cluster.Node{remote}
 
-	n := aggWorkerProcessOrForward(ac, aggDd, clstr, nil)
+	n := aggWorkerProcessOrForward(ac, aggDd, clstr, nil, 1)
 	if forward != 1 {
 		t.Errorf("aggWorkerProcessOrForward: aggWorkerForwardDPToNode not called")
 	}
@@ -237,7 +248,7 @@ func Test_aggworkerProcessOrForward(t *testing.T) {
 	}()
 
 	fwErr = fmt.Errorf("some error")
-	n = aggWorkerProcessOrForward(ac, aggDd, clstr, nil)
+	n = aggWorkerProcessOrForward(ac, aggDd, clstr, nil, 1)
 	if n != 0 {
 		t.Errorf("aggWorkerProcessOrForward: return value != 0")
 	}
@@ -268,7 +279,7 @@ func Test_aggworker_theAggworker(t *testing.T) {
 
 	// cluster with a node
 	clstr := &fakeCluster{}
-	md := make([]byte, 20)
+	md := make([]byte, 64)
 	md[0] = 1 // Ready
 	node := &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "local"}}
 	clstr.nodesForDd = []*cluster.Node{node}
@@ -277,7 +288,7 @@ func Test_aggworker_theAggworker(t *testing.T) {
 	saveFn1, saveFn2, saveFn3 := aggWorkerIncomingAggCmds, aggWorkerPeriodicFlushSignal, aggWorkerProcessOrForward
 
 	aiacCalled := 0
-	aggWorkerIncomingAggCmds = func(ident string, rcv chan *cluster.Msg, aggCh chan *aggregator.Command) {
+	aggWorkerIncomingAggCmds = func(ident string, rcv chan *cluster.Msg, aggCh chan *aggregator.Command, maxHops int) {
 		aiacCalled++
 	}
 
@@ -292,7 +303,7 @@ func Test_aggworker_theAggworker(t *testing.T) {
 	}
 
 	awpofCalled := 0
-	aggWorkerProcessOrForward = func(ac *aggregator.Command, aggDd *distDatumAggregator, clstr clusterer, snd chan *cluster.Msg) (forwarded int) {
+	aggWorkerProcessOrForward = func(ac *aggregator.Command, aggDd *distDatumAggregator, clstr clusterer, snd chan *cluster.Msg, maxForwards int) (forwarded int) {
 		awpofCalled++
 		return 1
 	}
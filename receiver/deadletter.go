@@ -0,0 +1,169 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// A DeadLetter is a data point (or a line of input) that was dropped,
+// along with the reason it was dropped.
+type DeadLetter struct {
+	Time   time.Time // when it was dropped
+	Reason string    // e.g. "no_spec", "nan", "create_limit", "parse"
+	Data   string
+}
+
+func (dl *DeadLetter) String() string {
+	return fmt.Sprintf("%s %s %s", dl.Time.Format(time.RFC3339), dl.Reason, dl.Data)
+}
+
+// Dead letter reasons
+const (
+	DeadNoSpec        = "no_spec"        // no DS spec matched the name
+	DeadNaN           = "nan"            // the value was NaN or ±Inf
+	DeadCreateLimit   = "create_limit"   // new DS limit was reached
+	DeadCreateBreaker = "create_breaker" // the DS creation breaker was open
+	DeadParse         = "parse"          // the input could not be parsed
+	DeadOutOfBounds   = "out_of_bounds"  // the value was outside the DS bounds
+	DeadBackfill      = "backfill"       // too old to be backfilled
+	DeadForward       = "forward"        // could not be forwarded to another node
+	DeadLoad          = "load"           // the DS could not be loaded or created
+)
+
+// The default size at which the dead letter file is rotated.
+const dftDeadLetterMaxSize = 10 * 1024 * 1024
+
+// deadLetterWriter writes dead letters to a file and/or a channel. It
+// never blocks the caller: dead letters that do not fit in its buffer
+// are discarded and counted. The file is capped at maxSize, when it is
+// reached, it is renamed by appending ".1" (replacing the previous
+// one) and a new file is started.
+type deadLetterWriter struct {
+	ch       chan *DeadLetter
+	out      chan<- *DeadLetter
+	path     string
+	maxSize  int64
+	f        *os.File
+	size     int64
+	overflow int64 // atomic
+}
+
+// newDeadLetterWriter returns a deadLetterWriter, or nil if neither
+// a path nor a channel is given.
+func newDeadLetterWriter(path string, maxSize int64, out chan<- *DeadLetter) (*deadLetterWriter, error) {
+	if path == "" && out == nil {
+		return nil, nil
+	}
+	w := &deadLetterWriter{
+		ch:      make(chan *DeadLetter, 1024),
+		out:     out,
+		path:    path,
+		maxSize: maxSize,
+	}
+	if w.maxSize <= 0 {
+		w.maxSize = dftDeadLetterMaxSize
+	}
+	if path != "" {
+		if err := w.open(); err != nil {
+			return nil, err
+		}
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *deadLetterWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size = f, fi.Size()
+	return nil
+}
+
+// add queues a dead letter. It is safe to call on a nil writer.
+func (w *deadLetterWriter) add(reason, data string) {
+	if w == nil {
+		return
+	}
+	select {
+	case w.ch <- &DeadLetter{Time: time.Now(), Reason: reason, Data: data}:
+	default:
+		atomic.AddInt64(&w.overflow, 1)
+	}
+}
+
+// addDP queues a dropped data point.
+func (w *deadLetterWriter) addDP(reason string, dp *incomingDP) {
+	if w == nil {
+		return
+	}
+	w.add(reason, fmt.Sprintf("%s %d %v", dp.cachedIdent.String(), dp.timeStamp.Unix(), dp.value))
+}
+
+// takeOverflow returns the number of dead letters discarded since
+// the last call.
+func (w *deadLetterWriter) takeOverflow() int64 {
+	if w == nil {
+		return 0
+	}
+	return atomic.SwapInt64(&w.overflow, 0)
+}
+
+func (w *deadLetterWriter) run() {
+	for dl := range w.ch {
+		if w.out != nil {
+			select {
+			case w.out <- dl:
+			default:
+				atomic.AddInt64(&w.overflow, 1)
+			}
+		}
+		if w.f != nil {
+			w.write(dl)
+		}
+	}
+}
+
+func (w *deadLetterWriter) write(dl *DeadLetter) {
+	line := dl.String() + "\n"
+	if w.size > 0 && w.size+int64(len(line)) > w.maxSize {
+		w.f.Close()
+		w.f = nil
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			log.Printf("deadLetterWriter: error rotating %q: %v", w.path, err)
+		}
+		if err := w.open(); err != nil {
+			log.Printf("deadLetterWriter: error opening %q: %v, dead letters will not be written to it.", w.path, err)
+			return
+		}
+	}
+	n, err := w.f.WriteString(line)
+	w.size += int64(n)
+	if err != nil {
+		log.Printf("deadLetterWriter: error writing to %q: %v", w.path, err)
+	}
+}
@@ -0,0 +1,84 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_deadletter_newDeadLetterWriter(t *testing.T) {
+	if w, err := newDeadLetterWriter("", 0, nil); w != nil || err != nil {
+		t.Errorf("newDeadLetterWriter: without a path or channel should return nil")
+	}
+	var w *deadLetterWriter
+	w.add(DeadParse, "foo")
+	if w.takeOverflow() != 0 {
+		t.Errorf("nil deadLetterWriter should do nothing")
+	}
+	if _, err := newDeadLetterWriter("/nonexistent/dir/dead.log", 0, nil); err == nil {
+		t.Errorf("newDeadLetterWriter: expected an error for a bad path")
+	}
+}
+
+func Test_deadletter_write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres-deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead.log")
+
+	ch := make(chan *DeadLetter, 10)
+	w, err := newDeadLetterWriter(path, 100, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dp := &incomingDP{cachedIdent: newCachedIdent(serde.Ident{"name": "foo"}), timeStamp: time.Unix(1000, 0), value: 123}
+	w.addDP(DeadNoSpec, dp)
+	dl := <-ch
+	if dl.Reason != DeadNoSpec || !strings.Contains(dl.Data, "foo") || !strings.HasSuffix(dl.Data, " 1000 123") {
+		t.Errorf("addDP: unexpected dead letter: %v", dl)
+	}
+
+	// the three lines do not fit in 100 bytes, so the file is rotated
+	w.add(DeadParse, "bad line")
+	<-ch
+	w.add(DeadParse, "another bad line")
+	<-ch
+
+	// the channel is sent to before the file is written
+	var b []byte
+	for i := 0; i < 100; i++ {
+		if b, _ = ioutil.ReadFile(path); strings.Contains(string(b), "another bad line") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(string(b), " parse another bad line\n") || strings.Contains(string(b), "no_spec") {
+		t.Errorf("write: unexpected file contents: %q", string(b))
+	}
+	if b, _ := ioutil.ReadFile(path + ".1"); !strings.Contains(string(b), "bad line") {
+		t.Errorf("write: rotated file should contain previous lines: %q", string(b))
+	}
+}
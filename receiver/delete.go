@@ -0,0 +1,70 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// DeleteDataSources deletes the DSs selected by q (see
+// serde.DeleteDataSources) and drops them from the cache, so that
+// data points for them create them anew. If dryRun is set, the DSs
+// are only returned.
+func (r *Receiver) DeleteDataSources(q serde.DeleteQuery, dryRun bool) (map[int64]serde.Ident, error) {
+	db, ok := r.dsc.db.(serde.DataSourceRemover)
+	if !ok {
+		return nil, fmt.Errorf("deleting DSs is not supported by this serde")
+	}
+	deleted, err := serde.DeleteDataSources(db, q, dryRun)
+	if !dryRun {
+		for id, ident := range deleted {
+			if ident == nil {
+				if ident = r.dsc.identById(id); ident == nil {
+					continue // not cached
+				}
+				deleted[id] = ident
+			}
+			r.dsc.delete(ident)
+		}
+		if len(deleted) > 0 {
+			log.Printf("DeleteDataSources(): deleted %d DSs.", len(deleted))
+		}
+	}
+	return deleted, err
+}
+
+// identById returns the ident of the cached DS with this id, or nil.
+func (d *dsCache) identById(id int64) serde.Ident {
+	d.RLock()
+	all := make([]*cachedDs, 0, len(d.byIdent))
+	for _, cds := range d.byIdent {
+		all = append(all, cds)
+	}
+	d.RUnlock()
+
+	for _, cds := range all {
+		cds.mu.Lock()
+		match := cds.Id() == id
+		cds.mu.Unlock()
+		if match {
+			return cds.Ident()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_Receiver_DeleteDataSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := serde.InitFileDb(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := &rrd.DSSpec{Step: time.Second, Heartbeat: time.Minute, RRAs: []rrd.RRASpec{
+		{Function: rrd.WMEAN, Step: time.Second, Span: 10 * time.Second},
+	}}
+	r := &Receiver{dsc: newDsCache(db, nil, nil)}
+	for _, name := range []string{"foo.a", "foo.b", "bar"} {
+		ds, err := db.FetchOrCreateDataSource(serde.Ident{"name": name}, spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.dsc.insert(&cachedDs{DbDataSourcer: ds.(serde.DbDataSourcer), mu: &sync.Mutex{}})
+	}
+
+	deleted, err := r.DeleteDataSources(serde.DeleteQuery{Glob: "foo.*"}, true)
+	if err != nil || len(deleted) != 2 || r.dsc.stats().dsCount != 3 {
+		t.Errorf("DeleteDataSources: (dry run) expected 2 and none dropped, got %v %v", deleted, err)
+	}
+	deleted, err = r.DeleteDataSources(serde.DeleteQuery{Ids: []int64{3}, Match: serde.SearchQuery{"name": "^foo\\.a$"}}, false)
+	if err != nil || len(deleted) != 2 || deleted[3]["name"] != "bar" {
+		t.Errorf("DeleteDataSources: expected foo.a and bar, got %v %v", deleted, err)
+	}
+	if n := r.dsc.stats().dsCount; n != 1 || r.dsc.getByIdent(newCachedIdent(serde.Ident{"name": "foo.b"})) == nil {
+		t.Errorf("DeleteDataSources: expected only foo.b cached, got %d", n)
+	}
+
+	r.dsc.db = &fakeSerde{}
+	if _, err := r.DeleteDataSources(serde.DeleteQuery{Glob: "*"}, false); err == nil {
+		t.Errorf("DeleteDataSources: expected an error for a serde that cannot delete")
+	}
+}
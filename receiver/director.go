@@ -24,9 +24,10 @@ import (
 	"time"
 
 	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/rrd"
 )
 
-var directorIncomingDPMessages = func(rcv chan *cluster.Msg, dpCh chan<- interface{}) {
+var directorIncomingDPMessages = func(rcv chan *cluster.Msg, dpCh chan<- interface{}, maxHops int) {
 	defer func() { recover() }() // if we're writing to a closed channel below
 
 	for {
@@ -36,24 +37,26 @@ var directorIncomingDPMessages = func(rcv chan *cluster.Msg, dpCh chan<- interfa
 		}
 
 		// To get an event back:
-		var dp incomingDP
-		if err := m.Decode(&dp); err != nil {
+		dp := newIncomingDP()
+		if err := m.Decode(dp); err != nil {
 			log.Printf("director: msg <- rcv data point decoding FAILED, ignoring this data point.")
+			dp.release()
 			continue
 		}
 
-		maxHops := 2
 		if dp.Hops > maxHops {
 			log.Printf("director: dropping data point, max hops (%d) reached", maxHops)
+			dp.release()
 			continue
 		}
 
-		dpCh <- &dp // See recover above
+		dp.arrived = time.Now()
+		dpCh <- dp // See recover above
 	}
 }
 
-var directorForwardDPToNode = func(dp *incomingDP, node *cluster.Node, snd chan *cluster.Msg) error {
-	if dp.Hops == 0 { // we do not forward more than once
+var directorForwardDPToNode = func(dp *incomingDP, node *cluster.Node, snd chan *cluster.Msg, maxForwards int) error {
+	if dp.Hops < maxForwards { // we do not forward more than maxForwards times
 		if node.Ready() {
 			dp.Hops++
 			msg, _ := cluster.NewMsg(node, dp) // can't possibly error
@@ -65,9 +68,9 @@ var directorForwardDPToNode = func(dp *incomingDP, node *cluster.Node, snd chan
 	return nil
 }
 
-var directorProcessDataPoint = func(cds *cachedDs, dsf dsFlusherBlocking) (int, int) {
+var directorProcessDataPoint = func(cds *cachedDs, dsf dsFlusherBlocking, lat *latencyHistogram) (int, int) {
 
-	cnt, blk, err := cds.processIncoming()
+	cnt, blk, err := cds.processIncoming(lat)
 	if err != nil {
 		if !strings.Contains(err.Error(), "not greater than data source") {
 			log.Printf("directorProcessDataPoint [%v] error: %v", cds.Ident(), err)
@@ -86,56 +89,138 @@ var directorProcessDataPoint = func(cds *cachedDs, dsf dsFlusherBlocking) (int,
 	return cnt, blk
 }
 
-var directorProcessOrForward = func(dsc *dsCache, cds *cachedDs, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats) {
+var directorProcessOrForward = func(dsc *dsCache, cds *cachedDs, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats, maxForwards int) {
 	if clstr == nil {
 		workerCh <- cds
 		return
 	}
 
-	for _, node := range clstr.NodesForDistDatum(&distDs{DbDataSourcer: cds.DbDataSourcer, dsc: dsc}) {
-		if node.Name() == clstr.LocalNode().Name() {
-			workerCh <- cds
-		} else {
-			for _, dp := range cds.incoming {
-				if err := directorForwardDPToNode(dp, node, snd); err != nil {
+	// With cluster-replicas above 1 there are several nodes, all of
+	// which apply the points. Points that arrived from another node
+	// were sent to every replica by it and are only applied.
+	nodes := clstr.NodesForDistDatum(&distDs{DbDataSourcer: cds.DbDataSourcer, dsc: dsc})
+	ln := clstr.LocalNode()
+	local := false
+	for _, node := range nodes {
+		local = local || node.Name() == ln.Name()
+	}
+
+	if local && len(nodes) == 1 {
+		workerCh <- cds // nothing to forward
+		return
+	}
+
+	// A worker may be processing (and releasing) the points of a
+	// local DS concurrently, so they are taken under the lock. Those
+	// staying for a worker are copied, once, the rest are forwarded
+	// from here and the DS is cleared.
+	var fwd []*incomingDP
+	cds.mu.Lock()
+	if local {
+		for _, dp := range cds.incoming {
+			if !dp.forwarded && dp.Hops == 0 {
+				cp := newIncomingDP()
+				*cp = *dp
+				fwd = append(fwd, cp)
+			}
+			dp.forwarded = true
+		}
+	} else {
+		fwd, cds.incoming = cds.incoming, nil
+		// Always clear RRAs to prevent it from being saved
+		if pc := cds.PointCount(); pc > 0 {
+			log.Printf("director: WARNING: Clearing DS with PointCount > 0: %v", pc)
+		}
+		cds.ClearRRAs()
+	}
+	cds.mu.Unlock()
+
+	for _, dp := range fwd {
+		hops := dp.Hops
+		for _, node := range nodes {
+			if node.Name() == ln.Name() {
+				continue
+			}
+			// as it arrived, for every replica
+			dp.Hops = hops
+			if dsc.fwdRetry.has(node) { // older points first
+				if !dsc.fwdRetry.add(dp, node) {
+					dsc.deadLetter.addDP(DeadForward, dp)
+				}
+			} else if err := directorForwardDPToNode(dp, node, snd, maxForwards); err != nil {
+				// The node is not ready, try again later
+				if !dsc.fwdRetry.add(dp, node) {
 					log.Printf("director: Error forwarding a data point: %v", err)
-					// TODO For not ready error - sleep and return the dp to the channel?
-					continue
+					dsc.deadLetter.addDP(DeadForward, dp)
 				}
+			} else {
 				stats.forwarded++
 				stats.forwarded_to[node.SanitizedAddr()]++
 			}
-			cds.incoming = nil
-			// Always clear RRAs to prevent it from being saved
-			if pc := cds.PointCount(); pc > 0 {
-				log.Printf("director: WARNING: Clearing DS with PointCount > 0: %v", pc)
-			}
-			cds.ClearRRAs()
 		}
+		dp.release()
+	}
+
+	if local {
+		workerCh <- cds
 	}
-	return
 }
 
-var directorProcessIncomingDP = func(dp *incomingDP, dsc *dsCache, loaderCh chan interface{}, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats) {
+var directorProcessIncomingDP = func(dp *incomingDP, dsc *dsCache, loaderCh chan interface{}, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats, maxForwards int, filter *dpFilter) {
+
+	if math.IsNaN(dp.value) || math.IsInf(dp.value, 0) {
+		// The NaN policy is that of the DS, or, before creating
+		// a DS for it, of the spec that matches it.
+		policy := rrd.NaNDrop
+		if cds := dsc.getByIdent(dp.cachedIdent); cds != nil {
+			policy = cds.nan
+		} else if finder := dsc.finderFor(dp.specSet); finder != nil {
+			if spec := finder.FindMatchingDSSpec(dp.cachedIdent.Ident); spec != nil {
+				policy = spec.NaN
+			}
+		}
+		if !directorApplyNaNPolicy(dp, policy, dsc, stats) {
+			dp.release()
+			return
+		}
+	}
 
-	if math.IsNaN(dp.value) {
-		// NaN is meaningless, e.g. "the thermometer is
-		// registering a NaN". Or it means that "for certain it is
-		// offline", but that is not part of our scope. You can
-		// only get a NaN by exceeding HB. Silently ignore it.
+	if !filter.allow(dp.cachedIdent.Ident["name"]) {
+		stats.filtered++
+		dp.release()
 		return
 	}
 
-	cds := dsc.getByIdentOrCreateEmpty(dp.cachedIdent)
+	cds := dsc.getByIdentOrCreateEmptyWith(dp.cachedIdent, dsc.finderFor(dp.specSet))
 	if cds == nil {
 		stats.unknown++
 		if debug {
 			log.Printf("director: No spec matched ident: %#v, ignoring data point", dp.cachedIdent.String())
 		}
+		if dsc.deadLetter != nil {
+			// A nil cds is either no spec match, the breaker
+			// or the new DS limit
+			reason := DeadNoSpec
+			if dsc.finderFor(dp.specSet).FindMatchingDSSpec(dp.cachedIdent.Ident) != nil {
+				reason = DeadCreateLimit
+				if dsc.breaker.isOpen() {
+					reason = DeadCreateBreaker
+				}
+			}
+			dsc.deadLetter.addDP(reason, dp)
+		}
+		dp.release()
 		return
 	}
 
-	cds.appendIncoming(dp)
+	if directorApplyBounds(dp, cds, dsc, stats) {
+		cds.appendIncoming(dp)
+	} else {
+		dp.release()
+		if cds.Id() != 0 {
+			return // a new DS is loaded regardless, so it does not linger unloaded
+		}
+	}
 
 	if cds.Id() == 0 { // this DS needs to be loaded.
 		if !cds.sentToLoader {
@@ -143,14 +228,58 @@ var directorProcessIncomingDP = func(dp *incomingDP, dsc *dsCache, loaderCh chan
 			loaderCh <- cds
 		}
 	} else {
-		directorProcessOrForward(dsc, cds, workerCh, clstr, snd, stats)
+		directorProcessOrForward(dsc, cds, workerCh, clstr, snd, stats, maxForwards)
+	}
+}
+
+// directorApplyNaNPolicy applies a NaN policy to a data point whose
+// value is NaN or ±Inf and counts it. It returns false if the data
+// point should be dropped. NaNLast is applied later by
+// processIncoming(), which knows the previous value.
+func directorApplyNaNPolicy(dp *incomingDP, policy rrd.NaNPolicy, dsc *dsCache, stats *dpStats) bool {
+	stats.nan[policy]++
+	switch policy {
+	case rrd.NaNZero:
+		dp.value = 0
+	case rrd.NaNLast, rrd.NaNGap:
+		dp.value = math.NaN() // also ±Inf
+	default:
+		// NaN is usually meaningless, e.g. "the thermometer is
+		// registering a NaN". Or it means that "for certain it is
+		// offline", which is what rrd.NaNGap is for.
+		dsc.deadLetter.addDP(DeadNaN, dp)
+		return false
 	}
+	return true
+}
+
+// directorApplyBounds checks the data point value against the DS
+// bounds, if any, clamping it if so configured. It returns false if
+// the data point should be dropped.
+func directorApplyBounds(dp *incomingDP, cds *cachedDs, dsc *dsCache, stats *dpStats) bool {
+	if cds.bounds == nil {
+		return true
+	}
+	value, ok := cds.bounds.Apply(dp.value)
+	if !ok {
+		stats.outOfBounds++
+		dsc.deadLetter.addDP(DeadOutOfBounds, dp)
+		return false
+	}
+	if value != dp.value {
+		stats.clamped++
+		dp.value = value
+	}
+	return true
 }
 
 func reportOverrunQueueSize(queue *fifoQueue, sr statReporter, nap time.Duration) {
 	for {
 		time.Sleep(nap) // TODO this should be a ticker really
 		sr.reportStatGauge("receiver.queue_len", float64(queue.size()))
+		dropped, blocked := queue.overflows()
+		sr.reportStatCount("receiver.queue.overflow_dropped", float64(dropped))
+		sr.reportStatCount("receiver.queue.overflow_blocked", float64(blocked))
 	}
 }
 
@@ -172,22 +301,27 @@ var loader = func(loaderCh chan interface{}, dpCh chan<- interface{}, dsc *dsCac
 		}
 	}()
 
-	for {
-		x, ok := <-loaderCh
-		if !ok {
-			log.Printf("loader: channel closed, closing director channel and exiting...")
-			close(dpCh)
-			log.Printf("loader: exiting.")
-			return
-		}
-
-		cds := x.(*cachedDs)
-
+	lr := newLoadRetrier(dsc.loadRetries, dsc.loadBreakerThreshold)
+	load := func(r *loadRetry, probe bool) {
+		cds := r.cds
 		if cds.spec != nil { // nil spec means it's been loaded already
-			if err := dsc.fetchOrCreateByIdent(cds); err != nil {
+			if !probe && !lr.allow() {
+				lr.keep(cds)
+				return
+			}
+			if err := dsc.fetchOrCreateByIdent(cds); err == errCreateRefused {
+				lr.success()
+				dsc.dropRefused(cds)
+				return
+			} else if err != nil {
 				log.Printf("loader: database error: %v", err)
-				continue
+				if !lr.failure(r) {
+					log.Printf("loader: giving up on loading %s.", cds.Ident())
+					dsc.dropUnloaded(cds, DeadLoad)
+				}
+				return
 			}
+			lr.success()
 		}
 
 		if cds.Created() {
@@ -196,16 +330,49 @@ var loader = func(loaderCh chan interface{}, dpCh chan<- interface{}, dsc *dsCac
 
 		dpCh <- cds
 	}
+
+	tick := time.NewTicker(250 * time.Millisecond)
+	defer tick.Stop()
+	var lastReport time.Time
+	for {
+		select {
+		case x, ok := <-loaderCh:
+			if !ok {
+				if pending := lr.drain(); len(pending) > 0 {
+					log.Printf("loader: dropping %d DSs that could not be loaded.", len(pending))
+					for _, r := range pending {
+						dsc.dropUnloaded(r.cds, DeadLoad)
+					}
+				}
+				log.Printf("loader: channel closed, closing director channel and exiting...")
+				close(dpCh)
+				log.Printf("loader: exiting.")
+				return
+			}
+			load(&loadRetry{cds: x.(*cachedDs)}, false)
+		case <-tick.C:
+			probe := !lr.allow()
+			for _, r := range lr.due() {
+				load(r, probe)
+			}
+			if time.Now().Sub(lastReport) >= time.Second {
+				lr.report(sr)
+				lastReport = time.Now()
+			}
+		}
+	}
 }
 
 type dpStats struct {
-	total, forwarded, unknown, dropped int
-	forwarded_to                       map[string]int
-	last                               time.Time
+	total, forwarded, unknown, dropped, filtered int
+	outOfBounds, clamped                         int
+	nan                                          [rrd.NaNGap + 1]int // by NaN policy
+	forwarded_to                                 map[string]int
+	last                                         time.Time
 }
 
 var director = func(wc wController, dpChIn chan<- interface{}, dpChOut <-chan interface{}, nWorkers int, clstr clusterer,
-	sr statReporter, dsc *dsCache, dsf dsFlusherBlocking, queue *fifoQueue, maxQLen int, maxMem uint64) {
+	sr statReporter, dsc *dsCache, dsf dsFlusherBlocking, queue *fifoQueue, maxMem uint64, maxHops, maxForwards int, filter *dpFilter) {
 	wc.onEnter()
 	defer wc.onExit()
 
@@ -217,9 +384,13 @@ var director = func(wc wController, dpChIn chan<- interface{}, dpChOut <-chan in
 	if clstr != nil {
 		clusterChgCh = clstr.NotifyClusterChanges() // Monitor Cluster changes
 		snd, rcv = clstr.RegisterMsgType()          // Channel for event forwards to other nodes and us
-		go directorIncomingDPMessages(rcv, dpChIn)
+		go directorIncomingDPMessages(rcv, dpChIn, maxHops)
 		log.Printf("director: marking cluster node as Ready.")
 		clstr.Ready(true)
+		// Not in the loop below, which Transition blocks
+		if ts, ok := clstr.(transitionStatuser); ok {
+			go reportTransitionStats(ts, sr, time.Second)
+		}
 	}
 
 	if queue != nil {
@@ -247,6 +418,13 @@ var director = func(wc wController, dpChIn chan<- interface{}, dpChOut <-chan in
 
 	stats := dpStats{forwarded_to: make(map[string]int), last: time.Now()}
 
+	var retryCh <-chan time.Time // forward retries, if any
+	if clstr != nil && dsc.fwdRetry != nil {
+		retryTick := time.NewTicker(fwdRetryMinBackoff)
+		defer retryTick.Stop()
+		retryCh = retryTick.C
+	}
+
 	for {
 		var (
 			x   interface{}
@@ -263,6 +441,9 @@ var director = func(wc wController, dpChIn chan<- interface{}, dpChOut <-chan in
 				}
 			}
 			continue
+		case <-retryCh:
+			dsc.fwdRetry.retry(snd, &stats, maxForwards)
+			continue
 		case x, ok = <-dpChOut:
 			switch x := x.(type) {
 			case *incomingDP:
@@ -289,18 +470,20 @@ var director = func(wc wController, dpChIn chan<- interface{}, dpChOut <-chan in
 				memoryChecked = time.Now()
 			}
 
-			if (maxMem > 0 && currentMemory > maxMem) || (queue != nil && maxQLen > 0 && queue.size() > maxQLen) {
+			// NB: The queue size limit is enforced by elasticCh
+			// according to the queue overflow policy.
+			if maxMem > 0 && currentMemory > maxMem {
 				stats.dropped++
 				// this data poind goes to /dev/null
 			} else {
 				// if the dp ident is not found, it will be submitted to
 				// the loader, which will return it to us through the dpCh
 				// as a cachedDs.
-				directorProcessIncomingDP(dp, dsc, loaderCh, workerCh, clstr, snd, &stats)
+				directorProcessIncomingDP(dp, dsc, loaderCh, workerCh, clstr, snd, &stats, maxForwards, filter)
 			}
 		} else if cds != nil {
 			// this came from the loader, we do not need to look it up
-			directorProcessOrForward(dsc, cds, workerCh, clstr, snd, &stats)
+			directorProcessOrForward(dsc, cds, workerCh, clstr, snd, &stats, maxForwards)
 		} else {
 			// wait for worker and loader channels to empty
 			log.Printf("director: channel closed, waiting for loader and workers to empty...")
@@ -329,16 +512,50 @@ var director = func(wc wController, dpChIn chan<- interface{}, dpChOut <-chan in
 			sr.reportStatCount("receiver.datapoints.total", float64(stats.total))
 			sr.reportStatCount("receiver.datapoints.dropped", float64(stats.dropped)) // this too might be dropped...
 			sr.reportStatCount("receiver.datapoints.unknown", float64(stats.unknown))
+			sr.reportStatCount("receiver.datapoints.create_limited", float64(dsc.limiter.takeDropped()))
+			dsc.breaker.report(sr)
+			sr.reportStatCount("receiver.datapoints.filtered", float64(stats.filtered))
+			sr.reportStatCount("receiver.datapoints.out_of_bounds", float64(stats.outOfBounds))
+			sr.reportStatCount("receiver.datapoints.clamped", float64(stats.clamped))
+			for p, cnt := range stats.nan {
+				sr.reportStatCount(fmt.Sprintf("receiver.datapoints.nan.%v", rrd.NaNPolicy(p)), float64(cnt))
+			}
+			sr.reportStatCount("receiver.datapoints.backfill_rejected", float64(dsc.takeBackfillRejected()))
+			sr.reportStatCount("receiver.dead_letter.overflow", float64(dsc.deadLetter.takeOverflow()))
+			filter.reportStats(sr)
 			sr.reportStatCount("receiver.datapoints.forwarded", float64(stats.forwarded))
 			for dest, cnt := range stats.forwarded_to {
 				sr.reportStatCount(fmt.Sprintf("receiver.forwarded_to.%s", dest), float64(cnt))
 			}
+			if clstr != nil {
+				for _, qs := range clstr.SendQueueStats() {
+					sr.reportStatGauge(fmt.Sprintf("receiver.send_queue.%s.len", qs.Addr), float64(qs.Len))
+					sr.reportStatCount(fmt.Sprintf("receiver.send_queue.%s.sent", qs.Addr), float64(qs.Sent))
+					sr.reportStatCount(fmt.Sprintf("receiver.send_queue.%s.dropped", qs.Addr), float64(qs.Dropped))
+					sr.reportStatGauge(fmt.Sprintf("receiver.send_queue.%s.latency_ms", qs.Addr), qs.Latency.Seconds()*1000)
+				}
+			}
+			if dsc.fwdRetry != nil {
+				sr.reportStatCount("receiver.forward_retry.overflow", float64(dsc.fwdRetry.takeOverflow()))
+				sr.reportStatGauge("receiver.forward_retry.pending", float64(dsc.fwdRetry.pending()))
+				spooled, replayed, dropped := dsc.fwdRetry.spool.takeStats()
+				sr.reportStatCount("receiver.forward_spool.spooled", float64(spooled))
+				sr.reportStatCount("receiver.forward_spool.replayed", float64(replayed))
+				sr.reportStatCount("receiver.forward_spool.dropped", float64(dropped))
+			}
 			sr.reportStatCount("receiver.created", 0)
 			stats = dpStats{forwarded_to: make(map[string]int), last: time.Now()}
 
+			sr.reportStatCount("receiver.cache.evicted", float64(dsc.evict()))
+			sr.reportStatCount("receiver.cache.unloaded_stale", float64(dsc.unloadStale()))
+			archived, failed := dsc.takeArchived()
+			sr.reportStatCount("receiver.cache.archived", float64(archived))
+			sr.reportStatCount("receiver.cache.archive_failed", float64(failed))
+
 			st := dsc.stats()
 			sr.reportStatGauge("receiver.cache.ds_count", float64(st.dsCount))
 			sr.reportStatGauge("receiver.cache.rra_count", float64(st.rraCount))
+			sr.reportStatGauge("receiver.cache.bytes_estimate", float64(st.memEstimate))
 		}
 	}
 }
@@ -348,19 +565,21 @@ var worker = func(wg *sync.WaitGroup, workerCh chan *cachedDs, dsf dsFlusherBloc
 	defer wg.Done()
 	lastStat := time.Now()
 	accepted, watchBlk := 0, 0
+	lat := newLatencyHistogram(ingestLatencyBuckets)
 	for {
 		cds, ok := <-workerCh
 		if !ok {
 			log.Printf("worker %d: exiting.", n)
 			return
 		}
-		cnt, blk := directorProcessDataPoint(cds, dsf)
+		cnt, blk := directorProcessDataPoint(cds, dsf, lat)
 		accepted += cnt
 		watchBlk += blk
 
 		if lastStat.Before(time.Now().Add(-time.Second)) {
 			sr.reportStatCount("receiver.datapoints.accepted", float64(accepted))
 			sr.reportStatCount("receiver.cache.watch_blocked", float64(watchBlk))
+			lat.report(sr, "receiver.ingest_latency")
 			lastStat = time.Now()
 			accepted, watchBlk = 0, 0
 		}
@@ -20,8 +20,10 @@ import (
 	"log"
 	"math"
 	"os"
+	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -52,23 +54,23 @@ func Test_directorIncomingDPMessages(t *testing.T) {
 	rcv := make(chan *cluster.Msg)
 	dpCh := make(chan interface{})
 
-	count := 0
+	var count int32
 	go func() {
 		for {
 			if _, ok := <-dpCh; !ok {
 				break
 			}
-			count++
+			atomic.AddInt32(&count, 1)
 		}
 	}()
 
-	go directorIncomingDPMessages(rcv, dpCh)
+	go directorIncomingDPMessages(rcv, dpCh, 2)
 
 	// Sending a bogus message should not cause anything be written to dpCh
 	rcv <- &cluster.Msg{}
 	rcv <- &cluster.Msg{} // second send ensures the loop has gone full circle
-	if count > 0 {
-		t.Errorf("Malformed messages should not cause data points, count: %d", count)
+	if atomic.LoadInt32(&count) > 0 {
+		t.Errorf("Malformed messages should not cause data points, count: %d", atomic.LoadInt32(&count))
 	}
 	if !strings.Contains(string(fl.last), "decoding FAILED") {
 		t.Errorf("Malformed messages should log 'decoding FAILED'")
@@ -80,18 +82,18 @@ func Test_directorIncomingDPMessages(t *testing.T) {
 	rcv <- m
 	rcv <- m
 
-	if count < 1 {
+	if atomic.LoadInt32(&count) < 1 {
 		t.Errorf("At least 1 data point should have been sent to dpCh")
 	}
 
 	dp.Hops = 1000 // exceed maxhops (which in fakeCluster is 0?)
 	m, _ = cluster.NewMsg(&cluster.Node{}, dp)
 	rcv <- m // "clear" the loop
-	count = 0
+	atomic.StoreInt32(&count, 0)
 	rcv <- m
 	rcv <- m
-	if count > 0 {
-		t.Errorf("Hops exceeded should not cause data points, count: %d", count)
+	if atomic.LoadInt32(&count) > 0 {
+		t.Errorf("Hops exceeded should not cause data points, count: %d", atomic.LoadInt32(&count))
 	}
 	if !strings.Contains(string(fl.last), "max hops") {
 		t.Errorf("Hops exceeded messages should log 'max hops'")
@@ -105,51 +107,64 @@ func Test_directorIncomingDPMessages(t *testing.T) {
 	rcv <- m
 
 	// Closing the channel exists (not sure how to really test for that)
-	go directorIncomingDPMessages(rcv, dpCh)
+	go directorIncomingDPMessages(rcv, dpCh, 2)
 	close(rcv)
 }
 
 func Test_directorForwardDPToNode(t *testing.T) {
 
 	dp := &incomingDP{cachedIdent: newCachedIdent(serde.Ident{"name": "foo"}), timeStamp: time.Unix(1000, 0), value: 123}
-	md := make([]byte, 20)
+	md := make([]byte, 64)
 	md[0] = 1 // Ready
 	node := &cluster.Node{Node: &memberlist.Node{Meta: md}}
 	snd := make(chan *cluster.Msg)
 
-	count := 0
+	var count int32
 	go func() {
 		for {
 			if _, ok := <-snd; !ok {
 				break
 			}
-			count++
+			atomic.AddInt32(&count, 1)
 		}
 	}()
 
 	// if hops is > 0, nothing happens
 	dp.Hops = 1
-	directorForwardDPToNode(dp, node, snd)
-	directorForwardDPToNode(dp, node, snd)
+	directorForwardDPToNode(dp, node, snd, 1)
+	directorForwardDPToNode(dp, node, snd, 1)
 
-	if count > 0 {
+	if atomic.LoadInt32(&count) > 0 {
 		t.Errorf("directorForwardDPToNode: Data points with hops > 0 should not be forwarded")
 	}
 
 	// otherwise it should work
 	dp.Hops = 0
-	directorForwardDPToNode(dp, node, snd)
+	directorForwardDPToNode(dp, node, snd, 1)
 	dp.Hops = 0 // because it just got incremented
-	directorForwardDPToNode(dp, node, snd)
+	directorForwardDPToNode(dp, node, snd, 1)
 
-	if count < 1 {
+	if atomic.LoadInt32(&count) < 1 {
 		t.Errorf("Data point not sent to channel?")
 	}
 
+	// with maxForwards > 1 a forwarded point can be forwarded again
+	atomic.StoreInt32(&count, 0)
+	dp.Hops = 1
+	directorForwardDPToNode(dp, node, snd, 2)
+	dp.Hops = 1
+	directorForwardDPToNode(dp, node, snd, 2)
+	if atomic.LoadInt32(&count) < 1 {
+		t.Errorf("directorForwardDPToNode: Data point with hops < maxForwards not forwarded")
+	}
+	if dp.Hops != 2 {
+		t.Errorf("directorForwardDPToNode: Hops not incremented: %d", dp.Hops)
+	}
+
 	// mark node not Ready
 	md[0] = 0
 	dp.Hops = 0 // because it just got incremented
-	if err := directorForwardDPToNode(dp, node, snd); err == nil {
+	if err := directorForwardDPToNode(dp, node, snd, 1); err == nil {
 		t.Errorf("not ready node should cause an error")
 	}
 }
@@ -158,7 +173,7 @@ func Test_directorProcessOrForward(t *testing.T) {
 
 	saveFn := directorForwardDPToNode
 	forward, fwErr := 0, error(nil)
-	directorForwardDPToNode = func(dp *incomingDP, node *cluster.Node, snd chan *cluster.Msg) error {
+	directorForwardDPToNode = func(dp *incomingDP, node *cluster.Node, snd chan *cluster.Msg, maxForwards int) error {
 		forward++
 		return fwErr
 	}
@@ -181,26 +196,19 @@ func Test_directorProcessOrForward(t *testing.T) {
 
 	// cluster
 	clstr := &fakeCluster{}
-	md := make([]byte, 20)
+	md := make([]byte, 64)
 	md[0] = 1 // Ready
 	node := &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "local"}}
 	clstr.nodesForDd = []*cluster.Node{node}
 	clstr.ln = node
 
 	// workerChs
-	workerCh := make(chan *cachedDs)
-	sent := 0
-	go func() {
-		for {
-			<-workerCh
-			sent++
-		}
-	}()
+	workerCh := make(chan *cachedDs, 2)
 
 	// Test if we are LocalNode
-	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st)
-	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st)
-	if sent < 1 {
+	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st, 1)
+	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st, 1)
+	if len(workerCh) < 1 {
 		t.Errorf("directorProcessOrForward: Nothing sent to workerChs")
 	}
 
@@ -208,7 +216,7 @@ func Test_directorProcessOrForward(t *testing.T) {
 	remote := &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "remote"}}
 	clstr.nodesForDd = []*cluster.Node{remote}
 
-	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st)
+	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st, 1)
 	if forward != 1 {
 		t.Errorf("directorProcessOrForward: directorForwardDPToNode not called")
 	}
@@ -234,9 +242,9 @@ func Test_directorProcessOrForward(t *testing.T) {
 	}))
 	ds.ProcessDataPoint(123, time.Unix(2000, 0))
 	ds.ProcessDataPoint(123, time.Unix(3000, 0))
-	cds = &cachedDs{DbDataSourcer: ds}
+	cds = &cachedDs{DbDataSourcer: ds, mu: &sync.Mutex{}}
 
-	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st)
+	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st, 1)
 	if !strings.Contains(string(fl.last), "PointCount") {
 		t.Errorf("directorProcessOrForward: Missing the PointCount warning log")
 	}
@@ -248,11 +256,95 @@ func Test_directorProcessOrForward(t *testing.T) {
 	directorForwardDPToNode = saveFn
 }
 
+func Test_directorProcessOrForward_replicas(t *testing.T) {
+	saveFn := directorForwardDPToNode
+	defer func() { directorForwardDPToNode = saveFn }()
+	var forwardedTo []string
+	directorForwardDPToNode = func(dp *incomingDP, node *cluster.Node, snd chan *cluster.Msg, maxForwards int) error {
+		if dp.Hops != 0 {
+			t.Errorf("directorForwardDPToNode: expected hops 0 for every replica, got %d", dp.Hops)
+		}
+		dp.Hops++
+		forwardedTo = append(forwardedTo, node.Name())
+		return nil
+	}
+
+	st := &dpStats{forwarded_to: make(map[string]int), last: time.Now()}
+	db := &fakeSerde{}
+	dsf := &dsFlusher{db: db.Flusher(), sr: &fakeSr{}}
+	dsc := newDsCache(db, &SimpleDSFinder{DftDSSPec}, dsf)
+
+	md := make([]byte, 64)
+	md[0] = 1 // Ready
+	local := &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "local"}}
+	r1 := &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "r1"}}
+	r2 := &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "r2"}}
+	clstr := &fakeCluster{ln: local, nodesForDd: []*cluster.Node{r1, local, r2}}
+
+	workerCh := make(chan *cachedDs, 1)
+	ds := serde.NewDbDataSource(1, serde.Ident{"name": "foo"}, 0, 0, rrd.NewDataSource(*DftDSSPec))
+	cds := &cachedDs{DbDataSourcer: ds, mu: &sync.Mutex{}}
+	cds.appendIncoming(&incomingDP{cachedIdent: newCachedIdent(serde.Ident{"name": "foo"}), timeStamp: time.Unix(1000, 0), value: 1})
+	cds.appendIncoming(&incomingDP{cachedIdent: newCachedIdent(serde.Ident{"name": "foo"}), timeStamp: time.Unix(1001, 0), value: 2, Hops: 1})
+
+	// The point that arrived here goes to both other replicas, the
+	// one from another node is only applied
+	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st, 1)
+	if len(forwardedTo) != 2 || forwardedTo[0] != "r1" || forwardedTo[1] != "r2" {
+		t.Errorf("directorProcessOrForward: expected forwards to r1 and r2, got %v", forwardedTo)
+	}
+	select {
+	case got := <-workerCh:
+		if len(got.incoming) != 2 {
+			t.Errorf("directorProcessOrForward: expected 2 points to apply locally, got %d", len(got.incoming))
+		}
+	default:
+		t.Errorf("directorProcessOrForward: a replica should apply the points")
+	}
+}
+
+func Test_directorProcessOrForward_once(t *testing.T) {
+	saveFn := directorForwardDPToNode
+	defer func() { directorForwardDPToNode = saveFn }()
+	directorForwardDPToNode = func(dp *incomingDP, node *cluster.Node, snd chan *cluster.Msg, maxForwards int) error {
+		return fmt.Errorf("not ready")
+	}
+
+	st := &dpStats{forwarded_to: make(map[string]int), last: time.Now()}
+	db := &fakeSerde{}
+	dsf := &dsFlusher{db: db.Flusher(), sr: &fakeSr{}}
+	dsc := newDsCache(db, &SimpleDSFinder{DftDSSPec}, dsf)
+	dsc.fwdRetry = newForwardRetrier(10, nil)
+
+	md := make([]byte, 64)
+	md[0] = 1 // Ready
+	local := &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "local"}}
+	r1 := &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "r1"}}
+	clstr := &fakeCluster{ln: local, nodesForDd: []*cluster.Node{local, r1}}
+
+	workerCh := make(chan *cachedDs, 2)
+	ds := serde.NewDbDataSource(1, serde.Ident{"name": "foo"}, 0, 0, rrd.NewDataSource(*DftDSSPec))
+	cds := &cachedDs{DbDataSourcer: ds, mu: &sync.Mutex{}}
+	cds.appendIncoming(&incomingDP{cachedIdent: newCachedIdent(serde.Ident{"name": "foo"}), timeStamp: time.Unix(1000, 0), value: 1})
+
+	// The point is still waiting for a worker when the next one
+	// arrives, it must not be queued for r1 again
+	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st, 1)
+	cds.appendIncoming(&incomingDP{cachedIdent: newCachedIdent(serde.Ident{"name": "foo"}), timeStamp: time.Unix(1001, 0), value: 2})
+	directorProcessOrForward(dsc, cds, workerCh, clstr, nil, st, 1)
+	if n := dsc.fwdRetry.pending(); n != 2 {
+		t.Errorf("directorProcessOrForward: expected 2 points queued for retry, got %d", n)
+	}
+	if len(cds.incoming) != 2 || cds.incoming[0].Hops != 0 {
+		t.Errorf("directorProcessOrForward: the points to apply locally should be left as they arrived: %v", cds.incoming)
+	}
+}
+
 func Test_directorProcessIncomingDP(t *testing.T) {
 
 	saveFn := directorProcessOrForward
 	dpofCalled := 0
-	directorProcessOrForward = func(dsc *dsCache, cds *cachedDs, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats) {
+	directorProcessOrForward = func(dsc *dsCache, cds *cachedDs, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats, maxForwards int) {
 		dpofCalled++
 	}
 
@@ -301,15 +393,18 @@ func Test_directorProcessIncomingDP(t *testing.T) {
 
 	// NaN
 	dp.value = math.NaN()
-	directorProcessIncomingDP(dp, dsc, nil, nil, nil, nil, st)
+	directorProcessIncomingDP(dp, dsc, nil, nil, nil, nil, st, 1, nil)
 	if dpofCalled > 0 {
 		t.Errorf("directorProcessIncomingDP: With a NaN, directorProcessOrForward should not be called")
 	}
+	if st.nan[rrd.NaNDrop] != 1 {
+		t.Errorf("directorProcessIncomingDP: A dropped NaN should be counted")
+	}
 
 	// A value
 	dp.value = 1234
 	lsent, dpofCalled = 0, 0
-	directorProcessIncomingDP(dp, dsc, loaderCh, workerCh, clstr, nil, st)
+	directorProcessIncomingDP(dp, dsc, loaderCh, workerCh, clstr, nil, st, 1, nil)
 	if lsent != 1 {
 		t.Errorf("directorProcessIncomingDP: With a value, should send it to loader")
 	}
@@ -320,7 +415,7 @@ func Test_directorProcessIncomingDP(t *testing.T) {
 	// A blank name should cause a nil rds
 	dp.cachedIdent = newCachedIdent(serde.Ident{"name": ""})
 	dpofCalled = 0
-	directorProcessIncomingDP(dp, dsc, nil, nil, nil, nil, st)
+	directorProcessIncomingDP(dp, dsc, nil, nil, nil, nil, st, 1, nil)
 	if dpofCalled > 0 {
 		t.Errorf("directorProcessIncomingDP: With a blank name, directorProcessOrForward should not be called")
 	}
@@ -329,7 +424,7 @@ func Test_directorProcessIncomingDP(t *testing.T) {
 	dp.cachedIdent = newCachedIdent(serde.Ident{"name": "blah"})
 	db.fakeErr = true
 	dpofCalled = 0
-	directorProcessIncomingDP(dp, dsc, loaderCh, nil, nil, nil, st)
+	directorProcessIncomingDP(dp, dsc, loaderCh, nil, nil, nil, st, 1, nil)
 	if dpofCalled > 0 {
 		t.Errorf("directorProcessIncomingDP: With a db error, directorProcessOrForward should not be called")
 	}
@@ -337,11 +432,19 @@ func Test_directorProcessIncomingDP(t *testing.T) {
 	// nil cluster
 	dp.value = 1234
 	db.fakeErr = false
-	directorProcessIncomingDP(dp, dsc, loaderCh, workerCh, nil, nil, st)
+	directorProcessIncomingDP(dp, dsc, loaderCh, workerCh, nil, nil, st, 1, nil)
 	if dpofCalled != 0 {
 		t.Errorf("directorProcessIncomingDP: With a value and no cluster, directorProcessOrForward should not be called: %v", dpofCalled)
 	}
 
+	// filtered out
+	dp.cachedIdent = newCachedIdent(serde.Ident{"name": "foo.debug.bar"})
+	filter := newDpFilter(nil, []*regexp.Regexp{regexp.MustCompile(`\.debug\.`)})
+	directorProcessIncomingDP(dp, dsc, loaderCh, workerCh, nil, nil, st, 1, filter)
+	if st.filtered != 1 || dsc.getByIdent(dp.cachedIdent) != nil {
+		t.Errorf("directorProcessIncomingDP: A blacklisted data point should be filtered before DS creation")
+	}
+
 	directorProcessOrForward = saveFn
 }
 
@@ -350,9 +453,9 @@ func Test_the_director(t *testing.T) {
 	saveFn1 := directorIncomingDPMessages
 	saveFn2 := directorProcessIncomingDP
 	dimCalled := 0
-	directorIncomingDPMessages = func(rcv chan *cluster.Msg, dpCh chan<- interface{}) { dimCalled++ }
+	directorIncomingDPMessages = func(rcv chan *cluster.Msg, dpCh chan<- interface{}, maxHops int) { dimCalled++ }
 	dpidpCalled := 0
-	directorProcessIncomingDP = func(dp *incomingDP, dsc *dsCache, loaderCh chan interface{}, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats) {
+	directorProcessIncomingDP = func(dp *incomingDP, dsc *dsCache, loaderCh chan interface{}, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats, maxForwards int, filter *dpFilter) {
 		dpidpCalled++
 	}
 
@@ -375,7 +478,7 @@ func Test_the_director(t *testing.T) {
 	dsc := newDsCache(db, df, dsf)
 
 	wc.startWg.Add(1)
-	go director(wc, dpCh, dpCh, 1, clstr, sr, dsc, nil, nil, 0, 0)
+	go director(wc, dpCh, dpCh, 1, clstr, sr, dsc, nil, nil, 0, 2, 1, nil)
 	wc.startWg.Wait()
 
 	if clstr.nReady == 0 {
@@ -438,7 +541,7 @@ func Test_the_director(t *testing.T) {
 	dpCh <- dp
 
 	wc.startWg.Add(1)
-	go director(wc, dpCh, dpCh, 1, clstr, sr, dsc, nil, nil, 0, 0)
+	go director(wc, dpCh, dpCh, 1, clstr, sr, dsc, nil, nil, 0, 2, 1, nil)
 	wc.startWg.Wait()
 
 	time.Sleep(100 * time.Millisecond)
@@ -464,3 +567,146 @@ func Test_director_fifoQueue(t *testing.T) {
 		t.Errorf("queue: size != 1")
 	}
 }
+
+func Test_director_elasticChOverflow(t *testing.T) {
+
+	fill := func(policy QueueOverflowPolicy) (*fifoQueue, chan interface{}, chan interface{}) {
+		queue := &fifoQueue{}
+		queue.setLimits(3, policy)
+		cin, cout := make(chan interface{}), make(chan interface{})
+		go elasticCh(cin, cout, queue)
+		// first one is held by elasticCh, the next 3 are queued
+		for i := 0; i < 4; i++ {
+			cin <- i
+		}
+		return queue, cin, cout
+	}
+
+	// drop-newest
+	queue, cin, cout := fill(QueueDropNewest)
+	cin <- 4
+	cin <- 5
+	time.Sleep(10 * time.Millisecond) // let elasticCh process the last one
+	if queue.size() != 3 {
+		t.Errorf("drop-newest: queue.size() != 3: %d", queue.size())
+	}
+	if dropped, _ := queue.overflows(); dropped != 2 {
+		t.Errorf("drop-newest: dropped != 2: %d", dropped)
+	}
+	for i := 0; i < 4; i++ {
+		if v := <-cout; v != i {
+			t.Errorf("drop-newest: expected %d, got %v", i, v)
+		}
+	}
+	close(cin)
+
+	// drop-oldest
+	queue, cin, cout = fill(QueueDropOldest)
+	cin <- 4
+	cin <- 5
+	time.Sleep(10 * time.Millisecond)
+	if dropped, _ := queue.overflows(); dropped != 2 {
+		t.Errorf("drop-oldest: dropped != 2: %d", dropped)
+	}
+	for _, exp := range []int{0, 3, 4, 5} {
+		if v := <-cout; v != exp {
+			t.Errorf("drop-oldest: expected %d, got %v", exp, v)
+		}
+	}
+	close(cin)
+
+	// block
+	queue, cin, cout = fill(QueueBlock)
+	cin <- 4 // accepted, but now elasticCh stops receiving
+	select {
+	case cin <- 5:
+		t.Errorf("block: send should have blocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, blocked := queue.overflows(); blocked != 1 {
+		t.Errorf("block: blocked != 1: %d", blocked)
+	}
+	go func() { cin <- 5 }()
+	for i := 0; i < 6; i++ {
+		if v := <-cout; v != i {
+			t.Errorf("block: expected %d, got %v", i, v)
+		}
+	}
+	close(cin)
+	if _, ok := <-cout; ok {
+		t.Errorf("block: cout should be closed")
+	}
+}
+
+func Test_director_ParseQueueOverflowPolicy(t *testing.T) {
+	for _, p := range []QueueOverflowPolicy{QueueDropNewest, QueueDropOldest, QueueBlock} {
+		if pp, err := ParseQueueOverflowPolicy(p.String()); err != nil || pp != p {
+			t.Errorf("ParseQueueOverflowPolicy(%q): %v %v", p.String(), pp, err)
+		}
+	}
+	if _, err := ParseQueueOverflowPolicy("bogus"); err == nil {
+		t.Errorf("ParseQueueOverflowPolicy: expected an error")
+	}
+}
+
+func Test_directorApplyBounds(t *testing.T) {
+	st := &dpStats{forwarded_to: make(map[string]int), last: time.Now()}
+	dsc := newDsCache(nil, nil, nil)
+	dsc.deadLetter = &deadLetterWriter{ch: make(chan *DeadLetter, 1)}
+
+	cds := &cachedDs{mu: &sync.Mutex{}}
+	dp := &incomingDP{cachedIdent: newCachedIdent(serde.Ident{"name": "foo"}), timeStamp: time.Unix(1000, 0), value: 1e20}
+	if !directorApplyBounds(dp, cds, dsc, st) {
+		t.Errorf("directorApplyBounds: dropped a point with no bounds")
+	}
+
+	cds.bounds = &rrd.Bounds{Min: 0, Max: 100}
+	if directorApplyBounds(dp, cds, dsc, st) || st.outOfBounds != 1 {
+		t.Errorf("directorApplyBounds: out of bounds point not dropped and counted")
+	}
+	if dl := <-dsc.deadLetter.ch; dl.Reason != DeadOutOfBounds {
+		t.Errorf("directorApplyBounds: dead letter reason %q", dl.Reason)
+	}
+
+	cds.bounds.Clamp = true
+	if !directorApplyBounds(dp, cds, dsc, st) || dp.value != 100 || st.clamped != 1 {
+		t.Errorf("directorApplyBounds: point not clamped: %v, clamped %d", dp.value, st.clamped)
+	}
+}
+
+func Test_directorApplyNaNPolicy(t *testing.T) {
+	st := &dpStats{forwarded_to: make(map[string]int), last: time.Now()}
+	dsc := newDsCache(nil, nil, nil)
+	dsc.deadLetter = &deadLetterWriter{ch: make(chan *DeadLetter, 1)}
+
+	dp := &incomingDP{cachedIdent: newCachedIdent(serde.Ident{"name": "foo"}), timeStamp: time.Unix(1000, 0), value: math.NaN()}
+	if directorApplyNaNPolicy(dp, rrd.NaNDrop, dsc, st) || st.nan[rrd.NaNDrop] != 1 {
+		t.Errorf("directorApplyNaNPolicy: drop should drop and count")
+	}
+	if dl := <-dsc.deadLetter.ch; dl.Reason != DeadNaN {
+		t.Errorf("directorApplyNaNPolicy: dead letter reason %q", dl.Reason)
+	}
+
+	if !directorApplyNaNPolicy(dp, rrd.NaNZero, dsc, st) || dp.value != 0 || st.nan[rrd.NaNZero] != 1 {
+		t.Errorf("directorApplyNaNPolicy: zero should make the value 0: %v", dp.value)
+	}
+
+	dp.value = math.Inf(1)
+	if !directorApplyNaNPolicy(dp, rrd.NaNGap, dsc, st) || !math.IsNaN(dp.value) || st.nan[rrd.NaNGap] != 1 {
+		t.Errorf("directorApplyNaNPolicy: gap should make Inf a NaN: %v", dp.value)
+	}
+
+	// the policy of the matching spec applies to a new DS
+	spec := *DftDSSPec
+	spec.NaN = rrd.NaNZero
+	dsc = newDsCache(&fakeSerde{}, &SimpleDSFinder{&spec}, nil)
+	loaderCh := make(chan interface{}, 1)
+	dp.value = math.NaN()
+	directorProcessIncomingDP(dp, dsc, loaderCh, nil, nil, nil, st, 1, nil)
+	if len(loaderCh) != 1 || st.nan[rrd.NaNZero] != 2 {
+		t.Errorf("directorProcessIncomingDP: NaN with a zero policy should create the DS")
+	}
+	if cds := dsc.getByIdent(dp.cachedIdent); cds == nil || cds.nan != rrd.NaNZero || cds.incoming[0].value != 0 {
+		t.Errorf("directorProcessIncomingDP: cachedDs should have the spec NaN policy and a 0 value")
+	}
+}
@@ -0,0 +1,91 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// dpFilter decides which incoming data points are accepted based on
+// their name. If there are any whitelist regular expressions, a name
+// must match at least one of them, and a name matching any of the
+// blacklist regular expressions is rejected. Rejected data points are
+// counted per rule. The dpFilter is only used by the director
+// goroutine and is not safe for concurrent use.
+type dpFilter struct {
+	whitelist      []*regexp.Regexp
+	blacklist      []*regexp.Regexp
+	notWhitelisted int
+	blacklisted    []int
+}
+
+// newDpFilter returns a dpFilter, or nil if both lists are empty.
+func newDpFilter(whitelist, blacklist []*regexp.Regexp) *dpFilter {
+	if len(whitelist) == 0 && len(blacklist) == 0 {
+		return nil
+	}
+	return &dpFilter{
+		whitelist:   whitelist,
+		blacklist:   blacklist,
+		blacklisted: make([]int, len(blacklist)),
+	}
+}
+
+// allow returns true if the data point name passes the filter.
+func (f *dpFilter) allow(name string) bool {
+	if f == nil {
+		return true
+	}
+
+	if len(f.whitelist) > 0 {
+		matched := false
+		for _, re := range f.whitelist {
+			if re.MatchString(name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			f.notWhitelisted++
+			return false
+		}
+	}
+
+	for n, re := range f.blacklist {
+		if re.MatchString(name) {
+			f.blacklisted[n]++
+			return false
+		}
+	}
+
+	return true
+}
+
+// reportStats reports and resets the drop counters.
+func (f *dpFilter) reportStats(sr statReporter) {
+	if f == nil {
+		return
+	}
+	if len(f.whitelist) > 0 {
+		sr.reportStatCount("receiver.filter.not_whitelisted", float64(f.notWhitelisted))
+		f.notWhitelisted = 0
+	}
+	for n, cnt := range f.blacklisted {
+		sr.reportStatCount(fmt.Sprintf("receiver.filter.blacklisted.%d", n), float64(cnt))
+		f.blacklisted[n] = 0
+	}
+}
@@ -0,0 +1,55 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"regexp"
+	"testing"
+)
+
+func Test_dpfilter_allow(t *testing.T) {
+	if f := newDpFilter(nil, nil); f != nil || !f.allow("foo") {
+		t.Errorf("newDpFilter: with empty lists should return nil, which allows everything")
+	}
+
+	f := newDpFilter(nil, []*regexp.Regexp{regexp.MustCompile(`\.debug\.`), regexp.MustCompile(`^tmp\.`)})
+	if !f.allow("foo.bar") {
+		t.Errorf("allow: foo.bar is not blacklisted")
+	}
+	if f.allow("foo.debug.bar") || f.allow("tmp.foo") || f.allow("tmp.bar") {
+		t.Errorf("allow: blacklisted names should not be allowed")
+	}
+	if f.blacklisted[0] != 1 || f.blacklisted[1] != 2 {
+		t.Errorf("allow: blacklist counters wrong: %v", f.blacklisted)
+	}
+
+	f = newDpFilter([]*regexp.Regexp{regexp.MustCompile(`^prod\.`)}, []*regexp.Regexp{regexp.MustCompile(`\.debug\.`)})
+	if !f.allow("prod.foo") {
+		t.Errorf("allow: prod.foo is whitelisted")
+	}
+	if f.allow("dev.foo") || f.notWhitelisted != 1 {
+		t.Errorf("allow: dev.foo is not whitelisted")
+	}
+	if f.allow("prod.debug.foo") || f.blacklisted[0] != 1 {
+		t.Errorf("allow: blacklist should apply to whitelisted names")
+	}
+
+	sr := &fakeSr{}
+	f.reportStats(sr)
+	if sr.called != 2 || f.notWhitelisted != 0 || f.blacklisted[0] != 0 {
+		t.Errorf("reportStats: counters not reported or reset")
+	}
+}
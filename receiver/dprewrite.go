@@ -0,0 +1,99 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// RewriteRule rewrites the name of matching incoming data points,
+// Replacement may refer to the capture groups of Regexp as in
+// regexp.Regexp.ReplaceAllString, e.g. $1 or ${name}.
+type RewriteRule struct {
+	Regexp      *regexp.Regexp
+	Replacement string
+}
+
+// dpRewriter applies an ordered list of rewrite rules to data point
+// names. Every matching rule is applied, in order, to the result of
+// the previous one. Rewrites are counted per rule. It is safe for
+// concurrent use.
+type dpRewriter struct {
+	rules     []RewriteRule
+	rewritten []int64 // atomic
+}
+
+// newDpRewriter returns a dpRewriter, or nil if there are no rules.
+func newDpRewriter(rules []RewriteRule) *dpRewriter {
+	if len(rules) == 0 {
+		return nil
+	}
+	for n, rule := range rules {
+		log.Printf("dpRewriter: rule %d: %v -> %q", n, rule.Regexp, rule.Replacement)
+	}
+	return &dpRewriter{
+		rules:     rules,
+		rewritten: make([]int64, len(rules)),
+	}
+}
+
+// rewrite returns the ident with the name rewritten. If no rule
+// matches the ident itself is returned, otherwise a copy, the
+// original is not modified.
+func (rw *dpRewriter) rewrite(ident serde.Ident) serde.Ident {
+	if rw == nil {
+		return ident
+	}
+
+	name := ident["name"]
+	orig := name
+	for n, rule := range rw.rules {
+		if rule.Regexp.MatchString(name) {
+			name = rule.Regexp.ReplaceAllString(name, rule.Replacement)
+			atomic.AddInt64(&rw.rewritten[n], 1)
+		}
+	}
+	if name == orig {
+		return ident
+	}
+
+	result := make(serde.Ident, len(ident))
+	for k, v := range ident {
+		result[k] = v
+	}
+	result["name"] = name
+	return result
+}
+
+// reportStats reports and resets the rewrite counters.
+func (rw *dpRewriter) reportStats(sr statReporter) {
+	for n := range rw.rewritten {
+		sr.reportStatCount(fmt.Sprintf("receiver.rewrite.%d", n), float64(atomic.SwapInt64(&rw.rewritten[n], 0)))
+	}
+}
+
+func reportRewriteCounts(rw *dpRewriter, sr statReporter, nap time.Duration) {
+	for {
+		time.Sleep(nap)
+		rw.reportStats(sr)
+	}
+}
@@ -0,0 +1,61 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_dprewrite_rewrite(t *testing.T) {
+	var rw *dpRewriter
+	if rw = newDpRewriter(nil); rw != nil {
+		t.Errorf("newDpRewriter: with no rules should return nil")
+	}
+	ident := serde.Ident{"name": "foo"}
+	if got := rw.rewrite(ident); got["name"] != "foo" {
+		t.Errorf("rewrite: nil rewriter changed the name: %v", got)
+	}
+
+	rw = newDpRewriter([]RewriteRule{
+		{Regexp: regexp.MustCompile(`^servers\.([^.]+)\.cpu\.`), Replacement: "hosts.$1.cpu."},
+		{Regexp: regexp.MustCompile(`^hosts\.`), Replacement: "infra.hosts."},
+	})
+
+	ident = serde.Ident{"name": "servers.web1.cpu.idle", "dc": "east"}
+	got := rw.rewrite(ident)
+	if got["name"] != "infra.hosts.web1.cpu.idle" || got["dc"] != "east" {
+		t.Errorf("rewrite: rules not applied in order: %v", got)
+	}
+	if ident["name"] != "servers.web1.cpu.idle" {
+		t.Errorf("rewrite: original ident modified: %v", ident)
+	}
+	if got := rw.rewrite(serde.Ident{"name": "foo"}); got["name"] != "foo" {
+		t.Errorf("rewrite: non-matching name changed: %v", got)
+	}
+
+	sr := make(recordingSr)
+	rw.reportStats(sr)
+	if sr["receiver.rewrite.0"] != 1 || sr["receiver.rewrite.1"] != 1 {
+		t.Errorf("reportStats: wrong counts: %v", sr)
+	}
+	rw.reportStats(sr)
+	if sr["receiver.rewrite.0"] != 1 {
+		t.Errorf("reportStats: counts not reset: %v", sr)
+	}
+}
@@ -0,0 +1,198 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// The most idents a dsCreateBreaker remembers as refused.
+const maxBreakerRefused = 100000
+
+// dsCreateBreaker stops the creation of new data sources altogether
+// when the total number of series reaches maxSeries, or when more
+// than maxRate new DSs are created within an interval, in which case
+// it stays open for cooldown. This protects the database from
+// cardinality explosions. Existing DSs keep working, including those
+// that are not cached (e.g. evicted), because those are still
+// fetched from the database, only their creation is refused. Unlike
+// the dsCreateLimiter, which lets the first so many DSs through in
+// every interval, a tripped breaker refuses everything new until the
+// condition clears.
+//
+// The series count is the number of DSs loaded on start plus those
+// created since, less deletions. While the breaker is open, idents
+// which were refused are remembered so that their data points can
+// be dropped without a database lookup.
+type dsCreateBreaker struct {
+	*sync.Mutex
+	maxSeries int
+	maxRate   int
+	interval  time.Duration
+	cooldown  time.Duration
+	series    int
+	start     time.Time
+	count     int       // DSs created in the current interval
+	openUntil time.Time // when tripped by rate
+	open      bool
+	refused   int // data points, reset by report()
+	idents    map[string]bool
+}
+
+// newDsCreateBreaker returns a breaker or nil if there are no
+// thresholds. A zero or negative threshold means none.
+func newDsCreateBreaker(maxSeries, maxRate int, interval, cooldown time.Duration) *dsCreateBreaker {
+	if maxSeries <= 0 && maxRate <= 0 {
+		return nil
+	}
+	b := &dsCreateBreaker{
+		Mutex:     &sync.Mutex{},
+		maxSeries: maxSeries,
+		maxRate:   maxRate,
+		interval:  interval,
+		cooldown:  cooldown,
+		idents:    make(map[string]bool),
+	}
+	if b.interval <= 0 {
+		b.interval = time.Minute
+	}
+	if b.cooldown <= 0 {
+		b.cooldown = 5 * time.Minute
+	}
+	return b
+}
+
+// check updates and returns the open state, tripping the breaker if
+// a threshold is exceeded. Must be called with the lock held.
+func (b *dsCreateBreaker) check() bool {
+	now := time.Now()
+	if now.Sub(b.start) >= b.interval {
+		b.start = now
+		b.count = 0
+	}
+
+	var why string
+	if b.maxSeries > 0 && b.series >= b.maxSeries {
+		why = "series count"
+	} else if now.Before(b.openUntil) {
+		why = "creation rate"
+	} else if b.maxRate > 0 && b.count >= b.maxRate {
+		b.openUntil = now.Add(b.cooldown)
+		why = "creation rate"
+	}
+
+	if why != "" && !b.open {
+		log.Printf("dsCreateBreaker: %s threshold reached (%d series, %d new per %v max), no longer creating new DSs.", why, b.maxSeries, b.maxRate, b.interval)
+	} else if why == "" && b.open {
+		log.Printf("dsCreateBreaker: below thresholds, creating new DSs again (%d series).", b.series)
+		b.idents = make(map[string]bool)
+	}
+	b.open = why != ""
+	return b.open
+}
+
+// allowCreate returns true if a new DS may be created. It does not
+// count anything, see created().
+func (b *dsCreateBreaker) allowCreate() bool {
+	if b == nil {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	return !b.check()
+}
+
+// created counts a newly created DS.
+func (b *dsCreateBreaker) created() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	b.count++
+	b.series++
+	b.Unlock()
+}
+
+// refuse records that the creation of the DS with this ident was
+// refused along with n data points.
+func (b *dsCreateBreaker) refuse(ident string, n int) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if len(b.idents) >= maxBreakerRefused {
+		b.idents = make(map[string]bool)
+	}
+	b.idents[ident] = true
+	b.refused += n
+}
+
+// wasRefused returns true if the breaker is open and the creation of
+// the DS with this ident has been refused, in which case the data
+// point is counted as refused.
+func (b *dsCreateBreaker) wasRefused(ident string) bool {
+	if b == nil {
+		return false
+	}
+	b.Lock()
+	defer b.Unlock()
+	if !b.check() || !b.idents[ident] {
+		return false
+	}
+	b.refused++
+	return true
+}
+
+// addSeries adjusts the series count, n can be negative.
+func (b *dsCreateBreaker) addSeries(n int) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	b.series += n
+	b.Unlock()
+}
+
+// isOpen returns true if the breaker is open.
+func (b *dsCreateBreaker) isOpen() bool {
+	if b == nil {
+		return false
+	}
+	b.Lock()
+	defer b.Unlock()
+	return b.open
+}
+
+// report reports the breaker state and the number of data points
+// refused since the last call.
+func (b *dsCreateBreaker) report(sr statReporter) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	open := 0.0
+	if b.open {
+		open = 1
+	}
+	sr.reportStatGauge("receiver.create_breaker.open", open)
+	sr.reportStatGauge("receiver.create_breaker.series", float64(b.series))
+	sr.reportStatCount("receiver.datapoints.create_breaker_refused", float64(b.refused))
+	b.refused = 0
+}
@@ -0,0 +1,95 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_dsbreaker_newDsCreateBreaker(t *testing.T) {
+	if b := newDsCreateBreaker(0, 0, time.Minute, time.Minute); b != nil {
+		t.Errorf("newDsCreateBreaker: with no thresholds should return nil")
+	}
+	var b *dsCreateBreaker
+	b.addSeries(1)
+	b.created()
+	b.refuse("foo", 1)
+	if !b.allowCreate() || b.wasRefused("foo") || b.isOpen() {
+		t.Errorf("nil dsCreateBreaker should allow everything")
+	}
+	if b = newDsCreateBreaker(1, 0, 0, 0); b.interval != time.Minute || b.cooldown != 5*time.Minute {
+		t.Errorf("newDsCreateBreaker: wrong defaults: %v %v", b.interval, b.cooldown)
+	}
+}
+
+func Test_dsbreaker_maxSeries(t *testing.T) {
+	b := newDsCreateBreaker(10, 0, time.Minute, time.Minute)
+	b.addSeries(9)
+	if !b.allowCreate() {
+		t.Errorf("allowCreate: below max series should be allowed")
+	}
+	b.created()
+	if b.allowCreate() || !b.isOpen() {
+		t.Errorf("allowCreate: at max series should be refused and open")
+	}
+
+	b.refuse("foo", 2)
+	if !b.wasRefused("foo") {
+		t.Errorf("wasRefused: a refused ident should be refused while open")
+	}
+	if b.wasRefused("bar") {
+		t.Errorf("wasRefused: an ident not refused should not be refused")
+	}
+
+	b.addSeries(-1)
+	if !b.allowCreate() || b.isOpen() {
+		t.Errorf("allowCreate: below max series again should be allowed and closed")
+	}
+	if b.wasRefused("foo") {
+		t.Errorf("wasRefused: closing should forget refused idents")
+	}
+
+	sr := make(recordingSr)
+	b.report(sr)
+	if sr["receiver.datapoints.create_breaker_refused"] != 3 || sr["receiver.create_breaker.series"] != 9 || sr["receiver.create_breaker.open"] != 0 {
+		t.Errorf("report: wrong stats: %v", sr)
+	}
+}
+
+func Test_dsbreaker_maxRate(t *testing.T) {
+	b := newDsCreateBreaker(0, 2, time.Hour, time.Hour)
+	for i := 0; i < 2; i++ {
+		if !b.allowCreate() {
+			t.Errorf("allowCreate: below max rate should be allowed")
+		}
+		b.created()
+	}
+	if b.allowCreate() || !b.isOpen() {
+		t.Errorf("allowCreate: above max rate should trip the breaker")
+	}
+
+	// a new interval does not close it before the cooldown
+	b.start = time.Now().Add(-2 * time.Hour)
+	if b.allowCreate() {
+		t.Errorf("allowCreate: should stay open for the cooldown")
+	}
+
+	b.start, b.openUntil = time.Now().Add(-2*time.Hour), time.Now().Add(-time.Second)
+	if !b.allowCreate() || b.isOpen() {
+		t.Errorf("allowCreate: after the cooldown should be allowed and closed")
+	}
+}
@@ -17,8 +17,11 @@ package receiver
 
 import (
 	"fmt"
+	"log"
+	"math"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tgres/tgres/cluster"
@@ -34,10 +37,37 @@ type dsCache struct {
 	db       serde.Fetcher
 	dsf      dsFlusherBlocking
 	finder   MatchingDSSpecFinder
+	specSets map[string]MatchingDSSpecFinder // see finderFor
 	clstr    clusterer
 	rraCount int
+	backfill time.Duration // how far behind LastUpdate points are still accepted
+	dups     DuplicatePolicy
+	limiter  *dsCreateLimiter
+	breaker  *dsCreateBreaker
+	maxMem   uint64        // memory budget (estimated), 0 is unlimited
+	minIdle  time.Duration // how long a DS must be idle to be evicted
+
+	staleAfter   time.Duration // unload DSs which received nothing for this long, 0 is never
+	archive      bool          // also mark stale DSs archived in the db
+	staleChecked time.Time
+
+	archived, archiveFailed int64 // atomic, reset by takeArchived()
+	backfillRejected        int64 // atomic, reset by takeBackfillRejected()
+
+	deadLetter *deadLetterWriter // nil unless dead letters are enabled
+	fwdRetry   *forwardRetrier   // nil unless forwards are retried
+
+	// DS loading retries and breaker threshold, see loadRetrier
+	loadRetries, loadBreakerThreshold int
 }
 
+// Rough estimates of how much memory a cached DS and each of its RRAs
+// take up, used for the dsCache memory budget.
+const (
+	cachedDsMemEstimate  = 1024
+	cachedRRAMemEstimate = 256
+)
+
 // Returns a new dsCache object.
 func newDsCache(db serde.Fetcher, finder MatchingDSSpecFinder, dsf dsFlusherBlocking) *dsCache {
 	return &dsCache{
@@ -60,6 +90,9 @@ func (d *dsCache) getByIdent(ident *cachedIdent) *cachedDs {
 func (d *dsCache) insert(cds *cachedDs) {
 	d.Lock()
 	defer d.Unlock()
+	cds.backfill = d.backfill
+	cds.dups = d.dups
+	cds.dsc = d
 	if cds.spec != nil {
 		d.rraCount += len(cds.spec.RRAs)
 	} else if ds, ok := cds.DbDataSourcer.(rrd.DataSourcer); ok && ds != nil {
@@ -84,49 +117,159 @@ func (d *dsCache) preLoad() error {
 	if err != nil {
 		return err
 	}
+	d.breaker.addSeries(len(dss))
 
 	for _, ds := range dss {
 		dbds, ok := ds.(serde.DbDataSourcer)
 		if !ok {
 			return fmt.Errorf("preLoad: ds must be a serde.DbDataSourcer")
 		}
-		d.insert(&cachedDs{DbDataSourcer: dbds, mu: &sync.Mutex{}, lastProcess: time.Now()})
+		cds := &cachedDs{DbDataSourcer: dbds, mu: &sync.Mutex{}, lastProcess: time.Now()}
+		// Bounds and the NaN policy are not stored in the db,
+		// they come from whatever spec matches the DS now.
+		if finder := d.getFinder(); finder != nil {
+			if spec := finder.FindMatchingDSSpec(dbds.Ident()); spec != nil {
+				cds.bounds, cds.nan = spec.Bounds, spec.NaN
+			}
+		}
+		d.insert(cds)
 		d.register(dbds)
 	}
 
 	return nil
 }
 
+// setFinder replaces the MatchingDSSpecFinder. DSs that are
+// already cached or exist in the database are not affected.
+func (d *dsCache) setFinder(finder MatchingDSSpecFinder) {
+	d.Lock()
+	defer d.Unlock()
+	d.finder = finder
+}
+
+// setSpecSet sets a named MatchingDSSpecFinder, see finderFor.
+func (d *dsCache) setSpecSet(name string, finder MatchingDSSpecFinder) {
+	d.Lock()
+	defer d.Unlock()
+	if d.specSets == nil {
+		d.specSets = make(map[string]MatchingDSSpecFinder)
+	}
+	d.specSets[name] = finder
+}
+
+// finderFor returns the finder for a data point of a spec set: the
+// set's, falling back to the current one. An empty or unknown set is
+// the current one.
+func (d *dsCache) finderFor(specSet string) MatchingDSSpecFinder {
+	d.RLock()
+	defer d.RUnlock()
+	if set := d.specSets[specSet]; set != nil && specSet != "" {
+		return &specSetFinder{set: set, dft: d.finder}
+	}
+	return d.finder
+}
+
+type specSetFinder struct {
+	set, dft MatchingDSSpecFinder
+}
+
+func (f *specSetFinder) FindMatchingDSSpec(ident serde.Ident) *rrd.DSSpec {
+	if spec := f.set.FindMatchingDSSpec(ident); spec != nil {
+		return spec
+	}
+	return f.dft.FindMatchingDSSpec(ident)
+}
+
+// getFinder rlocks and returns the current MatchingDSSpecFinder.
+func (d *dsCache) getFinder() MatchingDSSpecFinder {
+	d.RLock()
+	defer d.RUnlock()
+	return d.finder
+}
+
 // get or create and empty cached ds
 func (d *dsCache) getByIdentOrCreateEmpty(ident *cachedIdent) *cachedDs {
+	return d.getByIdentOrCreateEmptyWith(ident, d.getFinder())
+}
+
+// getByIdentOrCreateEmptyWith is getByIdentOrCreateEmpty with the
+// DSSpec of a new DS from finder.
+func (d *dsCache) getByIdentOrCreateEmptyWith(ident *cachedIdent, finder MatchingDSSpecFinder) *cachedDs {
 	result := d.getByIdent(ident)
 	if result == nil {
-		if spec := d.finder.FindMatchingDSSpec(ident.Ident); spec != nil {
+		if spec := finder.FindMatchingDSSpec(ident.Ident); spec != nil {
+			if d.breaker.wasRefused(ident.String()) || !d.limiter.allow(ident.Ident["name"]) {
+				return nil
+			}
 			// return a cachedDs with nil DataSourcer
 			dbds := serde.NewDbDataSource(0, ident.Ident, 0, 0, nil)
-			result = &cachedDs{DbDataSourcer: dbds, spec: spec, mu: &sync.Mutex{}, lastProcess: time.Now()}
+			result = &cachedDs{DbDataSourcer: dbds, spec: spec, bounds: spec.Bounds, nan: spec.NaN, mu: &sync.Mutex{}, lastProcess: time.Now()}
 			d.insert(result)
 		}
 	}
 	return result
 }
 
+// errCreateRefused is returned by fetchOrCreateByIdent when the DS
+// does not exist and the dsCreateBreaker is open.
+var errCreateRefused = fmt.Errorf("DS creation refused, the create breaker is open")
+
 // load (or create) via the SerDe given an empty cachedDs with ident and spec
 func (d *dsCache) fetchOrCreateByIdent(cds *cachedDs) error {
-	ds, err := d.db.FetchOrCreateDataSource(cds.Ident(), cds.spec)
+	spec := cds.spec
+	if !d.breaker.allowCreate() {
+		spec = nil // fetch only
+	}
+	ds, err := d.db.FetchOrCreateDataSource(cds.Ident(), spec)
 	if err != nil {
 		return err
 	}
+	if ds == nil && spec == nil {
+		return errCreateRefused
+	}
 	dbds, ok := ds.(serde.DbDataSourcer)
 	if !ok {
 		return fmt.Errorf("fetchOrCreateByIdent: ds must be a serde.DbDataSourcer")
 	}
+	if dbds.Created() {
+		d.breaker.created()
+	}
 	cds.DbDataSourcer = dbds
 	cds.spec = nil
 	d.register(dbds)
 	return nil
 }
 
+// dropRefused removes a cachedDs whose creation was refused by the
+// dsCreateBreaker from the cache, its incoming data points are
+// dropped.
+func (d *dsCache) dropRefused(cds *cachedDs) {
+	n := d.dropUnloaded(cds, DeadCreateBreaker)
+	d.breaker.refuse(cds.Ident().String(), n)
+}
+
+// dropUnloaded removes a cachedDs which was never loaded from the
+// cache, its incoming data points are dropped as dead letters for
+// reason. It returns how many there were.
+func (d *dsCache) dropUnloaded(cds *cachedDs, reason string) int {
+	d.Lock()
+	if d.byIdent[cds.Ident().String()] == cds {
+		delete(d.byIdent, cds.Ident().String())
+		d.rraCount -= len(cds.spec.RRAs) // as counted by insert()
+	}
+	d.Unlock()
+
+	cds.mu.Lock()
+	defer cds.mu.Unlock()
+	n := len(cds.incoming)
+	for _, dp := range cds.incoming {
+		d.deadLetter.addDP(reason, dp)
+		dp.release()
+	}
+	cds.incoming = nil
+	return n
+}
+
 // register the rds as a DistDatum with the cluster
 func (d *dsCache) register(ds serde.DbDataSourcer) {
 	if d.clstr != nil {
@@ -139,19 +282,187 @@ func (d *dsCache) register(ds serde.DbDataSourcer) {
 
 type dscStats struct {
 	dsCount, rraCount int
+	memEstimate       uint64
 }
 
 func (d *dsCache) stats() dscStats {
 	d.RLock()
 	defer d.RUnlock()
 	st := dscStats{
-		dsCount:  len(d.byIdent),
-		rraCount: d.rraCount,
+		dsCount:     len(d.byIdent),
+		rraCount:    d.rraCount,
+		memEstimate: d.memEstimate(),
 	}
 
 	return st
 }
 
+// memEstimate returns the estimated memory used by the cache. Must be
+// called with the lock held.
+func (d *dsCache) memEstimate() uint64 {
+	return uint64(len(d.byIdent))*cachedDsMemEstimate + uint64(d.rraCount)*cachedRRAMemEstimate
+}
+
+// evict removes least recently used DSs that have been idle for at
+// least minIdle until the cache is within its memory budget, and
+// returns the number evicted. A DS with unflushed data is flushed and
+// evicted no sooner than minIdle later, so that by the time its data
+// may need to be loaded again, it has made it from the vcache to the
+// database.
+func (d *dsCache) evict() int {
+	if d.maxMem == 0 {
+		return 0
+	}
+
+	d.RLock()
+	over := d.memEstimate() > d.maxMem
+	var all []*cachedDs
+	if over {
+		all = make([]*cachedDs, 0, len(d.byIdent))
+		for _, cds := range d.byIdent {
+			all = append(all, cds)
+		}
+	}
+	d.RUnlock()
+
+	if !over {
+		return 0
+	}
+
+	candidates := make(lruCachedDss, len(all))
+	for i, cds := range all {
+		cds.mu.Lock()
+		candidates[i] = lruCachedDs{cds, cds.lastProcess}
+		cds.mu.Unlock()
+	}
+	sort.Sort(candidates)
+
+	evicted := 0
+	for _, c := range candidates {
+		if d.stats().memEstimate <= d.maxMem {
+			break
+		}
+		if d.evictOne(c.cds, d.minIdle) {
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// evictOne flushes and/or removes a DS from the cache if it has been
+// idle for at least minIdle.
+func (d *dsCache) evictOne(cds *cachedDs, minIdle time.Duration) bool {
+	cds.mu.Lock()
+
+	now := time.Now()
+	if now.Sub(cds.lastProcess) < minIdle || len(cds.incoming) > 0 ||
+		cds.sentToLoader || cds.Id() == 0 || cds.watchCh != nil {
+		cds.mu.Unlock()
+		return false
+	}
+
+	if cds.PointCount() > 0 || cds.lastFlush.Before(cds.lastProcess) {
+		d.dsf.flushToVCache(cds.DbDataSourcer)
+		cds.lastFlush = now
+		cds.mu.Unlock()
+		return false
+	}
+
+	idle := now.Sub(cds.lastFlush) >= minIdle
+	cds.mu.Unlock()
+
+	if idle {
+		d.delete(cds.Ident())
+	}
+	return idle
+}
+
+// unloadStale removes DSs which have not received any data points
+// for staleAfter from the cache and returns the number removed. Same
+// as with evict(), a DS with unflushed data is flushed first and
+// removed on a later pass. If archive is set, removed DSs are also
+// marked archived in the database (if it supports it). The cache is
+// scanned no more often than every tenth of staleAfter.
+func (d *dsCache) unloadStale() int {
+	if d.staleAfter == 0 || time.Now().Sub(d.staleChecked) < d.staleAfter/10 {
+		return 0
+	}
+	d.staleChecked = time.Now()
+
+	d.RLock()
+	all := make([]*cachedDs, 0, len(d.byIdent))
+	for _, cds := range d.byIdent {
+		all = append(all, cds)
+	}
+	d.RUnlock()
+
+	var ids []int64
+	for _, cds := range all {
+		if d.evictOne(cds, d.staleAfter) {
+			ids = append(ids, cds.Id())
+		}
+	}
+
+	if archiver, ok := d.db.(serde.DataSourceArchiver); ok && d.archive && len(ids) > 0 {
+		go func() {
+			archived, failed := archiveDataSources(archiver, ids)
+			atomic.AddInt64(&d.archived, int64(archived))
+			atomic.AddInt64(&d.archiveFailed, int64(failed))
+		}()
+	}
+	return len(ids)
+}
+
+// takeArchived returns the number of stale DSs archived and the
+// number that failed to be archived since the last call.
+func (d *dsCache) takeArchived() (archived, failed int64) {
+	return atomic.SwapInt64(&d.archived, 0), atomic.SwapInt64(&d.archiveFailed, 0)
+}
+
+// rejectBackfill counts and dead-letters a data point which could
+// not be backfilled because it is older than what is in memory.
+func (d *dsCache) rejectBackfill(dp *incomingDP) {
+	if d == nil {
+		return
+	}
+	atomic.AddInt64(&d.backfillRejected, 1)
+	d.deadLetter.addDP(DeadBackfill, dp)
+}
+
+// takeBackfillRejected returns the number of data points rejected by
+// rejectBackfill since the last call.
+func (d *dsCache) takeBackfillRejected() int64 {
+	return atomic.SwapInt64(&d.backfillRejected, 0)
+}
+
+// archiveDataSources marks DSs by id as archived. A DS that fails to
+// be archived stays unloaded and is simply not archived (it will be
+// loaded on the next start).
+var archiveDataSources = func(archiver serde.DataSourceArchiver, ids []int64) (archived, failed int) {
+	for _, id := range ids {
+		if err := archiver.ArchiveDataSource(id); err != nil {
+			log.Printf("archiveDataSources: error archiving DS %d: %v", id, err)
+			failed++
+			continue
+		}
+		archived++
+	}
+	log.Printf("archiveDataSources: archived %d stale DSs, %d failed.", archived, failed)
+	return archived, failed
+}
+
+// Sortable by lastProcess, least recent first
+type lruCachedDs struct {
+	cds         *cachedDs
+	lastProcess time.Time
+}
+
+type lruCachedDss []lruCachedDs
+
+func (a lruCachedDss) Len() int           { return len(a) }
+func (a lruCachedDss) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a lruCachedDss) Less(i, j int) bool { return a[i].lastProcess.Before(a[j].lastProcess) }
+
 // Watch checks the cache for presence of ident, if found, it marks it
 // as watched by setting the watchCh and starts sending a copy of all
 // data points matching this ident to the provided channel, until
@@ -201,10 +512,15 @@ type cachedDs struct {
 	serde.DbDataSourcer
 	incoming     sortableIncomingDPs
 	spec         *rrd.DSSpec // for when DS needs to be created
+	bounds       *rrd.Bounds // valid values, nil is any
+	nan          rrd.NaNPolicy
 	sentToLoader bool
 	lastProcess  time.Time
 	lastFlush    time.Time
 	watchCh      chan dsl.DataPoint
+	backfill     time.Duration
+	dups         DuplicatePolicy
+	dsc          *dsCache // for rejected backfills
 	mu           *sync.Mutex
 }
 
@@ -214,7 +530,9 @@ func (cds *cachedDs) appendIncoming(dp *incomingDP) {
 	cds.incoming = append(cds.incoming, dp)
 }
 
-func (cds *cachedDs) processIncoming() (int, int, error) {
+// processIncoming processes the incoming data points, the time from
+// their arrival until now is recorded in lat.
+func (cds *cachedDs) processIncoming(lat *latencyHistogram) (int, int, error) {
 
 	const BIG = 32 // this number was chosen rather arbitrarily
 
@@ -235,12 +553,38 @@ func (cds *cachedDs) processIncoming() (int, int, error) {
 		return 0, 0, nil
 	}
 
-	sort.Sort(cds.incoming)
+	// A stable sort keeps data points with the same time stamp in
+	// the order of arrival for collapseDuplicates().
+	sort.Stable(cds.incoming)
+	incoming, _ := collapseDuplicates(cds.incoming, cds.dups)
 
 	blocked := 0 // watched ch blocked
-	for _, dp := range cds.incoming {
+	for _, dp := range incoming {
+		// A duplicate of a point processed in an earlier batch
+		// can no longer be combined with it, for keep-first it
+		// is simply ignored, otherwise processed as usual.
+		if cds.dups == DuplicateKeepFirst && dp.timeStamp.Equal(cds.LastUpdate()) {
+			continue
+		}
+		if math.IsNaN(dp.value) && cds.nan == rrd.NaNLast {
+			// The previous value is kept with the DS state,
+			// which survives eviction and restarts.
+			if math.IsNaN(cds.LastRaw()) {
+				continue // nothing to go by
+			}
+			dp.value = cds.LastRaw()
+		}
 		// continue on errors
-		err = cds.ProcessDataPoint(dp.value, dp.timeStamp)
+		if cds.backfill > 0 && dp.timeStamp.Before(cds.LastUpdate()) && cds.LastUpdate().Sub(dp.timeStamp) <= cds.backfill {
+			if err = cds.BackfillDataPoint(dp.value, dp.timeStamp); err == rrd.ErrBackfillTooOld {
+				cds.dsc.rejectBackfill(dp)
+			}
+		} else {
+			err = cds.ProcessDataPoint(dp.value, dp.timeStamp)
+		}
+		if !dp.arrived.IsZero() {
+			lat.observe(time.Now().Sub(dp.arrived))
+		}
 
 		if cds.watchCh != nil {
 			select {
@@ -256,6 +600,13 @@ func (cds *cachedDs) processIncoming() (int, int, error) {
 
 	cds.lastProcess = time.Now()
 
+	// Points collapsed into others by collapseDuplicates() are no
+	// longer referenced here and are left to the garbage collector.
+	for i, dp := range incoming {
+		dp.release()
+		incoming[i] = nil
+	}
+
 	if count < BIG {
 		// leave the backing array in place to avoid extra memory allocations
 		cds.incoming = cds.incoming[:0]
@@ -329,6 +680,11 @@ func (ds *distDs) Id() int64       { return ds.DbDataSourcer.Id() }
 func (ds *distDs) Type() string    { return "DataSource" }
 func (ds *distDs) GetName() string { return ds.DbDataSourcer.Ident().String() }
 
+// Size is the memory estimate of the DS, see cluster.DistDatumSizer.
+func (ds *distDs) Size() int64 {
+	return int64(cachedDsMemEstimate + len(ds.RRAs())*cachedRRAMemEstimate)
+}
+
 // end cluster.DistDatum interface
 
 type statster interface {
@@ -16,6 +16,9 @@ package receiver
 
 import (
 	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -108,6 +111,8 @@ type fakeSerde struct {
 	fakeErr                                bool
 	returnDss                              []rrd.DataSourcer
 	nondb                                  bool
+	notFound                               bool // nil spec means fetch only
+	lastSpec                               *rrd.DSSpec
 }
 
 func (m *fakeSerde) Fetcher() serde.Fetcher                                { return m }
@@ -137,9 +142,13 @@ func (f *fakeSerde) FlushDataSource(ds rrd.DataSourcer) error {
 
 func (f *fakeSerde) FetchOrCreateDataSource(ident serde.Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
 	f.createCalled++
+	f.lastSpec = dsSpec
 	if f.fakeErr {
 		return nil, fmt.Errorf("some error")
 	}
+	if f.notFound && dsSpec == nil {
+		return nil, nil
+	}
 	if f.nondb {
 		return rrd.NewDataSource(*DftDSSPec), nil
 	} else {
@@ -185,6 +194,46 @@ func Test_dscache_fetchOrCreateByIdent(t *testing.T) {
 	}
 }
 
+func Test_dscache_fetchOrCreateByIdent_breaker(t *testing.T) {
+	db := &fakeSerde{}
+	df := &SimpleDSFinder{DftDSSPec}
+	d := newDsCache(db, df, nil)
+	d.breaker = newDsCreateBreaker(1, 0, time.Minute, time.Minute)
+	d.breaker.addSeries(1) // open
+
+	// an existing DS is fetched with a nil spec
+	ident := newCachedIdent(serde.Ident{"name": "foo"})
+	cds := d.getByIdentOrCreateEmpty(ident)
+	if err := d.fetchOrCreateByIdent(cds); err != nil {
+		t.Errorf("fetchOrCreateByIdent: existing DS should load with the breaker open: %v", err)
+	}
+	if db.lastSpec != nil {
+		t.Errorf("fetchOrCreateByIdent: with the breaker open the spec should be nil (fetch only)")
+	}
+
+	// a DS that does not exist is refused
+	db.notFound = true
+	ident = newCachedIdent(serde.Ident{"name": "bar"})
+	cds = d.getByIdentOrCreateEmpty(ident)
+	cds.appendIncoming(&incomingDP{cachedIdent: ident, timeStamp: time.Unix(100, 0), value: 1})
+	if err := d.fetchOrCreateByIdent(cds); err != errCreateRefused {
+		t.Errorf("fetchOrCreateByIdent: expected errCreateRefused, got: %v", err)
+	}
+	d.dropRefused(cds)
+	if d.getByIdent(ident) != nil {
+		t.Errorf("dropRefused: cds should be removed from the cache")
+	}
+	if d.getByIdentOrCreateEmpty(ident) != nil {
+		t.Errorf("getByIdentOrCreateEmpty: a refused ident should be nil while the breaker is open")
+	}
+
+	sr := make(recordingSr)
+	d.breaker.report(sr)
+	if sr["receiver.datapoints.create_breaker_refused"] != 2 {
+		t.Errorf("expected 2 refused data points, got: %v", sr)
+	}
+}
+
 func Test_dscache_register(t *testing.T) {
 	d := newDsCache(nil, nil, nil)
 	d.clstr = &fakeCluster{}
@@ -244,3 +293,222 @@ func Test_dscache_cachedDs_Relinquish(t *testing.T) {
 		t.Errorf("id should be 0")
 	}
 }
+
+func Test_dscache_processIncomingBackfill(t *testing.T) {
+	dsc := newDsCache(nil, nil, nil)
+	dsc.backfill = time.Minute
+
+	foo := serde.Ident{"name": "foo"}
+	ds := serde.NewDbDataSource(0, foo, 0, 0, rrd.NewDataSource(*DftDSSPec))
+	cds := &cachedDs{DbDataSourcer: ds, mu: &sync.Mutex{}}
+	dsc.insert(cds)
+	if cds.backfill != time.Minute {
+		t.Errorf("insert did not set backfill: %v", cds.backfill)
+	}
+
+	process := func(secs ...int64) error {
+		for _, sec := range secs {
+			cds.appendIncoming(&incomingDP{timeStamp: time.Unix(sec, 0), value: 1})
+		}
+		cds.lastProcess = time.Time{}
+		_, _, err := cds.processIncoming(nil)
+		return err
+	}
+
+	process(1000, 1100)
+	if err := process(1050); err != nil {
+		t.Errorf("processIncoming: error on point within backfill window: %v", err)
+	}
+	if !cds.LastUpdate().Equal(time.Unix(1100, 0)) {
+		t.Errorf("processIncoming: backfill changed LastUpdate: %v", cds.LastUpdate())
+	}
+	if err := process(900); err == nil {
+		t.Errorf("processIncoming: no error on point outside backfill window")
+	}
+
+	cds.backfill = 0
+	if err := process(1090); err == nil {
+		t.Errorf("processIncoming: no error on out of order point with no backfill")
+	}
+
+	// slots which have been flushed are rejected
+	spec := &rrd.DSSpec{Step: 10 * time.Second, Heartbeat: time.Hour,
+		RRAs: []rrd.RRASpec{{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Hour}}}
+	ds = serde.NewDbDataSource(0, serde.Ident{"name": "bar"}, 0, 0, rrd.NewDataSource(*spec))
+	cds = &cachedDs{DbDataSourcer: ds, mu: &sync.Mutex{}}
+	dsc.insert(cds)
+	process(1000, 1100)
+	cds.ClearRRAs()
+	if err := process(1050); err != rrd.ErrBackfillTooOld {
+		t.Errorf("processIncoming: expected ErrBackfillTooOld for a flushed slot, got: %v", err)
+	}
+	if n := dsc.takeBackfillRejected(); n != 1 {
+		t.Errorf("processIncoming: expected 1 rejected backfill, got: %d", n)
+	}
+}
+
+func Test_dscache_processIncomingNaNLast(t *testing.T) {
+	dsc := newDsCache(nil, nil, nil)
+	ds := serde.NewDbDataSource(0, serde.Ident{"name": "foo"}, 0, 0, rrd.NewDataSource(*DftDSSPec))
+	cds := &cachedDs{DbDataSourcer: ds, nan: rrd.NaNLast, mu: &sync.Mutex{}}
+	dsc.insert(cds)
+
+	process := func(sec int64, v float64) {
+		cds.appendIncoming(&incomingDP{timeStamp: time.Unix(sec, 0), value: v})
+		cds.lastProcess = time.Time{}
+		cds.processIncoming(nil)
+	}
+
+	// no previous value, nothing to go by
+	process(1000, math.NaN())
+	if !cds.LastUpdate().IsZero() {
+		t.Errorf("processIncoming: NaN with no previous value should be skipped")
+	}
+
+	process(1000, 5)
+	process(1005, math.NaN())
+	if !cds.LastUpdate().Equal(time.Unix(1005, 0)) || cds.LastRaw() != 5 {
+		t.Errorf("processIncoming: NaN should be the last value: %v %v", cds.LastUpdate(), cds.LastRaw())
+	}
+
+	// the last value survives a reload from the DS state
+	spec := ds.Spec()
+	spec.LastUpdate, spec.LastRaw = cds.LastUpdate(), cds.LastRaw()
+	cds.DbDataSourcer = serde.NewDbDataSource(0, serde.Ident{"name": "foo"}, 0, 0, rrd.NewDataSource(spec))
+	process(1008, math.NaN())
+	if !cds.LastUpdate().Equal(time.Unix(1008, 0)) || cds.LastRaw() != 5 {
+		t.Errorf("processIncoming: NaN after a reload should be the last value: %v %v", cds.LastUpdate(), cds.LastRaw())
+	}
+}
+
+func Test_dscache_setFinder(t *testing.T) {
+	d := newDsCache(nil, &SimpleDSFinder{DftDSSPec}, nil)
+
+	spec := &rrd.DSSpec{Step: time.Minute}
+	d.setFinder(&SimpleDSFinder{spec})
+	if d.getFinder().FindMatchingDSSpec(serde.Ident{"name": "foo"}) != spec {
+		t.Errorf("setFinder: finder not replaced")
+	}
+	if cds := d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": "foo"})); cds == nil || cds.spec != spec {
+		t.Errorf("getByIdentOrCreateEmpty: new finder not used")
+	}
+}
+
+func Test_dscache_evict(t *testing.T) {
+	dsf := &fakeDsFlusher{}
+	d := newDsCache(nil, nil, dsf)
+	d.minIdle = time.Minute
+
+	mkCds := func(id int64, name string, idle time.Duration) *cachedDs {
+		ds := serde.NewDbDataSource(id, serde.Ident{"name": name}, 0, 0, rrd.NewDataSource(*DftDSSPec))
+		cds := &cachedDs{DbDataSourcer: ds, mu: &sync.Mutex{}, lastProcess: time.Now().Add(-idle), lastFlush: time.Now().Add(-idle)}
+		d.insert(cds)
+		return cds
+	}
+	mkCds(1, "old", time.Hour)
+	mkCds(2, "older", 2*time.Hour)
+	mkCds(3, "recent", time.Second)
+	unflushed := mkCds(4, "unflushed", 3*time.Hour)
+	unflushed.lastFlush = unflushed.lastProcess.Add(-time.Second)
+
+	if n := d.evict(); n != 0 {
+		t.Errorf("evict: nothing should be evicted without a budget: %d", n)
+	}
+
+	// room for exactly 2 DSs
+	d.maxMem = 2 * (cachedDsMemEstimate + uint64(len(DftDSSPec.RRAs))*cachedRRAMemEstimate)
+	if n := d.evict(); n != 2 {
+		t.Errorf("evict: expected 2 evictions, got %d", n)
+	}
+	if d.getByIdent(newCachedIdent(serde.Ident{"name": "older"})) != nil || d.getByIdent(newCachedIdent(serde.Ident{"name": "old"})) != nil {
+		t.Errorf("evict: least recently used DSs should be evicted first")
+	}
+	if d.getByIdent(newCachedIdent(serde.Ident{"name": "recent"})) == nil {
+		t.Errorf("evict: recently used DS should not be evicted")
+	}
+
+	// the unflushed DS was flushed, but not evicted yet
+	if d.getByIdent(newCachedIdent(serde.Ident{"name": "unflushed"})) == nil {
+		t.Errorf("evict: unflushed DS should not be evicted right away")
+	}
+	if unflushed.lastFlush.Before(time.Now().Add(-time.Second)) {
+		t.Errorf("evict: unflushed DS should have been flushed")
+	}
+}
+
+type fakeArchiverSerde struct {
+	*fakeSerde
+	archived []int64
+	failId   int64
+}
+
+func (f *fakeArchiverSerde) ArchiveDataSource(id int64) error {
+	if id == f.failId {
+		return fmt.Errorf("fake error")
+	}
+	f.archived = append(f.archived, id)
+	return nil
+}
+
+func Test_dscache_unloadStale(t *testing.T) {
+	db := &fakeArchiverSerde{fakeSerde: &fakeSerde{}}
+	d := newDsCache(db, nil, &fakeDsFlusher{})
+
+	mkCds := func(id int64, name string, idle time.Duration) {
+		ds := serde.NewDbDataSource(id, serde.Ident{"name": name}, 0, 0, rrd.NewDataSource(*DftDSSPec))
+		d.insert(&cachedDs{DbDataSourcer: ds, mu: &sync.Mutex{}, lastProcess: time.Now().Add(-idle), lastFlush: time.Now().Add(-idle)})
+	}
+	mkCds(1, "stale", 2*time.Hour)
+	mkCds(2, "fresh", time.Minute)
+
+	if n := d.unloadStale(); n != 0 {
+		t.Errorf("unloadStale: nothing should be unloaded without staleAfter: %d", n)
+	}
+
+	saved := archiveDataSources
+	defer func() { archiveDataSources = saved }()
+	done := make(chan bool)
+	archiveDataSources = func(archiver serde.DataSourceArchiver, ids []int64) (int, int) {
+		defer func() { done <- true }()
+		return saved(archiver, ids)
+	}
+
+	d.staleAfter, d.archive = time.Hour, true
+	if n := d.unloadStale(); n != 1 {
+		t.Errorf("unloadStale: expected 1 DS unloaded, got %d", n)
+	}
+	<-done
+	if d.getByIdent(newCachedIdent(serde.Ident{"name": "stale"})) != nil {
+		t.Errorf("unloadStale: stale DS should be unloaded")
+	}
+	if d.getByIdent(newCachedIdent(serde.Ident{"name": "fresh"})) == nil {
+		t.Errorf("unloadStale: fresh DS should not be unloaded")
+	}
+	if len(db.archived) != 1 || db.archived[0] != 1 {
+		t.Errorf("unloadStale: stale DS should be archived: %v", db.archived)
+	}
+
+	// checked too recently, nothing happens
+	mkCds(3, "stale2", 2*time.Hour)
+	if n := d.unloadStale(); n != 0 {
+		t.Errorf("unloadStale: should not check again so soon: %d", n)
+	}
+
+	// an error does not stop the rest from being archived
+	db.archived, db.failId = nil, 3
+	mkCds(4, "stale3", 2*time.Hour)
+	d.staleChecked = time.Time{}
+	if n := d.unloadStale(); n != 2 {
+		t.Errorf("unloadStale: expected 2 DSs unloaded, got %d", n)
+	}
+	<-done
+	for i := 0; i < 100 && atomic.LoadInt64(&d.archiveFailed) == 0; i++ {
+		time.Sleep(time.Millisecond) // the counts are added after archiveDataSources returns
+	}
+	if len(db.archived) != 1 || db.archived[0] != 4 {
+		t.Errorf("unloadStale: DS 4 should be archived despite the error on DS 3: %v", db.archived)
+	}
+	if archived, failed := d.takeArchived(); archived != 2 || failed != 1 {
+		t.Errorf("takeArchived: %d archived, %d failed, expected 2 and 1", archived, failed)
+	}
+}
@@ -16,12 +16,26 @@
 package receiver
 
 import (
+	"regexp"
 	"testing"
 	"time"
 
+	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/serde"
 )
 
+type regexpFinder struct {
+	re   *regexp.Regexp
+	spec *rrd.DSSpec
+}
+
+func (f *regexpFinder) FindMatchingDSSpec(ident serde.Ident) *rrd.DSSpec {
+	if f.re.MatchString(ident["name"]) {
+		return f.spec
+	}
+	return nil
+}
+
 func Test_dsfinder_FindMatchingDSSpec(t *testing.T) {
 	df := &SimpleDSFinder{DftDSSPec}
 	d := df.FindMatchingDSSpec(serde.Ident{"name": "whatever"})
@@ -29,3 +43,21 @@ func Test_dsfinder_FindMatchingDSSpec(t *testing.T) {
 		t.Errorf("FindMatchingDSSpec: d.Step != 10s || len(d.RRAs) == 0")
 	}
 }
+
+func Test_dsCache_finderFor(t *testing.T) {
+	dsc := newDsCache(&fakeSerde{}, &SimpleDSFinder{DftDSSPec}, nil)
+	hires := &rrd.DSSpec{Step: time.Second}
+	dsc.setSpecSet("hires", &regexpFinder{regexp.MustCompile(`^fast\.`), hires})
+
+	if spec := dsc.finderFor("hires").FindMatchingDSSpec(serde.Ident{"name": "fast.foo"}); spec != hires {
+		t.Errorf("finderFor: the spec set should match first")
+	}
+	if spec := dsc.finderFor("hires").FindMatchingDSSpec(serde.Ident{"name": "slow.foo"}); spec != DftDSSPec {
+		t.Errorf("finderFor: should fall back to the main finder")
+	}
+	for _, set := range []string{"", "bogus"} {
+		if spec := dsc.finderFor(set).FindMatchingDSSpec(serde.Ident{"name": "fast.foo"}); spec != DftDSSPec {
+			t.Errorf("finderFor(%q): should be the main finder", set)
+		}
+	}
+}
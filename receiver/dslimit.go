@@ -0,0 +1,141 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dsCreateLimiter limits how many new data sources may be created
+// within an interval, globally and under any given name prefix. This
+// protects the DS table from clients that put e.g. UUIDs or
+// timestamps in metric names. Limits apply to fixed intervals, the
+// counts reset at the beginning of every interval.
+type dsCreateLimiter struct {
+	*sync.Mutex
+	interval time.Duration
+	global   int
+	prefixes []string // sorted
+	limits   map[string]int
+	start    time.Time
+	count    int
+	counts   map[string]int
+	dropped  map[string]int // "" is the global limit
+	total    int            // total dropped, reset by takeDropped()
+}
+
+// newDsCreateLimiter returns a limiter or nil if there are no limits. A
+// zero or negative limit means no limit.
+func newDsCreateLimiter(interval time.Duration, global int, byPrefix map[string]int) *dsCreateLimiter {
+	l := &dsCreateLimiter{
+		Mutex:    &sync.Mutex{},
+		interval: interval,
+		global:   global,
+		limits:   make(map[string]int),
+		counts:   make(map[string]int),
+		dropped:  make(map[string]int),
+	}
+	for prefix, limit := range byPrefix {
+		if limit > 0 {
+			l.prefixes = append(l.prefixes, prefix)
+			l.limits[prefix] = limit
+		}
+	}
+	if l.global <= 0 && len(l.prefixes) == 0 {
+		return nil
+	}
+	sort.Strings(l.prefixes)
+	if l.interval <= 0 {
+		l.interval = time.Minute
+	}
+	return l
+}
+
+// allow returns true if a new DS by this name may be created and
+// counts it against every limit that applies to it. If any limit is
+// reached, nothing is counted and the drop is recorded instead.
+func (l *dsCreateLimiter) allow(name string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if now := time.Now(); now.Sub(l.start) >= l.interval {
+		l.logDropped()
+		l.start = now
+		l.count = 0
+		l.counts = make(map[string]int)
+	}
+
+	if l.global > 0 && l.count >= l.global {
+		l.dropped[""]++
+		l.total++
+		return false
+	}
+
+	var matched []string
+	for _, prefix := range l.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			if l.counts[prefix] >= l.limits[prefix] {
+				l.dropped[prefix]++
+				l.total++
+				return false
+			}
+			matched = append(matched, prefix)
+		}
+	}
+
+	l.count++
+	for _, prefix := range matched {
+		l.counts[prefix]++
+	}
+	return true
+}
+
+// logDropped logs what was dropped in the interval that just ended
+// and resets the per-limit drop counts. Must be called with the lock
+// held.
+func (l *dsCreateLimiter) logDropped() {
+	for prefix, n := range l.dropped {
+		if prefix == "" {
+			log.Printf("dsCreateLimiter: global new DS limit (%d per %v) reached, %d data points dropped", l.global, l.interval, n)
+		} else {
+			log.Printf("dsCreateLimiter: new DS limit for prefix %q (%d per %v) reached, %d data points dropped", prefix, l.limits[prefix], l.interval, n)
+		}
+	}
+	if len(l.dropped) > 0 {
+		l.dropped = make(map[string]int)
+	}
+}
+
+// takeDropped returns the number of data points dropped because of
+// the limits since the last call.
+func (l *dsCreateLimiter) takeDropped() int {
+	if l == nil {
+		return 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	n := l.total
+	l.total = 0
+	return n
+}
@@ -0,0 +1,80 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_dslimit_newDsCreateLimiter(t *testing.T) {
+	if l := newDsCreateLimiter(time.Minute, 0, map[string]int{"foo.": 0}); l != nil {
+		t.Errorf("newDsCreateLimiter: with no limits should return nil")
+	}
+	var l *dsCreateLimiter
+	if !l.allow("foo") || l.takeDropped() != 0 {
+		t.Errorf("nil dsCreateLimiter should allow everything")
+	}
+	if l = newDsCreateLimiter(0, 1, nil); l.interval != time.Minute {
+		t.Errorf("newDsCreateLimiter: default interval should be 1m: %v", l.interval)
+	}
+}
+
+func Test_dslimit_allow(t *testing.T) {
+	l := newDsCreateLimiter(time.Hour, 3, map[string]int{"foo.": 1, "foo.bar.": 5})
+
+	if !l.allow("foo.bar.1") {
+		t.Errorf("allow: first foo. name should be allowed")
+	}
+	if l.allow("foo.bar.2") {
+		t.Errorf("allow: second foo. name should not be allowed")
+	}
+	if !l.allow("baz.1") || !l.allow("baz.2") {
+		t.Errorf("allow: names without a limited prefix should be allowed")
+	}
+	if l.allow("baz.3") {
+		t.Errorf("allow: global limit exceeded, should not be allowed")
+	}
+	if n := l.takeDropped(); n != 2 {
+		t.Errorf("takeDropped: %d != 2", n)
+	}
+	if n := l.takeDropped(); n != 0 {
+		t.Errorf("takeDropped: should reset, got %d", n)
+	}
+
+	// a new interval resets the counts
+	l.start = time.Now().Add(-2 * time.Hour)
+	if !l.allow("foo.bar.2") {
+		t.Errorf("allow: counts should reset after interval")
+	}
+}
+
+func Test_dslimit_dsCache(t *testing.T) {
+	d := newDsCache(nil, &SimpleDSFinder{DftDSSPec}, nil)
+	d.limiter = newDsCreateLimiter(time.Hour, 1, nil)
+
+	if cds := d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": "foo"})); cds == nil {
+		t.Errorf("getByIdentOrCreateEmpty: first DS should be created")
+	}
+	if cds := d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": "foo"})); cds == nil {
+		t.Errorf("getByIdentOrCreateEmpty: a cached DS is not subject to limits")
+	}
+	if cds := d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": "bar"})); cds != nil {
+		t.Errorf("getByIdentOrCreateEmpty: second DS should be limited")
+	}
+}
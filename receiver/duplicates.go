@@ -0,0 +1,104 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DuplicatePolicy determines what happens when more than one data
+// point for the same DS with the same time stamp arrives, e.g. when
+// several emitters report the same series.
+type DuplicatePolicy int32
+
+const (
+	// The data point that arrived last wins. This is the default.
+	DuplicateKeepLast DuplicatePolicy = iota
+	// The data point that arrived first wins, the rest are ignored.
+	DuplicateKeepFirst
+	// The values are added up.
+	DuplicateSum
+	// The values are averaged.
+	DuplicateAverage
+)
+
+func (p DuplicatePolicy) String() string {
+	switch p {
+	case DuplicateKeepLast:
+		return "keep-last"
+	case DuplicateKeepFirst:
+		return "keep-first"
+	case DuplicateSum:
+		return "sum"
+	case DuplicateAverage:
+		return "average"
+	}
+	return fmt.Sprintf("DuplicatePolicy(%d)", int32(p))
+}
+
+// ParseDuplicatePolicy converts one of "keep-last", "keep-first",
+// "sum" or "average" into a DuplicatePolicy.
+func ParseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	switch strings.ToLower(s) {
+	case "keep-last":
+		return DuplicateKeepLast, nil
+	case "keep-first":
+		return DuplicateKeepFirst, nil
+	case "sum":
+		return DuplicateSum, nil
+	case "average":
+		return DuplicateAverage, nil
+	}
+	return DuplicateKeepLast, fmt.Errorf("Invalid duplicate time stamp policy: %q (must be keep-last, keep-first, sum or average)", s)
+}
+
+// collapseDuplicates combines the data points which have the same
+// time stamp into one according to the policy. The points must be
+// sorted by a stable sort so that the order of arrival is preserved
+// among equal time stamps. The result reuses the backing array of
+// dps, the number of points that were combined away is returned as
+// well.
+func collapseDuplicates(dps sortableIncomingDPs, policy DuplicatePolicy) (sortableIncomingDPs, int) {
+	if len(dps) < 2 {
+		return dps, 0
+	}
+
+	result := dps[:1]
+	n := 1 // points in the current run
+	for _, dp := range dps[1:] {
+		last := result[len(result)-1]
+		if !dp.timeStamp.Equal(last.timeStamp) {
+			if n > 1 && policy == DuplicateAverage {
+				last.value /= float64(n)
+			}
+			result = append(result, dp)
+			n = 1
+			continue
+		}
+		n++
+		switch policy {
+		case DuplicateKeepLast:
+			result[len(result)-1] = dp
+		case DuplicateSum, DuplicateAverage:
+			last.value += dp.value
+		}
+	}
+	if last := result[len(result)-1]; n > 1 && policy == DuplicateAverage {
+		last.value /= float64(n)
+	}
+	return result, len(dps) - len(result)
+}
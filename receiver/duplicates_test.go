@@ -0,0 +1,102 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/dsl"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_ParseDuplicatePolicy(t *testing.T) {
+	for _, p := range []DuplicatePolicy{DuplicateKeepLast, DuplicateKeepFirst, DuplicateSum, DuplicateAverage} {
+		if got, err := ParseDuplicatePolicy(p.String()); err != nil || got != p {
+			t.Errorf("ParseDuplicatePolicy(%q) = %v, %v", p.String(), got, err)
+		}
+	}
+	if _, err := ParseDuplicatePolicy("bogus"); err == nil {
+		t.Errorf("ParseDuplicatePolicy: no error on invalid policy")
+	}
+}
+
+func Test_collapseDuplicates(t *testing.T) {
+	dps := func() sortableIncomingDPs {
+		var result sortableIncomingDPs
+		for i, sec := range []int64{200, 100, 100, 300, 100, 200} {
+			result = append(result, &incomingDP{timeStamp: time.Unix(sec, 0), value: float64(i + 1)})
+		}
+		sort.Stable(result)
+		return result
+	}
+
+	for policy, expect := range map[DuplicatePolicy][]float64{
+		DuplicateKeepLast:  {5, 6, 4},
+		DuplicateKeepFirst: {2, 1, 4},
+		DuplicateSum:       {10, 7, 4},
+		DuplicateAverage:   {10.0 / 3, 3.5, 4},
+	} {
+		result, n := collapseDuplicates(dps(), policy)
+		if n != 3 || len(result) != len(expect) {
+			t.Errorf("collapseDuplicates(%v): %d points, %d combined", policy, len(result), n)
+			continue
+		}
+		for i, dp := range result {
+			if dp.timeStamp.Unix() != int64(100*(i+1)) || dp.value != expect[i] {
+				t.Errorf("collapseDuplicates(%v): point %d is %v at %v, expected %v", policy, i, dp.value, dp.timeStamp.Unix(), expect[i])
+			}
+		}
+	}
+}
+
+func Test_dscache_processIncomingDuplicates(t *testing.T) {
+	dsc := newDsCache(nil, nil, nil)
+	dsc.dups = DuplicateKeepFirst
+
+	foo := serde.Ident{"name": "foo"}
+	ds := serde.NewDbDataSource(0, foo, 0, 0, rrd.NewDataSource(*DftDSSPec))
+	watchCh := make(chan dsl.DataPoint, 10)
+	cds := &cachedDs{DbDataSourcer: ds, mu: &sync.Mutex{}, watchCh: watchCh}
+	dsc.insert(cds)
+	if cds.dups != DuplicateKeepFirst {
+		t.Errorf("insert did not set dups: %v", cds.dups)
+	}
+
+	process := func(sec int64, values ...float64) {
+		for _, v := range values {
+			cds.appendIncoming(&incomingDP{timeStamp: time.Unix(sec, 0), value: v})
+		}
+		cds.lastProcess = time.Time{}
+		cds.processIncoming(nil)
+	}
+
+	process(1000, 1, 2, 3)
+	process(1000, 4) // duplicate of an earlier batch
+	process(1010, 5)
+
+	close(watchCh)
+	var got []float64
+	for dp := range watchCh {
+		got = append(got, dp.V)
+	}
+	if len(got) != 2 || got[0] != 1 || got[1] != 5 {
+		t.Errorf("processIncoming with keep-first: processed %v, expected [1 5]", got)
+	}
+}
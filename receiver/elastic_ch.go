@@ -15,33 +15,115 @@
 
 package receiver
 
-type fifoQueue []interface{}
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// QueueOverflowPolicy determines what happens to incoming data points
+// when the receiver queue is full.
+type QueueOverflowPolicy int32
+
+const (
+	// Discard the incoming data point. This is the default.
+	QueueDropNewest QueueOverflowPolicy = iota
+	// Discard the oldest queued data point to make room for the
+	// incoming one.
+	QueueDropOldest
+	// Stop accepting data points until there is room in the queue,
+	// which blocks the producers (e.g. QueueDataPoint()).
+	QueueBlock
+)
+
+func (p QueueOverflowPolicy) String() string {
+	switch p {
+	case QueueDropNewest:
+		return "drop-newest"
+	case QueueDropOldest:
+		return "drop-oldest"
+	case QueueBlock:
+		return "block"
+	}
+	return fmt.Sprintf("QueueOverflowPolicy(%d)", int32(p))
+}
+
+// ParseQueueOverflowPolicy converts one of "drop-newest",
+// "drop-oldest" or "block" into a QueueOverflowPolicy.
+func ParseQueueOverflowPolicy(s string) (QueueOverflowPolicy, error) {
+	switch strings.ToLower(s) {
+	case "drop-newest":
+		return QueueDropNewest, nil
+	case "drop-oldest":
+		return QueueDropOldest, nil
+	case "block":
+		return QueueBlock, nil
+	}
+	return QueueDropNewest, fmt.Errorf("Invalid queue overflow policy: %q (valid: drop-newest, drop-oldest, block)", s)
+}
+
+// fifoQueue is the queue behind the elastic channel. Its capacity and
+// overflow policy can be changed while elasticCh is running, the
+// overflow counters are reset every time they are read. Only
+// elasticCh pushes and pops, but the size can be read by anyone.
+type fifoQueue struct {
+	dps      []interface{}
+	length   int64
+	capacity int64 // zero or negative is unlimited
+	policy   int32
+	dropped  int64
+	blocked  int64
+}
 
 func (q *fifoQueue) push(dp interface{}) {
-	*q = append(*q, dp)
+	q.dps = append(q.dps, dp)
+	atomic.StoreInt64(&q.length, int64(len(q.dps)))
 }
 
 func (q *fifoQueue) pop() (dp interface{}) {
-	if len(*q) == 0 {
+	if len(q.dps) == 0 {
 		return nil
 	}
-	dp, *q = (*q)[0], (*q)[1:]
-	if len(*q) == 0 {
-		*q = make([]interface{}, 0, 256) // replace the queue to free memory
+	dp, q.dps = q.dps[0], q.dps[1:]
+	if len(q.dps) == 0 {
+		q.dps = make([]interface{}, 0, 256) // replace the queue to free memory
 	}
+	atomic.StoreInt64(&q.length, int64(len(q.dps)))
 	return dp
 }
 
 func (q *fifoQueue) size() int {
-	return len(*q)
+	return int(atomic.LoadInt64(&q.length))
+}
+
+func (q *fifoQueue) setLimits(capacity int, policy QueueOverflowPolicy) {
+	atomic.StoreInt64(&q.capacity, int64(capacity))
+	atomic.StoreInt32(&q.policy, int32(policy))
+}
+
+func (q *fifoQueue) limits() (int, QueueOverflowPolicy) {
+	return int(atomic.LoadInt64(&q.capacity)), QueueOverflowPolicy(atomic.LoadInt32(&q.policy))
+}
+
+func (q *fifoQueue) full() bool {
+	capacity, _ := q.limits()
+	return capacity > 0 && q.size() >= capacity
+}
+
+// Returns the number of dropped data points and the number of times
+// the producers were blocked since the last call.
+func (q *fifoQueue) overflows() (dropped, blocked int64) {
+	return atomic.SwapInt64(&q.dropped, 0), atomic.SwapInt64(&q.blocked, 0)
 }
 
 // Inspired by https://github.com/npat-efault/musings/wiki/Elastic-channels
 //
 // TL;DR This clever structure provides never-blocking channel-like
 // behavior.  inLoop and outLoop are optimizations to read or send as
-// much as we can at a time for performance.
-func elasticCh(cin <-chan interface{}, cout chan<- interface{}, queue *fifoQueue, maxQueue int) {
+// much as we can at a time for performance. When the queue is full,
+// the queue overflow policy decides whether we drop a data point or
+// stop reading from cin (thereby blocking the senders).
+func elasticCh(cin <-chan interface{}, cout chan<- interface{}, queue *fifoQueue) {
 
 	const maxReceive = 1024
 	var (
@@ -49,6 +131,7 @@ func elasticCh(cin <-chan interface{}, cout chan<- interface{}, queue *fifoQueue
 		out    chan<- interface{}
 		vi, vo interface{}
 		ok     bool
+		closed bool
 	)
 
 	in, out = cin, nil
@@ -62,16 +145,32 @@ func elasticCh(cin <-chan interface{}, cout chan<- interface{}, queue *fifoQueue
 						close(cout)
 						return
 					}
-					in = nil
+					in, closed = nil, true
 					break
 				}
 				if out == nil {
 					vo = vi
 					out = cout
+				} else if !queue.full() {
+					queue.push(vi)
 				} else {
-					if maxQueue > 0 && queue.size() < maxQueue {
+					_, policy := queue.limits()
+					switch policy {
+					case QueueDropOldest:
+						queue.pop()
+						queue.push(vi)
+						atomic.AddInt64(&queue.dropped, 1)
+					case QueueBlock:
+						// Keep this one (the queue is one over
+						// capacity now), but do not receive any more
+						// until there is room.
 						queue.push(vi)
-					} // else /dev/null
+						atomic.AddInt64(&queue.blocked, 1)
+						in = nil
+						break inLoop
+					default:
+						atomic.AddInt64(&queue.dropped, 1) // /dev/null
+					}
 				}
 				select {
 				case vi, ok = <-in:
@@ -85,12 +184,15 @@ func elasticCh(cin <-chan interface{}, cout chan<- interface{}, queue *fifoQueue
 				if queue.size() > 0 {
 					vo = queue.pop()
 				} else {
-					if in == nil {
+					if closed {
 						close(cout)
 						return
 					}
 					out = nil
 				}
+				if in == nil && !closed && !queue.full() {
+					in = cin // there is room again
+				}
 				select {
 				case out <- vo:
 				default:
@@ -16,6 +16,7 @@
 package receiver
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
 	"sync"
@@ -25,10 +26,12 @@ import (
 )
 
 type dsFlusher struct {
-	db     serde.Flusher
-	vcache *verticalCache
-	sr     statReporter
-	dbCh   chan *vDpFlushRequest
+	db       serde.Flusher
+	vcache   *verticalCache
+	sr       statReporter
+	dbCh     chan *vDpFlushRequest
+	shardChs []chan *vDpFlushRequest // per flusher, nil unless sharded
+	quiesced sync.RWMutex            // write locked while a snapshot is taken
 }
 
 // There are 3 types of flush requests:
@@ -41,9 +44,13 @@ type vDpFlushRequest struct {
 	ivers                       map[int64]*iVer       // DPS (versions)
 	latests                     map[int64]interface{} // Latests
 	lastupdate, duration, value map[int64]interface{} // DSS
+	lastRaw                     map[int64]interface{} // DSS
 }
 
-func (f *dsFlusher) start(flusherWg, startWg *sync.WaitGroup, minStep time.Duration, n int) {
+// start starts n db flushers. If shard is nil, they all read from the
+// same channel, otherwise every flusher has its own channel and shard
+// decides which one gets a request.
+func (f *dsFlusher) start(flusherWg, startWg *sync.WaitGroup, minStep time.Duration, n, batchSize int, batchDelay time.Duration, pacer *flushPacer, shard FlushShardFunc) {
 
 	// It's not clear what the size of this channel should be, but
 	// we know we do not want it to be infinite. When it blocks,
@@ -55,12 +62,29 @@ func (f *dsFlusher) start(flusherWg, startWg *sync.WaitGroup, minStep time.Durat
 		dps:     make(map[bundleKey]*verticalCacheSegment),
 		dss:     make(map[int64]*dsStateSegment),
 		minStep: minStep,
+		pacer:   pacer,
 	}
 
 	log.Printf(" -- vertical db flusher...")
+	if _, ok := f.db.(serde.BatchFlusher); ok && batchSize > 1 {
+		log.Printf(" -- flushes batched by up to %d per transaction, waiting at most %v", batchSize, batchDelay)
+	}
+	if shard != nil && n > 1 {
+		log.Printf(" -- flush requests sharded among %d flushers", n)
+		f.shardChs = make([]chan *vDpFlushRequest, n)
+		for i := range f.shardChs {
+			f.shardChs[i] = make(chan *vDpFlushRequest, 1024)
+		}
+		go flushSharder(f.dbCh, f.shardChs, shard, f.sr)
+	}
+	qdb := newQuiescedFlusher(f.db, &f.quiesced)
 	for i := 0; i < n; i++ {
+		ch := f.dbCh
+		if f.shardChs != nil {
+			ch = f.shardChs[i]
+		}
 		startWg.Add(1)
-		go dbFlusher(&wrkCtl{wg: flusherWg, startWg: startWg, id: fmt.Sprintf("vdbflusher_%d", i)}, f.db, f.dbCh, f.sr)
+		go dbFlusher(&wrkCtl{wg: flusherWg, startWg: startWg, id: fmt.Sprintf("vdbflusher_%d", i)}, qdb, ch, f.sr, batchSize, batchDelay, pacer)
 	}
 	// TODO Consider making this nap time configurable?
 	go vcacheFlusher(f.vcache, f.dbCh, 100*time.Millisecond, f.sr)
@@ -69,6 +93,15 @@ func (f *dsFlusher) start(flusherWg, startWg *sync.WaitGroup, minStep time.Durat
 		log.Printf(" -- ts table size reporter")
 		go reportTsTableSize(tdb, f.sr)
 	}
+	if pdb, ok := f.db.(poolStatser); ok {
+		go reportPoolStats(pdb, f.sr)
+	}
+	if sdb, ok := f.db.(stmtStatser); ok {
+		go reportStmtStats(sdb, f.sr)
+	}
+	if odb, ok := f.db.(opStatser); ok {
+		go reportOpStats(odb, f.sr, 15*time.Second)
+	}
 }
 
 func (f *dsFlusher) stop() {
@@ -112,30 +145,68 @@ func (f *dsFlusher) statReporter() statReporter {
 	return f.sr
 }
 
+// pending returns the number of flush requests waiting to be written
+// to the database.
+func (f *dsFlusher) pending() int {
+	n := len(f.dbCh)
+	for _, ch := range f.shardChs {
+		n += len(ch)
+	}
+	return n
+}
+
 type dsFlusherBlocking interface {
 	flushToVCache(serde.DbDataSourcer)
 	statReporter() statReporter
-	start(flusherWg, startWg *sync.WaitGroup, minStep time.Duration, n int)
+	start(flusherWg, startWg *sync.WaitGroup, minStep time.Duration, n, batchSize int, batchDelay time.Duration, pacer *flushPacer, shard FlushShardFunc)
 	stop()
+	pending() int
 }
 
-var dbFlusher = func(wc wController, db serde.Flusher, ch chan *vDpFlushRequest, sr statReporter) {
+type dbFlusherStats struct {
+	dpsDur, dsDur, rraDur             time.Duration
+	dpsCount, dsCount, rraCount       int
+	dpsFlushes, dsFlushes, rraFlushes int
+	dpsSqlOps, dsSqlOps, rraSqlOps    int
+	chMaxLen, chGets                  int
+	batches, batchRequests            int
+	batchFailures                     int
+	start                             time.Time
+}
+
+// addFlushes adds the flush counts and durations of o to st.
+func (st *dbFlusherStats) addFlushes(o *dbFlusherStats) {
+	st.dpsDur += o.dpsDur
+	st.dsDur += o.dsDur
+	st.rraDur += o.rraDur
+	st.dpsCount += o.dpsCount
+	st.dsCount += o.dsCount
+	st.rraCount += o.rraCount
+	st.dpsFlushes += o.dpsFlushes
+	st.dsFlushes += o.dsFlushes
+	st.rraFlushes += o.rraFlushes
+	st.dpsSqlOps += o.dpsSqlOps
+	st.dsSqlOps += o.dsSqlOps
+	st.rraSqlOps += o.rraSqlOps
+}
+
+// If db is a serde.BatchFlusher and batchSize is greater than 1, up
+// to batchSize flush requests are grouped into a single transaction,
+// waiting at most batchDelay for the batch to fill up. The time every
+// write takes is reported to the pacer, which may adjust batchSize.
+var dbFlusher = func(wc wController, db serde.Flusher, ch chan *vDpFlushRequest, sr statReporter, batchSize int, batchDelay time.Duration, pacer *flushPacer) {
 	wc.onEnter()
 	defer wc.onExit()
 
 	log.Printf("  - %s started.", wc.ident())
 	wc.onStarted()
 
-	type stats struct {
-		dpsDur, dsDur, rraDur             time.Duration
-		dpsCount, dsCount, rraCount       int
-		dpsFlushes, dsFlushes, rraFlushes int
-		dpsSqlOps, dsSqlOps, rraSqlOps    int
-		chMaxLen, chGets                  int
-		start                             time.Time
+	bdb, _ := db.(serde.BatchFlusher)
+	if batchSize <= 1 {
+		bdb = nil
 	}
 
-	st := &stats{start: time.Now()}
+	st := &dbFlusherStats{start: time.Now()}
 
 	for {
 		dpr, ok := <-ch
@@ -149,42 +220,20 @@ var dbFlusher = func(wc wController, db serde.Flusher, ch chan *vDpFlushRequest,
 			st.chMaxLen = l
 		}
 
-		if len(dpr.lastupdate) > 0 {
-			// DS state Flush
+		if bdb == nil {
 			start := time.Now()
-			sqlOps, err := db.FlushDSStates(dpr.seg, dpr.lastupdate, dpr.value, dpr.duration)
-			if err != nil {
-				log.Printf("vdbflusher: ERROR in VerticalFlushDSs: %v", err)
-			}
-			st.dsDur += time.Now().Sub(start)
-			st.dsCount += len(dpr.lastupdate)
-			st.dsSqlOps += sqlOps
-			st.dsFlushes++
-
-		} else if len(dpr.dps) > 0 {
-			// Datapoints flush
-			idps, vers := dataPointsWithVersions(dpr.dps, dpr.i, dpr.ivers)
-			start := time.Now()
-			sqlOps, err := db.FlushDataPoints(dpr.bundleId, dpr.seg, dpr.i, idps, vers)
-			if err != nil {
-				log.Printf("vdbflusher: ERROR in VerticalFlushDps: %v", err)
-			}
-			st.dpsDur += time.Now().Sub(start)
-			st.dpsCount += len(dpr.dps)
-			st.dpsSqlOps += sqlOps
-			st.dpsFlushes++
-
-		} else if (len(dpr.latests) + len(dpr.value) + len(dpr.duration)) > 0 {
-			// RRA State flush
+			dbFlushRequest(db, dpr, st)
+			pacer.observe(time.Now().Sub(start), 1)
+		} else {
+			var batch []*vDpFlushRequest
+			batch, ok = dbFlusherCollectBatch(ch, dpr, pacer.batchSize(batchSize), batchDelay, st)
 			start := time.Now()
-			sqlOps, err := db.FlushRRAStates(dpr.bundleId, dpr.seg, dpr.latests, dpr.value, dpr.duration)
-			if err != nil {
-				log.Printf("verticalCache: ERROR in VerticalFlushRRAs: %v", err)
+			dbFlushBatch(bdb, batch, st)
+			pacer.observe(time.Now().Sub(start), len(batch))
+			if !ok {
+				log.Printf("%s: exiting", wc.ident())
+				return
 			}
-			st.rraDur += time.Now().Sub(start)
-			st.rraCount += len(dpr.latests)
-			st.rraSqlOps += sqlOps
-			st.rraFlushes++
 		}
 
 		if st.start.Before(time.Now().Add(-time.Second)) {
@@ -215,9 +264,124 @@ var dbFlusher = func(wc wController, db serde.Flusher, ch chan *vDpFlushRequest,
 			sr.reportStatCount("serde.flush_channel.gets", float64(st.chGets))
 			sr.reportStatGauge("serde.flush_channel.len", float64(st.chMaxLen))
 
-			st = &stats{start: time.Now()}
+			if bdb != nil {
+				sr.reportStatCount("serde.flush_batch.count", float64(st.batches))
+				if st.batches > 0 {
+					sr.reportStatGauge("serde.flush_batch.size", float64(st.batchRequests)/float64(st.batches))
+				}
+				sr.reportStatCount("serde.flush_batch.failed", float64(st.batchFailures))
+			}
+
+			st = &dbFlusherStats{start: time.Now()}
+		}
+	}
+}
+
+// dbFlusherCollectBatch reads up to batchSize requests (including
+// the first one) from ch, giving up after batchDelay. Returns false if
+// the channel has been closed.
+func dbFlusherCollectBatch(ch chan *vDpFlushRequest, first *vDpFlushRequest, batchSize int, batchDelay time.Duration, st *dbFlusherStats) ([]*vDpFlushRequest, bool) {
+	batch := make([]*vDpFlushRequest, 1, batchSize)
+	batch[0] = first
+
+	timer := time.NewTimer(batchDelay)
+	defer timer.Stop()
+
+	for len(batch) < batchSize {
+		select {
+		case dpr, ok := <-ch:
+			if !ok {
+				return batch, false
+			}
+			st.chGets += 1
+			batch = append(batch, dpr)
+		case <-timer.C:
+			return batch, true
+		}
+	}
+	return batch, true
+}
+
+// dbFlushBatch flushes all requests in a single transaction. If
+// anything fails, the transaction is rolled back and the requests are
+// flushed one by one without a transaction so that one bad request
+// does not cost us the whole batch. The flushes are only counted once
+// the transaction is committed.
+func dbFlushBatch(db serde.BatchFlusher, batch []*vDpFlushRequest, st *dbFlusherStats) {
+	st.batches++
+	st.batchRequests += len(batch)
+
+	txSt := &dbFlusherStats{}
+	tx, err := db.BeginFlushBatch()
+	if err == nil {
+		for _, dpr := range batch {
+			if err = dbFlushRequest(tx, dpr, txSt); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit()
+		}
+	}
+	if err == nil {
+		st.addFlushes(txSt)
+		return
+	}
+
+	log.Printf("vdbflusher: ERROR flushing batch of %d, retrying individually: %v", len(batch), err)
+	st.batchFailures++
+	for _, dpr := range batch {
+		dbFlushRequest(db, dpr, st)
+	}
+}
+
+// dbFlushRequest performs the flush a request calls for, errors are
+// logged (and returned). Only successful flushes are counted in st.
+func dbFlushRequest(db serde.Flusher, dpr *vDpFlushRequest, st *dbFlusherStats) (err error) {
+	var sqlOps int
+	if len(dpr.lastupdate) > 0 {
+		// DS state Flush
+		start := time.Now()
+		sqlOps, err = db.FlushDSStates(dpr.seg, dpr.lastupdate, dpr.value, dpr.duration, dpr.lastRaw)
+		if err != nil {
+			log.Printf("vdbflusher: ERROR in VerticalFlushDSs: %v", err)
+			return err
+		}
+		st.dsDur += time.Now().Sub(start)
+		st.dsCount += len(dpr.lastupdate)
+		st.dsSqlOps += sqlOps
+		st.dsFlushes++
+
+	} else if len(dpr.dps) > 0 {
+		// Datapoints flush
+		idps, vers := dataPointsWithVersions(dpr.dps, dpr.i, dpr.ivers)
+		start := time.Now()
+		sqlOps, err = db.FlushDataPoints(dpr.bundleId, dpr.seg, dpr.i, idps, vers)
+		if err != nil {
+			log.Printf("vdbflusher: ERROR in VerticalFlushDps: %v", err)
+			return err
 		}
+		st.dpsDur += time.Now().Sub(start)
+		st.dpsCount += len(dpr.dps)
+		st.dpsSqlOps += sqlOps
+		st.dpsFlushes++
+
+	} else if (len(dpr.latests) + len(dpr.value) + len(dpr.duration)) > 0 {
+		// RRA State flush
+		start := time.Now()
+		sqlOps, err = db.FlushRRAStates(dpr.bundleId, dpr.seg, dpr.latests, dpr.value, dpr.duration)
+		if err != nil {
+			log.Printf("verticalCache: ERROR in VerticalFlushRRAs: %v", err)
+			return err
+		}
+		st.rraDur += time.Now().Sub(start)
+		st.rraCount += len(dpr.latests)
+		st.rraSqlOps += sqlOps
+		st.rraFlushes++
 	}
+	return err
 }
 
 var vcacheFlusher = func(vcache *verticalCache, dbCh chan *vDpFlushRequest, nap time.Duration, sr statReporter) {
@@ -237,6 +401,12 @@ var vcacheFlusher = func(vcache *verticalCache, dbCh chan *vDpFlushRequest, nap
 		sr.reportStatCount("serde.flush_channel.ds_pushes", float64(st.dsFlushes))
 		sr.reportStatCount("serde.flush_channel.points", float64(st.dpFlushedPoints))
 		sr.reportStatCount("serde.flush_channel.blocked", float64(st.dpFlushBlocked))
+
+		if vcache.pacer != nil {
+			factor, latency := vcache.pacer.state()
+			sr.reportStatGauge("serde.flush_pacer.factor", factor)
+			sr.reportStatGauge("serde.flush_pacer.latency_ms", latency.Seconds()*1000)
+		}
 	}
 }
 
@@ -258,3 +428,89 @@ func reportTsTableSize(ts tsTableSizer, sr statReporter) {
 		sr.reportStatGauge("serde.ts_table.bloat_factor", bloat)
 	}
 }
+
+// Periodically report the utilization of the database connection
+// pools, so that the pool settings can be tuned.
+
+type poolStatser interface {
+	PoolStats() map[string]sql.DBStats
+}
+
+func reportPoolStats(ps poolStatser, sr statReporter) {
+	waits := make(map[string]int64)
+	for {
+		time.Sleep(15 * time.Second)
+		for name, st := range ps.PoolStats() {
+			prefix := "serde.pool." + name
+			sr.reportStatGauge(prefix+".open", float64(st.OpenConnections))
+			sr.reportStatGauge(prefix+".in_use", float64(st.InUse))
+			sr.reportStatGauge(prefix+".idle", float64(st.Idle))
+			if st.MaxOpenConnections > 0 {
+				sr.reportStatGauge(prefix+".utilization", float64(st.InUse)/float64(st.MaxOpenConnections))
+			}
+			// waiting for a connection means the pool is too small
+			sr.reportStatCount(prefix+".waits", float64(st.WaitCount-waits[name]))
+			waits[name] = st.WaitCount
+		}
+	}
+}
+
+// Periodically report how many statements were prepared and how
+// often they were executed.
+
+type stmtStatser interface {
+	StmtStats() map[string]serde.PgStmtStats
+}
+
+func reportStmtStats(ss stmtStatser, sr statReporter) {
+	last := make(map[string]serde.PgStmtStats)
+	for {
+		time.Sleep(15 * time.Second)
+		for name, st := range ss.StmtStats() {
+			prefix := "serde.stmt_cache." + name
+			sr.reportStatCount(prefix+".prepares", float64(st.Prepares-last[name].Prepares))
+			sr.reportStatCount(prefix+".execs", float64(st.Execs-last[name].Execs))
+			sr.reportStatCount(prefix+".unprepared", float64(st.Unprepared-last[name].Unprepared))
+			last[name] = st
+		}
+	}
+}
+
+// Periodically report the calls, errors, rows and latencies of the
+// database operations, so that a slower or failing database shows.
+
+type opStatser interface {
+	OpStats() map[string]serde.OpStat
+}
+
+func reportOpStats(ops opStatser, sr statReporter, nap time.Duration) {
+	last := make(map[string]serde.OpStat)
+	for {
+		time.Sleep(nap)
+		reportOpStatsOnce(ops.OpStats(), last, sr)
+	}
+}
+
+// reportOpStatsOnce reports the counts since last (which it updates)
+// as serde.op.<op>.calls, errors and rows, and the latencies as a
+// histogram, see latencyHistogram.report, of serde.op.<op>.latency.
+func reportOpStatsOnce(stats, last map[string]serde.OpStat, sr statReporter) {
+	for name, st := range stats {
+		prefix, prev := "serde.op."+name, last[name]
+		sr.reportStatCount(prefix+".calls", float64(st.Calls-prev.Calls))
+		sr.reportStatCount(prefix+".errors", float64(st.Errors-prev.Errors))
+		sr.reportStatCount(prefix+".rows", float64(st.Rows-prev.Rows))
+		h := newLatencyHistogram(serde.OpLatencyBuckets)
+		for i, n := range st.Latency {
+			if i < len(prev.Latency) {
+				n -= prev.Latency[i]
+			}
+			if i < len(h.counts) {
+				h.counts[i] = int(n)
+			}
+		}
+		h.count, h.sumMs = int(st.Calls-prev.Calls), st.LatencySumMs-prev.LatencySumMs
+		h.report(sr, prefix+".latency")
+		last[name] = st
+	}
+}
@@ -26,20 +26,23 @@ import (
 )
 
 type fakeDsFlusher struct {
-	called int
-	sr     statReporter
+	called  int
+	vcached int
+	sr      statReporter
 }
 
-func (f *fakeDsFlusher) flushDS(ds serde.DbDataSourcer, block bool)         { f.called++ }
-func (f *fakeDsFlusher) flushToVCache(serde.DbDataSourcer)                  {}
-func (f *fakeDsFlusher) flusher() serde.Flusher                             { return f }
-func (f *fakeDsFlusher) statReporter() statReporter                         { return f.sr }
-func (f *fakeDsFlusher) start(_, _ *sync.WaitGroup, _ time.Duration, n int) {}
-func (f *fakeDsFlusher) stop()                                              {}
+func (f *fakeDsFlusher) flushDS(ds serde.DbDataSourcer, block bool) { f.called++ }
+func (f *fakeDsFlusher) flushToVCache(serde.DbDataSourcer)          { f.vcached++ }
+func (f *fakeDsFlusher) flusher() serde.Flusher                     { return f }
+func (f *fakeDsFlusher) statReporter() statReporter                 { return f.sr }
+func (f *fakeDsFlusher) start(_, _ *sync.WaitGroup, _ time.Duration, n, _ int, _ time.Duration, _ *flushPacer, _ FlushShardFunc) {
+}
+func (f *fakeDsFlusher) stop()        {}
+func (f *fakeDsFlusher) pending() int { return 0 }
 func (f *fakeDsFlusher) FlushDataPoints(bunlde_id, seg, i int64, dps, vers map[int64]interface{}) (int, error) {
 	return 0, nil
 }
-func (f *fakeDsFlusher) FlushDSStates(seg int64, lastupdate, value, duration map[int64]interface{}) (int, error) {
+func (f *fakeDsFlusher) FlushDSStates(seg int64, lastupdate, value, duration, lastRaw map[int64]interface{}) (int, error) {
 	return 0, nil
 }
 func (f *fakeDsFlusher) FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (int, error) {
@@ -74,3 +77,101 @@ func Test_flusher_methods(t *testing.T) {
 		t.Errorf("sr != f.statReporter()")
 	}
 }
+
+type fakeBatchFlusher struct {
+	fakeDsFlusher
+	failOn             int // fail the Nth FlushDSStates call in a batch (1-based)
+	inTx               bool
+	txCalls, calls     int
+	commits, rollbacks int
+}
+
+func (f *fakeBatchFlusher) FlushDSStates(seg int64, lastupdate, value, duration, lastRaw map[int64]interface{}) (int, error) {
+	if f.inTx {
+		f.txCalls++
+		if f.txCalls == f.failOn {
+			return 0, fmt.Errorf("Fake error.")
+		}
+	} else {
+		f.calls++
+	}
+	return 1, nil
+}
+func (f *fakeBatchFlusher) BeginFlushBatch() (serde.FlushBatch, error) { f.inTx = true; return f, nil }
+func (f *fakeBatchFlusher) Commit() error                              { f.inTx = false; f.commits++; return nil }
+func (f *fakeBatchFlusher) Rollback() error                            { f.inTx = false; f.rollbacks++; return nil }
+
+func Test_flusher_dbFlushBatch(t *testing.T) {
+	dpr := &vDpFlushRequest{lastupdate: map[int64]interface{}{0: 1}}
+	batch := []*vDpFlushRequest{dpr, dpr, dpr}
+
+	db := &fakeBatchFlusher{}
+	st := &dbFlusherStats{}
+	dbFlushBatch(db, batch, st)
+	if db.txCalls != 3 || db.commits != 1 || db.rollbacks != 0 || db.calls != 0 {
+		t.Errorf("dbFlushBatch: expected 3 flushes in 1 committed tx: %+v", db)
+	}
+	if st.batches != 1 || st.batchRequests != 3 || st.dsSqlOps != 3 {
+		t.Errorf("dbFlushBatch: bad stats: %+v", st)
+	}
+
+	// an error rolls the batch back and flushes individually
+	db = &fakeBatchFlusher{failOn: 2}
+	st = &dbFlusherStats{}
+	dbFlushBatch(db, batch, st)
+	if db.rollbacks != 1 || db.commits != 0 || db.calls != 3 || st.batchFailures != 1 {
+		t.Errorf("dbFlushBatch: expected a rollback and 3 individual flushes: %+v %+v", db, st)
+	}
+	// only the individual retries are counted, not the rolled back ones
+	if st.dsFlushes != 3 || st.dsCount != 3 || st.dsSqlOps != 3 {
+		t.Errorf("dbFlushBatch: rolled back flushes should not be counted: %+v", st)
+	}
+}
+
+func Test_flusher_dbFlusherCollectBatch(t *testing.T) {
+	ch := make(chan *vDpFlushRequest, 10)
+	first := &vDpFlushRequest{}
+	for i := 0; i < 5; i++ {
+		ch <- &vDpFlushRequest{}
+	}
+	st := &dbFlusherStats{}
+
+	batch, ok := dbFlusherCollectBatch(ch, first, 4, time.Second, st)
+	if !ok || len(batch) != 4 || batch[0] != first || st.chGets != 3 {
+		t.Errorf("dbFlusherCollectBatch: expected a full batch of 4: %v %d %+v", ok, len(batch), st)
+	}
+
+	// two left, times out
+	batch, ok = dbFlusherCollectBatch(ch, first, 4, 10*time.Millisecond, st)
+	if !ok || len(batch) != 3 {
+		t.Errorf("dbFlusherCollectBatch: expected a partial batch of 3: %v %d", ok, len(batch))
+	}
+
+	close(ch)
+	batch, ok = dbFlusherCollectBatch(ch, first, 4, time.Second, st)
+	if ok || len(batch) != 1 {
+		t.Errorf("dbFlusherCollectBatch: closed channel should return false: %v %d", ok, len(batch))
+	}
+}
+
+func Test_flusher_reportOpStatsOnce(t *testing.T) {
+	latency := make([]int64, len(serde.OpLatencyBuckets)+1)
+	latency[0] = 2
+	last := make(map[string]serde.OpStat)
+	sr := recordingSr{}
+	reportOpStatsOnce(map[string]serde.OpStat{"fetch_series": {Calls: 3, Errors: 1, Rows: 20, Latency: latency, LatencySumMs: 1.5}}, last, sr)
+	if sr["serde.op.fetch_series.calls"] != 3 || sr["serde.op.fetch_series.errors"] != 1 || sr["serde.op.fetch_series.rows"] != 20 {
+		t.Errorf("reportOpStatsOnce: unexpected counts: %v", sr)
+	}
+	if sr["serde.op.fetch_series.latency.bin_1"] != 2 || sr["serde.op.fetch_series.latency.count"] != 3 || sr["serde.op.fetch_series.latency.sum_ms"] != 1.5 {
+		t.Errorf("reportOpStatsOnce: unexpected latencies: %v", sr)
+	}
+
+	latency = append([]int64(nil), latency...)
+	latency[len(latency)-1] = 1
+	sr = recordingSr{}
+	reportOpStatsOnce(map[string]serde.OpStat{"fetch_series": {Calls: 4, Errors: 1, Rows: 20, Latency: latency, LatencySumMs: 6001.5}}, last, sr)
+	if sr["serde.op.fetch_series.calls"] != 1 || sr["serde.op.fetch_series.errors"] != 0 || sr["serde.op.fetch_series.latency.bin_1"] != 0 || sr["serde.op.fetch_series.latency.bin_inf"] != 1 {
+		t.Errorf("reportOpStatsOnce: expected the counts since the last report: %v", sr)
+	}
+}
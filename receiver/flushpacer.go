@@ -0,0 +1,131 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// flushPacer adjusts the pace of flushing to how fast the database
+// is. The flushers report how long every write took, if the (moving)
+// average exceeds the target latency, the flush interval and batch
+// size are stretched, if it is well below target, they are shrunk
+// back, but never below what is configured.
+type flushPacer struct {
+	*sync.Mutex
+	target     time.Duration
+	maxFactor  float64
+	factor     float64
+	latency    time.Duration // exponential moving average per request
+	lastAdjust time.Time
+}
+
+const (
+	flushPacerStep     = 1.5
+	flushPacerAlpha    = 0.2
+	flushPacerInterval = time.Second
+)
+
+// newFlushPacer returns a pacer, or nil (meaning fixed pace) if target
+// is not positive. A maxFactor below 1 defaults to 8.
+func newFlushPacer(target time.Duration, maxFactor float64) *flushPacer {
+	if target <= 0 {
+		return nil
+	}
+	if maxFactor < 1 {
+		maxFactor = 8
+	}
+	return &flushPacer{
+		Mutex:      &sync.Mutex{},
+		target:     target,
+		maxFactor:  maxFactor,
+		factor:     1,
+		lastAdjust: time.Now(),
+	}
+}
+
+// observe records that n requests were written in dur and adjusts
+// the pace at most once per flushPacerInterval.
+func (p *flushPacer) observe(dur time.Duration, n int) {
+	if p == nil || n <= 0 {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	perReq := dur / time.Duration(n)
+	if p.latency == 0 {
+		p.latency = perReq
+	} else {
+		p.latency = time.Duration(flushPacerAlpha*float64(perReq) + (1-flushPacerAlpha)*float64(p.latency))
+	}
+
+	if time.Now().Sub(p.lastAdjust) < flushPacerInterval {
+		return
+	}
+	p.lastAdjust = time.Now()
+
+	factor := p.factor
+	if p.latency > p.target {
+		factor *= flushPacerStep
+	} else if p.latency < p.target/2 {
+		factor /= flushPacerStep
+	}
+	if factor > p.maxFactor {
+		factor = p.maxFactor
+	}
+	if factor < 1 {
+		factor = 1
+	}
+	if factor != p.factor {
+		log.Printf("flushPacer: write latency %v (target %v), flush pace factor %.2f -> %.2f", p.latency, p.target, p.factor, factor)
+		p.factor = factor
+	}
+}
+
+// stretch returns the interval d adjusted to the current pace.
+func (p *flushPacer) stretch(d time.Duration) time.Duration {
+	if p == nil {
+		return d
+	}
+	p.Lock()
+	defer p.Unlock()
+	return time.Duration(float64(d) * p.factor)
+}
+
+// batchSize returns the batch size adjusted to the current pace. No
+// batching (size of 1 or less) is left as is.
+func (p *flushPacer) batchSize(size int) int {
+	if p == nil || size <= 1 {
+		return size
+	}
+	p.Lock()
+	defer p.Unlock()
+	return int(float64(size) * p.factor)
+}
+
+// state returns the current factor and average latency.
+func (p *flushPacer) state() (float64, time.Duration) {
+	if p == nil {
+		return 1, 0
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.factor, p.latency
+}
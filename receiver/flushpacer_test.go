@@ -0,0 +1,66 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_flushPacer(t *testing.T) {
+	if p := newFlushPacer(0, 0); p != nil {
+		t.Errorf("newFlushPacer: zero target should return nil")
+	}
+
+	// nil pacer means fixed pace
+	var np *flushPacer
+	np.observe(time.Second, 1)
+	if np.stretch(time.Second) != time.Second || np.batchSize(16) != 16 {
+		t.Errorf("nil flushPacer should not change anything")
+	}
+
+	p := newFlushPacer(10*time.Millisecond, 2)
+	if p.maxFactor != 2 {
+		t.Errorf("newFlushPacer: maxFactor should be 2")
+	}
+
+	// slow
+	for i := 0; i < 3; i++ {
+		p.lastAdjust = time.Now().Add(-2 * flushPacerInterval)
+		p.observe(500*time.Millisecond, 10) // 50ms per request
+	}
+	if p.factor != 2 {
+		t.Errorf("flushPacer: factor should be capped at 2: %v", p.factor)
+	}
+	if p.stretch(time.Second) != 2*time.Second || p.batchSize(16) != 32 || p.batchSize(1) != 1 {
+		t.Errorf("flushPacer: stretch/batchSize not adjusted: %v %v", p.stretch(time.Second), p.batchSize(16))
+	}
+
+	// no adjustment within flushPacerInterval
+	p.observe(0, 1)
+	if p.factor != 2 {
+		t.Errorf("flushPacer: factor should not change within flushPacerInterval")
+	}
+
+	// fast
+	for i := 0; i < 20; i++ {
+		p.lastAdjust = time.Now().Add(-2 * flushPacerInterval)
+		p.observe(time.Millisecond, 10)
+	}
+	if factor, _ := p.state(); factor != 1 {
+		t.Errorf("flushPacer: factor should be back to 1: %v", factor)
+	}
+}
@@ -0,0 +1,88 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// A FlushShardFunc picks which of n db flushers writes a flush
+// request for the given RRA bundle and segment (bundleId is 0 for DS
+// state). Requests for the same segment should always go to the same
+// flusher, so that flushers do not contend for the same rows.
+type FlushShardFunc func(bundleId, seg int64, n int) int
+
+// FlushShardBySegment shards flush requests by segment number.
+func FlushShardBySegment(bundleId, seg int64, n int) int {
+	return int(seg % int64(n))
+}
+
+// FlushShardByBundleSegment shards flush requests by RRA bundle and
+// segment, which spreads the load better when there are few segments
+// but many bundles.
+func FlushShardByBundleSegment(bundleId, seg int64, n int) int {
+	return int((bundleId*31 + seg) % int64(n))
+}
+
+// ParseFlushSharding converts one of "shared" (or ""), "segment" or
+// "bundle-segment" into a FlushShardFunc, nil for shared.
+func ParseFlushSharding(s string) (FlushShardFunc, error) {
+	switch strings.ToLower(s) {
+	case "", "shared":
+		return nil, nil
+	case "segment":
+		return FlushShardBySegment, nil
+	case "bundle-segment":
+		return FlushShardByBundleSegment, nil
+	}
+	return nil, fmt.Errorf("Invalid flush sharding: %q (valid: shared, segment, bundle-segment)", s)
+}
+
+// flushSharder reads flush requests from in and sends each one to the
+// out channel chosen by shard, reporting the length of every out
+// channel as a gauge once per second. When in is closed, all out
+// channels are closed.
+var flushSharder = func(in chan *vDpFlushRequest, outs []chan *vDpFlushRequest, shard FlushShardFunc, sr statReporter) {
+	defer func() {
+		for _, out := range outs {
+			close(out)
+		}
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case dpr, ok := <-in:
+			if !ok {
+				return
+			}
+			i := shard(dpr.bundleId, dpr.seg, len(outs))
+			if i < 0 || i >= len(outs) {
+				log.Printf("flushSharder: shard function returned %d (of %d flushers), using 0", i, len(outs))
+				i = 0
+			}
+			outs[i] <- dpr
+		case <-ticker.C:
+			for n, out := range outs {
+				sr.reportStatGauge(fmt.Sprintf("serde.flush_channel.worker_%d.len", n), float64(len(out)))
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import "testing"
+
+func Test_flushshard_ParseFlushSharding(t *testing.T) {
+	for _, s := range []string{"", "shared", "SHARED"} {
+		if f, err := ParseFlushSharding(s); f != nil || err != nil {
+			t.Errorf("ParseFlushSharding(%q): expected nil, nil", s)
+		}
+	}
+	if f, err := ParseFlushSharding("segment"); f == nil || err != nil || f(3, 7, 4) != 3 {
+		t.Errorf("ParseFlushSharding: segment")
+	}
+	if f, err := ParseFlushSharding("bundle-segment"); f == nil || err != nil || f(1, 2, 4) != 1 {
+		t.Errorf("ParseFlushSharding: bundle-segment")
+	}
+	if _, err := ParseFlushSharding("foo"); err == nil {
+		t.Errorf("ParseFlushSharding: expected an error")
+	}
+}
+
+func Test_flushshard_flushSharder(t *testing.T) {
+	in := make(chan *vDpFlushRequest)
+	outs := []chan *vDpFlushRequest{make(chan *vDpFlushRequest, 10), make(chan *vDpFlushRequest, 10)}
+	done := make(chan bool)
+	go func() {
+		flushSharder(in, outs, func(_, seg int64, n int) int {
+			if seg == 99 {
+				return 5 // out of range
+			}
+			return int(seg % int64(n))
+		}, &fakeSr{})
+		done <- true
+	}()
+
+	for _, seg := range []int64{0, 1, 2, 3, 99} {
+		in <- &vDpFlushRequest{seg: seg}
+	}
+	close(in)
+	<-done
+
+	var got [2][]int64
+	for i, out := range outs {
+		for dpr := range out { // closed by flushSharder
+			got[i] = append(got[i], dpr.seg)
+		}
+	}
+	if len(got[0]) != 3 || got[0][2] != 99 || len(got[1]) != 2 {
+		t.Errorf("flushSharder: unexpected distribution: %v", got)
+	}
+}
@@ -0,0 +1,168 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"time"
+
+	"github.com/tgres/tgres/cluster"
+)
+
+// Retry backoff for forwarding to a node that is not ready, it
+// doubles with every failed attempt up to the maximum. Once it is
+// ready, up to fwdRetryBatch points per node are forwarded at a time
+// (every fwdRetryMinBackoff), so as to not overflow its outgoing
+// queue.
+const (
+	fwdRetryMinBackoff = 100 * time.Millisecond
+	fwdRetryMaxBackoff = 10 * time.Second
+	fwdRetryBatch      = 512
+)
+
+// forwardRetrier buffers data points which could not be forwarded
+// because the destination node was not ready (e.g. it is starting
+// up or transitioning) and forwards them once it is. Every node has
+// its own buffer of up to size points, points which do not fit are
+// spooled to disk, if there is a spool, or counted as overflow and
+// dropped. It is only used by the director goroutine and is therefore
+// not safe for concurrent use.
+type forwardRetrier struct {
+	size     int
+	byNode   map[string]*fwdRetryQueue
+	spool    *fwdSpool
+	overflow int // reset by takeOverflow()
+}
+
+type fwdRetryQueue struct {
+	node    *cluster.Node
+	dps     []*incomingDP
+	backoff time.Duration
+	next    time.Time // next attempt
+}
+
+// newForwardRetrier returns a forwardRetrier, or nil if size is not
+// above zero and there is no spool, in which case points that cannot
+// be forwarded are lost.
+func newForwardRetrier(size int, spool *fwdSpool) *forwardRetrier {
+	if size <= 0 && spool == nil {
+		return nil
+	}
+	return &forwardRetrier{size: size, byNode: make(map[string]*fwdRetryQueue), spool: spool}
+}
+
+// has returns true if there are points waiting to be forwarded to
+// node, new points for it must then wait their turn.
+func (fr *forwardRetrier) has(node *cluster.Node) bool {
+	if fr == nil {
+		return false
+	}
+	_, ok := fr.byNode[node.Name()]
+	return ok || fr.spool.has(node)
+}
+
+// add buffers a copy of dp for forwarding to node later, it returns
+// false if there is no room for it.
+func (fr *forwardRetrier) add(dp *incomingDP, node *cluster.Node) bool {
+	if fr == nil {
+		return false
+	}
+	if fr.spool.has(node) { // keep the order
+		if !fr.spool.add(dp, node) {
+			fr.overflow++
+			return false
+		}
+		return true
+	}
+	q := fr.byNode[node.Name()]
+	if q == nil {
+		q = &fwdRetryQueue{node: node, backoff: fwdRetryMinBackoff}
+		q.next = time.Now().Add(q.backoff)
+		fr.byNode[node.Name()] = q
+	}
+	if len(q.dps) >= fr.size {
+		if fr.spool.add(dp, node) {
+			return true
+		}
+		fr.overflow++
+		return false
+	}
+	// The original may still be processed locally and released
+	cp := newIncomingDP()
+	*cp = *dp
+	q.dps = append(q.dps, cp)
+	return true
+}
+
+// retry forwards the buffered points of every node that is due for
+// another attempt and is ready, for those that are not the backoff
+// is doubled. Spooled points are replayed once the buffer of the node
+// is empty.
+func (fr *forwardRetrier) retry(snd chan *cluster.Msg, stats *dpStats, maxForwards int) {
+	if fr == nil {
+		return
+	}
+	now := time.Now()
+	for name, q := range fr.byNode {
+		if now.Before(q.next) {
+			continue
+		}
+		if !q.node.Ready() {
+			if q.backoff *= 2; q.backoff > fwdRetryMaxBackoff {
+				q.backoff = fwdRetryMaxBackoff
+			}
+			q.next = now.Add(q.backoff)
+			continue
+		}
+		n := len(q.dps)
+		if n > fwdRetryBatch {
+			n = fwdRetryBatch
+		}
+		for _, dp := range q.dps[:n] {
+			if err := directorForwardDPToNode(dp, q.node, snd, maxForwards); err == nil {
+				stats.forwarded++
+				stats.forwarded_to[q.node.SanitizedAddr()]++
+			}
+			dp.release()
+		}
+		if q.dps = q.dps[n:]; len(q.dps) == 0 {
+			delete(fr.byNode, name)
+		}
+	}
+	fr.spool.replay(snd, stats, maxForwards, fr.byNode)
+}
+
+// pending returns the number of buffered points.
+func (fr *forwardRetrier) pending() int {
+	if fr == nil {
+		return 0
+	}
+	var n int
+	for _, q := range fr.byNode {
+		n += len(q.dps)
+	}
+	return n
+}
+
+// takeOverflow returns the number of points dropped since the last
+// call.
+func (fr *forwardRetrier) takeOverflow() int {
+	if fr == nil {
+		return 0
+	}
+	n := fr.overflow
+	fr.overflow = 0
+	return n
+}
@@ -0,0 +1,75 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_forwardRetrier(t *testing.T) {
+	if fr := newForwardRetrier(0, nil); fr != nil {
+		t.Errorf("newForwardRetrier: size 0 should mean nil")
+	}
+	var fr *forwardRetrier
+	if fr.add(&incomingDP{}, &cluster.Node{}) || fr.pending() != 0 || fr.takeOverflow() != 0 {
+		t.Errorf("nil forwardRetrier should buffer nothing")
+	}
+
+	fr = newForwardRetrier(2, nil)
+	md := make([]byte, 64) // not ready
+	node := &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "foo"}}
+	dp := &incomingDP{cachedIdent: newCachedIdent(serde.Ident{"name": "foo"}), timeStamp: time.Unix(1000, 0), value: 123}
+	for i := 0; i < 3; i++ {
+		fr.add(dp, node)
+	}
+	if fr.pending() != 2 || fr.takeOverflow() != 1 {
+		t.Errorf("forwardRetrier: expected 2 pending and 1 overflow, got %d pending", fr.pending())
+	}
+
+	snd := make(chan *cluster.Msg, 2)
+	stats := &dpStats{forwarded_to: make(map[string]int)}
+
+	// not ready, the backoff doubles
+	fr.byNode["foo"].next = time.Time{}
+	fr.retry(snd, stats, 1)
+	if q := fr.byNode["foo"]; q.backoff != 2*fwdRetryMinBackoff || !q.next.After(time.Now()) {
+		t.Errorf("forwardRetrier: backoff not doubled: %v", q.backoff)
+	}
+	if len(snd) != 0 {
+		t.Errorf("forwardRetrier: nothing should be forwarded to a node not ready")
+	}
+
+	// not due yet
+	md[0] = 1 // ready
+	fr.retry(snd, stats, 1)
+	if len(snd) != 0 {
+		t.Errorf("forwardRetrier: nothing should be forwarded before the backoff")
+	}
+
+	fr.byNode["foo"].next = time.Time{}
+	fr.retry(snd, stats, 1)
+	if len(snd) != 2 || stats.forwarded != 2 || fr.pending() != 0 {
+		t.Errorf("forwardRetrier: expected 2 forwarded, got %d (pending %d)", len(snd), fr.pending())
+	}
+	if dp.Hops != 0 {
+		t.Errorf("forwardRetrier: the original data point should not be modified")
+	}
+}
@@ -0,0 +1,241 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tgres/tgres/cluster"
+)
+
+// Spool defaults
+const (
+	dftFwdSpoolMaxSize = 100 * 1024 * 1024
+	dftFwdSpoolMaxAge  = 24 * time.Hour
+)
+
+// fwdSpool is the "hinted handoff" of the forwardRetrier: points for a
+// node whose retry buffer is full are appended to a file in dir, to be
+// forwarded once the node is ready again. A node spool is limited to
+// maxSize bytes, points that do not fit are dropped, and to maxAge,
+// after which whatever is spooled for a node is discarded, since it is
+// unlikely to be accepted any longer.
+//
+// The file format is that of the dead letter file, if need be a spool
+// can be replayed as dead letters. Like the forwardRetrier it is only
+// used by the director goroutine.
+type fwdSpool struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+	byNode  map[string]*nodeSpool
+
+	// stats, reset by takeStats()
+	spooled, replayed, dropped int
+}
+
+type nodeSpool struct {
+	node     *cluster.Node
+	path     string
+	f        *os.File
+	w        *bufio.Writer
+	size     int64
+	count    int       // points spooled, not replayed yet
+	started  time.Time // first point spooled
+	fStarted time.Time // first point in f
+
+	// the file being replayed, if any
+	rf      *os.File
+	scanner *bufio.Scanner
+}
+
+// newFwdSpool returns a fwdSpool, or nil if dir is empty. Spool files
+// left in dir (e.g. by a crash) are not replayed automatically, they
+// are logged so that they can be replayed as dead letters.
+func newFwdSpool(dir string, maxSize int64, maxAge time.Duration) *fwdSpool {
+	if dir == "" {
+		return nil
+	}
+	if maxSize <= 0 {
+		maxSize = dftFwdSpoolMaxSize
+	}
+	if maxAge <= 0 {
+		maxAge = dftFwdSpoolMaxAge
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "*.spool*")); len(left) > 0 {
+		log.Printf("fwdSpool: found spool files from before, they can be replayed as dead letters: %v", left)
+	}
+	return &fwdSpool{dir: dir, maxSize: maxSize, maxAge: maxAge, byNode: make(map[string]*nodeSpool)}
+}
+
+// has returns true if there are points spooled for node.
+func (s *fwdSpool) has(node *cluster.Node) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.byNode[node.Name()]
+	return ok
+}
+
+// add spools dp for node, it returns false if it cannot.
+func (s *fwdSpool) add(dp *incomingDP, node *cluster.Node) bool {
+	if s == nil {
+		return false
+	}
+	ns := s.byNode[node.Name()]
+	if ns == nil {
+		ns = &nodeSpool{node: node, path: filepath.Join(s.dir, node.SanitizedAddr()+".spool"), started: time.Now()}
+		s.byNode[node.Name()] = ns
+	}
+	if ns.f == nil {
+		f, err := os.OpenFile(ns.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Printf("fwdSpool: cannot open %q: %v", ns.path, err)
+			s.dropped++
+			s.remove(ns)
+			return false
+		}
+		ns.f, ns.w, ns.size, ns.fStarted = f, bufio.NewWriter(f), 0, time.Now()
+	}
+	dl := &DeadLetter{Time: time.Now(), Reason: DeadForward,
+		Data: fmt.Sprintf("%s %d %v", dp.cachedIdent.String(), dp.timeStamp.Unix(), dp.value)}
+	line := dl.String() + "\n"
+	if ns.size+int64(len(line)) > s.maxSize {
+		s.dropped++
+		return false
+	}
+	n, err := ns.w.WriteString(line)
+	ns.size += int64(n)
+	if err != nil {
+		log.Printf("fwdSpool: error writing to %q: %v", ns.path, err)
+		s.dropped++
+		return false
+	}
+	ns.count++
+	s.spooled++
+	return true
+}
+
+// replay forwards up to fwdRetryBatch spooled points of every
+// ready node which has nothing left in buffered (those points are
+// older), discards the spools that are too old and flushes the rest
+// to disk.
+func (s *fwdSpool) replay(snd chan *cluster.Msg, stats *dpStats, maxForwards int, buffered map[string]*fwdRetryQueue) {
+	if s == nil {
+		return
+	}
+	for name, ns := range s.byNode {
+		if time.Now().Sub(ns.started) > s.maxAge {
+			log.Printf("fwdSpool: discarding %d points spooled for %s since %v.", ns.count, ns.node.Name(), ns.started)
+			s.dropped += ns.count
+			s.remove(ns)
+			continue
+		}
+		if _, ok := buffered[name]; ok || !ns.node.Ready() {
+			if ns.w != nil {
+				ns.w.Flush()
+			}
+			continue
+		}
+		if ns.scanner == nil && !s.startReplay(ns) {
+			continue
+		}
+		for i := 0; i < fwdRetryBatch; i++ {
+			if !ns.scanner.Scan() {
+				// This file is done, points spooled meanwhile
+				// are in a new one.
+				ns.rf.Close()
+				os.Remove(ns.rf.Name())
+				ns.rf, ns.scanner, ns.started = nil, nil, ns.fStarted
+				if ns.f == nil {
+					s.remove(ns)
+				}
+				break
+			}
+			ns.count--
+			ident, ts, v, err := parseDeadLetterDP(ns.scanner.Text())
+			if err != nil {
+				s.dropped++
+				continue
+			}
+			dp := &incomingDP{cachedIdent: newCachedIdent(ident), timeStamp: ts, value: v}
+			if err := directorForwardDPToNode(dp, ns.node, snd, maxForwards); err != nil {
+				s.dropped++
+				continue
+			}
+			s.replayed++
+			stats.forwarded++
+			stats.forwarded_to[ns.node.SanitizedAddr()]++
+		}
+	}
+}
+
+// startReplay moves the spool file aside for replaying, so that
+// points spooled while it is replayed go to a new file.
+func (s *fwdSpool) startReplay(ns *nodeSpool) bool {
+	if ns.f == nil {
+		s.remove(ns)
+		return false
+	}
+	ns.w.Flush()
+	ns.f.Close()
+	ns.f, ns.w = nil, nil
+	rpath := ns.path + ".replay"
+	if err := os.Rename(ns.path, rpath); err != nil {
+		log.Printf("fwdSpool: cannot rename %q: %v, discarding it.", ns.path, err)
+		s.dropped += ns.count
+		s.remove(ns)
+		return false
+	}
+	rf, err := os.Open(rpath)
+	if err != nil {
+		log.Printf("fwdSpool: cannot open %q: %v, discarding it.", rpath, err)
+		s.dropped += ns.count
+		s.remove(ns)
+		return false
+	}
+	ns.rf, ns.scanner = rf, bufio.NewScanner(rf)
+	return true
+}
+
+// remove closes and deletes the files of a node spool.
+func (s *fwdSpool) remove(ns *nodeSpool) {
+	if ns.f != nil {
+		ns.f.Close()
+		os.Remove(ns.path)
+	}
+	if ns.rf != nil {
+		ns.rf.Close()
+		os.Remove(ns.rf.Name())
+	}
+	delete(s.byNode, ns.node.Name())
+}
+
+// takeStats returns the number of points spooled, replayed and
+// dropped since the last call.
+func (s *fwdSpool) takeStats() (spooled, replayed, dropped int) {
+	if s == nil {
+		return 0, 0, 0
+	}
+	spooled, replayed, dropped = s.spooled, s.replayed, s.dropped
+	s.spooled, s.replayed, s.dropped = 0, 0, 0
+	return spooled, replayed, dropped
+}
@@ -0,0 +1,91 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_fwdSpool(t *testing.T) {
+	if s := newFwdSpool("", 0, 0); s != nil {
+		t.Errorf("newFwdSpool: no dir should mean nil")
+	}
+
+	dir, err := ioutil.TempDir("", "tgres-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fr := newForwardRetrier(1, newFwdSpool(dir, 0, 0))
+	md := make([]byte, 64) // not ready
+	node := &cluster.Node{Node: &memberlist.Node{Meta: md, Name: "foo", Addr: net.ParseIP("10.0.0.1")}}
+	for i := 0; i < 3; i++ {
+		dp := &incomingDP{cachedIdent: newCachedIdent(serde.Ident{"name": "foo"}), timeStamp: time.Unix(int64(1000+i), 0), value: float64(i)}
+		if !fr.add(dp, node) {
+			t.Errorf("forwardRetrier: add should buffer or spool")
+		}
+	}
+	if !fr.has(node) || fr.pending() != 1 || fr.spool.byNode["foo"].count != 2 {
+		t.Errorf("forwardRetrier: expected 1 buffered and 2 spooled points")
+	}
+
+	snd := make(chan *cluster.Msg, 10)
+	stats := &dpStats{forwarded_to: make(map[string]int)}
+	fr.retry(snd, stats, 1) // not ready, flushed
+	if fi, err := os.Stat(filepath.Join(dir, "10_0_0_1.spool")); err != nil || fi.Size() == 0 {
+		t.Errorf("fwdSpool: spool file not written: %v", err)
+	}
+
+	md[0] = 1 // ready
+	fr.byNode["foo"].next = time.Time{}
+	fr.retry(snd, stats, 1) // the buffer and the spool, in this order
+	fr.retry(snd, stats, 1) // nothing left
+	if len(snd) != 3 || fr.has(node) {
+		t.Errorf("forwardRetrier: expected 3 forwarded, got %d (has: %v)", len(snd), fr.has(node))
+	}
+	var dp incomingDP
+	for i := 0; i < 3; i++ {
+		(<-snd).Decode(&dp)
+		if dp.value != float64(i) {
+			t.Errorf("forwardRetrier: points out of order: %d: %v", i, dp.value)
+		}
+	}
+	if spooled, replayed, dropped := fr.spool.takeStats(); spooled != 2 || replayed != 2 || dropped != 0 {
+		t.Errorf("fwdSpool: unexpected stats: %d %d %d", spooled, replayed, dropped)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "*")); len(left) != 0 {
+		t.Errorf("fwdSpool: files left behind: %v", left)
+	}
+
+	// too old
+	md[0] = 0
+	fr.spool.add(&incomingDP{cachedIdent: newCachedIdent(serde.Ident{"name": "foo"})}, node)
+	fr.spool.byNode["foo"].started = time.Now().Add(-25 * time.Hour)
+	fr.spool.replay(snd, stats, 1, nil)
+	if _, _, dropped := fr.spool.takeStats(); dropped != 1 || fr.spool.has(node) {
+		t.Errorf("fwdSpool: an old spool should be discarded")
+	}
+}
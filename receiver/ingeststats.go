@@ -0,0 +1,119 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds (in milliseconds) of ingest latency histogram buckets.
+var ingestLatencyBuckets = []float64{1, 5, 10, 50, 100, 500, 1000, 5000, 10000}
+
+// latencyHistogram counts durations in buckets. It is not safe for
+// concurrent use, every worker keeps its own.
+type latencyHistogram struct {
+	buckets []float64 // upper bounds, ms
+	counts  []int     // one more than buckets, the last is +Inf
+	count   int
+	sumMs   float64
+}
+
+func newLatencyHistogram(buckets []float64) *latencyHistogram {
+	return &latencyHistogram{buckets: buckets, counts: make([]int, len(buckets)+1)}
+}
+
+// observe records a duration. It is safe to call on a nil histogram.
+func (h *latencyHistogram) observe(d time.Duration) {
+	if h == nil {
+		return
+	}
+	ms := float64(d) / float64(time.Millisecond)
+	i := 0
+	for i < len(h.buckets) && ms > h.buckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sumMs += ms
+}
+
+// report reports the bucket counts as <prefix>.bin_<bound> (in ms,
+// bin_inf for the last one), the total count and the sum of all
+// durations in ms since the last call, then resets the histogram.
+func (h *latencyHistogram) report(sr statReporter, prefix string) {
+	for i, n := range h.counts {
+		name := "bin_inf"
+		if i < len(h.buckets) {
+			name = "bin_" + strings.Replace(fmt.Sprintf("%v", h.buckets[i]), ".", "_", -1)
+		}
+		sr.reportStatCount(prefix+"."+name, float64(n))
+		h.counts[i] = 0
+	}
+	sr.reportStatCount(prefix+".count", float64(h.count))
+	sr.reportStatCount(prefix+".sum_ms", h.sumMs)
+	h.count, h.sumMs = 0, 0
+}
+
+// listenerCounter counts data points received by each listener (e.g.
+// "graphite_tcp"), and other listener events, such as connections.
+type listenerCounter struct {
+	*sync.Mutex
+	counts map[string]int
+	events map[string]int // by "<listener>.<event>"
+}
+
+func newListenerCounter() *listenerCounter {
+	return &listenerCounter{Mutex: &sync.Mutex{}, counts: make(map[string]int), events: make(map[string]int)}
+}
+
+func (l *listenerCounter) add(listener string, n int) {
+	l.Lock()
+	l.counts[listener] += n
+	l.Unlock()
+}
+
+func (l *listenerCounter) addEvent(listener, event string) {
+	l.Lock()
+	l.events[listener+"."+event]++
+	l.Unlock()
+}
+
+// report reports the counts as receiver.listener.<name>.datapoints,
+// and the events as receiver.listener.<name>.<event>, and resets
+// them. Those that have been seen are reported even when their count
+// is zero.
+func (l *listenerCounter) report(sr statReporter) {
+	l.Lock()
+	defer l.Unlock()
+	for listener, n := range l.counts {
+		sr.reportStatCount(fmt.Sprintf("receiver.listener.%s.datapoints", listener), float64(n))
+		l.counts[listener] = 0
+	}
+	for key, n := range l.events {
+		sr.reportStatCount("receiver.listener."+key, float64(n))
+		l.events[key] = 0
+	}
+}
+
+func reportListenerCounts(l *listenerCounter, sr statReporter, nap time.Duration) {
+	for {
+		time.Sleep(nap)
+		l.report(sr)
+	}
+}
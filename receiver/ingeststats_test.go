@@ -0,0 +1,79 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"testing"
+	"time"
+)
+
+type recordingSr map[string]float64
+
+func (r recordingSr) reportStatCount(name string, f float64) { r[name] += f }
+func (r recordingSr) reportStatGauge(name string, f float64) { r[name] = f }
+
+func Test_ingeststats_latencyHistogram(t *testing.T) {
+	var h *latencyHistogram
+	h.observe(time.Second) // nil is a noop
+
+	h = newLatencyHistogram([]float64{0.5, 10})
+	h.observe(100 * time.Microsecond)
+	h.observe(5 * time.Millisecond)
+	h.observe(10 * time.Millisecond)
+	h.observe(time.Second)
+
+	sr := recordingSr{}
+	h.report(sr, "lat")
+	expect := map[string]float64{"lat.bin_0_5": 1, "lat.bin_10": 2, "lat.bin_inf": 1, "lat.count": 4}
+	for k, v := range expect {
+		if sr[k] != v {
+			t.Errorf("report: %s expected %v, got %v", k, v, sr[k])
+		}
+	}
+	if sr["lat.sum_ms"] < 1015 || sr["lat.sum_ms"] > 1015.2 {
+		t.Errorf("report: unexpected sum_ms: %v", sr["lat.sum_ms"])
+	}
+
+	sr = recordingSr{}
+	h.report(sr, "lat")
+	if sr["lat.count"] != 0 || sr["lat.bin_10"] != 0 {
+		t.Errorf("report: histogram should be reset after reporting")
+	}
+}
+
+func Test_ingeststats_listenerCounter(t *testing.T) {
+	l := newListenerCounter()
+	l.add("graphite_tcp", 2)
+	l.add("graphite_tcp", 1)
+	l.add("statsd_udp", 1)
+	l.addEvent("graphite_tcp", "timeouts")
+	l.addEvent("graphite_tcp", "timeouts")
+
+	sr := recordingSr{}
+	l.report(sr)
+	if sr["receiver.listener.graphite_tcp.datapoints"] != 3 || sr["receiver.listener.statsd_udp.datapoints"] != 1 {
+		t.Errorf("listenerCounter: unexpected counts: %v", sr)
+	}
+	if sr["receiver.listener.graphite_tcp.timeouts"] != 2 {
+		t.Errorf("listenerCounter: unexpected event counts: %v", sr)
+	}
+
+	sr = recordingSr{}
+	l.report(sr)
+	if v, ok := sr["receiver.listener.graphite_tcp.datapoints"]; !ok || v != 0 {
+		t.Errorf("listenerCounter: counts should be reset and still reported: %v", sr)
+	}
+}
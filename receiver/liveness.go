@@ -0,0 +1,34 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// DataSourcesByLastUpdate returns the DSs selected by q by when they
+// were last updated, see serde.LivenessFetcher. The last updates are
+// those in the database, which are behind those cached by the flush
+// interval at most.
+func (r *Receiver) DataSourcesByLastUpdate(q serde.LivenessQuery) ([]serde.StaleDataSource, error) {
+	db, ok := r.dsc.db.(serde.LivenessFetcher)
+	if !ok {
+		return nil, fmt.Errorf("Listing DSs by last update is not supported by this serde")
+	}
+	return db.FetchDataSourcesByLastUpdate(q)
+}
@@ -0,0 +1,47 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+type livenessSerde struct {
+	*fakeSerde
+	q serde.LivenessQuery
+}
+
+func (f *livenessSerde) FetchDataSourcesByLastUpdate(q serde.LivenessQuery) ([]serde.StaleDataSource, error) {
+	f.q = q
+	return []serde.StaleDataSource{{Id: 1, Ident: serde.Ident{"name": "foo"}}}, nil
+}
+
+func Test_Receiver_DataSourcesByLastUpdate(t *testing.T) {
+	r := &Receiver{dsc: newDsCache(&fakeSerde{}, nil, nil)}
+	if _, err := r.DataSourcesByLastUpdate(serde.LivenessQuery{}); err == nil {
+		t.Errorf("DataSourcesByLastUpdate: expected an error when not supported")
+	}
+
+	db := &livenessSerde{fakeSerde: &fakeSerde{}}
+	r = &Receiver{dsc: newDsCache(db, nil, nil)}
+	q := serde.LivenessQuery{After: time.Now().Add(-time.Hour), Before: time.Now().Add(-5 * time.Minute), Limit: 10}
+	if dss, err := r.DataSourcesByLastUpdate(q); err != nil || len(dss) != 1 || db.q != q {
+		t.Errorf("DataSourcesByLastUpdate: unexpected %v %v %v", dss, err, db.q)
+	}
+}
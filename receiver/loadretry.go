@@ -0,0 +1,193 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"log"
+	"time"
+)
+
+// Backoff between attempts to load a DS, it doubles with every failed
+// attempt up to the maximum. While the database breaker is open, the
+// database is probed at the same intervals.
+const (
+	loadRetryMinBackoff = time.Second
+	loadRetryMaxBackoff = time.Minute
+)
+
+// loadRetrier keeps the cachedDss which the loader could not load
+// because of a database error and retries them up to maxRetries times
+// with backoff, after which they are dropped along with their data
+// points. Meanwhile their incoming data points are buffered in the
+// cachedDs as usual and are processed once it is loaded.
+//
+// It is also a circuit breaker: after threshold consecutive errors
+// (the database is presumably down) it opens and no more loads are
+// attempted, new DSs are kept as well, other than an occasional probe.
+// Once a probe succeeds it closes and everything kept is loaded. Only
+// the loader goroutine uses it, it is not safe for concurrent use.
+type loadRetrier struct {
+	maxRetries int
+	threshold  int // 0 means no breaker
+	failures   int // consecutive
+	open       bool
+	backoff    time.Duration // probe backoff
+	probe      time.Time     // next probe
+	pending    []*loadRetry
+
+	retried, failed int // reset by report()
+}
+
+type loadRetry struct {
+	cds      *cachedDs
+	attempts int // failed, not counting probes
+	next     time.Time
+}
+
+// newLoadRetrier returns a loadRetrier, or nil if neither maxRetries
+// nor threshold are above zero, in which case a DS that fails to load
+// is dropped right away.
+func newLoadRetrier(maxRetries, threshold int) *loadRetrier {
+	if maxRetries <= 0 && threshold <= 0 {
+		return nil
+	}
+	if threshold < 0 {
+		threshold = 0
+	}
+	return &loadRetrier{maxRetries: maxRetries, threshold: threshold}
+}
+
+// allow returns true if a load may be attempted, i.e. the breaker is
+// not open.
+func (lr *loadRetrier) allow() bool {
+	return lr == nil || !lr.open
+}
+
+// keep keeps cds without an attempt, because the breaker is open.
+func (lr *loadRetrier) keep(cds *cachedDs) {
+	lr.pending = append(lr.pending, &loadRetry{cds: cds})
+}
+
+// failure records a failed attempt to load r.cds, it returns false if
+// it should not be retried (again).
+func (lr *loadRetrier) failure(r *loadRetry) bool {
+	if lr == nil {
+		return false
+	}
+	now := time.Now()
+	lr.failures++
+	if lr.open { // a failed probe
+		if lr.backoff *= 2; lr.backoff > loadRetryMaxBackoff {
+			lr.backoff = loadRetryMaxBackoff
+		}
+		lr.probe = now.Add(lr.backoff)
+		lr.pending = append(lr.pending, r)
+		return true
+	}
+	if lr.threshold > 0 && lr.failures >= lr.threshold {
+		log.Printf("loader: %d consecutive database errors, pausing DS loading and creation.", lr.failures)
+		lr.open, lr.backoff = true, loadRetryMinBackoff
+		lr.probe = now.Add(lr.backoff)
+	}
+	if r.attempts++; r.attempts > lr.maxRetries && !lr.open {
+		lr.failed++
+		return false
+	}
+	backoff := loadRetryMinBackoff << uint(r.attempts-1)
+	if backoff > loadRetryMaxBackoff || backoff <= 0 {
+		backoff = loadRetryMaxBackoff
+	}
+	r.next = now.Add(backoff)
+	lr.pending = append(lr.pending, r)
+	return true
+}
+
+// success records a successful load, closing the breaker if it was
+// open.
+func (lr *loadRetrier) success() {
+	if lr == nil {
+		return
+	}
+	lr.failures = 0
+	if lr.open {
+		log.Printf("loader: database is back, resuming DS loading with %d DSs pending.", len(lr.pending))
+		lr.open = false
+		for _, r := range lr.pending {
+			r.next = time.Time{}
+		}
+	}
+}
+
+// due removes and returns the pending loads which are due to be
+// retried, or, if the breaker is open, one to probe the database with
+// when it is time to.
+func (lr *loadRetrier) due() []*loadRetry {
+	if lr == nil || len(lr.pending) == 0 {
+		return nil
+	}
+	now := time.Now()
+	if lr.open {
+		if now.Before(lr.probe) {
+			return nil
+		}
+		r := lr.pending[0]
+		lr.pending = lr.pending[1:]
+		lr.probe = now.Add(lr.backoff) // in case it is not attempted
+		return []*loadRetry{r}
+	}
+	var result []*loadRetry
+	keep := lr.pending[:0]
+	for _, r := range lr.pending {
+		if now.Before(r.next) {
+			keep = append(keep, r)
+		} else {
+			result = append(result, r)
+		}
+	}
+	for i := len(keep); i < len(lr.pending); i++ {
+		lr.pending[i] = nil
+	}
+	lr.pending = keep
+	lr.retried += len(result)
+	return result
+}
+
+// drain removes and returns all the pending loads.
+func (lr *loadRetrier) drain() []*loadRetry {
+	if lr == nil {
+		return nil
+	}
+	result := lr.pending
+	lr.pending = nil
+	return result
+}
+
+// report reports the breaker state and the retry counts, which are
+// reset.
+func (lr *loadRetrier) report(sr statReporter) {
+	if lr == nil {
+		return
+	}
+	open := 0.0
+	if lr.open {
+		open = 1
+	}
+	sr.reportStatGauge("receiver.db_breaker.open", open)
+	sr.reportStatGauge("receiver.load.pending", float64(len(lr.pending)))
+	sr.reportStatCount("receiver.load.retried", float64(lr.retried))
+	sr.reportStatCount("receiver.load.failed", float64(lr.failed))
+	lr.retried, lr.failed = 0, 0
+}
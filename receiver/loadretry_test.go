@@ -0,0 +1,87 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_loadRetrier(t *testing.T) {
+	if lr := newLoadRetrier(0, 0); lr != nil {
+		t.Errorf("newLoadRetrier: no retries and no threshold should mean nil")
+	}
+	var lr *loadRetrier
+	if !lr.allow() || lr.failure(&loadRetry{}) || lr.due() != nil {
+		t.Errorf("nil loadRetrier should allow everything and retry nothing")
+	}
+
+	lr = newLoadRetrier(1, 3)
+	r := &loadRetry{cds: &cachedDs{}}
+	if !lr.failure(r) || r.attempts != 1 || len(lr.pending) != 1 {
+		t.Errorf("loadRetrier: first failure should be retried")
+	}
+	if len(lr.due()) != 0 {
+		t.Errorf("loadRetrier: nothing should be due before the backoff")
+	}
+	r.next = time.Time{}
+	if due := lr.due(); len(due) != 1 || len(lr.pending) != 0 || lr.retried != 1 {
+		t.Errorf("loadRetrier: expected 1 due, got %d", len(due))
+	}
+	if lr.failure(r) || lr.failed != 1 {
+		t.Errorf("loadRetrier: second failure exceeds maxRetries and should not be retried")
+	}
+
+	// third consecutive failure opens the breaker, nothing is dropped
+	r2 := &loadRetry{cds: &cachedDs{}}
+	if !lr.failure(r2) || !lr.open || lr.allow() {
+		t.Errorf("loadRetrier: breaker should be open after 3 failures")
+	}
+	lr.keep(&cachedDs{})
+	if len(lr.due()) != 0 {
+		t.Errorf("loadRetrier: nothing should be due before the probe")
+	}
+	lr.probe = time.Time{}
+	probe := lr.due()
+	if len(probe) != 1 || probe[0] != r2 || len(lr.pending) != 1 {
+		t.Errorf("loadRetrier: expected one probe")
+	}
+	if !lr.failure(probe[0]) || lr.backoff != 2*loadRetryMinBackoff || r2.attempts != 1 {
+		t.Errorf("loadRetrier: failed probe should double the backoff without counting an attempt: %v %d", lr.backoff, r2.attempts)
+	}
+
+	lr.success()
+	if lr.open || lr.failures != 0 || len(lr.due()) != 2 {
+		t.Errorf("loadRetrier: success should close the breaker and make everything due")
+	}
+}
+
+func Test_dsCache_dropUnloaded(t *testing.T) {
+	dsc := newDsCache(&fakeSerde{}, &SimpleDSFinder{DftDSSPec}, nil)
+	dsc.deadLetter = &deadLetterWriter{ch: make(chan *DeadLetter, 2)}
+	ident := newCachedIdent(serde.Ident{"name": "foo"})
+	cds := dsc.getByIdentOrCreateEmpty(ident)
+	cds.appendIncoming(&incomingDP{cachedIdent: ident, timeStamp: time.Unix(1000, 0), value: 1})
+
+	if n := dsc.dropUnloaded(cds, DeadLoad); n != 1 || dsc.getByIdent(ident) != nil || dsc.rraCount != 0 {
+		t.Errorf("dropUnloaded: expected 1 dropped and cds removed, got %d", n)
+	}
+	if dl := <-dsc.deadLetter.ch; dl.Reason != DeadLoad {
+		t.Errorf("dropUnloaded: dead letter reason %q", dl.Reason)
+	}
+}
@@ -0,0 +1,63 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"log"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// runMaintenance calls Maintain every interval, see
+// DbMaintenanceInterval.
+func runMaintenance(m serde.Maintainer, sr statReporter, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		maintainOnce(m, sr)
+	}
+}
+
+// maintainOnce calls Maintain and reports what it pruned as counts
+// and the table statistics as gauges, e.g. serde.table.ts.dead_rows.
+// The dead ratio is the share of dead rows, a high one means that
+// autovacuum is not keeping up.
+func maintainOnce(m serde.Maintainer, sr statReporter) {
+	start := time.Now()
+	report, err := m.Maintain()
+	if err != nil {
+		log.Printf("maintainOnce(): %v", err)
+		sr.reportStatCount("serde.maintenance.errors", 1)
+		return
+	}
+	sr.reportStatGauge("serde.maintenance.duration_ms", float64(time.Now().Sub(start).Nanoseconds())/1e6)
+	for table, n := range report.Pruned {
+		sr.reportStatCount("serde.maintenance.pruned."+table, float64(n))
+		if n > 0 {
+			log.Printf("maintainOnce(): pruned %d orphaned %s rows.", n, table)
+		}
+	}
+	for table, st := range report.Tables {
+		prefix := "serde.table." + table
+		sr.reportStatGauge(prefix+".bytes", float64(st.Bytes))
+		sr.reportStatGauge(prefix+".index_bytes", float64(st.IndexBytes))
+		sr.reportStatGauge(prefix+".live_rows", float64(st.LiveRows))
+		sr.reportStatGauge(prefix+".dead_rows", float64(st.DeadRows))
+		if total := st.LiveRows + st.DeadRows; total > 0 {
+			sr.reportStatGauge(prefix+".dead_ratio", float64(st.DeadRows)/float64(total))
+		}
+	}
+}
@@ -0,0 +1,50 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tgres/tgres/serde"
+)
+
+type fakeMaintainer struct {
+	report *serde.MaintenanceReport
+	err    error
+}
+
+func (m *fakeMaintainer) Maintain() (*serde.MaintenanceReport, error) { return m.report, m.err }
+
+func Test_maintainOnce(t *testing.T) {
+	m := &fakeMaintainer{report: &serde.MaintenanceReport{
+		Pruned: map[string]int64{"ts": 3},
+		Tables: map[string]serde.TableStats{"ts": {Bytes: 8192, IndexBytes: 1024, LiveRows: 75, DeadRows: 25}},
+	}}
+	sr := make(recordingSr)
+	maintainOnce(m, sr)
+	if sr["serde.maintenance.pruned.ts"] != 3 || sr["serde.table.ts.bytes"] != 8192 || sr["serde.table.ts.index_bytes"] != 1024 ||
+		sr["serde.table.ts.dead_ratio"] != 0.25 {
+		t.Errorf("maintainOnce: unexpected stats %v", sr)
+	}
+
+	m.err = fmt.Errorf("no database")
+	sr = make(recordingSr)
+	maintainOnce(m, sr)
+	if sr["serde.maintenance.errors"] != 1 || len(sr) != 1 {
+		t.Errorf("maintainOnce: expected only an error count, got %v", sr)
+	}
+}
@@ -0,0 +1,52 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// SetMetadata replaces the metadata of the DS named name, see
+// serde.SetDataSourceMetadata.
+func (r *Receiver) SetMetadata(name string, md serde.DSMetadata) (serde.Ident, error) {
+	db, ok := r.dsc.db.(serde.DataSourceAnnotator)
+	if !ok {
+		return nil, fmt.Errorf("DS metadata is not supported by this serde")
+	}
+	return serde.SetDataSourceMetadata(db, name, md)
+}
+
+// Metadata returns the ident and the metadata of the DS named name.
+func (r *Receiver) Metadata(name string) (serde.Ident, serde.DSMetadata, error) {
+	db, ok := r.dsc.db.(serde.DataSourceAnnotator)
+	if !ok {
+		return nil, serde.DSMetadata{}, fmt.Errorf("DS metadata is not supported by this serde")
+	}
+	return serde.DataSourceMetadata(db, name)
+}
+
+// LoadMetadata returns the metadata of those of the idents which have
+// any, by ident.String(). It is empty if the serde does not support
+// metadata.
+func (r *Receiver) LoadMetadata(idents []serde.Ident) (map[string]serde.DSMetadata, error) {
+	db, ok := r.dsc.db.(serde.DataSourceDescriber)
+	if !ok {
+		return map[string]serde.DSMetadata{}, nil
+	}
+	return db.LoadMetadata(idents)
+}
@@ -0,0 +1,55 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_Receiver_Metadata(t *testing.T) {
+	db := serde.NewMemSerDe()
+	spec := &rrd.DSSpec{Step: time.Second, Heartbeat: time.Minute, RRAs: []rrd.RRASpec{
+		{Function: rrd.WMEAN, Step: time.Second, Span: 10 * time.Second},
+	}}
+	if _, err := db.FetchOrCreateDataSource(serde.Ident{"name": "foo"}, spec); err != nil {
+		t.Fatal(err)
+	}
+	r := &Receiver{dsc: newDsCache(db, nil, nil)}
+
+	md := serde.DSMetadata{Units: "ms"}
+	if _, err := r.SetMetadata("foo", md); err != nil {
+		t.Fatal(err)
+	}
+	if _, got, err := r.Metadata("foo"); err != nil || got != md {
+		t.Errorf("Metadata: expected %v, got %v %v", md, got, err)
+	}
+	if mds, err := r.LoadMetadata([]serde.Ident{{"name": "foo"}}); err != nil || len(mds) != 1 {
+		t.Errorf("LoadMetadata: expected 1, got %v %v", mds, err)
+	}
+
+	// a serde without metadata
+	r = &Receiver{dsc: newDsCache(&fakeSerde{}, nil, nil)}
+	if _, err := r.SetMetadata("foo", md); err == nil {
+		t.Errorf("SetMetadata: expected an error")
+	}
+	if mds, err := r.LoadMetadata([]serde.Ident{{"name": "foo"}}); err != nil || len(mds) != 0 {
+		t.Errorf("LoadMetadata: expected none, got %v %v", mds, err)
+	}
+}
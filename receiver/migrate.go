@@ -0,0 +1,120 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// MigrateDataSources changes the RRAs of the DSs whose name matches
+// a Graphite-style glob to those of the DSSpec the
+// MatchingDSSpecFinder now returns for them, resampling their data
+// (see serde.MigrateDataSource). It returns the DSs whose RRAs
+// differ and, unless dryRun is set, migrates them in the background,
+// one at a time, counting them as receiver.migrate.migrated (or
+// .errors) and calling migrated, if not nil, with each one. Note that
+// a migrated DS gets a new id and that data points it receives while
+// being migrated are lost. Only one migration can be running at a
+// time.
+func (r *Receiver) MigrateDataSources(glob string, dryRun bool, migrated func(serde.Ident)) ([]serde.Ident, error) {
+	db, ok := r.dsc.db.(serde.DataSourceMigrator)
+	if !ok {
+		return nil, fmt.Errorf("migrating DSs is not supported by this serde")
+	}
+	if !dryRun && !atomic.CompareAndSwapInt32(&(r.migrating), 0, 1) {
+		return nil, fmt.Errorf("a migration is already running")
+	}
+	idents, err := migrationCandidates(db, r.dsc.getFinder(), glob)
+	if err != nil || dryRun || len(idents) == 0 {
+		if !dryRun {
+			atomic.StoreInt32(&(r.migrating), 0)
+		}
+		return idents, err
+	}
+	go func() {
+		defer atomic.StoreInt32(&(r.migrating), 0)
+		migrateDataSources(db, r.dsc, r.flusher, r.dsc.getFinder(), idents, r, migrated)
+	}()
+	return idents, nil
+}
+
+// migrationCandidates returns the DSs whose name matches glob and
+// whose RRAs are not those of the spec finder returns for them. With
+// no finder there is nothing to migrate to.
+func migrationCandidates(db serde.DataSourceMigrator, finder MatchingDSSpecFinder, glob string) ([]serde.Ident, error) {
+	if finder == nil {
+		return nil, nil
+	}
+	selected, err := serde.SelectDataSources(db, serde.DeleteQuery{Glob: glob})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(selected))
+	for id := range selected {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var result []serde.Ident
+	for _, id := range ids {
+		spec := finder.FindMatchingDSSpec(selected[id])
+		if spec == nil {
+			continue
+		}
+		ds, err := db.FetchOrCreateDataSource(selected[id], nil)
+		if err != nil {
+			return nil, err
+		}
+		if ds != nil && !serde.SameRRAs(ds, spec) {
+			result = append(result, selected[id])
+		}
+	}
+	return result, nil
+}
+
+// migrateDataSources migrates the DSs one at a time, flushing the
+// resampled data to the vertical cache, and drops them from the DS
+// cache so that data points for them find the new DSs.
+func migrateDataSources(db serde.DataSourceMigrator, dsc *dsCache, flusher dsFlusherBlocking, finder MatchingDSSpecFinder, idents []serde.Ident, sr statReporter, done func(serde.Ident)) {
+	flush := func(ds *serde.DbDataSource) { flusher.flushToVCache(ds) }
+	n := 0
+	for _, ident := range idents {
+		spec := finder.FindMatchingDSSpec(ident)
+		if spec == nil {
+			continue
+		}
+		ds, err := serde.MigrateDataSource(db, ident, spec, flush)
+		if err != nil {
+			log.Printf("migrateDataSources(): %v", err)
+			sr.reportStatCount("receiver.migrate.errors", 1)
+			continue
+		}
+		dsc.delete(ident)
+		if ds != nil {
+			n++
+			sr.reportStatCount("receiver.migrate.migrated", 1)
+			if done != nil {
+				done(ident)
+			}
+		}
+	}
+	log.Printf("migrateDataSources(): migrated %d of %d DSs.", n, len(idents))
+}
@@ -0,0 +1,84 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_Receiver_MigrateDataSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := serde.InitFileDb(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := &rrd.DSSpec{Step: time.Second, Heartbeat: time.Minute, RRAs: []rrd.RRASpec{
+		{Function: rrd.WMEAN, Step: time.Second, Span: 10 * time.Second},
+	}}
+	newSpec := &rrd.DSSpec{Step: time.Second, Heartbeat: time.Minute, RRAs: []rrd.RRASpec{
+		{Function: rrd.WMEAN, Step: 2 * time.Second, Span: 10 * time.Second},
+	}}
+	for name, spec := range map[string]*rrd.DSSpec{"foo.a": spec, "foo.b": newSpec, "bar": spec} {
+		if _, err := db.FetchOrCreateDataSource(serde.Ident{"name": name}, spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dsf, sr := &fakeDsFlusher{}, &fakeSr{}
+	r := &Receiver{dsc: newDsCache(db, &SimpleDSFinder{newSpec}, dsf), flusher: dsf}
+	ds, _ := db.FetchOrCreateDataSource(serde.Ident{"name": "foo.a"}, nil)
+	r.dsc.insert(&cachedDs{DbDataSourcer: ds.(serde.DbDataSourcer), mu: &sync.Mutex{}})
+
+	idents, err := r.MigrateDataSources("foo.*", true, nil)
+	if err != nil || len(idents) != 1 || idents[0]["name"] != "foo.a" {
+		t.Fatalf("MigrateDataSources: (dry run) expected foo.a, got %v %v", idents, err)
+	}
+	atomic.StoreInt32(&(r.migrating), 1)
+	if _, err := r.MigrateDataSources("foo.*", false, nil); err == nil {
+		t.Errorf("MigrateDataSources: expected an error while a migration is running")
+	}
+
+	var done []serde.Ident
+	migrateDataSources(db, r.dsc, dsf, r.dsc.getFinder(), idents, sr, func(ident serde.Ident) { done = append(done, ident) })
+	if dsf.vcached != 1 || sr.called != 1 || r.dsc.stats().dsCount != 0 || len(done) != 1 {
+		t.Errorf("migrateDataSources: expected 1 flushed, counted, dropped and done, got %d %d %d %v", dsf.vcached, sr.called, r.dsc.stats().dsCount, done)
+	}
+	ds, _ = db.FetchOrCreateDataSource(serde.Ident{"name": "foo.a"}, nil)
+	if ds == nil || !serde.SameRRAs(ds, newSpec) {
+		t.Errorf("migrateDataSources: foo.a not migrated: %v", ds)
+	}
+	if idents, _ := migrationCandidates(db, r.dsc.getFinder(), "foo.*"); len(idents) != 0 {
+		t.Errorf("migrationCandidates: expected nothing left, got %v", idents)
+	}
+
+	r.dsc.db = &fakeSerde{}
+	if _, err := r.MigrateDataSources("foo.*", false, nil); err == nil {
+		t.Errorf("MigrateDataSources: expected an error for a serde that cannot migrate")
+	}
+}
@@ -0,0 +1,121 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// NameTemplate extracts ident fields (tags) from the components of a
+// dotted name, e.g. "servers.<host>.<service>" applied to
+// "servers.web1.nginx.requests" adds host=web1 and service=nginx to
+// the ident. A template component is either a <field>, which matches
+// any name component and stores it in the field, a "*", which
+// matches any name component, or a literal which must be the same in
+// the name. A name must have at least as many components as the
+// template, the remaining ones are ignored. The name itself is not
+// changed.
+type NameTemplate struct {
+	template string
+	parts    []string
+	fields   []string // "" for non-capturing parts
+}
+
+// ParseNameTemplate parses a NameTemplate, see NameTemplate.
+func ParseNameTemplate(s string) (*NameTemplate, error) {
+	if s == "" {
+		return nil, fmt.Errorf("Empty name template")
+	}
+	t := &NameTemplate{template: s, parts: strings.Split(s, ".")}
+	t.fields = make([]string, len(t.parts))
+	seen := make(map[string]bool)
+	for i, part := range t.parts {
+		if part == "" {
+			return nil, fmt.Errorf("Name template %q: empty component", s)
+		}
+		if strings.HasPrefix(part, "<") && strings.HasSuffix(part, ">") {
+			field := part[1 : len(part)-1]
+			if field == "" || field == "name" {
+				return nil, fmt.Errorf("Name template %q: invalid field %q", s, part)
+			}
+			if seen[field] {
+				return nil, fmt.Errorf("Name template %q: duplicate field %q", s, part)
+			}
+			seen[field] = true
+			t.fields[i] = field
+		} else if strings.ContainsAny(part, "<>") {
+			return nil, fmt.Errorf("Name template %q: invalid component %q", s, part)
+		}
+	}
+	if len(seen) == 0 {
+		return nil, fmt.Errorf("Name template %q: no <field> components", s)
+	}
+	return t, nil
+}
+
+func (t *NameTemplate) String() string {
+	return t.template
+}
+
+// match returns the fields extracted from the name components, or
+// nil if the template does not match.
+func (t *NameTemplate) match(parts []string) map[string]string {
+	if len(parts) < len(t.parts) {
+		return nil
+	}
+	for i, part := range t.parts {
+		if t.fields[i] == "" && part != "*" && part != parts[i] {
+			return nil
+		}
+	}
+	result := make(map[string]string, len(t.fields))
+	for i, field := range t.fields {
+		if field != "" {
+			result[field] = parts[i]
+		}
+	}
+	return result
+}
+
+// applyNameTemplates adds to the ident the fields extracted by the
+// first matching template. Fields already in the ident are left as
+// is. If no template matches the ident itself is returned, otherwise
+// a copy, the original is not modified.
+func applyNameTemplates(templates []*NameTemplate, ident serde.Ident) serde.Ident {
+	if len(templates) == 0 {
+		return ident
+	}
+
+	parts := strings.Split(ident["name"], ".")
+	for _, t := range templates {
+		fields := t.match(parts)
+		if fields == nil {
+			continue
+		}
+		result := make(serde.Ident, len(ident)+len(fields))
+		for k, v := range fields {
+			result[k] = v
+		}
+		for k, v := range ident {
+			result[k] = v
+		}
+		return result
+	}
+	return ident
+}
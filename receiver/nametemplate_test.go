@@ -0,0 +1,64 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"testing"
+
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_ParseNameTemplate(t *testing.T) {
+	for _, s := range []string{"", "servers..<host>", "servers.<>", "servers.<name>", "<host>.<host>", "servers.*", "a<b>"} {
+		if _, err := ParseNameTemplate(s); err == nil {
+			t.Errorf("ParseNameTemplate(%q): no error", s)
+		}
+	}
+	if nt, err := ParseNameTemplate("servers.<host>.*.<metric>"); err != nil || nt.String() != "servers.<host>.*.<metric>" {
+		t.Errorf("ParseNameTemplate: %v %v", nt, err)
+	}
+}
+
+func Test_applyNameTemplates(t *testing.T) {
+	ident := serde.Ident{"name": "servers.web1.nginx.requests.count"}
+	if got := applyNameTemplates(nil, ident); len(got) != 1 {
+		t.Errorf("applyNameTemplates: no templates changed the ident: %v", got)
+	}
+
+	var templates []*NameTemplate
+	for _, s := range []string{"servers.<host>.*.<metric>.<kind>.<extra>", "servers.<host>.<service>", "<first>"} {
+		nt, _ := ParseNameTemplate(s)
+		templates = append(templates, nt)
+	}
+
+	got := applyNameTemplates(templates, ident)
+	if len(got) != 3 || got["host"] != "web1" || got["service"] != "nginx" || got["name"] != ident["name"] {
+		t.Errorf("applyNameTemplates: the first matching template should apply: %v", got)
+	}
+	if len(ident) != 1 {
+		t.Errorf("applyNameTemplates: original ident modified: %v", ident)
+	}
+
+	got = applyNameTemplates(templates, serde.Ident{"name": "foo.bar", "first": "kept"})
+	if got["first"] != "kept" {
+		t.Errorf("applyNameTemplates: existing fields should not be replaced: %v", got)
+	}
+
+	templates = templates[1:2]
+	if got := applyNameTemplates(templates, serde.Ident{"name": "hosts.web1.nginx"}); len(got) != 1 {
+		t.Errorf("applyNameTemplates: literal did not match, ident should not change: %v", got)
+	}
+}
@@ -0,0 +1,204 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PreAggregateFunc is how a PreAggregateRule combines the values of
+// the data points it matches.
+type PreAggregateFunc int
+
+const (
+	PreAggSum PreAggregateFunc = iota
+	PreAggAvg
+	PreAggMin
+	PreAggMax
+	PreAggCount
+)
+
+var preAggFuncNames = []string{"sum", "avg", "min", "max", "count"}
+
+func (f PreAggregateFunc) String() string {
+	if f >= 0 && int(f) < len(preAggFuncNames) {
+		return preAggFuncNames[f]
+	}
+	return fmt.Sprintf("PreAggregateFunc(%d)", int(f))
+}
+
+// ParsePreAggregateFunc converts one of "sum", "avg", "min", "max"
+// or "count" into a PreAggregateFunc.
+func ParsePreAggregateFunc(s string) (PreAggregateFunc, error) {
+	for i, name := range preAggFuncNames {
+		if strings.ToLower(s) == name {
+			return PreAggregateFunc(i), nil
+		}
+	}
+	return PreAggSum, fmt.Errorf("Invalid pre-aggregate function: %q (valid: %s)", s, strings.Join(preAggFuncNames, ", "))
+}
+
+// The default PreAggregateRule Interval.
+const dftPreAggInterval = 10 * time.Second
+
+// PreAggregateRule (similar to a carbon-aggregator rule) combines the
+// values of the data points whose names match Regexp into a new data
+// point every Interval (default 10s) named Output, which may refer to
+// the capture groups of Regexp as in regexp.Regexp.ReplaceAllString,
+// e.g. "servers\.[^.]+\.requests" -> "total.requests", or
+// "servers\.([^.]+)\.cpu\.[^.]+" -> "dc.$1.cpu". The original data
+// points are not affected.
+type PreAggregateRule struct {
+	Regexp   *regexp.Regexp
+	Output   string
+	Function PreAggregateFunc
+	Interval time.Duration
+}
+
+type preAggKey struct {
+	rule  int
+	name  string
+	start int64 // of the interval, unix seconds
+}
+
+type preAggBucket struct {
+	sum, min, max float64
+	count         int
+}
+
+func (b *preAggBucket) value(f PreAggregateFunc) float64 {
+	switch f {
+	case PreAggAvg:
+		return b.sum / float64(b.count)
+	case PreAggMin:
+		return b.min
+	case PreAggMax:
+		return b.max
+	case PreAggCount:
+		return float64(b.count)
+	}
+	return b.sum
+}
+
+// preAggregator applies the PreAggregateRules to data points as they
+// are queued. A bucket is emitted once its interval (plus another
+// interval to allow for stragglers) is over, points that arrive after
+// that are counted as late and not included. It is safe for
+// concurrent use.
+type preAggregator struct {
+	*sync.Mutex
+	rules   []PreAggregateRule
+	buckets map[preAggKey]*preAggBucket
+	done    map[string]int64 // last start emitted by rule/name
+	late    int              // reset by report()
+	emitted int              // reset by report()
+}
+
+// newPreAggregator returns a preAggregator, or nil if there are no
+// rules.
+func newPreAggregator(rules []PreAggregateRule) *preAggregator {
+	if len(rules) == 0 {
+		return nil
+	}
+	for n, rule := range rules {
+		if rule.Interval <= 0 {
+			rules[n].Interval = dftPreAggInterval
+		}
+		log.Printf("preAggregator: rule %d: %v(%v) every %v -> %q", n, rule.Function, rule.Regexp, rules[n].Interval, rule.Output)
+	}
+	return &preAggregator{
+		Mutex:   &sync.Mutex{},
+		rules:   rules,
+		buckets: make(map[preAggKey]*preAggBucket),
+		done:    make(map[string]int64),
+	}
+}
+
+// add adds a data point to the buckets of every rule it matches.
+func (pa *preAggregator) add(name string, ts time.Time, v float64) {
+	if pa == nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return
+	}
+	pa.Lock()
+	defer pa.Unlock()
+	for n, rule := range pa.rules {
+		if !rule.Regexp.MatchString(name) {
+			continue
+		}
+		out := rule.Regexp.ReplaceAllString(name, rule.Output)
+		start := ts.Truncate(rule.Interval).Unix()
+		if done, ok := pa.done[fmt.Sprintf("%d/%s", n, out)]; ok && start <= done {
+			pa.late++
+			continue
+		}
+		key := preAggKey{rule: n, name: out, start: start}
+		b := pa.buckets[key]
+		if b == nil {
+			pa.buckets[key] = &preAggBucket{sum: v, min: v, max: v, count: 1}
+			continue
+		}
+		b.sum += v
+		b.count++
+		b.min, b.max = math.Min(b.min, v), math.Max(b.max, v)
+	}
+}
+
+// flush emits the buckets which are due as of now, or all of them if
+// now is zero.
+func (pa *preAggregator) flush(now time.Time, emit func(name string, ts time.Time, v float64)) {
+	if pa == nil {
+		return
+	}
+	pa.Lock()
+	defer pa.Unlock()
+	for key, b := range pa.buckets {
+		rule := pa.rules[key.rule]
+		start := time.Unix(key.start, 0)
+		if !now.IsZero() && now.Before(start.Add(2*rule.Interval)) {
+			continue
+		}
+		emit(key.name, start, b.value(rule.Function))
+		pa.emitted++
+		delete(pa.buckets, key)
+		doneKey := fmt.Sprintf("%d/%s", key.rule, key.name)
+		if key.start > pa.done[doneKey] {
+			pa.done[doneKey] = key.start
+		}
+	}
+}
+
+// report reports and resets the counts of emitted and late points.
+func (pa *preAggregator) report(sr statReporter) {
+	pa.Lock()
+	defer pa.Unlock()
+	sr.reportStatCount("receiver.pre_aggregate.emitted", float64(pa.emitted))
+	sr.reportStatCount("receiver.pre_aggregate.late", float64(pa.late))
+	pa.emitted, pa.late = 0, 0
+}
+
+func runPreAggregator(pa *preAggregator, r *Receiver, nap time.Duration) {
+	for {
+		time.Sleep(nap)
+		pa.flush(time.Now(), r.queuePreAggregate)
+		pa.report(r)
+	}
+}
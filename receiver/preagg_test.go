@@ -0,0 +1,91 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func Test_ParsePreAggregateFunc(t *testing.T) {
+	for _, name := range []string{"sum", "avg", "min", "max", "count"} {
+		f, err := ParsePreAggregateFunc(name)
+		if err != nil || f.String() != name {
+			t.Errorf("ParsePreAggregateFunc(%q): %v %v", name, f, err)
+		}
+	}
+	if _, err := ParsePreAggregateFunc("median"); err == nil {
+		t.Errorf("ParsePreAggregateFunc: expected an error")
+	}
+}
+
+func Test_preAggregator(t *testing.T) {
+	if pa := newPreAggregator(nil); pa != nil {
+		t.Errorf("newPreAggregator: no rules should mean nil")
+	}
+	var pa *preAggregator
+	pa.add("foo", time.Now(), 1) // no panic
+
+	pa = newPreAggregator([]PreAggregateRule{
+		{Regexp: regexp.MustCompile(`^servers\.[^.]+\.requests$`), Output: "total.requests", Function: PreAggSum},
+		{Regexp: regexp.MustCompile(`^servers\.([^.]+)\.requests$`), Output: "max.$1", Function: PreAggMax, Interval: time.Minute},
+	})
+	if pa.rules[0].Interval != dftPreAggInterval {
+		t.Errorf("newPreAggregator: default interval not set")
+	}
+
+	ts := time.Unix(1000, 0)
+	pa.add("servers.a.requests", ts, 1)
+	pa.add("servers.b.requests", ts.Add(time.Second), 2)
+	pa.add("servers.a.requests", ts.Add(2*time.Second), 3)
+	pa.add("servers.a.other", ts, 100)
+
+	got := make(map[string]float64)
+	emit := func(name string, ts time.Time, v float64) { got[name] = v }
+
+	pa.flush(ts.Add(15*time.Second), emit)
+	if len(got) != 0 {
+		t.Errorf("preAggregator: nothing should be emitted before the interval is over: %v", got)
+	}
+	pa.flush(ts.Add(20*time.Second), emit)
+	if len(got) != 1 || got["total.requests"] != 6 {
+		t.Errorf("preAggregator: expected total.requests = 6, got %v", got)
+	}
+
+	// late for the sum rule, but not for the max rule
+	pa.add("servers.a.requests", ts, 5)
+	if pa.late != 1 {
+		t.Errorf("preAggregator: expected 1 late point, got %d", pa.late)
+	}
+
+	pa.flush(time.Time{}, emit)
+	if got["max.a"] != 5 || got["max.b"] != 2 {
+		t.Errorf("preAggregator: expected max.a = 5, max.b = 2, got %v", got)
+	}
+	if len(pa.buckets) != 0 || pa.emitted != 3 {
+		t.Errorf("preAggregator: expected no buckets and 3 emitted, got %d, %d", len(pa.buckets), pa.emitted)
+	}
+}
+
+func Test_preAggBucket_value(t *testing.T) {
+	b := &preAggBucket{sum: 6, min: 1, max: 3, count: 3}
+	for f, want := range map[PreAggregateFunc]float64{PreAggSum: 6, PreAggAvg: 2, PreAggMin: 1, PreAggMax: 3, PreAggCount: 3} {
+		if v := b.value(f); v != want {
+			t.Errorf("preAggBucket.value(%v): expected %v, got %v", f, want, v)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuotaPolicy determines what happens to data points received by a
+// listener in excess of its quota.
+type QuotaPolicy int
+
+const (
+	// Discard the data points. This is the default.
+	QuotaDrop QuotaPolicy = iota
+	// Wait until the quota allows them, which slows down the sender
+	// (for TCP, since it stops reading from the connection).
+	QuotaThrottle
+)
+
+func (p QuotaPolicy) String() string {
+	switch p {
+	case QuotaDrop:
+		return "drop"
+	case QuotaThrottle:
+		return "throttle"
+	}
+	return fmt.Sprintf("QuotaPolicy(%d)", int(p))
+}
+
+// ParseQuotaPolicy converts "drop" or "throttle" into a QuotaPolicy.
+func ParseQuotaPolicy(s string) (QuotaPolicy, error) {
+	switch strings.ToLower(s) {
+	case "drop":
+		return QuotaDrop, nil
+	case "throttle":
+		return QuotaThrottle, nil
+	}
+	return QuotaDrop, fmt.Errorf("Invalid quota policy: %q (valid: drop, throttle)", s)
+}
+
+// How long a source bucket may go unused before it is forgotten.
+const quotaSourceIdle = time.Minute
+
+// tokenBucket allows rate points per second with bursts of up to one
+// second worth of points.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+// take takes n tokens if there are enough, otherwise it returns how
+// long until there will be. More than rate tokens are taken once the
+// bucket is full.
+func (b *tokenBucket) take(n int, now time.Time) (bool, time.Duration) {
+	if b.tokens += now.Sub(b.last).Seconds() * b.rate; b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	need := math.Min(float64(n), b.rate)
+	if b.tokens >= need {
+		b.tokens -= need
+		return true, 0
+	}
+	return false, time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+}
+
+// listenerQuota limits the points per second each listener accepts,
+// overall (byListener) and from any one source address (perSource).
+type listenerQuota struct {
+	*sync.Mutex
+	byListener map[string]int // points per second
+	perSource  int
+	policy     QuotaPolicy
+	buckets    map[string]*tokenBucket // by listener and listener/source
+	dropped    map[string]int          // by listener, reset by report()
+	throttled  map[string]int          // by listener, reset by report()
+}
+
+// newListenerQuota returns a listenerQuota, or nil if there are no
+// quotas.
+func newListenerQuota(byListener map[string]int, perSource int, policy QuotaPolicy) *listenerQuota {
+	if len(byListener) == 0 && perSource <= 0 {
+		return nil
+	}
+	return &listenerQuota{
+		Mutex:      &sync.Mutex{},
+		byListener: byListener,
+		perSource:  perSource,
+		policy:     policy,
+		buckets:    make(map[string]*tokenBucket),
+		dropped:    make(map[string]int),
+		throttled:  make(map[string]int),
+	}
+}
+
+// bucket returns the bucket for key, creating it as needed, or nil if
+// rate is not above zero.
+func (q *listenerQuota) bucket(key string, rate int, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := q.buckets[key]
+	if b == nil {
+		b = newTokenBucket(rate, now)
+		q.buckets[key] = b
+	}
+	return b
+}
+
+// acquire returns true if n points received by listener from source
+// (which may be blank if unknown) are within the quota. With the
+// throttle policy it waits until they are, and always returns true.
+func (q *listenerQuota) acquire(listener, source string, n int) bool {
+	if q == nil {
+		return true
+	}
+	throttled := false
+	for {
+		q.Lock()
+		now := time.Now()
+		var wait time.Duration
+		ok := true
+		lb := q.bucket(listener, q.byListener[listener], now)
+		var sb *tokenBucket
+		if source != "" {
+			sb = q.bucket(listener+"/"+source, q.perSource, now)
+		}
+		// Take from both or neither
+		if sb != nil {
+			ok, wait = sb.take(n, now)
+		}
+		if ok && lb != nil {
+			if ok, wait = lb.take(n, now); !ok && sb != nil {
+				sb.tokens += math.Min(float64(n), sb.rate) // give them back
+			}
+		}
+		if ok || q.policy != QuotaThrottle {
+			if !ok {
+				q.dropped[listener] += n
+			} else if throttled {
+				q.throttled[listener] += n
+			}
+			q.Unlock()
+			return ok
+		}
+		q.Unlock()
+		throttled = true
+		time.Sleep(wait)
+	}
+}
+
+// report reports the points dropped and delayed by the quotas as
+// receiver.listener.<name>.quota_dropped and .quota_throttled, resets
+// the counts and forgets the idle source buckets.
+func (q *listenerQuota) report(sr statReporter) {
+	q.Lock()
+	defer q.Unlock()
+	for listener, n := range q.dropped {
+		sr.reportStatCount(fmt.Sprintf("receiver.listener.%s.quota_dropped", listener), float64(n))
+		q.dropped[listener] = 0
+	}
+	for listener, n := range q.throttled {
+		sr.reportStatCount(fmt.Sprintf("receiver.listener.%s.quota_throttled", listener), float64(n))
+		q.throttled[listener] = 0
+	}
+	for key, b := range q.buckets {
+		if strings.Contains(key, "/") && time.Now().Sub(b.last) > quotaSourceIdle {
+			delete(q.buckets, key)
+		}
+	}
+}
+
+func reportListenerQuota(q *listenerQuota, sr statReporter, nap time.Duration) {
+	for {
+		time.Sleep(nap)
+		q.report(sr)
+	}
+}
@@ -0,0 +1,91 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_ParseQuotaPolicy(t *testing.T) {
+	for _, p := range []QuotaPolicy{QuotaDrop, QuotaThrottle} {
+		if pp, err := ParseQuotaPolicy(p.String()); err != nil || pp != p {
+			t.Errorf("ParseQuotaPolicy(%q): %v %v", p, pp, err)
+		}
+	}
+	if _, err := ParseQuotaPolicy("bogus"); err == nil {
+		t.Errorf("ParseQuotaPolicy: no error on an invalid policy")
+	}
+}
+
+func Test_tokenBucket(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newTokenBucket(10, now)
+	if ok, _ := b.take(10, now); !ok {
+		t.Errorf("tokenBucket: a full bucket should allow rate tokens")
+	}
+	if ok, wait := b.take(5, now); ok || wait != 500*time.Millisecond {
+		t.Errorf("tokenBucket: an empty bucket should refuse and wait 500ms, got %v", wait)
+	}
+	if ok, _ := b.take(5, now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("tokenBucket: the bucket should have refilled")
+	}
+	if ok, _ := b.take(100, now.Add(10*time.Second)); !ok {
+		t.Errorf("tokenBucket: more than rate should be allowed from a full bucket")
+	}
+}
+
+func Test_listenerQuota(t *testing.T) {
+	var q *listenerQuota
+	if !q.acquire("foo", "", 1) {
+		t.Errorf("listenerQuota: nil should allow everything")
+	}
+	if newListenerQuota(nil, 0, QuotaDrop) != nil {
+		t.Errorf("newListenerQuota: no quotas should mean nil")
+	}
+
+	q = newListenerQuota(map[string]int{"foo": 3}, 2, QuotaDrop)
+	allowed := 0
+	for i := 0; i < 4; i++ {
+		if q.acquire("foo", "1.2.3.4", 1) {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("listenerQuota: the source quota should allow 2, allowed %d", allowed)
+	}
+	if !q.acquire("foo", "5.6.7.8", 1) || q.acquire("foo", "5.6.7.8", 1) {
+		t.Errorf("listenerQuota: the listener quota should allow 1 more")
+	}
+	if !q.acquire("bar", "", 100) {
+		t.Errorf("listenerQuota: a listener with no quota should be allowed")
+	}
+
+	sr := &fakeSr{}
+	q.report(sr)
+	if sr.called == 0 || q.dropped["foo"] != 0 {
+		t.Errorf("listenerQuota: report should report and reset")
+	}
+
+	q = newListenerQuota(map[string]int{"foo": 100}, 0, QuotaThrottle)
+	start := time.Now()
+	for i := 0; i < 101; i++ {
+		q.acquire("foo", "", 1)
+	}
+	if time.Now().Sub(start) < 5*time.Millisecond || q.throttled["foo"] != 1 {
+		t.Errorf("listenerQuota: throttle should delay the point over the quota")
+	}
+}
@@ -21,7 +21,9 @@ package receiver
 import (
 	"bytes"
 	"encoding/gob"
+	"io"
 	"os"
+	"regexp"
 	"sync"
 	"time"
 
@@ -65,25 +67,250 @@ type Receiver struct {
 	// Smallest step
 	MinStep time.Duration
 
-	// MaxReceiverQueueSize is the limit on the receiver queue. Points
-	// are sent to /dev/null when this size is exceeded. Zero or a
-	// negative value means unlimited.
+	// MaxReceiverQueueSize is the limit on the receiver queue. What
+	// happens when this size is exceeded is determined by
+	// QueueOverflowPolicy. Zero or a negative value means unlimited.
 	MaxReceiverQueueSize int
 
+	// QueueOverflowPolicy determines whether points are dropped
+	// (newest or oldest) or producers are blocked when the receiver
+	// queue is full. Default is QueueDropNewest.
+	QueueOverflowPolicy QueueOverflowPolicy
+
 	// MaxMemoryBytes is the limit after which points are
 	// discarded. It is based on runtime.ReadMemStats() and is rough
 	// and approximate, but better than nothing.
 	MaxMemoryBytes uint64
 
+	// BackfillWindow is how far behind the DS LastUpdate a data
+	// point may be and still be accepted, in which case it is
+	// applied to the RRA slots which include it (see
+	// rrd.DataSource.BackfillDataPoint). Zero (default) means data
+	// points that are out of order are rejected.
+	BackfillWindow time.Duration
+
+	// DuplicatePolicy determines how data points for the same DS
+	// with the same time stamp are combined, see DuplicatePolicy.
+	// Only points processed together (within the same batch) can
+	// be combined, a later duplicate of a time stamp which has
+	// already been processed is ignored if the policy is
+	// DuplicateKeepFirst and otherwise processed as any other
+	// data point.
+	DuplicatePolicy DuplicatePolicy
+
+	// MaxNewDSs limits how many new data sources may be created per
+	// NewDSInterval, MaxNewDSsByPrefix does the same for names
+	// beginning with a given prefix. Data points for which a DS
+	// cannot be created because of a limit are dropped. Zero means
+	// no limit. The default NewDSInterval is one minute.
+	MaxNewDSs         int
+	MaxNewDSsByPrefix map[string]int
+	NewDSInterval     time.Duration
+
+	// DSCacheMaxMemory is the (roughly estimated) memory budget of
+	// the DS cache. When it is exceeded, least recently used DSs
+	// which have been idle for at least DSCacheMinIdle (default 10
+	// minutes) are flushed and evicted, to be loaded from the
+	// database again when needed. Zero means unlimited. In a cluster
+	// the DS is still referenced by the cluster and its memory is
+	// not entirely reclaimed.
+	DSCacheMaxMemory uint64
+	DSCacheMinIdle   time.Duration
+
+	// DSStaleAfter is how long a DS can go without receiving any
+	// data points before it is flushed and unloaded from the cache.
+	// If DSArchiveStale is true, unloaded DSs are also marked
+	// archived in the database, which excludes them from wildcard
+	// expansion and from loading on start until they receive data
+	// again. Zero means DSs are never considered stale.
+	DSStaleAfter   time.Duration
+	DSArchiveStale bool
+
+	// Retention is how long a DS may go without being updated before
+	// it is deleted along with its RRAs, if the serde is a
+	// serde.DataSourcePurger. RetentionByPrefix overrides it for
+	// names beginning with a prefix (the longest matching one), zero
+	// means forever. With RetentionDryRun the DSs that would be
+	// deleted are only logged. Zero (default) means forever.
+	Retention         time.Duration
+	RetentionByPrefix map[string]time.Duration
+	RetentionDryRun   bool
+
+	// Dropped data points (no DS spec match, NaN, new DS limit) and
+	// input that could not be parsed (see RecordDropped) are written
+	// to DeadLetterFile and/or sent to DeadLetterCh, along with the
+	// reason. The file is rotated when it reaches DeadLetterMaxSize
+	// (default 10MB), only one previous file (with a ".1" suffix) is
+	// kept. Sends to DeadLetterCh never block.
+	DeadLetterFile    string
+	DeadLetterMaxSize int64
+	DeadLetterCh      chan<- *DeadLetter
+
+	// ShutdownTimeout limits how long Stop() spends flushing cached
+	// data to the database. When it is reached, whatever was not
+	// flushed is logged and lost. Zero means no limit.
+	ShutdownTimeout time.Duration
+
+	// DbMaintenanceInterval is how often the database is maintained,
+	// if the serde is a serde.Maintainer: orphaned rows are pruned,
+	// the hot tables analyzed and the table statistics reported as
+	// serde.table.<table>.*. In a cluster every node does it, which
+	// is cheap when there is nothing to prune. Zero means never.
+	DbMaintenanceInterval time.Duration
+
+	// CreateBreakerMaxSeries and CreateBreakerMaxRate, if above
+	// zero, stop the creation of new DSs altogether when the total
+	// number of series reaches CreateBreakerMaxSeries, or when more
+	// than CreateBreakerMaxRate new DSs are created within
+	// CreateBreakerInterval (default 1m), in which case creation
+	// stays off for CreateBreakerCooldown (default 5m). Existing
+	// DSs are not affected. The breaker state is reported as
+	// receiver.create_breaker.open.
+	CreateBreakerMaxSeries int
+	CreateBreakerMaxRate   int
+	CreateBreakerInterval  time.Duration
+	CreateBreakerCooldown  time.Duration
+
+	// LoadRetries is how many times the loading (or creation) of a
+	// DS is retried on database errors, with backoff, its data
+	// points are buffered meanwhile. After DBBreakerThreshold
+	// consecutive errors loading pauses altogether, other than an
+	// occasional probe, until the database is back. Zero means no
+	// retries and no breaker, i.e. a DS which cannot be loaded is
+	// dropped along with its data points.
+	LoadRetries        int
+	DBBreakerThreshold int
+
+	// Whitelist and Blacklist filter incoming data points by name
+	// before they are looked up or a DS is created. If Whitelist is
+	// not empty, only names matching one of its regular expressions
+	// are accepted, names matching any of the Blacklist regular
+	// expressions are rejected.
+	Whitelist []*regexp.Regexp
+	Blacklist []*regexp.Regexp
+
+	// Rewrites are applied in order to the names of data points as
+	// they are queued (QueueDataPoint), before the filters above
+	// and the DS lookup, e.g. to normalize legacy naming schemes.
+	// Data points forwarded by other cluster nodes have already
+	// been rewritten and are left alone.
+	Rewrites []RewriteRule
+
+	// NameTemplates extract ident fields (tags) from the components
+	// of the (rewritten) name, the first matching template is used.
+	// Note that adding fields changes the ident, i.e. a series with
+	// a matching name that already exists without them is not
+	// updated anymore, a new one is created instead.
+	NameTemplates []*NameTemplate
+
+	// PreAggregates are applied to the (rewritten) names of data
+	// points as they are queued, see PreAggregateRule. Each node of a
+	// cluster only aggregates the points it receives, so its output
+	// is a partial result, use the sum DuplicatePolicy for the
+	// outputs of sum and count rules so that they add up.
+	PreAggregates []PreAggregateRule
+
 	StatFlushDuration time.Duration // Period after which stats are flushed
 	StatsNamePrefix   string        // Stat names are prefixed with this
 
+	// AggOutputs specifies which values (percentiles, min, max,
+	// stddev, etc.) are flushed for timers by name prefix, see
+	// aggregator.OutputSpec. Names not matching any prefix get the
+	// default aggregator outputs.
+	AggOutputs []aggregator.OutputSpec
+
+	// AggHistograms specifies bucket boundaries for timers by name
+	// pattern, see aggregator.HistogramSpec.
+	AggHistograms []aggregator.HistogramSpec
+
+	// Timer aggregates flushed for names not matching AggOutputs,
+	// see aggregator.State. Empty values mean aggregator defaults.
+	AggThresholds          []int
+	AggTimerAggregates     []string
+	AggThresholdAggregates []string
+	AggThresholdSep        string
+
 	ReportStats       bool   // report internal stats?
 	ReportStatsPrefix string // prefix for internal stats
 
 	// Number of workers and flushers
 	NWorkers int
 
+	// FlushWorkers is the number of db flushers, default is twice
+	// NWorkers. If FlushSharding is set, every flusher has its own
+	// queue and FlushSharding decides which flusher writes what
+	// (e.g. FlushShardBySegment), otherwise all flushers share one
+	// queue.
+	FlushWorkers  int
+	FlushSharding FlushShardFunc
+
+	// FlushBatchSize is how many flushes may be grouped into a single
+	// database transaction (if the serde supports it), waiting at
+	// most FlushBatchDelay for a batch to fill up. A FlushBatchSize
+	// of 0 or 1 (default) means every flush is its own transaction.
+	FlushBatchSize  int
+	FlushBatchDelay time.Duration
+
+	// FlushTargetLatency, if set, enables adaptive flush pacing:
+	// when the average database write takes longer than this, the
+	// flush interval and FlushBatchSize are stretched, up to
+	// FlushMaxStretch (default 8) times, and shrunk back when the
+	// database is fast again.
+	FlushTargetLatency time.Duration
+	FlushMaxStretch    float64
+
+	// MaxHops is the number of times a data point (or aggregator
+	// command) may have been forwarded between cluster nodes, points
+	// with more hops than this are dropped. Default is 2.
+	MaxHops int
+
+	// MaxForwards limits forwarding: a point is only forwarded to
+	// the node responsible for it if it has been forwarded fewer
+	// than MaxForwards times. The default of 1 means that points
+	// received from another node are never forwarded again, larger
+	// values allow a node which no longer owns a DS (e.g. during
+	// rebalancing) to pass points on to its new owner. MaxForwards
+	// should not exceed MaxHops.
+	MaxForwards int
+
+	// ForwardRetrySize is how many data points per cluster node are
+	// buffered when they cannot be forwarded because the node is not
+	// ready, they are forwarded once it is. Points that do not fit
+	// are dropped and counted as receiver.forward_retry.overflow.
+	// Zero (default) means such points are lost, unless spooled.
+	ForwardRetrySize int
+
+	// If ForwardSpoolDir is set, points which do not fit in the
+	// ForwardRetrySize buffer of a node are spooled to a file in it
+	// (hinted handoff) and forwarded once the node is ready again,
+	// so that a node can be down for a while without losing them.
+	// A node spool is limited to ForwardSpoolMaxSize bytes (default
+	// 100MB), and discarded when older than ForwardSpoolMaxAge
+	// (default 24h). Spool files are in the dead letter format.
+	ForwardSpoolDir     string
+	ForwardSpoolMaxSize int64
+	ForwardSpoolMaxAge  time.Duration
+
+	// ListenerQuotas limits the data points per second accepted by a
+	// listener (e.g. "graphite_tcp"), ListenerSourceQuota the points
+	// per second accepted by any listener from any one source address
+	// (where known, i.e. not for UDP). Points over a quota are dropped
+	// or, if the QuotaPolicy is QuotaThrottle, delayed. Both are
+	// counted by listener. See AcquireListenerInput. Zero or absent
+	// means no quota.
+	ListenerQuotas      map[string]int
+	ListenerSourceQuota int
+	QuotaPolicy         QuotaPolicy
+
+	// ListenerPrefixes are prepended to the names of the points
+	// received by a listener, e.g. "dc1.", see ListenerName.
+	ListenerPrefixes map[string]string
+
+	// ListenerTimestamps are what listeners do with the time stamps
+	// of the points they receive, e.g. replace them with the time
+	// of arrival, see ListenerTime. Absent is TimestampSender.
+	ListenerTimestamps map[string]ListenerTimestamps
+
 	Blaster *blaster.Blaster
 
 	// unexported internal stuff
@@ -101,12 +328,19 @@ type Receiver struct {
 	aggCh         chan *aggregator.Command // aggregator commands (for statsd type stuff)
 	pacedMetricCh chan *pacedMetric        // paced metrics (only flushed periodically)
 
+	listeners *listenerCounter // data points received by listener
+	quota     *listenerQuota   // nil if no listener quotas
+	rewriter  *dpRewriter      // set up from Rewrites by Start()
+	preAgg    *preAggregator   // set up from PreAggregates by Start()
+
 	workerWg      sync.WaitGroup
 	flusherWg     sync.WaitGroup
 	aggWg         sync.WaitGroup
 	directorWg    sync.WaitGroup
 	pacedMetricWg sync.WaitGroup
 
+	migrating int32 // atomic, 1 while MigrateDataSources runs
+
 	stopped bool
 }
 
@@ -126,43 +360,77 @@ func NewWithMaxQueue(db serde.SerDe, finder MatchingDSSpecFinder, maxQueue int)
 	// The elastic channel must exist before the receiver is started,
 	// so that incoming data points could be sent in even when we
 	// don't know how to process them yet. This happens during a
-	// graceful restart.  TODO: Until the receiver is started
-	// (i.e. director() is running), the size of the queue is not
-	// controlled.
+	// graceful restart. Until the receiver is started, the queue is
+	// limited to maxQueue and overflows are dropped, after that
+	// MaxReceiverQueueSize and QueueOverflowPolicy apply.
 	var queue = &fifoQueue{}
+	queue.setLimits(maxQueue, QueueDropNewest)
 	dpChIn := make(chan interface{}, 256)
 	dpChOut := make(chan interface{}, 128)
-	go elasticCh(dpChIn, dpChOut, queue, maxQueue+256)
+	go elasticCh(dpChIn, dpChOut, queue)
 
 	r := &Receiver{
-		serde:             db,
-		MinStep:           10 * time.Second,
-		StatFlushDuration: 10 * time.Second,
-		StatsNamePrefix:   "stats",
-		dpChIn:            dpChIn,
-		dpChOut:           dpChOut,
-		queue:             queue,
-		aggCh:             make(chan *aggregator.Command, 256),
-		pacedMetricCh:     make(chan *pacedMetric, 256),
-		ReportStats:       false,
-		ReportStatsPrefix: "tgres",
-		NWorkers:          1,
+		serde:                db,
+		MaxReceiverQueueSize: maxQueue,
+		MinStep:              10 * time.Second,
+		StatFlushDuration:    10 * time.Second,
+		StatsNamePrefix:      "stats",
+		dpChIn:               dpChIn,
+		dpChOut:              dpChOut,
+		queue:                queue,
+		aggCh:                make(chan *aggregator.Command, 256),
+		pacedMetricCh:        make(chan *pacedMetric, 256),
+		listeners:            newListenerCounter(),
+		ReportStats:          false,
+		ReportStatsPrefix:    "tgres",
+		NWorkers:             1,
+		MaxHops:              2,
+		MaxForwards:          1,
 	}
 
 	//r.flusher = &dsFlusher{db: db.Flusher(), vdb: db.VerticalFlusher(), sr: r}
 	r.flusher = &dsFlusher{db: db.Flusher(), sr: r}
 	r.dsc = newDsCache(db.Fetcher(), finder, r.flusher)
 
-	// Register DS delete listener
+	// Register DS delete and rename listeners
 	if el := db.EventListener(); el != nil {
 		el.RegisterDeleteListener(func(ident serde.Ident) {
 			r.dsc.delete(ident)
+			r.dsc.breaker.addSeries(-1)
+		})
+	}
+	if rl, ok := db.EventListener().(serde.RenameEventListener); ok {
+		rl.RegisterRenameListener(func(ident serde.Ident) {
+			r.dsc.delete(ident) // it is fetched under the new ident
 		})
 	}
 
 	return r
 }
 
+// SetDSSpecFinder replaces the MatchingDSSpecFinder used to
+// determine the DSSpec of new DSs, it is safe to call while the
+// receiver is running. Only DSs created subsequently are affected.
+func (r *Receiver) SetDSSpecFinder(finder MatchingDSSpecFinder) {
+	if finder == nil {
+		finder = &SimpleDSFinder{DftDSSPec}
+	}
+	r.dsc.setFinder(finder)
+}
+
+// SetDSSpecSet sets a named MatchingDSSpecFinder for the data
+// points queued with QueueDataPointSpecSet, new DSs get the first
+// DSSpec it finds or, if none, that of the main finder. It must be
+// called before the receiver is started.
+func (r *Receiver) SetDSSpecSet(name string, finder MatchingDSSpecFinder) {
+	r.dsc.setSpecSet(name, finder)
+}
+
+// DSSpecFinder returns the current MatchingDSSpecFinder.
+func (r *Receiver) DSSpecFinder() MatchingDSSpecFinder {
+	return r.dsc.getFinder()
+}
+
 // Before using the receiver it must be Started. This starts all the
 // worker and flusher goroutines, etc.
 func (r *Receiver) Start() {
@@ -187,7 +455,9 @@ func (r *Receiver) Stop() {
 // In a clustered set up informes other nodes that we are ready to
 // handle data.
 func (r *Receiver) ClusterReady(ready bool) {
-	r.cluster.Ready(ready)
+	if r.cluster != nil {
+		r.cluster.Ready(ready)
+	}
 }
 
 // Make the receiver clustered. It will also cause internal stats to
@@ -218,11 +488,84 @@ func (r *Receiver) DsCache() *dsCache {
 // rate. Consider using the Aggregator (QueueAggregatorCommand) or
 // paced metrics (QueueSum/QueueGauge) for non-rate data.
 func (r *Receiver) QueueDataPoint(ident serde.Ident, ts time.Time, v float64) {
+	r.QueueDataPointSpecSet(ident, ts, v, "")
+}
+
+// QueueDataPointSpecSet is QueueDataPoint with the DSSpec of a new
+// DS from the named DS spec set (see SetDSSpecSet), "" is the main
+// finder. The set is forwarded to other nodes along with the point,
+// pre-aggregated outputs are always created with the main finder.
+func (r *Receiver) QueueDataPointSpecSet(ident serde.Ident, ts time.Time, v float64, specSet string) {
+	ident = r.rewriter.rewrite(ident)
+	r.preAgg.add(ident["name"], ts, v)
+	r.queueDataPoint(applyNameTemplates(r.NameTemplates, ident), ts, v, specSet)
+}
+
+// queuePreAggregate queues a pre-aggregated data point, it is not
+// subject to Rewrites or PreAggregates.
+func (r *Receiver) queuePreAggregate(name string, ts time.Time, v float64) {
+	r.queueIdentDataPoint(applyNameTemplates(r.NameTemplates, serde.Ident{"name": name}), ts, v)
+}
+
+// queueIdentDataPoint is QueueDataPoint without Rewrites and
+// NameTemplates.
+func (r *Receiver) queueIdentDataPoint(ident serde.Ident, ts time.Time, v float64) {
+	r.queueDataPoint(ident, ts, v, "")
+}
+
+func (r *Receiver) queueDataPoint(ident serde.Ident, ts time.Time, v float64, specSet string) {
 	if !r.stopped {
-		r.dpChIn <- &incomingDP{cachedIdent: newCachedIdent(ident), timeStamp: ts, value: v}
+		dp := newIncomingDP()
+		dp.cachedIdent, dp.timeStamp, dp.value, dp.arrived = newCachedIdent(ident), ts, v, time.Now()
+		dp.specSet = specSet
+		r.dpChIn <- dp
 	}
 }
 
+// QueueLen returns the number of data points waiting in the receiver
+// queue, e.g. for listeners to stop reading when it is too long.
+func (r *Receiver) QueueLen() int {
+	return r.queue.size()
+}
+
+// CountListenerInput counts n data points received by a listener
+// (e.g. "graphite_tcp"), the counts are reported as
+// receiver.listener.<listener>.datapoints.
+func (r *Receiver) CountListenerInput(listener string, n int) {
+	r.listeners.add(listener, n)
+}
+
+// ListenerName returns the name of a point received by a listener
+// with the listener's prefix, if any, prepended. It is for the
+// listeners to call before queueing, so that the prefixed name is
+// what Rewrites and DS specs see.
+func (r *Receiver) ListenerName(listener, name string) string {
+	return r.ListenerPrefixes[listener] + name
+}
+
+// CountListenerEvent counts an event of a listener other than data
+// received, e.g. "conns_rejected", reported as
+// receiver.listener.<listener>.<event>.
+func (r *Receiver) CountListenerEvent(listener, event string) {
+	r.listeners.addEvent(listener, event)
+}
+
+// AcquireListenerInput checks n data points received by a listener
+// (e.g. "graphite_tcp") from a source address (blank if unknown)
+// against the ListenerQuotas and ListenerSourceQuota. It returns false
+// if they are over the quota and should be dropped, with the
+// QuotaThrottle policy it instead blocks until they are within it.
+func (r *Receiver) AcquireListenerInput(listener, source string, n int) bool {
+	return r.quota.acquire(listener, source, n)
+}
+
+// RecordDropped records input that was dropped before it could be
+// queued, e.g. a line that could not be parsed, as a dead letter. It
+// does nothing unless dead letters are enabled.
+func (r *Receiver) RecordDropped(reason, data string) {
+	r.dsc.deadLetter.add(reason, data)
+}
+
 // Sends a data point (in the form of an aggregator.Command) to the
 // aggregator.
 func (r *Receiver) QueueAggregatorCommand(agg *aggregator.Command) {
@@ -285,6 +628,7 @@ type clusterer interface {
 	Ready(bool) error
 	Leave(timeout time.Duration) error
 	Shutdown() error
+	SendQueueStats() []cluster.SendQueueStats
 	//NewMsg(*cluster.Node, interface{}) (*cluster.Msg, error)
 }
 
@@ -299,6 +643,26 @@ type incomingDP struct {
 	timeStamp   time.Time
 	value       float64
 	Hops        int
+	arrived     time.Time // when it was queued or received from another node
+	specSet     string    // see QueueDataPointSpecSet
+	forwarded   bool      // to the other replicas, see directorProcessOrForward
+}
+
+// Every data point received is an incomingDP, they are reused rather
+// than left to the garbage collector.
+var incomingDPPool = sync.Pool{New: func() interface{} { return new(incomingDP) }}
+
+// newIncomingDP returns a zero incomingDP from the pool.
+func newIncomingDP() *incomingDP {
+	dp := incomingDPPool.Get().(*incomingDP)
+	*dp = incomingDP{}
+	return dp
+}
+
+// release returns the data point to the pool once it has been
+// processed, forwarded or dropped, dp must not be used after this.
+func (dp *incomingDP) release() {
+	incomingDPPool.Put(dp)
 }
 
 func (dp *incomingDP) GobEncode() ([]byte, error) {
@@ -314,6 +678,7 @@ func (dp *incomingDP) GobEncode() ([]byte, error) {
 	check(enc.Encode(dp.timeStamp))
 	check(enc.Encode(dp.value))
 	check(enc.Encode(dp.Hops))
+	check(enc.Encode(dp.specSet))
 	if err != nil {
 		return nil, err
 	}
@@ -334,5 +699,11 @@ func (dp *incomingDP) GobDecode(b []byte) error {
 	check(dec.Decode(&dp.timeStamp))
 	check(dec.Decode(&dp.value))
 	check(dec.Decode(&dp.Hops))
+	if err == nil {
+		// Older nodes do not send the spec set, it is "" then.
+		if er := dec.Decode(&dp.specSet); er != io.EOF {
+			check(er)
+		}
+	}
 	return err
 }
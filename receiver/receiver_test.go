@@ -189,6 +189,7 @@ func (c *fakeCluster) Shutdown() error {
 	c.nShutdown = c.n
 	return nil
 }
+func (c *fakeCluster) SendQueueStats() []cluster.SendQueueStats { return nil }
 
 // IncomingDP must be gob encodable
 func TestIncomingDP_gobEncodable(t *testing.T) {
@@ -198,6 +199,7 @@ func TestIncomingDP_gobEncodable(t *testing.T) {
 		timeStamp:   now,
 		value:       1.2345,
 		Hops:        7,
+		specSet:     "hires",
 	}
 
 	var bb bytes.Buffer
@@ -216,3 +218,14 @@ func TestIncomingDP_gobEncodable(t *testing.T) {
 		t.Errorf("dp1 != dp2 after gob encode/decode")
 	}
 }
+
+func Test_newIncomingDP(t *testing.T) {
+	dp := newIncomingDP()
+	dp.cachedIdent, dp.value, dp.Hops = newCachedIdent(serde.Ident{"name": "foo.bar"}), 1, 2
+	dp.release()
+
+	// whether or not it is the same one, it must be zero
+	if dp = newIncomingDP(); !reflect.DeepEqual(dp, &incomingDP{}) {
+		t.Errorf("newIncomingDP: not a zero incomingDP: %#v", dp)
+	}
+}
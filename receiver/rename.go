@@ -0,0 +1,45 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// RenameDataSources renames DSs (see serde.RenameDataSources) and
+// drops them from the cache, so that data points for the old names
+// create new DSs and those for the new ones find the renamed DSs. If
+// dryRun is set, the renames are only returned.
+func (r *Receiver) RenameDataSources(from, to string, dryRun bool) ([]serde.Rename, error) {
+	db, ok := r.dsc.db.(serde.DataSourceMover)
+	if !ok {
+		return nil, fmt.Errorf("renaming DSs is not supported by this serde")
+	}
+	renames, err := serde.RenameDataSources(db, from, to, dryRun)
+	if !dryRun {
+		for _, rn := range renames {
+			r.dsc.delete(rn.From)
+			r.dsc.delete(rn.To)
+		}
+		if len(renames) > 0 {
+			log.Printf("RenameDataSources(): renamed %d DSs from %q to %q.", len(renames), from, to)
+		}
+	}
+	return renames, err
+}
@@ -0,0 +1,106 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// ReplayDeadLetters reads dead letters in the format of the dead
+// letter file (see DeadLetter) and queues the data points among them
+// for processing again, at up to rate points per second (0 is
+// unlimited), e.g. to recover points which were dropped during an
+// outage or before a DS spec was added. The points go through the
+// director as any other, except that Rewrites and NameTemplates are
+// not applied again, because the recorded ident is already a result
+// of them. Unparseable input and NaN values cannot be replayed and
+// are skipped, as are lines which are not valid dead letters. It
+// returns once everything has been queued, or with an error if the
+// receiver is stopped before that.
+//
+// NB: If rd is the dead letter file this receiver writes to, the
+// points which are dropped again are appended to it, it is up to the
+// caller to limit rd to what was there before (see io.LimitReader).
+func (r *Receiver) ReplayDeadLetters(rd io.Reader, rate int) (queued, skipped int, err error) {
+	start := time.Now()
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		if r.stopped {
+			return queued, skipped, fmt.Errorf("Receiver stopped, replay incomplete")
+		}
+		ident, ts, v, err := parseDeadLetterDP(scanner.Text())
+		if err != nil {
+			skipped++
+			continue
+		}
+		r.queueIdentDataPoint(ident, ts, v)
+		queued++
+
+		if rate > 0 {
+			// Sleep if ahead of schedule
+			if due := start.Add(time.Duration(queued) * time.Second / time.Duration(rate)); time.Now().Before(due) {
+				time.Sleep(due.Sub(time.Now()))
+			}
+		}
+	}
+	return queued, skipped, scanner.Err()
+}
+
+// parseDeadLetterDP parses a dead letter line of a dropped data
+// point, i.e. "<time> <reason> <ident> <timestamp> <value>".
+func parseDeadLetterDP(line string) (serde.Ident, time.Time, float64, error) {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 3 {
+		return nil, time.Time{}, 0, fmt.Errorf("Invalid dead letter: %q", line)
+	}
+	if reason := parts[1]; reason == DeadParse || reason == DeadNaN {
+		return nil, time.Time{}, 0, fmt.Errorf("Dead letter cannot be replayed (%s): %q", reason, line)
+	}
+
+	// The ident may contain spaces, the time stamp and the value
+	// cannot.
+	data := strings.TrimSpace(parts[2])
+	var fields [2]string // time stamp, value
+	for i := 1; i >= 0; i-- {
+		n := strings.LastIndex(data, " ")
+		if n < 0 {
+			return nil, time.Time{}, 0, fmt.Errorf("Invalid dead letter data point: %q", line)
+		}
+		fields[i], data = data[n+1:], strings.TrimSpace(data[:n])
+	}
+
+	sec, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, time.Time{}, 0, fmt.Errorf("Invalid dead letter time stamp: %q", line)
+	}
+	v, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, time.Time{}, 0, fmt.Errorf("Invalid dead letter value: %q", line)
+	}
+	var ident serde.Ident
+	if err := json.Unmarshal([]byte(data), &ident); err != nil || ident["name"] == "" {
+		return nil, time.Time{}, 0, fmt.Errorf("Invalid dead letter ident: %q", line)
+	}
+	return ident, time.Unix(sec, 0), v, nil
+}
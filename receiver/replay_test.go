@@ -0,0 +1,75 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_replay_parseDeadLetterDP(t *testing.T) {
+	dl := &DeadLetter{Time: time.Now(), Reason: DeadNoSpec, Data: serde.Ident{"name": "foo bar", "host": "a"}.String() + " 1000 1.5"}
+	ident, ts, v, err := parseDeadLetterDP(dl.String())
+	if err != nil || ident["name"] != "foo bar" || ident["host"] != "a" || ts.Unix() != 1000 || v != 1.5 {
+		t.Errorf("parseDeadLetterDP: %v %v %v %v", ident, ts, v, err)
+	}
+
+	for _, line := range []string{
+		"",
+		"2017-01-01T00:00:00Z no_spec",
+		`2017-01-01T00:00:00Z no_spec {"name": "foo"} 1000`,
+		`2017-01-01T00:00:00Z no_spec {"name": "foo"} x 1`,
+		`2017-01-01T00:00:00Z no_spec {"name": "foo"} 1000 x`,
+		`2017-01-01T00:00:00Z no_spec {"nam 1000 1`,
+		`2017-01-01T00:00:00Z nan {"name": "foo"} 1000 NaN`,
+		`2017-01-01T00:00:00Z parse foo 1 1000`,
+	} {
+		if _, _, _, err := parseDeadLetterDP(line); err == nil {
+			t.Errorf("parseDeadLetterDP(%q): no error", line)
+		}
+	}
+}
+
+func Test_replay_ReplayDeadLetters(t *testing.T) {
+	ch := make(chan interface{}, 10)
+	r := &Receiver{dpChIn: ch, dpChOut: ch}
+
+	input := strings.Join([]string{
+		`2017-01-01T00:00:00Z no_spec {"name": "foo"} 1000 1`,
+		`2017-01-01T00:00:00Z parse garbage`,
+		`2017-01-01T00:00:00Z create_limit {"name": "bar"} 1010 2`,
+	}, "\n")
+
+	start := time.Now()
+	queued, skipped, err := r.ReplayDeadLetters(strings.NewReader(input), 20)
+	if queued != 2 || skipped != 1 || err != nil {
+		t.Errorf("ReplayDeadLetters: %d queued, %d skipped, %v", queued, skipped, err)
+	}
+	if time.Now().Sub(start) < 100*time.Millisecond {
+		t.Errorf("ReplayDeadLetters: rate not applied")
+	}
+	if dp := (<-ch).(*incomingDP); dp.cachedIdent.Ident["name"] != "foo" || dp.timeStamp.Unix() != 1000 || dp.value != 1 {
+		t.Errorf("ReplayDeadLetters: wrong data point queued: %v", dp)
+	}
+	// a stopped receiver stops the replay
+	r.stopped = true
+	if queued, _, err := r.ReplayDeadLetters(strings.NewReader(input), 0); queued != 0 || err == nil {
+		t.Errorf("ReplayDeadLetters: a stopped receiver should stop the replay with an error: %d %v", queued, err)
+	}
+}
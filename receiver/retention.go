@@ -0,0 +1,130 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// How often DSs past their retention are looked for.
+var retentionCheckInterval = time.Hour
+
+// retention is how long DSs are kept without being updated, see
+// Receiver.Retention.
+type retention struct {
+	dft      time.Duration
+	byPrefix map[string]time.Duration
+	dryRun   bool
+}
+
+// newRetention returns the retention, or nil if DSs are kept
+// forever.
+func newRetention(dft time.Duration, byPrefix map[string]time.Duration, dryRun bool) *retention {
+	rt := &retention{dft: dft, byPrefix: byPrefix, dryRun: dryRun}
+	if rt.shortest() == 0 {
+		return nil
+	}
+	return rt
+}
+
+// of returns the retention of a name, that of the longest matching
+// prefix, if any. Zero is forever.
+func (rt *retention) of(name string) time.Duration {
+	result, longest := rt.dft, -1
+	for prefix, r := range rt.byPrefix {
+		if strings.HasPrefix(name, prefix) && len(prefix) > longest {
+			result, longest = r, len(prefix)
+		}
+	}
+	return result
+}
+
+// shortest returns the shortest retention other than forever, zero
+// if there is none.
+func (rt *retention) shortest() time.Duration {
+	result := rt.dft
+	for _, r := range rt.byPrefix {
+		if r > 0 && (result == 0 || r < result) {
+			result = r
+		}
+	}
+	return result
+}
+
+// runRetention purges DSs past their retention every
+// retentionCheckInterval.
+func runRetention(p serde.DataSourcePurger, dsc *dsCache, rt *retention, sr statReporter) {
+	for {
+		purgeStale(p, dsc, rt, sr, time.Now())
+		time.Sleep(retentionCheckInterval)
+	}
+}
+
+// purgeStale deletes the DSs which have not been updated for longer
+// than their retention, or in a dry run only logs them, and returns
+// how many there were. A DS in the cache may have been updated since
+// it was last flushed, it is only deleted if it has not been. The
+// DSs are counted as receiver.retention.purged (or .dry_run).
+func purgeStale(p serde.DataSourcePurger, dsc *dsCache, rt *retention, sr statReporter, now time.Time) int {
+	stale, err := p.FetchStaleDataSources(now.Add(-rt.shortest()))
+	if err != nil {
+		log.Printf("purgeStale(): %v", err)
+		sr.reportStatCount("receiver.retention.errors", 1)
+		return 0
+	}
+
+	purged := 0
+	for _, sds := range stale {
+		r := rt.of(sds.Ident["name"])
+		if r == 0 || now.Sub(sds.LastUpdate) < r {
+			continue
+		}
+		if cds := dsc.getByIdent(newCachedIdent(sds.Ident)); cds != nil {
+			cds.mu.Lock()
+			recent := cds.Id() == 0 || now.Sub(cds.LastUpdate()) < r // 0 is being loaded
+			cds.mu.Unlock()
+			if recent {
+				continue
+			}
+		}
+		if rt.dryRun {
+			log.Printf("purgeStale(): (dry run) would delete %v, last updated %v.", sds.Ident, sds.LastUpdate)
+			purged++
+			continue
+		}
+		if err := p.DeleteDataSource(sds.Id); err != nil {
+			log.Printf("purgeStale(): error deleting %v: %v", sds.Ident, err)
+			sr.reportStatCount("receiver.retention.errors", 1)
+			continue
+		}
+		dsc.delete(sds.Ident)
+		purged++
+	}
+
+	if rt.dryRun {
+		sr.reportStatCount("receiver.retention.dry_run", float64(purged))
+	} else {
+		sr.reportStatCount("receiver.retention.purged", float64(purged))
+	}
+	if purged > 0 {
+		log.Printf("purgeStale(): %d DSs past their retention (dry run: %v).", purged, rt.dryRun)
+	}
+	return purged
+}
@@ -0,0 +1,80 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+type fakePurger struct {
+	stale   []serde.StaleDataSource
+	deleted []int64
+}
+
+func (p *fakePurger) FetchStaleDataSources(before time.Time) ([]serde.StaleDataSource, error) {
+	var result []serde.StaleDataSource
+	for _, sds := range p.stale {
+		if sds.LastUpdate.Before(before) {
+			result = append(result, sds)
+		}
+	}
+	return result, nil
+}
+
+func (p *fakePurger) DeleteDataSource(id int64) error {
+	p.deleted = append(p.deleted, id)
+	return nil
+}
+
+func Test_retention_of(t *testing.T) {
+	rt := newRetention(30*24*time.Hour, map[string]time.Duration{"tmp.": time.Hour, "tmp.keep.": 0}, false)
+	if rt.of("foo") != 30*24*time.Hour || rt.of("tmp.x") != time.Hour || rt.of("tmp.keep.x") != 0 || rt.shortest() != time.Hour {
+		t.Errorf("retention: unexpected %v %v %v %v", rt.of("foo"), rt.of("tmp.x"), rt.of("tmp.keep.x"), rt.shortest())
+	}
+	if newRetention(0, map[string]time.Duration{"foo": 0}, false) != nil {
+		t.Errorf("newRetention: expected nil when everything is kept forever")
+	}
+}
+
+func Test_purgeStale(t *testing.T) {
+	now := time.Now()
+	p := &fakePurger{stale: []serde.StaleDataSource{
+		{Id: 1, Ident: serde.Ident{"name": "tmp.a"}, LastUpdate: now.Add(-2 * time.Hour)},
+		{Id: 2, Ident: serde.Ident{"name": "b"}, LastUpdate: now.Add(-2 * time.Hour)}, // within 1d
+		{Id: 3, Ident: serde.Ident{"name": "c"}, LastUpdate: now.Add(-48 * time.Hour)},
+		{Id: 4, Ident: serde.Ident{"name": "tmp.d"}, LastUpdate: now.Add(-2 * time.Hour)}, // cached, recent
+		{Id: 5, Ident: serde.Ident{"name": "tmp.keep.e"}, LastUpdate: now.Add(-48 * time.Hour)},
+	}}
+	dsc := newDsCache(nil, nil, nil)
+	spec := *DftDSSPec
+	spec.LastUpdate = now.Add(-time.Minute)
+	dsc.insert(&cachedDs{DbDataSourcer: serde.NewDbDataSource(4, serde.Ident{"name": "tmp.d"}, 0, 0, rrd.NewDataSource(spec)), mu: &sync.Mutex{}})
+	rt := newRetention(24*time.Hour, map[string]time.Duration{"tmp.": time.Hour, "tmp.keep.": 0}, true)
+
+	sr := make(recordingSr)
+	if n := purgeStale(p, dsc, rt, sr, now); n != 2 || len(p.deleted) != 0 || sr["receiver.retention.dry_run"] != 2 {
+		t.Errorf("purgeStale: (dry run) expected 2 and nothing deleted, got %d %v %v", n, p.deleted, sr)
+	}
+	rt.dryRun = false
+	if n := purgeStale(p, dsc, rt, sr, now); n != 2 || len(p.deleted) != 2 || p.deleted[0] != 1 || p.deleted[1] != 3 {
+		t.Errorf("purgeStale: expected 1 and 3 deleted, got %d %v", n, p.deleted)
+	}
+}
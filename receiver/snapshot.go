@@ -0,0 +1,163 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// MaxSnapshotHold is the longest Snapshot keeps the writes quiesced.
+// Along with snapshotDrainTimeout it is well within the write timeout
+// of the HTTP server, which responds once the writes resume.
+const MaxSnapshotHold = 15 * time.Second
+
+// How long Snapshot waits for the flush queue to empty.
+var snapshotDrainTimeout = 10 * time.Second
+
+type flushQuiescer interface {
+	quiesce(timeout time.Duration) (resume func(), err error)
+}
+
+// Snapshot coordinates a consistent snapshot of the database, e.g. for
+// a backup: the cached DSs are flushed, once the flush queue is empty
+// the database writes are quiesced, the marker of where the database
+// is (see serde.Snapshotter, otherwise it is only the time) is
+// recorded, and after hold (at most MaxSnapshotHold, e.g. for a
+// filesystem snapshot to be taken) the writes resume. Data points
+// keep being received and cached meanwhile.
+func (r *Receiver) Snapshot(hold time.Duration) (*serde.SnapshotMarker, error) {
+	q, ok := r.flusher.(flushQuiescer)
+	if !ok {
+		return nil, fmt.Errorf("snapshots are not supported by this flusher")
+	}
+	if hold > MaxSnapshotHold {
+		hold = MaxSnapshotHold
+	}
+
+	flushDSCache(r.dsc, time.Time{})
+	resume, err := q.quiesce(snapshotDrainTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Snapshot(): %v", err)
+	}
+	defer resume()
+
+	marker := &serde.SnapshotMarker{Time: time.Now()}
+	if s, ok := r.serde.(serde.Snapshotter); ok {
+		if marker, err = s.SnapshotMarker(); err != nil {
+			return nil, fmt.Errorf("Snapshot(): %v", err)
+		}
+	}
+	log.Printf("Snapshot(): writes quiesced at %v, resuming in %v.", marker, hold)
+	time.Sleep(hold)
+	r.reportStatCount("receiver.snapshots", 1)
+	return marker, nil
+}
+
+// quiesce flushes the whole vcache, waits for the flush queue to
+// empty and then for the flushes in progress, and holds off any more
+// until resume is called.
+func (f *dsFlusher) quiesce(timeout time.Duration) (func(), error) {
+	if f.vcache == nil {
+		return nil, fmt.Errorf("the flushers are not running")
+	}
+	f.vcache.flush(f.dbCh, true)
+	deadline := time.Now().Add(timeout)
+	for f.pending() > 0 {
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("the flush queue did not empty in %v", timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	f.quiesced.Lock()
+	return f.quiesced.Unlock, nil
+}
+
+// quiescedFlusher is the serde.Flusher of the db flushers, whose
+// every write holds the read lock of mu, so that a snapshot can hold
+// them off.
+type quiescedFlusher struct {
+	serde.Flusher
+	mu *sync.RWMutex
+}
+
+// quiescedBatchFlusher holds the read lock from the beginning of a
+// batch until it is committed or rolled back.
+type quiescedBatchFlusher struct {
+	*quiescedFlusher
+	bf serde.BatchFlusher
+}
+
+type quiescedFlushBatch struct {
+	serde.FlushBatch
+	once sync.Once
+	mu   *sync.RWMutex
+}
+
+// newQuiescedFlusher returns db as a quiescedFlusher, which is a
+// serde.BatchFlusher if db is one.
+func newQuiescedFlusher(db serde.Flusher, mu *sync.RWMutex) serde.Flusher {
+	if db == nil {
+		return nil
+	}
+	qf := &quiescedFlusher{Flusher: db, mu: mu}
+	if bf, ok := db.(serde.BatchFlusher); ok {
+		return &quiescedBatchFlusher{quiescedFlusher: qf, bf: bf}
+	}
+	return qf
+}
+
+func (q *quiescedFlusher) FlushDataPoints(bundleId, seg, i int64, dps, vers map[int64]interface{}) (int, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.Flusher.FlushDataPoints(bundleId, seg, i, dps, vers)
+}
+
+func (q *quiescedFlusher) FlushDSStates(seg int64, lastupdate, value, duration, lastRaw map[int64]interface{}) (int, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.Flusher.FlushDSStates(seg, lastupdate, value, duration, lastRaw)
+}
+
+func (q *quiescedFlusher) FlushRRAStates(bundleId, seg int64, latests, value, duration map[int64]interface{}) (int, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.Flusher.FlushRRAStates(bundleId, seg, latests, value, duration)
+}
+
+func (q *quiescedBatchFlusher) BeginFlushBatch() (serde.FlushBatch, error) {
+	q.mu.RLock()
+	fb, err := q.bf.BeginFlushBatch()
+	if err != nil {
+		q.mu.RUnlock()
+		return nil, err
+	}
+	return &quiescedFlushBatch{FlushBatch: fb, mu: q.mu}, nil
+}
+
+func (b *quiescedFlushBatch) Commit() error {
+	defer b.once.Do(b.mu.RUnlock)
+	return b.FlushBatch.Commit()
+}
+
+func (b *quiescedFlushBatch) Rollback() error {
+	defer b.once.Do(b.mu.RUnlock)
+	return b.FlushBatch.Rollback()
+}
@@ -0,0 +1,102 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_Receiver_Snapshot(t *testing.T) {
+	db := serde.NewMemSerDe()
+
+	// a flusher that cannot quiesce
+	r := &Receiver{flusher: &fakeDsFlusher{}, dsc: newDsCache(db, nil, nil)}
+	if _, err := r.Snapshot(0); err == nil {
+		t.Errorf("Snapshot: expected an error")
+	}
+
+	f := &dsFlusher{db: &fakeDsFlusher{}, dbCh: make(chan *vDpFlushRequest, 1)}
+	r = &Receiver{flusher: f, dsc: newDsCache(db, nil, f)}
+	if _, err := r.Snapshot(0); err == nil {
+		t.Errorf("Snapshot: expected an error when the flushers are not running")
+	}
+
+	f.vcache = &verticalCache{
+		Mutex:   &sync.Mutex{},
+		dps:     make(map[bundleKey]*verticalCacheSegment),
+		dss:     make(map[int64]*dsStateSegment),
+		minStep: time.Second,
+	}
+
+	// the queue does not empty
+	save := snapshotDrainTimeout
+	defer func() { snapshotDrainTimeout = save }()
+	snapshotDrainTimeout = 50 * time.Millisecond
+	f.dbCh <- &vDpFlushRequest{}
+	if _, err := r.Snapshot(0); err == nil {
+		t.Errorf("Snapshot: expected an error when the queue does not empty")
+	}
+	<-f.dbCh
+
+	before := time.Now()
+	marker, err := r.Snapshot(10 * time.Millisecond)
+	if err != nil || marker == nil || marker.Time.Before(before) {
+		t.Errorf("Snapshot: expected a marker, got %v %v", marker, err)
+	}
+	if time.Now().Sub(before) < 10*time.Millisecond {
+		t.Errorf("Snapshot: expected the writes to be held")
+	}
+}
+
+func Test_quiescedFlusher(t *testing.T) {
+	f := &dsFlusher{db: &fakeDsFlusher{}, dbCh: make(chan *vDpFlushRequest, 1), vcache: &verticalCache{
+		Mutex: &sync.Mutex{},
+		dps:   make(map[bundleKey]*verticalCacheSegment),
+		dss:   make(map[int64]*dsStateSegment),
+	}}
+	qdb := newQuiescedFlusher(f.db, &f.quiesced)
+	if _, ok := qdb.(serde.BatchFlusher); ok {
+		t.Errorf("newQuiescedFlusher: expected no BatchFlusher of a db which is not one")
+	}
+	if newQuiescedFlusher(nil, &f.quiesced) != nil {
+		t.Errorf("newQuiescedFlusher: expected nil of nil")
+	}
+
+	resume, err := f.quiesce(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		qdb.FlushDSStates(0, nil, nil, nil, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Errorf("quiesce: expected the flush to be held off")
+	case <-time.After(50 * time.Millisecond):
+	}
+	resume()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("quiesce: expected the flush to resume")
+	}
+}
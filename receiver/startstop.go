@@ -21,6 +21,7 @@ import (
 	"time"
 
 	"github.com/tgres/tgres/aggregator"
+	"github.com/tgres/tgres/serde"
 )
 
 type wrkCtl struct {
@@ -47,6 +48,46 @@ var startAllWorkers = func(r *Receiver, startWg *sync.WaitGroup) {
 }
 
 var doStart = func(r *Receiver) {
+	if r.BackfillWindow > 0 {
+		log.Printf("Receiver: accepting out of order data points up to %v behind (backfill window).", r.BackfillWindow)
+	}
+	r.dsc.backfill = r.BackfillWindow
+	if r.DuplicatePolicy != DuplicateKeepLast {
+		log.Printf("Receiver: data points with duplicate time stamps are combined using the %v policy.", r.DuplicatePolicy)
+	}
+	r.dsc.dups = r.DuplicatePolicy
+	r.dsc.limiter = newDsCreateLimiter(r.NewDSInterval, r.MaxNewDSs, r.MaxNewDSsByPrefix)
+	r.dsc.breaker = newDsCreateBreaker(r.CreateBreakerMaxSeries, r.CreateBreakerMaxRate, r.CreateBreakerInterval, r.CreateBreakerCooldown)
+	if r.dsc.breaker != nil {
+		log.Printf("Receiver: DS creation breaker: max series: %d, max new DSs: %d per %v, cooldown: %v.",
+			r.dsc.breaker.maxSeries, r.dsc.breaker.maxRate, r.dsc.breaker.interval, r.dsc.breaker.cooldown)
+	}
+	r.dsc.loadRetries, r.dsc.loadBreakerThreshold = r.LoadRetries, r.DBBreakerThreshold
+	r.dsc.maxMem, r.dsc.minIdle = r.DSCacheMaxMemory, r.DSCacheMinIdle
+	if r.dsc.maxMem > 0 {
+		if r.dsc.minIdle <= 0 {
+			r.dsc.minIdle = 10 * time.Minute
+		}
+		log.Printf("Receiver: DS cache memory budget is %d bytes, DSs idle for %v may be evicted.", r.dsc.maxMem, r.dsc.minIdle)
+	}
+	if r.quota = newListenerQuota(r.ListenerQuotas, r.ListenerSourceQuota, r.QuotaPolicy); r.quota != nil {
+		log.Printf("Receiver: listener quotas: %v, per source: %d, policy: %v.", r.ListenerQuotas, r.ListenerSourceQuota, r.QuotaPolicy)
+	}
+	spool := newFwdSpool(r.ForwardSpoolDir, r.ForwardSpoolMaxSize, r.ForwardSpoolMaxAge)
+	if r.dsc.fwdRetry = newForwardRetrier(r.ForwardRetrySize, spool); r.dsc.fwdRetry != nil {
+		log.Printf("Receiver: up to %d data points per node will be buffered when a node is not ready (spool: %q).", r.ForwardRetrySize, r.ForwardSpoolDir)
+	}
+	r.dsc.staleAfter, r.dsc.archive = r.DSStaleAfter, r.DSArchiveStale
+	if r.dsc.staleAfter > 0 {
+		log.Printf("Receiver: DSs receiving no data for %v will be unloaded (archive: %v).", r.dsc.staleAfter, r.dsc.archive)
+	}
+	if dl, err := newDeadLetterWriter(r.DeadLetterFile, r.DeadLetterMaxSize, r.DeadLetterCh); err != nil {
+		log.Printf("Receiver: error opening dead letter file, dead letters disabled: %v", err)
+	} else if dl != nil {
+		r.dsc.deadLetter = dl
+		log.Printf("Receiver: dropped data points will be recorded as dead letters (file: %q).", r.DeadLetterFile)
+	}
+
 	log.Printf("Receiver: Caching data source definitions...")
 	start := time.Now()
 	if err := r.dsc.preLoad(); err != nil {
@@ -64,14 +105,42 @@ var doStart = func(r *Receiver) {
 	startWg.Wait()
 	log.Printf("Receiver: All workers running, starting director.")
 
+	if r.queue != nil {
+		log.Printf("Receiver: queue size limit: %d, overflow policy: %v", r.MaxReceiverQueueSize, r.QueueOverflowPolicy)
+		r.queue.setLimits(r.MaxReceiverQueueSize, r.QueueOverflowPolicy)
+	}
+
+	if r.rewriter = newDpRewriter(r.Rewrites); r.rewriter != nil {
+		go reportRewriteCounts(r.rewriter, r, time.Second)
+	}
+	if r.preAgg = newPreAggregator(r.PreAggregates); r.preAgg != nil {
+		go runPreAggregator(r.preAgg, r, time.Second)
+	}
+
 	startWg.Add(1)
 	go director(&wrkCtl{wg: &r.directorWg, startWg: &startWg, id: "director"}, r.dpChIn,
-		r.dpChOut, r.NWorkers, r.cluster, r, r.dsc, r.flusher, r.queue,
-		r.MaxReceiverQueueSize, r.MaxMemoryBytes)
+		r.dpChOut, r.NWorkers, r.cluster, r, r.dsc, r.flusher, r.queue, r.MaxMemoryBytes, r.MaxHops, r.MaxForwards,
+		newDpFilter(r.Whitelist, r.Blacklist))
 	startWg.Wait()
 
 	log.Printf("Receiver: Starting runtime cpu/mem reporter.")
 	go reportRuntime(r)
+	go reportListenerCounts(r.listeners, r, time.Second)
+	if r.quota != nil {
+		go reportListenerQuota(r.quota, r, time.Second)
+	}
+	if rt := newRetention(r.Retention, r.RetentionByPrefix, r.RetentionDryRun); rt != nil {
+		if p, ok := r.dsc.db.(serde.DataSourcePurger); ok {
+			log.Printf("Receiver: DSs not updated for %v are deleted, by prefix: %v (dry run: %v).", r.Retention, r.RetentionByPrefix, r.RetentionDryRun)
+			go runRetention(p, r.dsc, rt, r)
+		} else {
+			log.Printf("Receiver: WARNING: the database does not support deleting DSs, retention ignored.")
+		}
+	}
+	if m, ok := r.serde.(serde.Maintainer); ok && r.DbMaintenanceInterval > 0 {
+		log.Printf("Receiver: maintaining the database every %v.", r.DbMaintenanceInterval)
+		go runMaintenance(m, r, r.DbMaintenanceInterval)
+	}
 
 	log.Printf("Receiver: Ready.")
 }
@@ -84,23 +153,126 @@ var stopDirector = func(r *Receiver) {
 }
 
 var doStop = func(r *Receiver, clstr clusterer) {
+	var deadline time.Time
+	if r.ShutdownTimeout > 0 {
+		deadline = time.Now().Add(r.ShutdownTimeout)
+		log.Printf("Receiver: stopping, deadline %v.", r.ShutdownTimeout)
+	}
+
 	// Order matters here
 	stopPacedMetricWorker(r.pacedMetricCh, &r.pacedMetricWg)
 	stopAggWorker(r.aggCh, &r.aggWg)
+	flushPreAggregates(r)
 	stopDirector(r)
-	stopFlushers(r.flusher, &r.flusherWg)
-	log.Printf("Leaving cluster...")
-	clstr.Leave(1 * time.Second)
-	clstr.Shutdown()
-	log.Printf("Left cluster.")
+	flushDSCache(r.dsc, deadline)
+	stopFlushers(r.flusher, &r.flusherWg, deadline)
+	if clstr != nil {
+		log.Printf("Leaving cluster...")
+		clstr.Leave(1 * time.Second)
+		clstr.Shutdown()
+		log.Printf("Left cluster.")
+	}
+}
+
+// flushPreAggregates queues whatever the pre-aggregation rules have
+// accumulated, including the intervals that are not over yet. The
+// receiver is already stopped at this point, the points go straight
+// to the director.
+var flushPreAggregates = func(r *Receiver) {
+	r.preAgg.flush(time.Time{}, func(name string, ts time.Time, v float64) {
+		dp := newIncomingDP()
+		dp.cachedIdent = newCachedIdent(applyNameTemplates(r.NameTemplates, serde.Ident{"name": name}))
+		dp.timeStamp, dp.value, dp.arrived = ts, v, time.Now()
+		r.dpChIn <- dp
+	})
+}
+
+// flushDSCache moves whatever data cached DSs have not flushed yet
+// to the vcache, so that the final vcache flush can write it to the
+// database. If the deadline (unless zero) is reached, the DSs not yet
+// flushed are logged and their data is lost.
+var flushDSCache = func(dsc *dsCache, deadline time.Time) {
+	dsc.RLock()
+	all := make([]*cachedDs, 0, len(dsc.byIdent))
+	for _, cds := range dsc.byIdent {
+		all = append(all, cds)
+	}
+	dsc.RUnlock()
+
+	log.Printf("flushDSCache(): flushing %d cached DSs...", len(all))
+	flushed, lastLog := 0, time.Now()
+	for i, cds := range all {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			logUnflushedDSs(all[i:])
+			return
+		}
+
+		cds.mu.Lock()
+		if cds.Id() != 0 && (cds.PointCount() > 0 || cds.lastFlush.Before(cds.lastProcess)) {
+			dsc.dsf.flushToVCache(cds.DbDataSourcer)
+			cds.lastFlush = time.Now()
+			flushed++
+		}
+		cds.mu.Unlock()
+
+		if time.Now().Sub(lastLog) >= time.Second {
+			log.Printf("flushDSCache(): %d of %d DSs checked, %d flushed.", i+1, len(all), flushed)
+			lastLog = time.Now()
+		}
+	}
+	log.Printf("flushDSCache(): done, %d DSs flushed.", flushed)
 }
 
-var stopFlushers = func(flusher dsFlusherBlocking, flusherWg *sync.WaitGroup) {
+// logUnflushedDSs logs the DSs whose unflushed data is lost because
+// of the shutdown deadline. Only the first few are logged by name.
+func logUnflushedDSs(cdss []*cachedDs) {
+	const maxNames = 10
+	var names []string
+	lost := 0
+	for _, cds := range cdss {
+		cds.mu.Lock()
+		if cds.Id() != 0 && (cds.PointCount() > 0 || cds.lastFlush.Before(cds.lastProcess)) {
+			if lost < maxNames {
+				names = append(names, cds.Ident().String())
+			}
+			lost++
+		}
+		cds.mu.Unlock()
+	}
+	if lost > 0 {
+		log.Printf("flushDSCache(): shutdown deadline reached, data of %d DSs was not flushed (first %d: %v).", lost, len(names), names)
+	}
+}
+
+var stopFlushers = func(flusher dsFlusherBlocking, flusherWg *sync.WaitGroup, deadline time.Time) {
 	log.Printf("stopFlushers(): stopping flusher(s)...")
 	flusher.stop()
 	log.Printf("stopFlushers(): waiting for flushers to finish...")
-	flusherWg.Wait()
-	log.Printf("stopFlushers(): all flushers finished.")
+
+	done := make(chan bool)
+	go func() {
+		flusherWg.Wait()
+		close(done)
+	}()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timeout = time.After(deadline.Sub(time.Now()))
+	}
+	progress := time.NewTicker(time.Second)
+	defer progress.Stop()
+	for {
+		select {
+		case <-done:
+			log.Printf("stopFlushers(): all flushers finished.")
+			return
+		case <-progress.C:
+			log.Printf("stopFlushers(): %d flush requests pending...", flusher.pending())
+		case <-timeout:
+			log.Printf("stopFlushers(): shutdown deadline reached, %d flush requests were not written to the database.", flusher.pending())
+			return
+		}
+	}
 }
 
 var stopAggWorker = func(aggCh chan *aggregator.Command, aggWg *sync.WaitGroup) {
@@ -126,7 +298,11 @@ var startFlushers = func(r *Receiver, startWg *sync.WaitGroup) {
 	// }
 
 	log.Printf("Starting flusher(s)...")
-	r.flusher.start(&r.flusherWg, startWg, r.MinStep, r.NWorkers*2)
+	n := r.FlushWorkers
+	if n <= 0 {
+		n = r.NWorkers * 2
+	}
+	r.flusher.start(&r.flusherWg, startWg, r.MinStep, n, r.FlushBatchSize, r.FlushBatchDelay, newFlushPacer(r.FlushTargetLatency, r.FlushMaxStretch), r.FlushSharding)
 }
 
 var startAggWorker = func(r *Receiver, startWg *sync.WaitGroup) {
@@ -21,6 +21,8 @@ import (
 	"time"
 
 	"github.com/tgres/tgres/aggregator"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
 )
 
 func Test_startstop_wrkCtl(t *testing.T) {
@@ -62,7 +64,7 @@ func Test_startstop_doStart(t *testing.T) {
 	called := 0
 	stopped := false
 	director = func(wc wController, dpChIn chan<- interface{}, dpChOut <-chan interface{}, nWorkers int, clstr clusterer, sr statReporter, dsc *dsCache,
-		dsf dsFlusherBlocking, queue *fifoQueue, maxQLen int, maxMem uint64) {
+		dsf dsFlusherBlocking, queue *fifoQueue, maxMem uint64, maxHops, maxForwards int, filter *dpFilter) {
 		wc.onEnter()
 		defer wc.onExit()
 		called++
@@ -103,12 +105,13 @@ func Test_startstop_doStart(t *testing.T) {
 }
 
 func Test_startstop_Receiver_doStop(t *testing.T) {
-	f1, f2, f3, f4 := stopPacedMetricWorker, stopAggWorker, stopDirector, stopFlushers
+	f1, f2, f3, f4, f5 := stopPacedMetricWorker, stopAggWorker, stopDirector, stopFlushers, flushDSCache
 	called := 0
 	stopPacedMetricWorker = func(_ chan *pacedMetric, _ *sync.WaitGroup) { called++ }
 	stopAggWorker = func(_ chan *aggregator.Command, _ *sync.WaitGroup) { called++ }
 	stopDirector = func(_ *Receiver) { called++ }
-	stopFlushers = func(_ dsFlusherBlocking, _ *sync.WaitGroup) { called++ }
+	stopFlushers = func(_ dsFlusherBlocking, _ *sync.WaitGroup, _ time.Time) { called++ }
+	flushDSCache = func(_ *dsCache, _ time.Time) { called++ }
 	r := &Receiver{}
 	c := &fakeCluster{}
 	doStop(r, c)
@@ -118,7 +121,7 @@ func Test_startstop_Receiver_doStop(t *testing.T) {
 	if c.nShutdown != 2 {
 		t.Errorf("doStop: never called cluster.Shutdown, or not second: %d", c.nShutdown)
 	}
-	stopPacedMetricWorker, stopAggWorker, stopDirector, stopFlushers = f1, f2, f3, f4
+	stopPacedMetricWorker, stopAggWorker, stopDirector, stopFlushers, flushDSCache = f1, f2, f3, f4, f5
 }
 
 func Test_startstop_stopPacedMetricWorker(t *testing.T) {
@@ -220,3 +223,51 @@ func Test_startstop_startPacedMetricWorker(t *testing.T) {
 	}
 	pacedMetricWorker = savePMW
 }
+
+func Test_startstop_flushDSCache(t *testing.T) {
+	dsf := &fakeDsFlusher{}
+	d := newDsCache(nil, nil, dsf)
+
+	mkCds := func(id int64, name string, unflushed bool) {
+		ds := serde.NewDbDataSource(id, serde.Ident{"name": name}, 0, 0, rrd.NewDataSource(*DftDSSPec))
+		cds := &cachedDs{DbDataSourcer: ds, mu: &sync.Mutex{}, lastProcess: time.Now(), lastFlush: time.Now()}
+		if unflushed {
+			cds.lastFlush = cds.lastProcess.Add(-time.Second)
+		}
+		d.insert(cds)
+	}
+	mkCds(1, "flushed", false)
+	mkCds(2, "unflushed", true)
+	mkCds(0, "notloaded", true)
+
+	flushDSCache(d, time.Time{})
+	if dsf.vcached != 1 {
+		t.Errorf("flushDSCache: expected 1 DS flushed, got %d", dsf.vcached)
+	}
+
+	// past deadline, nothing gets flushed
+	dsf.vcached = 0
+	mkCds(3, "unflushed2", true)
+	flushDSCache(d, time.Now().Add(-time.Second))
+	if dsf.vcached != 0 {
+		t.Errorf("flushDSCache: nothing should be flushed past the deadline: %d", dsf.vcached)
+	}
+}
+
+type slowDsFlusher struct {
+	fakeDsFlusher
+}
+
+func (f *slowDsFlusher) pending() int { return 42 }
+
+func Test_startstop_stopFlushers_deadline(t *testing.T) {
+	var wg sync.WaitGroup
+	wg.Add(1) // never done
+	start := time.Now()
+	stopFlushers(&slowDsFlusher{}, &wg, time.Now().Add(50*time.Millisecond))
+	if time.Now().Sub(start) > time.Second {
+		t.Errorf("stopFlushers: deadline not respected")
+	}
+	wg.Done()
+	stopFlushers(&slowDsFlusher{}, &wg, time.Time{})
+}
@@ -0,0 +1,110 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimestampPolicy determines what a listener does with the time
+// stamps of the points it receives, see ListenerTime.
+type TimestampPolicy int
+
+const (
+	// Keep the time stamp of the sender. This is the default.
+	TimestampSender TimestampPolicy = iota
+	// Replace it with the time of arrival, for senders whose clocks
+	// cannot be trusted at all.
+	TimestampArrival
+	// Drop the points with time stamps further than MaxSkew from
+	// the time of arrival.
+	TimestampReject
+	// Move such time stamps to MaxSkew of the time of arrival.
+	TimestampClamp
+)
+
+func (p TimestampPolicy) String() string {
+	switch p {
+	case TimestampSender:
+		return "sender"
+	case TimestampArrival:
+		return "arrival"
+	case TimestampReject:
+		return "reject"
+	case TimestampClamp:
+		return "clamp"
+	}
+	return fmt.Sprintf("TimestampPolicy(%d)", int(p))
+}
+
+// ParseTimestampPolicy converts "sender", "arrival", "reject" or
+// "clamp" into a TimestampPolicy.
+func ParseTimestampPolicy(s string) (TimestampPolicy, error) {
+	switch strings.ToLower(s) {
+	case "sender":
+		return TimestampSender, nil
+	case "arrival":
+		return TimestampArrival, nil
+	case "reject":
+		return TimestampReject, nil
+	case "clamp":
+		return TimestampClamp, nil
+	}
+	return TimestampSender, fmt.Errorf("invalid timestamp policy %q (must be sender, arrival, reject or clamp)", s)
+}
+
+// ListenerTimestamps is the TimestampPolicy of a listener and, for
+// TimestampReject and TimestampClamp, how far (either way) a time
+// stamp may be from the time of arrival.
+type ListenerTimestamps struct {
+	Policy  TimestampPolicy
+	MaxSkew time.Duration
+}
+
+// ListenerTime returns the time stamp of a point received by a
+// listener as per its ListenerTimestamps, and false if the point is
+// to be dropped. It is for the listeners to call before queueing.
+// Rejected and clamped time stamps are counted as
+// receiver.listener.<listener>.timestamps_rejected and
+// timestamps_clamped.
+func (r *Receiver) ListenerTime(listener string, ts time.Time) (time.Time, bool) {
+	lt, ok := r.ListenerTimestamps[listener]
+	if !ok || lt.Policy == TimestampSender {
+		return ts, true
+	}
+	now := time.Now()
+	if lt.Policy == TimestampArrival {
+		return now, true
+	}
+	if lt.MaxSkew <= 0 {
+		return ts, true
+	}
+	early, late := now.Add(-lt.MaxSkew), now.Add(lt.MaxSkew)
+	if !ts.Before(early) && !ts.After(late) {
+		return ts, true
+	}
+	if lt.Policy == TimestampReject {
+		r.CountListenerEvent(listener, "timestamps_rejected")
+		return ts, false
+	}
+	r.CountListenerEvent(listener, "timestamps_clamped")
+	if ts.Before(early) {
+		return early, true
+	}
+	return late, true
+}
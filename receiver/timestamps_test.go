@@ -0,0 +1,62 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_ParseTimestampPolicy(t *testing.T) {
+	for _, p := range []TimestampPolicy{TimestampSender, TimestampArrival, TimestampReject, TimestampClamp} {
+		if pp, err := ParseTimestampPolicy(p.String()); err != nil || pp != p {
+			t.Errorf("ParseTimestampPolicy: %v did not round trip: %v %v", p, pp, err)
+		}
+	}
+	if _, err := ParseTimestampPolicy("bogus"); err == nil {
+		t.Errorf("ParseTimestampPolicy: expected an error")
+	}
+}
+
+func TestReceiver_ListenerTime(t *testing.T) {
+	r := New(&fakeSerde{}, nil)
+	r.ListenerTimestamps = map[string]ListenerTimestamps{
+		"graphite_udp": {Policy: TimestampArrival},
+		"collectd_udp": {Policy: TimestampClamp, MaxSkew: time.Minute},
+		"opentsdb_tcp": {Policy: TimestampReject, MaxSkew: time.Minute},
+	}
+	past := time.Now().Add(-time.Hour)
+
+	if ts, ok := r.ListenerTime("graphite_tcp", past); !ok || !ts.Equal(past) {
+		t.Errorf("ListenerTime: a listener without a policy should keep the time stamp: %v %v", ts, ok)
+	}
+	if ts, ok := r.ListenerTime("graphite_udp", past); !ok || time.Since(ts) > time.Second {
+		t.Errorf("ListenerTime: arrival should be now: %v %v", ts, ok)
+	}
+	if ts, ok := r.ListenerTime("collectd_udp", past); !ok || time.Since(ts) < time.Minute-time.Second || time.Since(ts) > time.Minute+time.Second {
+		t.Errorf("ListenerTime: expected a clamp to a minute ago: %v %v", ts, ok)
+	}
+	if ts, ok := r.ListenerTime("collectd_udp", time.Now().Add(time.Hour)); !ok || time.Until(ts) > time.Minute {
+		t.Errorf("ListenerTime: expected a clamp to a minute ahead: %v %v", ts, ok)
+	}
+	if _, ok := r.ListenerTime("opentsdb_tcp", past); ok {
+		t.Errorf("ListenerTime: a time stamp an hour off should be rejected")
+	}
+	recent := time.Now().Add(-time.Second)
+	if ts, ok := r.ListenerTime("opentsdb_tcp", recent); !ok || !ts.Equal(recent) {
+		t.Errorf("ListenerTime: a time stamp within the skew should be kept: %v %v", ts, ok)
+	}
+}
@@ -0,0 +1,90 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"time"
+
+	"github.com/tgres/tgres/cluster"
+)
+
+// A transitionStatuser is a cluster that reports the progress of its
+// transitions, i.e. *cluster.Cluster.
+type transitionStatuser interface {
+	TransitionStatus() cluster.TransitionStatus
+}
+
+type memberLister interface {
+	Members() []*cluster.Node
+}
+
+func reportTransitionStats(ts transitionStatuser, sr statReporter, nap time.Duration) {
+	for {
+		time.Sleep(nap)
+		st := ts.TransitionStatus()
+		running := 0.0
+		if st.Running {
+			running = 1
+		}
+		sr.reportStatGauge("receiver.cluster.transition.running", running)
+		sr.reportStatGauge("receiver.cluster.transition.relinquishing", float64(st.Relinquishing))
+		sr.reportStatGauge("receiver.cluster.transition.relinquished", float64(st.Relinquished))
+		sr.reportStatGauge("receiver.cluster.transition.relinquished_bytes", float64(st.RelinquishedBytes))
+		sr.reportStatGauge("receiver.cluster.transition.acquiring", float64(st.Acquiring))
+		sr.reportStatGauge("receiver.cluster.transition.acquired", float64(st.Acquired))
+		sr.reportStatGauge("receiver.cluster.transition.timed_out", float64(st.TimedOut))
+		sr.reportStatGauge("receiver.cluster.transition.remaining", float64(st.Remaining()))
+	}
+}
+
+// ClusterMember is a node of the cluster as seen by this one.
+type ClusterMember struct {
+	Name  string `json:"name"`
+	Addr  string `json:"addr"`
+	Ready bool   `json:"ready"`
+	Local bool   `json:"local"`
+}
+
+// ClusterStatus is the membership of the cluster and the progress of
+// the current (or the last) rebalancing of its DSs.
+type ClusterStatus struct {
+	Members    []ClusterMember           `json:"members"`
+	Transition *cluster.TransitionStatus `json:"transition,omitempty"`
+}
+
+// ClusterStatus returns the status of the cluster, or nil if the
+// receiver is not clustered.
+func (r *Receiver) ClusterStatus() *ClusterStatus {
+	if r.cluster == nil {
+		return nil
+	}
+	status := &ClusterStatus{Members: []ClusterMember{}}
+	if ml, ok := r.cluster.(memberLister); ok {
+		local := r.cluster.LocalNode()
+		for _, n := range ml.Members() {
+			m := ClusterMember{Name: n.Name(), Ready: n.Ready(), Local: local != nil && n.Name() == local.Name()}
+			if n.Node != nil && n.Addr != nil {
+				m.Addr = n.Addr.String()
+			}
+			status.Members = append(status.Members, m)
+		}
+	}
+	if ts, ok := r.cluster.(transitionStatuser); ok {
+		st := ts.TransitionStatus()
+		status.Transition = &st
+	}
+	return status
+}
@@ -0,0 +1,88 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/tgres/tgres/cluster"
+)
+
+type fakeTransitionCluster struct {
+	fakeCluster
+	members []*cluster.Node
+	status  cluster.TransitionStatus
+}
+
+func (c *fakeTransitionCluster) Members() []*cluster.Node                   { return c.members }
+func (c *fakeTransitionCluster) TransitionStatus() cluster.TransitionStatus { return c.status }
+
+type gaugeSr struct {
+	sync.Mutex
+	gauges map[string]float64
+}
+
+func (sr *gaugeSr) reportStatCount(string, float64) {}
+func (sr *gaugeSr) reportStatGauge(name string, v float64) {
+	sr.Lock()
+	defer sr.Unlock()
+	sr.gauges[name] = v
+}
+
+func Test_reportTransitionStats(t *testing.T) {
+	c := &fakeTransitionCluster{status: cluster.TransitionStatus{Running: true, Relinquishing: 5, Relinquished: 2, Acquiring: 3, Acquired: 1}}
+	sr := &gaugeSr{gauges: make(map[string]float64)}
+	go reportTransitionStats(c, sr, time.Millisecond)
+
+	var remaining, running float64
+	for i := 0; i < 100; i++ {
+		time.Sleep(5 * time.Millisecond)
+		sr.Lock()
+		remaining, running = sr.gauges["receiver.cluster.transition.remaining"], sr.gauges["receiver.cluster.transition.running"]
+		sr.Unlock()
+		if remaining != 0 {
+			break
+		}
+	}
+	if remaining != 5 || running != 1 {
+		t.Errorf("reportTransitionStats: expected 5 remaining and running, got %v %v", remaining, running)
+	}
+}
+
+func TestReceiver_ClusterStatus(t *testing.T) {
+	r := &Receiver{}
+	if r.ClusterStatus() != nil {
+		t.Errorf("ClusterStatus: expected nil without a cluster")
+	}
+
+	foo := &cluster.Node{Node: &memberlist.Node{Name: "foo", Addr: net.ParseIP("10.0.0.1")}}
+	bar := &cluster.Node{Node: &memberlist.Node{Name: "bar", Addr: net.ParseIP("10.0.0.2")}}
+	c := &fakeTransitionCluster{members: []*cluster.Node{foo, bar}, status: cluster.TransitionStatus{Acquiring: 1}}
+	c.ln = foo
+	r.cluster = c
+
+	st := r.ClusterStatus()
+	if len(st.Members) != 2 || !st.Members[0].Local || st.Members[1].Local || st.Members[1].Addr != "10.0.0.2" {
+		t.Errorf("ClusterStatus: unexpected members: %#v", st.Members)
+	}
+	if st.Transition == nil || st.Transition.Acquiring != 1 || st.Transition.Remaining() != 0 {
+		t.Errorf("ClusterStatus: unexpected transition: %#v", st.Transition)
+	}
+}
@@ -42,6 +42,7 @@ type verticalCacheSegment struct {
 	latests     map[int64]time.Time // rra.latest
 	value       map[int64]float64
 	duration    map[int64]int64
+	dirty       map[int64]bool // RRAs updated since the last flush, by idx
 	maxLatest   time.Time
 	latestIndex int64
 	lastFlushRT time.Time
@@ -55,6 +56,7 @@ type dsStateSegment struct {
 	lastupdate  map[int64]time.Time
 	value       map[int64]float64
 	duration    map[int64]int64
+	lastRaw     map[int64]float64
 }
 
 // The top level key for this cache is the combination of bundleId,
@@ -70,6 +72,7 @@ type verticalCache struct {
 	dps     map[bundleKey]*verticalCacheSegment
 	dss     map[int64]*dsStateSegment // keyed on seg
 	minStep time.Duration
+	pacer   *flushPacer // stretches the flush interval, may be nil
 	*sync.Mutex
 }
 
@@ -89,6 +92,7 @@ func (vc *verticalCache) updateDps(rra serde.DbRoundRobinArchiver) {
 			latests:     make(map[int64]time.Time),
 			value:       make(map[int64]float64),
 			duration:    make(map[int64]int64),
+			dirty:       make(map[int64]bool),
 			step:        rra.Step(),
 			size:        rra.Size(),
 			lastFlushRT: time.Now(), // Or else it will get sent to the flusher right away!
@@ -117,6 +121,7 @@ func (vc *verticalCache) updateDps(rra serde.DbRoundRobinArchiver) {
 	segment.latests[idx] = latest
 	segment.value[idx] = rra.Value()
 	segment.duration[idx] = rra.Duration().Nanoseconds() / 1e6
+	segment.dirty[idx] = true
 
 	segment.Unlock()
 }
@@ -135,6 +140,7 @@ func (vc *verticalCache) updateDss(ds serde.DbDataSourcer) {
 			lastupdate:  make(map[int64]time.Time),
 			duration:    make(map[int64]int64), // milliseconds
 			value:       make(map[int64]float64),
+			lastRaw:     make(map[int64]float64),
 		}
 		vc.dss[seg] = segment
 	}
@@ -144,6 +150,7 @@ func (vc *verticalCache) updateDss(ds serde.DbDataSourcer) {
 	segment.lastupdate[idx] = ds.LastUpdate()
 	segment.duration[idx] = ds.Duration().Nanoseconds() / 1e6
 	segment.value[idx] = ds.Value()
+	segment.lastRaw[idx] = ds.LastRaw()
 	segment.Unlock()
 }
 
@@ -188,10 +195,13 @@ func (vc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 	dpFlushes, dpFlushedPoints, dpFlushBlocked, dsFlushes, rsFlushes := 0, 0, 0, 0, 0
 	toFlush := make(map[bundleKey]*verticalCacheSegment, len(vc.dps))
 
+	// When the database is slow, flush less often
+	interval := vc.pacer.stretch(vc.minStep)
+
 	vc.Lock()
 	for key, segment := range vc.dps {
 		now := time.Now()
-		if !full && (now.Sub(segment.lastFlushRT) < vc.minStep) {
+		if !full && (now.Sub(segment.lastFlushRT) < interval) {
 			continue
 		}
 		toFlush[key] = segment
@@ -252,7 +262,13 @@ func (vc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 				continue
 			}
 
-			dfr := &vDpFlushRequest{key.bundleId, key.seg, i, dps, flushIVers, nil, nil, nil, nil}
+			if len(dps) == 0 {
+				// nothing changed in this row (e.g. all NaNs)
+				delete(segment.rows, i)
+				continue
+			}
+
+			dfr := &vDpFlushRequest{key.bundleId, key.seg, i, dps, flushIVers, nil, nil, nil, nil, nil}
 
 			if full { // insist, even if we block
 				ch <- dfr
@@ -272,7 +288,8 @@ func (vc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 			delete(segment.rows, i)
 		}
 
-		// RRA State
+		// RRA State. Only RRAs that were updated since the last
+		// flush are written, the rest are the same as in the db.
 		var lat, dur, val map[int64]interface{}
 		if len(flushLatests) > 0 {
 			lat = make(map[int64]interface{}, len(flushLatests))
@@ -280,26 +297,23 @@ func (vc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 				lat[k] = interface{}(v)
 			}
 		}
-		if len(segment.duration) > 0 {
-			dur = make(map[int64]interface{}, len(segment.duration))
-			for k, v := range segment.duration {
-				dur[k] = interface{}(v)
+		if len(segment.dirty) > 0 {
+			dur = make(map[int64]interface{}, len(segment.dirty))
+			val = make(map[int64]interface{}, len(segment.dirty))
+			for k, _ := range segment.dirty {
+				dur[k] = interface{}(segment.duration[k])
+				val[k] = interface{}(segment.value[k])
 			}
 		}
-		if len(segment.value) > 0 {
-			val = make(map[int64]interface{}, len(segment.value))
-			for k, v := range segment.value {
-				val[k] = interface{}(v)
-			}
-		}
-		if (len(flushLatests) + len(segment.duration) + len(segment.value)) > 0 {
+		if (len(lat) + len(dur) + len(val)) > 0 {
 			// unlike dps, insist on a blocking operation
-			ch <- &vDpFlushRequest{key.bundleId, key.seg, 0, nil, nil, lat, nil, dur, val}
+			ch <- &vDpFlushRequest{key.bundleId, key.seg, 0, nil, nil, lat, nil, dur, val, nil}
 			rsFlushes += 1
+			segment.dirty = make(map[int64]bool)
 		}
 
 		// update lastFlushRT even if nothing was flushed above, we will only try
-		// again in minStep time.
+		// again in minStep (stretched by the pacer) time.
 		segment.lastFlushRT = time.Now()
 		segment.Unlock()
 	}
@@ -311,7 +325,7 @@ func (vc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 	vc.Lock()
 	for seg, segment := range vc.dss {
 		now := time.Now()
-		if !full && (now.Sub(segment.lastFlushRT) < (vc.minStep * 2)) {
+		if !full && (now.Sub(segment.lastFlushRT) < (interval * 2)) {
 			continue
 		}
 		dssToFlush[seg] = segment
@@ -336,13 +350,18 @@ func (vc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 			for k, v := range segment.value {
 				val[k] = interface{}(v)
 			}
-			ch <- &vDpFlushRequest{0, seg, 0, nil, nil, nil, lu, dur, val}
+			lr := make(map[int64]interface{}, len(segment.lastRaw))
+			for k, v := range segment.lastRaw {
+				lr[k] = interface{}(v)
+			}
+			ch <- &vDpFlushRequest{0, seg, 0, nil, nil, nil, lu, dur, val, lr}
 			dsFlushes += 1
 
 			// Clear out the segment
 			segment.lastupdate = make(map[int64]time.Time)
 			segment.duration = make(map[int64]int64)
 			segment.value = make(map[int64]float64)
+			segment.lastRaw = make(map[int64]float64)
 		}
 
 		// even if there was nothing to flush consider it a flush
@@ -0,0 +1,94 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+type fakeDbRRA struct {
+	rrd.RoundRobinArchiver
+	idx int64
+	dps map[int64]float64
+}
+
+func (f *fakeDbRRA) Id() int64                    { return f.idx }
+func (f *fakeDbRRA) Width() int64                 { return 200 }
+func (f *fakeDbRRA) SlotRow(slot int64) int64     { return slot / 200 }
+func (f *fakeDbRRA) Seg() int64                   { return 0 }
+func (f *fakeDbRRA) Idx() int64                   { return f.idx }
+func (f *fakeDbRRA) BundleId() int64              { return 1 }
+func (f *fakeDbRRA) DPs() map[int64]float64       { return f.dps }
+func (f *fakeDbRRA) Copy() rrd.RoundRobinArchiver { return f }
+
+func newFakeDbRRA(idx int64, dps map[int64]float64) serde.DbRoundRobinArchiver {
+	latest := time.Unix(1000, 0)
+	rra := rrd.NewRoundRobinArchive(rrd.RRASpec{Function: rrd.WMEAN, Step: 10 * time.Second, Span: 100 * time.Second, Latest: latest})
+	return &fakeDbRRA{RoundRobinArchiver: rra, idx: idx, dps: dps}
+}
+
+func Test_verticalCache_flushDirty(t *testing.T) {
+	vc := &verticalCache{
+		Mutex:   &sync.Mutex{},
+		dps:     make(map[bundleKey]*verticalCacheSegment),
+		dss:     make(map[int64]*dsStateSegment),
+		minStep: 10 * time.Second,
+	}
+
+	vc.updateDps(newFakeDbRRA(0, map[int64]float64{1: 1}))
+	vc.updateDps(newFakeDbRRA(1, map[int64]float64{2: math.NaN()})) // empty row
+
+	ch := make(chan *vDpFlushRequest, 10)
+	st := vc.flush(ch, true)
+	if st.dpFlushes != 1 {
+		t.Errorf("flush: empty rows should not be flushed, dpFlushes: %d", st.dpFlushes)
+	}
+
+	var rs *vDpFlushRequest
+	for len(ch) > 0 {
+		if dpr := <-ch; len(dpr.dps) == 0 {
+			rs = dpr
+		}
+	}
+	if rs == nil || len(rs.value) != 2 || len(rs.duration) != 2 {
+		t.Fatalf("flush: expected RRA state for 2 RRAs: %+v", rs)
+	}
+
+	// only RRA 1 is updated, RRA 0 state should not be written again
+	vc.updateDps(newFakeDbRRA(1, map[int64]float64{3: 3}))
+	vc.flush(ch, true)
+	rs = nil
+	for len(ch) > 0 {
+		if dpr := <-ch; len(dpr.dps) == 0 {
+			rs = dpr
+		}
+	}
+	if rs == nil || len(rs.value) != 1 || rs.value[1] == nil {
+		t.Errorf("flush: expected RRA state for RRA 1 only: %+v", rs)
+	}
+
+	// nothing updated, nothing flushed
+	vc.flush(ch, true)
+	if len(ch) != 0 {
+		t.Errorf("flush: nothing should be flushed when nothing changed, got %d requests", len(ch))
+	}
+}
@@ -18,9 +18,58 @@ package rrd
 import (
 	"fmt"
 	"math"
+	"strings"
 	"time"
 )
 
+// DSType determines how incoming values are interpreted. GAUGE values
+// are stored as is, the rest are converted to a per-second rate before
+// they are added to the PDP, similar to RRDTool:
+//
+// COUNTER - a continuously increasing value (e.g. bytes sent), the rate
+// is the difference from the previous value divided by the time
+// elapsed. A decrease is considered a wrap of a 32-bit or (if the
+// previous value exceeds 32 bits) a 64-bit counter.
+//
+// DERIVE - same as COUNTER, but without wrap detection, a decrease
+// results in a negative rate.
+//
+// ABSOLUTE - a counter which is reset every time it is read, the rate
+// is the value divided by the time elapsed since the previous one.
+//
+// The previous value (see LastRaw) is kept along with the rest of the
+// DS state, thus a COUNTER or DERIVE continues where it left off when
+// the DS is loaded again, only the very first data point of a DS
+// results in NaN.
+type DSType int
+
+const (
+	GAUGE    DSType = iota // Value as is (default)
+	COUNTER                // Rate of a counter, with wrap detection
+	DERIVE                 // Rate of change
+	ABSOLUTE               // Rate of a reset-on-read counter
+)
+
+var dsTypeNames = []string{"GAUGE", "COUNTER", "DERIVE", "ABSOLUTE"}
+
+func (t DSType) String() string {
+	if t >= 0 && int(t) < len(dsTypeNames) {
+		return dsTypeNames[t]
+	}
+	return fmt.Sprintf("DSType(%d)", int(t))
+}
+
+// ParseDSType returns the DSType by its name, which is not
+// case-sensitive, e.g. "gauge" or "COUNTER".
+func ParseDSType(s string) (DSType, error) {
+	for i, name := range dsTypeNames {
+		if strings.ToUpper(s) == name {
+			return DSType(i), nil
+		}
+	}
+	return GAUGE, fmt.Errorf("Invalid DS type: %q (valid types: gauge, counter, derive, absolute)", s)
+}
+
 // DataSource contains a time series and its parameters, RRAs and
 // intermediate state (PDP). The DS PDP is the smallest unit of
 // accumulation for this series, all RRAs should have PDPs that are a
@@ -35,6 +84,8 @@ type DataSource struct {
 	heartbeat  time.Duration        // Heartbeat is inactivity period longer than this causes NaN values. 0 -> no heartbeat.
 	lastUpdate time.Time            // Last time we received an update (series time - can be in the past or future)
 	rras       []RoundRobinArchiver // Array of Round Robin Archives
+	dsType     DSType               // How incoming values are interpreted
+	lastRaw    float64              // Previous value as received, before any rate conversion
 }
 
 // DataSourcer is a DataSource as an interface.
@@ -42,7 +93,9 @@ type DataSourcer interface {
 	Pdper
 	Step() time.Duration
 	Heartbeat() time.Duration
+	Type() DSType
 	LastUpdate() time.Time
+	LastRaw() float64
 	RRAs() []RoundRobinArchiver
 	SetRRAs(rras []RoundRobinArchiver)
 	Copy() DataSourcer
@@ -50,6 +103,7 @@ type DataSourcer interface {
 	PointCount() int
 	ClearRRAs()
 	ProcessDataPoint(value float64, ts time.Time) error
+	BackfillDataPoint(value float64, ts time.Time) error
 	Spec() DSSpec
 }
 
@@ -60,12 +114,18 @@ func NewDataSource(spec DSSpec) *DataSource {
 		step:       spec.Step,
 		heartbeat:  spec.Heartbeat,
 		lastUpdate: spec.LastUpdate,
+		dsType:     spec.Type,
+		lastRaw:    spec.LastRaw,
 		Pdp: Pdp{
 			value:    spec.Value,
 			duration: spec.Duration,
 		},
 	}
 
+	if spec.LastUpdate.IsZero() {
+		result.lastRaw = math.NaN()
+	}
+
 	for _, rspec := range spec.RRAs {
 		rra := NewRoundRobinArchive(rspec)
 		result.rras = append(result.rras, rra)
@@ -104,9 +164,17 @@ func (ds *DataSource) Step() time.Duration { return ds.step }
 // success".
 func (ds *DataSource) Heartbeat() time.Duration { return ds.heartbeat }
 
+// Type returns the DS type, see DSType.
+func (ds *DataSource) Type() DSType { return ds.dsType }
+
 // LastUpdate returns the timestamp of the last Data Point processed
 func (ds *DataSource) LastUpdate() time.Time { return ds.lastUpdate }
 
+// LastRaw returns the value of the last Data Point processed as it
+// was received, i.e. before any rate conversion. It is NaN if there
+// is none.
+func (ds *DataSource) LastRaw() float64 { return ds.lastRaw }
+
 // List of Round Robin Archives this Data Source has
 func (ds *DataSource) RRAs() []RoundRobinArchiver { return ds.rras }
 
@@ -124,6 +192,8 @@ func (ds *DataSource) Copy() DataSourcer {
 		heartbeat:  ds.heartbeat,
 		lastUpdate: ds.lastUpdate,
 		rras:       make([]RoundRobinArchiver, len(ds.rras)),
+		dsType:     ds.dsType,
+		lastRaw:    ds.lastRaw,
 	}
 	for n, rra := range ds.rras {
 		newDs.rras[n] = rra.Copy()
@@ -305,6 +375,8 @@ func (ds *DataSource) ProcessDataPoint(value float64, ts time.Time) error {
 		return fmt.Errorf("Data point time stamp %v is not greater than data source last update time %v", ts, ds.lastUpdate)
 	}
 
+	value = ds.rate(value, ts)
+
 	if ds.heartbeat == 0 {
 		// With 0 HB, just set the step to the value. Do not attempt
 		// to back-fill anything. Subsequent data point in the same
@@ -334,6 +406,111 @@ func (ds *DataSource) ProcessDataPoint(value float64, ts time.Time) error {
 	return nil
 }
 
+// ErrBackfillTooOld is returned by BackfillDataPoint when the data
+// point is too old for every RRA, or falls into slots which have been
+// flushed and are no longer in memory.
+var ErrBackfillTooOld = fmt.Errorf("Data point is too old to be backfilled or no longer in memory")
+
+// BackfillDataPoint accepts a data point whose time stamp is before
+// lastUpdate, i.e. one that arrived out of order. Rather than going
+// through the PDP, the value is applied directly to the slot of every
+// RRA which includes it, in accordance with the RRA consolidation
+// function, while lastUpdate and the rest of the series are left
+// alone. A data point that is not before lastUpdate is simply passed
+// on to ProcessDataPoint.
+//
+// Since the original data points are not kept, the recomputed value
+// is an approximation: for WMEAN the backfilled value is weighed as
+// if it covered the part of the PDP between the PDP beginning and
+// the data point time stamp (the whole PDP if HB is 0), for LAST an
+// existing value always wins because it is more recent. Note also
+// that RRA data points are cleared once flushed, and a backfilled
+// slot which is no longer in memory cannot be merged with what is
+// stored, for such data points ErrBackfillTooOld is returned.
+func (ds *DataSource) BackfillDataPoint(value float64, ts time.Time) error {
+
+	if math.IsInf(value, 0) {
+		return fmt.Errorf("±Inf is not a valid data point value: %v", value)
+	}
+
+	if !ts.Before(ds.lastUpdate) {
+		return ds.ProcessDataPoint(value, ts)
+	}
+
+	if ds.dsType != GAUGE {
+		return fmt.Errorf("Only GAUGE data sources can be backfilled")
+	}
+
+	if math.IsNaN(value) {
+		return nil // nothing to backfill
+	}
+
+	// completed is the time up to which PDPs have been sent to the
+	// RRAs. begin and end are the PDP the data point belongs to,
+	// duration is how much of it the data point accounts for.
+	var completed, begin, end time.Time
+	var duration time.Duration
+	if ds.heartbeat == 0 {
+		completed = ds.lastUpdate.Truncate(ds.step).Add(ds.step)
+		begin = ts.Truncate(ds.step)
+		end, duration = begin.Add(ds.step), ds.step
+	} else {
+		completed = ds.lastUpdate.Truncate(ds.step)
+		begin, end = surroundingStep(ts, ds.step)
+		duration = ts.Sub(begin)
+	}
+
+	if end.After(completed) {
+		// The data point belongs to the current (incomplete) PDP
+		ds.AddValue(value, duration)
+		return nil
+	}
+
+	updated := false
+	for _, rra := range ds.rras {
+		if rra.backfill(end, completed, value, duration) {
+			updated = true
+		}
+	}
+	if !updated {
+		return ErrBackfillTooOld
+	}
+	return nil
+}
+
+// rate converts a value to a per-second rate in accordance with the
+// DS type, it is a noop for GAUGE. The result is NaN if there is no
+// previous value or no time elapsed since it.
+func (ds *DataSource) rate(value float64, ts time.Time) float64 {
+	prev := ds.lastRaw
+	ds.lastRaw = value
+	if ds.dsType == GAUGE {
+		return value
+	}
+
+	var delta float64
+	switch ds.dsType {
+	case COUNTER, DERIVE:
+		delta = value - prev // NaN if prev is NaN
+		if ds.dsType == COUNTER && delta < 0 {
+			// Assume a wrap of a 32 or 64 bit counter
+			if prev <= math.MaxUint32 {
+				delta += math.MaxUint32 + 1
+			} else {
+				delta += math.MaxUint64 + 1
+			}
+		}
+	case ABSOLUTE:
+		delta = value
+	}
+
+	elapsed := ts.Sub(ds.lastUpdate).Seconds()
+	if ds.lastUpdate.IsZero() || elapsed <= 0 {
+		return math.NaN()
+	}
+	return delta / elapsed
+}
+
 func (ds *DataSource) updateRRAs(periodBegin, periodEnd time.Time) {
 	for _, rra := range ds.rras {
 		// If this is a multi ds.step update and the step of the RRA
@@ -374,6 +551,7 @@ func (ds *DataSource) Spec() DSSpec {
 	spec := DSSpec{
 		Step:      ds.step,
 		Heartbeat: ds.heartbeat,
+		Type:      ds.dsType,
 		RRAs:      make([]RRASpec, len(ds.rras)),
 	}
 	for i, rra := range ds.rras {
@@ -389,10 +567,78 @@ func (ds *DataSource) Spec() DSSpec {
 type DSSpec struct {
 	Step      time.Duration
 	Heartbeat time.Duration
+	Type      DSType
 	RRAs      []RRASpec
 
-	// These can be used to fill the initial value
+	// These can be used to fill the initial value. LastRaw is
+	// ignored if LastUpdate is zero.
 	LastUpdate time.Time
 	Value      float64
 	Duration   time.Duration
+	LastRaw    float64
+
+	// Bounds, if not nil, is the range of valid data point
+	// values. It is not stored with the DataSource and it is up to
+	// whatever feeds the data points (i.e. the receiver) to apply
+	// it. The same goes for NaN.
+	Bounds *Bounds
+	NaN    NaNPolicy
+}
+
+// NaNPolicy determines what becomes of a data point whose value is
+// NaN or ±Inf, neither of which can be stored.
+type NaNPolicy int
+
+const (
+	NaNDrop NaNPolicy = iota // ignore the data point (default)
+	NaNZero                  // treat it as 0
+	NaNLast                  // treat it as the previous value (see LastRaw)
+	NaNGap                   // process it as NaN, i.e. mark the period as unknown
+)
+
+var nanPolicyNames = []string{"drop", "zero", "last", "gap"}
+
+func (p NaNPolicy) String() string {
+	if p >= 0 && int(p) < len(nanPolicyNames) {
+		return nanPolicyNames[p]
+	}
+	return fmt.Sprintf("NaNPolicy(%d)", int(p))
+}
+
+// ParseNaNPolicy converts one of "drop", "zero", "last" or "gap"
+// (not case-sensitive) into a NaNPolicy.
+func ParseNaNPolicy(s string) (NaNPolicy, error) {
+	for i, name := range nanPolicyNames {
+		if strings.ToLower(s) == name {
+			return NaNPolicy(i), nil
+		}
+	}
+	return NaNDrop, fmt.Errorf("Invalid NaN policy: %q (valid policies: drop, zero, last, gap)", s)
+}
+
+// Bounds is the range of valid data point values of a DS, e.g. a
+// percentage must be between 0 and 100. A value outside the range is
+// usually garbage (such as 2^64 from a broken agent) which would
+// otherwise distort the RRA averages for a long time.
+type Bounds struct {
+	Min, Max float64 // use ±Inf for no limit
+	Clamp    bool    // clamp out of bounds values instead of dropping them
+}
+
+// Apply returns the value adjusted to the bounds and whether it
+// should be accepted at all. A value within the bounds is returned
+// as is, one outside is either clamped to the nearest bound or
+// rejected, depending on Clamp. NaN, which is not a value, is left
+// alone. A nil Bounds accepts everything.
+func (b *Bounds) Apply(value float64) (float64, bool) {
+	if b == nil || math.IsNaN(value) || (value >= b.Min && value <= b.Max) {
+		return value, true
+	}
+	if !b.Clamp {
+		return value, false
+	}
+	if value < b.Min {
+		return b.Min, true
+	}
+	return b.Max, true
 }
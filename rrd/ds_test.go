@@ -18,6 +18,7 @@ package rrd
 import (
 	"math"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -384,6 +385,140 @@ func Test_DataSource_ProcessDataPoint_HB0(t *testing.T) {
 	}
 }
 
+func Test_DataSource_BackfillDataPoint(t *testing.T) {
+
+	ds := &DataSource{step: 10 * time.Second, heartbeat: 60 * time.Second}
+	ds.SetRRAs([]RoundRobinArchiver{
+		&RoundRobinArchive{step: 10 * time.Second, size: 10, cf: WMEAN},
+		&RoundRobinArchive{step: 20 * time.Second, size: 5, cf: MAX},
+	})
+	for _, sec := range []int64{1010, 1020, 1030, 1040, 1045} {
+		ds.ProcessDataPoint(100, time.Unix(sec, 0))
+	}
+
+	// Lands in a slot already in dps
+	if err := ds.BackfillDataPoint(200, time.Unix(1025, 0)); err != nil {
+		t.Errorf("BackfillDataPoint: unexpected error: %v", err)
+	}
+	if v := ds.rras[0].DPs()[3]; v != 150 {
+		t.Errorf("BackfillDataPoint: WMEAN slot value %v != 150", v)
+	}
+	if v := ds.rras[1].DPs()[2]; v != 200 {
+		t.Errorf("BackfillDataPoint: MAX slot value %v != 200", v)
+	}
+	if !ds.lastUpdate.Equal(time.Unix(1045, 0)) {
+		t.Errorf("BackfillDataPoint: lastUpdate changed: %v", ds.lastUpdate)
+	}
+
+	// Lands in the current DS PDP
+	ds.BackfillDataPoint(300, time.Unix(1043, 0))
+	if ds.value != 175 || ds.duration != 8*time.Second {
+		t.Errorf("BackfillDataPoint: ds.value != 175 || ds.duration != 8s: %v %v", ds.value, ds.duration)
+	}
+
+	// Too old for every RRA
+	if err := ds.BackfillDataPoint(100, time.Unix(900, 0)); err != ErrBackfillTooOld {
+		t.Errorf("BackfillDataPoint: expected ErrBackfillTooOld on data point older than all RRAs, got: %v", err)
+	}
+
+	// Flushed slots are no longer in memory and are not overwritten
+	cp := ds.Copy().(*DataSource)
+	cp.ClearRRAs()
+	if err := cp.BackfillDataPoint(200, time.Unix(1025, 0)); err != ErrBackfillTooOld {
+		t.Errorf("BackfillDataPoint: expected ErrBackfillTooOld on a flushed slot, got: %v", err)
+	}
+	if len(cp.rras[0].DPs()) != 0 {
+		t.Errorf("BackfillDataPoint: a flushed slot should not be set: %v", cp.rras[0].DPs())
+	}
+
+	// Inf
+	if err := ds.BackfillDataPoint(math.Inf(1), time.Unix(1025, 0)); err == nil {
+		t.Errorf("BackfillDataPoint: no error on Inf value")
+	}
+
+	// Not before last update is processed normally
+	ds.BackfillDataPoint(100, time.Unix(1050, 0))
+	if !ds.lastUpdate.Equal(time.Unix(1050, 0)) {
+		t.Errorf("BackfillDataPoint: lastUpdate not advanced: %v", ds.lastUpdate)
+	}
+}
+
+func Test_DataSource_rate(t *testing.T) {
+
+	ds := NewDataSource(DSSpec{Step: 10 * time.Second, Heartbeat: time.Hour, Type: COUNTER})
+	if v := ds.rate(100, time.Unix(1000, 0)); !math.IsNaN(v) {
+		t.Errorf("rate: COUNTER first value should be NaN: %v", v)
+	}
+	ds.lastUpdate = time.Unix(1000, 0)
+	if v := ds.rate(300, time.Unix(1010, 0)); v != 20 {
+		t.Errorf("rate: COUNTER 100 -> 300 in 10s should be 20: %v", v)
+	}
+	ds.lastUpdate = time.Unix(1010, 0)
+	if v := ds.rate(10, time.Unix(1020, 0)); v != (math.MaxUint32+1-300+10)/10.0 {
+		t.Errorf("rate: COUNTER 32-bit wrap not detected: %v", v)
+	}
+
+	ds = NewDataSource(DSSpec{Step: 10 * time.Second, Heartbeat: time.Hour, Type: DERIVE})
+	ds.rate(300, time.Unix(1000, 0))
+	ds.lastUpdate = time.Unix(1000, 0)
+	if v := ds.rate(100, time.Unix(1010, 0)); v != -20 {
+		t.Errorf("rate: DERIVE 300 -> 100 in 10s should be -20: %v", v)
+	}
+
+	ds = NewDataSource(DSSpec{Step: 10 * time.Second, Heartbeat: time.Hour, Type: ABSOLUTE})
+	ds.lastUpdate = time.Unix(1000, 0)
+	if v := ds.rate(50, time.Unix(1010, 0)); v != 5 {
+		t.Errorf("rate: ABSOLUTE 50 in 10s should be 5: %v", v)
+	}
+
+	ds = NewDataSource(DSSpec{Step: 10 * time.Second, Heartbeat: time.Hour})
+	if v := ds.rate(50, time.Unix(1010, 0)); v != 50 {
+		t.Errorf("rate: GAUGE should not change the value: %v", v)
+	}
+
+	// Through ProcessDataPoint
+	ds = NewDataSource(DSSpec{Step: 10 * time.Second, Heartbeat: time.Hour, Type: COUNTER})
+	ds.ProcessDataPoint(1000, time.Unix(1000, 0))
+	ds.ProcessDataPoint(1050, time.Unix(1005, 0))
+	if ds.Value() != 10 || ds.Duration() != 5*time.Second {
+		t.Errorf("ProcessDataPoint: COUNTER PDP should be 10 over 5s: %v %v", ds.Value(), ds.Duration())
+	}
+	if err := ds.BackfillDataPoint(1020, time.Unix(1002, 0)); err == nil {
+		t.Errorf("BackfillDataPoint: COUNTER should not be backfilled")
+	}
+	if ds.Spec().Type != COUNTER || ds.Copy().(*DataSource).dsType != COUNTER {
+		t.Errorf("Type not preserved by Spec() or Copy()")
+	}
+
+	// LastRaw continues where it left off when loaded
+	if ds.LastRaw() != 1050 {
+		t.Errorf("LastRaw: expected 1050, got %v", ds.LastRaw())
+	}
+	ds = NewDataSource(DSSpec{Step: 10 * time.Second, Heartbeat: time.Hour, Type: COUNTER,
+		LastUpdate: time.Unix(1005, 0), LastRaw: 1050})
+	ds.ProcessDataPoint(1080, time.Unix(1008, 0))
+	if ds.Value() != 10 {
+		t.Errorf("ProcessDataPoint: COUNTER loaded with LastRaw should continue: %v", ds.Value())
+	}
+	if ds = NewDataSource(DSSpec{LastRaw: 1050}); !math.IsNaN(ds.LastRaw()) {
+		t.Errorf("NewDataSource: LastRaw should be NaN without LastUpdate: %v", ds.LastRaw())
+	}
+}
+
+func Test_DSType_String(t *testing.T) {
+	for _, typ := range []DSType{GAUGE, COUNTER, DERIVE, ABSOLUTE} {
+		if parsed, err := ParseDSType(strings.ToLower(typ.String())); err != nil || parsed != typ {
+			t.Errorf("ParseDSType(%q): %v %v", typ.String(), parsed, err)
+		}
+	}
+	if _, err := ParseDSType("bogus"); err == nil {
+		t.Errorf("ParseDSType: no error on an invalid type")
+	}
+	if s := DSType(42).String(); s != "DSType(42)" {
+		t.Errorf("String: unexpected %q", s)
+	}
+}
+
 func Test_DataSource_ClearRRAs(t *testing.T) {
 
 	ds := &DataSource{step: 10 * time.Second}
@@ -429,3 +564,46 @@ func Test_DataSource_Copy(t *testing.T) {
 		t.Errorf("Copy: !reflect.DeepEqual(ds, cpy)")
 	}
 }
+
+func Test_Bounds_Apply(t *testing.T) {
+	var b *Bounds
+	if v, ok := b.Apply(math.MaxFloat64); !ok || v != math.MaxFloat64 {
+		t.Errorf("nil Bounds: %v %v", v, ok)
+	}
+	if v, ok := (&Bounds{Min: 0, Max: 1}).Apply(math.NaN()); !ok || !math.IsNaN(v) {
+		t.Errorf("Bounds: NaN should be left alone: %v %v", v, ok)
+	}
+
+	b = &Bounds{Min: 0, Max: 100}
+	for _, c := range []struct {
+		value, expect float64
+		ok, clamp     bool
+	}{
+		{50, 50, true, false},
+		{0, 0, true, false},
+		{100, 100, true, false},
+		{-1, -1, false, false},
+		{math.Pow(2, 64), math.Pow(2, 64), false, false},
+		{-1, 0, true, true},
+		{math.Pow(2, 64), 100, true, true},
+	} {
+		b.Clamp = c.clamp
+		if v, ok := b.Apply(c.value); v != c.expect || ok != c.ok {
+			t.Errorf("Apply(%v) with clamp %v: %v %v, expected %v %v", c.value, c.clamp, v, ok, c.expect, c.ok)
+		}
+	}
+}
+
+func Test_NaNPolicy_String(t *testing.T) {
+	for _, p := range []NaNPolicy{NaNDrop, NaNZero, NaNLast, NaNGap} {
+		if parsed, err := ParseNaNPolicy(strings.ToUpper(p.String())); err != nil || parsed != p {
+			t.Errorf("ParseNaNPolicy(%q): %v %v", p.String(), parsed, err)
+		}
+	}
+	if _, err := ParseNaNPolicy("bogus"); err == nil {
+		t.Errorf("ParseNaNPolicy: no error on an invalid policy")
+	}
+	if s := NaNPolicy(42).String(); s != "NaNPolicy(42)" {
+		t.Errorf("String: unexpected %q", s)
+	}
+}
@@ -0,0 +1,128 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// resampleAcc accumulates what of the source data points falls in a
+// slot of the resampled RRA.
+type resampleAcc struct {
+	sum, v  float64
+	known   time.Duration
+	lastEnd time.Time
+}
+
+// Resample returns the data points of an RRA of spec ending at latest
+// (the end of its last slot), consolidated with its CF from the data
+// points of srcs, e.g. the RRAs of a DS whose RRAs are changing. Each
+// slot is made of the data of a single source: those of the same CF
+// come first and, among them, the finer ones, the others are only
+// used where none of those has data. A source slot which only
+// partially overlaps a slot is weighted by the overlap for WMEAN, and
+// a slot with less than Xff of it known is left out, as when
+// consolidating.
+func Resample(spec RRASpec, latest time.Time, srcs []RoundRobinArchiver) map[int64]float64 {
+	size := spec.Span.Nanoseconds() / spec.Step.Nanoseconds()
+	result := make(map[int64]float64)
+	if latest.IsZero() || size == 0 {
+		return result
+	}
+	begin := latest.Add(-time.Duration(size) * spec.Step)
+
+	srcs = append([]RoundRobinArchiver(nil), srcs...)
+	sort.SliceStable(srcs, func(i, j int) bool {
+		si, sj := srcs[i].Spec().Function == spec.Function, srcs[j].Spec().Function == spec.Function
+		if si != sj {
+			return si
+		}
+		return srcs[i].Step() < srcs[j].Step()
+	})
+
+	done := make(map[int64]bool) // slots made of a previous source
+	for _, src := range srcs {
+		if src.Latest().IsZero() || src.Size() == 0 {
+			continue
+		}
+		accs := make(map[int64]*resampleAcc)
+		for i, v := range src.DPs() {
+			if math.IsNaN(v) {
+				continue
+			}
+			srcEnd := SlotTime(i, src.Latest(), src.Step(), src.Size())
+			srcBegin := srcEnd.Add(-src.Step())
+			for end := srcBegin.Truncate(spec.Step).Add(spec.Step); end.Add(-spec.Step).Before(srcEnd); end = end.Add(spec.Step) {
+				if !end.After(begin) || end.After(latest) {
+					continue
+				}
+				n := SlotIndex(end, spec.Step, size)
+				if done[n] {
+					continue
+				}
+				overlap := minTime(end, srcEnd).Sub(maxTime(end.Add(-spec.Step), srcBegin))
+				if overlap <= 0 {
+					continue
+				}
+				acc := accs[n]
+				if acc == nil {
+					acc = &resampleAcc{v: v}
+					accs[n] = acc
+				}
+				acc.sum += v * float64(overlap)
+				acc.known += overlap
+				switch spec.Function {
+				case MAX:
+					acc.v = math.Max(acc.v, v)
+				case MIN:
+					acc.v = math.Min(acc.v, v)
+				case LAST:
+					if srcEnd.After(acc.lastEnd) {
+						acc.v, acc.lastEnd = v, srcEnd
+					}
+				}
+			}
+		}
+		for n, acc := range accs {
+			done[n] = true
+			if float32(acc.known)/float32(spec.Step) < spec.Xff {
+				continue
+			}
+			if spec.Function == WMEAN {
+				result[n] = acc.sum / float64(acc.known)
+			} else {
+				result[n] = acc.v
+			}
+		}
+	}
+	return result
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,74 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Resample(t *testing.T) {
+	fine := NewRoundRobinArchive(RRASpec{Function: WMEAN, Step: 10 * time.Second, Span: time.Minute, Latest: time.Unix(120, 0)})
+	for n := int64(1); n <= 6; n++ {
+		end := time.Unix(60+n*10, 0)
+		fine.dps[SlotIndex(end, fine.step, fine.size)] = float64(n)
+	}
+	coarse := NewRoundRobinArchive(RRASpec{Function: MAX, Step: time.Minute, Span: 5 * time.Minute, Latest: time.Unix(120, 0)})
+	coarse.dps[SlotIndex(time.Unix(60, 0), coarse.step, coarse.size)] = 10
+	coarse.dps[SlotIndex(time.Unix(120, 0), coarse.step, coarse.size)] = 20
+
+	at := func(dps map[int64]float64, spec RRASpec, end int64) (float64, bool) {
+		v, ok := dps[SlotIndex(time.Unix(end, 0), spec.Step, spec.Span.Nanoseconds()/spec.Step.Nanoseconds())]
+		return v, ok
+	}
+
+	// Downsampling, the fine WMEAN source wins where it has data
+	spec := RRASpec{Function: WMEAN, Step: 30 * time.Second, Span: 2 * time.Minute}
+	dps := Resample(spec, time.Unix(120, 0), []RoundRobinArchiver{coarse, fine})
+	if v, _ := at(dps, spec, 90); v != 2 {
+		t.Errorf("Resample: expected 2 at 90, got %v", v)
+	}
+	if v, _ := at(dps, spec, 120); v != 5 {
+		t.Errorf("Resample: expected 5 at 120, got %v", v)
+	}
+	if v, _ := at(dps, spec, 60); v != 10 { // only the coarse one has it
+		t.Errorf("Resample: expected 10 at 60 from the coarse source, got %v", v)
+	}
+	if len(dps) != 4 {
+		t.Errorf("Resample: expected 4 data points, got %v", dps)
+	}
+
+	// Same CF first, even if coarser
+	spec = RRASpec{Function: MAX, Step: 30 * time.Second, Span: 2 * time.Minute}
+	dps = Resample(spec, time.Unix(120, 0), []RoundRobinArchiver{fine, coarse})
+	if v, _ := at(dps, spec, 90); v != 20 {
+		t.Errorf("Resample: expected 20 at 90 from the MAX source, got %v", v)
+	}
+
+	// Upsampling
+	spec = RRASpec{Function: LAST, Step: 5 * time.Second, Span: time.Minute}
+	dps = Resample(spec, time.Unix(120, 0), []RoundRobinArchiver{fine})
+	if v, _ := at(dps, spec, 65); v != 1 || len(dps) != 12 {
+		t.Errorf("Resample: expected 1 at 65 and 12 data points, got %v %v", v, dps)
+	}
+
+	// Xff
+	spec = RRASpec{Function: WMEAN, Step: time.Minute, Span: 2 * time.Minute, Xff: 0.9}
+	fine.dps = map[int64]float64{SlotIndex(time.Unix(110, 0), fine.step, fine.size): 1}
+	if dps = Resample(spec, time.Unix(120, 0), []RoundRobinArchiver{fine}); len(dps) != 0 {
+		t.Errorf("Resample: expected nothing with 1/6 known and xff 0.9, got %v", dps)
+	}
+}
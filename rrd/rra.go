@@ -71,6 +71,10 @@ type RoundRobinArchive struct {
 	// having to store it. Slot numbers are aligned on millisecond,
 	// therefore an RRA step cannot be less than a millisecond.
 	dps map[int64]float64
+	// Slots ending at or before flushed are no longer in dps,
+	// either because they were cleared after a flush, or because
+	// the RRA was created without its data points.
+	flushed time.Time
 }
 
 // RoundRobinArchive as an interface
@@ -90,6 +94,7 @@ type RoundRobinArchiver interface {
 	clear()
 	includes(t time.Time) bool
 	update(periodBegin, periodEnd time.Time, value float64, duration time.Duration)
+	backfill(pdpEnd, completed time.Time, value float64, duration time.Duration) bool
 }
 
 // Latest returns the time on which the last slot ends.
@@ -121,6 +126,8 @@ func NewRoundRobinArchive(spec RRASpec) *RoundRobinArchive {
 	}
 	if len(spec.DPs) > 0 {
 		result.dps = spec.DPs
+	} else {
+		result.flushed = spec.Latest
 	}
 	return result
 }
@@ -128,13 +135,14 @@ func NewRoundRobinArchive(spec RRASpec) *RoundRobinArchive {
 // Returns a complete copy of the RRA.
 func (rra *RoundRobinArchive) Copy() RoundRobinArchiver {
 	new_rra := &RoundRobinArchive{
-		Pdp:    Pdp{value: rra.value, duration: rra.duration},
-		cf:     rra.cf,
-		step:   rra.step,
-		size:   rra.size,
-		latest: rra.latest,
-		xff:    rra.xff,
-		dps:    make(map[int64]float64, len(rra.dps)),
+		Pdp:     Pdp{value: rra.value, duration: rra.duration},
+		cf:      rra.cf,
+		step:    rra.step,
+		size:    rra.size,
+		latest:  rra.latest,
+		xff:     rra.xff,
+		dps:     make(map[int64]float64, len(rra.dps)),
+		flushed: rra.flushed,
 	}
 	for k, v := range rra.dps {
 		new_rra.dps[k] = v
@@ -227,6 +235,74 @@ func (rra *RoundRobinArchive) update(periodBegin, periodEnd time.Time, value flo
 	}
 }
 
+// backfill applies an out-of-order value to the slot which includes
+// the DS PDP ending at pdpEnd. Completed is the time up to which DS
+// PDPs have been sent to this RRA, slots ending after it still reside
+// in the RRA PDP. Returns false if the slot is beyond the RRA span or
+// no longer in memory, since its stored value cannot be merged with.
+func (rra *RoundRobinArchive) backfill(pdpEnd, completed time.Time, value float64, duration time.Duration) bool {
+
+	slotEnd := pdpEnd.Truncate(rra.step)
+	if !slotEnd.Equal(pdpEnd) {
+		slotEnd = slotEnd.Add(rra.step)
+	}
+
+	if slotEnd.After(completed) {
+		// The slot has not been moved to dps yet
+		switch rra.cf {
+		case WMEAN:
+			rra.AddValue(value, duration)
+		case MAX:
+			rra.AddValueMax(value, duration)
+		case MIN:
+			rra.AddValueMin(value, duration)
+		case LAST:
+			if rra.duration == 0 {
+				rra.AddValueLast(value, duration)
+			}
+		}
+		return true
+	}
+
+	if !slotEnd.After(rra.latest.Add(-rra.step * time.Duration(rra.size))) {
+		return false // too old
+	}
+
+	if !slotEnd.After(rra.flushed) {
+		return false // flushed, not in dps
+	}
+
+	if rra.dps == nil {
+		rra.dps = make(map[int64]float64)
+	}
+
+	slotN := SlotIndex(slotEnd, rra.step, rra.size)
+	old, ok := rra.dps[slotN]
+	if !ok || math.IsNaN(old) {
+		rra.dps[slotN] = value
+		return true
+	}
+
+	switch rra.cf {
+	case WMEAN:
+		// Pretend the existing value covers the rest of the slot
+		p := Pdp{value: old, duration: rra.step - duration}
+		p.AddValue(value, duration)
+		rra.dps[slotN] = p.value
+	case MAX:
+		if value > old {
+			rra.dps[slotN] = value
+		}
+	case MIN:
+		if value < old {
+			rra.dps[slotN] = value
+		}
+	case LAST:
+		// The existing value is more recent, leave it be
+	}
+	return true
+}
+
 // movePdpToDps moves the PDP into its proper slot in the dps map and
 // resets the PDP.
 func (rra *RoundRobinArchive) movePdpToDps(endOfSlot time.Time) {
@@ -257,6 +333,7 @@ func (rra *RoundRobinArchive) clear() {
 	if len(rra.dps) > 0 {
 		rra.dps = make(map[int64]float64)
 	}
+	rra.flushed = rra.latest
 }
 
 // Given a slot timestamp, RRA step and size, return the slot's
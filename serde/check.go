@@ -0,0 +1,62 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import "fmt"
+
+// A Checker can verify that the stored DSs and RRAs are in a possible
+// state, such as positions of RRAs within their bundles and latest
+// times that are not in the future, and optionally repair what it
+// safely can.
+type Checker interface {
+	Check(repair bool) (*CheckReport, error)
+}
+
+// CheckReport is the result of Check: the problems found, in the
+// order of the checks.
+type CheckReport struct {
+	Problems []CheckProblem
+}
+
+// Unrepaired is the number of problems not (or not able to be)
+// repaired.
+func (r *CheckReport) Unrepaired() int {
+	n := 0
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+// CheckProblem is an impossible state found by a check. DsId and
+// RRAId are 0 if the problem is not of a DS or an RRA.
+type CheckProblem struct {
+	Check    string
+	DsId     int64
+	RRAId    int64
+	Detail   string
+	Repaired bool
+}
+
+func (p CheckProblem) String() string {
+	s := fmt.Sprintf("%s: ds %d rra %d: %s", p.Check, p.DsId, p.RRAId, p.Detail)
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
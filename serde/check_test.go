@@ -0,0 +1,56 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func Test_CheckReport(t *testing.T) {
+	report := &CheckReport{Problems: []CheckProblem{
+		{Check: "rra_latest_in_future", DsId: 1, RRAId: 2, Detail: "latest 2100-01-01", Repaired: true},
+		{Check: "rra_slot_shared", DsId: 3, RRAId: 4, Detail: "seg 0 idx 1"},
+	}}
+	if n := report.Unrepaired(); n != 1 {
+		t.Errorf("Unrepaired: expected 1, got %d", n)
+	}
+	if s := report.Problems[0].String(); s != "rra_latest_in_future: ds 1 rra 2: latest 2100-01-01 (repaired)" {
+		t.Errorf("String: unexpected %q", s)
+	}
+}
+
+func Test_pgCheckSql(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, c := range pgCheckSql {
+		if seen[c.name] {
+			t.Errorf("pgCheckSql: duplicate check %q", c.name)
+		}
+		seen[c.name] = true
+		for _, stmt := range []string{c.check, c.repair} {
+			if stmt == "" {
+				continue
+			}
+			if s := fmt.Sprintf(stmt, "tgres_"); strings.Contains(s, "%!") {
+				t.Errorf("pgCheckSql: %s: bad substitution: %s", c.name, s)
+			}
+		}
+		if c.repair != "" && !strings.Contains(c.repair, "$1") {
+			t.Errorf("pgCheckSql: %s: the repair does not use the key", c.name)
+		}
+	}
+}
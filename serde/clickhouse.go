@@ -0,0 +1,1019 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//
+// A ClickHouse implementation, for large installs where most of the
+// load is writing data points and reading long time ranges of them.
+//
+
+// Nothing is ever updated: every write, including that of a state or
+// of a data point in a slot, is an INSERT of a new row, and the
+// tables are ReplacingMergeTrees which keep the row with the highest
+// wr (write sequence) of each key. The data points of an RRA are
+// thus contiguous in the ts table (its key is the RRA's rra_bundle_id,
+// seg and idx, then the slot i), and an RRA is read with a single
+// range scan. The slot versioning is that of PostgreSQL (see
+// postgres.go). The DS layout is also that of PostgreSQL, but, as in
+// SQLite, a row is that of a single DS or RRA.
+//
+// ClickHouse is spoken to over its HTTP interface, which needs no
+// driver. Times are stored as Unix nanoseconds, NULL being the zero
+// time, and NULL is also NaN (and infinity, which JSON lacks).
+//
+// ClickHouse has no sequences (nor transactions), ids are allocated
+// in blocks claimed in the id_block table, see claimBlock, so that the
+// nodes of a tgres cluster may share a database.
+
+package serde
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/series"
+)
+
+type clickhouseSerDe struct {
+	url    *url.URL // the HTTP interface, with the settings
+	client *http.Client
+	prefix string
+	mu     sync.Mutex            // serializes the creation of DSs
+	wr     int64                 // atomic, the last write sequence
+	owner  string                // of the claimed id blocks, unique to this process
+	blocks map[string]*chIdBlock // the claimed block of every kind of id, with mu held
+}
+
+// chIdBlock is the rest of a claimed block of ids, next to end
+// inclusive.
+type chIdBlock struct{ next, end int64 }
+
+func init() {
+	Register("clickhouse", func(connectString, prefix string) (DbSerDe, error) {
+		db, err := InitClickhouseDb(connectString, prefix)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	})
+}
+
+// InitClickhouseDb connects to the ClickHouse HTTP interface at the
+// URL in connectString, e.g.
+// "http://localhost:8123/?database=tgres&user=tgres&password=secret",
+// and creates the tables if need be. The database must exist.
+func InitClickhouseDb(connectString, prefix string) (*clickhouseSerDe, error) {
+	u, err := url.Parse(connectString)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("InitClickhouseDb(): invalid URL %q, expecting http(s)://host:port/?database=...", connectString)
+	}
+	q := u.Query()
+	q.Set("output_format_json_quote_64bit_integers", "0")
+	u.RawQuery = q.Encode()
+
+	owner := make([]byte, 16)
+	if _, err := rand.Read(owner); err != nil {
+		return nil, err
+	}
+	p := &clickhouseSerDe{url: u, client: &http.Client{Timeout: time.Minute}, prefix: prefix,
+		owner: hex.EncodeToString(owner), blocks: make(map[string]*chIdBlock)}
+	if err := p.query("SELECT 1 AS one", nil, func(*json.Decoder) error { return nil }); err != nil {
+		return nil, err
+	}
+	if err := p.createTablesIfNotExist(); err != nil {
+		return nil, fmt.Errorf("createTablesIfNotExist: %v", err)
+	}
+	return p, nil
+}
+
+func (p *clickhouseSerDe) Fetcher() Fetcher             { return p }
+func (p *clickhouseSerDe) Flusher() Flusher             { return p }
+func (p *clickhouseSerDe) EventListener() EventListener { return p }
+func (p *clickhouseSerDe) DbAddresser() DbAddresser     { return p }
+
+// The nodes of a cluster are not found through the database, see
+// cluster-join and cluster-seeds.
+func (p *clickhouseSerDe) ListDbClientIps() ([]string, error) { return nil, nil }
+func (p *clickhouseSerDe) MyDbAddr() (*string, error)         { return nil, nil }
+
+func (p *clickhouseSerDe) createTablesIfNotExist() error {
+	for _, stmt := range []string{`
+       CREATE TABLE IF NOT EXISTS %[1]sds (
+       id Int64,
+       ident String,
+       step_ms Int64,
+       heartbeat_ms Int64,
+       seg Int64,
+       idx Int64,
+       created_at Int64,
+       ds_type String,
+       archived UInt8,
+       wr Int64)
+       ENGINE = ReplacingMergeTree(wr) ORDER BY id`, `
+       CREATE TABLE IF NOT EXISTS %[1]sds_state (
+       seg Int64,
+       idx Int64,
+       lastupdate Nullable(Int64),
+       duration_ms Int64,
+       value Nullable(Float64),
+       last_raw Nullable(Float64),
+       wr Int64)
+       ENGINE = ReplacingMergeTree(wr) ORDER BY (seg, idx)`, `
+       CREATE TABLE IF NOT EXISTS %[1]srra_bundle (
+       id Int64,
+       step_ms Int64,
+       size Int64,
+       width Int64)
+       ENGINE = ReplacingMergeTree ORDER BY id`, `
+       CREATE TABLE IF NOT EXISTS %[1]srra_state (
+       rra_bundle_id Int64,
+       seg Int64,
+       idx Int64,
+       latest Nullable(Int64),
+       duration_ms Int64,
+       value Nullable(Float64),
+       wr Int64)
+       ENGINE = ReplacingMergeTree(wr) ORDER BY (rra_bundle_id, seg, idx)`, `
+       CREATE TABLE IF NOT EXISTS %[1]srra (
+       id Int64,
+       ds_id Int64,
+       rra_bundle_id Int64,
+       cf String,
+       pos Int64,
+       seg Int64,
+       idx Int64,
+       xff Float32)
+       ENGINE = ReplacingMergeTree ORDER BY (ds_id, id)`, `
+       CREATE TABLE IF NOT EXISTS %[1]sts (
+       rra_bundle_id Int64,
+       seg Int64,
+       idx Int64,
+       i Int64,
+       dp Nullable(Float64),
+       ver Int64,
+       wr Int64)
+       ENGINE = ReplacingMergeTree(wr) ORDER BY (rra_bundle_id, seg, idx, i)`, `
+       CREATE TABLE IF NOT EXISTS %[1]sid_block (
+       kind String,
+       block Int64,
+       owner String,
+       claimed DateTime64(9) DEFAULT now64(9))
+       ENGINE = MergeTree ORDER BY (kind, block)`, `
+       CREATE TABLE IF NOT EXISTS %[1]sdsl_cache (
+       ident String)
+       ENGINE = MergeTree ORDER BY tuple()`,
+	} {
+		if err := p.exec(stmt, nil, nil); err != nil {
+			log.Printf("ERROR: initial CREATE TABLE failed: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// send sends a statement (the table prefix is its %[1]s) with params
+// as its {name:Type} parameters and body as the data of an INSERT, if
+// any, and returns the response body.
+func (p *clickhouseSerDe) send(stmt string, params map[string]string, body io.Reader) (io.ReadCloser, error) {
+	u := *p.url
+	q := u.Query()
+	q.Set("query", fmt.Sprintf(stmt, p.prefix))
+	for k, v := range params {
+		q.Set("param_"+k, v)
+	}
+	u.RawQuery = q.Encode()
+	if body == nil {
+		body = http.NoBody
+	}
+	resp, err := p.client.Post(u.String(), "text/plain", body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("clickhouse: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
+
+// exec sends a statement which returns nothing, see send.
+func (p *clickhouseSerDe) exec(stmt string, params map[string]string, body io.Reader) error {
+	resp, err := p.send(stmt, params, body)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp)
+	return resp.Close()
+}
+
+// query sends a SELECT and calls scan to decode every row of the
+// result, see send.
+func (p *clickhouseSerDe) query(stmt string, params map[string]string, scan func(*json.Decoder) error) error {
+	resp, err := p.send(stmt+" FORMAT JSONEachRow", params, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	dec := json.NewDecoder(resp)
+	for dec.More() {
+		if err := scan(dec); err != nil {
+			return fmt.Errorf("error scanning: %v", err)
+		}
+	}
+	return nil
+}
+
+// insert inserts rows (their JSON is that of the columns) into a
+// table in a single request.
+func (p *clickhouseSerDe) insert(table string, rows []interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, row := range rows {
+		if err := enc.Encode(row); err != nil {
+			return err
+		}
+	}
+	return p.exec("INSERT INTO %[1]s"+table+" FORMAT JSONEachRow", nil, &buf)
+}
+
+// nextWr returns the next write sequence, which is the time in
+// nanoseconds, unless that is not later than the last one.
+func (p *clickhouseSerDe) nextWr() int64 {
+	for {
+		last, wr := atomic.LoadInt64(&(p.wr)), time.Now().UnixNano()
+		if wr <= last {
+			wr = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&(p.wr), last, wr) {
+			return wr
+		}
+	}
+}
+
+// maxId returns the highest value of col in table, 0 if it is empty.
+func (p *clickhouseSerDe) maxId(table, col, where string) (int64, error) {
+	var max int64
+	err := p.query("SELECT max("+col+") AS max FROM %[1]s"+table+where, nil, func(dec *json.Decoder) error {
+		var row struct{ Max int64 }
+		err := dec.Decode(&row)
+		max = row.Max
+		return err
+	})
+	return max, err
+}
+
+// The number of blocks tried by claimBlock before giving up.
+const chClaimAttempts = 16
+
+// allocId returns the next id of kind (1-based, as are positions),
+// claiming a block of width ids if need be, with p.mu held. The ids
+// allocated before there were blocks are the col of table (where).
+// As the block of a DS id or an RRA position is its segment, a node
+// fills segments of its own.
+func (p *clickhouseSerDe) allocId(kind string, width int64, table, col, where string) (int64, error) {
+	b := p.blocks[kind]
+	if b == nil || b.next > b.end {
+		block, err := p.claimBlock(kind, width, table, col, where)
+		if err != nil {
+			return 0, err
+		}
+		b = &chIdBlock{next: block*width + 1, end: (block + 1) * width}
+		p.blocks[kind] = b
+	}
+	id := b.next
+	b.next++
+	return id, nil
+}
+
+// claimBlock claims the first block of kind past those claimed or
+// used. A block is claimed by inserting a row into id_block and then
+// verifying that the earliest claim of it (by the time of the server)
+// is ours, otherwise another node got it and the next one is tried.
+// This relies on an INSERT being visible to the SELECTs that follow
+// it, as it is on a single server (replicas need insert_quorum).
+func (p *clickhouseSerDe) claimBlock(kind string, width int64, table, col, where string) (int64, error) {
+	used, err := p.maxId(table, col, where)
+	if err != nil {
+		return 0, err
+	}
+	var block int64
+	if used > 0 {
+		block = (used-1)/width + 1
+	}
+	params := map[string]string{"kind": kind}
+	err = p.query("SELECT count() AS n, max(block) AS max FROM %[1]sid_block WHERE kind = {kind:String}", params, func(dec *json.Decoder) error {
+		var row struct{ N, Max int64 }
+		err := dec.Decode(&row)
+		if row.N > 0 && row.Max >= block {
+			block = row.Max + 1
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < chClaimAttempts; i, block = i+1, block+1 {
+		if err := p.insert("id_block", []interface{}{&chIdBlockRow{Kind: kind, Block: block, Owner: p.owner}}); err != nil {
+			return 0, err
+		}
+		var owner string
+		params["block"] = strconv.FormatInt(block, 10)
+		err := p.query("SELECT owner FROM %[1]sid_block WHERE kind = {kind:String} AND block = {block:Int64} ORDER BY claimed, owner LIMIT 1", params,
+			func(dec *json.Decoder) error {
+				var row chIdBlockRow
+				err := dec.Decode(&row)
+				owner = row.Owner
+				return err
+			})
+		if err != nil {
+			return 0, err
+		}
+		if owner == p.owner {
+			return block, nil
+		}
+	}
+	return 0, fmt.Errorf("claimBlock(): no block of %s ids claimed in %d attempts", kind, chClaimAttempts)
+}
+
+// clickhouseValue converts a value for storing, see the layout notes
+// above.
+func clickhouseValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Time:
+		if v.IsZero() {
+			return nil
+		}
+		return v.UnixNano()
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil
+		}
+	}
+	return v
+}
+
+func clickhouseTime(ns *int64) *time.Time {
+	t := time.Time{}
+	if ns != nil {
+		t = time.Unix(0, *ns)
+	}
+	return &t
+}
+
+func clickhouseFloat(f *float64) *float64 {
+	v := math.NaN()
+	if f != nil {
+		v = *f
+	}
+	return &v
+}
+
+type chDsRow struct {
+	Id          int64  `json:"id"`
+	Ident       string `json:"ident"`
+	StepMs      int64  `json:"step_ms"`
+	HeartbeatMs int64  `json:"heartbeat_ms"`
+	Seg         int64  `json:"seg"`
+	Idx         int64  `json:"idx"`
+	CreatedAt   int64  `json:"created_at"`
+	DsType      string `json:"ds_type"`
+	Archived    uint8  `json:"archived"`
+	Wr          int64  `json:"wr"`
+}
+
+type chDsStateRow struct {
+	Seg        int64       `json:"seg"`
+	Idx        int64       `json:"idx"`
+	Lastupdate interface{} `json:"lastupdate"`
+	DurationMs interface{} `json:"duration_ms"`
+	Value      interface{} `json:"value"`
+	LastRaw    interface{} `json:"last_raw"`
+	Wr         int64       `json:"wr"`
+}
+
+// chDsState is a chDsStateRow as read.
+type chDsState struct {
+	Seg        int64    `json:"seg"`
+	Idx        int64    `json:"idx"`
+	Lastupdate *int64   `json:"lastupdate"`
+	DurationMs int64    `json:"duration_ms"`
+	Value      *float64 `json:"value"`
+	LastRaw    *float64 `json:"last_raw"`
+}
+
+type chRRABundleRow struct {
+	Id     int64 `json:"id"`
+	StepMs int64 `json:"step_ms"`
+	Size   int64 `json:"size"`
+	Width  int64 `json:"width"`
+}
+
+type chRRARow struct {
+	Id       int64   `json:"id"`
+	DsId     int64   `json:"ds_id"`
+	BundleId int64   `json:"rra_bundle_id"`
+	Cf       string  `json:"cf"`
+	Pos      int64   `json:"pos"`
+	Seg      int64   `json:"seg"`
+	Idx      int64   `json:"idx"`
+	Xff      float32 `json:"xff"`
+}
+
+type chIdBlockRow struct {
+	Kind  string `json:"kind"`
+	Block int64  `json:"block"`
+	Owner string `json:"owner"`
+}
+
+type chRRAStateRow struct {
+	BundleId   int64       `json:"rra_bundle_id"`
+	Seg        int64       `json:"seg"`
+	Idx        int64       `json:"idx"`
+	Latest     interface{} `json:"latest"`
+	DurationMs interface{} `json:"duration_ms"`
+	Value      interface{} `json:"value"`
+	Wr         int64       `json:"wr"`
+}
+
+// chRRAState is a chRRAStateRow as read.
+type chRRAState struct {
+	BundleId   int64    `json:"rra_bundle_id"`
+	Seg        int64    `json:"seg"`
+	Idx        int64    `json:"idx"`
+	Latest     *int64   `json:"latest"`
+	DurationMs int64    `json:"duration_ms"`
+	Value      *float64 `json:"value"`
+}
+
+type chTsRow struct {
+	BundleId int64       `json:"rra_bundle_id"`
+	Seg      int64       `json:"seg"`
+	Idx      int64       `json:"idx"`
+	I        int64       `json:"i"`
+	Dp       interface{} `json:"dp"`
+	Ver      interface{} `json:"ver"`
+	Wr       int64       `json:"wr"`
+}
+
+// The columns of chDsRow, for selecting.
+const chDsColumns = "id, ident, step_ms, heartbeat_ms, seg, idx, created_at, ds_type, archived, wr"
+
+// fetchDsRows returns the (current) rows of the ds table matching
+// where. Unlike with PostgreSQL, the tables are joined here.
+func (p *clickhouseSerDe) fetchDsRows(where string, params map[string]string) ([]*chDsRow, error) {
+	var result []*chDsRow
+	err := p.query("SELECT "+chDsColumns+" FROM %[1]sds FINAL"+where+" ORDER BY id", params, func(dec *json.Decoder) error {
+		var row chDsRow
+		err := dec.Decode(&row)
+		result = append(result, &row)
+		return err
+	})
+	return result, err
+}
+
+// dataSources builds the DSs of ds rows, along with their state and
+// RRAs. If all is false, the DSs are few and only their states and
+// RRAs are fetched, otherwise all of them are.
+func (p *clickhouseSerDe) dataSources(dsRows []*chDsRow, all bool) ([]*DbDataSource, error) {
+	var dsWhere, rraWhere string
+	if !all {
+		var segIdxs, ids []string
+		for _, row := range dsRows {
+			segIdxs = append(segIdxs, fmt.Sprintf("(%d, %d)", row.Seg, row.Idx))
+			ids = append(ids, strconv.FormatInt(row.Id, 10))
+		}
+		dsWhere = " WHERE (seg, idx) IN (" + strings.Join(segIdxs, ", ") + ")"
+		rraWhere = " WHERE ds_id IN (" + strings.Join(ids, ", ") + ")"
+	}
+
+	states := make(map[[2]int64]*chDsState)
+	err := p.query("SELECT seg, idx, lastupdate, duration_ms, value, last_raw FROM %[1]sds_state FINAL"+dsWhere, nil, func(dec *json.Decoder) error {
+		var st chDsState
+		err := dec.Decode(&st)
+		states[[2]int64{st.Seg, st.Idx}] = &st
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	rras, err := p.fetchRRAs(rraWhere)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*DbDataSource, 0, len(dsRows))
+	for _, row := range dsRows {
+		dsr := &dsRecord{id: row.Id, identJson: []byte(row.Ident), stepMs: row.StepMs, hbMs: row.HeartbeatMs,
+			seg: row.Seg, idx: row.Idx, dsType: row.DsType}
+		st := states[[2]int64{row.Seg, row.Idx}]
+		if st == nil {
+			st = &chDsState{}
+		}
+		dsr.lastupdate, dsr.value, dsr.lastRaw = clickhouseTime(st.Lastupdate), clickhouseFloat(st.Value), clickhouseFloat(st.LastRaw)
+		dsr.durationMs = &st.DurationMs
+		ds, err := dataSourceFromDsRec(dsr)
+		if err != nil {
+			return nil, err
+		}
+		ds.SetRRAs(rras[row.Id])
+		result = append(result, ds)
+	}
+	return result, nil
+}
+
+// fetchRRAs returns the RRAs of the rra rows matching where (all if
+// it is blank), along with their bundles and states, by DS id.
+func (p *clickhouseSerDe) fetchRRAs(where string) (map[int64][]rrd.RoundRobinArchiver, error) {
+	var rraRows []*chRRARow
+	err := p.query("SELECT id, ds_id, rra_bundle_id, cf, pos, seg, idx, xff FROM %[1]srra FINAL"+where+" ORDER BY id", nil, func(dec *json.Decoder) error {
+		var row chRRARow
+		err := dec.Decode(&row)
+		rraRows = append(rraRows, &row)
+		return err
+	})
+	if err != nil || len(rraRows) == 0 {
+		return nil, err
+	}
+
+	bundles := make(map[int64]*rraBundleRecord)
+	err = p.query("SELECT id, step_ms, size, width FROM %[1]srra_bundle FINAL", nil, func(dec *json.Decoder) error {
+		var row chRRABundleRow
+		err := dec.Decode(&row)
+		bundles[row.Id] = &rraBundleRecord{id: row.Id, stepMs: row.StepMs, size: row.Size, width: row.Width}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var stateWhere string
+	if where != "" {
+		var keys []string
+		for _, row := range rraRows {
+			keys = append(keys, fmt.Sprintf("(%d, %d, %d)", row.BundleId, row.Seg, row.Idx))
+		}
+		stateWhere = " WHERE (rra_bundle_id, seg, idx) IN (" + strings.Join(keys, ", ") + ")"
+	}
+	states := make(map[[3]int64]*chRRAState)
+	err = p.query("SELECT rra_bundle_id, seg, idx, latest, duration_ms, value FROM %[1]srra_state FINAL"+stateWhere, nil, func(dec *json.Decoder) error {
+		var st chRRAState
+		err := dec.Decode(&st)
+		states[[3]int64{st.BundleId, st.Seg, st.Idx}] = &st
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[int64][]rrd.RoundRobinArchiver)
+	for _, row := range rraRows {
+		bundle := bundles[row.BundleId]
+		if bundle == nil {
+			return nil, fmt.Errorf("rra_bundle %d of RRA %d not found", row.BundleId, row.Id)
+		}
+		st := states[[3]int64{row.BundleId, row.Seg, row.Idx}]
+		if st == nil {
+			st = &chRRAState{}
+		}
+		rrar := &rraRecord{id: row.Id, dsId: row.DsId, bundleId: row.BundleId, pos: row.Pos, seg: row.Seg, idx: row.Idx, cf: row.Cf, xff: row.Xff}
+		rra, err := rraFromRRARecordStateAndBundle(rrar,
+			&rraStateRecord{latest: clickhouseTime(st.Latest), value: clickhouseFloat(st.Value), durationMs: &st.DurationMs}, bundle)
+		if err != nil {
+			return nil, err
+		}
+		result[row.DsId] = append(result[row.DsId], rra)
+	}
+	return result, nil
+}
+
+func (p *clickhouseSerDe) FetchDataSources() ([]rrd.DataSourcer, error) {
+	dsRows, err := p.fetchDsRows("", nil)
+	if err != nil {
+		log.Printf("FetchDataSources(): error querying database: %v", err)
+		return nil, err
+	}
+	// archived is filtered here, a WHERE could see an older row
+	current := dsRows[:0]
+	for _, row := range dsRows {
+		if row.Archived == 0 {
+			current = append(current, row)
+		}
+	}
+	dss, err := p.dataSources(current, true)
+	if err != nil {
+		log.Printf("FetchDataSources(): %v", err)
+		return nil, err
+	}
+	result := make([]rrd.DataSourcer, 0, len(dss))
+	for _, ds := range dss {
+		if len(ds.RRAs()) > 0 { // as in PostgreSQL, a DS without RRAs is not loaded
+			result = append(result, ds)
+		}
+	}
+	return result, nil
+}
+
+// fetchDataSource returns the DS with this ident and its row, or nil
+// if there is none.
+func (p *clickhouseSerDe) fetchDataSource(ident Ident) (*DbDataSource, *chDsRow, error) {
+	dsRows, err := p.fetchDsRows(" WHERE ident = {ident:String}", map[string]string{"ident": ident.String()})
+	if err != nil || len(dsRows) == 0 {
+		return nil, nil, err
+	}
+	dss, err := p.dataSources(dsRows[:1], false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dss[0], dsRows[0], nil
+}
+
+// setArchived (re)writes the row of a DS with archived set.
+func (p *clickhouseSerDe) setArchived(row *chDsRow, archived bool) error {
+	r := *row
+	r.Archived, r.Wr = 0, p.nextWr()
+	if archived {
+		r.Archived = 1
+	}
+	return p.insert("ds", []interface{}{&r})
+}
+
+// ArchiveDataSource marks a DS as archived, as in PostgreSQL.
+func (p *clickhouseSerDe) ArchiveDataSource(id int64) error {
+	dsRows, err := p.fetchDsRows(fmt.Sprintf(" WHERE id = %d", id), nil)
+	if err == nil && len(dsRows) > 0 {
+		err = p.setArchived(dsRows[0], true)
+	}
+	if err != nil {
+		log.Printf("ArchiveDataSource(): error updating database: %v", err)
+	}
+	return err
+}
+
+// FetchOrCreateDataSource loads or creates a DS. The returned DS
+// contains no data (use FetchSeries). A nil dsSpec means fetch only,
+// do not create.
+func (p *clickhouseSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	ds, row, err := p.fetchDataSource(ident)
+	if err != nil {
+		log.Printf("FetchOrCreateDataSource(): error fetching DS: %v", err)
+		return nil, err
+	}
+	if ds != nil {
+		if dsSpec != nil && row.Archived != 0 { // see pgvSerDe.FetchOrCreateDataSource
+			if err := p.setArchived(row, false); err != nil {
+				log.Printf("FetchOrCreateDataSource(): error unarchiving DS: %v", err)
+				return nil, err
+			}
+		}
+		return ds, nil
+	}
+	if dsSpec == nil {
+		return nil, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ds, _, err = p.fetchDataSource(ident); ds != nil || err != nil { // created while we waited
+		return ds, err
+	}
+	if ds, err = p.createDataSource(ident, dsSpec); err != nil {
+		log.Printf("FetchOrCreateDataSource(): error creating DS: %v", err)
+		return nil, err
+	}
+	return ds, nil
+}
+
+// createDataSource creates a DS, its state and RRAs, with p.mu held.
+// The ds row is inserted last, there is no transaction and until then
+// the DS does not exist.
+func (p *clickhouseSerDe) createDataSource(ident Ident, dsSpec *rrd.DSSpec) (*DbDataSource, error) {
+	id, err := p.allocId("ds", int64(PgSegmentWidth), "ds", "id", "")
+	if err != nil {
+		return nil, err
+	}
+	seg, idx := segIdxFromPosWidth(id, int64(PgSegmentWidth)) // like the PostgreSQL defaults
+	dsRow := &chDsRow{Id: id, Ident: ident.String(), StepMs: dsSpec.Step.Nanoseconds() / 1e6, HeartbeatMs: dsSpec.Heartbeat.Nanoseconds() / 1e6,
+		Seg: seg, Idx: idx, CreatedAt: time.Now().UnixNano(), DsType: dsSpec.Type.String()}
+
+	ds, err := dataSourceFromDsRec(&dsRecord{id: id, identJson: []byte(dsRow.Ident), stepMs: dsRow.StepMs, hbMs: dsRow.HeartbeatMs,
+		seg: seg, idx: idx, created: true, dsType: dsRow.DsType})
+	if err != nil {
+		return nil, err
+	}
+
+	var rras []rrd.RoundRobinArchiver
+	for _, rraSpec := range dsSpec.RRAs {
+		bundle, err := p.rraBundle(rraSpec.Step.Nanoseconds()/1e6, rraSpec.Span.Nanoseconds()/rraSpec.Step.Nanoseconds())
+		if err != nil {
+			return nil, err
+		}
+		pos, err := p.allocId(fmt.Sprintf("pos:%d", bundle.id), bundle.width, "rra", "pos", fmt.Sprintf(" WHERE rra_bundle_id = %d", bundle.id))
+		if err != nil {
+			return nil, err
+		}
+		rraId, err := p.allocId("rra", int64(PgSegmentWidth), "rra", "id", "")
+		if err != nil {
+			return nil, err
+		}
+
+		rraRec := &rraRecord{id: rraId, dsId: id, bundleId: bundle.id, pos: pos, cf: cfName(rraSpec.Function), xff: rraSpec.Xff}
+		rraRec.seg, rraRec.idx = segIdxFromPosWidth(rraRec.pos, bundle.width)
+		dur := rraSpec.Duration.Nanoseconds() / 1e6
+		if err = p.insert("rra_state", []interface{}{&chRRAStateRow{BundleId: bundle.id, Seg: rraRec.seg, Idx: rraRec.idx,
+			Latest: clickhouseValue(rraSpec.Latest), DurationMs: dur, Value: clickhouseValue(rraSpec.Value), Wr: p.nextWr()}}); err != nil {
+			return nil, err
+		}
+		if err = p.insert("rra", []interface{}{&chRRARow{Id: rraRec.id, DsId: id, BundleId: bundle.id, Cf: rraRec.cf,
+			Pos: rraRec.pos, Seg: rraRec.seg, Idx: rraRec.idx, Xff: rraSpec.Xff}}); err != nil {
+			return nil, err
+		}
+
+		rra, err := rraFromRRARecordStateAndBundle(rraRec, &rraStateRecord{latest: &rraSpec.Latest, durationMs: &dur, value: &rraSpec.Value}, bundle)
+		if err != nil {
+			return nil, err
+		}
+		rras = append(rras, rra)
+	}
+
+	if err = p.insert("ds_state", []interface{}{&chDsStateRow{Seg: seg, Idx: idx, DurationMs: 0, Wr: p.nextWr()}}); err != nil {
+		return nil, err
+	}
+	if err = p.insert("ds", []interface{}{dsRow}); err != nil {
+		return nil, err
+	}
+	ds.SetRRAs(rras)
+	return ds, nil
+}
+
+// rraBundle returns the bundle of this step and size, creating it if
+// need be, with p.mu held. Should two nodes have created one at once,
+// the first is used from then on.
+func (p *clickhouseSerDe) rraBundle(stepMs, size int64) (*rraBundleRecord, error) {
+	var bundle *rraBundleRecord
+	err := p.query(fmt.Sprintf("SELECT id, step_ms, size, width FROM %%[1]srra_bundle FINAL WHERE step_ms = %d AND size = %d ORDER BY id LIMIT 1", stepMs, size),
+		nil, func(dec *json.Decoder) error {
+			var row chRRABundleRow
+			err := dec.Decode(&row)
+			bundle = &rraBundleRecord{id: row.Id, stepMs: row.StepMs, size: row.Size, width: row.Width}
+			return err
+		})
+	if err != nil || bundle != nil {
+		return bundle, err
+	}
+	id, err := p.allocId("rra_bundle", 1, "rra_bundle", "id", "")
+	if err != nil {
+		return nil, err
+	}
+	bundle = &rraBundleRecord{id: id, stepMs: stepMs, size: size, width: int64(PgSegmentWidth)}
+	return bundle, p.insert("rra_bundle", []interface{}{&chRRABundleRow{Id: bundle.id, StepMs: stepMs, Size: size, Width: bundle.width}})
+}
+
+// Search returns the idents matching the query, see
+// SearchQuery.matcher. The matching is done here, as in SQLite.
+func (p *clickhouseSerDe) Search(query SearchQuery) (SearchResult, error) {
+	match, err := query.matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	dsRows, err := p.fetchDsRows("", nil)
+	if err != nil {
+		log.Printf("Search(): error querying database: %v", err)
+		return nil, err
+	}
+
+	sr := newIdentSearchResult()
+	for _, row := range dsRows {
+		var ident Ident
+		if err := json.Unmarshal([]byte(row.Ident), &ident); err != nil {
+			log.Printf("Search(): error unmarshalling ident %q: %v", row.Ident, err)
+			continue
+		}
+		if match(ident) {
+			sr.add(ident, row.Archived != 0)
+		}
+	}
+	return sr, nil
+}
+
+// FetchSeries loads the data of the most suitable RRA and presents it
+// as a series, see rraDataSeries.
+func (p *clickhouseSerDe) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	return rraDataSeries(ds, from, to, maxPoints, p.LoadRRAData)
+}
+
+// LoadRRAData returns a new RRA based on the one passed in and
+// containing all of its current data points, see
+// pgvSerDe.LoadRRAData. The latest row of every slot is that with the
+// highest wr, regardless of whether its dp is NULL, hence the tuple.
+func (p *clickhouseSerDe) LoadRRAData(rra rrd.RoundRobinArchiver) (rrd.RoundRobinArchiver, error) {
+	dbrra, ok := rra.(*DbRoundRobinArchive)
+	if !ok {
+		return nil, fmt.Errorf("LoadRRAData: Not a *DbRoundRobinArchive")
+	}
+
+	var dps map[int64]float64
+	if !rra.Latest().IsZero() {
+		latestI, latestVer, prevVer := slotVersions(dbrra)
+		dps = make(map[int64]float64)
+		err := p.query(fmt.Sprintf("SELECT i, t.1 AS v FROM ("+
+			"SELECT i, argMax((dp, ver), wr) AS t FROM %%[1]sts "+
+			"WHERE rra_bundle_id = %d AND seg = %d AND idx = %d GROUP BY i) "+
+			"WHERE t.1 IS NOT NULL AND ((i <= %d AND t.2 = %d) OR (i > %d AND t.2 = %d))",
+			dbrra.BundleId(), dbrra.Seg(), dbrra.Idx(), latestI, latestVer, latestI, prevVer), nil, func(dec *json.Decoder) error {
+			var row struct {
+				I int64   `json:"i"`
+				V float64 `json:"v"`
+			}
+			err := dec.Decode(&row)
+			dps[row.I] = row.V
+			return err
+		})
+		if err != nil {
+			log.Printf("LoadRRAData: error %v", err)
+			return nil, err
+		}
+	}
+
+	spec := dbrra.Spec()
+	spec.Latest = dbrra.Latest()
+	spec.Value = dbrra.Value()
+	spec.Duration = dbrra.Duration()
+	spec.DPs = dps
+	return newDbRoundRobinArchive(dbrra.id, dbrra.width, dbrra.bundleId, dbrra.pos, spec)
+}
+
+// TsTableSize returns the size of the ts table on disk and the
+// number of its rows, which, until the parts are merged, includes
+// replaced data points.
+func (p *clickhouseSerDe) TsTableSize() (size, count int64, err error) {
+	err = p.query("SELECT sum(bytes_on_disk) AS size, sum(rows) AS count FROM system.parts "+
+		"WHERE active AND database = currentDatabase() AND table = {table:String}",
+		map[string]string{"table": p.prefix + "ts"}, func(dec *json.Decoder) error {
+			var row struct{ Size, Count int64 }
+			err := dec.Decode(&row)
+			size, count = row.Size, row.Count
+			return err
+		})
+	return size, count, err
+}
+
+// RegisterDeleteListener does nothing, ClickHouse has no
+// notifications. A DS deleted from the database stays in the cache
+// until restart.
+func (p *clickhouseSerDe) RegisterDeleteListener(func(Ident)) error {
+	return nil
+}
+
+// clickhouseFlusher inserts the rows of every flush right away or,
+// if it is a batch, those of all flushes on Commit, one INSERT per
+// table, which is what ClickHouse is best at. (The batch is not
+// atomic, but rows inserted twice are merged away.)
+type clickhouseFlusher struct {
+	p    *clickhouseSerDe
+	rows map[string][]interface{} // by table, nil is not a batch
+}
+
+func (f *clickhouseFlusher) add(table string, rows []interface{}) (int, error) {
+	if f.rows == nil {
+		return 1, f.p.insert(table, rows)
+	}
+	f.rows[table] = append(f.rows[table], rows...)
+	return 1, nil
+}
+
+func (f *clickhouseFlusher) Commit() error {
+	for _, table := range []string{"ts", "rra_state", "ds_state"} {
+		if err := f.p.insert(table, f.rows[table]); err != nil {
+			return err
+		}
+	}
+	f.rows = make(map[string][]interface{})
+	return nil
+}
+
+func (f *clickhouseFlusher) Rollback() error {
+	f.rows = make(map[string][]interface{})
+	return nil
+}
+
+// BeginFlushBatch returns a FlushBatch whose rows are all inserted on
+// Commit.
+func (p *clickhouseSerDe) BeginFlushBatch() (FlushBatch, error) {
+	return &clickhouseFlusher{p: p, rows: make(map[string][]interface{})}, nil
+}
+
+func (p *clickhouseSerDe) FlushDSStates(seg int64, lastupdate, value, duration, lastRaw map[int64]interface{}) (int, error) {
+	return (&clickhouseFlusher{p: p}).FlushDSStates(seg, lastupdate, value, duration, lastRaw)
+}
+
+func (p *clickhouseSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]interface{}) (int, error) {
+	return (&clickhouseFlusher{p: p}).FlushDataPoints(bundle_id, seg, i, dps, vers)
+}
+
+func (p *clickhouseSerDe) FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (int, error) {
+	return (&clickhouseFlusher{p: p}).FlushRRAStates(bundle_id, seg, latests, value, duration)
+}
+
+// The state of a DS or RRA is always flushed in its entirety, i.e.
+// the maps have the same idxs.
+
+func (f *clickhouseFlusher) FlushDSStates(seg int64, lastupdate, value, duration, lastRaw map[int64]interface{}) (int, error) {
+	wr := f.p.nextWr()
+	rows := make([]interface{}, 0, len(lastupdate))
+	for idx, lu := range lastupdate {
+		rows = append(rows, &chDsStateRow{Seg: seg, Idx: idx, Lastupdate: clickhouseValue(lu), DurationMs: duration[idx],
+			Value: clickhouseValue(value[idx]), LastRaw: clickhouseValue(lastRaw[idx]), Wr: wr})
+	}
+	return f.add("ds_state", rows)
+}
+
+func (f *clickhouseFlusher) FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (int, error) {
+	wr := f.p.nextWr()
+	rows := make([]interface{}, 0, len(latests))
+	for idx, latest := range latests {
+		rows = append(rows, &chRRAStateRow{BundleId: bundle_id, Seg: seg, Idx: idx, Latest: clickhouseValue(latest),
+			DurationMs: duration[idx], Value: clickhouseValue(value[idx]), Wr: wr})
+	}
+	return f.add("rra_state", rows)
+}
+
+func (f *clickhouseFlusher) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]interface{}) (int, error) {
+	wr := f.p.nextWr()
+	rows := make([]interface{}, 0, len(dps))
+	for idx, dp := range dps {
+		rows = append(rows, &chTsRow{BundleId: bundle_id, Seg: seg, Idx: idx, I: i, Dp: clickhouseValue(dp), Ver: vers[idx], Wr: wr})
+	}
+	return f.add("ts", rows)
+}
+
+// DSL LRU keys
+
+func (p *clickhouseSerDe) SaveDSLCacheKeys(idents []Ident) error {
+	rows := make([]interface{}, 0, len(idents))
+	for _, ident := range idents {
+		rows = append(rows, map[string]string{"ident": ident.String()})
+	}
+	err := p.exec("TRUNCATE TABLE IF EXISTS %[1]sdsl_cache", nil, nil)
+	if err == nil {
+		err = p.insert("dsl_cache", rows)
+	}
+	if err != nil {
+		log.Printf("SaveDSLCacheKeys(): %v", err)
+	}
+	return err
+}
+
+func (p *clickhouseSerDe) LoadDSLCacheKeys() ([]Ident, error) {
+	var result []Ident
+	err := p.query("SELECT ident FROM %[1]sdsl_cache", nil, func(dec *json.Decoder) error {
+		var row struct {
+			Ident string `json:"ident"`
+		}
+		if err := dec.Decode(&row); err != nil {
+			return err
+		}
+		var ident Ident
+		if err := json.Unmarshal([]byte(row.Ident), &ident); err != nil {
+			log.Printf("LoadDSLCacheKeys(): error unmarshalling ident: %v", err)
+			return nil
+		}
+		result = append(result, ident)
+		return nil
+	})
+	if err != nil {
+		log.Printf("LoadDSLCacheKeys(): %v", err)
+		return nil, err
+	}
+	return result, nil
+}
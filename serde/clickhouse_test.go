@@ -0,0 +1,208 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// fakeClickhouse records the statements and data it is sent and
+// answers queries with the rows of the first matching entry in
+// results (by substring of the statement).
+type fakeClickhouse struct {
+	sync.Mutex
+	stmts   []string
+	data    []string
+	results map[string]string
+}
+
+func (f *fakeClickhouse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	stmt := r.URL.Query().Get("query")
+	if r.URL.Query().Get("output_format_json_quote_64bit_integers") != "0" {
+		http.Error(w, "settings missing", http.StatusBadRequest)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	f.stmts, f.data = append(f.stmts, stmt), append(f.data, string(body))
+	if strings.Contains(stmt, "syntax error") {
+		http.Error(w, "Code: 62. DB::Exception: Syntax error", http.StatusBadRequest)
+		return
+	}
+	for k, v := range f.results {
+		if strings.Contains(stmt, k) {
+			w.Write([]byte(v))
+			return
+		}
+	}
+}
+
+func (f *fakeClickhouse) last() (string, string) {
+	f.Lock()
+	defer f.Unlock()
+	return f.stmts[len(f.stmts)-1], f.data[len(f.data)-1]
+}
+
+func Test_clickhouseSerDe(t *testing.T) {
+	if _, err := InitClickhouseDb("localhost:8123", ""); err == nil {
+		t.Errorf("InitClickhouseDb: no error for a URL without a scheme")
+	}
+
+	fake := &fakeClickhouse{results: map[string]string{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	p, err := InitClickhouseDb(srv.URL+"/?database=tgres", "tgres_")
+	if err != nil {
+		t.Fatalf("InitClickhouseDb: %v", err)
+	}
+	if stmt, _ := fake.last(); !strings.Contains(stmt, "CREATE TABLE IF NOT EXISTS tgres_dsl_cache") {
+		t.Errorf("InitClickhouseDb: expected the tables to be created, last statement: %q", stmt)
+	}
+
+	if err := p.exec("syntax error", nil, nil); err == nil || !strings.Contains(err.Error(), "Syntax error") {
+		t.Errorf("exec: expected the error of the server, got %v", err)
+	}
+
+	// Data points, NaN is NULL
+	if _, err := p.FlushDataPoints(1, 0, 5, map[int64]interface{}{2: math.NaN()}, map[int64]interface{}{2: 3}); err != nil {
+		t.Fatal(err)
+	}
+	stmt, data := fake.last()
+	if stmt != "INSERT INTO tgres_ts FORMAT JSONEachRow" || !strings.Contains(data, `"i":5,"dp":null,"ver":3`) {
+		t.Errorf("FlushDataPoints: unexpected %q %q", stmt, data)
+	}
+
+	// A batch is inserted on Commit, one INSERT per table
+	fb, _ := p.BeginFlushBatch()
+	n := len(fake.stmts)
+	fb.FlushDSStates(0, map[int64]interface{}{1: time.Unix(100, 0)}, map[int64]interface{}{1: 1.5},
+		map[int64]interface{}{1: int64(10)}, map[int64]interface{}{1: 2.0})
+	fb.FlushDataPoints(1, 0, 6, map[int64]interface{}{2: 1.0}, map[int64]interface{}{2: 3})
+	fb.FlushDataPoints(1, 0, 7, map[int64]interface{}{2: 2.0}, map[int64]interface{}{2: 3})
+	if len(fake.stmts) != n {
+		t.Errorf("FlushBatch: rows inserted before Commit")
+	}
+	if err := fb.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.stmts) != n+2 {
+		t.Errorf("FlushBatch: expected 2 INSERTs, got %d", len(fake.stmts)-n)
+	}
+	stmt, data = fake.last()
+	if stmt != "INSERT INTO tgres_ds_state FORMAT JSONEachRow" || !strings.Contains(data, `"lastupdate":100000000000,"duration_ms":10,"value":1.5,"last_raw":2`) {
+		t.Errorf("FlushBatch: unexpected %q %q", stmt, data)
+	}
+
+	// Loading an RRA
+	rra, _ := newDbRoundRobinArchive(1, 10, 1, 2, rrd.RRASpec{Step: time.Second, Span: 10 * time.Second,
+		Latest: time.Unix(25, 0), Function: rrd.WMEAN})
+	fake.results["argMax"] = "{\"i\":4,\"v\":1.5}\n{\"i\":5,\"v\":2}\n"
+	loaded, err := p.LoadRRAData(rra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dps := loaded.DPs(); len(dps) != 2 || dps[4] != 1.5 || dps[5] != 2 {
+		t.Errorf("LoadRRAData: unexpected %v", dps)
+	}
+	if stmt, _ := fake.last(); !strings.Contains(stmt, "(i <= 5 AND t.2 = 2) OR (i > 5 AND t.2 = 1)") {
+		t.Errorf("LoadRRAData: unexpected versions in %q", stmt)
+	}
+}
+
+// fakeIdBlocks answers the statements of claimBlock. A rival claim is
+// recorded ahead of the first one, as if another node had claimed the
+// same block at the same time.
+type fakeIdBlocks struct {
+	sync.Mutex
+	claims []chIdBlockRow // in the order claimed
+	rival  bool
+}
+
+func (f *fakeIdBlocks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	q := r.URL.Query()
+	stmt := q.Get("query")
+	switch {
+	case strings.HasPrefix(stmt, "INSERT INTO id_block"):
+		var row chIdBlockRow
+		json.NewDecoder(r.Body).Decode(&row)
+		if f.rival {
+			f.rival = false
+			f.claims = append(f.claims, chIdBlockRow{Kind: row.Kind, Block: row.Block, Owner: "rival"})
+		}
+		f.claims = append(f.claims, row)
+	case strings.Contains(stmt, "count() AS n"):
+		n, max := 0, int64(0)
+		for _, c := range f.claims {
+			if c.Kind == q.Get("param_kind") {
+				if n++; c.Block > max {
+					max = c.Block
+				}
+			}
+		}
+		fmt.Fprintf(w, "{\"n\":%d,\"max\":%d}\n", n, max)
+	case strings.Contains(stmt, "SELECT owner"):
+		for _, c := range f.claims {
+			if c.Kind == q.Get("param_kind") && strconv.FormatInt(c.Block, 10) == q.Get("param_block") {
+				fmt.Fprintf(w, "{\"owner\":%q}\n", c.Owner)
+				break
+			}
+		}
+	case strings.Contains(stmt, "SELECT max(id)"):
+		fmt.Fprint(w, "{\"max\":3}\n") // allocated before there were blocks
+	}
+}
+
+func Test_clickhouseSerDe_allocId(t *testing.T) {
+	fake := &fakeIdBlocks{rival: true}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	p1, err := InitClickhouseDb(srv.URL+"/?database=tgres", "")
+	if err != nil {
+		t.Fatalf("InitClickhouseDb: %v", err)
+	}
+	p2, _ := InitClickhouseDb(srv.URL+"/?database=tgres", "")
+
+	// Block 0 is in use, block 1 is lost to the rival
+	for _, expect := range []int64{21, 22} {
+		if id, err := p1.allocId("ds", 10, "ds", "id", ""); err != nil || id != expect {
+			t.Errorf("allocId: expected %d, got %d %v", expect, id, err)
+		}
+	}
+	// Another node gets the next block
+	if id, err := p2.allocId("ds", 10, "ds", "id", ""); err != nil || id != 31 {
+		t.Errorf("allocId: expected 31 for another node, got %d %v", id, err)
+	}
+	if len(fake.claims) != 4 || fake.claims[3].Owner != p2.owner || fake.claims[3].Block != 3 {
+		t.Errorf("allocId: unexpected claims %v", fake.claims)
+	}
+}
@@ -82,4 +82,6 @@ type dsRecord struct {
 	seg        int64
 	idx        int64
 	created    bool
+	dsType     string
+	lastRaw    *float64
 }
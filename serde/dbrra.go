@@ -20,6 +20,7 @@ import (
 	"time"
 
 	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/series"
 )
 
 type DbRoundRobinArchiver interface {
@@ -59,6 +60,68 @@ func segIdxFromPosWidth(pos, width int64) (seg, idx int64) {
 	return (pos - 1) / width, (pos-1)%width + 1
 }
 
+// cfName is how a consolidation function is stored in the rra table.
+func cfName(f rrd.Consolidation) string {
+	switch f {
+	case rrd.WMEAN:
+		return "WMEAN"
+	case rrd.MIN:
+		return "MIN"
+	case rrd.MAX:
+		return "MAX"
+	case rrd.LAST:
+		return "LAST"
+	}
+	return ""
+}
+
+// slotVersions returns the index of the latest slot of an RRA and
+// the versions that the slots up to and including it and those after
+// it (i.e. from the previous time round) must have to be current.
+// The version is incremented every time round, see the data layout
+// notes in postgres.go.
+func slotVersions(rra *DbRoundRobinArchive) (latestI int64, latestVer, prevVer int) {
+	latestI = rrd.SlotIndex(rra.Latest(), rra.Step(), rra.Size())
+	spanMs := (rra.Step().Nanoseconds() / 1e6) * rra.Size()
+	latestMs := rra.Latest().UnixNano() / 1e6
+	latestVer = int((latestMs / spanMs) % 32767)
+	prevVer = latestVer - 1
+	if prevVer == -1 {
+		prevVer = 32767
+	}
+	return latestI, latestVer, prevVer
+}
+
+// rraDataSeries is FetchSeries for backends which cannot group in
+// the query: the data of the most suitable RRA is all loaded, and
+// grouped by the series.
+func rraDataSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64,
+	load func(rrd.RoundRobinArchiver) (rrd.RoundRobinArchiver, error)) (series.Series, error) {
+	dbds, ok := ds.(DbDataSourcer)
+	if !ok {
+		return nil, fmt.Errorf("FetchSeries: ds must be a DbDataSourcer")
+	}
+
+	rra := dbds.BestRRA(from, to, maxPoints)
+	if rra == nil {
+		return nil, fmt.Errorf("FetchSeries: No adequate RRA found for DS id: %v from: %v to: %v maxPoints: %v", dbds.Id(), from, to, maxPoints)
+	}
+	if rraEarliest := rra.Begins(rra.Latest()); from.IsZero() || rraEarliest.After(from) {
+		from = rraEarliest
+	}
+
+	loaded, err := load(rra)
+	if err != nil {
+		return nil, err
+	}
+	s := series.NewRRASeries(loaded)
+	if !to.IsZero() {
+		s.TimeRange(from, to)
+	}
+	s.MaxPoints(maxPoints)
+	return s, nil
+}
+
 func newDbRoundRobinArchive(id, width, bundleId, pos int64, spec rrd.RRASpec) (*DbRoundRobinArchive, error) {
 	if spec.Span == 0 {
 		return nil, fmt.Errorf("Invalid span: Span cannot be 0.")
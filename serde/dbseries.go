@@ -20,7 +20,10 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"sync"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 type dbSeries struct {
@@ -48,6 +51,17 @@ type dbSeries struct {
 
 	// Alias
 	alias string
+
+	// Batch stuff, see dbSeriesBatch
+	batch    *dbSeriesBatch
+	buf      []dbPoint // read by the batch, nil if not buffered
+	bufPos   int
+	bufGroup time.Duration
+}
+
+type dbPoint struct {
+	t time.Time
+	v float64
 }
 
 func (dps *dbSeries) Step() time.Duration {
@@ -93,12 +107,8 @@ func (dps *dbSeries) Alias(s ...string) string {
 	return dps.alias
 }
 
-func (dps *dbSeries) seriesQuerySqlUsingViewAndSeries() (*sql.Rows, error) {
-	var (
-		rows *sql.Rows
-		err  error
-	)
-
+// finalGroupByMs is the group by interval of the series query.
+func (dps *dbSeries) finalGroupByMs() int64 {
 	var (
 		finalGroupByMs int64
 		groupByMs      = dps.groupBy.Nanoseconds() / 1e6
@@ -120,6 +130,19 @@ func (dps *dbSeries) seriesQuerySqlUsingViewAndSeries() (*sql.Rows, error) {
 	if finalGroupByMs == 0 {
 		finalGroupByMs = 1000 // TODO Why would this happen (it did)?
 	}
+	return finalGroupByMs
+}
+
+func (dps *dbSeries) seriesQuerySqlUsingViewAndSeries() (*sql.Rows, error) {
+	var (
+		rows *sql.Rows
+		err  error
+	)
+
+	var (
+		finalGroupByMs = dps.finalGroupByMs()
+		rraStepMs      = dps.rra.Step().Nanoseconds() / 1e6
+	)
 
 	// Ensure that the true group by interval is reflected in the series.
 	if finalGroupByMs != dps.groupBy.Nanoseconds()/1e6 {
@@ -142,7 +165,9 @@ func (dps *dbSeries) seriesQuerySqlUsingViewAndSeries() (*sql.Rows, error) {
 			finalGroupByMs)
 		log.Printf("seriesQuerySqlUsingViewAndSeries() sqlSelectSeries -- " + sqlStatement)
 	}
-	rows, err = dps.db.sqlSelectSeries.Query(aligned_from, dps.to, fmt.Sprintf("%d milliseconds", rraStepMs), dps.ds.Id(), dps.rra.Id(), dps.from, dps.to, finalGroupByMs)
+	start := time.Now()
+	rows, err = dps.db.reader().sqlSelectSeries.Query(aligned_from, dps.to, fmt.Sprintf("%d milliseconds", rraStepMs), dps.ds.Id(), dps.rra.Id(), dps.from, dps.to, finalGroupByMs)
+	dps.db.ops.observe(opFetchSeries, start, 0, err) // the rows are counted by Next()
 
 	if err != nil {
 		log.Printf("seriesQuery(): error %v", err)
@@ -154,6 +179,26 @@ func (dps *dbSeries) seriesQuerySqlUsingViewAndSeries() (*sql.Rows, error) {
 
 func (dps *dbSeries) Next() bool {
 
+	if dps.rows == nil && dps.buf == nil && dps.batch != nil { // First Next()
+		dps.batch.load()
+		if buf, ok := dps.batch.take(dps); ok {
+			dps.buf, dps.bufPos = buf, 0
+			dps.groupBy = dps.bufGroup
+		}
+	}
+
+	if dps.buf != nil {
+		if dps.bufPos < len(dps.buf) {
+			dps.posBegin = dps.latest
+			dps.posEnd = dps.buf[dps.bufPos].t
+			dps.value = dps.buf[dps.bufPos].v
+			dps.latest = dps.posEnd
+			dps.bufPos++
+			return true
+		}
+		return false
+	}
+
 	if dps.rows == nil { // First Next()
 		rows, err := dps.seriesQuerySqlUsingViewAndSeries()
 		if err == nil {
@@ -169,6 +214,7 @@ func (dps *dbSeries) Next() bool {
 			log.Printf("dbSeries.Next(): database error: %v", err)
 			return false
 		} else {
+			dps.db.ops.addRows(opFetchSeries, 1)
 			dps.posBegin = dps.latest
 			dps.posEnd = ts
 			dps.value = value
@@ -188,6 +234,10 @@ func (dps *dbSeries) CurrentTime() time.Time {
 }
 
 func (dps *dbSeries) Close() error {
+	if dps.buf != nil {
+		dps.buf, dps.batch = nil, nil // next Next() will re-open with a query
+		return nil
+	}
 	if dps.rows == nil {
 		return fmt.Errorf("Close() on dbSeries that isn not open.")
 	}
@@ -211,3 +261,167 @@ func timeValueFromRow(rows *sql.Rows) (time.Time, float64, error) {
 		return time.Time{}, math.NaN(), err
 	}
 }
+
+// The batched series query: the series query of every series of a
+// dbSeriesBatch at once, the RRA ids and the per series parameters
+// are arrays. The ordinality tells the series apart, because one RRA
+// may appear in more than one series.
+const pgSelectSeriesBatchSql = `
+SELECT x.n, max(tg) mt, avg(r) ar
+  FROM unnest($1::bigint[], $2::bigint[], $3::bigint[], $4::bigint[], $5::bigint[], $6::bigint[])
+       WITH ORDINALITY AS x(rra_id, step_ms, group_ms, aligned_ms, from_ms, to_ms, n)
+ CROSS JOIN LATERAL generate_series(to_timestamp(x.aligned_ms/1000.0), to_timestamp(x.to_ms/1000.0), x.step_ms * '1 millisecond'::interval) AS tg
+  LEFT OUTER JOIN (SELECT rra_id, t, r FROM %[1]stv tv WHERE rra_id = ANY($1) AND t >= $7 AND t <= $8) s
+    ON s.rra_id = x.rra_id AND s.t = tg AND s.t >= to_timestamp(x.from_ms/1000.0) AND s.t <= to_timestamp(x.to_ms/1000.0)
+ GROUP BY x.n, trunc((extract(epoch from tg)*1000-1))::bigint/x.group_ms
+ ORDER BY x.n, mt`
+
+// A dbSeriesBatch is the series of a FetchSeriesBatch. The first
+// Next() of any of them reads the data of all of them in one query,
+// except of those which had their time range, group by or max points
+// changed since, these do their own query.
+type dbSeriesBatch struct {
+	sync.Mutex
+	db     *pgvSerDe
+	series []*dbSeries
+	keys   map[*dbSeries]dbSeriesKey // as of the FetchSeriesBatch
+	data   map[*dbSeries][]dbPoint
+	loaded bool
+}
+
+type dbSeriesKey struct {
+	from, to  time.Time
+	groupBy   time.Duration
+	maxPoints int64
+}
+
+func (dps *dbSeries) key() dbSeriesKey {
+	return dbSeriesKey{from: dps.from, to: dps.to, groupBy: dps.groupBy, maxPoints: dps.maxPoints}
+}
+
+func (b *dbSeriesBatch) add(dps *dbSeries) {
+	if b.keys == nil {
+		b.keys = make(map[*dbSeries]dbSeriesKey)
+	}
+	dps.batch = b
+	b.series = append(b.series, dps)
+	b.keys[dps] = dps.key()
+}
+
+// pending returns the series which are still as they were when added.
+func (b *dbSeriesBatch) pending() []*dbSeries {
+	var result []*dbSeries
+	for _, dps := range b.series {
+		if dps.key() == b.keys[dps] {
+			result = append(result, dps)
+		}
+	}
+	return result
+}
+
+// take returns the points the batch read for the series, unless the
+// series was changed since, then it needs its own query.
+func (b *dbSeriesBatch) take(dps *dbSeries) ([]dbPoint, bool) {
+	b.Lock()
+	defer b.Unlock()
+	dp, ok := b.data[dps]
+	if !ok || dps.key() != b.keys[dps] {
+		return nil, false
+	}
+	delete(b.data, dps) // read once
+	if dp == nil {
+		dp = []dbPoint{}
+	}
+	return dp, true
+}
+
+// load runs the batched series query once. On error the series fall
+// back to their own queries.
+func (b *dbSeriesBatch) load() {
+	b.Lock()
+	defer b.Unlock()
+	if b.loaded {
+		return
+	}
+	b.loaded = true
+
+	pending := b.pending()
+	if len(pending) == 0 {
+		return
+	}
+	var (
+		rraIds  = make([]int64, len(pending))
+		steps   = make([]int64, len(pending))
+		groups  = make([]int64, len(pending))
+		aligned = make([]int64, len(pending))
+		froms   = make([]int64, len(pending))
+		tos     = make([]int64, len(pending))
+		from    = pending[0].from
+		to      = pending[0].to
+	)
+	for i, dps := range pending {
+		groupByMs := dps.finalGroupByMs()
+		dps.bufGroup = time.Duration(groupByMs) * time.Millisecond
+		rraIds[i] = dps.rra.Id()
+		steps[i] = dps.rra.Step().Nanoseconds() / 1e6
+		groups[i] = groupByMs
+		aligned[i] = dps.from.Truncate(dps.bufGroup).UnixNano() / 1e6
+		froms[i] = dps.from.UnixNano() / 1e6
+		tos[i] = dps.to.UnixNano() / 1e6
+		if dps.from.Before(from) {
+			from = dps.from
+		}
+		if dps.to.After(to) {
+			to = dps.to
+		}
+	}
+
+	var (
+		start = time.Now()
+		n     int
+		err   error
+	)
+	defer func() { b.db.ops.observe(opFetchSeries, start, n, err) }()
+
+	rows, err := b.db.reader().stmts.query(nil, fmt.Sprintf(pgSelectSeriesBatchSql, b.db.prefix),
+		pq.Array(rraIds), pq.Array(steps), pq.Array(groups), pq.Array(aligned), pq.Array(froms), pq.Array(tos), from, to)
+	if err != nil {
+		log.Printf("dbSeriesBatch.load(): database error: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	data := make(map[*dbSeries][]dbPoint, len(pending))
+	for rows.Next() {
+		var (
+			i     int64
+			ts    time.Time
+			value sql.NullFloat64
+		)
+		if err = rows.Scan(&i, &ts, &value); err != nil {
+			log.Printf("dbSeriesBatch.load(): database error: %v", err)
+			return
+		}
+		if i < 1 || i > int64(len(pending)) {
+			log.Printf("dbSeriesBatch.load(): unexpected series number: %d", i)
+			return
+		}
+		n++
+		v := math.NaN()
+		if value.Valid {
+			v = value.Float64
+		}
+		dps := pending[i-1]
+		data[dps] = append(data[dps], dbPoint{t: ts, v: v})
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("dbSeriesBatch.load(): database error: %v", err)
+		return
+	}
+	for _, dps := range pending {
+		if _, ok := data[dps]; !ok {
+			data[dps] = nil // no rows, but read
+		}
+	}
+	b.data = data
+}
@@ -0,0 +1,167 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// A DataSourceRemover can find DSs and delete them, see
+// DeleteDataSources.
+type DataSourceRemover interface {
+	DataSourceSelector
+	DataSourceDeleter
+}
+
+// DeleteQuery selects DSs, e.g. the ones to delete: by id, those
+// matching a SearchQuery and those whose name matches a Graphite-style
+// glob, e.g. "foo.*.{bar,baz}". A DS matching any of them is selected.
+type DeleteQuery struct {
+	Ids   []int64
+	Match SearchQuery
+	Glob  string
+}
+
+// A DataSourceSelector can find DSs, see SelectDataSources.
+type DataSourceSelector interface {
+	DataSourceSearcher
+	FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error)
+}
+
+// SelectDataSources returns the DSs selected by q, by id. The idents
+// of the DSs selected by id are not known, they are nil.
+func SelectDataSources(db DataSourceSelector, q DeleteQuery) (map[int64]Ident, error) {
+	selected := make(map[int64]Ident)
+	for _, id := range q.Ids {
+		selected[id] = nil
+	}
+
+	var queries []SearchQuery
+	if len(q.Match) > 0 {
+		queries = append(queries, q.Match)
+	}
+	if q.Glob != "" {
+		queries = append(queries, SearchQuery{"name": GlobRegexp(q.Glob)})
+	}
+	for _, query := range queries {
+		idents, err := searchIdents(db, query)
+		if err != nil {
+			return nil, err
+		}
+		for _, ident := range idents {
+			ds, err := db.FetchOrCreateDataSource(ident, nil)
+			if err != nil {
+				return nil, fmt.Errorf("SelectDataSources(): fetching %v: %v", ident, err)
+			}
+			if dbds, ok := ds.(DbDataSourcer); ok && dbds != nil {
+				selected[dbds.Id()] = ident
+			}
+		}
+	}
+	return selected, nil
+}
+
+// DeleteDataSources deletes the DSs selected by q (see
+// SelectDataSources), each in a transaction of its own, and returns
+// them by id. If dryRun is set, nothing is deleted. On error the DSs
+// deleted so far are returned with it.
+func DeleteDataSources(db DataSourceRemover, q DeleteQuery, dryRun bool) (map[int64]Ident, error) {
+	selected, err := SelectDataSources(db, q)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return selected, nil
+	}
+	deleted := make(map[int64]Ident, len(selected))
+	for id, ident := range selected {
+		if err := db.DeleteDataSource(id); err != nil {
+			return deleted, fmt.Errorf("DeleteDataSources(): deleting %d: %v", id, err)
+		}
+		deleted[id] = ident
+	}
+	return deleted, nil
+}
+
+func searchIdents(db DataSourceSearcher, query SearchQuery) ([]Ident, error) {
+	sr, err := db.Search(query)
+	if err != nil {
+		return nil, fmt.Errorf("searching %v: %v", query, err)
+	}
+	defer sr.Close()
+	var idents []Ident
+	for sr.Next() {
+		idents = append(idents, sr.Ident())
+	}
+	return idents, nil
+}
+
+// GlobRegexp translates a dotted name glob to a regular expression
+// matching the whole name: "*" and "?" do not match a dot, character
+// classes are as in filepath.Match and "{a,b}" matches either.
+func GlobRegexp(glob string) string {
+	var re bytes.Buffer
+	re.WriteString("^")
+	braces := 0
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			re.WriteString(`[^.]*`)
+		case '?':
+			re.WriteString(`[^.]`)
+		case '[':
+			if j := strings.IndexByte(glob[i:], ']'); j > 0 {
+				class := glob[i+1 : i+j]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				re.WriteString("[" + class + "]")
+				i += j
+			} else {
+				re.WriteString(`\[`)
+			}
+		case '{':
+			braces++
+			re.WriteString("(")
+		case '}':
+			if braces > 0 {
+				braces--
+				re.WriteString(")")
+			} else {
+				re.WriteString(`\}`)
+			}
+		case ',':
+			if braces > 0 {
+				re.WriteString("|")
+			} else {
+				re.WriteString(",")
+			}
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	for ; braces > 0; braces-- {
+		re.WriteString(")")
+	}
+	re.WriteString("$")
+	return re.String()
+}
@@ -0,0 +1,123 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_GlobRegexp(t *testing.T) {
+	for _, c := range []struct {
+		glob, name string
+		match      bool
+	}{
+		{"foo.*", "foo.bar", true},
+		{"foo.*", "foo.bar.baz", false},
+		{"foo.b?r", "foo.bar", true},
+		{"foo.{bar,baz}.x", "foo.baz.x", true},
+		{"foo.{bar,baz}.x", "foo.bax.x", false},
+		{"foo.[a-c]ar", "foo.bar", true},
+		{"foo.[!a-c]ar", "foo.bar", false},
+		{"a+b.(c)", "a+b.(c)", true},
+		{"a,b", "a,b", true},
+	} {
+		re := regexp.MustCompile(GlobRegexp(c.glob))
+		if re.MatchString(c.name) != c.match {
+			t.Errorf("GlobRegexp(%q) = %q: expected %q to match: %v", c.glob, re, c.name, c.match)
+		}
+	}
+}
+
+func Test_DeleteDataSources(t *testing.T) {
+	kv := &memKV{m: make(map[string][]byte)}
+	p := InitKVDb(kv, "tgres_")
+	spec := &rrd.DSSpec{Step: time.Second, Heartbeat: time.Minute, RRAs: []rrd.RRASpec{
+		{Function: rrd.WMEAN, Step: time.Second, Span: 10 * time.Second},
+	}}
+	for _, name := range []string{"foo.bar", "foo.baz", "foo.baz.x", "bar"} {
+		if _, err := p.FetchOrCreateDataSource(Ident{"name": name}, spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ds, _ := p.FetchOrCreateDataSource(Ident{"name": "foo.bar"}, nil)
+	rra := ds.RRAs()[0].(*DbRoundRobinArchive)
+	p.FlushDataPoints(rra.BundleId(), rra.Seg(), 1, map[int64]interface{}{rra.Idx(): 10.0}, map[int64]interface{}{rra.Idx(): 0})
+
+	deleted, err := DeleteDataSources(p, DeleteQuery{Glob: "foo.*"}, true)
+	if err != nil || len(deleted) != 2 {
+		t.Fatalf("DeleteDataSources: (dry run) expected 2, got %v %v", deleted, err)
+	}
+	if dss, _ := p.FetchDataSources(); len(dss) != 4 {
+		t.Errorf("DeleteDataSources: deleted on a dry run")
+	}
+
+	deleted, err = DeleteDataSources(p, DeleteQuery{Ids: []int64{4}, Glob: "foo.*"}, false)
+	if err != nil || len(deleted) != 3 || deleted[ds.(*DbDataSource).Id()]["name"] != "foo.bar" || deleted[4] != nil {
+		t.Fatalf("DeleteDataSources: expected foo.bar, foo.baz and 4, got %v %v", deleted, err)
+	}
+	if dss, _ := p.FetchDataSources(); len(dss) != 1 || dss[0].(*DbDataSource).Ident()["name"] != "foo.baz.x" {
+		t.Errorf("DeleteDataSources: expected only foo.baz.x left, got %v", dss)
+	}
+	if ds, _ := p.FetchOrCreateDataSource(Ident{"name": "foo.bar"}, nil); ds != nil {
+		t.Errorf("DeleteDataSources: foo.bar can still be fetched")
+	}
+	n := 0
+	kv.View(func(tx KVTx) error {
+		return tx.Scan(p.tsKey(rra.BundleId(), rra.pos, -1, -1), func(_, _ []byte) bool { n++; return true })
+	})
+	if n != 0 {
+		t.Errorf("DeleteDataSource: %d data points left", n)
+	}
+
+	if _, err := DeleteDataSources(p, DeleteQuery{Match: SearchQuery{"name": "("}}, false); err == nil {
+		t.Errorf("DeleteDataSources: expected an error for an invalid regexp")
+	}
+}
+
+func Test_fileSerDe_DeleteDataSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := InitFileDb(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &rrd.DSSpec{Step: time.Second, Heartbeat: time.Minute, RRAs: []rrd.RRASpec{
+		{Function: rrd.WMEAN, Step: time.Second, Span: 10 * time.Second},
+	}}
+	ds, err := p.FetchOrCreateDataSource(Ident{"name": "foo.bar"}, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.DeleteDataSource(ds.(*DbDataSource).Id()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(p.filePath(Ident{"name": "foo.bar"})); !os.IsNotExist(err) {
+		t.Errorf("DeleteDataSource: expected the file to be removed, got %v", err)
+	}
+	if ds, _ := p.FetchOrCreateDataSource(Ident{"name": "foo.bar"}, nil); ds != nil {
+		t.Errorf("DeleteDataSource: foo.bar can still be fetched")
+	}
+}
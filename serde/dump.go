@@ -0,0 +1,353 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// The format and the version of the dumps written by Dump.
+const (
+	dumpFormat  = "tgres-dump"
+	dumpVersion = 1
+)
+
+// A DataSourceDumper can find DSs and load their data, see Dump.
+type DataSourceDumper interface {
+	DataSourceSelector
+	LoadRRAData(rra rrd.RoundRobinArchiver) (rrd.RoundRobinArchiver, error)
+}
+
+// A DataSourceRestorer can create DSs and write their data, see
+// Restore and ImportDataSource.
+type DataSourceRestorer interface {
+	FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error)
+	LoadRRAData(rra rrd.RoundRobinArchiver) (rrd.RoundRobinArchiver, error)
+	Flusher
+}
+
+// dumpHeader is the first document of a dump.
+type dumpHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	From    time.Time `json:"from"`
+	Until   time.Time `json:"until"`
+}
+
+// dumpedDataSource is a DS in a dump, with its state and RRAs. The
+// durations are as in Go, e.g. "1m30s".
+type dumpedDataSource struct {
+	Ident      Ident       `json:"ident"`
+	Step       string      `json:"step"`
+	Heartbeat  string      `json:"heartbeat"`
+	Type       string      `json:"type"`
+	LastUpdate time.Time   `json:"last_update"`
+	Value      float64     `json:"value"`
+	Duration   string      `json:"duration"`
+	LastRaw    float64     `json:"last_raw"`
+	RRAs       []dumpedRRA `json:"rras"`
+}
+
+// dumpedRRA is an RRA in a dump. The points are [time, value] pairs,
+// the time (of the end of the slot) in milliseconds since the epoch.
+type dumpedRRA struct {
+	Function string       `json:"cf"`
+	Step     string       `json:"step"`
+	Span     string       `json:"span"`
+	Xff      float32      `json:"xff"`
+	Latest   time.Time    `json:"latest"`
+	Value    float64      `json:"value"`
+	Duration string       `json:"duration"`
+	Points   [][2]float64 `json:"points"`
+}
+
+var cfNames = []string{rrd.WMEAN: "WMEAN", rrd.MAX: "MAX", rrd.MIN: "MIN", rrd.LAST: "LAST"}
+
+// Dump writes the DSs whose name matches a Graphite-style glob, with
+// their data points from after from up to until (either zero is
+// unbounded), to w in a portable format which Restore reads into any
+// serde: a gzipped stream of JSON documents, a header followed by one
+// per DS describing it and its RRAs along with their data points. It
+// returns the number of DSs written.
+func Dump(db DataSourceDumper, w io.Writer, glob string, from, until time.Time) (int, error) {
+	if glob == "" {
+		return 0, fmt.Errorf("Dump(): a glob is required")
+	}
+	selected, err := SelectDataSources(db, DeleteQuery{Glob: glob})
+	if err != nil {
+		return 0, fmt.Errorf("Dump(): %v", err)
+	}
+	ids := make([]int64, 0, len(selected))
+	for id := range selected {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	if err := enc.Encode(&dumpHeader{Format: dumpFormat, Version: dumpVersion, Created: time.Now(), From: from, Until: until}); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, id := range ids {
+		ds, err := db.FetchOrCreateDataSource(selected[id], nil)
+		if err != nil {
+			return n, fmt.Errorf("Dump(): fetching %v: %v", selected[id], err)
+		}
+		if ds == nil {
+			continue // deleted since
+		}
+		dds := dumpedDataSource{Ident: selected[id], Step: ds.Step().String(), Heartbeat: ds.Heartbeat().String(),
+			Type: ds.Type().String(), LastUpdate: ds.LastUpdate(), Value: finite(ds.Value()),
+			Duration: ds.Duration().String(), LastRaw: finite(ds.LastRaw())}
+		for _, rra := range ds.RRAs() {
+			loaded, err := db.LoadRRAData(rra)
+			if err != nil {
+				return n, fmt.Errorf("Dump(): loading %v: %v", selected[id], err)
+			}
+			dds.RRAs = append(dds.RRAs, dumpRRA(loaded, from, until))
+		}
+		if err := enc.Encode(&dds); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, gz.Close()
+}
+
+// dumpRRA returns an RRA with its data points in the time range, in
+// time order.
+func dumpRRA(rra rrd.RoundRobinArchiver, from, until time.Time) dumpedRRA {
+	spec := rra.Spec()
+	result := dumpedRRA{Function: cfNames[spec.Function], Step: spec.Step.String(), Span: spec.Span.String(), Xff: spec.Xff,
+		Latest: rra.Latest(), Value: finite(rra.Value()), Duration: rra.Duration().String(), Points: [][2]float64{}}
+	for i, v := range rra.DPs() {
+		t := rrd.SlotTime(i, rra.Latest(), rra.Step(), rra.Size())
+		if math.IsNaN(v) || (!from.IsZero() && !t.After(from)) || (!until.IsZero() && t.After(until)) {
+			continue
+		}
+		result.Points = append(result.Points, [2]float64{float64(t.UnixNano() / 1e6), v})
+	}
+	sort.Slice(result.Points, func(i, j int) bool { return result.Points[i][0] < result.Points[j][0] })
+	return result
+}
+
+// finite returns f, or 0 if it cannot be in JSON.
+func finite(f float64) float64 {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0
+	}
+	return f
+}
+
+// Restore reads a dump written by Dump from r and writes its data
+// points to db. A DS that does not exist is created as it was
+// dumped, that of one that does is resampled to its RRAs (see
+// rrd.Resample), the points take the place of those there, if any,
+// and its state is that of the dump if it was updated later. It
+// returns the number of DSs restored.
+func Restore(db DataSourceRestorer, r io.Reader) (int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, fmt.Errorf("Restore(): not a dump: %v", err)
+	}
+	defer gz.Close()
+	dec := json.NewDecoder(gz)
+	var hdr dumpHeader
+	if err := dec.Decode(&hdr); err != nil || hdr.Format != dumpFormat {
+		return 0, fmt.Errorf("Restore(): not a dump: %v", err)
+	}
+	if hdr.Version != dumpVersion {
+		return 0, fmt.Errorf("Restore(): unsupported dump version %d", hdr.Version)
+	}
+
+	n := 0
+	for {
+		var dds dumpedDataSource
+		if err := dec.Decode(&dds); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf("Restore(): %v", err)
+		}
+		if err := restoreDataSource(db, &dds); err != nil {
+			return n, fmt.Errorf("Restore(): %v: %v", dds.Ident, err)
+		}
+		n++
+	}
+}
+
+// restoreDataSource writes a dumped DS, see Restore.
+func restoreDataSource(db DataSourceRestorer, dds *dumpedDataSource) error {
+	if len(dds.Ident) == 0 || dds.Ident["name"] == "" {
+		return fmt.Errorf("DS without a name")
+	}
+	spec, srcs, err := dds.spec()
+	if err != nil {
+		return err
+	}
+	return ImportDataSource(db, dds.Ident, spec, srcs, true)
+}
+
+// ImportDataSource writes the data points of srcs, RRAs of any
+// layout ending at their latest, to the DS of ident, creating it with
+// spec if it does not exist. They are resampled to the RRAs of the DS
+// (see rrd.Resample) and, if overwrite is set, take the place of the
+// data points there, otherwise only fill the slots without one. The
+// state of the DS becomes that of spec if it was updated later.
+func ImportDataSource(db DataSourceRestorer, ident Ident, spec *rrd.DSSpec, srcs []rrd.RoundRobinArchiver, overwrite bool) error {
+	ds, err := db.FetchOrCreateDataSource(ident, spec)
+	if err != nil {
+		return err
+	}
+	dbds, ok := ds.(*DbDataSource)
+	if !ok {
+		return fmt.Errorf("not a *DbDataSource")
+	}
+
+	rras := make([]rrd.RoundRobinArchiver, 0, len(dbds.RRAs()))
+	for _, rra := range dbds.RRAs() {
+		dbrra, ok := rra.(*DbRoundRobinArchive)
+		if !ok {
+			return fmt.Errorf("not a *DbRoundRobinArchive")
+		}
+		rs := dbrra.Spec()
+		rs.Latest, rs.Value, rs.Duration = dbrra.Latest(), dbrra.Value(), dbrra.Duration()
+		if latest := spec.LastUpdate.Truncate(rs.Step); latest.After(rs.Latest) {
+			rs.Latest, rs.Value, rs.Duration = latest, 0, 0
+			for _, src := range srcs { // the partial step carries over to the same layout only
+				if s := src.Spec(); s.Function == rs.Function && s.Step == rs.Step && s.Span == rs.Span {
+					rs.Latest, rs.Value, rs.Duration = src.Latest(), src.Value(), src.Duration()
+				}
+			}
+		}
+		rs.DPs = rrd.Resample(rs, rs.Latest, srcs)
+		if !overwrite && !dbrra.Latest().IsZero() {
+			existing, err := db.LoadRRAData(dbrra)
+			if err != nil {
+				return err
+			}
+			for i := range existing.DPs() {
+				if t := rrd.SlotTime(i, existing.Latest(), existing.Step(), existing.Size()); rs.Latest.Sub(t) < rs.Span {
+					delete(rs.DPs, i) // still current
+				}
+			}
+		}
+		if rra, err = newDbRoundRobinArchive(dbrra.id, dbrra.width, dbrra.bundleId, dbrra.pos, rs); err != nil {
+			return err
+		}
+		rras = append(rras, rra)
+	}
+
+	state := rrd.DSSpec{Step: dbds.Step(), Heartbeat: dbds.Heartbeat(), Type: dbds.Type(),
+		LastUpdate: dbds.LastUpdate(), Value: dbds.Value(), Duration: dbds.Duration(), LastRaw: dbds.LastRaw()}
+	if spec.LastUpdate.After(state.LastUpdate) {
+		state.LastUpdate, state.Value, state.Duration, state.LastRaw = spec.LastUpdate, spec.Value, spec.Duration, spec.LastRaw
+	}
+	rds := rrd.NewDataSource(state)
+	rds.SetRRAs(rras)
+	return flushDataSource(db, NewDbDataSource(dbds.Id(), dbds.Ident(), dbds.Seg(), dbds.Idx(), rds))
+}
+
+// spec returns the spec of a dumped DS, with its state, and its RRAs
+// with their data points.
+func (dds *dumpedDataSource) spec() (*rrd.DSSpec, []rrd.RoundRobinArchiver, error) {
+	var err error
+	spec := &rrd.DSSpec{LastUpdate: dds.LastUpdate, Value: dds.Value, LastRaw: dds.LastRaw}
+	if spec.Step, err = time.ParseDuration(dds.Step); err != nil || spec.Step <= 0 {
+		return nil, nil, fmt.Errorf("invalid step %q", dds.Step)
+	}
+	if spec.Heartbeat, err = time.ParseDuration(dds.Heartbeat); err != nil {
+		return nil, nil, fmt.Errorf("invalid heartbeat %q", dds.Heartbeat)
+	}
+	if spec.Duration, err = time.ParseDuration(dds.Duration); err != nil {
+		return nil, nil, fmt.Errorf("invalid duration %q", dds.Duration)
+	}
+	if spec.Type, err = rrd.ParseDSType(dds.Type); err != nil {
+		return nil, nil, err
+	}
+
+	srcs := make([]rrd.RoundRobinArchiver, 0, len(dds.RRAs))
+	for _, dr := range dds.RRAs {
+		rs := rrd.RRASpec{Function: -1, Xff: dr.Xff, Latest: dr.Latest, Value: dr.Value, DPs: make(map[int64]float64, len(dr.Points))}
+		for cf, name := range cfNames {
+			if name == dr.Function {
+				rs.Function = rrd.Consolidation(cf)
+			}
+		}
+		if rs.Function < 0 {
+			return nil, nil, fmt.Errorf("invalid consolidation %q", dr.Function)
+		}
+		if rs.Step, err = time.ParseDuration(dr.Step); err != nil || rs.Step <= 0 {
+			return nil, nil, fmt.Errorf("invalid RRA step %q", dr.Step)
+		}
+		if rs.Span, err = time.ParseDuration(dr.Span); err != nil || rs.Span < rs.Step {
+			return nil, nil, fmt.Errorf("invalid RRA span %q", dr.Span)
+		}
+		if rs.Duration, err = time.ParseDuration(dr.Duration); err != nil {
+			return nil, nil, fmt.Errorf("invalid RRA duration %q", dr.Duration)
+		}
+		size := rs.Span.Nanoseconds() / rs.Step.Nanoseconds()
+		for _, p := range dr.Points {
+			if t := time.Unix(0, int64(p[0])*1e6); !t.After(rs.Latest) && rs.Latest.Sub(t) < rs.Span {
+				rs.DPs[rrd.SlotIndex(t, rs.Step, size)] = p[1]
+			}
+		}
+		spec.RRAs = append(spec.RRAs, rrd.RRASpec{Function: rs.Function, Step: rs.Step, Span: rs.Span, Xff: rs.Xff})
+		srcs = append(srcs, rrd.NewRoundRobinArchive(rs))
+	}
+	return spec, srcs, nil
+}
+
+// flushDataSource writes the state and the data points of a DS as
+// the vertical cache of a receiver would.
+func flushDataSource(f Flusher, ds *DbDataSource) error {
+	seg, idx := ds.Seg(), ds.Idx()
+	if _, err := f.FlushDSStates(seg, map[int64]interface{}{idx: ds.LastUpdate()}, map[int64]interface{}{idx: ds.Value()},
+		map[int64]interface{}{idx: ds.Duration().Nanoseconds() / 1e6}, map[int64]interface{}{idx: ds.LastRaw()}); err != nil {
+		return err
+	}
+	for _, rra := range ds.RRAs() {
+		rra, ok := rra.(*DbRoundRobinArchive)
+		if !ok {
+			return fmt.Errorf("not a *DbRoundRobinArchive")
+		}
+		idx := rra.Idx()
+		if _, err := f.FlushRRAStates(rra.BundleId(), rra.Seg(), map[int64]interface{}{idx: rra.Latest()}, map[int64]interface{}{idx: rra.Value()},
+			map[int64]interface{}{idx: rra.Duration().Nanoseconds() / 1e6}); err != nil {
+			return err
+		}
+		latestI, ver, prev := slotVersions(rra)
+		for i, v := range rra.DPs() {
+			vr := ver
+			if i > latestI {
+				vr = prev
+			}
+			if _, err := f.FlushDataPoints(rra.BundleId(), rra.Seg(), i, map[int64]interface{}{idx: v}, map[int64]interface{}{idx: vr}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
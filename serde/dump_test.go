@@ -0,0 +1,99 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_DumpRestore(t *testing.T) {
+	src := InitKVDb(&memKV{m: make(map[string][]byte)}, "tgres_")
+	spec := &rrd.DSSpec{Step: time.Second, Heartbeat: time.Minute, Type: rrd.COUNTER, RRAs: []rrd.RRASpec{
+		{Function: rrd.WMEAN, Step: time.Second, Span: 10 * time.Second},
+	}}
+	for _, name := range []string{"foo.a", "foo.b", "bar"} {
+		ds, err := src.FetchOrCreateDataSource(Ident{"name": name}, spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbds := ds.(*DbDataSource)
+		rra := dbds.RRAs()[0].(*DbRoundRobinArchive)
+		rs := rra.Spec()
+		rs.Latest, rs.DPs = time.Unix(20, 0), make(map[int64]float64)
+		for n := int64(11); n <= 20; n++ {
+			rs.DPs[rrd.SlotIndex(time.Unix(n, 0), time.Second, 10)] = float64(n)
+		}
+		rra, _ = newDbRoundRobinArchive(rra.id, rra.width, rra.bundleId, rra.pos, rs)
+		rds := rrd.NewDataSource(rrd.DSSpec{Step: time.Second, Heartbeat: time.Minute, Type: rrd.COUNTER, LastUpdate: time.Unix(20, 0), LastRaw: 7})
+		rds.SetRRAs([]rrd.RoundRobinArchiver{rra})
+		flushDataSource(src, NewDbDataSource(dbds.Id(), dbds.Ident(), dbds.Seg(), dbds.Idx(), rds))
+	}
+
+	if _, err := Dump(src, &bytes.Buffer{}, "", time.Time{}, time.Time{}); err == nil {
+		t.Errorf("Dump: expected an error without a glob")
+	}
+	var buf bytes.Buffer
+	n, err := Dump(src, &buf, "foo.*", time.Unix(12, 0), time.Time{})
+	if err != nil || n != 2 {
+		t.Fatalf("Dump: expected 2 DSs, got %d %v", n, err)
+	}
+	dump := buf.Bytes()
+
+	// Into an empty database, as dumped
+	dst := InitKVDb(&memKV{m: make(map[string][]byte)}, "tgres_")
+	if n, err := Restore(dst, bytes.NewReader(dump)); err != nil || n != 2 {
+		t.Fatalf("Restore: expected 2 DSs, got %d %v", n, err)
+	}
+	ds, _ := dst.FetchOrCreateDataSource(Ident{"name": "foo.b"}, nil)
+	if ds == nil || ds.Type() != rrd.COUNTER || ds.LastRaw() != 7 || !ds.LastUpdate().Equal(time.Unix(20, 0)) || !SameRRAs(ds, spec) {
+		t.Fatalf("Restore: unexpected DS %v", ds)
+	}
+	loaded, _ := dst.LoadRRAData(ds.RRAs()[0])
+	if dps := loaded.DPs(); len(dps) != 8 || dps[rrd.SlotIndex(time.Unix(13, 0), time.Second, 10)] != 13 {
+		t.Errorf("Restore: expected the 8 points after 12, got %v", dps)
+	}
+	if ds, _ := dst.FetchOrCreateDataSource(Ident{"name": "bar"}, nil); ds != nil {
+		t.Errorf("Restore: bar was not dumped")
+	}
+
+	// Into an existing DS with other RRAs, resampled
+	dst = InitKVDb(&memKV{m: make(map[string][]byte)}, "tgres_")
+	other := &rrd.DSSpec{Step: time.Second, Heartbeat: time.Minute, RRAs: []rrd.RRASpec{
+		{Function: rrd.WMEAN, Step: 2 * time.Second, Span: 10 * time.Second},
+	}}
+	if _, err := dst.FetchOrCreateDataSource(Ident{"name": "foo.a"}, other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Restore(dst, bytes.NewReader(dump)); err != nil {
+		t.Fatal(err)
+	}
+	ds, _ = dst.FetchOrCreateDataSource(Ident{"name": "foo.a"}, nil)
+	if !SameRRAs(ds, other) || !ds.LastUpdate().Equal(time.Unix(20, 0)) {
+		t.Fatalf("Restore: expected the existing RRAs and the dumped state, got %v", ds)
+	}
+	loaded, _ = dst.LoadRRAData(ds.RRAs()[0])
+	if v := loaded.DPs()[rrd.SlotIndex(time.Unix(14, 0), 2*time.Second, 5)]; v != 13.5 || len(loaded.DPs()) != 4 {
+		t.Errorf("Restore: expected 4 points, 13.5 at 14, got %v", loaded.DPs())
+	}
+
+	if _, err := Restore(dst, bytes.NewReader([]byte("not a dump"))); err == nil {
+		t.Errorf("Restore: expected an error for garbage")
+	}
+}
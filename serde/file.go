@@ -0,0 +1,801 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//
+// A filesystem implementation, one fixed-size binary file per DS
+// (much like whisper), which needs no database at all and where a
+// series can be backed up or copied by copying its file.
+//
+
+// The file of a DS is <dir>/<name>.tgr, where the dots of the name
+// are directories and the tags (if any) follow the last part of the
+// name. The file is:
+//
+//   magic "TGRS", format version uint16, flags uint16 (1 is archived)
+//   DS id int64
+//   DS state: lastupdate int64 (Unix ns, 0 is none), duration_ms int64,
+//             value float64, last_raw float64
+//   length of the meta uint32, the meta JSON (ident, steps, RRAs)
+//   for every RRA:
+//     RRA state: latest int64, duration_ms int64, value float64
+//     size slots: version int32 (-1 is empty), data point float64
+//
+// all big-endian. The slots are versioned as in PostgreSQL (see
+// postgres.go). The ids, RRA bundles and positions of all the files
+// are kept in memory (they are how the flusher addresses DSs and
+// RRAs) and are allocated by this process, so only one tgres may use
+// a directory. A file copied from elsewhere whose ids are taken gets
+// new ones on start (the first file in path order keeps them).
+
+package serde
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/series"
+)
+
+// The layout of a DS file, see above.
+const (
+	fileMagic      = "TGRS"
+	fileVersion    = 1
+	fileArchived   = 1  // flag
+	fileOffDsState = 16 // offsets
+	fileOffMetaLen = 48
+	fileOffMeta    = 52
+	fileSlot       = 12  // size
+	fileMetaSpare  = 256 // room for the meta to grow when ids change
+)
+
+type fileSerDe struct {
+	dir string
+	mu  sync.RWMutex
+	// all of the below is protected by mu
+	byIdent map[string]*fileDs
+	byId    map[int64]*fileDs
+	rras    map[[2]int64]*fileRRA // by bundle id and pos
+	bundles map[[2]int64]int64    // bundle id by step_ms and size
+	lastPos map[int64]int64       // by bundle id
+	lastId  int64
+	lastRRA int64
+}
+
+// fileDs is the location and meta of a DS file.
+type fileDs struct {
+	path     string
+	id       int64
+	archived bool
+	meta     dsMeta
+	metaLen  int64 // the room for the meta
+}
+
+// fileRRA is where an RRA is in the file of its DS.
+type fileRRA struct {
+	ds     *fileDs
+	meta   *rraMeta
+	offset int64 // of its state
+}
+
+func (ds *fileDs) rraOffsets() []int64 {
+	offsets := make([]int64, len(ds.meta.RRAs))
+	offset := fileOffMeta + ds.metaLen
+	for n, rra := range ds.meta.RRAs {
+		offsets[n] = offset
+		offset += rraStateLen + rra.Size*fileSlot
+	}
+	return offsets
+}
+
+func init() {
+	Register("file", func(dir, prefix string) (DbSerDe, error) {
+		db, err := InitFileDb(dir, prefix)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	})
+}
+
+// InitFileDb opens the DS files in dir (or its subdirectory prefix,
+// if not blank), which is created if need be.
+func InitFileDb(dir, prefix string) (*fileSerDe, error) {
+	if prefix != "" {
+		dir = filepath.Join(dir, prefix)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("InitFileDb(): %v", err)
+	}
+	p := &fileSerDe{dir: dir,
+		byIdent: make(map[string]*fileDs),
+		byId:    make(map[int64]*fileDs),
+		rras:    make(map[[2]int64]*fileRRA),
+		bundles: make(map[[2]int64]int64),
+		lastPos: make(map[int64]int64),
+	}
+	if err := p.loadFiles(); err != nil {
+		return nil, fmt.Errorf("InitFileDb(): %v", err)
+	}
+	return p, nil
+}
+
+func (p *fileSerDe) Fetcher() Fetcher             { return p }
+func (p *fileSerDe) Flusher() Flusher             { return p }
+func (p *fileSerDe) EventListener() EventListener { return p }
+func (p *fileSerDe) DbAddresser() DbAddresser     { return p }
+
+// There is only one tgres per directory, see above.
+func (p *fileSerDe) ListDbClientIps() ([]string, error) { return nil, nil }
+func (p *fileSerDe) MyDbAddr() (*string, error)         { return nil, nil }
+
+// loadFiles reads the headers of all the DS files. Those with ids
+// which are already taken are given new ones, in two passes, so that
+// a file keeps its ids unless it conflicts with another.
+func (p *fileSerDe) loadFiles() error {
+	var dss []*fileDs
+	err := filepath.Walk(p.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, ".tgr") {
+			return err
+		}
+		ds, err := readFileDs(path)
+		if err != nil {
+			log.Printf("InitFileDb(): skipping %s: %v", path, err)
+			return nil
+		}
+		dss = append(dss, ds)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var conflicts []*fileDs
+	for _, ds := range dss {
+		if !p.index(ds, false) {
+			conflicts = append(conflicts, ds)
+		}
+	}
+	for _, ds := range conflicts {
+		if _, ok := p.byIdent[ds.meta.Ident.String()]; ok {
+			log.Printf("InitFileDb(): skipping %s: a DS with this ident exists in another file", ds.path)
+			continue
+		}
+		log.Printf("InitFileDb(): %s: ids in use, assigning new ones", ds.path)
+		p.index(ds, true)
+		if err := ds.writeHeader(); err != nil {
+			return fmt.Errorf("%s: %v", ds.path, err)
+		}
+	}
+	return nil
+}
+
+// index adds a DS to the in-memory index. Unless renumber is true, it
+// is not added if any of its ids are taken.
+func (p *fileSerDe) index(ds *fileDs, renumber bool) bool {
+	if !renumber {
+		if p.byId[ds.id] != nil || p.byIdent[ds.meta.Ident.String()] != nil {
+			return false
+		}
+		seen := make(map[[2]int64]bool)
+		for _, rm := range ds.meta.RRAs {
+			key := [2]int64{rm.BundleId, rm.Pos}
+			if id, ok := p.bundles[[2]int64{rm.StepMs, rm.Size}]; (ok && id != rm.BundleId) || p.rras[key] != nil || seen[key] {
+				return false
+			}
+			for k, id := range p.bundles {
+				if id == rm.BundleId && k != [2]int64{rm.StepMs, rm.Size} {
+					return false
+				}
+			}
+			seen[key] = true
+		}
+	} else {
+		p.lastId++
+		ds.id = p.lastId
+		for _, rm := range ds.meta.RRAs {
+			p.lastRRA++
+			rm.Id = p.lastRRA
+			rm.BundleId = p.bundleId(rm.StepMs, rm.Size)
+			p.lastPos[rm.BundleId]++
+			rm.Pos = p.lastPos[rm.BundleId]
+		}
+	}
+
+	p.byId[ds.id], p.byIdent[ds.meta.Ident.String()] = ds, ds
+	if ds.id > p.lastId {
+		p.lastId = ds.id
+	}
+	offsets := ds.rraOffsets()
+	for n, rm := range ds.meta.RRAs {
+		p.rras[[2]int64{rm.BundleId, rm.Pos}] = &fileRRA{ds: ds, meta: rm, offset: offsets[n]}
+		p.bundles[[2]int64{rm.StepMs, rm.Size}] = rm.BundleId
+		if rm.Pos > p.lastPos[rm.BundleId] {
+			p.lastPos[rm.BundleId] = rm.Pos
+		}
+		if rm.Id > p.lastRRA {
+			p.lastRRA = rm.Id
+		}
+	}
+	return true
+}
+
+// bundleId returns the id of the RRA bundle of this step and size,
+// allocating one if need be.
+func (p *fileSerDe) bundleId(stepMs, size int64) int64 {
+	if id, ok := p.bundles[[2]int64{stepMs, size}]; ok {
+		return id
+	}
+	var max int64
+	for _, id := range p.bundles {
+		if id > max {
+			max = id
+		}
+	}
+	p.bundles[[2]int64{stepMs, size}] = max + 1
+	return max + 1
+}
+
+func readFileDs(path string) (*fileDs, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	head := make([]byte, fileOffMeta)
+	if _, err := f.ReadAt(head, 0); err != nil {
+		return nil, err
+	}
+	if string(head[:4]) != fileMagic || binary.BigEndian.Uint16(head[4:]) != fileVersion {
+		return nil, fmt.Errorf("not a tgres file of version %d", fileVersion)
+	}
+	ds := &fileDs{path: path,
+		archived: binary.BigEndian.Uint16(head[6:])&fileArchived != 0,
+		id:       int64(binary.BigEndian.Uint64(head[8:])),
+		metaLen:  int64(binary.BigEndian.Uint32(head[fileOffMetaLen:])),
+	}
+	meta := make([]byte, ds.metaLen)
+	if _, err := f.ReadAt(meta, fileOffMeta); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(meta, &ds.meta); err != nil {
+		return nil, fmt.Errorf("invalid meta: %v", err)
+	}
+	return ds, nil
+}
+
+// header returns the magic, flags, id and meta of a DS.
+func (ds *fileDs) header() ([]byte, []byte, error) {
+	meta, err := json.Marshal(&ds.meta)
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(meta)) > ds.metaLen {
+		return nil, nil, fmt.Errorf("meta of %d bytes does not fit in %d", len(meta), ds.metaLen)
+	}
+	head := make([]byte, fileOffDsState)
+	copy(head, fileMagic)
+	binary.BigEndian.PutUint16(head[4:], fileVersion)
+	if ds.archived {
+		binary.BigEndian.PutUint16(head[6:], fileArchived)
+	}
+	binary.BigEndian.PutUint64(head[8:], uint64(ds.id))
+	metaLen := make([]byte, 4)
+	binary.BigEndian.PutUint32(metaLen, uint32(ds.metaLen))
+	// the spare room is blank, which JSON ignores
+	meta = append(append(metaLen, meta...), bytes.Repeat([]byte(" "), int(ds.metaLen)-len(meta))...)
+	return head, meta, nil
+}
+
+// writeHeader rewrites the header (not the state) of an existing DS
+// file.
+func (ds *fileDs) writeHeader() error {
+	head, meta, err := ds.header()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(ds.path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteAt(head, 0); err == nil {
+		_, err = f.WriteAt(meta, fileOffMetaLen)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// create writes a new DS file, under a temporary name first, so that
+// a file is never seen half-written. If the path is taken (by a
+// different ident, which escapes to the same path), the id is
+// appended.
+func (ds *fileDs) create(rraSpecs []rrd.RRASpec) error {
+	head, meta, err := ds.header()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.Write(head)
+	buf.Write(newDsState())
+	buf.Write(meta)
+	for n, rm := range ds.meta.RRAs {
+		buf.Write(newRRAState(rraSpecs[n]))
+		slot := make([]byte, fileSlot)
+		fileWriteSlot(slot, -1, math.NaN())
+		buf.Write(bytes.Repeat(slot, int(rm.Size)))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ds.path), 0755); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", ds.path, ds.id)
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := os.Link(tmp, ds.path); err != nil {
+		if !os.IsExist(err) {
+			return err
+		}
+		ds.path = fmt.Sprintf("%s~%d.tgr", strings.TrimSuffix(ds.path, ".tgr"), ds.id)
+		return os.Link(tmp, ds.path)
+	}
+	return nil
+}
+
+func fileWriteSlot(b []byte, ver int32, dp float64) {
+	binary.BigEndian.PutUint32(b, uint32(ver))
+	binary.BigEndian.PutUint64(b[4:], math.Float64bits(dp))
+}
+
+// filePath returns the path of the file of an ident, see above.
+// Everything but letters, digits, - and _ is escaped.
+func (p *fileSerDe) filePath(ident Ident) string {
+	parts := strings.Split(ident["name"], ".")
+	for n, part := range parts {
+		parts[n] = fileEscape(part)
+	}
+	var tags []string
+	for k, v := range ident {
+		if k != "name" {
+			tags = append(tags, ";"+fileEscape(k)+"="+fileEscape(v))
+		}
+	}
+	sort.Strings(tags)
+	parts[len(parts)-1] += strings.Join(tags, "") + ".tgr"
+	return filepath.Join(append([]string{p.dir}, parts...)...)
+}
+
+var fileUnescaped = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func fileEscape(s string) string {
+	if s == "" {
+		return "_"
+	}
+	if fileUnescaped.MatchString(s) {
+		return s
+	}
+	var b bytes.Buffer
+	for _, c := range []byte(s) {
+		if fileUnescaped.Match([]byte{c}) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// dataSource reads the state of a DS and its RRAs from its file.
+func (p *fileSerDe) dataSource(fds *fileDs, created bool) (*DbDataSource, error) {
+	f, err := os.Open(fds.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dsState := make([]byte, dsStateLen)
+	if _, err := f.ReadAt(dsState, fileOffDsState); err != nil {
+		return nil, err
+	}
+	var rraStates [][]byte
+	for _, offset := range fds.rraOffsets() {
+		state := make([]byte, rraStateLen)
+		if _, err := f.ReadAt(state, offset); err != nil {
+			return nil, err
+		}
+		rraStates = append(rraStates, state)
+	}
+	return dataSourceFromMeta(fds.id, &fds.meta, dsState, rraStates, created)
+}
+
+func (p *fileSerDe) FetchDataSources() ([]rrd.DataSourcer, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	ids := make([]int64, 0, len(p.byId))
+	for id := range p.byId {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	result := make([]rrd.DataSourcer, 0, len(ids))
+	for _, id := range ids {
+		fds := p.byId[id]
+		if fds.archived || len(fds.meta.RRAs) == 0 { // as in PostgreSQL
+			continue
+		}
+		ds, err := p.dataSource(fds, false)
+		if err != nil {
+			log.Printf("FetchDataSources(): error reading %s: %v", fds.path, err)
+			return nil, err
+		}
+		result = append(result, ds)
+	}
+	return result, nil
+}
+
+// ArchiveDataSource marks a DS as archived, as in PostgreSQL.
+func (p *fileSerDe) ArchiveDataSource(id int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if fds := p.byId[id]; fds != nil && !fds.archived {
+		fds.archived = true
+		if err := fds.writeHeader(); err != nil {
+			log.Printf("ArchiveDataSource(): error writing %s: %v", fds.path, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// RenameDataSource changes the ident of a DS, which moves its file.
+// It is an error if the ident is taken, or if the new meta does not
+// fit in the room for it.
+func (p *fileSerDe) RenameDataSource(id int64, ident Ident) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fds := p.byId[id]
+	if fds == nil {
+		return fmt.Errorf("RenameDataSource(): no DS with id %d", id)
+	}
+	if p.byIdent[ident.String()] != nil {
+		return fmt.Errorf("RenameDataSource(): a DS with ident %v exists", ident)
+	}
+
+	moved := *fds
+	moved.meta.Ident, moved.path = ident, p.filePath(ident)
+	if _, _, err := moved.header(); err != nil {
+		return fmt.Errorf("RenameDataSource(): %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(moved.path), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(fds.path, moved.path); err != nil {
+		log.Printf("RenameDataSource(): error linking %s: %v", moved.path, err)
+		return err
+	}
+	if err := moved.writeHeader(); err != nil {
+		os.Remove(moved.path)
+		log.Printf("RenameDataSource(): error writing %s: %v", moved.path, err)
+		return err
+	}
+	if err := os.Remove(fds.path); err != nil {
+		log.Printf("RenameDataSource(): error removing %s: %v", fds.path, err)
+	}
+	delete(p.byIdent, fds.meta.Ident.String())
+	*fds = moved // the RRAs point to it
+	p.byIdent[ident.String()] = fds
+	return nil
+}
+
+// DeleteDataSource removes a DS file and drops it from the index.
+func (p *fileSerDe) DeleteDataSource(id int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fds := p.byId[id]
+	if fds == nil {
+		return nil
+	}
+	if err := os.Remove(fds.path); err != nil && !os.IsNotExist(err) {
+		log.Printf("DeleteDataSource(): error removing %s: %v", fds.path, err)
+		return err
+	}
+	delete(p.byId, id)
+	delete(p.byIdent, fds.meta.Ident.String())
+	for _, rm := range fds.meta.RRAs {
+		delete(p.rras, [2]int64{rm.BundleId, rm.Pos})
+	}
+	return nil
+}
+
+// FetchOrCreateDataSource loads or creates a DS. The returned DS
+// contains no data (use FetchSeries). A nil dsSpec means fetch only,
+// do not create.
+func (p *fileSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	p.mu.RLock()
+	fds := p.byIdent[ident.String()]
+	p.mu.RUnlock()
+	if fds == nil && dsSpec == nil {
+		return nil, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	created := false
+	if fds = p.byIdent[ident.String()]; fds == nil {
+		var err error
+		if fds, err = p.createDataSource(ident, dsSpec); err != nil {
+			log.Printf("FetchOrCreateDataSource(): error creating DS: %v", err)
+			return nil, err
+		}
+		created = true
+	} else if dsSpec != nil && fds.archived { // see pgvSerDe.FetchOrCreateDataSource
+		fds.archived = false
+		if err := fds.writeHeader(); err != nil {
+			log.Printf("FetchOrCreateDataSource(): error unarchiving DS: %v", err)
+			return nil, err
+		}
+	}
+	return p.dataSource(fds, created)
+}
+
+// createDataSource creates the file of a DS and indexes it, with p.mu
+// held.
+func (p *fileSerDe) createDataSource(ident Ident, dsSpec *rrd.DSSpec) (*fileDs, error) {
+	lastPos, lastRRA := make(map[int64]int64), p.lastRRA
+	dsm := newDsMeta(ident, dsSpec, func(rm *rraMeta) {
+		lastRRA++
+		rm.Id, rm.BundleId = lastRRA, p.bundleId(rm.StepMs, rm.Size)
+		if _, ok := lastPos[rm.BundleId]; !ok {
+			lastPos[rm.BundleId] = p.lastPos[rm.BundleId]
+		}
+		lastPos[rm.BundleId]++
+		rm.Pos = lastPos[rm.BundleId]
+	})
+	fds := &fileDs{path: p.filePath(ident), id: p.lastId + 1, meta: *dsm}
+	meta, err := json.Marshal(&fds.meta)
+	if err != nil {
+		return nil, err
+	}
+	fds.metaLen = int64(len(meta)) + fileMetaSpare
+
+	if err := fds.create(dsSpec.RRAs); err != nil {
+		return nil, err
+	}
+	p.index(fds, false)
+	return fds, nil
+}
+
+// Search returns the idents matching the query, see
+// SearchQuery.matcher, from the in-memory index.
+func (p *fileSerDe) Search(query SearchQuery) (SearchResult, error) {
+	match, err := query.matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	sr := newIdentSearchResult()
+	for _, fds := range p.byId {
+		if match(fds.meta.Ident) {
+			sr.add(fds.meta.Ident, fds.archived)
+		}
+	}
+	return sr, nil
+}
+
+// FetchSeries loads the data of the most suitable RRA and presents it
+// as a series, see rraDataSeries.
+func (p *fileSerDe) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	return rraDataSeries(ds, from, to, maxPoints, p.LoadRRAData)
+}
+
+// LoadRRAData returns a new RRA based on the one passed in and
+// containing all of its current data points, see
+// pgvSerDe.LoadRRAData.
+func (p *fileSerDe) LoadRRAData(rra rrd.RoundRobinArchiver) (rrd.RoundRobinArchiver, error) {
+	dbrra, ok := rra.(*DbRoundRobinArchive)
+	if !ok {
+		return nil, fmt.Errorf("LoadRRAData: Not a *DbRoundRobinArchive")
+	}
+
+	var dps map[int64]float64
+	if !rra.Latest().IsZero() {
+		p.mu.RLock()
+		frra := p.rras[[2]int64{dbrra.BundleId(), dbrra.pos}]
+		p.mu.RUnlock()
+		if frra == nil {
+			return nil, fmt.Errorf("LoadRRAData: RRA %d not found", dbrra.Id())
+		}
+		slots, err := frra.readSlots()
+		if err != nil {
+			log.Printf("LoadRRAData: error reading %s: %v", frra.ds.path, err)
+			return nil, err
+		}
+		latestI, latestVer, prevVer := slotVersions(dbrra)
+		dps = make(map[int64]float64)
+		for i := int64(0); i < frra.meta.Size; i++ {
+			ver := int32(binary.BigEndian.Uint32(slots[i*fileSlot:]))
+			dp := math.Float64frombits(binary.BigEndian.Uint64(slots[i*fileSlot+4:]))
+			if !math.IsNaN(dp) && ((i <= latestI && ver == int32(latestVer)) || (i > latestI && ver == int32(prevVer))) {
+				dps[i] = dp
+			}
+		}
+	}
+
+	spec := dbrra.Spec()
+	spec.Latest = dbrra.Latest()
+	spec.Value = dbrra.Value()
+	spec.Duration = dbrra.Duration()
+	spec.DPs = dps
+	return newDbRoundRobinArchive(dbrra.id, dbrra.width, dbrra.bundleId, dbrra.pos, spec)
+}
+
+func (frra *fileRRA) readSlots() ([]byte, error) {
+	f, err := os.Open(frra.ds.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	slots := make([]byte, frra.meta.Size*fileSlot)
+	_, err = f.ReadAt(slots, frra.offset+rraStateLen)
+	return slots, err
+}
+
+// TsTableSize returns the size of all the DS files and the number of
+// slots in them.
+func (p *fileSerDe) TsTableSize() (size, count int64, err error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, fds := range p.byId {
+		fi, err := os.Stat(fds.path)
+		if err != nil {
+			return 0, 0, err
+		}
+		size += fi.Size()
+		for _, rm := range fds.meta.RRAs {
+			count += rm.Size
+		}
+	}
+	return size, count, nil
+}
+
+// RegisterDeleteListener does nothing. A DS whose file is deleted
+// stays in the cache until restart.
+func (p *fileSerDe) RegisterDeleteListener(func(Ident)) error {
+	return nil
+}
+
+// writeAt writes b at the offsets of the files of the DSs or RRAs
+// (whose keys are idxs) that locate returns, nil ones are skipped, as
+// a flush to a deleted row would be. The files are opened and closed
+// every time, there would be too many to keep open.
+func (p *fileSerDe) writeAt(idxs []int64, locate func(idx int64) (path string, offset int64), b func(idx int64) []byte) (int, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, idx := range idxs {
+		path, offset := locate(idx)
+		if path == "" {
+			continue
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return 0, err
+		}
+		_, err = f.WriteAt(b(idx), offset)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(idxs), nil
+}
+
+func fileIdxs(m map[int64]interface{}) []int64 {
+	idxs := make([]int64, 0, len(m))
+	for idx := range m {
+		idxs = append(idxs, idx)
+	}
+	return idxs
+}
+
+// The state of a DS or RRA is always flushed in its entirety, i.e.
+// the maps have the same idxs.
+
+func (p *fileSerDe) FlushDSStates(seg int64, lastupdate, value, duration, lastRaw map[int64]interface{}) (int, error) {
+	return p.writeAt(fileIdxs(lastupdate), func(idx int64) (string, int64) {
+		if fds := p.byId[seg*int64(PgSegmentWidth)+idx]; fds != nil {
+			return fds.path, fileOffDsState
+		}
+		return "", 0
+	}, func(idx int64) []byte {
+		return encodeDsState(flushInt64(lastupdate[idx]), flushInt64(duration[idx]), flushFloat(value[idx]), flushFloat(lastRaw[idx]))
+	})
+}
+
+func (p *fileSerDe) FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (int, error) {
+	return p.writeAt(fileIdxs(latests), func(idx int64) (string, int64) {
+		if frra := p.rras[[2]int64{bundle_id, seg*int64(PgSegmentWidth) + idx}]; frra != nil {
+			return frra.ds.path, frra.offset
+		}
+		return "", 0
+	}, func(idx int64) []byte {
+		return encodeRRAState(flushInt64(latests[idx]), flushInt64(duration[idx]), flushFloat(value[idx]))
+	})
+}
+
+func (p *fileSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]interface{}) (int, error) {
+	return p.writeAt(fileIdxs(dps), func(idx int64) (string, int64) {
+		if frra := p.rras[[2]int64{bundle_id, seg*int64(PgSegmentWidth) + idx}]; frra != nil && i < frra.meta.Size {
+			return frra.ds.path, frra.offset + rraStateLen + i*fileSlot
+		}
+		return "", 0
+	}, func(idx int64) []byte {
+		b := make([]byte, fileSlot)
+		fileWriteSlot(b, int32(flushInt64(vers[idx])), flushFloat(dps[idx]))
+		return b
+	})
+}
+
+// DSL LRU keys, in dsl_cache.json
+
+func (p *fileSerDe) SaveDSLCacheKeys(idents []Ident) error {
+	data, err := json.Marshal(idents)
+	if err == nil {
+		tmp := filepath.Join(p.dir, "dsl_cache.json.tmp")
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, filepath.Join(p.dir, "dsl_cache.json"))
+		}
+	}
+	if err != nil {
+		log.Printf("SaveDSLCacheKeys(): %v", err)
+	}
+	return err
+}
+
+func (p *fileSerDe) LoadDSLCacheKeys() ([]Ident, error) {
+	data, err := ioutil.ReadFile(filepath.Join(p.dir, "dsl_cache.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	var result []Ident
+	if err == nil {
+		err = json.Unmarshal(data, &result)
+	}
+	if err != nil {
+		log.Printf("LoadDSLCacheKeys(): %v", err)
+		return nil, err
+	}
+	return result, nil
+}
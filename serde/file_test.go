@@ -0,0 +1,137 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_fileSerDe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := InitFileDb(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := p.filePath(Ident{"name": "foo.b/r..baz", "host": "a b"}); path != filepath.Join(dir, "foo", "b%2Fr", "_", "baz;host=a%20b.tgr") {
+		t.Errorf("filePath: unexpected %q", path)
+	}
+
+	spec := &rrd.DSSpec{Step: time.Second, Heartbeat: time.Minute, RRAs: []rrd.RRASpec{
+		{Function: rrd.WMEAN, Step: time.Second, Span: 10 * time.Second},
+		{Function: rrd.MAX, Step: time.Minute, Span: time.Hour},
+	}}
+	ids, err := p.FetchOrCreateDataSource(Ident{"name": "foo.bar"}, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := ids.(*DbDataSource)
+	if !ds.Created() || ds.Id() != 1 || len(ds.RRAs()) != 2 {
+		t.Fatalf("FetchOrCreateDataSource: unexpected %v", ds)
+	}
+	if _, err := p.FetchOrCreateDataSource(Ident{"name": "foo.baz"}, spec); err != nil {
+		t.Fatal(err)
+	}
+	if ds, _ := p.FetchOrCreateDataSource(Ident{"name": "nope"}, nil); ds != nil {
+		t.Errorf("FetchOrCreateDataSource: created with a nil spec")
+	}
+
+	// Flush the states and two data points as the flusher would
+	rra := ds.RRAs()[0].(*DbRoundRobinArchive)
+	latest := time.Unix(25, 0)
+	rrs := rra.Spec()
+	rrs.Latest = latest
+	chk, _ := newDbRoundRobinArchive(rra.id, rra.width, rra.bundleId, rra.pos, rrs)
+	_, ver, prev := slotVersions(chk)
+	p.FlushDSStates(ds.Seg(), map[int64]interface{}{ds.Idx(): latest}, map[int64]interface{}{ds.Idx(): 1.5},
+		map[int64]interface{}{ds.Idx(): int64(500)}, map[int64]interface{}{ds.Idx(): 7.0})
+	p.FlushRRAStates(rra.BundleId(), rra.Seg(), map[int64]interface{}{rra.Idx(): latest}, map[int64]interface{}{rra.Idx(): 2.0},
+		map[int64]interface{}{rra.Idx(): int64(300)})
+	p.FlushDataPoints(rra.BundleId(), rra.Seg(), 5, map[int64]interface{}{rra.Idx(): 10.0}, map[int64]interface{}{rra.Idx(): ver})
+	p.FlushDataPoints(rra.BundleId(), rra.Seg(), 7, map[int64]interface{}{rra.Idx(): 20.0}, map[int64]interface{}{rra.Idx(): prev})
+	p.FlushDataPoints(rra.BundleId(), rra.Seg(), 8, map[int64]interface{}{rra.Idx(): 30.0}, map[int64]interface{}{rra.Idx(): ver}) // stale
+
+	// A copy of a file conflicts and is renumbered on start
+	data, _ := ioutil.ReadFile(p.filePath(Ident{"name": "foo.bar"}))
+	ioutil.WriteFile(filepath.Join(dir, "zcopy.tgr"), data, 0644)
+	os.MkdirAll(filepath.Join(dir, "other"), 0755)
+	other, _ := InitFileDb(filepath.Join(dir, "other"), "")
+	other.FetchOrCreateDataSource(Ident{"name": "copied"}, spec)
+	data, _ = ioutil.ReadFile(other.filePath(Ident{"name": "copied"}))
+	ioutil.WriteFile(filepath.Join(dir, "zcopied.tgr"), data, 0644)
+
+	p, err = InitFileDb(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dss, err := p.FetchDataSources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dss) != 3 { // the copy of foo.bar has the same ident
+		t.Fatalf("FetchDataSources: expected 3 DSs, got %d", len(dss))
+	}
+	ds = dss[0].(*DbDataSource)
+	if ds.Ident()["name"] != "foo.bar" || !ds.LastUpdate().Equal(latest) || ds.Value() != 1.5 || ds.LastRaw() != 7 {
+		t.Errorf("FetchDataSources: unexpected DS state %v %v %v %v", ds.Ident(), ds.LastUpdate(), ds.Value(), ds.LastRaw())
+	}
+	if c := dss[2].(*DbDataSource); c.Ident()["name"] != "copied" || c.Id() != 3 || c.RRAs()[0].(*DbRoundRobinArchive).pos != 3 {
+		t.Errorf("InitFileDb: expected copied to be renumbered, got id %d", c.Id())
+	}
+
+	loaded, err := p.LoadRRAData(ds.RRAs()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dps := loaded.DPs(); len(dps) != 2 || dps[5] != 10 || dps[7] != 20 || loaded.Value() != 2 {
+		t.Errorf("LoadRRAData: unexpected %v, value %v", dps, loaded.Value())
+	}
+
+	if err := p.ArchiveDataSource(ds.Id()); err != nil {
+		t.Fatal(err)
+	}
+	res, _ := p.Search(SearchQuery{"name": "^FOO"})
+	sr := res.(ArchivedSearchResult)
+	n := 0
+	for sr.Next() {
+		if n++; sr.Ident()["name"] == "foo.bar" && !sr.Archived() {
+			t.Errorf("Search: foo.bar should be archived")
+		}
+	}
+	if n != 2 {
+		t.Errorf("Search: expected 2 results, got %d", n)
+	}
+	if dss, _ = p.FetchDataSources(); len(dss) != 2 {
+		t.Errorf("FetchDataSources: expected the archived DS to be left out, got %d", len(dss))
+	}
+
+	if err := p.SaveDSLCacheKeys([]Ident{{"name": "foo.bar"}}); err != nil {
+		t.Fatal(err)
+	}
+	if idents, _ := p.LoadDSLCacheKeys(); len(idents) != 1 || idents[0]["name"] != "foo.bar" {
+		t.Errorf("LoadDSLCacheKeys: unexpected %v", idents)
+	}
+}
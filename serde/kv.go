@@ -0,0 +1,772 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//
+// An implementation on an embedded ordered key-value store, such as
+// Bolt, for single binary installs which need more write throughput
+// than SQLite.
+//
+
+// The keys (after the table prefix) are a kind byte followed by
+// big-endian ids:
+//
+//   d <ds id>                     the DS meta (JSON)
+//   i <ident>                     the DS id
+//   s <ds id>                     the DS state
+//   r <bundle id> <pos>           the state of an RRA
+//   t <bundle id> <pos> <ver> <i> a data point of an RRA
+//   b <step_ms> <size>            the RRA bundle id
+//   p <bundle id>                 the last pos of a bundle
+//   n <name>                      the last ds, rra or bundle id
+//   c                             the DSL cache keys (JSON)
+//
+// The data points of an RRA are partitioned by time, i.e. by the slot
+// version, which changes every time round (see postgres.go), so that
+// the current data points are two contiguous ranges of keys, and once
+// the RRA is written in a new round, the partitions that are no
+// longer current are deleted. The seg and idx of a DS are derived
+// from its id, those of an RRA from its pos.
+
+package serde
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/series"
+)
+
+// KVStore is an ordered key-value store with transactions (e.g. Bolt,
+// see InitBoltDb), which the KV serde stores everything in.
+type KVStore interface {
+	View(func(KVTx) error) error
+	// An error returned by the function rolls back the transaction.
+	Update(func(KVTx) error) error
+	Close() error
+}
+
+// KVTx is a transaction of a KVStore. The values it returns are only
+// valid until it ends, those passed to it must not be modified.
+type KVTx interface {
+	Get(key []byte) ([]byte, error) // nil if there is none
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	// Scan calls fn with the keys with prefix, in order, and their
+	// values until it returns false. fn must not modify the store.
+	Scan(prefix []byte, fn func(key, value []byte) bool) error
+}
+
+// The kinds of keys, see above.
+const (
+	kvDs       = 'd'
+	kvIdent    = 'i'
+	kvDsState  = 's'
+	kvRRAState = 'r'
+	kvTs       = 't'
+	kvBundle   = 'b'
+	kvLastPos  = 'p'
+	kvSeq      = 'n'
+	kvDslCache = 'c'
+)
+
+type kvSerDe struct {
+	kv       KVStore
+	prefix   string
+	mu       sync.Mutex // serializes the creation of DSs
+	roundsMu sync.Mutex
+	rounds   map[[2]int64]int64 // the latest version written, by bundle id and pos
+}
+
+// kvDsValue is the value of a d key.
+type kvDsValue struct {
+	dsMeta
+	Archived bool        `json:"archived,omitempty"`
+	Metadata *DSMetadata `json:"metadata,omitempty"`
+}
+
+// InitKVDb returns a serde storing everything in kv, the keys
+// begin with prefix.
+func InitKVDb(kv KVStore, prefix string) *kvSerDe {
+	return &kvSerDe{kv: kv, prefix: prefix, rounds: make(map[[2]int64]int64)}
+}
+
+func init() {
+	Register("bolt", func(path, prefix string) (DbSerDe, error) {
+		db, err := InitBoltDb(path, prefix)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	})
+}
+
+// InitBoltDb opens (and creates, if needed) the Bolt database in the
+// file path, see InitKVDb.
+func InitBoltDb(path, prefix string) (*kvSerDe, error) {
+	kv, err := openBolt(path)
+	if err != nil {
+		return nil, fmt.Errorf("InitBoltDb(): %v", err)
+	}
+	return InitKVDb(kv, prefix), nil
+}
+
+func (p *kvSerDe) Fetcher() Fetcher             { return p }
+func (p *kvSerDe) Flusher() Flusher             { return p }
+func (p *kvSerDe) EventListener() EventListener { return p }
+func (p *kvSerDe) DbAddresser() DbAddresser     { return p }
+
+// There are no other clients, the store is embedded.
+func (p *kvSerDe) ListDbClientIps() ([]string, error) { return nil, nil }
+func (p *kvSerDe) MyDbAddr() (*string, error)         { return nil, nil }
+
+func (p *kvSerDe) key(kind byte, ids ...int64) []byte {
+	k := make([]byte, len(p.prefix)+1, len(p.prefix)+1+8*len(ids)+10)
+	copy(k, p.prefix)
+	k[len(p.prefix)] = kind
+	for _, id := range ids {
+		k = kvAppendInt64(k, id)
+	}
+	return k
+}
+
+func kvAppendInt64(b []byte, n int64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(n))
+	return append(b, buf[:]...)
+}
+
+// kvInt64 decodes an id, nil is 0.
+func kvInt64(v []byte) int64 {
+	if len(v) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(v))
+}
+
+// tsKey is the key of a data point, or of a partition if i is
+// negative, or of all the partitions if ver is too.
+func (p *kvSerDe) tsKey(bundleId, pos, ver, i int64) []byte {
+	k := p.key(kvTs, bundleId, pos)
+	if ver >= 0 {
+		k = append(k, byte(ver>>8), byte(ver))
+		if i >= 0 {
+			k = kvAppendInt64(k, i)
+		}
+	}
+	return k
+}
+
+// nextSeq returns the next id of a kind.
+func (p *kvSerDe) nextSeq(tx KVTx, name string) (int64, error) {
+	k := append(p.key(kvSeq), name...)
+	v, err := tx.Get(k)
+	if err != nil {
+		return 0, err
+	}
+	n := kvInt64(v) + 1
+	return n, tx.Put(k, kvAppendInt64(nil, n))
+}
+
+// getDs returns the meta of a DS, or nil if there is none.
+func (p *kvSerDe) getDs(tx KVTx, id int64) (*kvDsValue, error) {
+	v, err := tx.Get(p.key(kvDs, id))
+	if err != nil || v == nil {
+		return nil, err
+	}
+	var dsv kvDsValue
+	if err := json.Unmarshal(v, &dsv); err != nil {
+		return nil, fmt.Errorf("invalid meta of DS %d: %v", id, err)
+	}
+	return &dsv, nil
+}
+
+func (p *kvSerDe) putDs(tx KVTx, id int64, dsv *kvDsValue) error {
+	v, err := json.Marshal(dsv)
+	if err != nil {
+		return err
+	}
+	return tx.Put(p.key(kvDs, id), v)
+}
+
+// dataSource reads the states of a DS and its RRAs.
+func (p *kvSerDe) dataSource(tx KVTx, id int64, dsv *kvDsValue, created bool) (*DbDataSource, error) {
+	dsState, err := tx.Get(p.key(kvDsState, id))
+	if err != nil {
+		return nil, err
+	}
+	rraStates := make([][]byte, len(dsv.RRAs))
+	for n, rm := range dsv.RRAs {
+		if rraStates[n], err = tx.Get(p.key(kvRRAState, rm.BundleId, rm.Pos)); err != nil {
+			return nil, err
+		}
+	}
+	return dataSourceFromMeta(id, &dsv.dsMeta, dsState, rraStates, created)
+}
+
+func (p *kvSerDe) FetchDataSources() ([]rrd.DataSourcer, error) {
+	var result []rrd.DataSourcer
+	err := p.kv.View(func(tx KVTx) error {
+		var (
+			ids  []int64
+			dsvs []*kvDsValue
+			err  error
+		)
+		prefix := p.key(kvDs)
+		if err := tx.Scan(prefix, func(k, v []byte) bool {
+			var dsv kvDsValue
+			if err = json.Unmarshal(v, &dsv); err != nil {
+				err = fmt.Errorf("invalid meta of DS %d: %v", kvInt64(k[len(prefix):]), err)
+				return false
+			}
+			ids, dsvs = append(ids, kvInt64(k[len(prefix):])), append(dsvs, &dsv)
+			return true
+		}); err != nil {
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		for n, dsv := range dsvs {
+			if dsv.Archived || len(dsv.RRAs) == 0 { // as in PostgreSQL
+				continue
+			}
+			ds, err := p.dataSource(tx, ids[n], dsv, false)
+			if err != nil {
+				return err
+			}
+			result = append(result, ds)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("FetchDataSources(): %v", err)
+		return nil, err
+	}
+	return result, nil
+}
+
+// ArchiveDataSource marks a DS as archived, as in PostgreSQL.
+func (p *kvSerDe) ArchiveDataSource(id int64) error {
+	err := p.kv.Update(func(tx KVTx) error {
+		dsv, err := p.getDs(tx, id)
+		if err != nil || dsv == nil || dsv.Archived {
+			return err
+		}
+		dsv.Archived = true
+		return p.putDs(tx, id, dsv)
+	})
+	if err != nil {
+		log.Printf("ArchiveDataSource(): %v", err)
+	}
+	return err
+}
+
+// SetMetadata replaces the metadata of a DS.
+func (p *kvSerDe) SetMetadata(id int64, md DSMetadata) error {
+	err := p.kv.Update(func(tx KVTx) error {
+		dsv, err := p.getDs(tx, id)
+		if err != nil {
+			return err
+		}
+		if dsv == nil {
+			return fmt.Errorf("no DS with id %d", id)
+		}
+		dsv.Metadata = nil
+		if !md.Empty() {
+			dsv.Metadata = &md
+		}
+		return p.putDs(tx, id, dsv)
+	})
+	if err != nil {
+		log.Printf("SetMetadata(): %v", err)
+	}
+	return err
+}
+
+// LoadMetadata returns the metadata of the idents.
+func (p *kvSerDe) LoadMetadata(idents []Ident) (map[string]DSMetadata, error) {
+	result := make(map[string]DSMetadata)
+	err := p.kv.View(func(tx KVTx) error {
+		for _, ident := range idents {
+			v, err := tx.Get(append(p.key(kvIdent), ident.String()...))
+			if err != nil || v == nil {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			dsv, err := p.getDs(tx, kvInt64(v))
+			if err != nil {
+				return err
+			}
+			if dsv != nil && dsv.Metadata != nil {
+				result[ident.String()] = *dsv.Metadata
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("LoadMetadata(): %v", err)
+		return nil, err
+	}
+	return result, nil
+}
+
+// RenameDataSource changes the ident of a DS. It is an error if the
+// ident is taken.
+func (p *kvSerDe) RenameDataSource(id int64, ident Ident) error {
+	p.mu.Lock() // as creating, which could take the ident
+	defer p.mu.Unlock()
+	err := p.kv.Update(func(tx KVTx) error {
+		dsv, err := p.getDs(tx, id)
+		if err != nil {
+			return err
+		}
+		if dsv == nil {
+			return fmt.Errorf("no DS with id %d", id)
+		}
+		newKey := append(p.key(kvIdent), ident.String()...)
+		if v, err := tx.Get(newKey); err != nil || v != nil {
+			if err == nil {
+				err = fmt.Errorf("a DS with ident %v exists", ident)
+			}
+			return err
+		}
+		if err := tx.Delete(append(p.key(kvIdent), dsv.Ident.String()...)); err != nil {
+			return err
+		}
+		if err := tx.Put(newKey, kvAppendInt64(nil, id)); err != nil {
+			return err
+		}
+		dsv.Ident = ident
+		return p.putDs(tx, id, dsv)
+	})
+	if err != nil {
+		log.Printf("RenameDataSource(): %v", err)
+	}
+	return err
+}
+
+// DeleteDataSource deletes a DS along with its state, RRAs and data
+// points in a single transaction.
+func (p *kvSerDe) DeleteDataSource(id int64) error {
+	var rras []*rraMeta
+	err := p.kv.Update(func(tx KVTx) error {
+		dsv, err := p.getDs(tx, id)
+		if err != nil || dsv == nil {
+			return err
+		}
+		keys := [][]byte{p.key(kvDs, id), append(p.key(kvIdent), dsv.Ident.String()...), p.key(kvDsState, id)}
+		for _, rm := range dsv.RRAs {
+			keys = append(keys, p.key(kvRRAState, rm.BundleId, rm.Pos))
+			if err := tx.Scan(p.tsKey(rm.BundleId, rm.Pos, -1, -1), func(k, _ []byte) bool {
+				keys = append(keys, append([]byte(nil), k...))
+				return true
+			}); err != nil {
+				return err
+			}
+		}
+		for _, k := range keys {
+			if err := tx.Delete(k); err != nil {
+				return err
+			}
+		}
+		rras = dsv.RRAs
+		return nil
+	})
+	if err != nil {
+		log.Printf("DeleteDataSource(): %v", err)
+		return err
+	}
+	p.roundsMu.Lock()
+	for _, rm := range rras {
+		delete(p.rounds, [2]int64{rm.BundleId, rm.Pos})
+	}
+	p.roundsMu.Unlock()
+	return nil
+}
+
+// FetchOrCreateDataSource loads or creates a DS, in the latter case
+// along with its state and RRAs in a single transaction. The returned
+// DS contains no data (use FetchSeries). A nil dsSpec means fetch
+// only, do not create.
+func (p *kvSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	var ds *DbDataSource
+	fetch := func(tx KVTx) (*kvDsValue, int64, error) {
+		v, err := tx.Get(append(p.key(kvIdent), ident.String()...))
+		if err != nil || v == nil {
+			return nil, 0, err
+		}
+		id := kvInt64(v)
+		dsv, err := p.getDs(tx, id)
+		if err == nil && dsv != nil {
+			ds, err = p.dataSource(tx, id, dsv, false)
+		}
+		return dsv, id, err
+	}
+
+	if dsSpec == nil {
+		err := p.kv.View(func(tx KVTx) error {
+			_, _, err := fetch(tx)
+			return err
+		})
+		if err != nil {
+			log.Printf("FetchOrCreateDataSource(): %v", err)
+			return nil, err
+		}
+		if ds == nil {
+			return nil, nil
+		}
+		return ds, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.kv.Update(func(tx KVTx) error {
+		dsv, id, err := fetch(tx)
+		if err != nil {
+			return err
+		}
+		if dsv != nil {
+			if dsv.Archived { // see pgvSerDe.FetchOrCreateDataSource
+				dsv.Archived = false
+				return p.putDs(tx, id, dsv)
+			}
+			return nil
+		}
+		ds, err = p.createDataSource(tx, ident, dsSpec)
+		return err
+	})
+	if err != nil {
+		log.Printf("FetchOrCreateDataSource(): %v", err)
+		return nil, err
+	}
+	return ds, nil
+}
+
+func (p *kvSerDe) createDataSource(tx KVTx, ident Ident, dsSpec *rrd.DSSpec) (*DbDataSource, error) {
+	id, err := p.nextSeq(tx, "ds")
+	if err != nil {
+		return nil, err
+	}
+	dsm := newDsMeta(ident, dsSpec, func(rm *rraMeta) {
+		if err != nil {
+			return
+		}
+		if rm.Id, err = p.nextSeq(tx, "rra"); err != nil {
+			return
+		}
+		if rm.BundleId, err = p.bundleId(tx, rm.StepMs, rm.Size); err != nil {
+			return
+		}
+		k := p.key(kvLastPos, rm.BundleId)
+		var v []byte
+		if v, err = tx.Get(k); err == nil {
+			rm.Pos = kvInt64(v) + 1
+			err = tx.Put(k, kvAppendInt64(nil, rm.Pos))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = p.putDs(tx, id, &kvDsValue{dsMeta: *dsm}); err != nil {
+		return nil, err
+	}
+	if err = tx.Put(append(p.key(kvIdent), ident.String()...), kvAppendInt64(nil, id)); err != nil {
+		return nil, err
+	}
+	dsState := newDsState()
+	if err = tx.Put(p.key(kvDsState, id), dsState); err != nil {
+		return nil, err
+	}
+	rraStates := make([][]byte, len(dsm.RRAs))
+	for n, rm := range dsm.RRAs {
+		rraStates[n] = newRRAState(dsSpec.RRAs[n])
+		if err = tx.Put(p.key(kvRRAState, rm.BundleId, rm.Pos), rraStates[n]); err != nil {
+			return nil, err
+		}
+	}
+	return dataSourceFromMeta(id, dsm, dsState, rraStates, true)
+}
+
+// bundleId returns the id of the RRA bundle of this step and size,
+// creating it if need be.
+func (p *kvSerDe) bundleId(tx KVTx, stepMs, size int64) (int64, error) {
+	k := p.key(kvBundle, stepMs, size)
+	v, err := tx.Get(k)
+	if err != nil || v != nil {
+		return kvInt64(v), err
+	}
+	id, err := p.nextSeq(tx, "bundle")
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Put(k, kvAppendInt64(nil, id))
+}
+
+// Search returns the idents matching the query, see
+// SearchQuery.matcher.
+func (p *kvSerDe) Search(query SearchQuery) (SearchResult, error) {
+	match, err := query.matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	sr := newIdentSearchResult()
+	err = p.kv.View(func(tx KVTx) error {
+		return tx.Scan(p.key(kvDs), func(k, v []byte) bool {
+			var dsv kvDsValue
+			if err := json.Unmarshal(v, &dsv); err != nil {
+				log.Printf("Search(): error unmarshalling DS meta: %v", err)
+				return true
+			}
+			if match(dsv.Ident) {
+				sr.add(dsv.Ident, dsv.Archived)
+			}
+			return true
+		})
+	})
+	if err != nil {
+		log.Printf("Search(): %v", err)
+		return nil, err
+	}
+	return sr, nil
+}
+
+// FetchSeries loads the data of the most suitable RRA and presents it
+// as a series, see rraDataSeries.
+func (p *kvSerDe) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	return rraDataSeries(ds, from, to, maxPoints, p.LoadRRAData)
+}
+
+// LoadRRAData returns a new RRA based on the one passed in and
+// containing all of its current data points, see
+// pgvSerDe.LoadRRAData: those up to the latest in its partition and
+// those after it in the previous one.
+func (p *kvSerDe) LoadRRAData(rra rrd.RoundRobinArchiver) (rrd.RoundRobinArchiver, error) {
+	dbrra, ok := rra.(*DbRoundRobinArchive)
+	if !ok {
+		return nil, fmt.Errorf("LoadRRAData: Not a *DbRoundRobinArchive")
+	}
+
+	var dps map[int64]float64
+	if !rra.Latest().IsZero() {
+		latestI, latestVer, prevVer := slotVersions(dbrra)
+		dps = make(map[int64]float64)
+		err := p.kv.View(func(tx KVTx) error {
+			for _, part := range []struct {
+				ver    int
+				latest bool
+			}{{latestVer, true}, {prevVer, false}} {
+				prefix := p.tsKey(dbrra.BundleId(), dbrra.pos, int64(part.ver), -1)
+				if err := tx.Scan(prefix, func(k, v []byte) bool {
+					i := kvInt64(k[len(prefix):])
+					if dp := math.Float64frombits(binary.BigEndian.Uint64(v)); !math.IsNaN(dp) && (i <= latestI) == part.latest {
+						dps[i] = dp
+					}
+					return true
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("LoadRRAData: error %v", err)
+			return nil, err
+		}
+	}
+
+	spec := dbrra.Spec()
+	spec.Latest = dbrra.Latest()
+	spec.Value = dbrra.Value()
+	spec.Duration = dbrra.Duration()
+	spec.DPs = dps
+	return newDbRoundRobinArchive(dbrra.id, dbrra.width, dbrra.bundleId, dbrra.pos, spec)
+}
+
+// RegisterDeleteListener does nothing, there are no notifications.
+func (p *kvSerDe) RegisterDeleteListener(func(Ident)) error {
+	return nil
+}
+
+// kvFlusher performs the flushes in a transaction each or, if it is a
+// batch, all of them in a single one on Commit.
+type kvFlusher struct {
+	p     *kvSerDe
+	batch bool
+	ops   []func(KVTx) error
+}
+
+func (f *kvFlusher) run(op func(KVTx) error) (int, error) {
+	if f.batch {
+		f.ops = append(f.ops, op)
+		return 1, nil
+	}
+	return 1, f.p.kv.Update(op)
+}
+
+func (f *kvFlusher) Commit() error {
+	ops := f.ops
+	f.ops = nil
+	return f.p.kv.Update(func(tx KVTx) error {
+		for _, op := range ops {
+			if err := op(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (f *kvFlusher) Rollback() error {
+	f.ops = nil
+	return nil
+}
+
+// BeginFlushBatch returns a FlushBatch whose flushes are all
+// performed in a single transaction on Commit.
+func (p *kvSerDe) BeginFlushBatch() (FlushBatch, error) {
+	return &kvFlusher{p: p, batch: true}, nil
+}
+
+func (p *kvSerDe) FlushDSStates(seg int64, lastupdate, value, duration, lastRaw map[int64]interface{}) (int, error) {
+	return (&kvFlusher{p: p}).FlushDSStates(seg, lastupdate, value, duration, lastRaw)
+}
+
+func (p *kvSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]interface{}) (int, error) {
+	return (&kvFlusher{p: p}).FlushDataPoints(bundle_id, seg, i, dps, vers)
+}
+
+func (p *kvSerDe) FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (int, error) {
+	return (&kvFlusher{p: p}).FlushRRAStates(bundle_id, seg, latests, value, duration)
+}
+
+// The state of a DS or RRA is always flushed in its entirety, i.e.
+// the maps have the same idxs.
+
+func (f *kvFlusher) FlushDSStates(seg int64, lastupdate, value, duration, lastRaw map[int64]interface{}) (int, error) {
+	return f.run(func(tx KVTx) error {
+		for idx, lu := range lastupdate {
+			state := encodeDsState(flushInt64(lu), flushInt64(duration[idx]), flushFloat(value[idx]), flushFloat(lastRaw[idx]))
+			if err := tx.Put(f.p.key(kvDsState, seg*int64(PgSegmentWidth)+idx), state); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (f *kvFlusher) FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (int, error) {
+	return f.run(func(tx KVTx) error {
+		for idx, latest := range latests {
+			state := encodeRRAState(flushInt64(latest), flushInt64(duration[idx]), flushFloat(value[idx]))
+			if err := tx.Put(f.p.key(kvRRAState, bundle_id, seg*int64(PgSegmentWidth)+idx), state); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (f *kvFlusher) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]interface{}) (int, error) {
+	return f.run(func(tx KVTx) error {
+		for idx, dp := range dps {
+			pos, ver := seg*int64(PgSegmentWidth)+idx, flushInt64(vers[idx])
+			v := make([]byte, 8)
+			binary.BigEndian.PutUint64(v, math.Float64bits(flushFloat(dp)))
+			if err := tx.Put(f.p.tsKey(bundle_id, pos, ver, i), v); err != nil {
+				return err
+			}
+			if err := f.p.dropRounds(tx, bundle_id, pos, ver); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// dropRounds deletes the partitions of an RRA other than that of ver
+// and the previous one, the first time ver is written (since start).
+// The previous version is as in slotVersions, and also the one before
+// ver, which is not the same when ver is 0.
+func (p *kvSerDe) dropRounds(tx KVTx, bundleId, pos, ver int64) error {
+	key := [2]int64{bundleId, pos}
+	p.roundsMu.Lock()
+	last, ok := p.rounds[key]
+	if ok && (last == ver || (ver+1)%32767 == last) { // nothing new, or a late write of the previous round
+		p.roundsMu.Unlock()
+		return nil
+	}
+	p.rounds[key] = ver
+	p.roundsMu.Unlock()
+
+	prefix := p.tsKey(bundleId, pos, -1, -1)
+	keep := map[int64]bool{ver: true, (ver + 32766) % 32767: true}
+	if ver == 0 {
+		keep[32767] = true
+	}
+	var drop [][]byte
+	if err := tx.Scan(prefix, func(k, _ []byte) bool {
+		if len(k) >= len(prefix)+2 && !keep[int64(k[len(prefix)])<<8|int64(k[len(prefix)+1])] {
+			drop = append(drop, append([]byte(nil), k...))
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	for _, k := range drop {
+		if err := tx.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DSL LRU keys
+
+func (p *kvSerDe) SaveDSLCacheKeys(idents []Ident) error {
+	v, err := json.Marshal(idents)
+	if err == nil {
+		err = p.kv.Update(func(tx KVTx) error { return tx.Put(p.key(kvDslCache), v) })
+	}
+	if err != nil {
+		log.Printf("SaveDSLCacheKeys(): %v", err)
+	}
+	return err
+}
+
+func (p *kvSerDe) LoadDSLCacheKeys() ([]Ident, error) {
+	var result []Ident
+	err := p.kv.View(func(tx KVTx) error {
+		v, err := tx.Get(p.key(kvDslCache))
+		if err != nil || v == nil {
+			return err
+		}
+		return json.Unmarshal(v, &result)
+	})
+	if err != nil {
+		log.Printf("LoadDSLCacheKeys(): %v", err)
+		return nil, err
+	}
+	return result, nil
+}
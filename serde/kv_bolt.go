@@ -0,0 +1,76 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build bolt
+
+package serde
+
+import (
+	"bytes"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt is only linked in when building with -tags bolt.
+
+var boltBucket = []byte("tgres")
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBolt(path string) (KVStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) View(fn func(KVTx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error { return fn(boltTx{tx.Bucket(boltBucket)}) })
+}
+
+func (s *boltStore) Update(fn func(KVTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error { return fn(boltTx{tx.Bucket(boltBucket)}) })
+}
+
+func (s *boltStore) Close() error { return s.db.Close() }
+
+type boltTx struct {
+	b *bolt.Bucket
+}
+
+func (t boltTx) Get(key []byte) ([]byte, error) { return t.b.Get(key), nil }
+func (t boltTx) Put(key, value []byte) error    { return t.b.Put(key, value) }
+func (t boltTx) Delete(key []byte) error        { return t.b.Delete(key) }
+
+func (t boltTx) Scan(prefix []byte, fn func(key, value []byte) bool) error {
+	c := t.b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if !fn(k, v) {
+			break
+		}
+	}
+	return nil
+}
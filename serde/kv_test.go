@@ -0,0 +1,189 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// memKV is a KVStore in a map, Update is rolled back on error.
+type memKV struct {
+	sync.Mutex
+	m map[string][]byte
+}
+
+func (s *memKV) View(fn func(KVTx) error) error {
+	s.Lock()
+	defer s.Unlock()
+	return fn(memKVTx{s.m})
+}
+
+func (s *memKV) Update(fn func(KVTx) error) error {
+	s.Lock()
+	defer s.Unlock()
+	m := make(map[string][]byte, len(s.m))
+	for k, v := range s.m {
+		m[k] = v
+	}
+	if err := fn(memKVTx{m}); err != nil {
+		return err
+	}
+	s.m = m
+	return nil
+}
+
+func (s *memKV) Close() error { return nil }
+
+type memKVTx struct {
+	m map[string][]byte
+}
+
+func (t memKVTx) Get(key []byte) ([]byte, error) { return t.m[string(key)], nil }
+func (t memKVTx) Delete(key []byte) error        { delete(t.m, string(key)); return nil }
+
+func (t memKVTx) Put(key, value []byte) error {
+	if len(key) == 0 {
+		return fmt.Errorf("empty key")
+	}
+	t.m[string(key)] = value
+	return nil
+}
+
+func (t memKVTx) Scan(prefix []byte, fn func(key, value []byte) bool) error {
+	var keys []string
+	for k := range t.m {
+		if strings.HasPrefix(k, string(prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !fn([]byte(k), t.m[k]) {
+			break
+		}
+	}
+	return nil
+}
+
+func Test_kvSerDe(t *testing.T) {
+	if _, err := InitBoltDb("/nonexistent/tgres.db", ""); err == nil {
+		t.Errorf("InitBoltDb: expected an error")
+	}
+
+	kv := &memKV{m: make(map[string][]byte)}
+	p := InitKVDb(kv, "tgres_")
+
+	spec := &rrd.DSSpec{Step: time.Second, Heartbeat: time.Minute, RRAs: []rrd.RRASpec{
+		{Function: rrd.WMEAN, Step: time.Second, Span: 10 * time.Second},
+		{Function: rrd.MAX, Step: time.Second, Span: 10 * time.Second},
+	}}
+	ids, err := p.FetchOrCreateDataSource(Ident{"name": "foo.bar"}, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := ids.(*DbDataSource)
+	if !ds.Created() || ds.Id() != 1 || len(ds.RRAs()) != 2 {
+		t.Fatalf("FetchOrCreateDataSource: unexpected %v", ds)
+	}
+	if rra := ds.RRAs()[1].(*DbRoundRobinArchive); rra.BundleId() != 1 || rra.pos != 2 {
+		t.Errorf("FetchOrCreateDataSource: expected both RRAs in bundle 1, got %d pos %d", rra.BundleId(), rra.pos)
+	}
+	if ids, _ := p.FetchOrCreateDataSource(Ident{"name": "foo.bar"}, nil); ids == nil || ids.(*DbDataSource).Created() {
+		t.Errorf("FetchOrCreateDataSource: expected the existing DS")
+	}
+	if ids, _ := p.FetchOrCreateDataSource(Ident{"name": "nope"}, nil); ids != nil {
+		t.Errorf("FetchOrCreateDataSource: created with a nil spec")
+	}
+
+	// Flush as the flusher would, in a batch
+	rra := ds.RRAs()[0].(*DbRoundRobinArchive)
+	latest := time.Unix(25, 0)
+	rrs := rra.Spec()
+	rrs.Latest = latest
+	chk, _ := newDbRoundRobinArchive(rra.id, rra.width, rra.bundleId, rra.pos, rrs)
+	_, ver, prev := slotVersions(chk)
+	fb, _ := p.BeginFlushBatch()
+	fb.FlushDSStates(ds.Seg(), map[int64]interface{}{ds.Idx(): latest}, map[int64]interface{}{ds.Idx(): 1.5},
+		map[int64]interface{}{ds.Idx(): int64(500)}, map[int64]interface{}{ds.Idx(): 7.0})
+	fb.FlushRRAStates(rra.BundleId(), rra.Seg(), map[int64]interface{}{rra.Idx(): latest}, map[int64]interface{}{rra.Idx(): 2.0},
+		map[int64]interface{}{rra.Idx(): int64(300)})
+	fb.FlushDataPoints(rra.BundleId(), rra.Seg(), 8, map[int64]interface{}{rra.Idx(): 30.0}, map[int64]interface{}{rra.Idx(): prev - 1}) // old round
+	fb.FlushDataPoints(rra.BundleId(), rra.Seg(), 9, map[int64]interface{}{rra.Idx(): 40.0}, map[int64]interface{}{rra.Idx(): prev})
+	fb.FlushDataPoints(rra.BundleId(), rra.Seg(), 5, map[int64]interface{}{rra.Idx(): 10.0}, map[int64]interface{}{rra.Idx(): ver})
+	fb.FlushDataPoints(rra.BundleId(), rra.Seg(), 7, map[int64]interface{}{rra.Idx(): 20.0}, map[int64]interface{}{rra.Idx(): prev})
+	fb.FlushDataPoints(rra.BundleId(), rra.Seg(), 3, map[int64]interface{}{rra.Idx(): 5.0}, map[int64]interface{}{rra.Idx(): prev}) // stale
+	if dss, _ := p.FetchDataSources(); dss[0].LastUpdate().Equal(latest) {
+		t.Errorf("FlushBatch: flushed before Commit")
+	}
+	if err := fb.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	dss, err := p.FetchDataSources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds = dss[0].(*DbDataSource)
+	if len(dss) != 1 || !ds.LastUpdate().Equal(latest) || ds.Value() != 1.5 || ds.LastRaw() != 7 {
+		t.Errorf("FetchDataSources: unexpected DS state %v %v %v", ds.LastUpdate(), ds.Value(), ds.LastRaw())
+	}
+	loaded, err := p.LoadRRAData(ds.RRAs()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dps := loaded.DPs(); len(dps) != 3 || dps[5] != 10 || dps[7] != 20 || dps[9] != 40 || loaded.Value() != 2 {
+		t.Errorf("LoadRRAData: unexpected %v, value %v", dps, loaded.Value())
+	}
+	n := 0
+	kv.View(func(tx KVTx) error {
+		return tx.Scan(p.tsKey(rra.BundleId(), rra.pos, -1, -1), func(_, _ []byte) bool { n++; return true })
+	})
+	if n != 4 {
+		t.Errorf("dropRounds: expected the old round to be deleted, %d data points left", n)
+	}
+
+	if err := p.ArchiveDataSource(ds.Id()); err != nil {
+		t.Fatal(err)
+	}
+	if dss, _ = p.FetchDataSources(); len(dss) != 0 {
+		t.Errorf("FetchDataSources: expected the archived DS to be left out")
+	}
+	res, _ := p.Search(SearchQuery{"name": "^FOO"})
+	sr := res.(ArchivedSearchResult)
+	if !sr.Next() || sr.Ident()["name"] != "foo.bar" || !sr.Archived() || sr.Next() {
+		t.Errorf("Search: expected the archived foo.bar")
+	}
+	if _, err := p.FetchOrCreateDataSource(Ident{"name": "foo.bar"}, spec); err != nil {
+		t.Fatal(err)
+	}
+	if dss, _ = p.FetchDataSources(); len(dss) != 1 {
+		t.Errorf("FetchOrCreateDataSource: expected the DS to be unarchived")
+	}
+
+	if err := p.SaveDSLCacheKeys([]Ident{{"name": "foo.bar"}}); err != nil {
+		t.Fatal(err)
+	}
+	if idents, _ := p.LoadDSLCacheKeys(); len(idents) != 1 || idents[0]["name"] != "foo.bar" {
+		t.Errorf("LoadDSLCacheKeys: unexpected %v", idents)
+	}
+}
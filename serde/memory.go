@@ -25,8 +25,9 @@ import (
 
 type memSerDe struct {
 	*sync.RWMutex
-	byIdent map[string]*DbDataSource
-	lastId  int64
+	byIdent  map[string]*DbDataSource
+	lastId   int64
+	metadata map[int64]DSMetadata
 }
 
 // Returns a SerDe which keeps everything in memory.
@@ -82,6 +83,34 @@ func (m *memSerDe) FetchDataSources() ([]rrd.DataSourcer, error) {
 	return result, nil
 }
 
+func (m *memSerDe) SetMetadata(id int64, md DSMetadata) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.metadata == nil {
+		m.metadata = make(map[int64]DSMetadata)
+	}
+	if md.Empty() {
+		delete(m.metadata, id)
+	} else {
+		m.metadata[id] = md
+	}
+	return nil
+}
+
+func (m *memSerDe) LoadMetadata(idents []Ident) (map[string]DSMetadata, error) {
+	m.RLock()
+	defer m.RUnlock()
+	result := make(map[string]DSMetadata)
+	for _, ident := range idents {
+		if ds, ok := m.byIdent[ident.String()]; ok {
+			if md, ok := m.metadata[ds.Id()]; ok {
+				result[ident.String()] = md
+			}
+		}
+	}
+	return result, nil
+}
+
 func (m *memSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
 	m.Lock()
 	defer m.Unlock()
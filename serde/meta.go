@@ -0,0 +1,159 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// The DS meta and the binary states of the serdes which keep them
+// themselves, i.e. the file and KV serdes, rather than in tables.
+
+// dsMeta is what does not change about a DS (unless its ids are
+// reassigned), stored as JSON.
+type dsMeta struct {
+	Ident       Ident      `json:"ident"`
+	StepMs      int64      `json:"step_ms"`
+	HeartbeatMs int64      `json:"heartbeat_ms"`
+	DsType      string     `json:"ds_type"`
+	RRAs        []*rraMeta `json:"rras"`
+}
+
+type rraMeta struct {
+	Id       int64   `json:"id"`
+	BundleId int64   `json:"rra_bundle_id"`
+	Pos      int64   `json:"pos"`
+	StepMs   int64   `json:"step_ms"`
+	Size     int64   `json:"size"`
+	Cf       string  `json:"cf"`
+	Xff      float32 `json:"xff"`
+}
+
+// newDsMeta returns the meta of a new DS, the RRAs are allocated
+// their ids, bundles and positions by alloc.
+func newDsMeta(ident Ident, dsSpec *rrd.DSSpec, alloc func(rm *rraMeta)) *dsMeta {
+	meta := &dsMeta{Ident: ident, StepMs: dsSpec.Step.Nanoseconds() / 1e6, HeartbeatMs: dsSpec.Heartbeat.Nanoseconds() / 1e6,
+		DsType: dsSpec.Type.String()}
+	for _, rraSpec := range dsSpec.RRAs {
+		rm := &rraMeta{StepMs: rraSpec.Step.Nanoseconds() / 1e6, Size: rraSpec.Span.Nanoseconds() / rraSpec.Step.Nanoseconds(),
+			Cf: cfName(rraSpec.Function), Xff: rraSpec.Xff}
+		alloc(rm)
+		meta.RRAs = append(meta.RRAs, rm)
+	}
+	return meta
+}
+
+// The states are big-endian: a time (Unix ns, 0 is the zero time),
+// duration_ms and value, and for a DS also last_raw.
+const (
+	dsStateLen  = 32
+	rraStateLen = 24
+)
+
+func encodeRRAState(t, durationMs int64, value float64) []byte {
+	b := make([]byte, dsStateLen)
+	binary.BigEndian.PutUint64(b, uint64(t))
+	binary.BigEndian.PutUint64(b[8:], uint64(durationMs))
+	binary.BigEndian.PutUint64(b[16:], math.Float64bits(value))
+	return b[:rraStateLen]
+}
+
+func encodeDsState(t, durationMs int64, value, lastRaw float64) []byte {
+	b := encodeRRAState(t, durationMs, value)[:dsStateLen]
+	binary.BigEndian.PutUint64(b[24:], math.Float64bits(lastRaw))
+	return b
+}
+
+// newDsState is the state of a new DS.
+func newDsState() []byte { return encodeDsState(0, 0, 0, math.NaN()) }
+
+// newRRAState is the state of a new RRA.
+func newRRAState(spec rrd.RRASpec) []byte {
+	return encodeRRAState(flushInt64(spec.Latest), spec.Duration.Nanoseconds()/1e6, spec.Value)
+}
+
+func decodeState(b []byte) (t *time.Time, durationMs *int64, value *float64) {
+	tm, dur, val := time.Time{}, int64(binary.BigEndian.Uint64(b[8:])), math.Float64frombits(binary.BigEndian.Uint64(b[16:]))
+	if ns := int64(binary.BigEndian.Uint64(b)); ns != 0 {
+		tm = time.Unix(0, ns)
+	}
+	return &tm, &dur, &val
+}
+
+// flushInt64 converts the int64 values of the flusher, times are Unix
+// nanoseconds, 0 is the zero time.
+func flushInt64(v interface{}) int64 {
+	switch v := v.(type) {
+	case time.Time:
+		if v.IsZero() {
+			return 0
+		}
+		return v.UnixNano()
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	}
+	return 0
+}
+
+func flushFloat(v interface{}) float64 {
+	if f, ok := v.(float64); ok {
+		return f
+	}
+	return math.NaN()
+}
+
+// dataSourceFromMeta builds a DS and its RRAs from the meta and the
+// states, which are nil if there are none. The DS seg and idx are
+// derived from its id as in the PostgreSQL defaults, those of an RRA
+// from its pos.
+func dataSourceFromMeta(id int64, meta *dsMeta, dsState []byte, rraStates [][]byte, created bool) (*DbDataSource, error) {
+	seg, idx := segIdxFromPosWidth(id, int64(PgSegmentWidth))
+	dsr := &dsRecord{id: id, identJson: []byte(meta.Ident.String()), stepMs: meta.StepMs, hbMs: meta.HeartbeatMs,
+		seg: seg, idx: idx, created: created, dsType: meta.DsType}
+	if dsState != nil {
+		dsr.lastupdate, dsr.durationMs, dsr.value = decodeState(dsState)
+		lastRaw := math.Float64frombits(binary.BigEndian.Uint64(dsState[24:]))
+		dsr.lastRaw = &lastRaw
+	}
+	ds, err := dataSourceFromDsRec(dsr)
+	if err != nil {
+		return nil, err
+	}
+
+	var rras []rrd.RoundRobinArchiver
+	for n, rm := range meta.RRAs {
+		rrar := &rraRecord{id: rm.Id, dsId: id, bundleId: rm.BundleId, pos: rm.Pos, cf: rm.Cf, xff: rm.Xff}
+		rrar.seg, rrar.idx = segIdxFromPosWidth(rm.Pos, int64(PgSegmentWidth))
+		state := &rraStateRecord{}
+		if rraStates[n] != nil {
+			state.latest, state.durationMs, state.value = decodeState(rraStates[n])
+		}
+		rra, err := rraFromRRARecordStateAndBundle(rrar, state,
+			&rraBundleRecord{id: rm.BundleId, stepMs: rm.StepMs, size: rm.Size, width: int64(PgSegmentWidth)})
+		if err != nil {
+			return nil, err
+		}
+		rras = append(rras, rra)
+	}
+	ds.SetRRAs(rras)
+	return ds, nil
+}
@@ -0,0 +1,96 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// DSMetadata describes what a DS measures, so that dashboard builders
+// need not guess from the name.
+type DSMetadata struct {
+	Units       string `json:"units,omitempty"`
+	Description string `json:"description,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+}
+
+// Empty returns true if there is no metadata.
+func (md DSMetadata) Empty() bool { return md == DSMetadata{} }
+
+// A DataSourceDescriber can attach DSMetadata to a DS. LoadMetadata
+// returns the metadata of those of the idents that exist and have
+// any, by ident.String().
+type DataSourceDescriber interface {
+	SetMetadata(id int64, md DSMetadata) error
+	LoadMetadata(idents []Ident) (map[string]DSMetadata, error)
+}
+
+// A DataSourceAnnotator can find DSs and attach metadata to them, see
+// SetDataSourceMetadata.
+type DataSourceAnnotator interface {
+	DataSourceSelector
+	DataSourceDescriber
+}
+
+// SetDataSourceMetadata replaces the metadata of the DS named name
+// with md, an empty md clears it. It returns the ident of the DS.
+func SetDataSourceMetadata(db DataSourceAnnotator, name string, md DSMetadata) (Ident, error) {
+	ident, id, err := dataSourceByName(db, name)
+	if err != nil {
+		return nil, fmt.Errorf("SetDataSourceMetadata(): %v", err)
+	}
+	if err := db.SetMetadata(id, md); err != nil {
+		return nil, fmt.Errorf("SetDataSourceMetadata(): %v", err)
+	}
+	return ident, nil
+}
+
+// DataSourceMetadata returns the ident and the metadata of the DS
+// named name.
+func DataSourceMetadata(db DataSourceAnnotator, name string) (Ident, DSMetadata, error) {
+	ident, _, err := dataSourceByName(db, name)
+	if err != nil {
+		return nil, DSMetadata{}, fmt.Errorf("DataSourceMetadata(): %v", err)
+	}
+	mds, err := db.LoadMetadata([]Ident{ident})
+	if err != nil {
+		return nil, DSMetadata{}, fmt.Errorf("DataSourceMetadata(): %v", err)
+	}
+	return ident, mds[ident.String()], nil
+}
+
+// dataSourceByName returns the ident and the id of the DS whose name
+// is exactly name.
+func dataSourceByName(db DataSourceSelector, name string) (Ident, int64, error) {
+	idents, err := searchIdents(db, SearchQuery{"name": "^" + regexp.QuoteMeta(name) + "$"})
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, ident := range idents {
+		if ident["name"] != name {
+			continue // the search is case-insensitive
+		}
+		ds, err := db.FetchOrCreateDataSource(ident, nil)
+		if err != nil {
+			return nil, 0, fmt.Errorf("fetching %v: %v", ident, err)
+		}
+		if dbds, ok := ds.(DbDataSourcer); ok && dbds != nil {
+			return ident, dbds.Id(), nil
+		}
+	}
+	return nil, 0, fmt.Errorf("no DS named %q", name)
+}
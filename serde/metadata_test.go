@@ -0,0 +1,64 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_DataSourceMetadata(t *testing.T) {
+	spec := &rrd.DSSpec{Step: time.Second, Heartbeat: time.Minute, RRAs: []rrd.RRASpec{
+		{Function: rrd.WMEAN, Step: time.Second, Span: 10 * time.Second},
+	}}
+	for name, db := range map[string]DataSourceAnnotator{
+		"memory": NewMemSerDe(),
+		"kv":     InitKVDb(&memKV{m: make(map[string][]byte)}, "tgres_"),
+	} {
+		for _, n := range []string{"foo.bar", "foo.baz"} {
+			if _, err := db.FetchOrCreateDataSource(Ident{"name": n}, spec); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		md := DSMetadata{Units: "bytes", Description: "Bytes received", Owner: "ops"}
+		ident, err := SetDataSourceMetadata(db, "foo.bar", md)
+		if err != nil || ident["name"] != "foo.bar" {
+			t.Errorf("%s: SetDataSourceMetadata: expected foo.bar, got %v %v", name, ident, err)
+		}
+		if _, err := SetDataSourceMetadata(db, "FOO.BAR", md); err == nil {
+			t.Errorf("%s: SetDataSourceMetadata: expected an error for a name that is not exact", name)
+		}
+
+		if _, got, err := DataSourceMetadata(db, "foo.bar"); err != nil || got != md {
+			t.Errorf("%s: DataSourceMetadata: expected %v, got %v %v", name, md, got, err)
+		}
+		mds, err := db.LoadMetadata([]Ident{{"name": "foo.bar"}, {"name": "foo.baz"}, {"name": "nope"}})
+		if err != nil || len(mds) != 1 || mds[Ident{"name": "foo.bar"}.String()] != md {
+			t.Errorf("%s: LoadMetadata: expected only foo.bar, got %v %v", name, mds, err)
+		}
+
+		// clearing
+		if _, err := SetDataSourceMetadata(db, "foo.bar", DSMetadata{}); err != nil {
+			t.Fatal(err)
+		}
+		if mds, _ := db.LoadMetadata([]Ident{{"name": "foo.bar"}}); len(mds) != 0 {
+			t.Errorf("%s: LoadMetadata: expected none after clearing, got %v", name, mds)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// The ident field marking the DS a migration creates until it takes
+// the place of the old one, see MigrateDataSource.
+const migratingField = "tgres_migrating"
+
+// A DataSourceMigrator can change the RRAs of a DS, see
+// MigrateDataSource.
+type DataSourceMigrator interface {
+	DataSourceRemover
+	DataSourceRenamer
+	LoadRRAData(rra rrd.RoundRobinArchiver) (rrd.RoundRobinArchiver, error)
+}
+
+// SameRRAs reports whether the RRAs of a DS have the steps, spans and
+// CFs of those of spec, in any order.
+func SameRRAs(ds rrd.DataSourcer, spec *rrd.DSSpec) bool {
+	if len(ds.RRAs()) != len(spec.RRAs) {
+		return false
+	}
+	type layout struct {
+		cf         rrd.Consolidation
+		step, span int64
+	}
+	want := make(map[layout]int)
+	for _, rs := range spec.RRAs {
+		want[layout{rs.Function, int64(rs.Step), int64(rs.Span)}]++
+	}
+	for _, rra := range ds.RRAs() {
+		rs := rra.Spec()
+		l := layout{rs.Function, int64(rs.Step), int64(rs.Span)}
+		if want[l] == 0 {
+			return false
+		}
+		want[l]--
+	}
+	return true
+}
+
+// MigrateDataSource changes the RRAs of the DS of ident to those of
+// spec, resampling its data (see rrd.Resample). As RRAs cannot be
+// added to a DS, a new one is created with a temporary ident and
+// passed with the resampled data to flush, which is to write it
+// (e.g. to the vertical cache of a receiver), then the old DS is
+// deleted and the new one renamed, i.e. the DS gets a new id. Data
+// points the old DS gets in the meantime are lost. It returns the new
+// DS, or nil if the RRAs are already those of spec.
+func MigrateDataSource(db DataSourceMigrator, ident Ident, spec *rrd.DSSpec, flush func(*DbDataSource)) (*DbDataSource, error) {
+	ds, err := db.FetchOrCreateDataSource(ident, nil)
+	if err != nil {
+		return nil, fmt.Errorf("MigrateDataSource(): fetching %v: %v", ident, err)
+	}
+	old, ok := ds.(*DbDataSource)
+	if !ok || old == nil {
+		return nil, fmt.Errorf("MigrateDataSource(): no DS %v", ident)
+	}
+	if SameRRAs(old, spec) {
+		return nil, nil
+	}
+	srcs := make([]rrd.RoundRobinArchiver, 0, len(old.RRAs()))
+	for _, rra := range old.RRAs() {
+		loaded, err := db.LoadRRAData(rra)
+		if err != nil {
+			return nil, fmt.Errorf("MigrateDataSource(): loading %v: %v", ident, err)
+		}
+		srcs = append(srcs, loaded)
+	}
+
+	tmp := make(Ident, len(ident)+1)
+	for k, v := range ident {
+		tmp[k] = v
+	}
+	tmp[migratingField] = strconv.FormatInt(old.Id(), 10)
+	if left, err := db.FetchOrCreateDataSource(tmp, nil); err != nil {
+		return nil, err
+	} else if left, ok := left.(*DbDataSource); ok && left != nil { // of a failed migration
+		if err := db.DeleteDataSource(left.Id()); err != nil {
+			return nil, err
+		}
+	}
+	ds, err = db.FetchOrCreateDataSource(tmp, spec)
+	if err != nil {
+		return nil, fmt.Errorf("MigrateDataSource(): creating %v: %v", tmp, err)
+	}
+	created, ok := ds.(*DbDataSource)
+	if !ok {
+		return nil, fmt.Errorf("MigrateDataSource(): not a *DbDataSource: %v", tmp)
+	}
+
+	rras := make([]rrd.RoundRobinArchiver, 0, len(created.RRAs()))
+	for _, rra := range created.RRAs() {
+		dbrra, ok := rra.(*DbRoundRobinArchive)
+		if !ok {
+			return nil, fmt.Errorf("MigrateDataSource(): not a *DbRoundRobinArchive")
+		}
+		rs := dbrra.Spec()
+		if !old.LastUpdate().IsZero() {
+			rs.Latest = old.LastUpdate().Truncate(rs.Step)
+			rs.DPs = rrd.Resample(rs, rs.Latest, srcs)
+		}
+		if rra, err = newDbRoundRobinArchive(dbrra.id, dbrra.width, dbrra.bundleId, dbrra.pos, rs); err != nil {
+			return nil, err
+		}
+		rras = append(rras, rra)
+	}
+	rds := rrd.NewDataSource(rrd.DSSpec{Step: created.Step(), Heartbeat: created.Heartbeat(), Type: created.Type(),
+		LastUpdate: old.LastUpdate(), Value: old.Value(), Duration: old.Duration(), LastRaw: old.LastRaw()})
+	rds.SetRRAs(rras)
+	migrated := NewDbDataSource(created.Id(), ident, created.Seg(), created.Idx(), rds)
+	flush(migrated)
+
+	if err := db.DeleteDataSource(old.Id()); err != nil {
+		return nil, fmt.Errorf("MigrateDataSource(): deleting the old %v: %v", ident, err)
+	}
+	if err := db.RenameDataSource(created.Id(), ident); err != nil {
+		return nil, fmt.Errorf("MigrateDataSource(): renaming %v: %v", tmp, err)
+	}
+	return migrated, nil
+}
@@ -0,0 +1,85 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_MigrateDataSource(t *testing.T) {
+	p := InitKVDb(&memKV{m: make(map[string][]byte)}, "tgres_")
+	spec := &rrd.DSSpec{Step: time.Second, Heartbeat: time.Minute, RRAs: []rrd.RRASpec{
+		{Function: rrd.WMEAN, Step: time.Second, Span: 10 * time.Second},
+	}}
+	ident := Ident{"name": "foo"}
+	ds, err := p.FetchOrCreateDataSource(ident, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := ds.(*DbDataSource)
+	rra := old.RRAs()[0].(*DbRoundRobinArchive)
+	rs := rra.Spec()
+	rs.Latest, rs.DPs = time.Unix(20, 0), make(map[int64]float64)
+	for n := int64(11); n <= 20; n++ {
+		rs.DPs[rrd.SlotIndex(time.Unix(n, 0), time.Second, 10)] = float64(n)
+	}
+	rra, _ = newDbRoundRobinArchive(rra.id, rra.width, rra.bundleId, rra.pos, rs)
+	rds := rrd.NewDataSource(rrd.DSSpec{Step: time.Second, Heartbeat: time.Minute, LastUpdate: time.Unix(20, 0), LastRaw: 7})
+	rds.SetRRAs([]rrd.RoundRobinArchiver{rra})
+	flushDataSource(p, NewDbDataSource(old.Id(), ident, old.Seg(), old.Idx(), rds))
+
+	flush := func(ds *DbDataSource) { flushDataSource(p, ds) }
+
+	if migrated, err := MigrateDataSource(p, ident, spec, flush); err != nil || migrated != nil {
+		t.Errorf("MigrateDataSource: expected nothing to do, got %v %v", migrated, err)
+	}
+
+	spec = &rrd.DSSpec{Step: time.Second, Heartbeat: time.Minute, RRAs: []rrd.RRASpec{
+		{Function: rrd.WMEAN, Step: 2 * time.Second, Span: 10 * time.Second},
+		{Function: rrd.MAX, Step: 5 * time.Second, Span: 10 * time.Second},
+	}}
+	migrated, err := MigrateDataSource(p, ident, spec, flush)
+	if err != nil || migrated == nil {
+		t.Fatalf("MigrateDataSource: %v %v", migrated, err)
+	}
+	if migrated.Id() == old.Id() || migrated.LastRaw() != 7 || !migrated.LastUpdate().Equal(time.Unix(20, 0)) {
+		t.Errorf("MigrateDataSource: unexpected DS %v, last update %v", migrated.Id(), migrated.LastUpdate())
+	}
+
+	ds, _ = p.FetchOrCreateDataSource(ident, nil)
+	if ds == nil || ds.(*DbDataSource).Id() != migrated.Id() || !SameRRAs(ds, spec) {
+		t.Fatalf("MigrateDataSource: expected %v to be the migrated DS, got %v", ident, ds)
+	}
+	if left, _ := p.FetchOrCreateDataSource(Ident{"name": "foo", migratingField: "1"}, nil); left != nil {
+		t.Errorf("MigrateDataSource: the temporary DS is left")
+	}
+	for _, rra := range ds.RRAs() {
+		loaded, err := p.LoadRRAData(rra)
+		if err != nil {
+			t.Fatal(err)
+		}
+		end, want := int64(14), 13.5 // the mean of 13 and 14
+		if loaded.Spec().Function == rrd.MAX {
+			end, want = 15, 15
+		}
+		if v := loaded.DPs()[rrd.SlotIndex(time.Unix(end, 0), loaded.Step(), loaded.Size())]; v != want || len(loaded.DPs()) != int(loaded.Size()) {
+			t.Errorf("MigrateDataSource: expected %v at %d, got %v", want, end, loaded.DPs())
+		}
+	}
+}
@@ -0,0 +1,123 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// The operations counted and timed by opStats.
+const (
+	opFetchDataSources = iota
+	opFetchDataSource
+	opCreateDataSource
+	opFetchSeries
+	opSearch
+	opFlushDataPoints
+	opFlushDSStates
+	opFlushRRAStates
+	opFlushCommit
+	numOps
+)
+
+var opNames = [numOps]string{
+	"fetch_data_sources", "fetch_data_source", "create_data_source", "fetch_series", "search",
+	"flush_data_points", "flush_ds_states", "flush_rra_states", "flush_commit",
+}
+
+// Upper bounds (in milliseconds) of the OpStat latency buckets.
+var OpLatencyBuckets = []float64{1, 5, 10, 50, 100, 500, 1000, 5000}
+
+// OpStat are the counts of a database operation so far: the calls,
+// those that failed and the rows read or written by those that did
+// not (where known), and the latencies, counted in one more bucket
+// than OpLatencyBuckets (the last is +Inf) and summed up.
+type OpStat struct {
+	Calls, Errors, Rows int64
+	Latency             []int64
+	LatencySumMs        float64
+}
+
+// opStats counts the calls of every operation, it is safe for
+// concurrent use without locking. A nil opStats counts nothing.
+type opStats [numOps]*opCounter
+
+type opCounter struct {
+	calls, errors, rows int64   // atomic
+	latencyUs           int64   // atomic
+	latency             []int64 // atomic, by bucket
+}
+
+func newOpStats() *opStats {
+	s := &opStats{}
+	for i := range s {
+		s[i] = &opCounter{latency: make([]int64, len(OpLatencyBuckets)+1)}
+	}
+	return s
+}
+
+// observe counts a call of op which began at start.
+func (s *opStats) observe(op int, start time.Time, rows int, err error) {
+	if s == nil {
+		return
+	}
+	c := s[op]
+	atomic.AddInt64(&c.calls, 1)
+	if err != nil {
+		atomic.AddInt64(&c.errors, 1)
+	} else {
+		atomic.AddInt64(&c.rows, int64(rows))
+	}
+	d := time.Since(start)
+	ms := float64(d) / float64(time.Millisecond)
+	i := 0
+	for i < len(OpLatencyBuckets) && ms > OpLatencyBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&c.latency[i], 1)
+	atomic.AddInt64(&c.latencyUs, int64(d/time.Microsecond))
+}
+
+// addRows counts rows read by op after the call, e.g. from a cursor.
+func (s *opStats) addRows(op, n int) {
+	if s != nil {
+		atomic.AddInt64(&(s[op].rows), int64(n))
+	}
+}
+
+// stats returns the counts by operation name.
+func (s *opStats) stats() map[string]OpStat {
+	result := make(map[string]OpStat, numOps)
+	if s == nil {
+		return result
+	}
+	for i := range s {
+		c := s[i]
+		st := OpStat{
+			Calls:        atomic.LoadInt64(&c.calls),
+			Errors:       atomic.LoadInt64(&c.errors),
+			Rows:         atomic.LoadInt64(&c.rows),
+			Latency:      make([]int64, len(c.latency)),
+			LatencySumMs: float64(atomic.LoadInt64(&c.latencyUs)) / 1000,
+		}
+		for j := range c.latency {
+			st.Latency[j] = atomic.LoadInt64(&c.latency[j])
+		}
+		result[opNames[i]] = st
+	}
+	return result
+}
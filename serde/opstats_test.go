@@ -0,0 +1,50 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_opStats(t *testing.T) {
+	var s *opStats
+	s.observe(opSearch, time.Now(), 1, nil) // nil is a noop
+	s.addRows(opSearch, 1)
+	if len(s.stats()) != 0 {
+		t.Errorf("opStats: nil should have no stats")
+	}
+
+	s = newOpStats()
+	s.observe(opFetchSeries, time.Now(), 0, nil)
+	s.addRows(opFetchSeries, 10)
+	s.observe(opFetchSeries, time.Now().Add(-time.Minute), 5, fmt.Errorf("boom"))
+	st := s.stats()
+	if len(st) != numOps {
+		t.Errorf("opStats: expected every operation, got %v", st)
+	}
+	fs := st["fetch_series"]
+	if fs.Calls != 2 || fs.Errors != 1 || fs.Rows != 10 {
+		t.Errorf("opStats: unexpected counts: %+v", fs)
+	}
+	if fs.Latency[0] != 1 || fs.Latency[len(OpLatencyBuckets)] != 1 || fs.LatencySumMs < 60000 {
+		t.Errorf("opStats: unexpected latencies: %+v", fs)
+	}
+	if st["search"].Calls != 0 {
+		t.Errorf("opStats: unexpected search calls: %+v", st["search"])
+	}
+}
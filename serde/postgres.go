@@ -40,6 +40,8 @@ import (
 	"math/rand"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lib/pq"
@@ -52,6 +54,14 @@ type pgvSerDe struct {
 	dbQConn *sql.DB // a separate connection for querying
 	prefix  string
 	listen  *pq.Listener
+	stmts   *pgStmtCache  // of dbConn
+	qstmts  *pgStmtCache  // of dbQConn
+	reads   []*pgReadPool // dbQConn or the read replicas
+	read    uint32        // atomic, the next of reads
+	ops     *opStats
+
+	handlersMu sync.Mutex
+	handlers   map[string][]func(Ident) // of the notifications, by channel
 
 	sqlSelectSeries              *sql.Stmt
 	sqlSelectDSByIdent           *sql.Stmt
@@ -66,20 +76,102 @@ type pgvSerDe struct {
 	sqlSelectRRAState            *sql.Stmt
 	sqlInsertTs                  *sql.Stmt
 	sqlUpdateTs                  *sql.Stmt
+	sqlArchiveDS                 *sql.Stmt
+	sqlUnarchiveDS               *sql.Stmt
+}
+
+// pgReadPool is where queries go, the query pool of the primary or
+// a read replica.
+type pgReadPool struct {
+	name            string
+	db              *sql.DB
+	stmts           *pgStmtCache
+	sqlSelectSeries *sql.Stmt
+}
+
+// PgReadReplicas are the connect strings of read replicas. If there
+// are any, series and searches are queried from them, in turn, rather
+// than from the primary, everything else (flushing and the data
+// sources) still goes to the primary. Each replica has a pool the
+// size of the query pool. A replica that is behind returns only the
+// data it has, slots written since are left out as if never flushed.
+var PgReadReplicas []string
+
+// PgMaxConnections limits the number of database connections. They
+// are divided between the query path (series, searches) and
+// everything else, mainly the flushers, according to PgQueryShare, so
+// that neither can starve the other. Zero means no limit.
+var (
+	PgMaxConnections int     = 0
+	PgQueryShare     float64 = 0.25
+)
+
+// More pool settings, zero is the database/sql default for all of
+// them. PgMaxIdleConnections is per pool (flush and query), and no
+// more than its open connections; PgStatementTimeout aborts any
+// statement running longer than that.
+var (
+	PgMaxIdleConnections int
+	PgConnMaxLifetime    time.Duration
+	PgStatementTimeout   time.Duration
+)
+
+// pgConnectionLimits divides max connections into the flush and the
+// query pool, each gets at least one.
+func pgConnectionLimits(max int, queryShare float64) (flush, query int) {
+	query = int(float64(max)*queryShare + 0.5)
+	if query > max-1 {
+		query = max - 1
+	}
+	if query < 1 {
+		query = 1
+	}
+	if flush = max - query; flush < 1 {
+		flush = 1
+	}
+	return flush, query
+}
+
+func init() {
+	Register("postgres", func(connectString, prefix string) (DbSerDe, error) {
+		db, err := InitDb(connectString, prefix)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	})
 }
 
 func InitDb(connect_string, prefix string) (*pgvSerDe, error) {
-	if dbConn, err := sql.Open("postgres", connect_string); err != nil {
+	if PgStatementTimeout > 0 {
+		connect_string = PgConnectString(connect_string, map[string]string{"statement_timeout": fmt.Sprint(PgStatementTimeout.Nanoseconds() / 1e6)})
+	}
+	if dbConn, err := pgOpen(connect_string); err != nil {
 		return nil, err
 	} else {
 		// NB: disabling materialization (enable_material=off) speeds up
 		// sqlSelectSeries.
-		dbQConn, err := sql.Open("postgres", connect_string+" enable_material=off")
+		dbQConn, err := pgOpen(PgConnectString(connect_string, map[string]string{"enable_material": "off"}))
 		if err != nil {
 			return nil, err
 		}
-		l := pq.NewListener(connect_string, time.Second, 8*time.Second, nil)
-		p := &pgvSerDe{dbConn: dbConn, dbQConn: dbQConn, listen: l, prefix: prefix}
+		flush, query := pgConnectionLimits(PgMaxConnections, PgQueryShare)
+		if PgMaxConnections > 0 {
+			log.Printf("InitDb(): at most %d connections for flushing and %d for queries.", flush, query)
+		}
+		pgSetPoolLimits(dbConn, flush)
+		pgSetPoolLimits(dbQConn, query)
+		listen_string := connect_string
+		if PgPasswordFile != "" { // NB: the listener keeps the password it starts with
+			password, err := pgReadPassword(PgPasswordFile)
+			if err != nil {
+				return nil, err
+			}
+			listen_string = PgConnectString(connect_string, map[string]string{"password": password})
+		}
+		l := pq.NewListener(listen_string, time.Second, 8*time.Second, nil)
+		p := &pgvSerDe{dbConn: dbConn, dbQConn: dbQConn, listen: l, prefix: prefix,
+			stmts: newPgStmtCache(dbConn), qstmts: newPgStmtCache(dbQConn), ops: newOpStats()}
 		if err := p.dbConn.Ping(); err != nil {
 			return nil, err
 		}
@@ -89,11 +181,93 @@ func InitDb(connect_string, prefix string) (*pgvSerDe, error) {
 		if err := p.prepareSqlStatements(); err != nil {
 			return nil, fmt.Errorf("prepareSqlStatements: %v", err)
 		}
+		if p.reads, err = p.openReadReplicas(query); err != nil {
+			return nil, err
+		}
 
 		return p, nil
 	}
 }
 
+// pgSetPoolLimits applies the pool settings to db, max is its share
+// of PgMaxConnections, if any.
+func pgSetPoolLimits(db *sql.DB, max int) {
+	if PgMaxConnections > 0 {
+		db.SetMaxOpenConns(max)
+		db.SetMaxIdleConns(max)
+	}
+	if PgMaxIdleConnections > 0 {
+		db.SetMaxIdleConns(PgMaxIdleConnections) // capped at max open
+	}
+	if PgConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(PgConnMaxLifetime)
+	}
+}
+
+// openReadReplicas connects to the PgReadReplicas, with the options
+// of the query pool, e.g. the statement timeout. Without replicas,
+// reads is the query pool.
+func (p *pgvSerDe) openReadReplicas(max int) ([]*pgReadPool, error) {
+	if len(PgReadReplicas) == 0 {
+		return []*pgReadPool{{name: "query", db: p.dbQConn, stmts: p.qstmts, sqlSelectSeries: p.sqlSelectSeries}}, nil
+	}
+	options := map[string]string{"enable_material": "off"}
+	if PgStatementTimeout > 0 {
+		options["statement_timeout"] = fmt.Sprint(PgStatementTimeout.Nanoseconds() / 1e6)
+	}
+	var reads []*pgReadPool
+	for i, replica := range PgReadReplicas {
+		db, err := pgOpen(PgConnectString(replica, options))
+		if err != nil {
+			return nil, err
+		}
+		pgSetPoolLimits(db, max)
+		if err := db.Ping(); err != nil {
+			return nil, fmt.Errorf("read replica %d: %v", i, err)
+		}
+		stmt, err := db.Prepare(fmt.Sprintf(pgSelectSeriesSql, p.prefix))
+		if err != nil {
+			return nil, fmt.Errorf("read replica %d: %v", i, err)
+		}
+		reads = append(reads, &pgReadPool{name: fmt.Sprintf("replica%d", i), db: db, stmts: newPgStmtCache(db), sqlSelectSeries: stmt})
+	}
+	log.Printf("InitDb(): querying %d read replica(s).", len(reads))
+	return reads, nil
+}
+
+// reader returns the pool the next query goes to, the read replicas
+// take turns.
+func (p *pgvSerDe) reader() *pgReadPool {
+	return p.reads[int(atomic.AddUint32(&p.read, 1)-1)%len(p.reads)]
+}
+
+// StmtStats returns the counts of the statements prepared as needed,
+// by pool as in PoolStats.
+func (p *pgvSerDe) StmtStats() map[string]PgStmtStats {
+	stats := map[string]PgStmtStats{"flush": p.stmts.stats(), "query": p.qstmts.stats()}
+	for _, r := range p.reads {
+		stats[r.name] = r.stmts.stats()
+	}
+	return stats
+}
+
+// OpStats returns the counts and latencies of the operations so far,
+// by operation, e.g. "fetch_series" or "flush_data_points".
+func (p *pgvSerDe) OpStats() map[string]OpStat {
+	return p.ops.stats()
+}
+
+// PoolStats returns the statistics of the connection pools, "flush"
+// (everything but queries), "query" and the read replicas, if any,
+// "replica0" and so on.
+func (p *pgvSerDe) PoolStats() map[string]sql.DBStats {
+	stats := map[string]sql.DBStats{"flush": p.dbConn.Stats(), "query": p.dbQConn.Stats()}
+	for _, r := range p.reads {
+		stats[r.name] = r.db.Stats()
+	}
+	return stats
+}
+
 func (p *pgvSerDe) Fetcher() Fetcher             { return p }
 func (p *pgvSerDe) Flusher() Flusher             { return p }
 func (p *pgvSerDe) EventListener() EventListener { return p }
@@ -148,6 +322,11 @@ func (p *pgvSerDe) MyDbAddr() (*string, error) {
 	return nil, nil
 }
 
+// The series query, prepared on the query pool and the read replicas.
+const pgSelectSeriesSql = "SELECT max(tg) mt, avg(r) ar FROM generate_series($1, $2, ($3)::interval) AS tg " +
+	"LEFT OUTER JOIN (SELECT t, r FROM %[1]stv tv WHERE ds_id = $4 AND rra_id = $5 " +
+	" AND t >= $6 AND t <= $7) s ON tg = s.t GROUP BY trunc((extract(epoch from tg)*1000-1))::bigint/$8 ORDER BY mt"
+
 func (p *pgvSerDe) prepareSqlStatements() error {
 	// PG 9.5+ required. DO NOTHING causes RETURNING to return
 	// nothing, so we're using this dummy UPDATEs to work around. Note
@@ -169,17 +348,13 @@ func (p *pgvSerDe) prepareSqlStatements() error {
 		return err
 	}
 	// NB: dbQConn used here
-	if p.sqlSelectSeries, err = p.dbQConn.Prepare(fmt.Sprintf(
-		"SELECT max(tg) mt, avg(r) ar FROM generate_series($1, $2, ($3)::interval) AS tg "+
-			"LEFT OUTER JOIN (SELECT t, r FROM %[1]stv tv WHERE ds_id = $4 AND rra_id = $5 "+
-			" AND t >= $6 AND t <= $7) s ON tg = s.t GROUP BY trunc((extract(epoch from tg)*1000-1))::bigint/$8 ORDER BY mt",
-		p.prefix)); err != nil {
+	if p.sqlSelectSeries, err = p.dbQConn.Prepare(fmt.Sprintf(pgSelectSeriesSql, p.prefix)); err != nil {
 		return err
 	}
 	if p.sqlSelectDSByIdent, err = p.dbConn.Prepare(fmt.Sprintf(
 		"SELECT id, ident, step_ms, heartbeat_ms, ds.seg, ds.idx, "+
 			"dsst.lastupdate[ds.idx] AS lastupdate, dsst.value[ds.idx] AS value, dsst.duration_ms[ds.idx] AS duration_ms, "+
-			"false AS created "+
+			"false AS created, ds_type, dsst.last_raw[ds.idx] AS last_raw "+
 			"FROM %[1]sds ds JOIN %[1]sds_state dsst ON ds.seg = dsst.seg "+
 			"WHERE ident = $1",
 		p.prefix)); err != nil {
@@ -187,11 +362,11 @@ func (p *pgvSerDe) prepareSqlStatements() error {
 	}
 	if p.sqlInsertDS, err = p.dbConn.Prepare(fmt.Sprintf(
 		// Here created is a trick to determine whether this was an INSERT or an UPDATE
-		"INSERT INTO %[1]sds AS ds (ident, step_ms, heartbeat_ms) VALUES ($1, $2, $3) "+
-			"ON CONFLICT (ident) DO UPDATE SET created = false "+
+		"INSERT INTO %[1]sds AS ds (ident, step_ms, heartbeat_ms, ds_type) VALUES ($1, $2, $3, $4) "+
+			"ON CONFLICT (ident) DO UPDATE SET created = false, archived = false "+
 			"RETURNING id, ident, step_ms, heartbeat_ms, seg, idx, "+
 			"NULL::TIMESTAMPTZ AS lastupdate, 'NaN'::DOUBLE PRECISION AS value, "+
-			"0::BIGINT AS duration_ms, created", p.prefix)); err != nil {
+			"0::BIGINT AS duration_ms, created, ds_type, 'NaN'::DOUBLE PRECISION AS last_raw", p.prefix)); err != nil {
 		return err
 	}
 	if p.sqlInsertDSState, err = p.dbConn.Prepare(fmt.Sprintf(
@@ -236,11 +411,106 @@ func (p *pgvSerDe) prepareSqlStatements() error {
 		p.prefix)); err != nil {
 		return err
 	}
+	if p.sqlArchiveDS, err = p.dbConn.Prepare(fmt.Sprintf(
+		"UPDATE %[1]sds SET archived = true WHERE id = $1", p.prefix)); err != nil {
+		return err
+	}
+	if p.sqlUnarchiveDS, err = p.dbConn.Prepare(fmt.Sprintf(
+		"UPDATE %[1]sds SET archived = false WHERE id = $1 AND archived", p.prefix)); err != nil {
+		return err
+	}
 	return nil
 }
 
 var PgSegmentWidth int = 200
 
+// Index options of the tables, applied (or undone) every time tgres
+// starts, see pgIndexSql.
+var (
+	// PgCoveringIndexes makes the index by which the RRAs of a DS
+	// are looked up a covering one, so that loading a DS is an
+	// index-only scan, at the cost of a larger index to maintain.
+	// Requires PostgreSQL 11+.
+	PgCoveringIndexes bool
+	// PgBrinIndexes adds BRIN indexes on the ts and rra tables by
+	// bundle and segment, for queries by those, e.g. through the tv
+	// and tvd views. They are small and cheap to maintain, but lossy.
+	PgBrinIndexes bool
+)
+
+// PgTsCompression is the compression of the data point arrays of the
+// ts table, "pglz" or "lz4" (the latter requires PostgreSQL 14+ built
+// with it), applied (or undone, if blank) every time tgres starts, see
+// pgCompressionSql. A ts row is normally too small for PostgreSQL to
+// compress it, with compression it is compressed inline whenever it
+// is written, and decompressed transparently when read, which saves
+// space, mostly with long-retention RRAs, at the cost of CPU time on
+// every flush. Rows are compressed as they are next written, i.e.
+// within a round of their RRAs.
+var PgTsCompression string
+
+// pgCompressionSql returns the statements setting the compression of
+// the ts table (see PgTsCompression) or resetting it to the default.
+// A method once set with SET COMPRESSION stays, after a reset it only
+// applies to the rows large enough for PostgreSQL to compress anyway.
+func pgCompressionSql(prefix, compression string) ([]string, error) {
+	var result []string
+	switch compression {
+	case "":
+		result = []string{
+			"ALTER TABLE %[1]sts RESET (toast_tuple_target)",
+			"ALTER TABLE %[1]sts ALTER COLUMN dp SET STORAGE EXTENDED",
+			"ALTER TABLE %[1]sts ALTER COLUMN ver SET STORAGE EXTENDED"}
+	case "pglz", "lz4":
+		result = []string{
+			"ALTER TABLE %[1]sts ALTER COLUMN dp SET COMPRESSION %[2]s",
+			"ALTER TABLE %[1]sts ALTER COLUMN ver SET COMPRESSION %[2]s",
+			// MAIN is compressed but kept inline, the smallest
+			// target makes PostgreSQL compress every row
+			"ALTER TABLE %[1]sts ALTER COLUMN dp SET STORAGE MAIN",
+			"ALTER TABLE %[1]sts ALTER COLUMN ver SET STORAGE MAIN",
+			"ALTER TABLE %[1]sts SET (toast_tuple_target = 128)"}
+		if compression == "pglz" {
+			result = result[2:] // the default method, and SET COMPRESSION needs 14+
+		}
+	default:
+		return nil, fmt.Errorf("invalid ts compression %q (valid: pglz, lz4)", compression)
+	}
+	for i, stmt := range result {
+		result[i] = fmt.Sprintf(stmt, prefix, compression)
+	}
+	return result, nil
+}
+
+// pgIndexSql returns the statements creating the optional indexes
+// and dropping the ones not wanted. The unique btree indexes the
+// upserts rely on are always there, covering or not.
+func pgIndexSql(prefix string, covering, brin bool) []string {
+	var result []string
+	if covering {
+		result = append(result,
+			"CREATE UNIQUE INDEX IF NOT EXISTS %[1]sidx_rra_rra_bundle_id_covering ON %[1]srra (ds_id, rra_bundle_id, cf) INCLUDE (id, pos, seg, idx, xff)",
+			"DROP INDEX IF EXISTS %[1]sidx_rra_rra_bundle_id")
+	} else {
+		result = append(result,
+			"CREATE UNIQUE INDEX IF NOT EXISTS %[1]sidx_rra_rra_bundle_id ON %[1]srra (ds_id, rra_bundle_id, cf)",
+			"DROP INDEX IF EXISTS %[1]sidx_rra_rra_bundle_id_covering")
+	}
+	if brin {
+		result = append(result,
+			"CREATE INDEX IF NOT EXISTS %[1]sidx_ts_brin ON %[1]sts USING brin (rra_bundle_id, seg)",
+			"CREATE INDEX IF NOT EXISTS %[1]sidx_rra_brin ON %[1]srra USING brin (rra_bundle_id, seg)")
+	} else {
+		result = append(result,
+			"DROP INDEX IF EXISTS %[1]sidx_ts_brin",
+			"DROP INDEX IF EXISTS %[1]sidx_rra_brin")
+	}
+	for i, stmt := range result {
+		result[i] = fmt.Sprintf(stmt, prefix)
+	}
+	return result
+}
+
 func (p *pgvSerDe) createTablesIfNotExist() error {
 	create_sql := `
        -- NB: seg and idx are based on id, using lastval()
@@ -252,16 +522,22 @@ func (p *pgvSerDe) createTablesIfNotExist() error {
        seg INT NOT NULL DEFAULT (lastval()-1) / %[2]d,
        idx INT NOT NULL DEFAULT mod(lastval()-1, %[2]d)+1,
        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-       created BOOL NOT NULL DEFAULT true);
+       created BOOL NOT NULL DEFAULT true,
+       ds_type TEXT NOT NULL DEFAULT 'GAUGE',
+       archived BOOL NOT NULL DEFAULT false);
 
        CREATE UNIQUE INDEX IF NOT EXISTS %[1]sidx_ds_ident_uniq ON %[1]sds (ident);
        CREATE INDEX IF NOT EXISTS %[1]sidx_ds_ident ON %[1]sds USING gin(ident);
+       -- tag equality (@>) and name prefix searches, see TagSearcher
+       CREATE INDEX IF NOT EXISTS %[1]sidx_ds_ident_path ON %[1]sds USING gin(ident jsonb_path_ops);
+       CREATE INDEX IF NOT EXISTS %[1]sidx_ds_ident_name ON %[1]sds ((ident ->> 'name') text_pattern_ops);
 
        CREATE TABLE IF NOT EXISTS %[1]sds_state (
        seg INT NOT NULL PRIMARY KEY,
        lastupdate TIMESTAMPTZ[] NOT NULL DEFAULT '{}',
        duration_ms BIGINT[] NOT NULL DEFAULT '{}',
-       value DOUBLE PRECISION[] NOT NULL DEFAULT '{}');
+       value DOUBLE PRECISION[] NOT NULL DEFAULT '{}',
+       last_raw DOUBLE PRECISION[] NOT NULL DEFAULT '{}');
 
        CREATE TABLE IF NOT EXISTS %[1]srra_bundle (
        id SERIAL NOT NULL PRIMARY KEY,
@@ -293,7 +569,7 @@ func (p *pgvSerDe) createTablesIfNotExist() error {
        value DOUBLE PRECISION NOT NULL DEFAULT 'NaN',
        duration_ms BIGINT NOT NULL DEFAULT 0);
 
-       CREATE UNIQUE INDEX IF NOT EXISTS %[1]sidx_rra_rra_bundle_id ON %[1]srra (ds_id, rra_bundle_id, cf);
+       -- the rra (ds_id, rra_bundle_id, cf) index is in pgIndexSql
 
        CREATE TABLE IF NOT EXISTS %[1]sts (
        rra_bundle_id INT NOT NULL REFERENCES %[1]srra_bundle(id) ON DELETE CASCADE,
@@ -389,6 +665,22 @@ $$;
 		return err
 	}
 
+	if err := p.migrateSchema(); err != nil {
+		log.Printf("ERROR: schema migration failed: %v", err)
+		return err
+	}
+
+	compression, err := pgCompressionSql(p.prefix, PgTsCompression)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range append(pgIndexSql(p.prefix, PgCoveringIndexes, PgBrinIndexes), compression...) {
+		if _, err := p.dbConn.Exec(stmt); err != nil {
+			log.Printf("ERROR: %s failed: %v", stmt, err)
+			return err
+		}
+	}
+
 	// NB: BEGIN > DROP > CREATE > COMMIT is the equivalent of CREATE OR REPLACE
 	// See https://wiki.postgresql.org/wiki/Transactional_DDL_in_PostgreSQL:_A_Competitive_Analysis
 
@@ -398,10 +690,11 @@ BEGIN;
 -- a view do simplify looking at DSs
 DROP VIEW IF EXISTS %[1]sdsv;
 CREATE VIEW %[1]sdsv AS
-  SELECT id, ident, step_ms, heartbeat_ms, created_at,
+  SELECT id, ident, step_ms, heartbeat_ms, ds_type, created_at,
          dss.lastupdate[ds.idx] AS lastupdate,
          dss.value[ds.idx] AS value,
          dss.duration_ms[ds.idx] AS duration_ms,
+         dss.last_raw[ds.idx] AS last_raw,
          ds.seg, idx
     FROM %[1]sds AS ds
     JOIN %[1]sds_state AS dss
@@ -522,6 +815,37 @@ CREATE TRIGGER %[1]sds_delete_trigger AFTER DELETE ON %[1]sds
   FOR EACH ROW
   EXECUTE PROCEDURE %[1]sds_delete_notify();
 
+DROP TRIGGER IF EXISTS %[1]sds_rename_trigger ON %[1]sds;
+
+CREATE OR REPLACE FUNCTION %[1]sds_rename_notify() RETURNS TRIGGER AS
+$body$
+  BEGIN
+    PERFORM pg_notify('%[1]sds_rename_event', OLD.ident::text);
+    RETURN NULL;
+  END;
+$body$
+LANGUAGE plpgsql;
+
+CREATE TRIGGER %[1]sds_rename_trigger AFTER UPDATE OF ident ON %[1]sds
+  FOR EACH ROW
+  WHEN (OLD.ident IS DISTINCT FROM NEW.ident)
+  EXECUTE PROCEDURE %[1]sds_rename_notify();
+
+DROP TRIGGER IF EXISTS %[1]sds_create_trigger ON %[1]sds;
+
+CREATE OR REPLACE FUNCTION %[1]sds_create_notify() RETURNS TRIGGER AS
+$body$
+  BEGIN
+    PERFORM pg_notify('%[1]sds_create_event', NEW.ident::text);
+    RETURN NULL;
+  END;
+$body$
+LANGUAGE plpgsql;
+
+CREATE TRIGGER %[1]sds_create_trigger AFTER INSERT ON %[1]sds
+  FOR EACH ROW
+  EXECUTE PROCEDURE %[1]sds_create_notify();
+
 COMMIT;
 `
 	if _, err := p.dbConn.Exec(fmt.Sprintf(create_sql, p.prefix)); err != nil {
@@ -605,7 +929,7 @@ func rraFromRRARecordStateAndBundle(rraRec *rraRecord, stateRec *rraStateRecord,
 func (p *pgvSerDe) Search(query SearchQuery) (SearchResult, error) {
 
 	var (
-		sql   = `SELECT ident FROM %[1]sds ds`
+		sql   = `SELECT ident, archived FROM %[1]sds ds`
 		where string
 		args  []interface{}
 	)
@@ -614,7 +938,9 @@ func (p *pgvSerDe) Search(query SearchQuery) (SearchResult, error) {
 		sql += fmt.Sprintf(" WHERE %s", where)
 	}
 
-	rows, err := p.dbConn.Query(fmt.Sprintf(sql, p.prefix), args...)
+	start := time.Now()
+	rows, err := p.reader().db.Query(fmt.Sprintf(sql, p.prefix), args...)
+	p.ops.observe(opSearch, start, 0, err)
 	if err != nil {
 		log.Printf("Search(): error querying database: %v", err)
 		return nil, err
@@ -623,7 +949,64 @@ func (p *pgvSerDe) Search(query SearchQuery) (SearchResult, error) {
 	return &pgSearchResult{rows: rows}, nil
 }
 
+// SearchTags implements the TagSearcher.
+func (p *pgvSerDe) SearchTags(q TagQuery) (SearchResult, error) {
+	where, args := buildTagWhere(q, 0)
+	start := time.Now()
+	rows, err := p.reader().db.Query(fmt.Sprintf("SELECT ident, archived FROM %[1]sds ds WHERE %[2]s", p.prefix, where), args...)
+	p.ops.observe(opSearch, start, 0, err)
+	if err != nil {
+		log.Printf("SearchTags(): error querying database: %v", err)
+		return nil, err
+	}
+	return &pgSearchResult{rows: rows}, nil
+}
+
+// TagNames implements the TagSearcher.
+func (p *pgvSerDe) TagNames(q TagQuery, prefix string, limit int) ([]string, error) {
+	where, args := buildTagWhere(q, 1)
+	stmt := fmt.Sprintf("SELECT DISTINCT k FROM %[1]sds ds, jsonb_object_keys(ident) k WHERE %[2]s AND k LIKE $1 ORDER BY k", p.prefix, where)
+	return p.tagStrings(stmt, limit, append([]interface{}{pgLikePrefix(prefix)}, args...))
+}
+
+// TagValues implements the TagSearcher.
+func (p *pgvSerDe) TagValues(q TagQuery, tag, prefix string, limit int) ([]string, error) {
+	where, args := buildTagWhere(q, 2)
+	stmt := fmt.Sprintf("SELECT DISTINCT ident ->> $1 v FROM %[1]sds ds WHERE ident ? $1 AND ident ->> $1 LIKE $2 AND %[2]s ORDER BY v", p.prefix, where)
+	return p.tagStrings(stmt, limit, append([]interface{}{tag, pgLikePrefix(prefix)}, args...))
+}
+
+func (p *pgvSerDe) tagStrings(stmt string, limit int, args []interface{}) ([]string, error) {
+	if limit > 0 {
+		stmt += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	rows, err := p.reader().db.Query(stmt, args...)
+	if err != nil {
+		log.Printf("tagStrings(): error querying database: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []string{}
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			log.Printf("tagStrings(): error scanning row: %v", err)
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, rows.Err()
+}
+
 func (p *pgvSerDe) FetchDataSources() ([]rrd.DataSourcer, error) {
+	start := time.Now()
+	dss, err := p.fetchDataSources()
+	p.ops.observe(opFetchDataSources, start, len(dss), err)
+	return dss, err
+}
+
+func (p *pgvSerDe) fetchDataSources() ([]rrd.DataSourcer, error) {
 
 	// This statement is slightly faster than the non-CTE version, but
 	// I'm not exactly sure why.
@@ -637,18 +1020,22 @@ WITH rra AS (
     LEFT OUTER JOIN %[1]srra_state AS rs ON rs.rra_bundle_id = rra.rra_bundle_id AND rs.seg = rra.seg
 ), ds AS (
   SELECT ds.id, ds.ident, ds.step_ms,
-         ds.heartbeat_ms, ds.seg, ds.idx,
+         ds.heartbeat_ms, ds.seg, ds.idx, ds.ds_type,
          dsst.lastupdate[ds.idx] AS lastupdate,
          dsst.value[ds.idx] AS ds_value,
-         dsst.duration_ms[ds.idx] AS ds_duration_ms
+         dsst.duration_ms[ds.idx] AS ds_duration_ms,
+         dsst.last_raw[ds.idx] AS ds_last_raw
    FROM %[1]sds ds
    LEFT OUTER JOIN %[1]sds_state dsst ON ds.seg = dsst.seg
+  WHERE NOT ds.archived
 )
 SELECT ds.id, ds.ident, ds.step_ms,
            ds.heartbeat_ms, ds.seg, ds.idx,
            ds.lastupdate,
            ds.ds_value,
            ds.ds_duration_ms,
+           ds.ds_type,
+           ds.ds_last_raw,
            rra.id, rra.rra_bundle_id, rra.pos, rra.seg, rra.idx, rra.cf, rra.xff,
            rra.step_ms, rra.size, rra.width,
            rra.latest,
@@ -687,7 +1074,7 @@ SELECT ds.id, ds.ident, ds.step_ms,
 		)
 
 		err = rows.Scan(
-			&dsr.id, &dsr.identJson, &dsr.stepMs, &dsr.hbMs, &dsr.seg, &dsr.idx, &dsr.lastupdate, &dsr.value, &dsr.durationMs, // DS
+			&dsr.id, &dsr.identJson, &dsr.stepMs, &dsr.hbMs, &dsr.seg, &dsr.idx, &dsr.lastupdate, &dsr.value, &dsr.durationMs, &dsr.dsType, &dsr.lastRaw, // DS
 			&rrar.id, &rrar.bundleId, &rrar.pos, &rrar.seg, &rrar.idx, &rrar.cf, &rrar.xff, // RRA
 			&bundle.stepMs, &bundle.size, &bundle.width, // Bundle
 			&state.latest, &state.value, &state.durationMs) // RRA State
@@ -863,11 +1250,89 @@ func (p *pgvSerDe) fetchRoundRobinArchives(ds *DbDataSource) ([]rrd.RoundRobinAr
 	return rras, nil
 }
 
-func (p *pgvSerDe) FlushDSStates(seg int64, lastupdate, value, duration map[int64]interface{}) (sqlOps int, err error) {
+// PgFlushValuesWidth, if greater than 1, is the number of ts rows a
+// flush batch updates in a single UPDATE ... FROM (VALUES ...)
+// statement instead of one statement per row, see pgFlusher.
+var PgFlushValuesWidth int = 0
+
+// pgFlusher performs the flushes, either directly or as part of a
+// batch transaction (if tx is not nil). In a batch with a values
+// width, data point flushes are queued and written as multi-row
+// statements once width of them are queued and on Commit.
+type pgFlusher struct {
+	p       *pgvSerDe
+	tx      *sql.Tx
+	width   int
+	pending []*pgTsFlush
+}
+
+// pgTsFlush is a queued data point flush of a ts row, the version
+// chunks are those of the data points.
+type pgTsFlush struct {
+	key          [3]int64 // rra_bundle_id, seg, i
+	chunks, vers []*arrayUpdateChunk
+}
+
+// pgTsChunk is a row of the VALUES list.
+type pgTsChunk struct {
+	key        [3]int64
+	chunk, ver *arrayUpdateChunk
+}
+
+func (f *pgFlusher) exec(query string, args ...interface{}) (sql.Result, error) {
+	return f.p.stmts.exec(f.tx, query, args...)
+}
+
+func (f *pgFlusher) stmt(stmt *sql.Stmt) *sql.Stmt {
+	if f.tx != nil {
+		return f.tx.Stmt(stmt)
+	}
+	return stmt
+}
+
+func (f *pgFlusher) Commit() (err error) {
+	defer func(start time.Time) { f.p.ops.observe(opFlushCommit, start, 0, err) }(time.Now())
+	if _, err := f.flushPending(); err != nil {
+		f.tx.Rollback()
+		return err
+	}
+	return f.tx.Commit()
+}
+
+func (f *pgFlusher) Rollback() error {
+	f.pending = nil
+	return f.tx.Rollback()
+}
+
+// BeginFlushBatch starts a transaction, all flushes on the returned
+// FlushBatch are part of it until it is committed or rolled back.
+func (p *pgvSerDe) BeginFlushBatch() (FlushBatch, error) {
+	tx, err := p.dbConn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &pgFlusher{p: p, tx: tx, width: PgFlushValuesWidth}, nil
+}
+
+func (p *pgvSerDe) FlushDSStates(seg int64, lastupdate, value, duration, lastRaw map[int64]interface{}) (int, error) {
+	return (&pgFlusher{p: p}).FlushDSStates(seg, lastupdate, value, duration, lastRaw)
+}
+
+func (p *pgvSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]interface{}) (int, error) {
+	return (&pgFlusher{p: p}).FlushDataPoints(bundle_id, seg, i, dps, vers)
+}
+
+func (p *pgvSerDe) FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (int, error) {
+	return (&pgFlusher{p: p}).FlushRRAStates(bundle_id, seg, latests, value, duration)
+}
+
+func (f *pgFlusher) FlushDSStates(seg int64, lastupdate, value, duration, lastRaw map[int64]interface{}) (sqlOps int, err error) {
+	defer func(start time.Time) { f.p.ops.observe(opFlushDSStates, start, 1, err) }(time.Now())
 
 	luChunks := arrayUpdateChunks(lastupdate)
 	durChunks := arrayUpdateChunks(duration)
 	valChunks := arrayUpdateChunks(value)
+	lrChunks := arrayUpdateChunks(lastRaw)
 
 	offset := 2
 	dest1, args := singleStmtUpdateArgs(luChunks, "lastupdate", offset, []interface{}{seg})
@@ -875,20 +1340,22 @@ func (p *pgvSerDe) FlushDSStates(seg int64, lastupdate, value, duration map[int6
 	dest2, args := singleStmtUpdateArgs(valChunks, "value", offset, args)
 	offset += 3 * len(valChunks)
 	dest3, args := singleStmtUpdateArgs(durChunks, "duration_ms", offset, args)
+	offset += 3 * len(durChunks)
+	dest4, args := singleStmtUpdateArgs(lrChunks, "last_raw", offset, args)
 
-	stmt := fmt.Sprintf("UPDATE %[1]sds_state AS dss SET %s, %s, %s WHERE seg = $1", p.prefix, dest1, dest2, dest3)
-	res, err := p.dbConn.Exec(stmt, args...)
+	stmt := fmt.Sprintf("UPDATE %[1]sds_state AS dss SET %s, %s, %s, %s WHERE seg = $1", f.p.prefix, dest1, dest2, dest3, dest4)
+	res, err := f.exec(stmt, args...)
 	if err != nil {
 		return 0, err
 	}
 	sqlOps++
 
 	if affected, _ := res.RowsAffected(); affected == 0 { // Insert and try again.
-		insert := fmt.Sprintf("INSERT INTO %[1]sds_state AS dss (seg) VALUES ($1) ON CONFLICT(seg) DO NOTHING", p.prefix)
-		if _, err = p.dbConn.Exec(insert, seg); err != nil {
+		insert := fmt.Sprintf("INSERT INTO %[1]sds_state AS dss (seg) VALUES ($1) ON CONFLICT(seg) DO NOTHING", f.p.prefix)
+		if _, err = f.exec(insert, seg); err != nil {
 			return 0, err
 		}
-		if res, err := p.dbConn.Exec(stmt, args...); err != nil {
+		if res, err := f.exec(stmt, args...); err != nil {
 			return 0, err
 		} else if affected, _ := res.RowsAffected(); affected == 0 {
 			return 0, fmt.Errorf("Unable to update row?")
@@ -898,7 +1365,8 @@ func (p *pgvSerDe) FlushDSStates(seg int64, lastupdate, value, duration map[int6
 	return sqlOps, nil
 }
 
-func (p *pgvSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]interface{}) (sqlOps int, err error) {
+func (f *pgFlusher) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]interface{}) (sqlOps int, err error) {
+	defer func(start time.Time) { f.p.ops.observe(opFlushDataPoints, start, 1, err) }(time.Now())
 	// Due to the way PG array syntax works, we use two different
 	// methods of updating data points. When the data points updated
 	// are *one* contiguous chunk, we can use the form array[a:b] =
@@ -922,6 +1390,14 @@ func (p *pgvSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]
 	chunks := arrayUpdateChunks(dps)
 	vchunks := arrayUpdateChunks(vers)
 
+	if f.tx != nil && f.width > 1 && len(chunks) == len(vchunks) {
+		f.pending = append(f.pending, &pgTsFlush{key: [3]int64{bundle_id, seg, i}, chunks: chunks, vers: vchunks})
+		if len(f.pending) < f.width {
+			return 0, nil
+		}
+		return f.flushPending()
+	}
+
 	if len(chunks) > 1 {
 		//
 		// Use single-statement update  // TODO make me a function!
@@ -929,19 +1405,19 @@ func (p *pgvSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]
 		dest1, args := singleStmtUpdateArgs(chunks, "dp", 4, []interface{}{bundle_id, seg, i})
 		dest2, args := singleStmtUpdateArgs(vchunks, "ver", 4+3*len(chunks), args)
 
-		stmt := fmt.Sprintf("UPDATE %[1]sts AS ts SET %s, %s WHERE rra_bundle_id = $1 AND seg = $2 AND i = $3", p.prefix, dest1, dest2)
+		stmt := fmt.Sprintf("UPDATE %[1]sts AS ts SET %s, %s WHERE rra_bundle_id = $1 AND seg = $2 AND i = $3", f.p.prefix, dest1, dest2)
 
-		res, err := p.dbConn.Exec(stmt, args...)
+		res, err := f.exec(stmt, args...)
 		if err != nil {
 			return 0, err
 		}
 		sqlOps++
 
 		if affected, _ := res.RowsAffected(); affected == 0 { // Insert and try again.
-			if _, err = p.sqlInsertTs.Exec(bundle_id, seg, i); err != nil {
+			if _, err = f.stmt(f.p.sqlInsertTs).Exec(bundle_id, seg, i); err != nil {
 				return 0, err
 			}
-			if res, err := p.dbConn.Exec(stmt, args...); err != nil {
+			if res, err := f.exec(stmt, args...); err != nil {
 				return 0, err
 			} else if affected, _ := res.RowsAffected(); affected == 0 {
 				return 0, fmt.Errorf("Unable to update row?")
@@ -957,40 +1433,161 @@ func (p *pgvSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]
 		for _, args := range multiStmtUpdateArgs(chunks, []interface{}{bundle_id, seg, i}) {
 			for _, args := range multiStmtUpdateArgs(vchunks, args) {
 
-				tx, err := p.dbConn.Begin()
-				if err != nil {
-					return 0, err
+				// In a batch, the batch transaction is used and it is
+				// up to the caller to commit or roll it back.
+				tx := f.tx
+				if tx == nil {
+					if tx, err = f.p.dbConn.Begin(); err != nil {
+						return 0, err
+					}
+				}
+				rollback := func() {
+					if f.tx == nil {
+						tx.Rollback()
+					}
 				}
 
-				res, err := tx.Stmt(p.sqlUpdateTs).Exec(args...)
+				res, err := tx.Stmt(f.p.sqlUpdateTs).Exec(args...)
 				if err != nil {
-					tx.Rollback()
+					rollback()
 					return 0, err
 				}
 				sqlOps++
 
 				if affected, _ := res.RowsAffected(); affected == 0 { // Insert and try again.
-					if _, err = tx.Stmt(p.sqlInsertTs).Exec(bundle_id, seg, i); err != nil {
-						tx.Rollback()
+					if _, err = tx.Stmt(f.p.sqlInsertTs).Exec(bundle_id, seg, i); err != nil {
+						rollback()
 						return 0, err
 					}
-					if res, err := tx.Stmt(p.sqlUpdateTs).Exec(args...); err != nil {
-						tx.Rollback()
+					if res, err := tx.Stmt(f.p.sqlUpdateTs).Exec(args...); err != nil {
+						rollback()
 						return 0, err
 					} else if affected, _ := res.RowsAffected(); affected == 0 {
-						tx.Rollback()
+						rollback()
 						return 0, fmt.Errorf("Unable to update row?")
 					}
 					sqlOps++
 				}
-				tx.Commit()
+				if f.tx == nil {
+					tx.Commit()
+				}
+			}
+		}
+		return sqlOps, nil
+	}
+}
+
+// pgTsRounds arranges queued flushes into VALUES lists, one
+// statement each. A row can only be updated once by a statement, so
+// every chunk of a row, and every later flush of the same row, goes
+// into the next statement.
+func pgTsRounds(pending []*pgTsFlush) [][]*pgTsChunk {
+	var rounds [][]*pgTsChunk
+	next := make(map[[3]int64]int, len(pending))
+	for _, tf := range pending {
+		r := next[tf.key]
+		for j := range tf.chunks {
+			if r == len(rounds) {
+				rounds = append(rounds, nil)
+			}
+			rounds[r] = append(rounds[r], &pgTsChunk{key: tf.key, chunk: tf.chunks[j], ver: tf.vers[j]})
+			r++
+		}
+		next[tf.key] = r
+	}
+	return rounds
+}
+
+// pgTsValuesSql is the statement updating n ts rows, each VALUES row
+// is rra_bundle_id, seg, i, begin, end, dps, vers.
+func pgTsValuesSql(prefix string, n int) string {
+	values := make([]string, n)
+	for j := range values {
+		k := j * 7
+		values[j] = fmt.Sprintf("($%d::INT,$%d::INT,$%d::INT,$%d::INT,$%d::INT,$%d::DOUBLE PRECISION[],$%d::SMALLINT[])",
+			k+1, k+2, k+3, k+4, k+5, k+6, k+7)
+	}
+	return fmt.Sprintf("UPDATE %[1]sts AS ts SET dp[v.b:v.e] = v.dp, ver[v.b:v.e] = v.ver "+
+		"FROM (VALUES %[2]s) AS v(rra_bundle_id, seg, i, b, e, dp, ver) "+
+		"WHERE ts.rra_bundle_id = v.rra_bundle_id AND ts.seg = v.seg AND ts.i = v.i "+
+		"RETURNING ts.rra_bundle_id, ts.seg, ts.i", prefix, strings.Join(values, ","))
+}
+
+// flushPending writes the queued data point flushes.
+func (f *pgFlusher) flushPending() (sqlOps int, err error) {
+	pending := f.pending
+	f.pending = nil
+	for _, round := range pgTsRounds(pending) {
+		n, err := f.updateTsValues(round)
+		if err != nil {
+			return sqlOps, err
+		}
+		sqlOps += n
+	}
+	return sqlOps, nil
+}
+
+// updateTsValues updates the ts rows of a VALUES list. As with the
+// single row statements, rows that do not exist are inserted and
+// updated again.
+func (f *pgFlusher) updateTsValues(round []*pgTsChunk) (sqlOps int, err error) {
+	update := func(rows []*pgTsChunk) (map[[3]int64]bool, error) {
+		args := make([]interface{}, 0, len(rows)*7)
+		for _, r := range rows {
+			args = append(args, r.key[0], r.key[1], r.key[2], r.chunk.begin, r.chunk.end, pq.Array(r.chunk.vals), pq.Array(r.ver.vals))
+		}
+		res, err := f.p.stmts.query(f.tx, pgTsValuesSql(f.p.prefix, len(rows)), args...)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Close()
+		updated := make(map[[3]int64]bool, len(rows))
+		for res.Next() {
+			var key [3]int64
+			if err := res.Scan(&key[0], &key[1], &key[2]); err != nil {
+				return nil, err
 			}
+			updated[key] = true
 		}
+		return updated, res.Err()
+	}
+
+	updated, err := update(round)
+	if err != nil {
+		return 0, err
+	}
+	sqlOps++
+	if len(updated) == len(round) {
 		return sqlOps, nil
 	}
+
+	// Insert the missing rows and try those again.
+	var missing []*pgTsChunk
+	var values []string
+	var args []interface{}
+	for _, r := range round {
+		if !updated[r.key] {
+			missing = append(missing, r)
+			values = append(values, fmt.Sprintf("($%d::INT,$%d::INT,$%d::INT)", len(args)+1, len(args)+2, len(args)+3))
+			args = append(args, r.key[0], r.key[1], r.key[2])
+		}
+	}
+	insert := fmt.Sprintf("INSERT INTO %[1]sts AS ts (rra_bundle_id, seg, i) VALUES %[2]s ON CONFLICT(rra_bundle_id, seg, i) DO NOTHING",
+		f.p.prefix, strings.Join(values, ","))
+	if _, err = f.exec(insert, args...); err != nil {
+		return 0, err
+	}
+	if updated, err = update(missing); err != nil {
+		return 0, err
+	} else if len(updated) != len(missing) {
+		return 0, fmt.Errorf("Unable to update row?")
+	}
+	sqlOps++
+	return sqlOps, nil
 }
 
-func (p *pgvSerDe) FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (sqlOps int, err error) {
+func (f *pgFlusher) FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (sqlOps int, err error) {
+	defer func(start time.Time) { f.p.ops.observe(opFlushRRAStates, start, 1, err) }(time.Now())
 
 	latChunks := arrayUpdateChunks(latests)
 	valChunks := arrayUpdateChunks(value)
@@ -1003,18 +1600,18 @@ func (p *pgvSerDe) FlushRRAStates(bundle_id, seg int64, latests, value, duration
 	offset += 3 * len(valChunks)
 	dest3, args := singleStmtUpdateArgs(durChunks, "duration_ms", offset, args)
 
-	stmt := fmt.Sprintf("UPDATE %[1]srra_state AS rra_state SET %s, %s, %s WHERE rra_bundle_id = $1 AND seg = $2", p.prefix, dest1, dest2, dest3)
-	res, err := p.dbConn.Exec(stmt, args...)
+	stmt := fmt.Sprintf("UPDATE %[1]srra_state AS rra_state SET %s, %s, %s WHERE rra_bundle_id = $1 AND seg = $2", f.p.prefix, dest1, dest2, dest3)
+	res, err := f.exec(stmt, args...)
 	if err != nil {
 		return 0, err
 	}
 	sqlOps++
 
 	if affected, _ := res.RowsAffected(); affected == 0 { // Insert and try again.
-		if _, err = p.sqlInsertRRAState.Exec(bundle_id, seg); err != nil {
+		if _, err = f.stmt(f.p.sqlInsertRRAState).Exec(bundle_id, seg); err != nil {
 			return 0, err
 		}
-		if res, err := p.dbConn.Exec(stmt, args...); err != nil {
+		if res, err := f.exec(stmt, args...); err != nil {
 			return 0, err
 		} else if affected, _ := res.RowsAffected(); affected == 0 {
 			return 0, fmt.Errorf("Unable to update row?")
@@ -1052,28 +1649,246 @@ func (p *pgvSerDe) fetchDataSource(ident Ident) (*DbDataSource, error) {
 	return nil, nil
 }
 
+// ArchiveDataSource marks a DS as archived. Archived DSs are not
+// loaded by FetchDataSources and are flagged as such in search
+// results. The flag is cleared the next time the DS is loaded by
+// FetchOrCreateDataSource with a non-nil spec, i.e. by the receiver
+// when a data point for it arrives.
+func (p *pgvSerDe) ArchiveDataSource(id int64) error {
+	if _, err := p.sqlArchiveDS.Exec(id); err != nil {
+		log.Printf("ArchiveDataSource(): error updating database: %v", err)
+		return err
+	}
+	return nil
+}
+
+// FetchStaleDataSources returns the DSs last updated before before,
+// including archived ones. A DS never updated is as old as it was
+// created.
+func (p *pgvSerDe) FetchStaleDataSources(before time.Time) ([]StaleDataSource, error) {
+	return p.FetchDataSourcesByLastUpdate(LivenessQuery{Before: before, Archived: true})
+}
+
+// FetchDataSourcesByLastUpdate implements the LivenessFetcher. The
+// last updates are not indexed, every DS is looked at.
+func (p *pgvSerDe) FetchDataSourcesByLastUpdate(q LivenessQuery) ([]StaleDataSource, error) {
+	const stmt = `
+  SELECT ds.id, ds.ident, COALESCE(dsst.lastupdate[ds.idx], ds.created_at) AS lastupdate
+    FROM %[1]sds ds
+    JOIN %[1]sds_state dsst ON ds.seg = dsst.seg
+   WHERE %[2]s
+   ORDER BY lastupdate, ds.id`
+	where, args := []string{"true"}, []interface{}{}
+	if !q.After.IsZero() {
+		args = append(args, q.After)
+		where = append(where, fmt.Sprintf("COALESCE(dsst.lastupdate[ds.idx], ds.created_at) > $%d", len(args)))
+	}
+	if !q.Before.IsZero() {
+		args = append(args, q.Before)
+		where = append(where, fmt.Sprintf("COALESCE(dsst.lastupdate[ds.idx], ds.created_at) < $%d", len(args)))
+	}
+	if !q.Archived {
+		where = append(where, "NOT ds.archived")
+	}
+	sql := fmt.Sprintf(stmt, p.prefix, strings.Join(where, " AND "))
+	if q.Limit > 0 {
+		sql += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+	rows, err := p.dbConn.Query(sql, args...)
+	if err != nil {
+		log.Printf("FetchDataSourcesByLastUpdate(): error querying database: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []StaleDataSource
+	for rows.Next() {
+		var (
+			sds StaleDataSource
+			b   []byte
+		)
+		if err := rows.Scan(&sds.Id, &b, &sds.LastUpdate); err != nil {
+			log.Printf("FetchDataSourcesByLastUpdate(): error scanning row: %v", err)
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &sds.Ident); err != nil {
+			log.Printf("FetchDataSourcesByLastUpdate(): error unmarshalling ident %q: %v", string(b), err)
+			continue
+		}
+		result = append(result, sds)
+	}
+	return result, rows.Err()
+}
+
+// SnapshotMarker returns the database time and the current WAL
+// location. pg_current_wal_lsn() is PG 10+, pg_current_xlog_location()
+// is what it was called before.
+func (p *pgvSerDe) SnapshotMarker() (*SnapshotMarker, error) {
+	m := &SnapshotMarker{}
+	if err := p.dbConn.QueryRow("SELECT now(), pg_current_wal_lsn()::text").Scan(&m.Time, &m.LSN); err != nil {
+		if err := p.dbConn.QueryRow("SELECT now(), pg_current_xlog_location()::text").Scan(&m.Time, &m.LSN); err != nil {
+			log.Printf("SnapshotMarker(): error querying database: %v", err)
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// SetMetadata replaces the metadata of a DS.
+func (p *pgvSerDe) SetMetadata(id int64, md DSMetadata) error {
+	b, _ := json.Marshal(md) // cannot fail
+	res, err := p.dbConn.Exec(fmt.Sprintf("UPDATE %[1]sds SET metadata = $2 WHERE id = $1", p.prefix), id, string(b))
+	if err != nil {
+		log.Printf("SetMetadata(): error updating database: %v", err)
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("SetMetadata(): no DS with id %d", id)
+	}
+	return nil
+}
+
+// LoadMetadata returns the metadata of the idents in one query, which
+// uses the unique ident index.
+func (p *pgvSerDe) LoadMetadata(idents []Ident) (map[string]DSMetadata, error) {
+	result := make(map[string]DSMetadata)
+	if len(idents) == 0 {
+		return result, nil
+	}
+	strs := make([]string, len(idents))
+	for i, ident := range idents {
+		strs[i] = ident.String()
+	}
+	rows, err := p.reader().db.Query(fmt.Sprintf(
+		"SELECT ident, metadata FROM %[1]sds WHERE ident = ANY($1::jsonb[]) AND metadata <> '{}'", p.prefix), pq.Array(strs))
+	if err != nil {
+		log.Printf("LoadMetadata(): error querying database: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			ib, mb []byte
+			ident  Ident
+			md     DSMetadata
+		)
+		if err := rows.Scan(&ib, &mb); err != nil {
+			log.Printf("LoadMetadata(): error scanning row: %v", err)
+			return nil, err
+		}
+		if err := json.Unmarshal(ib, &ident); err != nil {
+			log.Printf("LoadMetadata(): error unmarshalling ident %q: %v", string(ib), err)
+			continue
+		}
+		if err := json.Unmarshal(mb, &md); err != nil {
+			log.Printf("LoadMetadata(): error unmarshalling metadata %q: %v", string(mb), err)
+			continue
+		}
+		result[ident.String()] = md
+	}
+	return result, rows.Err()
+}
+
+// RenameDataSource changes the ident of a DS, the rename trigger
+// notifies all the receivers. It is an error if the ident is taken.
+func (p *pgvSerDe) RenameDataSource(id int64, ident Ident) error {
+	res, err := p.dbConn.Exec(fmt.Sprintf("UPDATE %[1]sds SET ident = $2 WHERE id = $1", p.prefix), id, ident.String())
+	if err != nil {
+		log.Printf("RenameDataSource(): error updating database: %v", err)
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("RenameDataSource(): no DS with id %d", id)
+	}
+	return nil
+}
+
+// DeleteDataSource deletes a DS in a transaction: its data points are
+// cleared from the ts rows it shares with other DSs and it is deleted,
+// its RRAs along with it, and the delete trigger notifies all the
+// receivers. Rows left with no one's data are pruned by Maintain.
+func (p *pgvSerDe) DeleteDataSource(id int64) error {
+	tx, err := p.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // a noop after Commit
+
+	rows, err := tx.Query(fmt.Sprintf("SELECT rra_bundle_id, seg, idx FROM %[1]srra WHERE ds_id = $1", p.prefix), id)
+	if err != nil {
+		log.Printf("DeleteDataSource(): error querying database: %v", err)
+		return err
+	}
+	var rras [][3]int64
+	for rows.Next() {
+		var rra [3]int64
+		if err := rows.Scan(&rra[0], &rra[1], &rra[2]); err != nil {
+			rows.Close()
+			return err
+		}
+		rras = append(rras, rra)
+	}
+	rows.Close()
+
+	for _, rra := range rras {
+		if _, err := tx.Exec(fmt.Sprintf("UPDATE %[1]sts SET dp[$3] = NULL WHERE rra_bundle_id = $1 AND seg = $2", p.prefix),
+			rra[0], rra[1], rra[2]); err != nil {
+			log.Printf("DeleteDataSource(): error clearing data points: %v", err)
+			return err
+		}
+	}
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %[1]sds WHERE id = $1", p.prefix), id); err != nil {
+		log.Printf("DeleteDataSource(): error deleting: %v", err)
+		return err
+	}
+	return tx.Commit()
+}
+
 // FetchOrCreateDataSource loads or returns an existing DS. This is
 // done by using upserts first on the ds table, then for each
 // RRA. This method also attempt to create the TS empty rows with ON
 // CONFLICT DO NOTHING. The returned DS contains no data, to get data
 // use FetchSeries(). A nil dsSpec means fetch only, do not create.
 func (p *pgvSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
-	var (
-		err  error
-		rows *sql.Rows
-	)
-
 	// Try SELECT first
+	start := time.Now()
 	ds, err := p.fetchDataSource(ident)
+	found := 0
+	if ds != nil {
+		found = 1
+	}
+	p.ops.observe(opFetchDataSource, start, found, err)
 	if err != nil {
 		return nil, err
 	}
-	if ds != nil || dsSpec == nil {
-		return ds, err
+	if ds != nil {
+		// A DS is only unarchived when it is loaded in order to
+		// receive data (i.e. with a spec), not when it is merely
+		// fetched to be queried.
+		if dsSpec != nil {
+			if _, err := p.sqlUnarchiveDS.Exec(ds.Id()); err != nil {
+				log.Printf("FetchOrCreateDataSource(): error unarchiving DS: %v", err)
+				return nil, err
+			}
+		}
+		return ds, nil
+	}
+	if dsSpec == nil {
+		return nil, nil
 	}
 
-	// Now try INSERT
-	rows, err = p.sqlInsertDS.Query(ident.String(), dsSpec.Step.Nanoseconds()/1000000, dsSpec.Heartbeat.Nanoseconds()/1000000)
+	start = time.Now()
+	created, err := p.createDataSource(ident, dsSpec)
+	p.ops.observe(opCreateDataSource, start, 1, err)
+	return created, err
+}
+
+// createDataSource is the INSERT of FetchOrCreateDataSource, which
+// returns the DS (without creating its RRAs) if another client has
+// created it in the meantime.
+func (p *pgvSerDe) createDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	rows, err := p.sqlInsertDS.Query(ident.String(), dsSpec.Step.Nanoseconds()/1000000, dsSpec.Heartbeat.Nanoseconds()/1000000, dsSpec.Type.String())
 	if err != nil {
 		log.Printf("FetchOrCreateDataSource(): error querying database: %v", err)
 		return nil, err
@@ -1084,7 +1899,7 @@ func (p *pgvSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd
 	}
 	defer rows.Close()
 
-	ds, err = dataSourceFromRow(rows)
+	ds, err := dataSourceFromRow(rows)
 	if err != nil {
 		log.Printf("FetchOrCreateDataSource(): error 1: %v", err)
 		return nil, err
@@ -1111,17 +1926,7 @@ func (p *pgvSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd
 	for _, rraSpec := range dsSpec.RRAs {
 		stepMs := rraSpec.Step.Nanoseconds() / 1000000
 		size := rraSpec.Span.Nanoseconds() / rraSpec.Step.Nanoseconds()
-		var cf string
-		switch rraSpec.Function {
-		case rrd.WMEAN:
-			cf = "WMEAN"
-		case rrd.MIN:
-			cf = "MIN"
-		case rrd.MAX:
-			cf = "MAX"
-		case rrd.LAST:
-			cf = "LAST"
-		}
+		cf := cfName(rraSpec.Function)
 
 		// rra_bundle
 		var bundle *rraBundleRecord
@@ -1218,6 +2023,22 @@ func (p *pgvSerDe) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints
 	return dps, nil
 }
 
+// FetchSeriesBatch is FetchSeries of many DSs whose data is then read
+// in one query, see dbSeriesBatch.
+func (p *pgvSerDe) FetchSeriesBatch(dss []rrd.DataSourcer, from, to time.Time, maxPoints int64) ([]series.Series, error) {
+	batch := &dbSeriesBatch{db: p}
+	result := make([]series.Series, 0, len(dss))
+	for _, ds := range dss {
+		s, err := p.FetchSeries(ds, from, to, maxPoints)
+		if err != nil {
+			return nil, err
+		}
+		batch.add(s.(*dbSeries))
+		result = append(result, s)
+	}
+	return result, nil
+}
+
 func (p *pgvSerDe) loadRRADps(rra *DbRoundRobinArchive) (map[int64]float64, error) {
 	// the subselect apparently encourages index scan
 	stmt := `
@@ -1227,17 +2048,9 @@ func (p *pgvSerDe) loadRRADps(rra *DbRoundRobinArchive) (map[int64]float64, erro
            WHERE rra_bundle_id = $2 AND seg = $3 AND dp[$1] IS NOT NULL AND dp[$1] <> 'NaN') x
     WHERE (i <= $4) AND v = $5 OR (i > $4) AND v = $6
 `
-	// TODO There should be a centralized place for version calculation
-	latest_i := rrd.SlotIndex(rra.Latest(), rra.Step(), rra.Size())
-	span_ms := (rra.Step().Nanoseconds() / 1e6) * rra.Size()
-	latest_ms := rra.Latest().UnixNano() / 1e6
-	latestVer := int((latest_ms / span_ms) % 32767)
-	prevVer := latestVer - 1
-	if prevVer == -1 {
-		prevVer = 32767
-	}
+	latest_i, latestVer, prevVer := slotVersions(rra)
 
-	rows, err := p.dbConn.Query(fmt.Sprintf(stmt, p.prefix), rra.Idx(), rra.BundleId(), rra.Seg(), latest_i, latestVer, prevVer)
+	rows, err := p.reader().stmts.query(nil, fmt.Sprintf(stmt, p.prefix), rra.Idx(), rra.BundleId(), rra.Seg(), latest_i, latestVer, prevVer)
 	if err != nil {
 		log.Printf("LoadRRAData: error %v", err)
 		return nil, err
@@ -1341,38 +2154,71 @@ func (p *pgvSerDe) rraBundleIncrPos(tx *sql.Tx, id int64) (int64, error) {
 	return 0, fmt.Errorf("rraBundleIncrPos: could not increment pos?")
 }
 
-// DS delete LISTEN/NOTIFY
+// DS delete, rename and create LISTEN/NOTIFY
 
 func (p *pgvSerDe) RegisterDeleteListener(handler func(Ident)) error {
-	err := p.listen.Listen(fmt.Sprintf("%[1]sds_delete_event", p.prefix))
-	if err != nil {
-		return err
-	}
+	return p.registerListener(fmt.Sprintf("%[1]sds_delete_event", p.prefix), handler)
+}
 
-	go handleDeleteNotifications(p.listen, handler)
+// RegisterRenameListener registers a function called with the old
+// ident of every DS renamed, by any client of the database.
+func (p *pgvSerDe) RegisterRenameListener(handler func(Ident)) error {
+	return p.registerListener(fmt.Sprintf("%[1]sds_rename_event", p.prefix), handler)
+}
+
+// RegisterCreateListener registers a function called with the ident
+// of every DS created, by any client of the database.
+func (p *pgvSerDe) RegisterCreateListener(handler func(Ident)) error {
+	return p.registerListener(fmt.Sprintf("%[1]sds_create_event", p.prefix), handler)
+}
+
+// registerListener listens on a channel whose notifications are an
+// ident. The notifications of all channels come from the one
+// listener, the first registration starts handling them. A channel
+// can have more than one handler, they are called in the order
+// registered.
+func (p *pgvSerDe) registerListener(channel string, handler func(Ident)) error {
+	p.handlersMu.Lock()
+	defer p.handlersMu.Unlock()
+	if len(p.handlers[channel]) == 0 {
+		if err := p.listen.Listen(channel); err != nil {
+			return err
+		}
+	}
+	if p.handlers == nil {
+		p.handlers = make(map[string][]func(Ident))
+		go p.handleNotifications()
+	}
+	p.handlers[channel] = append(p.handlers[channel], handler)
 	return nil
 }
 
-func handleDeleteNotifications(l *pq.Listener, handler func(Ident)) {
+func (p *pgvSerDe) handleNotifications() {
 	for {
 		select {
-		case n := <-l.Notify:
-			// TODO: Should we be checking the n.Channel value to make sure
-			// it is not some other event?
+		case n := <-p.listen.Notify:
 			if n == nil || n.Extra == "" {
-				log.Printf("handleDeleteNotifications: Warning: ignoring empty n.Extra string.")
+				log.Printf("handleNotifications: Warning: ignoring empty n.Extra string.")
 				continue
 			}
+			p.handlersMu.Lock()
+			handlers := p.handlers[n.Channel]
+			p.handlersMu.Unlock()
+			if len(handlers) == 0 {
+				continue // not ours
+			}
 			var ident Ident
 			err := json.Unmarshal([]byte(n.Extra), &ident)
 			if err != nil {
-				log.Printf("handleDeleteNotifications(): error unmarshalling ident: %v", err)
+				log.Printf("handleNotifications(): error unmarshalling ident: %v", err)
+			}
+			for _, handler := range handlers {
+				handler(ident)
 			}
-			handler(ident)
 		case <-time.After(30 * time.Second):
 			// This is what the example code does, not sure we need it
 			// https://godoc.org/github.com/lib/pq/listen_example
-			go l.Ping()
+			go p.listen.Ping()
 		}
 	}
 }
@@ -0,0 +1,136 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import "fmt"
+
+// The checks of Check. Each query returns the DS and RRA ids (0 if
+// none), the key passed to the repair statement as $1 and a
+// description of every problem. A repair statement re-checks the
+// problem, so that one fixed in the meantime is left alone, and
+// those without one are only reported, they cannot be repaired
+// without losing data. A DS is not checked for RRAs in the first
+// minute, while it is being created.
+var pgCheckSql = []struct{ name, check, repair string }{
+	{"ds_without_rras",
+		`SELECT ds.id, 0, ds.id, 'no RRAs: ' || ds.ident::text FROM %[1]sds ds
+          WHERE ds.created_at < now() - interval '1 minute'
+            AND NOT EXISTS (SELECT 1 FROM %[1]srra rra WHERE rra.ds_id = ds.id)`,
+		// it has no data, it is recreated with its spec
+		`DELETE FROM %[1]sds ds WHERE ds.id = $1
+            AND NOT EXISTS (SELECT 1 FROM %[1]srra rra WHERE rra.ds_id = ds.id)`},
+	{"rra_pos_beyond_last_pos",
+		`SELECT rra.ds_id, rra.id, rra.id, 'pos ' || rra.pos || ' beyond last_pos ' || b.last_pos || ' of bundle ' || b.id
+           FROM %[1]srra rra JOIN %[1]srra_bundle b ON b.id = rra.rra_bundle_id
+          WHERE rra.pos > b.last_pos`,
+		// so that the position is not given to another RRA
+		`UPDATE %[1]srra_bundle b SET last_pos = rra.pos FROM %[1]srra rra
+          WHERE rra.id = $1 AND b.id = rra.rra_bundle_id AND rra.pos > b.last_pos`},
+	{"rra_seg_idx_mismatch",
+		`SELECT rra.ds_id, rra.id, rra.id, 'seg ' || rra.seg || ' idx ' || rra.idx || ' is not that of pos ' || rra.pos ||
+                ' (seg ' || ((rra.pos-1) / b.width) || ' idx ' || (mod(rra.pos-1, b.width)+1) || ')'
+           FROM %[1]srra rra JOIN %[1]srra_bundle b ON b.id = rra.rra_bundle_id
+          WHERE rra.pos < 1 OR rra.seg <> (rra.pos-1) / b.width OR rra.idx <> mod(rra.pos-1, b.width)+1`,
+		""},
+	{"rra_slot_shared",
+		`SELECT rra.ds_id, rra.id, rra.id, 'seg ' || rra.seg || ' idx ' || rra.idx || ' of bundle ' || rra.rra_bundle_id ||
+                ' also that of rra ' || o.id || ' of ds ' || o.ds_id
+           FROM %[1]srra rra
+           JOIN %[1]srra o ON o.rra_bundle_id = rra.rra_bundle_id AND o.seg = rra.seg AND o.idx = rra.idx AND o.id <> rra.id`,
+		""},
+	{"rra_latest_in_future",
+		`SELECT rra.ds_id, rra.id, rra.id, 'latest ' || rs.latest[rra.idx] || ' more than a day in the future'
+           FROM %[1]srra rra JOIN %[1]srra_state rs ON rs.rra_bundle_id = rra.rra_bundle_id AND rs.seg = rra.seg
+          WHERE rs.latest[rra.idx] > now() + interval '1 day'`,
+		// as if never flushed, the data points are dropped by the version check
+		`UPDATE %[1]srra_state rs SET latest[rra.idx] = NULL, value[rra.idx] = NULL, duration_ms[rra.idx] = NULL
+           FROM %[1]srra rra
+          WHERE rra.id = $1 AND rs.rra_bundle_id = rra.rra_bundle_id AND rs.seg = rra.seg
+            AND rs.latest[rra.idx] > now() + interval '1 day'`},
+	{"rra_latest_unaligned",
+		`SELECT rra.ds_id, rra.id, rra.id, 'latest ' || rs.latest[rra.idx] || ' not a multiple of the step of ' || b.step_ms || 'ms'
+           FROM %[1]srra rra
+           JOIN %[1]srra_bundle b ON b.id = rra.rra_bundle_id
+           JOIN %[1]srra_state rs ON rs.rra_bundle_id = rra.rra_bundle_id AND rs.seg = rra.seg
+          WHERE mod((extract(epoch FROM rs.latest[rra.idx]) * 1000)::bigint, b.step_ms) <> 0`,
+		// the beginning of the slot, which is in the same slot
+		`UPDATE %[1]srra_state rs
+            SET latest[rra.idx] = to_timestamp((extract(epoch FROM rs.latest[rra.idx]) * 1000)::bigint / b.step_ms * b.step_ms / 1000.0)
+           FROM %[1]srra rra JOIN %[1]srra_bundle b ON b.id = rra.rra_bundle_id
+          WHERE rra.id = $1 AND rs.rra_bundle_id = rra.rra_bundle_id AND rs.seg = rra.seg
+            AND mod((extract(epoch FROM rs.latest[rra.idx]) * 1000)::bigint, b.step_ms) <> 0`},
+	{"ts_slot_beyond_size",
+		`SELECT 0, 0, b.id, count(1) || ' ts rows of bundle ' || b.id || ' beyond its size of ' || b.size
+           FROM %[1]sts ts JOIN %[1]srra_bundle b ON b.id = ts.rra_bundle_id
+          WHERE ts.i < 0 OR ts.i >= b.size
+          GROUP BY b.id, b.size`,
+		// no time maps to them, they are never read
+		`DELETE FROM %[1]sts ts USING %[1]srra_bundle b
+          WHERE ts.rra_bundle_id = $1 AND b.id = ts.rra_bundle_id AND (ts.i < 0 OR ts.i >= b.size)`},
+}
+
+// Check runs the checks of pgCheckSql and, with repair, repairs the
+// problems found which can be. It can be run while tgres is, but a
+// running tgres may write the (impossible) state it has cached over
+// a repair, it is best done while none is.
+func (p *pgvSerDe) Check(repair bool) (*CheckReport, error) {
+	report := &CheckReport{}
+	for _, c := range pgCheckSql {
+		problems, keys, err := p.check(c.name, c.check)
+		if err != nil {
+			return report, err
+		}
+		for i := range problems {
+			if repair && c.repair != "" {
+				res, err := p.dbConn.Exec(fmt.Sprintf(c.repair, p.prefix), keys[i])
+				if err != nil {
+					return report, fmt.Errorf("Check(): repairing %s: %v", c.name, err)
+				}
+				n, _ := res.RowsAffected()
+				problems[i].Repaired = n > 0
+			}
+			report.Problems = append(report.Problems, problems[i])
+		}
+	}
+	return report, nil
+}
+
+// check runs a query of pgCheckSql and returns the problems and
+// their repair keys.
+func (p *pgvSerDe) check(name, stmt string) ([]CheckProblem, []int64, error) {
+	rows, err := p.dbConn.Query(fmt.Sprintf(stmt, p.prefix))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Check(): %s: %v", name, err)
+	}
+	defer rows.Close()
+
+	var (
+		problems []CheckProblem
+		keys     []int64
+	)
+	for rows.Next() {
+		var (
+			cp  = CheckProblem{Check: name}
+			key int64
+		)
+		if err := rows.Scan(&cp.DsId, &cp.RRAId, &key, &cp.Detail); err != nil {
+			return nil, nil, fmt.Errorf("Check(): %s: %v", name, err)
+		}
+		problems = append(problems, cp)
+		keys = append(keys, key)
+	}
+	return problems, keys, rows.Err()
+}
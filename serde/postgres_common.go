@@ -20,6 +20,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
+	"sort"
 	"strings"
 	"time"
 
@@ -39,6 +41,19 @@ func dataSourceFromDsRec(dsr *dsRecord) (*DbDataSource, error) {
 		dsr.durationMs = new(int64)
 	}
 
+	if dsr.lastRaw == nil {
+		nan := math.NaN()
+		dsr.lastRaw = &nan
+	}
+
+	dsType := rrd.GAUGE
+	if dsr.dsType != "" {
+		var err error
+		if dsType, err = rrd.ParseDSType(dsr.dsType); err != nil {
+			return nil, fmt.Errorf("dataSourceFromDsRec(): %v", err)
+		}
+	}
+
 	var ident Ident
 	err := json.Unmarshal(dsr.identJson, &ident)
 	if err != nil {
@@ -51,9 +66,11 @@ func dataSourceFromDsRec(dsr *dsRecord) (*DbDataSource, error) {
 			rrd.DSSpec{
 				Step:       time.Duration(dsr.stepMs) * time.Millisecond,
 				Heartbeat:  time.Duration(dsr.hbMs) * time.Millisecond,
+				Type:       dsType,
 				LastUpdate: *dsr.lastupdate,
 				Value:      *dsr.value,
 				Duration:   time.Duration(*dsr.durationMs) * time.Millisecond,
+				LastRaw:    *dsr.lastRaw,
 			},
 		),
 	)
@@ -65,7 +82,7 @@ func dataSourceFromDsRec(dsr *dsRecord) (*DbDataSource, error) {
 
 func dsRecordFromRow(rows *sql.Rows) (*dsRecord, error) {
 	var dsr dsRecord
-	err := rows.Scan(&dsr.id, &dsr.identJson, &dsr.stepMs, &dsr.hbMs, &dsr.seg, &dsr.idx, &dsr.lastupdate, &dsr.value, &dsr.durationMs, &dsr.created)
+	err := rows.Scan(&dsr.id, &dsr.identJson, &dsr.stepMs, &dsr.hbMs, &dsr.seg, &dsr.idx, &dsr.lastupdate, &dsr.value, &dsr.durationMs, &dsr.created, &dsr.dsType, &dsr.lastRaw)
 	return &dsr, err
 }
 
@@ -79,9 +96,10 @@ func dataSourceFromRow(rows *sql.Rows) (*DbDataSource, error) {
 }
 
 type pgSearchResult struct {
-	rows  *sql.Rows
-	err   error
-	ident Ident
+	rows     *sql.Rows
+	err      error
+	ident    Ident
+	archived bool
 }
 
 func (sr *pgSearchResult) Next() bool {
@@ -90,7 +108,7 @@ func (sr *pgSearchResult) Next() bool {
 	}
 
 	var b []byte
-	sr.err = sr.rows.Scan(&b)
+	sr.err = sr.rows.Scan(&b, &sr.archived)
 	if sr.err != nil {
 		log.Printf("pgSearchResult.Next(): error scanning row: %v", sr.err)
 		return false
@@ -105,8 +123,9 @@ func (sr *pgSearchResult) Next() bool {
 	return true
 }
 
-func (sr *pgSearchResult) Ident() Ident { return sr.ident }
-func (sr *pgSearchResult) Close() error { return sr.rows.Close() }
+func (sr *pgSearchResult) Ident() Ident   { return sr.ident }
+func (sr *pgSearchResult) Archived() bool { return sr.archived }
+func (sr *pgSearchResult) Close() error   { return sr.rows.Close() }
 
 func buildSearchWhere(query map[string]string) (string, []interface{}) {
 	var (
@@ -132,6 +151,42 @@ func buildSearchWhere(query map[string]string) (string, []interface{}) {
 	return where, args
 }
 
+// buildTagWhere is the WHERE clause of a TagQuery, using the ident
+// GIN index for the equalities (@>) and the tags present (?). The
+// placeholders begin with $n+1.
+func buildTagWhere(q TagQuery, n int) (string, []interface{}) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	if len(q.Equal) > 0 {
+		b, _ := json.Marshal(q.Equal) // a map[string]string cannot fail
+		where = append(where, fmt.Sprintf("ident @> $%d::jsonb", n+1))
+		args = append(args, string(b))
+		n++
+	}
+	keys := make([]string, 0, len(q.Prefix))
+	for k := range q.Prefix {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // for the same statement every time
+	for _, k := range keys {
+		where = append(where, fmt.Sprintf("ident ? $%d AND ident ->> $%d LIKE $%d", n+1, n+1, n+2))
+		args = append(args, k, pgLikePrefix(q.Prefix[k]))
+		n += 2
+	}
+	if len(where) == 0 {
+		return "true", nil
+	}
+	return strings.Join(where, " AND "), args
+}
+
+// pgLikePrefix is the LIKE pattern matching strings beginning with
+// prefix.
+func pgLikePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
+}
+
 // Turn {3:0.1, 10:0.2, 9:0.3}
 // to "dp[$1:$2] = $3, dp[$3:$4] = $5", {3, 3, "{0.1}", 9, 10, "{0.2,0.3}"}
 // n is the beginning index, ($1 above), col is column name, e.g. "dp"
@@ -0,0 +1,105 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// PgPasswordFile, if set, is a file with the database password, e.g.
+// a mounted secret. It is read for every new connection, so that a
+// rotated password is used without a restart, with
+// PgConnMaxLifetime the connections using the old one are closed in
+// time.
+var PgPasswordFile string
+
+// PgConnectString adds options, e.g. sslmode, to a connect string,
+// which can be a URL or key=value pairs. Options already in the
+// connect string are replaced.
+func PgConnectString(connect_string string, options map[string]string) string {
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if strings.HasPrefix(connect_string, "postgres://") || strings.HasPrefix(connect_string, "postgresql://") {
+		if u, err := url.Parse(connect_string); err == nil {
+			q := u.Query()
+			for _, k := range keys {
+				if k == "password" {
+					u.User = url.UserPassword(u.User.Username(), options[k])
+				} else {
+					q.Set(k, options[k])
+				}
+			}
+			u.RawQuery = q.Encode()
+			return u.String()
+		}
+	}
+	for _, k := range keys { // the last of a key wins
+		v := strings.Replace(strings.Replace(options[k], `\`, `\\`, -1), `'`, `\'`, -1)
+		connect_string += fmt.Sprintf(" %s='%s'", k, v)
+	}
+	return connect_string
+}
+
+// pgReadPassword returns the password in a PgPasswordFile, without
+// the trailing newline.
+func pgReadPassword(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("password file: %v", err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// pgPasswordConnector connects with the password currently in a
+// password file.
+type pgPasswordConnector struct {
+	connect_string string
+	path           string
+	driver         driver.Driver
+}
+
+func (c *pgPasswordConnector) Connect(context.Context) (driver.Conn, error) {
+	password, err := pgReadPassword(c.path)
+	if err != nil {
+		return nil, err
+	}
+	return c.driver.Open(PgConnectString(c.connect_string, map[string]string{"password": password}))
+}
+
+func (c *pgPasswordConnector) Driver() driver.Driver { return c.driver }
+
+// pgOpen is sql.Open of the postgres driver, with the password of
+// PgPasswordFile, if any.
+func pgOpen(connect_string string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", connect_string)
+	if err != nil || PgPasswordFile == "" {
+		return db, err
+	}
+	drv := db.Driver()
+	db.Close() // it has no connections yet
+	return sql.OpenDB(&pgPasswordConnector{connect_string: connect_string, path: PgPasswordFile, driver: drv}), nil
+}
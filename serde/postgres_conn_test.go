@@ -0,0 +1,71 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_PgConnectString(t *testing.T) {
+	for _, c := range []struct {
+		in, out string
+	}{
+		{"host=db dbname=tgres", `host=db dbname=tgres password='it\'s' sslmode='require'`},
+		{"postgres://tgres@db/tgres?connect_timeout=5", "postgres://tgres:it%27s@db/tgres?connect_timeout=5&sslmode=require"},
+	} {
+		if out := PgConnectString(c.in, map[string]string{"sslmode": "require", "password": "it's"}); out != c.out {
+			t.Errorf("PgConnectString(%q): expected %q, got %q", c.in, c.out, out)
+		}
+	}
+}
+
+// dsnDriver records the connect strings it is opened with.
+type dsnDriver struct{ dsns []string }
+
+func (d *dsnDriver) Open(dsn string) (driver.Conn, error) {
+	d.dsns = append(d.dsns, dsn)
+	return &stmtConn{&stmtDriver{}}, nil
+}
+
+func Test_pgPasswordConnector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "password")
+	ioutil.WriteFile(path, []byte("one\n"), 0600)
+
+	d := &dsnDriver{}
+	db := sql.OpenDB(&pgPasswordConnector{connect_string: "host=db", path: path, driver: d})
+	db.SetMaxIdleConns(0) // a new connection every time
+	db.Exec("SELECT 1")
+	ioutil.WriteFile(path, []byte("two\n"), 0600) // rotated
+	db.Exec("SELECT 1")
+	if len(d.dsns) != 2 || d.dsns[0] != "host=db password='one'" || d.dsns[1] != "host=db password='two'" {
+		t.Errorf("pgPasswordConnector: expected the password of the moment, got %q", d.dsns)
+	}
+
+	os.Remove(path)
+	if _, err := db.Exec("SELECT 1"); err == nil {
+		t.Errorf("pgPasswordConnector: a missing password file should be an error")
+	}
+}
@@ -0,0 +1,91 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The tables written to all the time, analyzed by Maintain.
+var pgHotTables = []string{"ts", "rra_state", "ds_state"}
+
+// The rows left over when DSs are deleted (their RRAs are deleted
+// along with them): the ts and rra_state rows of a bundle segment
+// without RRAs and the ds_state rows of a segment without DSs.
+// Segments are never reused, so such a row stays orphaned.
+var pgPruneSql = []struct{ table, sql string }{
+	{"ts", `DELETE FROM %[1]sts ts WHERE NOT EXISTS
+             (SELECT 1 FROM %[1]srra rra WHERE rra.rra_bundle_id = ts.rra_bundle_id AND rra.seg = ts.seg)`},
+	{"rra_state", `DELETE FROM %[1]srra_state rs WHERE NOT EXISTS
+             (SELECT 1 FROM %[1]srra rra WHERE rra.rra_bundle_id = rs.rra_bundle_id AND rra.seg = rs.seg)`},
+	{"ds_state", `DELETE FROM %[1]sds_state dss WHERE NOT EXISTS
+             (SELECT 1 FROM %[1]sds ds WHERE ds.seg = dss.seg)`},
+}
+
+// Maintain prunes orphaned rows, analyzes the hot tables, so that
+// the planner knows how large they are, and returns the sizes and
+// dead rows of all the tables.
+func (p *pgvSerDe) Maintain() (*MaintenanceReport, error) {
+	report := &MaintenanceReport{Pruned: make(map[string]int64), Tables: make(map[string]TableStats)}
+
+	for _, prune := range pgPruneSql {
+		res, err := p.dbConn.Exec(fmt.Sprintf(prune.sql, p.prefix))
+		if err != nil {
+			return nil, fmt.Errorf("Maintain(): pruning %s: %v", prune.table, err)
+		}
+		report.Pruned[prune.table], _ = res.RowsAffected()
+	}
+
+	for _, table := range pgHotTables {
+		if _, err := p.dbConn.Exec(fmt.Sprintf("ANALYZE %s%s", p.prefix, table)); err != nil {
+			return nil, fmt.Errorf("Maintain(): analyzing %s: %v", table, err)
+		}
+	}
+
+	const stmt = `
+  SELECT relname, pg_table_size(relid), pg_indexes_size(relid), n_live_tup, n_dead_tup
+    FROM pg_stat_user_tables
+   WHERE schemaname = current_schema() AND relname LIKE $1`
+	rows, err := p.dbConn.Query(stmt, strings.Replace(p.prefix, "_", `\_`, -1)+"%")
+	if err != nil {
+		return nil, fmt.Errorf("Maintain(): table stats: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			name string
+			st   TableStats
+		)
+		if err := rows.Scan(&name, &st.Bytes, &st.IndexBytes, &st.LiveRows, &st.DeadRows); err != nil {
+			return nil, fmt.Errorf("Maintain(): table stats: %v", err)
+		}
+		if table := strings.TrimPrefix(name, p.prefix); pgIsTable(table) {
+			report.Tables[table] = st
+		}
+	}
+	return report, rows.Err()
+}
+
+// pgIsTable is whether a table (without the prefix) is one of ours,
+// rather than that of another prefix starting with this one.
+func pgIsTable(table string) bool {
+	switch table {
+	case "ds", "ds_state", "rra", "rra_state", "rra_bundle", "ts", "dsl_cache", "schema_version":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// The version of the schema this tgres creates. Version 1 is that of
+// the tgres versions from before the schema was versioned, i.e. of a
+// database without a schema_version row.
+const pgSchemaVersion = 2
+
+// PgSchemaCompat keeps the schema usable by the previous version of
+// tgres during a rolling upgrade: the new version only makes the
+// changes which add to the schema and leaves out those which take
+// away from it (see pgSchemaStep), and the previous version can
+// still start. Once every node runs the new version, it is turned off
+// and the next start makes the remaining changes.
+var PgSchemaCompat bool
+
+// A pgSchemaStep is a change of the schema made by a version of it.
+// Expanding steps only add to the schema, e.g. columns with a
+// default, which the previous version does not notice, contracting
+// ones take away from it what only the previous version uses and are
+// held back by PgSchemaCompat. Every step is idempotent.
+type pgSchemaStep struct {
+	version  int
+	contract bool
+	sql      string
+}
+
+var pgSchemaSteps = []pgSchemaStep{
+	{2, false, pgAddColumnSql("ds", "ds_type", "TEXT NOT NULL DEFAULT 'GAUGE'")}, // GAUGE, COUNTER, DERIVE, ABSOLUTE
+	{2, false, pgAddColumnSql("ds", "archived", "BOOL NOT NULL DEFAULT false")},
+	{2, false, pgAddColumnSql("ds", "metadata", "JSONB NOT NULL DEFAULT '{}'")},                    // units, description, owner
+	{2, false, pgAddColumnSql("ds_state", "last_raw", "DOUBLE PRECISION[] NOT NULL DEFAULT '{}'")}, // for COUNTER and DERIVE
+}
+
+// pgAddColumnSql adds a column unless it exists. NB: ADD COLUMN IF
+// NOT EXISTS is PG 9.6+, we check information_schema instead so that
+// 9.5 works.
+func pgAddColumnSql(table, column, def string) string {
+	return fmt.Sprintf(`
+DO $$
+BEGIN
+  IF (SELECT COUNT(1) FROM information_schema.columns WHERE table_name='%%[1]s%[1]s' and column_name='%[2]s') = 0 THEN
+    ALTER TABLE %%[1]s%[1]s ADD COLUMN %[2]s %[3]s;
+  END IF;
+END
+$$;
+`, table, column, def)
+}
+
+// pgSchemaPlan returns the steps to bring a schema of version (usable
+// by versions from minVersion on) up to date and the versions it is
+// then. A schema made by a version whose changes this one does not
+// know about is left alone, unless it is no longer usable by it.
+func pgSchemaPlan(version, minVersion int, compat bool) (steps []pgSchemaStep, newVersion, newMinVersion int, err error) {
+	if minVersion > pgSchemaVersion {
+		return nil, version, minVersion, fmt.Errorf("the database schema (version %d) is no longer usable by tgres versions with schema version %d, "+
+			"it was upgraded by a newer version without pg-schema-compat", version, pgSchemaVersion)
+	}
+	newVersion, newMinVersion = version, minVersion
+	if version < pgSchemaVersion {
+		newVersion = pgSchemaVersion
+	}
+	if !compat && minVersion < pgSchemaVersion {
+		newMinVersion = pgSchemaVersion
+	}
+	for _, step := range pgSchemaSteps {
+		if step.contract && step.version > minVersion && step.version <= newMinVersion {
+			steps = append(steps, step)
+		} else if !step.contract && step.version > version {
+			steps = append(steps, step)
+		}
+	}
+	return steps, newVersion, newMinVersion, nil
+}
+
+// migrateSchema makes the changes of pgSchemaPlan and records the
+// versions of the schema in the schema_version table, while holding a
+// lock on it, so that nodes starting at the same time take turns.
+func (p *pgvSerDe) migrateSchema() error {
+	create := `CREATE TABLE IF NOT EXISTS %[1]sschema_version (
+       version INT NOT NULL,
+       min_version INT NOT NULL,
+       updated_at TIMESTAMPTZ NOT NULL DEFAULT now())`
+	if _, err := p.dbConn.Exec(fmt.Sprintf(create, p.prefix)); err != nil {
+		return err
+	}
+
+	tx, err := p.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // a noop after Commit()
+
+	if _, err := tx.Exec(fmt.Sprintf("LOCK TABLE %[1]sschema_version IN SHARE ROW EXCLUSIVE MODE", p.prefix)); err != nil {
+		return err
+	}
+	version, minVersion := 1, 1
+	err = tx.QueryRow(fmt.Sprintf("SELECT version, min_version FROM %[1]sschema_version", p.prefix)).Scan(&version, &minVersion)
+	found := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	steps, newVersion, newMinVersion, err := pgSchemaPlan(version, minVersion, PgSchemaCompat)
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		if _, err := tx.Exec(fmt.Sprintf(step.sql, p.prefix)); err != nil {
+			return fmt.Errorf("schema version %d step: %v", step.version, err)
+		}
+	}
+
+	if !found {
+		_, err = tx.Exec(fmt.Sprintf("INSERT INTO %[1]sschema_version (version, min_version) VALUES ($1, $2)", p.prefix), newVersion, newMinVersion)
+	} else if newVersion != version || newMinVersion != minVersion {
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %[1]sschema_version SET version = $1, min_version = $2, updated_at = now()", p.prefix), newVersion, newMinVersion)
+	}
+	if err != nil {
+		return err
+	}
+	if newVersion != version || newMinVersion != minVersion {
+		log.Printf("Database schema version %d (usable from version %d on), was %d (from %d on).", newVersion, newMinVersion, version, minVersion)
+	}
+	if PgSchemaCompat && newMinVersion < pgSchemaVersion {
+		log.Printf("The database schema is kept usable by the previous version of tgres (pg-schema-compat).")
+	}
+	return tx.Commit()
+}
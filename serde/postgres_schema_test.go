@@ -0,0 +1,63 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_pgSchemaPlan(t *testing.T) {
+	save := pgSchemaSteps
+	defer func() { pgSchemaSteps = save }()
+	pgSchemaSteps = []pgSchemaStep{
+		{1, false, "v1"},
+		{2, false, "add"},
+		{2, true, "drop"},
+	}
+
+	// an unversioned schema, the previous version keeps running
+	steps, v, min, err := pgSchemaPlan(1, 1, true)
+	if err != nil || v != 2 || min != 1 || len(steps) != 1 || steps[0].sql != "add" {
+		t.Errorf("pgSchemaPlan: (compat) unexpected %v %d %d %v", steps, v, min, err)
+	}
+	// every node upgraded
+	steps, v, min, err = pgSchemaPlan(2, 1, false)
+	if err != nil || v != 2 || min != 2 || len(steps) != 1 || steps[0].sql != "drop" {
+		t.Errorf("pgSchemaPlan: (contract) unexpected %v %d %d %v", steps, v, min, err)
+	}
+	steps, v, min, err = pgSchemaPlan(1, 1, false)
+	if err != nil || v != 2 || min != 2 || len(steps) != 2 {
+		t.Errorf("pgSchemaPlan: (both) unexpected %v %d %d %v", steps, v, min, err)
+	}
+	if steps, v, min, err = pgSchemaPlan(2, 2, false); err != nil || v != 2 || min != 2 || len(steps) != 0 {
+		t.Errorf("pgSchemaPlan: (up to date) unexpected %v %d %d %v", steps, v, min, err)
+	}
+
+	// the previous version during the upgrade of a newer one
+	if steps, v, min, err = pgSchemaPlan(3, 2, false); err != nil || v != 3 || min != 2 || len(steps) != 0 {
+		t.Errorf("pgSchemaPlan: (newer) unexpected %v %d %d %v", steps, v, min, err)
+	}
+	if _, _, _, err = pgSchemaPlan(3, 3, false); err == nil || !strings.Contains(err.Error(), "no longer usable") {
+		t.Errorf("pgSchemaPlan: (newer, contracted) expected an error, got %v", err)
+	}
+}
+
+func Test_pgAddColumnSql(t *testing.T) {
+	if s := pgAddColumnSql("ds", "archived", "BOOL"); !strings.Contains(s, "table_name='%[1]sds'") || !strings.Contains(s, "ALTER TABLE %[1]sds ADD COLUMN archived BOOL;") {
+		t.Errorf("pgAddColumnSql: unexpected %s", s)
+	}
+}
@@ -0,0 +1,122 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"sync"
+	"sync/atomic"
+)
+
+// The most statements a pgStmtCache prepares.
+const pgStmtCacheSize = 1024
+
+// pgStmtCache prepares statements the first time they are used and
+// keeps them, database/sql in turn prepares a statement once on
+// every connection it is used on and reuses it there. It is for the
+// statements which are made up as needed, e.g. the array updates of
+// a varying number of chunks, the fixed ones are prepared in
+// prepareSqlStatements.
+//
+// Preparing needs a connection of its own, which, in a transaction,
+// may only become available once the transaction is done, so a
+// statement is prepared in a goroutine and executed without
+// preparing until it is. Once the cache is full, new statements are
+// never prepared.
+type pgStmtCache struct {
+	db *sql.DB
+	sync.Mutex
+	stmts map[string]*sql.Stmt // nil while being prepared
+
+	prepares, execs, unprepared int64 // atomic
+}
+
+func newPgStmtCache(db *sql.DB) *pgStmtCache {
+	return &pgStmtCache{db: db, stmts: make(map[string]*sql.Stmt)}
+}
+
+// stmt returns the prepared statement of query, or nil if it is not
+// prepared (yet).
+func (c *pgStmtCache) stmt(query string) *sql.Stmt {
+	c.Lock()
+	defer c.Unlock()
+	if stmt, ok := c.stmts[query]; ok || len(c.stmts) >= pgStmtCacheSize {
+		return stmt
+	}
+	c.stmts[query] = nil
+	go func() {
+		stmt, err := c.db.Prepare(query)
+		c.Lock()
+		defer c.Unlock()
+		if err != nil {
+			delete(c.stmts, query) // the error is that of the execution
+			return
+		}
+		atomic.AddInt64(&c.prepares, 1)
+		c.stmts[query] = stmt
+	}()
+	return nil
+}
+
+// exec executes query as a prepared statement, in tx unless it is nil.
+func (c *pgStmtCache) exec(tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+	stmt := c.stmt(query)
+	if stmt == nil {
+		atomic.AddInt64(&c.unprepared, 1)
+		if tx != nil {
+			return tx.Exec(query, args...)
+		}
+		return c.db.Exec(query, args...)
+	}
+	atomic.AddInt64(&c.execs, 1)
+	if tx != nil {
+		return tx.Stmt(stmt).Exec(args...)
+	}
+	return stmt.Exec(args...)
+}
+
+// query is exec for statements returning rows.
+func (c *pgStmtCache) query(tx *sql.Tx, query string, args ...interface{}) (*sql.Rows, error) {
+	stmt := c.stmt(query)
+	if stmt == nil {
+		atomic.AddInt64(&c.unprepared, 1)
+		if tx != nil {
+			return tx.Query(query, args...)
+		}
+		return c.db.Query(query, args...)
+	}
+	atomic.AddInt64(&c.execs, 1)
+	if tx != nil {
+		return tx.Stmt(stmt).Query(args...)
+	}
+	return stmt.Query(args...)
+}
+
+// PgStmtStats are the counts of a pgStmtCache so far: statements
+// prepared, executions of prepared statements and executions of
+// statements not prepared, because they were not yet or the cache was
+// full.
+type PgStmtStats struct {
+	Prepares, Execs, Unprepared int64
+}
+
+func (c *pgStmtCache) stats() PgStmtStats {
+	return PgStmtStats{
+		Prepares:   atomic.LoadInt64(&c.prepares),
+		Execs:      atomic.LoadInt64(&c.execs),
+		Unprepared: atomic.LoadInt64(&c.unprepared),
+	}
+}
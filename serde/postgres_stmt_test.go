@@ -0,0 +1,109 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var stmtDrivers int64 // a driver can only be registered once
+
+// stmtDriver counts the statements prepared on its connections.
+type stmtDriver struct{ prepares int64 }
+
+type stmtConn struct{ d *stmtDriver }
+type stmtStmt struct{}
+type stmtRows struct{}
+
+func (d *stmtDriver) Open(string) (driver.Conn, error) { return &stmtConn{d}, nil }
+func (c *stmtConn) Prepare(string) (driver.Stmt, error) {
+	atomic.AddInt64(&c.d.prepares, 1)
+	return stmtStmt{}, nil
+}
+func (*stmtConn) Close() error              { return nil }
+func (*stmtConn) Begin() (driver.Tx, error) { return stmtStmt{}, nil }
+func (stmtStmt) Commit() error              { return nil }
+func (stmtStmt) Rollback() error            { return nil }
+func (stmtStmt) Close() error               { return nil }
+func (stmtStmt) NumInput() int              { return -1 }
+func (stmtStmt) Exec([]driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+func (stmtStmt) Query([]driver.Value) (driver.Rows, error) { return stmtRows{}, nil }
+func (stmtRows) Columns() []string                         { return nil }
+func (stmtRows) Close() error                              { return nil }
+func (stmtRows) Next([]driver.Value) error                 { return io.EOF }
+
+func Test_pgStmtCache(t *testing.T) {
+	d := &stmtDriver{}
+	name := fmt.Sprintf("stmtcachetest%d", atomic.AddInt64(&stmtDrivers, 1))
+	sql.Register(name, d)
+	db, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	c := newPgStmtCache(db)
+
+	// The first exec is not prepared, it is prepared meanwhile
+	if _, err := c.exec(nil, "UPDATE foo SET x = $1", 0); err != nil {
+		t.Fatal(err)
+	}
+	waitPrepares := func(n int64) {
+		for i := 0; i < 1000 && c.stats().Prepares < n; i++ {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitPrepares(1)
+
+	// In a transaction, which holds the only connection
+	tx, _ := db.Begin()
+	for i := 1; i < 3; i++ {
+		if _, err := c.exec(tx, "UPDATE foo SET x = $1", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rows, err := c.query(tx, "SELECT 1", 4); err != nil {
+		t.Fatal(err)
+	} else {
+		rows.Close()
+	}
+	tx.Commit()
+	waitPrepares(2)
+	c.exec(nil, "SELECT 1")
+	// The driver has no Execer, so the unprepared ones are prepared too
+	if st := c.stats(); st.Prepares != 2 || st.Execs != 3 || st.Unprepared != 2 || atomic.LoadInt64(&d.prepares) != 4 {
+		t.Errorf("pgStmtCache: expected 2 prepares, 3 execs and 2 unprepared, got %+v (%d driver prepares)", st, d.prepares)
+	}
+
+	for i := 0; i < pgStmtCacheSize; i++ {
+		c.exec(nil, fmt.Sprintf("SELECT %d", i))
+	}
+	waitPrepares(pgStmtCacheSize)
+	before := c.stats()
+	c.exec(nil, "SELECT 2, 3")
+	c.exec(nil, "SELECT 2, 3")
+	time.Sleep(10 * time.Millisecond)
+	if st := c.stats(); st.Prepares != pgStmtCacheSize || st.Unprepared != before.Unprepared+2 {
+		t.Errorf("pgStmtCache: a full cache should not prepare, got %+v", st)
+	}
+}
@@ -0,0 +1,177 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_pgConnectionLimits(t *testing.T) {
+	for _, c := range []struct {
+		max          int
+		share        float64
+		flush, query int
+	}{
+		{20, 0.25, 15, 5},
+		{2, 0.25, 1, 1},
+		{10, 0, 9, 1},
+		{3, 0.9, 1, 2},
+	} {
+		if flush, query := pgConnectionLimits(c.max, c.share); flush != c.flush || query != c.query {
+			t.Errorf("pgConnectionLimits(%d, %v): expected %d, %d got %d, %d", c.max, c.share, c.flush, c.query, flush, query)
+		}
+	}
+}
+
+func Test_pgIndexSql(t *testing.T) {
+	stmts := strings.Join(pgIndexSql("tgres_", false, false), ";\n")
+	if !strings.Contains(stmts, "CREATE UNIQUE INDEX IF NOT EXISTS tgres_idx_rra_rra_bundle_id ON tgres_rra (ds_id, rra_bundle_id, cf)") ||
+		!strings.Contains(stmts, "DROP INDEX IF EXISTS tgres_idx_rra_rra_bundle_id_covering") ||
+		!strings.Contains(stmts, "DROP INDEX IF EXISTS tgres_idx_ts_brin") || strings.Contains(stmts, "USING brin") {
+		t.Errorf("pgIndexSql: unexpected default statements:\n%s", stmts)
+	}
+	stmts = strings.Join(pgIndexSql("tgres_", true, true), ";\n")
+	if !strings.Contains(stmts, "tgres_idx_rra_rra_bundle_id_covering ON tgres_rra (ds_id, rra_bundle_id, cf) INCLUDE") ||
+		!strings.Contains(stmts, "DROP INDEX IF EXISTS tgres_idx_rra_rra_bundle_id;") ||
+		!strings.Contains(stmts, "tgres_idx_ts_brin ON tgres_ts USING brin") || strings.Contains(stmts, "DROP INDEX IF EXISTS tgres_idx_ts_brin") {
+		t.Errorf("pgIndexSql: unexpected covering and brin statements:\n%s", stmts)
+	}
+}
+
+func Test_pgCompressionSql(t *testing.T) {
+	stmts, err := pgCompressionSql("tgres_", "")
+	if err != nil || !strings.Contains(strings.Join(stmts, ";\n"), "ALTER TABLE tgres_ts RESET (toast_tuple_target)") {
+		t.Errorf("pgCompressionSql: unexpected default statements %v %v", stmts, err)
+	}
+	stmts, _ = pgCompressionSql("tgres_", "lz4")
+	if s := strings.Join(stmts, ";\n"); !strings.Contains(s, "ALTER TABLE tgres_ts ALTER COLUMN dp SET COMPRESSION lz4") ||
+		!strings.Contains(s, "ALTER TABLE tgres_ts ALTER COLUMN dp SET STORAGE MAIN") || !strings.Contains(s, "toast_tuple_target = 128") {
+		t.Errorf("pgCompressionSql: unexpected lz4 statements:\n%s", s)
+	}
+	if stmts, _ = pgCompressionSql("tgres_", "pglz"); strings.Contains(strings.Join(stmts, ";\n"), "SET COMPRESSION") {
+		t.Errorf("pgCompressionSql: pglz should not need SET COMPRESSION: %v", stmts)
+	}
+	if _, err := pgCompressionSql("tgres_", "zstd"); err == nil {
+		t.Errorf("pgCompressionSql: expected an error for zstd")
+	}
+}
+
+func Test_pgTsRounds(t *testing.T) {
+	one := arrayUpdateChunks(map[int64]interface{}{1: 1.0, 2: 2.0})
+	two := arrayUpdateChunks(map[int64]interface{}{1: 1.0, 5: 5.0})
+	rounds := pgTsRounds([]*pgTsFlush{
+		{key: [3]int64{1, 0, 0}, chunks: two, vers: two},
+		{key: [3]int64{1, 0, 1}, chunks: one, vers: one},
+		{key: [3]int64{1, 0, 0}, chunks: one, vers: one}, // again, after both chunks above
+	})
+	if len(rounds) != 3 || len(rounds[0]) != 2 || len(rounds[1]) != 1 || len(rounds[2]) != 1 {
+		t.Fatalf("pgTsRounds: unexpected %v", rounds)
+	}
+	if r := rounds[1][0]; r.key != [3]int64{1, 0, 0} || r.chunk.begin != 5 {
+		t.Errorf("pgTsRounds: the second chunk should be in the second round: %v", r)
+	}
+	if r := rounds[2][0]; r.key != [3]int64{1, 0, 0} || r.chunk.end != 2 {
+		t.Errorf("pgTsRounds: the later flush should be in the third round: %v", r)
+	}
+
+	stmt := pgTsValuesSql("tgres_", 2)
+	if !strings.HasPrefix(stmt, "UPDATE tgres_ts AS ts SET dp[v.b:v.e] = v.dp, ver[v.b:v.e] = v.ver FROM (VALUES ($1::INT,") ||
+		!strings.Contains(stmt, "($8::INT,$9::INT,$10::INT,$11::INT,$12::INT,$13::DOUBLE PRECISION[],$14::SMALLINT[])) AS v") {
+		t.Errorf("pgTsValuesSql: unexpected %q", stmt)
+	}
+}
+
+func Test_pgvSerDe_reader(t *testing.T) {
+	p := &pgvSerDe{reads: []*pgReadPool{{name: "replica0"}, {name: "replica1"}}}
+	var names []string
+	for i := 0; i < 4; i++ {
+		names = append(names, p.reader().name)
+	}
+	if got := strings.Join(names, " "); got != "replica0 replica1 replica0 replica1" {
+		t.Errorf("reader: expected round-robin, got %s", got)
+	}
+}
+
+func Test_pgIsTable(t *testing.T) {
+	// "tgres_" tables seen with the "tg" prefix
+	for table, ok := range map[string]bool{"ts": true, "dsl_cache": true, "res_ts": false, "": false} {
+		if pgIsTable(table) != ok {
+			t.Errorf("pgIsTable(%q): expected %v", table, ok)
+		}
+	}
+}
+
+func Test_dbSeriesBatch(t *testing.T) {
+	rra, err := newDbRoundRobinArchive(1, 200, 1, 0, rrd.RRASpec{Function: rrd.WMEAN, Step: 10 * time.Second, Span: 100 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := time.Unix(1000, 0)
+	from := to.Add(-100 * time.Second)
+	a := &dbSeries{rra: rra, from: from, to: to}
+	b := &dbSeries{rra: rra, from: from, to: to}
+	c := &dbSeries{rra: rra, from: from, to: to}
+
+	batch := &dbSeriesBatch{}
+	for _, dps := range []*dbSeries{a, b, c} {
+		batch.add(dps)
+	}
+	c.TimeRange(from.Add(time.Minute), to)
+	if pending := batch.pending(); len(pending) != 2 || pending[0] != a || pending[1] != b {
+		t.Errorf("pending: expected a and b, got %v", pending)
+	}
+	if ms := a.finalGroupByMs(); ms != 10000 {
+		t.Errorf("finalGroupByMs: expected 10000, got %d", ms)
+	}
+
+	// As if loaded, a has points, b has none, c was not read
+	batch.loaded = true
+	batch.data = map[*dbSeries][]dbPoint{a: {{to.Add(-10 * time.Second), 1}, {to, math.NaN()}}, b: nil}
+	for _, dps := range []*dbSeries{a, b, c} {
+		dps.bufGroup = 10 * time.Second
+	}
+
+	var n int
+	for a.Next() {
+		n++
+	}
+	if n != 2 || !a.CurrentTime().Equal(to) || !math.IsNaN(a.CurrentValue()) {
+		t.Errorf("a: expected 2 points ending at %v with a NaN, got %d: %v %v", to, n, a.CurrentTime(), a.CurrentValue())
+	}
+	if a.GroupBy() != 10*time.Second {
+		t.Errorf("a: expected the group by of the batch, got %v", a.GroupBy())
+	}
+	if err := a.Close(); err != nil || a.batch != nil {
+		t.Errorf("a.Close(): expected the batch to be dropped, got %v", err)
+	}
+	if b.Next() {
+		t.Errorf("b: expected no points")
+	}
+	if _, ok := batch.take(c); ok {
+		t.Errorf("take(c): expected c to need its own query")
+	}
+	// b changed after the batch was read
+	batch.data[b] = nil
+	b.MaxPoints(5)
+	if _, ok := batch.take(b); ok {
+		t.Errorf("take(b): expected b to need its own query after a change")
+	}
+}
@@ -0,0 +1,95 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The driver of a connect string naming none, see ParseConnectString.
+const DefaultDriver = "postgres"
+
+// A Factory opens (or creates) the database of a driver given the
+// connect string (without the driver name) and the prefix of the
+// names of the tables, keys or files, as the driver has them.
+type Factory func(connectString, prefix string) (DbSerDe, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a driver available by name to Open. The backends of
+// this package register themselves, others can do so in an init
+// function. As with database/sql, it panics if a driver is registered
+// twice or factory is nil.
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if factory == nil {
+		panic("serde: Register factory is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic("serde: Register called twice for driver " + name)
+	}
+	factories[name] = factory
+}
+
+// Drivers returns the names of the registered drivers, sorted.
+func Drivers() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open opens the database with the named driver, blank is the one
+// the connect string names, see ParseConnectString.
+func Open(driver, connectString, prefix string) (DbSerDe, error) {
+	if driver == "" {
+		driver, connectString = ParseConnectString(connectString)
+	}
+	factoriesMu.RLock()
+	factory, ok := factories[driver]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown serde driver %q (registered: %s)", driver, strings.Join(Drivers(), ", "))
+	}
+	return factory(connectString, prefix)
+}
+
+// ParseConnectString splits a "<driver>:<connect string>" connect
+// string, e.g. "sqlite:/var/lib/tgres.db", into the driver and the
+// rest. Any other, e.g. "host=/var/run/postgresql dbname=tgres" or a
+// "postgres://" URL, is of the DefaultDriver in its entirety.
+func ParseConnectString(s string) (driver, connectString string) {
+	if i := strings.Index(s, ":"); i > 0 && !strings.HasPrefix(s[i:], "://") {
+		factoriesMu.RLock()
+		_, ok := factories[s[:i]]
+		factoriesMu.RUnlock()
+		if ok {
+			return s[:i], s[i+1:]
+		}
+	}
+	return DefaultDriver, s
+}
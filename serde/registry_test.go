@@ -0,0 +1,73 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func Test_Registry(t *testing.T) {
+	names := strings.Join(Drivers(), " ")
+	if names != "bolt clickhouse file postgres sqlite" {
+		t.Errorf("Drivers: unexpected %q", names)
+	}
+
+	var got string
+	Register("test_registry", func(connectString, prefix string) (DbSerDe, error) {
+		got = connectString + " " + prefix
+		return nil, fmt.Errorf("test")
+	})
+	defer func() {
+		factoriesMu.Lock()
+		delete(factories, "test_registry")
+		factoriesMu.Unlock()
+	}()
+
+	if _, err := Open("", "test_registry:foo:bar", "p_"); err == nil || got != "foo:bar p_" {
+		t.Errorf("Open: unexpected %v %q", err, got)
+	}
+	if _, err := Open("test_registry", "test_registry:foo", "p_"); err == nil || got != "test_registry:foo p_" {
+		t.Errorf("Open: a driver should get the connect string as is: %v %q", err, got)
+	}
+	if _, err := Open("bogus", "", ""); err == nil || !strings.Contains(err.Error(), "test_registry") {
+		t.Errorf("Open: an unknown driver should be an error listing the known ones: %v", err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Register: a duplicate should panic")
+			}
+		}()
+		Register("test_registry", func(connectString, prefix string) (DbSerDe, error) { return nil, nil })
+	}()
+}
+
+func Test_ParseConnectString(t *testing.T) {
+	for _, c := range []struct{ s, driver, rest string }{
+		{"host=/tmp dbname=tgres", "postgres", "host=/tmp dbname=tgres"},
+		{"postgres://localhost/tgres", "postgres", "postgres://localhost/tgres"},
+		{"sqlite:/var/lib/tgres.db", "sqlite", "/var/lib/tgres.db"},
+		{"clickhouse:http://localhost:8123/", "clickhouse", "http://localhost:8123/"},
+		{"bogus:foo", "postgres", "bogus:foo"},
+	} {
+		if driver, rest := ParseConnectString(c.s); driver != c.driver || rest != c.rest {
+			t.Errorf("ParseConnectString(%q): expected %q %q, got %q %q", c.s, c.driver, c.rest, driver, rest)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A DataSourceMover can find DSs and rename them, see
+// RenameDataSources.
+type DataSourceMover interface {
+	DataSourceSelector
+	DataSourceRenamer
+}
+
+// A Rename is a DS renamed by RenameDataSources.
+type Rename struct {
+	Id   int64 `json:"id"`
+	From Ident `json:"from"`
+	To   Ident `json:"to"`
+}
+
+// RenameDataSources renames the DS named from to the name to or, if
+// both end in ".*", moves the subtree, i.e. every DS whose name
+// begins with the from prefix gets the to prefix instead, e.g.
+// "servers.old.*" to "servers.new.*". Only the name of an ident
+// changes, the other fields are kept, and so does the data. Nothing
+// is renamed if any of the new idents is taken. If dryRun is set,
+// the renames are only returned. On error the DSs renamed so far are
+// returned with it.
+func RenameDataSources(db DataSourceMover, from, to string, dryRun bool) ([]Rename, error) {
+	subtree := strings.HasSuffix(from, ".*")
+	if subtree != strings.HasSuffix(to, ".*") {
+		return nil, fmt.Errorf("RenameDataSources(): either both or neither of %q and %q must end in .*", from, to)
+	}
+	from, to = strings.TrimSuffix(from, "*"), strings.TrimSuffix(to, "*")
+	if from == "" || to == "" || strings.ContainsAny(from+to, "*?[]{}") {
+		return nil, fmt.Errorf("RenameDataSources(): invalid name %q or %q", from, to)
+	}
+	if from == to {
+		return nil, nil
+	}
+
+	re := "^" + regexp.QuoteMeta(from)
+	if !subtree {
+		re += "$"
+	}
+	idents, err := searchIdents(db, SearchQuery{"name": re})
+	if err != nil {
+		return nil, err
+	}
+	var renames []Rename
+	for _, ident := range idents {
+		name := ident["name"]
+		if (subtree && !strings.HasPrefix(name, from)) || (!subtree && name != from) {
+			continue // the search is case-insensitive
+		}
+		ds, err := db.FetchOrCreateDataSource(ident, nil)
+		if err != nil {
+			return nil, fmt.Errorf("RenameDataSources(): fetching %v: %v", ident, err)
+		}
+		dbds, ok := ds.(DbDataSourcer)
+		if !ok || dbds == nil {
+			continue
+		}
+		newIdent := make(Ident, len(ident))
+		for k, v := range ident {
+			newIdent[k] = v
+		}
+		newIdent["name"] = to + strings.TrimPrefix(name, from)
+		if taken, err := db.FetchOrCreateDataSource(newIdent, nil); err != nil || taken != nil {
+			if err == nil {
+				err = fmt.Errorf("%v exists", newIdent)
+			}
+			return nil, fmt.Errorf("RenameDataSources(): renaming %v: %v", ident, err)
+		}
+		renames = append(renames, Rename{Id: dbds.Id(), From: ident, To: newIdent})
+	}
+
+	if dryRun {
+		return renames, nil
+	}
+	for n, r := range renames {
+		if err := db.RenameDataSource(r.Id, r.To); err != nil {
+			return renames[:n], fmt.Errorf("RenameDataSources(): renaming %v: %v", r.From, err)
+		}
+	}
+	return renames, nil
+}
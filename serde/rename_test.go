@@ -0,0 +1,100 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_RenameDataSources(t *testing.T) {
+	kv := &memKV{m: make(map[string][]byte)}
+	p := InitKVDb(kv, "tgres_")
+	spec := &rrd.DSSpec{Step: time.Second, Heartbeat: time.Minute, RRAs: []rrd.RRASpec{
+		{Function: rrd.WMEAN, Step: time.Second, Span: 10 * time.Second},
+	}}
+	for _, ident := range []Ident{{"name": "servers.old.cpu", "dc": "east"}, {"name": "servers.old.mem"}, {"name": "servers.older"}, {"name": "taken"}} {
+		if _, err := p.FetchOrCreateDataSource(ident, spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := RenameDataSources(p, "servers.old.*", "servers.new", false); err == nil {
+		t.Errorf("RenameDataSources: expected an error for a subtree renamed to a name")
+	}
+	renames, err := RenameDataSources(p, "servers.old.*", "servers.new.*", true)
+	if err != nil || len(renames) != 2 {
+		t.Fatalf("RenameDataSources: (dry run) expected 2, got %v %v", renames, err)
+	}
+	if ds, _ := p.FetchOrCreateDataSource(Ident{"name": "servers.old.mem"}, nil); ds == nil {
+		t.Errorf("RenameDataSources: renamed on a dry run")
+	}
+	if renames, err = RenameDataSources(p, "servers.old.*", "servers.new.*", false); err != nil || len(renames) != 2 {
+		t.Fatalf("RenameDataSources: expected 2, got %v %v", renames, err)
+	}
+	ds, _ := p.FetchOrCreateDataSource(Ident{"name": "servers.new.cpu", "dc": "east"}, nil)
+	if ds == nil || ds.(*DbDataSource).Id() != 1 {
+		t.Errorf("RenameDataSources: expected servers.new.cpu to be DS 1, got %v", ds)
+	}
+	if ds, _ := p.FetchOrCreateDataSource(Ident{"name": "servers.old.mem"}, nil); ds != nil {
+		t.Errorf("RenameDataSources: servers.old.mem can still be fetched")
+	}
+
+	if _, err := RenameDataSources(p, "servers.older", "taken", false); err == nil {
+		t.Errorf("RenameDataSources: expected an error for a taken name")
+	}
+	if ds, _ := p.FetchOrCreateDataSource(Ident{"name": "servers.older"}, nil); ds == nil {
+		t.Errorf("RenameDataSources: renamed to a taken name")
+	}
+}
+
+func Test_fileSerDe_RenameDataSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := InitFileDb(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &rrd.DSSpec{Step: time.Second, Heartbeat: time.Minute, RRAs: []rrd.RRASpec{
+		{Function: rrd.WMEAN, Step: time.Second, Span: 10 * time.Second},
+	}}
+	ds, err := p.FetchOrCreateDataSource(Ident{"name": "foo.bar"}, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RenameDataSource(ds.(*DbDataSource).Id(), Ident{"name": "baz.bar"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(p.filePath(Ident{"name": "foo.bar"})); !os.IsNotExist(err) {
+		t.Errorf("RenameDataSource: expected the old file to be removed, got %v", err)
+	}
+
+	// The new file has the new ident
+	if p, err = InitFileDb(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	if ds, _ := p.FetchOrCreateDataSource(Ident{"name": "baz.bar"}, nil); ds == nil || ds.(*DbDataSource).Id() != 1 {
+		t.Errorf("RenameDataSource: expected baz.bar to be DS 1, got %v", ds)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"regexp"
 	"sort"
 	"time"
 
@@ -41,8 +42,60 @@ type SearchResult interface {
 	Ident() Ident
 }
 
+// A SearchResult which also knows whether the DS is archived.
+type ArchivedSearchResult interface {
+	SearchResult
+	Archived() bool
+}
+
 type SearchQuery map[string]string
 
+// matcher returns a function reporting whether an ident has all the
+// keys in the query with values matching its regular expressions
+// (case-insensitive, as in PostgreSQL), for the serdes which search
+// their idents themselves.
+func (q SearchQuery) matcher() (func(Ident) bool, error) {
+	res := make(map[string]*regexp.Regexp, len(q))
+	for k, v := range q {
+		re, err := regexp.Compile("(?i)" + v)
+		if err != nil {
+			return nil, fmt.Errorf("Search(): invalid regular expression for %q: %v", k, err)
+		}
+		res[k] = re
+	}
+	return func(ident Ident) bool {
+		for k, re := range res {
+			if v, ok := ident[k]; !ok || !re.MatchString(v) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// identSearchResult is an ArchivedSearchResult of idents already
+// found.
+type identSearchResult struct {
+	idents   []Ident
+	archived []bool
+	pos      int
+}
+
+func newIdentSearchResult() *identSearchResult { return &identSearchResult{pos: -1} }
+
+func (sr *identSearchResult) add(ident Ident, archived bool) {
+	sr.idents, sr.archived = append(sr.idents, ident), append(sr.archived, archived)
+}
+
+func (sr *identSearchResult) Next() bool {
+	sr.pos++
+	return sr.pos < len(sr.idents)
+}
+
+func (sr *identSearchResult) Ident() Ident   { return sr.idents[sr.pos] }
+func (sr *identSearchResult) Archived() bool { return sr.archived[sr.pos] }
+func (sr *identSearchResult) Close() error   { return nil }
+
 type DataSourceSearcher interface {
 	// Return a list od DS ids based on the query. How the query works
 	// is up to the serde, it can even ignore the argumen, but the
@@ -54,7 +107,8 @@ type DataSourceSearcher interface {
 
 type Fetcher interface {
 	DataSourceSearcher
-	// Fetch all the data sources (used to populate the cache on start)
+	// Fetch all the data sources which are not archived (used to
+	// populate the cache on start)
 	FetchDataSources() ([]rrd.DataSourcer, error)
 	// Fetch or create a single DS. Passing a nil dsSpec disables creation.
 	FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error)
@@ -66,16 +120,126 @@ type Fetcher interface {
 	FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error)
 }
 
+// A SeriesFetcher is the part of a Fetcher presenting the DSs as
+// series.
+type SeriesFetcher interface {
+	FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error)
+}
+
+// A SeriesBatchFetcher can present many DSs as series at once, so
+// that the data of all of them is read in a single query rather than
+// a query per series, which matters for wildcards spanning hundreds
+// of series. The series are returned in the order of dss.
+type SeriesBatchFetcher interface {
+	FetchSeriesBatch(dss []rrd.DataSourcer, from, to time.Time, maxPoints int64) ([]series.Series, error)
+}
+
+// FetchSeriesBatch presents the DSs as series with a single
+// FetchSeriesBatch if db is a SeriesBatchFetcher, or with a
+// FetchSeries per DS otherwise.
+func FetchSeriesBatch(db SeriesFetcher, dss []rrd.DataSourcer, from, to time.Time, maxPoints int64) ([]series.Series, error) {
+	if bf, ok := db.(SeriesBatchFetcher); ok {
+		return bf.FetchSeriesBatch(dss, from, to, maxPoints)
+	}
+	result := make([]series.Series, 0, len(dss))
+	for _, ds := range dss {
+		s, err := db.FetchSeries(ds, from, to, maxPoints)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// A DataSourceArchiver can mark a DS as archived, i.e. no longer
+// receiving data. Archived DSs are not loaded on start and are left
+// out of wildcard expansion.
+type DataSourceArchiver interface {
+	ArchiveDataSource(id int64) error
+}
+
+// A DataSourceDeleter can delete a DS, along with its RRAs and data
+// points, see also DeleteDataSources.
+type DataSourceDeleter interface {
+	DeleteDataSource(id int64) error
+}
+
+// A DataSourceRenamer can change the ident of a DS, keeping its
+// data, see also RenameDataSources.
+type DataSourceRenamer interface {
+	RenameDataSource(id int64, ident Ident) error
+}
+
+// DataSourcePurger can find the DSs not updated in a long time and
+// delete them.
+type DataSourcePurger interface {
+	DataSourceDeleter
+	FetchStaleDataSources(before time.Time) ([]StaleDataSource, error)
+}
+
+// StaleDataSource is a DS last updated (or, if never, created) at
+// LastUpdate.
+type StaleDataSource struct {
+	Id         int64
+	Ident      Ident
+	LastUpdate time.Time
+}
+
+// A LivenessFetcher can find the DSs by when they were last updated,
+// e.g. those which stopped receiving data in the last hour.
+type LivenessFetcher interface {
+	FetchDataSourcesByLastUpdate(q LivenessQuery) ([]StaleDataSource, error)
+}
+
+// LivenessQuery selects the DSs last updated (or, if never, created)
+// after After and before Before, either zero is unbounded, least
+// recently updated first and at most Limit of them (0 is no limit).
+// Archived DSs are left out unless Archived.
+type LivenessQuery struct {
+	After, Before time.Time
+	Limit         int
+	Archived      bool
+}
+
 type EventListener interface {
 	RegisterDeleteListener(func(Ident)) error
 }
 
+// A RenameEventListener also calls a function with the old ident of
+// every DS renamed, by this or any other client of the database.
+type RenameEventListener interface {
+	RegisterRenameListener(func(Ident)) error
+}
+
+// A CreateEventListener also calls a function with the ident of every
+// DS created, by this or any other client of the database, so that
+// e.g. the name index need not be reloaded to learn about it.
+type CreateEventListener interface {
+	RegisterCreateListener(func(Ident)) error
+}
+
 type Flusher interface {
 	FlushDataPoints(bunlde_id, seg, i int64, dps, vers map[int64]interface{}) (int, error)
-	FlushDSStates(seg int64, lastupdate, value, duration map[int64]interface{}) (int, error)
+	FlushDSStates(seg int64, lastupdate, value, duration, lastRaw map[int64]interface{}) (int, error)
 	FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (int, error)
 }
 
+// A BatchFlusher can group several flushes into a single database
+// transaction, which saves a commit (and a round trip) per flush.
+type BatchFlusher interface {
+	Flusher
+	BeginFlushBatch() (FlushBatch, error)
+}
+
+// FlushBatch is a Flusher whose flushes are not committed until Commit()
+// is called. After an error, the batch must be rolled back.
+type FlushBatch interface {
+	Flusher
+	Commit() error
+	Rollback() error
+}
+
 type SerDe interface {
 	Fetcher() Fetcher
 	Flusher() Flusher
@@ -92,6 +256,26 @@ type DbSerDe interface {
 	DbAddresser() DbAddresser
 }
 
+// Maintainer is a serde which needs housekeeping now and then, e.g.
+// to prune rows nothing refers to anymore.
+type Maintainer interface {
+	Maintain() (*MaintenanceReport, error)
+}
+
+// MaintenanceReport is the result of Maintain: the rows pruned and
+// the statistics of the tables, both by table (without the prefix).
+type MaintenanceReport struct {
+	Pruned map[string]int64
+	Tables map[string]TableStats
+}
+
+// TableStats are the size on disk of a table and of its indexes and
+// its live and dead (not yet vacuumed) rows.
+type TableStats struct {
+	Bytes, IndexBytes  int64
+	LiveRows, DeadRows int64
+}
+
 type Ident map[string]string
 
 func (it Ident) String() string {
@@ -16,9 +16,67 @@
 package serde
 
 import (
+	"fmt"
 	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/series"
 )
 
 func Test_TODO(t *testing.T) {
 
 }
+
+type fakeSeriesFetcher struct {
+	calls int
+}
+
+func (f *fakeSeriesFetcher) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	f.calls++
+	if ds == nil {
+		return nil, fmt.Errorf("nil ds")
+	}
+	return series.NewRRASeries(ds.RRAs()[0]), nil
+}
+
+type fakeSeriesBatchFetcher struct {
+	fakeSeriesFetcher
+	batches int
+}
+
+func (f *fakeSeriesBatchFetcher) FetchSeriesBatch(dss []rrd.DataSourcer, from, to time.Time, maxPoints int64) ([]series.Series, error) {
+	f.batches++
+	return make([]series.Series, len(dss)), nil
+}
+
+func Test_FetchSeriesBatch(t *testing.T) {
+	spec := &rrd.DSSpec{
+		Step: 10 * time.Second,
+		RRAs: []rrd.RRASpec{{Function: rrd.WMEAN, Step: 10 * time.Second, Span: 100 * time.Second}},
+	}
+	dss := []rrd.DataSourcer{rrd.NewDataSource(*spec), rrd.NewDataSource(*spec)}
+
+	// Not a batch fetcher, a FetchSeries per DS
+	f := &fakeSeriesFetcher{}
+	sers, err := FetchSeriesBatch(f, dss, time.Time{}, time.Time{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sers) != 2 || f.calls != 2 {
+		t.Errorf("FetchSeriesBatch: expected 2 series of 2 calls, got %d of %d", len(sers), f.calls)
+	}
+	if _, err := FetchSeriesBatch(f, []rrd.DataSourcer{nil}, time.Time{}, time.Time{}, 0); err == nil {
+		t.Errorf("FetchSeriesBatch: expected an error")
+	}
+
+	// A batch fetcher, one call
+	bf := &fakeSeriesBatchFetcher{}
+	sers, err = FetchSeriesBatch(bf, dss, time.Time{}, time.Time{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sers) != 2 || bf.batches != 1 || bf.calls != 0 {
+		t.Errorf("FetchSeriesBatch: expected 1 batch and no calls, got %d and %d", bf.batches, bf.calls)
+	}
+}
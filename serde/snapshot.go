@@ -0,0 +1,41 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"time"
+)
+
+// A SnapshotMarker is the point in the history of the database a
+// snapshot is consistent as of, see Receiver.Snapshot.
+type SnapshotMarker struct {
+	Time time.Time `json:"time"`
+	LSN  string    `json:"lsn,omitempty"` // the PostgreSQL WAL location
+}
+
+func (m *SnapshotMarker) String() string {
+	if m.LSN == "" {
+		return m.Time.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprintf("%s (LSN %s)", m.Time.Format(time.RFC3339Nano), m.LSN)
+}
+
+// A Snapshotter can tell where in its history the database is, while
+// the writes are quiesced for a snapshot.
+type Snapshotter interface {
+	SnapshotMarker() (*SnapshotMarker, error)
+}
@@ -0,0 +1,816 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//
+// A SQLite implementation, for small single-node installs, tests and
+// edge deployments without a PostgreSQL server.
+//
+
+// The data layout is that of the PostgreSQL implementation (DSs and
+// RRAs are positions in segments of PgSegmentWidth, data points are
+// versioned by slot), except that SQLite has no arrays, so a state or
+// ts row is that of a single DS or RRA (slot). Times are stored as
+// Unix nanoseconds, NULL being the zero time, and NULL is also NaN,
+// which is what SQLite stores NaN as anyway.
+//
+// The driver is not linked in by default, see sqlite_driver.go.
+
+package serde
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/series"
+)
+
+// SqliteDriver is the database/sql driver name InitSqliteDb uses.
+var SqliteDriver = "sqlite3"
+
+type sqliteSerDe struct {
+	db     *sql.DB
+	prefix string
+}
+
+func init() {
+	Register("sqlite", func(path, prefix string) (DbSerDe, error) {
+		db, err := InitSqliteDb(path, prefix)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	})
+}
+
+// InitSqliteDb opens (and creates, if needed) the SQLite database in
+// the file path, or an in-memory one if path is ":memory:". There is
+// a single connection, since SQLite has one writer at a time anyway
+// and an in-memory database is per connection.
+func InitSqliteDb(path, prefix string) (*sqliteSerDe, error) {
+	db, err := sql.Open(SqliteDriver, path)
+	if err != nil {
+		return nil, fmt.Errorf("InitSqliteDb(): %v (SQLite support requires building with -tags sqlite)", err)
+	}
+	db.SetMaxOpenConns(1)
+	p := &sqliteSerDe{db: db, prefix: prefix}
+	if err := p.db.Ping(); err != nil {
+		return nil, err
+	}
+	if err := p.createTablesIfNotExist(); err != nil {
+		return nil, fmt.Errorf("createTablesIfNotExist: %v", err)
+	}
+	return p, nil
+}
+
+func (p *sqliteSerDe) Fetcher() Fetcher             { return p }
+func (p *sqliteSerDe) Flusher() Flusher             { return p }
+func (p *sqliteSerDe) EventListener() EventListener { return p }
+func (p *sqliteSerDe) DbAddresser() DbAddresser     { return p }
+
+// There are no other clients to infer addresses from, SQLite is
+// single-node.
+func (p *sqliteSerDe) ListDbClientIps() ([]string, error) { return nil, nil }
+func (p *sqliteSerDe) MyDbAddr() (*string, error)         { return nil, nil }
+
+func (p *sqliteSerDe) createTablesIfNotExist() error {
+	for _, stmt := range []string{`
+       CREATE TABLE IF NOT EXISTS %[1]sds (
+       id INTEGER PRIMARY KEY AUTOINCREMENT,
+       ident TEXT NOT NULL UNIQUE CHECK (ident <> '{}'),
+       step_ms INTEGER NOT NULL,
+       heartbeat_ms INTEGER NOT NULL,
+       seg INTEGER NOT NULL DEFAULT 0,
+       idx INTEGER NOT NULL DEFAULT 0,
+       created_at INTEGER NOT NULL,
+       ds_type TEXT NOT NULL DEFAULT 'GAUGE',
+       archived INTEGER NOT NULL DEFAULT 0,
+       metadata TEXT NOT NULL DEFAULT '{}')`, `
+       CREATE TABLE IF NOT EXISTS %[1]sds_state (
+       seg INTEGER NOT NULL,
+       idx INTEGER NOT NULL,
+       lastupdate INTEGER,
+       duration_ms INTEGER NOT NULL DEFAULT 0,
+       value REAL,
+       last_raw REAL,
+       PRIMARY KEY (seg, idx))`, `
+       CREATE TABLE IF NOT EXISTS %[1]srra_bundle (
+       id INTEGER PRIMARY KEY AUTOINCREMENT,
+       step_ms INTEGER NOT NULL,
+       size INTEGER NOT NULL,
+       last_pos INTEGER NOT NULL DEFAULT 0,
+       width INTEGER NOT NULL DEFAULT %[2]d,
+       UNIQUE (step_ms, size))`, `
+       CREATE TABLE IF NOT EXISTS %[1]srra_state (
+       rra_bundle_id INTEGER NOT NULL REFERENCES %[1]srra_bundle(id) ON DELETE CASCADE,
+       seg INTEGER NOT NULL,
+       idx INTEGER NOT NULL,
+       latest INTEGER,
+       duration_ms INTEGER NOT NULL DEFAULT 0,
+       value REAL,
+       PRIMARY KEY (rra_bundle_id, seg, idx))`, `
+       CREATE TABLE IF NOT EXISTS %[1]srra (
+       id INTEGER PRIMARY KEY AUTOINCREMENT,
+       ds_id INTEGER NOT NULL REFERENCES %[1]sds(id) ON DELETE CASCADE,
+       rra_bundle_id INTEGER NOT NULL REFERENCES %[1]srra_bundle(id) ON DELETE RESTRICT,
+       cf TEXT NOT NULL,
+       pos INTEGER NOT NULL,
+       seg INTEGER NOT NULL,
+       idx INTEGER NOT NULL,
+       xff REAL NOT NULL DEFAULT 0,
+       UNIQUE (ds_id, rra_bundle_id, cf))`, `
+       CREATE INDEX IF NOT EXISTS %[1]sidx_rra_ds_id ON %[1]srra (ds_id)`, `
+       CREATE TABLE IF NOT EXISTS %[1]sts (
+       rra_bundle_id INTEGER NOT NULL REFERENCES %[1]srra_bundle(id) ON DELETE CASCADE,
+       seg INTEGER NOT NULL,
+       idx INTEGER NOT NULL,
+       i INTEGER NOT NULL,
+       dp REAL,
+       ver INTEGER NOT NULL,
+       PRIMARY KEY (rra_bundle_id, seg, idx, i)) WITHOUT ROWID`, `
+       CREATE TABLE IF NOT EXISTS %[1]sdsl_cache (
+       ident TEXT NOT NULL)`,
+	} {
+		if _, err := p.db.Exec(fmt.Sprintf(stmt, p.prefix, PgSegmentWidth)); err != nil {
+			log.Printf("ERROR: initial CREATE TABLE failed: %v", err)
+			return err
+		}
+	}
+
+	// Columns added later
+	var n int
+	if err := p.db.QueryRow(fmt.Sprintf("SELECT COUNT(1) FROM pragma_table_info('%[1]sds') WHERE name = 'metadata'", p.prefix)).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		if _, err := p.db.Exec(fmt.Sprintf("ALTER TABLE %[1]sds ADD COLUMN metadata TEXT NOT NULL DEFAULT '{}'", p.prefix)); err != nil {
+			log.Printf("ERROR: metadata migrate failed: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteValue converts a value for storing, see the layout notes
+// above.
+func sqliteValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Time:
+		if v.IsZero() {
+			return nil
+		}
+		return v.UnixNano()
+	case float64:
+		if math.IsNaN(v) {
+			return nil
+		}
+	}
+	return v
+}
+
+func sqliteTime(ns sql.NullInt64) *time.Time {
+	t := time.Time{}
+	if ns.Valid {
+		t = time.Unix(0, ns.Int64)
+	}
+	return &t
+}
+
+func sqliteFloat(f sql.NullFloat64) *float64 {
+	v := math.NaN()
+	if f.Valid {
+		v = f.Float64
+	}
+	return &v
+}
+
+type sqliteScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// The DS columns sqliteDsRecord scans, the ds table is ds, its state
+// dss.
+const sqliteDsColumns = "ds.id, ds.ident, ds.step_ms, ds.heartbeat_ms, ds.seg, ds.idx, ds.ds_type, ds.archived, " +
+	"dss.lastupdate, dss.value, dss.duration_ms, dss.last_raw"
+
+func sqliteDsRecord(row sqliteScanner) (*dsRecord, bool, error) {
+	var (
+		dsr      dsRecord
+		archived bool
+		lu, dur  sql.NullInt64
+		val, lr  sql.NullFloat64
+	)
+	if err := row.Scan(&dsr.id, &dsr.identJson, &dsr.stepMs, &dsr.hbMs, &dsr.seg, &dsr.idx, &dsr.dsType, &archived,
+		&lu, &val, &dur, &lr); err != nil {
+		return nil, false, err
+	}
+	dsr.lastupdate, dsr.value, dsr.lastRaw = sqliteTime(lu), sqliteFloat(val), sqliteFloat(lr)
+	dsr.durationMs = &dur.Int64
+	return &dsr, archived, nil
+}
+
+// The RRA columns sqliteRRA scans, the rra table is rra, its bundle b
+// and state rs.
+const sqliteRRAColumns = "rra.id, rra.ds_id, rra.rra_bundle_id, rra.pos, rra.seg, rra.idx, rra.cf, rra.xff, " +
+	"b.step_ms, b.size, b.width, rs.latest, rs.value, rs.duration_ms"
+
+func sqliteRRA(row sqliteScanner) (*DbRoundRobinArchive, int64, error) {
+	var (
+		rrar     rraRecord
+		bundle   rraBundleRecord
+		lat, dur sql.NullInt64
+		val      sql.NullFloat64
+	)
+	if err := row.Scan(&rrar.id, &rrar.dsId, &rrar.bundleId, &rrar.pos, &rrar.seg, &rrar.idx, &rrar.cf, &rrar.xff,
+		&bundle.stepMs, &bundle.size, &bundle.width, &lat, &val, &dur); err != nil {
+		return nil, 0, err
+	}
+	bundle.id = rrar.bundleId
+	state := &rraStateRecord{latest: sqliteTime(lat), value: sqliteFloat(val), durationMs: &dur.Int64}
+	rra, err := rraFromRRARecordStateAndBundle(&rrar, state, &bundle)
+	return rra, rrar.dsId, err
+}
+
+// sqliteRRAs returns the RRAs of the DSs matching where, by DS id. All
+// rows are read before returning, there is only one connection.
+func (p *sqliteSerDe) sqliteRRAs(where string, args ...interface{}) (map[int64][]rrd.RoundRobinArchiver, error) {
+	rows, err := p.db.Query(fmt.Sprintf("SELECT "+sqliteRRAColumns+" FROM %[1]srra rra "+
+		"JOIN %[1]srra_bundle b ON b.id = rra.rra_bundle_id "+
+		"LEFT OUTER JOIN %[1]srra_state rs ON rs.rra_bundle_id = rra.rra_bundle_id AND rs.seg = rra.seg AND rs.idx = rra.idx "+
+		"JOIN %[1]sds ds ON ds.id = rra.ds_id WHERE "+where+" ORDER BY rra.id", p.prefix), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[int64][]rrd.RoundRobinArchiver)
+	for rows.Next() {
+		rra, dsId, err := sqliteRRA(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning: %v", err)
+		}
+		result[dsId] = append(result[dsId], rra)
+	}
+	return result, rows.Err()
+}
+
+func (p *sqliteSerDe) FetchDataSources() ([]rrd.DataSourcer, error) {
+	rows, err := p.db.Query(fmt.Sprintf("SELECT "+sqliteDsColumns+" FROM %[1]sds ds "+
+		"LEFT OUTER JOIN %[1]sds_state dss ON dss.seg = ds.seg AND dss.idx = ds.idx "+
+		"WHERE NOT ds.archived ORDER BY ds.id", p.prefix))
+	if err != nil {
+		log.Printf("FetchDataSources(): error querying database: %v", err)
+		return nil, err
+	}
+	var dsrs []*dsRecord
+	for rows.Next() {
+		dsr, _, err := sqliteDsRecord(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning: %v", err)
+		}
+		dsrs = append(dsrs, dsr)
+	}
+	rows.Close()
+
+	rras, err := p.sqliteRRAs("NOT ds.archived")
+	if err != nil {
+		log.Printf("FetchDataSources(): error fetching RRAs: %v", err)
+		return nil, err
+	}
+
+	result := make([]rrd.DataSourcer, 0, len(dsrs))
+	for _, dsr := range dsrs {
+		if len(rras[dsr.id]) == 0 {
+			continue // as in PostgreSQL, a DS without RRAs is not loaded
+		}
+		ds, err := dataSourceFromDsRec(dsr)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning: %v", err)
+		}
+		ds.SetRRAs(rras[dsr.id])
+		result = append(result, ds)
+	}
+	return result, nil
+}
+
+// fetchDataSource returns the DS with this ident and whether it is
+// archived, or nil if there is none.
+func (p *sqliteSerDe) fetchDataSource(ident Ident) (*DbDataSource, bool, error) {
+	row := p.db.QueryRow(fmt.Sprintf("SELECT "+sqliteDsColumns+" FROM %[1]sds ds "+
+		"LEFT OUTER JOIN %[1]sds_state dss ON dss.seg = ds.seg AND dss.idx = ds.idx "+
+		"WHERE ds.ident = ?", p.prefix), ident.String())
+	dsr, archived, err := sqliteDsRecord(row)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		log.Printf("fetchDataSource(): error scanning DS: %v", err)
+		return nil, false, err
+	}
+	ds, err := dataSourceFromDsRec(dsr)
+	if err != nil {
+		return nil, false, err
+	}
+	rras, err := p.sqliteRRAs("ds.id = ?", ds.Id())
+	if err != nil {
+		log.Printf("fetchDataSource(): error fetching RRAs: %v", err)
+		return nil, false, err
+	}
+	ds.SetRRAs(rras[ds.Id()])
+	return ds, archived, nil
+}
+
+// ArchiveDataSource marks a DS as archived, as in PostgreSQL.
+func (p *sqliteSerDe) ArchiveDataSource(id int64) error {
+	if _, err := p.db.Exec(fmt.Sprintf("UPDATE %[1]sds SET archived = 1 WHERE id = ?", p.prefix), id); err != nil {
+		log.Printf("ArchiveDataSource(): error updating database: %v", err)
+		return err
+	}
+	return nil
+}
+
+// SetMetadata replaces the metadata of a DS.
+func (p *sqliteSerDe) SetMetadata(id int64, md DSMetadata) error {
+	b, _ := json.Marshal(md) // cannot fail
+	res, err := p.db.Exec(fmt.Sprintf("UPDATE %[1]sds SET metadata = ? WHERE id = ?", p.prefix), string(b), id)
+	if err != nil {
+		log.Printf("SetMetadata(): error updating database: %v", err)
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("SetMetadata(): no DS with id %d", id)
+	}
+	return nil
+}
+
+// LoadMetadata returns the metadata of the idents.
+func (p *sqliteSerDe) LoadMetadata(idents []Ident) (map[string]DSMetadata, error) {
+	result := make(map[string]DSMetadata)
+	stmt := fmt.Sprintf("SELECT metadata FROM %[1]sds WHERE ident = ? AND metadata <> '{}'", p.prefix)
+	for _, ident := range idents {
+		var b string
+		if err := p.db.QueryRow(stmt, ident.String()).Scan(&b); err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			log.Printf("LoadMetadata(): error querying database: %v", err)
+			return nil, err
+		}
+		var md DSMetadata
+		if err := json.Unmarshal([]byte(b), &md); err != nil {
+			log.Printf("LoadMetadata(): error unmarshalling metadata %q: %v", b, err)
+			continue
+		}
+		result[ident.String()] = md
+	}
+	return result, nil
+}
+
+// RenameDataSource changes the ident of a DS. It is an error if the
+// ident is taken.
+func (p *sqliteSerDe) RenameDataSource(id int64, ident Ident) error {
+	res, err := p.db.Exec(fmt.Sprintf("UPDATE %[1]sds SET ident = ? WHERE id = ?", p.prefix), ident.String(), id)
+	if err != nil {
+		log.Printf("RenameDataSource(): error updating database: %v", err)
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("RenameDataSource(): no DS with id %d", id)
+	}
+	return nil
+}
+
+// DeleteDataSource deletes a DS along with its state, RRAs and data
+// points in a transaction.
+func (p *sqliteSerDe) DeleteDataSource(id int64) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // a noop after Commit
+
+	for _, stmt := range []string{
+		`DELETE FROM %[1]sts WHERE EXISTS (SELECT 1 FROM %[1]srra rra WHERE rra.ds_id = ?
+           AND rra.rra_bundle_id = %[1]sts.rra_bundle_id AND rra.seg = %[1]sts.seg AND rra.idx = %[1]sts.idx)`,
+		`DELETE FROM %[1]srra_state WHERE EXISTS (SELECT 1 FROM %[1]srra rra WHERE rra.ds_id = ?
+           AND rra.rra_bundle_id = %[1]srra_state.rra_bundle_id AND rra.seg = %[1]srra_state.seg AND rra.idx = %[1]srra_state.idx)`,
+		`DELETE FROM %[1]srra WHERE ds_id = ?`,
+		`DELETE FROM %[1]sds_state WHERE EXISTS (SELECT 1 FROM %[1]sds ds WHERE ds.id = ?
+           AND ds.seg = %[1]sds_state.seg AND ds.idx = %[1]sds_state.idx)`,
+		`DELETE FROM %[1]sds WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(fmt.Sprintf(stmt, p.prefix), id); err != nil {
+			log.Printf("DeleteDataSource(): error deleting: %v", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// FetchOrCreateDataSource loads or creates a DS, in the latter case
+// along with its state and RRAs in a single transaction. The returned
+// DS contains no data (use FetchSeries). A nil dsSpec means fetch
+// only, do not create.
+func (p *sqliteSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	ds, archived, err := p.fetchDataSource(ident)
+	if err != nil {
+		return nil, err
+	}
+	if ds != nil {
+		if dsSpec != nil && archived { // see pgvSerDe.FetchOrCreateDataSource
+			if _, err := p.db.Exec(fmt.Sprintf("UPDATE %[1]sds SET archived = 0 WHERE id = ?", p.prefix), ds.Id()); err != nil {
+				log.Printf("FetchOrCreateDataSource(): error unarchiving DS: %v", err)
+				return nil, err
+			}
+		}
+		return ds, nil
+	}
+	if dsSpec == nil {
+		return nil, nil
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if ds, err = p.createDataSource(tx, ident, dsSpec); err != nil {
+		log.Printf("FetchOrCreateDataSource(): error creating DS: %v", err)
+		tx.Rollback()
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	if ds == nil { // lost a race, someone else created it
+		return p.FetchOrCreateDataSource(ident, dsSpec)
+	}
+	return ds, nil
+}
+
+func (p *sqliteSerDe) createDataSource(tx *sql.Tx, ident Ident, dsSpec *rrd.DSSpec) (*DbDataSource, error) {
+	res, err := tx.Exec(fmt.Sprintf("INSERT OR IGNORE INTO %[1]sds (ident, step_ms, heartbeat_ms, ds_type, created_at) VALUES (?, ?, ?, ?, ?)", p.prefix),
+		ident.String(), dsSpec.Step.Nanoseconds()/1e6, dsSpec.Heartbeat.Nanoseconds()/1e6, dsSpec.Type.String(), time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, nil
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	seg, idx := segIdxFromPosWidth(id, int64(PgSegmentWidth)) // like the PostgreSQL defaults
+	if _, err = tx.Exec(fmt.Sprintf("UPDATE %[1]sds SET seg = ?, idx = ? WHERE id = ?", p.prefix), seg, idx, id); err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec(fmt.Sprintf("INSERT OR IGNORE INTO %[1]sds_state (seg, idx) VALUES (?, ?)", p.prefix), seg, idx); err != nil {
+		return nil, err
+	}
+
+	ds, err := dataSourceFromDsRec(&dsRecord{id: id, identJson: []byte(ident.String()), stepMs: dsSpec.Step.Nanoseconds() / 1e6,
+		hbMs: dsSpec.Heartbeat.Nanoseconds() / 1e6, seg: seg, idx: idx, created: true, dsType: dsSpec.Type.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	var rras []rrd.RoundRobinArchiver
+	for _, rraSpec := range dsSpec.RRAs {
+		stepMs := rraSpec.Step.Nanoseconds() / 1e6
+		size := rraSpec.Span.Nanoseconds() / rraSpec.Step.Nanoseconds()
+
+		if _, err = tx.Exec(fmt.Sprintf("INSERT OR IGNORE INTO %[1]srra_bundle (step_ms, size) VALUES (?, ?)", p.prefix), stepMs, size); err != nil {
+			return nil, err
+		}
+		if _, err = tx.Exec(fmt.Sprintf("UPDATE %[1]srra_bundle SET last_pos = last_pos + 1 WHERE step_ms = ? AND size = ?", p.prefix), stepMs, size); err != nil {
+			return nil, err
+		}
+		bundle := &rraBundleRecord{stepMs: stepMs, size: size}
+		var pos int64
+		if err = tx.QueryRow(fmt.Sprintf("SELECT id, width, last_pos FROM %[1]srra_bundle WHERE step_ms = ? AND size = ?", p.prefix),
+			stepMs, size).Scan(&bundle.id, &bundle.width, &pos); err != nil {
+			return nil, err
+		}
+
+		rraRec := &rraRecord{dsId: id, bundleId: bundle.id, pos: pos, cf: cfName(rraSpec.Function), xff: rraSpec.Xff}
+		rraRec.seg, rraRec.idx = segIdxFromPosWidth(pos, bundle.width)
+		res, err := tx.Exec(fmt.Sprintf("INSERT INTO %[1]srra (ds_id, rra_bundle_id, pos, seg, idx, cf, xff) VALUES (?, ?, ?, ?, ?, ?, ?)", p.prefix),
+			id, bundle.id, pos, rraRec.seg, rraRec.idx, rraRec.cf, rraSpec.Xff)
+		if err != nil {
+			return nil, err
+		}
+		if rraRec.id, err = res.LastInsertId(); err != nil {
+			return nil, err
+		}
+
+		dur := rraSpec.Duration.Nanoseconds() / 1e6
+		rra, err := rraFromRRARecordStateAndBundle(rraRec, &rraStateRecord{latest: &rraSpec.Latest, durationMs: &dur, value: &rraSpec.Value}, bundle)
+		if err != nil {
+			return nil, err
+		}
+		rras = append(rras, rra)
+	}
+	ds.SetRRAs(rras)
+	return ds, nil
+}
+
+// Search returns the idents matching the query, see
+// SearchQuery.matcher. There is no index to use, the matching is done
+// here.
+func (p *sqliteSerDe) Search(query SearchQuery) (SearchResult, error) {
+	match, err := query.matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := p.db.Query(fmt.Sprintf("SELECT ident, archived FROM %[1]sds", p.prefix))
+	if err != nil {
+		log.Printf("Search(): error querying database: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	sr := newIdentSearchResult()
+	for rows.Next() {
+		var (
+			b        []byte
+			archived bool
+			ident    Ident
+		)
+		if err := rows.Scan(&b, &archived); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &ident); err != nil {
+			log.Printf("Search(): error unmarshalling ident %q: %v", string(b), err)
+			continue
+		}
+		if match(ident) {
+			sr.add(ident, archived)
+		}
+	}
+	return sr, rows.Err()
+}
+
+// FetchSeries loads the data of the most suitable RRA and presents it
+// as a series, see rraDataSeries.
+func (p *sqliteSerDe) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	return rraDataSeries(ds, from, to, maxPoints, p.LoadRRAData)
+}
+
+// LoadRRAData returns a new RRA based on the one passed in and
+// containing all of its current data points, see
+// pgvSerDe.LoadRRAData.
+func (p *sqliteSerDe) LoadRRAData(rra rrd.RoundRobinArchiver) (rrd.RoundRobinArchiver, error) {
+	dbrra, ok := rra.(*DbRoundRobinArchive)
+	if !ok {
+		return nil, fmt.Errorf("LoadRRAData: Not a *DbRoundRobinArchive")
+	}
+
+	var dps map[int64]float64
+	if !rra.Latest().IsZero() {
+		latestI, latestVer, prevVer := slotVersions(dbrra)
+		rows, err := p.db.Query(fmt.Sprintf("SELECT i, dp FROM %[1]sts "+
+			"WHERE rra_bundle_id = ? AND seg = ? AND idx = ? AND dp IS NOT NULL "+
+			"AND ((i <= ? AND ver = ?) OR (i > ? AND ver = ?))", p.prefix),
+			dbrra.BundleId(), dbrra.Seg(), dbrra.Idx(), latestI, latestVer, latestI, prevVer)
+		if err != nil {
+			log.Printf("LoadRRAData: error %v", err)
+			return nil, err
+		}
+		defer rows.Close()
+		dps = make(map[int64]float64)
+		for rows.Next() {
+			var (
+				i  int64
+				dp float64
+			)
+			if err := rows.Scan(&i, &dp); err != nil {
+				log.Printf("LoadRRAData: error scanning %v", err)
+				return nil, err
+			}
+			dps[i] = dp
+		}
+	}
+
+	spec := dbrra.Spec()
+	spec.Latest = dbrra.Latest()
+	spec.Value = dbrra.Value()
+	spec.Duration = dbrra.Duration()
+	spec.DPs = dps
+	return newDbRoundRobinArchive(dbrra.id, dbrra.width, dbrra.bundleId, dbrra.pos, spec)
+}
+
+// TsTableSize returns the size of the whole database file and the
+// number of data points stored.
+func (p *sqliteSerDe) TsTableSize() (size, count int64, err error) {
+	var pages, pageSize int64
+	if err = p.db.QueryRow("PRAGMA page_count").Scan(&pages); err != nil {
+		return 0, 0, err
+	}
+	if err = p.db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, 0, err
+	}
+	if err = p.db.QueryRow(fmt.Sprintf("SELECT count(1) FROM %[1]sts", p.prefix)).Scan(&count); err != nil {
+		return 0, 0, err
+	}
+	return pages * pageSize, count, nil
+}
+
+// RegisterDeleteListener does nothing, SQLite has no notifications.
+// A DS deleted from the database stays in the cache until restart.
+func (p *sqliteSerDe) RegisterDeleteListener(func(Ident)) error {
+	return nil
+}
+
+// sqliteFlusher performs the flushes in a transaction, that of a
+// batch if tx is not nil, otherwise one per flush, which in SQLite is
+// much faster than a commit per statement.
+type sqliteFlusher struct {
+	p  *sqliteSerDe
+	tx *sql.Tx
+}
+
+func (f *sqliteFlusher) Commit() error   { return f.tx.Commit() }
+func (f *sqliteFlusher) Rollback() error { return f.tx.Rollback() }
+
+func (f *sqliteFlusher) run(flush func(tx *sql.Tx) (int, error)) (int, error) {
+	if f.tx != nil {
+		return flush(f.tx)
+	}
+	tx, err := f.p.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	sqlOps, err := flush(tx)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return sqlOps, tx.Commit()
+}
+
+// BeginFlushBatch starts a transaction, all flushes on the returned
+// FlushBatch are part of it until it is committed or rolled back.
+func (p *sqliteSerDe) BeginFlushBatch() (FlushBatch, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteFlusher{p: p, tx: tx}, nil
+}
+
+func (p *sqliteSerDe) FlushDSStates(seg int64, lastupdate, value, duration, lastRaw map[int64]interface{}) (int, error) {
+	return (&sqliteFlusher{p: p}).FlushDSStates(seg, lastupdate, value, duration, lastRaw)
+}
+
+func (p *sqliteSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]interface{}) (int, error) {
+	return (&sqliteFlusher{p: p}).FlushDataPoints(bundle_id, seg, i, dps, vers)
+}
+
+func (p *sqliteSerDe) FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (int, error) {
+	return (&sqliteFlusher{p: p}).FlushRRAStates(bundle_id, seg, latests, value, duration)
+}
+
+// stateColumn is a column of a state table and its new values by idx.
+type stateColumn struct {
+	name string
+	vals map[int64]interface{}
+}
+
+// flushStates sets the columns of the rows of a state table (ds_state
+// or rra_state), creating them first if need be. Every row is that
+// of an idx, key is the values of the other key columns, keyCols.
+func (f *sqliteFlusher) flushStates(table string, keyCols []string, key []interface{}, cols []stateColumn) (int, error) {
+	idxs := make(map[int64]bool)
+	for _, col := range cols {
+		for idx := range col.vals {
+			idxs[idx] = true
+		}
+	}
+	sorted := make([]int64, 0, len(idxs))
+	for idx := range idxs {
+		sorted = append(sorted, idx)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	where := strings.Join(keyCols, " = ? AND ") + " = ? AND idx = ?"
+	insert := fmt.Sprintf("INSERT OR IGNORE INTO %s%s (%s, idx) VALUES (%s?)", f.p.prefix, table,
+		strings.Join(keyCols, ", "), strings.Repeat("?, ", len(keyCols)))
+
+	return f.run(func(tx *sql.Tx) (sqlOps int, err error) {
+		for _, idx := range sorted {
+			keyArgs := append(append([]interface{}{}, key...), idx)
+			if _, err = tx.Exec(insert, keyArgs...); err != nil {
+				return 0, err
+			}
+			var (
+				sets []string
+				args []interface{}
+			)
+			for _, col := range cols {
+				if v, ok := col.vals[idx]; ok {
+					sets = append(sets, col.name+" = ?")
+					args = append(args, sqliteValue(v))
+				}
+			}
+			stmt := fmt.Sprintf("UPDATE %s%s SET %s WHERE %s", f.p.prefix, table, strings.Join(sets, ", "), where)
+			if _, err = tx.Exec(stmt, append(args, keyArgs...)...); err != nil {
+				return 0, err
+			}
+			sqlOps += 2
+		}
+		return sqlOps, nil
+	})
+}
+
+func (f *sqliteFlusher) FlushDSStates(seg int64, lastupdate, value, duration, lastRaw map[int64]interface{}) (int, error) {
+	return f.flushStates("ds_state", []string{"seg"}, []interface{}{seg},
+		[]stateColumn{{"lastupdate", lastupdate}, {"value", value}, {"duration_ms", duration}, {"last_raw", lastRaw}})
+}
+
+func (f *sqliteFlusher) FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (int, error) {
+	return f.flushStates("rra_state", []string{"rra_bundle_id", "seg"}, []interface{}{bundle_id, seg},
+		[]stateColumn{{"latest", latests}, {"value", value}, {"duration_ms", duration}})
+}
+
+func (f *sqliteFlusher) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]interface{}) (int, error) {
+	return f.run(func(tx *sql.Tx) (sqlOps int, err error) {
+		stmt, err := tx.Prepare(fmt.Sprintf("INSERT OR REPLACE INTO %[1]sts (rra_bundle_id, seg, idx, i, dp, ver) VALUES (?, ?, ?, ?, ?, ?)", f.p.prefix))
+		if err != nil {
+			return 0, err
+		}
+		defer stmt.Close()
+		for idx, dp := range dps {
+			if _, err = stmt.Exec(bundle_id, seg, idx, i, sqliteValue(dp), vers[idx]); err != nil {
+				return 0, err
+			}
+			sqlOps++
+		}
+		return sqlOps, nil
+	})
+}
+
+// DSL LRU keys
+
+func (p *sqliteSerDe) SaveDSLCacheKeys(idents []Ident) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(fmt.Sprintf("DELETE FROM %[1]sdsl_cache", p.prefix)); err == nil {
+		for _, ident := range idents {
+			if _, err = tx.Exec(fmt.Sprintf("INSERT INTO %[1]sdsl_cache (ident) VALUES (?)", p.prefix), ident.String()); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("SaveDSLCacheKeys(): %v", err)
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *sqliteSerDe) LoadDSLCacheKeys() ([]Ident, error) {
+	rows, err := p.db.Query(fmt.Sprintf("SELECT ident FROM %[1]sdsl_cache", p.prefix))
+	if err != nil {
+		log.Printf("LoadDSLCacheKeys(): %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Ident
+	for rows.Next() {
+		var istr string
+		if err := rows.Scan(&istr); err != nil {
+			log.Printf("LoadDSLCacheKeys(): %v", err)
+			return nil, err
+		}
+		var ident Ident
+		if err := json.Unmarshal([]byte(istr), &ident); err != nil {
+			log.Printf("LoadDSLCacheKeys(): error unmarshalling ident: %v", err)
+			continue
+		}
+		result = append(result, ident)
+	}
+	return result, nil
+}
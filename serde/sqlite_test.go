@@ -0,0 +1,78 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_sqliteValue(t *testing.T) {
+	now := time.Now()
+	for _, c := range []struct {
+		in, out interface{}
+	}{
+		{time.Time{}, nil},
+		{now, now.UnixNano()},
+		{math.NaN(), nil},
+		{1.5, 1.5},
+		{int64(7), int64(7)},
+	} {
+		if out := sqliteValue(c.in); out != c.out {
+			t.Errorf("sqliteValue(%v): expected %v, got %v", c.in, c.out, out)
+		}
+	}
+
+	if tm := sqliteTime(sql.NullInt64{Int64: now.UnixNano(), Valid: true}); !tm.Equal(now) {
+		t.Errorf("sqliteTime: expected %v, got %v", now, tm)
+	}
+	if tm := sqliteTime(sql.NullInt64{}); !tm.IsZero() {
+		t.Errorf("sqliteTime: NULL should be the zero time, got %v", tm)
+	}
+	if f := sqliteFloat(sql.NullFloat64{}); !math.IsNaN(*f) {
+		t.Errorf("sqliteFloat: NULL should be NaN, got %v", *f)
+	}
+}
+
+func Test_slotVersions(t *testing.T) {
+	rra, err := newDbRoundRobinArchive(1, 10, 1, 1, rrd.RRASpec{Step: time.Second, Span: 10 * time.Second,
+		Latest: time.Unix(25, 0), Function: rrd.MAX})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i, ver, prev := slotVersions(rra); i != 5 || ver != 2 || prev != 1 {
+		t.Errorf("slotVersions: expected 5, 2, 1, got %d, %d, %d", i, ver, prev)
+	}
+	if cfName(rrd.MAX) != "MAX" || cfName(rrd.WMEAN) != "WMEAN" {
+		t.Errorf("cfName: unexpected name")
+	}
+}
+
+func Test_InitSqliteDb_noDriver(t *testing.T) {
+	for _, d := range sql.Drivers() {
+		if d == SqliteDriver {
+			t.Skip("the SQLite driver is linked in")
+		}
+	}
+	if _, err := InitSqliteDb(":memory:", ""); err == nil || !strings.Contains(err.Error(), "-tags sqlite") {
+		t.Errorf("InitSqliteDb: expected an error about the build tag, got %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A TagQuery selects DSs by their ident tags, every tag in Equal must
+// have exactly the value given and every tag in Prefix must have a
+// value beginning with the prefix given. Unlike a SearchQuery, which
+// is regular expressions, this is what an index can make fast.
+type TagQuery struct {
+	Equal  map[string]string
+	Prefix map[string]string
+}
+
+// Match returns true if the ident satisfies the query.
+func (q TagQuery) Match(ident Ident) bool {
+	for k, v := range q.Equal {
+		if iv, ok := ident[k]; !ok || iv != v {
+			return false
+		}
+	}
+	for k, p := range q.Prefix {
+		if iv, ok := ident[k]; !ok || !strings.HasPrefix(iv, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// searchQuery returns the SearchQuery which selects (case
+// insensitively) at least all of the DSs the TagQuery does.
+func (q TagQuery) searchQuery() SearchQuery {
+	sq := make(SearchQuery, len(q.Equal)+len(q.Prefix))
+	for k, p := range q.Prefix {
+		sq[k] = "^" + regexp.QuoteMeta(p)
+	}
+	for k, v := range q.Equal {
+		sq[k] = "^" + regexp.QuoteMeta(v) + "$"
+	}
+	if len(sq) == 0 {
+		sq["name"] = ".*"
+	}
+	return sq
+}
+
+// A TagSearcher searches DSs by their tags using an index, which is
+// what seriesByTag and tag autocompletion need to be fast with
+// millions of DSs. TagNames returns the distinct tags of the DSs
+// selected beginning with prefix, TagValues the distinct values of
+// the tag beginning with prefix, both sorted and at most limit of
+// them unless limit is 0.
+type TagSearcher interface {
+	SearchTags(q TagQuery) (SearchResult, error)
+	TagNames(q TagQuery, prefix string, limit int) ([]string, error)
+	TagValues(q TagQuery, tag, prefix string, limit int) ([]string, error)
+}
+
+// SearchTags searches the DSs with the TagSearcher if db is one, or
+// with a Search narrowed down by Match otherwise.
+func SearchTags(db DataSourceSearcher, q TagQuery) (SearchResult, error) {
+	if ts, ok := db.(TagSearcher); ok {
+		return ts.SearchTags(q)
+	}
+	idents, archived, err := searchTags(db, q)
+	if err != nil {
+		return nil, err
+	}
+	sr := newIdentSearchResult()
+	for i, ident := range idents {
+		sr.add(ident, archived[i])
+	}
+	return sr, nil
+}
+
+// TagNames is the TagSearcher TagNames of db if it is one, or a
+// Search otherwise.
+func TagNames(db DataSourceSearcher, q TagQuery, prefix string, limit int) ([]string, error) {
+	if ts, ok := db.(TagSearcher); ok {
+		return ts.TagNames(q, prefix, limit)
+	}
+	idents, _, err := searchTags(db, q)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool)
+	for _, ident := range idents {
+		for k := range ident {
+			if strings.HasPrefix(k, prefix) {
+				set[k] = true
+			}
+		}
+	}
+	return sortedTags(set, limit), nil
+}
+
+// TagValues is the TagSearcher TagValues of db if it is one, or a
+// Search otherwise.
+func TagValues(db DataSourceSearcher, q TagQuery, tag, prefix string, limit int) ([]string, error) {
+	if ts, ok := db.(TagSearcher); ok {
+		return ts.TagValues(q, tag, prefix, limit)
+	}
+	idents, _, err := searchTags(db, q)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool)
+	for _, ident := range idents {
+		if v, ok := ident[tag]; ok && strings.HasPrefix(v, prefix) {
+			set[v] = true
+		}
+	}
+	return sortedTags(set, limit), nil
+}
+
+func searchTags(db DataSourceSearcher, q TagQuery) ([]Ident, []bool, error) {
+	sr, err := db.Search(q.searchQuery())
+	if err != nil {
+		return nil, nil, err
+	}
+	if sr == nil {
+		return nil, nil, nil
+	}
+	defer sr.Close()
+
+	var (
+		idents   []Ident
+		archived []bool
+	)
+	asr, _ := sr.(ArchivedSearchResult)
+	for sr.Next() {
+		if ident := sr.Ident(); q.Match(ident) {
+			idents = append(idents, ident)
+			archived = append(archived, asr != nil && asr.Archived())
+		}
+	}
+	return idents, archived, nil
+}
+
+func sortedTags(set map[string]bool, limit int) []string {
+	result := make([]string, 0, len(set))
+	for s := range set {
+		result = append(result, s)
+	}
+	sort.Strings(result)
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
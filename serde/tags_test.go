@@ -0,0 +1,109 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_TagQuery_Match(t *testing.T) {
+	ident := Ident{"name": "foo.bar", "host": "web1", "dc": "east"}
+	for _, c := range []struct {
+		q  TagQuery
+		ok bool
+	}{
+		{TagQuery{}, true},
+		{TagQuery{Equal: map[string]string{"host": "web1"}}, true},
+		{TagQuery{Equal: map[string]string{"host": "WEB1"}}, false},
+		{TagQuery{Equal: map[string]string{"rack": "1"}}, false},
+		{TagQuery{Prefix: map[string]string{"host": "web"}}, true},
+		{TagQuery{Equal: map[string]string{"dc": "east"}, Prefix: map[string]string{"host": "db"}}, false},
+	} {
+		if ok := c.q.Match(ident); ok != c.ok {
+			t.Errorf("Match(%v): expected %v", c.q, c.ok)
+		}
+	}
+}
+
+func Test_TagSearch_fallback(t *testing.T) {
+	db := NewMemSerDe()
+	spec := &rrd.DSSpec{
+		Step: 10 * time.Second,
+		RRAs: []rrd.RRASpec{{Function: rrd.WMEAN, Step: 10 * time.Second, Span: 100 * time.Second}},
+	}
+	for _, ident := range []Ident{
+		{"name": "cpu", "host": "web1", "dc": "east"},
+		{"name": "cpu", "host": "web2", "dc": "west"},
+		{"name": "mem", "host": "db1", "dc": "east", "rack": "3"},
+	} {
+		db.FetchOrCreateDataSource(ident, spec)
+	}
+
+	sr, err := SearchTags(db, TagQuery{Equal: map[string]string{"dc": "east"}, Prefix: map[string]string{"host": "w"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []Ident
+	for sr.Next() {
+		found = append(found, sr.Ident())
+	}
+	if len(found) != 1 || found[0]["host"] != "web1" {
+		t.Errorf("SearchTags: expected web1, got %v", found)
+	}
+
+	names, err := TagNames(db, TagQuery{Equal: map[string]string{"dc": "east"}}, "", 0)
+	if expect := []string{"dc", "host", "name", "rack"}; err != nil || !reflect.DeepEqual(names, expect) {
+		t.Errorf("TagNames: expected %v, got %v (%v)", expect, names, err)
+	}
+	names, _ = TagNames(db, TagQuery{}, "h", 0)
+	if expect := []string{"host"}; !reflect.DeepEqual(names, expect) {
+		t.Errorf("TagNames: expected %v, got %v", expect, names)
+	}
+
+	values, err := TagValues(db, TagQuery{}, "host", "web", 0)
+	if expect := []string{"web1", "web2"}; err != nil || !reflect.DeepEqual(values, expect) {
+		t.Errorf("TagValues: expected %v, got %v (%v)", expect, values, err)
+	}
+	values, _ = TagValues(db, TagQuery{}, "host", "", 2)
+	if expect := []string{"db1", "web1"}; !reflect.DeepEqual(values, expect) {
+		t.Errorf("TagValues: expected the limit of %v, got %v", expect, values)
+	}
+}
+
+func Test_buildTagWhere(t *testing.T) {
+	where, args := buildTagWhere(TagQuery{}, 0)
+	if where != "true" || len(args) != 0 {
+		t.Errorf("buildTagWhere: expected true, got %q %v", where, args)
+	}
+	where, args = buildTagWhere(TagQuery{
+		Equal:  map[string]string{"dc": "east"},
+		Prefix: map[string]string{"name": "foo_", "host": "web"},
+	}, 1)
+	expect := "ident @> $2::jsonb AND ident ? $3 AND ident ->> $3 LIKE $4 AND ident ? $5 AND ident ->> $5 LIKE $6"
+	if where != expect {
+		t.Errorf("buildTagWhere: expected %q, got %q", expect, where)
+	}
+	if eargs := []interface{}{`{"dc":"east"}`, "host", "web%", "name", `foo\_%`}; !reflect.DeepEqual(args, eargs) {
+		t.Errorf("buildTagWhere: expected args %v, got %v", eargs, args)
+	}
+	if p := pgLikePrefix(`a%b\`); p != `a\%b\\%` {
+		t.Errorf("pgLikePrefix: got %q", p)
+	}
+}
@@ -29,29 +29,43 @@ var (
 	Prefix string = "stats"
 )
 
+// ident returns an ident with the given name and the stat tags, if
+// any.
+func (st *Stat) ident(name string) serde.Ident {
+	ident := serde.Ident{"name": name}
+	for k, v := range st.Tags {
+		ident[k] = v
+	}
+	return ident
+}
+
 func (st *Stat) AggregatorCmd() *aggregator.Command {
 	if st.Metric == "c" {
 		return aggregator.NewCommand(
 			aggregator.CmdAdd,
-			serde.Ident{"name": Prefix + "." + st.Name},
+			st.ident(Prefix+"."+st.Name),
 			st.Value*(1/st.Sample))
 	} else if st.Metric == "g" {
 		if st.Delta {
 			return aggregator.NewCommand(
-				aggregator.CmdAddGauge,
-				serde.Ident{"name": Prefix + ".gauges." + st.Name},
+				aggregator.CmdDeltaGauge,
+				st.ident(Prefix+".gauges."+st.Name),
 				st.Value)
 		} else {
 			return aggregator.NewCommand(
 				aggregator.CmdSetGauge,
-				serde.Ident{"name": Prefix + ".gauges." + st.Name},
+				st.ident(Prefix+".gauges."+st.Name),
 				st.Value)
 		}
 	} else if st.Metric == "ms" {
 		return aggregator.NewCommand(
 			aggregator.CmdAppend,
-			serde.Ident{"name": Prefix + ".timers." + st.Name},
+			st.ident(Prefix+".timers."+st.Name),
 			st.Value)
+	} else if st.Metric == "s" {
+		return aggregator.NewSetCommand(
+			st.ident(Prefix+".sets."+st.Name),
+			st.Member)
 	}
 	return nil
 }
@@ -62,20 +76,29 @@ type Stat struct {
 	Metric string
 	Sample float64
 	Delta  bool
+	Member string            // For sets, the value as is
+	Tags   map[string]string // DogStatsD tags, become part of the ident
 }
 
 // ParseStatsdPacket parses a statsd packet e.g: gorets:1|c|@0.1. See
 // https://github.com/etsy/statsd/blob/master/docs/metric_types.md
 // There is no need to support multi-metric packets here, since it
 // uses newline as separator, the text handler in daemon/services.go
-// would take care of it.
+// would take care of it. DogStatsD tags (e.g. gorets:1|c|#env:prod,canary)
+// are also supported.
 func ParseStatsdPacket(packet string) (*Stat, error) {
 
 	var (
 		result = &Stat{Sample: 1}
 		parts  []string
+		err    error
 	)
 
+	// Tags may contain ":", extract them first.
+	if packet, result.Tags, err = extractTags(packet); err != nil {
+		return nil, err
+	}
+
 	parts = strings.Split(packet, ":")
 	if len(parts) < 1 {
 		return nil, fmt.Errorf("invalid packet: %q", packet)
@@ -94,10 +117,19 @@ func ParseStatsdPacket(packet string) (*Stat, error) {
 		return nil, fmt.Errorf("invalid packet: %q", packet)
 	}
 
+	if parts[1] == "s" {
+		// Set members are not necessarily numeric
+		if parts[0] == "" {
+			return nil, fmt.Errorf("invalid packet (empty set member): %q", packet)
+		}
+		result.Member, result.Metric = parts[0], parts[1]
+		return result, nil
+	}
+
 	if n, err := fmt.Sscanf(parts[0], "%f", &result.Value); n != 1 || err != nil {
 		return nil, fmt.Errorf("error %v scanning input (cannot parse value|metric): %q", err, packet)
 	}
-	if parts[0][0] == '+' || parts[1][0] == '-' { // safe because "" would cause an error above
+	if parts[0][0] == '+' || parts[0][0] == '-' { // safe because "" would cause an error above
 		result.Delta = true
 	}
 	if parts[1] != "c" && parts[1] != "g" && parts[1] != "ms" {
@@ -116,3 +148,40 @@ func ParseStatsdPacket(packet string) (*Stat, error) {
 
 	return result, nil
 }
+
+// extractTags removes the DogStatsD "|#tag:value,tag" section from
+// the packet and returns the remaining packet and the tags. A tag
+// without a value gets an empty value. Since tags become part of the
+// ident, a tag cannot be called "name".
+func extractTags(packet string) (string, map[string]string, error) {
+	start := strings.Index(packet, "|#")
+	if start == -1 {
+		return packet, nil, nil
+	}
+	section, rest := packet[start+2:], ""
+	if end := strings.Index(section, "|"); end != -1 {
+		section, rest = section[:end], section[end:]
+	}
+
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(section, ",") {
+		if tag == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, ":", 2)
+		key := misc.SanitizeName(kv[0])
+		if key == "" || key == "name" {
+			return "", nil, fmt.Errorf("invalid tag %q in packet: %q", tag, packet)
+		}
+		if len(kv) == 2 {
+			tags[key] = misc.SanitizeName(kv[1])
+		} else {
+			tags[key] = ""
+		}
+	}
+	if len(tags) == 0 {
+		tags = nil
+	}
+
+	return packet[:start] + rest, tags, nil
+}
@@ -0,0 +1,72 @@
+//
+// Copyright 2015 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_ParseStatsdPacket_Tags(t *testing.T) {
+	for packet, expect := range map[string]*Stat{
+		"foo:1|c|#env:prod,canary":      {Name: "foo", Value: 1, Metric: "c", Sample: 1, Tags: map[string]string{"env": "prod", "canary": ""}},
+		"foo:1|c|#env:prod|@0.5":        {Name: "foo", Value: 1, Metric: "c", Sample: 0.5, Tags: map[string]string{"env": "prod"}},
+		"foo:1|c|@0.5|#host:a:b":        {Name: "foo", Value: 1, Metric: "c", Sample: 0.5, Tags: map[string]string{"host": "ab"}},
+		"foo:12.5|ms":                   {Name: "foo", Value: 12.5, Metric: "ms", Sample: 1},
+		"users:bob|s|#region:us-east-1": {Name: "users", Metric: "s", Sample: 1, Member: "bob", Tags: map[string]string{"region": "us-east-1"}},
+	} {
+		st, err := ParseStatsdPacket(packet)
+		if err != nil {
+			t.Errorf("ParseStatsdPacket(%q): unexpected error: %v", packet, err)
+			continue
+		}
+		if !reflect.DeepEqual(st, expect) {
+			t.Errorf("ParseStatsdPacket(%q): %#v != %#v", packet, st, expect)
+		}
+	}
+
+	for _, packet := range []string{"foo:1|c|#name:bar", "foo:1|c|#:bar", "users:|s"} {
+		if _, err := ParseStatsdPacket(packet); err == nil {
+			t.Errorf("ParseStatsdPacket(%q): expected an error", packet)
+		}
+	}
+}
+
+func Test_ParseStatsdPacket_Delta(t *testing.T) {
+	for packet, delta := range map[string]bool{
+		"foo:+3|g":  true,
+		"foo:-3|g":  true,
+		"foo:3|g":   false,
+		"foo:-3|ms": true, // only meaningful for gauges
+	} {
+		st, err := ParseStatsdPacket(packet)
+		if err != nil {
+			t.Errorf("ParseStatsdPacket(%q): unexpected error: %v", packet, err)
+			continue
+		}
+		if st.Delta != delta {
+			t.Errorf("ParseStatsdPacket(%q): Delta should be %v", packet, delta)
+		}
+	}
+}
+
+func Test_Stat_ident(t *testing.T) {
+	st := &Stat{Name: "foo", Value: 1, Metric: "c", Sample: 1, Tags: map[string]string{"env": "prod"}}
+	ident := st.ident("stats.foo")
+	if ident["name"] != "stats.foo" || ident["env"] != "prod" {
+		t.Errorf("ident: tags not in ident: %v", ident)
+	}
+}
@@ -0,0 +1,287 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tier
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+// An rraLoader can load the data points of an RRA, all the database
+// serdes can.
+type rraLoader interface {
+	LoadRRAData(rra rrd.RoundRobinArchiver) (rrd.RoundRobinArchiver, error)
+}
+
+// A chunk is a cold object: the values of consecutive slots of an
+// RRA, stored as gzipped JSON.
+type chunk struct {
+	StepMs  int64      `json:"step_ms"`
+	StartMs int64      `json:"start_ms"` // end of the first slot
+	Values  []*float64 `json:"values"`   // null is NaN
+}
+
+func encodeChunk(c *chunk) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(c); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeChunk(data []byte) (*chunk, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	var c chunk
+	if err := json.NewDecoder(gz).Decode(&c); err != nil {
+		return nil, err
+	}
+	if c.StepMs <= 0 {
+		return nil, fmt.Errorf("invalid step: %d", c.StepMs)
+	}
+	return &c, nil
+}
+
+// keyEscape percent-encodes everything but [A-Za-z0-9._-].
+func keyEscape(s string) string {
+	var b bytes.Buffer
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '.' || c == '_' || c == '-' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func cfName(f rrd.Consolidation) string {
+	switch f {
+	case rrd.MIN:
+		return "min"
+	case rrd.MAX:
+		return "max"
+	case rrd.LAST:
+		return "last"
+	}
+	return "wmean"
+}
+
+// rraPrefix is where the chunks of an RRA are kept,
+// "<ident>/<cf>-<step ms>-<span ms>/". The ident is used rather than
+// the DS id because it does not depend on the database.
+func rraPrefix(ident serde.Ident, spec rrd.RRASpec) string {
+	return fmt.Sprintf("%s/%s-%d-%d/", keyEscape(ident.String()), cfName(spec.Function),
+		spec.Step.Nanoseconds()/1e6, spec.Span.Nanoseconds()/1e6)
+}
+
+// chunkKey names a chunk by the ends of its first and last slots in
+// ms, zero-padded so that the keys sort by time.
+func chunkKey(prefix string, from, to time.Time) string {
+	return fmt.Sprintf("%s%013d-%013d.json.gz", prefix, from.UnixNano()/1e6, to.UnixNano()/1e6)
+}
+
+func parseChunkKey(prefix, key string) (from, to int64, ok bool) {
+	name := strings.TrimPrefix(key, prefix)
+	if n, err := fmt.Sscanf(name, "%d-%d.json.gz", &from, &to); err != nil || n != 2 || from > to {
+		return 0, 0, false
+	}
+	return from, to, true
+}
+
+// An Archiver periodically copies the slots of RRAs older than the
+// cold age into the cold tier. The slots are not removed from the
+// database: the RRAs are of fixed size, and the slots are overwritten
+// once the RRA wraps around, which is what makes long term storage in
+// the database costly. With the cold tier the RRAs in the database
+// only need to span a little longer than the cold age plus the
+// interval, the rest of the history is in the object store.
+type Archiver struct {
+	db       serde.Fetcher
+	store    ObjectStore
+	age      time.Duration
+	interval time.Duration
+	skipped  map[string]bool // RRAs too short to archive, logged once
+}
+
+func NewArchiver(db serde.Fetcher, store ObjectStore, age, interval time.Duration) *Archiver {
+	return &Archiver{
+		db:       db,
+		store:    store,
+		age:      age,
+		interval: interval,
+		skipped:  make(map[string]bool),
+	}
+}
+
+// Start runs Archive every interval in a goroutine.
+func (a *Archiver) Start() {
+	go func() {
+		for {
+			time.Sleep(a.interval)
+			start := time.Now()
+			n, err := a.Archive(start)
+			if err != nil {
+				log.Printf("Cold tier: archiving failed: %v", err)
+			}
+			if n > 0 {
+				log.Printf("Cold tier: archived %d chunk(s) in %v.", n, time.Now().Sub(start))
+			}
+		}
+	}()
+}
+
+// Archive copies the slots of all the RRAs of all the (not archived)
+// DSs older than the cold age as of now and not yet in the cold tier
+// into it, one chunk per RRA, and returns the number of chunks
+// written. An RRA whose span is not longer than the cold age plus
+// the interval is skipped, its slots are overwritten before they are
+// old enough.
+func (a *Archiver) Archive(now time.Time) (int, error) {
+	loader, ok := a.db.(rraLoader)
+	if !ok {
+		return 0, fmt.Errorf("the database does not support loading RRA data")
+	}
+	dss, err := a.db.FetchDataSources()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, ds := range dss {
+		dbds, ok := ds.(serde.DbDataSourcer)
+		if !ok {
+			continue
+		}
+		for _, rra := range dbds.RRAs() {
+			spec := rra.Spec()
+			if a.age+a.interval >= spec.Span {
+				if s := fmt.Sprintf("%v/%v", spec.Step, spec.Span); !a.skipped[s] {
+					log.Printf("Cold tier: not archiving RRAs of step %v and span %v, the span must be longer than the cold age plus the interval (%v).",
+						spec.Step, spec.Span, a.age+a.interval)
+					a.skipped[s] = true
+				}
+				continue
+			}
+			written, err := a.archiveRRA(loader, dbds.Ident(), rra, now)
+			if err != nil {
+				return n, fmt.Errorf("%v: %v", dbds.Ident(), err)
+			}
+			if written {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// archiveRRA writes the slots of an RRA from the one after the last
+// archived up to the cold age as a chunk.
+func (a *Archiver) archiveRRA(loader rraLoader, ident serde.Ident, rra rrd.RoundRobinArchiver, now time.Time) (bool, error) {
+	loaded, err := loader.LoadRRAData(rra)
+	if err != nil {
+		return false, err
+	}
+	latest, step, size := loaded.Latest(), loaded.Step(), loaded.Size()
+	if latest.IsZero() {
+		return false, nil
+	}
+	cutoff := now.Add(-a.age).Truncate(step)
+	if cutoff.After(latest) {
+		cutoff = latest
+	}
+	first := latest.Add(-step * time.Duration(size-1)) // the earliest slot in the database
+
+	prefix := rraPrefix(ident, loaded.Spec())
+	keys, err := a.store.List(prefix)
+	if err != nil {
+		return false, err
+	}
+	for _, key := range keys {
+		if _, to, ok := parseChunkKey(prefix, key); ok {
+			if end := time.Unix(0, to*1e6).Add(step); !end.Before(first) {
+				first = end
+			}
+		}
+	}
+	if first.After(cutoff) {
+		return false, nil
+	}
+
+	c := &chunk{StepMs: step.Nanoseconds() / 1e6, StartMs: first.UnixNano() / 1e6}
+	var found bool
+	dps := loaded.DPs()
+	for t := first; !t.After(cutoff); t = t.Add(step) {
+		var val *float64
+		if v, ok := dps[rrd.SlotIndex(t, step, size)]; ok && !math.IsNaN(v) && !math.IsInf(v, 0) {
+			val, found = &v, true
+		}
+		c.Values = append(c.Values, val)
+	}
+	if !found {
+		return false, nil // nothing to keep, e.g. a DS which stopped receiving data
+	}
+	data, err := encodeChunk(c)
+	if err != nil {
+		return false, err
+	}
+	return true, a.store.Put(chunkKey(prefix, first, cutoff), data)
+}
+
+// readChunks returns the values of the chunks of an RRA which
+// overlap the [from, to) time range keyed by slot end in ms.
+func readChunks(store ObjectStore, prefix string, from, to time.Time) (map[int64]float64, error) {
+	keys, err := store.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	fromMs, toMs := from.UnixNano()/1e6, to.UnixNano()/1e6
+	result := make(map[int64]float64)
+	for _, key := range keys {
+		if cfrom, cto, ok := parseChunkKey(prefix, key); !ok || cto < fromMs || cfrom >= toMs {
+			continue
+		}
+		data, err := store.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		c, err := decodeChunk(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		for i, v := range c.Values {
+			if t := c.StartMs + int64(i)*c.StepMs; v != nil && t >= fromMs && t < toMs {
+				result[t] = *v
+			}
+		}
+	}
+	return result, nil
+}
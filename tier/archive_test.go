@@ -0,0 +1,138 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tier
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/series"
+)
+
+// fakeDb has a single DS whose RRAs are replaced by the test.
+type fakeDb struct {
+	ds      *serde.DbDataSource
+	fetches int
+}
+
+func (*fakeDb) Search(serde.SearchQuery) (serde.SearchResult, error) { return nil, nil }
+func (f *fakeDb) FetchDataSources() ([]rrd.DataSourcer, error) {
+	return []rrd.DataSourcer{f.ds}, nil
+}
+func (*fakeDb) FetchOrCreateDataSource(serde.Ident, *rrd.DSSpec) (rrd.DataSourcer, error) {
+	return nil, nil
+}
+func (f *fakeDb) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	f.fetches++
+	return series.NewRRASeries(ds.RRAs()[0]), nil
+}
+func (*fakeDb) LoadRRAData(rra rrd.RoundRobinArchiver) (rrd.RoundRobinArchiver, error) {
+	return rra.Copy(), nil
+}
+
+// setLatest makes the slot values the seconds since base, and the
+// last one end at latest.
+func (f *fakeDb) setLatest(base, latest time.Time) {
+	spec := rrd.DSSpec{Step: 10 * time.Second, Heartbeat: time.Hour}
+	for _, span := range []time.Duration{100 * time.Second, 30 * time.Second} {
+		rspec := rrd.RRASpec{Function: rrd.WMEAN, Step: 10 * time.Second, Span: span, Latest: latest, DPs: make(map[int64]float64)}
+		size := int64(span / rspec.Step)
+		for i := int64(0); i < size; i++ {
+			t := latest.Add(-rspec.Step * time.Duration(i))
+			rspec.DPs[rrd.SlotIndex(t, rspec.Step, size)] = t.Sub(base).Seconds()
+		}
+		spec.RRAs = append(spec.RRAs, rspec)
+	}
+	f.ds = serde.NewDbDataSource(1, serde.Ident{"name": "foo.bar"}, 0, 0, rrd.NewDataSource(spec))
+}
+
+func Test_Archiver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := newDirStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Unix(1000000, 0)
+	db := &fakeDb{}
+	db.setLatest(base, base)
+	a := NewArchiver(db, store, 30*time.Second, 10*time.Second)
+
+	// The 100s RRA is archived up to 30s ago, the 30s one is too short
+	if n, err := a.Archive(base); n != 1 || err != nil {
+		t.Fatalf("Archive: unexpected %d %v", n, err)
+	}
+	prefix := rraPrefix(serde.Ident{"name": "foo.bar"}, rrd.RRASpec{Function: rrd.WMEAN, Step: 10 * time.Second, Span: 100 * time.Second})
+	if prefix != "%7B%22name%22%3A%20%22foo.bar%22%7D/wmean-10000-100000/" {
+		t.Errorf("rraPrefix: unexpected %q", prefix)
+	}
+	keys, _ := store.List("")
+	if len(keys) != 1 || keys[0] != chunkKey(prefix, base.Add(-90*time.Second), base.Add(-30*time.Second)) {
+		t.Fatalf("Archive: unexpected keys %v", keys)
+	}
+	if n, err := a.Archive(base); n != 0 || err != nil {
+		t.Errorf("Archive: nothing new should be archived, got %d %v", n, err)
+	}
+
+	// 50s later only what has not been archived yet is
+	now := base.Add(50 * time.Second)
+	db.setLatest(base, now)
+	if n, err := a.Archive(now); n != 1 || err != nil {
+		t.Fatalf("Archive: unexpected %d %v", n, err)
+	}
+	keys, _ = store.List(prefix)
+	if len(keys) != 2 || keys[1] != chunkKey(prefix, base.Add(-20*time.Second), base.Add(20*time.Second)) {
+		t.Fatalf("Archive: unexpected keys %v", keys)
+	}
+	data, _ := store.Get(keys[1])
+	if c, err := decodeChunk(data); err != nil || c.StepMs != 10000 || len(c.Values) != 5 || *c.Values[0] != -20 {
+		t.Errorf("decodeChunk: unexpected %v %v", c, err)
+	}
+
+	// A query reaching back into the cold tier merges it in
+	f := NewFetcher(db, store)
+	s, err := f.FetchSeries(db.ds, base.Add(-200*time.Second), now, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for s.Next() {
+		tm, v := s.CurrentTime(), s.CurrentValue()
+		if tm.Before(base.Add(-90 * time.Second)) {
+			t.Errorf("FetchSeries: %v is before the cold tier", tm)
+		}
+		if v != tm.Sub(base).Seconds() {
+			t.Errorf("FetchSeries: %v: expected %v, got %v", tm, tm.Sub(base).Seconds(), v)
+		}
+		n++
+	}
+	if n != 15 || db.fetches != 0 {
+		t.Errorf("FetchSeries: expected 15 points from the merged RRA, got %d (%d db fetches)", n, db.fetches)
+	}
+
+	// Within the database it is the database
+	if _, err := f.FetchSeries(db.ds, now.Add(-50*time.Second), now, 0); err != nil || db.fetches != 1 {
+		t.Errorf("FetchSeries: expected a db fetch, got %d %v", db.fetches, err)
+	}
+}
@@ -0,0 +1,102 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tier
+
+import (
+	"log"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/series"
+)
+
+// Fetcher is a serde.Fetcher which merges the cold tier into the
+// series of queries reaching back further than the best RRA of a DS.
+type Fetcher struct {
+	serde.Fetcher
+	store ObjectStore
+}
+
+func NewFetcher(db serde.Fetcher, store ObjectStore) *Fetcher {
+	return &Fetcher{Fetcher: db, store: store}
+}
+
+// FetchSeries is that of the database unless from is before the
+// beginning of the best RRA and the cold tier has older slots of it,
+// in which case the series is of an RRA extended back to the
+// earliest of those (and from is moved up to it), with the database
+// winning where both have a slot. If the cold tier cannot be read,
+// the series is that of the database.
+func (f *Fetcher) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	dbds, ok := ds.(serde.DbDataSourcer)
+	loader, lok := f.Fetcher.(rraLoader)
+	if !ok || !lok || from.IsZero() {
+		return f.Fetcher.FetchSeries(ds, from, to, maxPoints)
+	}
+	rra := dbds.BestRRA(from, to, maxPoints)
+	if rra == nil || rra.Latest().IsZero() {
+		return f.Fetcher.FetchSeries(ds, from, to, maxPoints)
+	}
+	step := rra.Step()
+	hotBegins := rra.Begins(rra.Latest())
+	if !hotBegins.After(from) {
+		return f.Fetcher.FetchSeries(ds, from, to, maxPoints)
+	}
+
+	cold, err := readChunks(f.store, rraPrefix(dbds.Ident(), rra.Spec()), from.Truncate(step), hotBegins)
+	if err != nil {
+		log.Printf("Cold tier: unable to read %v: %v", dbds.Ident(), err)
+		return f.Fetcher.FetchSeries(ds, from, to, maxPoints)
+	}
+	if len(cold) == 0 {
+		return f.Fetcher.FetchSeries(ds, from, to, maxPoints)
+	}
+
+	loaded, err := loader.LoadRRAData(rra)
+	if err != nil {
+		return nil, err
+	}
+	latest := loaded.Latest()
+	begins := hotBegins
+	for ms := range cold {
+		if t := time.Unix(0, ms*1e6); t.Before(begins) {
+			begins = t
+		}
+	}
+	size := int64(latest.Sub(begins)/step) + 1
+	dps := make(map[int64]float64, len(cold)+loaded.PointCount())
+	for ms, v := range cold {
+		dps[rrd.SlotIndex(time.Unix(0, ms*1e6), step, size)] = v
+	}
+	for i, v := range loaded.DPs() {
+		t := rrd.SlotTime(i, latest, step, loaded.Size())
+		dps[rrd.SlotIndex(t, step, size)] = v
+	}
+	spec := loaded.Spec()
+	spec.Span, spec.Latest, spec.DPs = step*time.Duration(size), latest, dps
+
+	s := series.NewRRASeries(rrd.NewRoundRobinArchive(spec))
+	if from.Before(begins) {
+		from = begins
+	}
+	if to.IsZero() {
+		to = latest
+	}
+	s.TimeRange(from, to)
+	s.MaxPoints(maxPoints)
+	return s, nil
+}
@@ -0,0 +1,218 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tier
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Store is an object store speaking the S3 REST API with path
+// style addressing and AWS Signature Version 4, which GCS also
+// accepts with HMAC keys.
+type s3Store struct {
+	opts     S3Options
+	endpoint *url.URL
+	bucket   string
+	prefix   string // "" or ending in "/"
+	client   *http.Client
+	now      func() time.Time
+}
+
+func newS3Store(opts S3Options, bucket, prefix string) (*s3Store, error) {
+	ep, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %q: %v", opts.Endpoint, err)
+	}
+	if ep.Scheme != "http" && ep.Scheme != "https" || ep.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", opts.Endpoint)
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Store{
+		opts:     opts,
+		endpoint: ep,
+		bucket:   bucket,
+		prefix:   prefix,
+		client:   &http.Client{Timeout: time.Minute},
+		now:      time.Now,
+	}, nil
+}
+
+func (s *s3Store) Put(key string, data []byte) error {
+	_, err := s.do("PUT", s.prefix+key, nil, data)
+	return err
+}
+
+func (s *s3Store) Get(key string) ([]byte, error) {
+	return s.do("GET", s.prefix+key, nil, nil)
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List pages through ListObjectsV2, which returns keys in lexical
+// order.
+func (s *s3Store) List(prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+	for {
+		body, err := s.do("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("invalid list response: %v", err)
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, s.prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// do sends a signed request for a key of the bucket (or the bucket
+// itself if key is "") and returns the response body.
+func (s *s3Store) do(method, key string, query url.Values, body []byte) ([]byte, error) {
+	path := s.endpoint.Path + "/" + s.bucket
+	if key != "" {
+		path += "/" + key
+	}
+	u := *s.endpoint
+	u.Path, u.RawPath = path, s3Escape(path, false)
+	u.RawQuery = s3Query(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, path, body)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
+
+// sign adds the AWS Signature Version 4 headers to the request.
+func (s *s3Store) sign(req *http.Request, path string, body []byte) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		s3Escape(path, false),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+
+	scope := date + "/" + s.opts.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+	signature := hex.EncodeToString(hmacSHA256(s3SigningKey(s.opts.SecretKey, date, s.opts.Region, "s3"), toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.opts.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3SigningKey derives the Signature Version 4 signing key.
+func s3SigningKey(secret, date, region, service string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), date)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, service)
+	return hmacSHA256(k, "aws4_request")
+}
+
+// s3Escape is the URI encoding of Signature Version 4: everything
+// but the unreserved characters is percent-encoded, and "/" too if
+// encodeSlash is set (it is not in paths).
+func s3Escape(s string, encodeSlash bool) string {
+	var b bytes.Buffer
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query is the canonical query string, sorted by name.
+func s3Query(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for k := range query {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, k := range names {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,163 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tier moves RRA data older than a configurable age into
+// compressed objects in an object store (a directory, S3 or GCS), the
+// cold tier, and merges it back in when a query reaches further back
+// than the RRAs in the database.
+package tier
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// An ObjectStore is where the cold tier is kept. Keys are
+// "/"-separated paths.
+type ObjectStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	// List returns the keys beginning with prefix in lexical order.
+	List(prefix string) ([]string, error)
+}
+
+// S3Options are the settings of an S3 or GCS object store, see
+// NewObjectStore.
+type S3Options struct {
+	Endpoint  string // e.g. "https://s3.eu-west-1.amazonaws.com", default is by scheme and region
+	Region    string // default is "us-east-1" ("auto" for GCS)
+	AccessKey string
+	SecretKey string
+}
+
+// NewObjectStore returns the object store of a URL:
+//
+//	file:///var/lib/tgres/cold - a directory
+//	s3://bucket/prefix         - an S3 (or S3 compatible) bucket
+//	gs://bucket/prefix         - a GCS bucket via its S3 compatible
+//	                             XML API, with HMAC keys
+func NewObjectStore(rawurl string, opts S3Options) (ObjectStore, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("missing directory in %q", rawurl)
+		}
+		return newDirStore(u.Path)
+	case "s3", "gs":
+		if u.Host == "" {
+			return nil, fmt.Errorf("missing bucket in %q", rawurl)
+		}
+		if opts.AccessKey == "" || opts.SecretKey == "" {
+			return nil, fmt.Errorf("an access key and a secret key are required for %q", rawurl)
+		}
+		if opts.Region == "" {
+			opts.Region = "us-east-1"
+			if u.Scheme == "gs" {
+				opts.Region = "auto"
+			}
+		}
+		if opts.Endpoint == "" {
+			opts.Endpoint = "https://s3." + opts.Region + ".amazonaws.com"
+			if u.Scheme == "gs" {
+				opts.Endpoint = "https://storage.googleapis.com"
+			}
+		}
+		return newS3Store(opts, u.Host, strings.Trim(u.Path, "/"))
+	}
+	return nil, fmt.Errorf("unsupported object store %q, must be file://, s3:// or gs://", rawurl)
+}
+
+// dirStore keeps objects as files in a directory.
+type dirStore struct {
+	root string
+}
+
+func newDirStore(root string) (*dirStore, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &dirStore{root: root}, nil
+}
+
+func (d *dirStore) path(key string) string {
+	return filepath.Join(d.root, filepath.FromSlash(key))
+}
+
+// Put writes the object into a temporary file first, so that a
+// partial object is never seen.
+func (d *dirStore) Put(key string, data []byte) error {
+	path := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (d *dirStore) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(d.path(key))
+}
+
+func (d *dirStore) List(prefix string) ([]string, error) {
+	dir := d.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = d.path(prefix[:i])
+	}
+	var keys []string
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.root, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
@@ -0,0 +1,159 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tier
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testObjectStore(t *testing.T, name string, s ObjectStore) {
+	for _, key := range []string{"a/x/2", "a/x/1", "a/y/1", "b/1"} {
+		if err := s.Put(key, []byte("data "+key)); err != nil {
+			t.Fatalf("%s: Put: %v", name, err)
+		}
+	}
+	if data, err := s.Get("a/x/1"); err != nil || string(data) != "data a/x/1" {
+		t.Errorf("%s: Get: unexpected %q %v", name, data, err)
+	}
+	if _, err := s.Get("a/x/3"); err == nil {
+		t.Errorf("%s: Get: a missing key should be an error", name)
+	}
+	if keys, err := s.List("a/x/"); err != nil || !reflect.DeepEqual(keys, []string{"a/x/1", "a/x/2"}) {
+		t.Errorf("%s: List: unexpected %v %v", name, keys, err)
+	}
+	if keys, err := s.List("c/"); err != nil || len(keys) != 0 {
+		t.Errorf("%s: List: unexpected %v %v", name, keys, err)
+	}
+}
+
+func Test_dirStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewObjectStore("file://"+dir, S3Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testObjectStore(t, "dirStore", s)
+}
+
+// fakeS3 is enough of S3 for s3Store, it checks that requests are
+// signed.
+type fakeS3 struct {
+	sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	sum := sha256.Sum256(body)
+	if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AK/") ||
+		r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		http.Error(w, "not signed", http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.Method == "PUT":
+		f.objects[r.URL.Path] = body
+	case r.Method == "GET" && r.URL.Query().Get("list-type") == "2":
+		prefix := "/bucket/" + r.URL.Query().Get("prefix")
+		var keys []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, strings.TrimPrefix(k, "/bucket/"))
+			}
+		}
+		sort.Strings(keys)
+		var buf bytes.Buffer
+		buf.WriteString("<ListBucketResult>")
+		// one key per page, to exercise the continuation
+		start := 0
+		if token := r.URL.Query().Get("continuation-token"); token != "" {
+			fmt.Sscanf(token, "%d", &start)
+		}
+		if start < len(keys) {
+			fmt.Fprintf(&buf, "<Contents><Key>%s</Key></Contents>", keys[start])
+		}
+		if start+1 < len(keys) {
+			fmt.Fprintf(&buf, "<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>", start+1)
+		}
+		buf.WriteString("</ListBucketResult>")
+		w.Write(buf.Bytes())
+	case r.Method == "GET":
+		if data, ok := f.objects[r.URL.Path]; ok {
+			w.Write(data)
+		} else {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+		}
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+func Test_s3Store(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	if _, err := NewObjectStore("s3://bucket/cold", S3Options{}); err == nil {
+		t.Errorf("NewObjectStore: missing keys should be an error")
+	}
+	s, err := NewObjectStore("s3://bucket/cold", S3Options{Endpoint: srv.URL, AccessKey: "AK", SecretKey: "SK"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testObjectStore(t, "s3Store", s)
+	if _, ok := fake.objects["/bucket/cold/a/x/1"]; !ok {
+		t.Errorf("s3Store: objects not under the prefix: %v", fake.objects)
+	}
+
+	// Escaped keys are stored as is
+	if err := s.Put("%7B x/1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := s.List("%7B"); err != nil || !reflect.DeepEqual(keys, []string{"%7B x/1"}) {
+		t.Errorf("s3Store: List: unexpected %v %v", keys, err)
+	}
+}
+
+func Test_s3SigningKey(t *testing.T) {
+	// The example of the AWS Signature Version 4 documentation
+	key := s3SigningKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam")
+	if hex.EncodeToString(key) != "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d" {
+		t.Errorf("s3SigningKey: unexpected %x", key)
+	}
+	if q := s3Query(map[string][]string{"prefix": {"a/b c"}, "list-type": {"2"}}); q != "list-type=2&prefix=a%2Fb%20c" {
+		t.Errorf("s3Query: unexpected %q", q)
+	}
+}
@@ -0,0 +1,273 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package whisper reads Graphite (carbon) whisper files, e.g. to
+// import their history into tgres.
+package whisper
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// AggregationMethod is how whisper consolidates the points of an
+// archive into the next one.
+type AggregationMethod uint32
+
+const (
+	Unknown AggregationMethod = iota // treated as Average
+	Average
+	Sum
+	Last
+	Max
+	Min
+)
+
+// Metadata is the beginning of the header of a whisper file.
+type Metadata struct {
+	AggregationMethod AggregationMethod
+	MaxRetention      uint32 // seconds
+	XFilesFactor      float32
+	Count             uint32 // of archives
+}
+
+// ArchiveInfo describes an archive of a whisper file.
+type ArchiveInfo struct {
+	Offset uint32 // The byte offset of the archive within the file
+	Step   uint32 // seconds per point
+	Size   uint32 // The number of points
+}
+
+// Point is a point of an archive. The timestamp marks the beginning
+// of its slot (tgres marks the end), zero is an empty slot.
+type Point struct {
+	Timestamp uint32 // seconds since the epoch
+	Value     float64
+}
+
+// File is an open whisper file and its header. The archives are in
+// order of precision, the finest first.
+type File struct {
+	Metadata
+	Archives []ArchiveInfo
+	file     *os.File
+}
+
+// Open opens a whisper file and reads its header.
+func Open(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &File{file: f}
+	if err := w.readHeader(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: invalid whisper header: %v", path, err)
+	}
+	return w, nil
+}
+
+func (w *File) readHeader(r io.Reader) error {
+	if err := binary.Read(r, binary.BigEndian, &w.Metadata); err != nil {
+		return err
+	}
+	if w.Count == 0 || w.Count > 1024 {
+		return fmt.Errorf("unlikely number of archives: %d", w.Count)
+	}
+	w.Archives = make([]ArchiveInfo, w.Count)
+	if err := binary.Read(r, binary.BigEndian, w.Archives); err != nil {
+		return err
+	}
+	for _, a := range w.Archives {
+		if a.Step == 0 || a.Size == 0 {
+			return fmt.Errorf("empty archive")
+		}
+	}
+	return nil
+}
+
+// Points returns the points of archive n as they are in the file, in
+// no particular order and possibly including those of a previous time
+// round (which whisper leaves as they are).
+func (w *File) Points(n int) ([]Point, error) {
+	if n < 0 || n >= len(w.Archives) {
+		return nil, fmt.Errorf("the file contains only %d archives", len(w.Archives))
+	}
+	info := w.Archives[n]
+	if _, err := w.file.Seek(int64(info.Offset), 0); err != nil {
+		return nil, err
+	}
+	points := make([]Point, int(info.Size))
+	if err := binary.Read(w.file, binary.BigEndian, points); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+// Close closes the file.
+func (w *File) Close() error {
+	return w.file.Close()
+}
+
+// Spec returns the DSSpec with RRAs equivalent to the archives, the
+// step being that of the finest one. There is no sum consolidation in
+// tgres, a file aggregated by sum is an error.
+func (w *File) Spec(heartbeat time.Duration) (*rrd.DSSpec, error) {
+	var cf rrd.Consolidation
+	switch w.AggregationMethod {
+	case Unknown, Average:
+		cf = rrd.WMEAN
+	case Last:
+		cf = rrd.LAST
+	case Max:
+		cf = rrd.MAX
+	case Min:
+		cf = rrd.MIN
+	default:
+		return nil, fmt.Errorf("unsupported aggregation method: %d", w.AggregationMethod)
+	}
+
+	spec := &rrd.DSSpec{Step: time.Duration(w.Archives[0].Step) * time.Second, Heartbeat: heartbeat}
+	for _, a := range w.Archives {
+		step := time.Duration(a.Step) * time.Second
+		spec.RRAs = append(spec.RRAs, rrd.RRASpec{Function: cf, Step: step, Span: time.Duration(a.Size) * step, Xff: w.XFilesFactor})
+	}
+	return spec, nil
+}
+
+// RRAs returns the archives as RRAs of spec (see Spec) with their
+// data points, each ending with its most recent point, and the time
+// of the most recent point of all, the end of its slot. The points of
+// a previous time round are left out.
+func (w *File) RRAs(spec *rrd.DSSpec) ([]rrd.RoundRobinArchiver, time.Time, error) {
+	var (
+		result []rrd.RoundRobinArchiver
+		last   time.Time
+	)
+	for n, rs := range spec.RRAs {
+		points, err := w.Points(n)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		sort.Slice(points, func(i, j int) bool { return points[i].Timestamp < points[j].Timestamp })
+
+		step := int64(w.Archives[n].Step)
+		size := int64(w.Archives[n].Size)
+		if latest := int64(points[len(points)-1].Timestamp); latest != 0 {
+			rs.Latest = time.Unix(latest+step, 0) // the end of the slot
+			rs.DPs = make(map[int64]float64, len(points))
+			for _, p := range points {
+				end := time.Unix(int64(p.Timestamp)+step, 0)
+				if p.Timestamp == 0 || math.IsNaN(p.Value) || rs.Latest.Sub(end) >= rs.Span {
+					continue
+				}
+				rs.DPs[rrd.SlotIndex(end, rs.Step, size)] = p.Value
+			}
+			if rs.Latest.After(last) {
+				last = rs.Latest
+			}
+		}
+		result = append(result, rrd.NewRoundRobinArchive(rs))
+	}
+	return result, last, nil
+}
+
+// Create writes a whisper file with archives equivalent to the RRAs,
+// in order of their steps (which must be whole seconds), and their
+// data points, e.g. to export a DS to Graphite. The aggregation
+// method and the xFilesFactor are those of the finest RRA, whisper
+// has only one.
+func Create(path string, rras []rrd.RoundRobinArchiver) error {
+	if len(rras) == 0 {
+		return fmt.Errorf("no RRAs")
+	}
+	rras = append([]rrd.RoundRobinArchiver(nil), rras...)
+	sort.SliceStable(rras, func(i, j int) bool { return rras[i].Step() < rras[j].Step() })
+
+	md := Metadata{XFilesFactor: rras[0].Spec().Xff, Count: uint32(len(rras))}
+	switch rras[0].Spec().Function {
+	case rrd.WMEAN:
+		md.AggregationMethod = Average
+	case rrd.LAST:
+		md.AggregationMethod = Last
+	case rrd.MAX:
+		md.AggregationMethod = Max
+	case rrd.MIN:
+		md.AggregationMethod = Min
+	}
+	offset := uint32(binary.Size(md) + len(rras)*binary.Size(ArchiveInfo{}))
+	archives := make([]ArchiveInfo, 0, len(rras))
+	for _, rra := range rras {
+		if rra.Step() < time.Second || rra.Step()%time.Second != 0 {
+			return fmt.Errorf("step %v is not in whole seconds", rra.Step())
+		}
+		a := ArchiveInfo{Offset: offset, Step: uint32(rra.Step() / time.Second), Size: uint32(rra.Size())}
+		if retention := a.Step * a.Size; retention > md.MaxRetention {
+			md.MaxRetention = retention
+		}
+		archives = append(archives, a)
+		offset += a.Size * uint32(binary.Size(Point{}))
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(f, binary.BigEndian, &md); err != nil {
+		f.Close()
+		return err
+	}
+	if err := binary.Write(f, binary.BigEndian, archives); err != nil {
+		f.Close()
+		return err
+	}
+	for _, rra := range rras {
+		if err := binary.Write(f, binary.BigEndian, archivePoints(rra)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// archivePoints returns the data points of an RRA as a whisper
+// archive. Whisper places a point relative to the first one of the
+// archive, which is the oldest.
+func archivePoints(rra rrd.RoundRobinArchiver) []Point {
+	points := make([]Point, rra.Size())
+	if rra.Latest().IsZero() {
+		return points
+	}
+	step := int64(rra.Step() / time.Second)
+	var result []Point
+	for i, v := range rra.DPs() {
+		if !math.IsNaN(v) {
+			end := rrd.SlotTime(i, rra.Latest(), rra.Step(), rra.Size())
+			result = append(result, Point{Timestamp: uint32(end.Unix() - step), Value: v}) // the beginning of the slot
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Timestamp < result[j].Timestamp })
+	for _, p := range result {
+		points[(int64(p.Timestamp-result[0].Timestamp)/step)%rra.Size()] = p
+	}
+	return points
+}
@@ -0,0 +1,147 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package whisper
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// writeFile writes a whisper file with a 10s archive of 6 points and
+// a 1m one of 5.
+func writeFile(t *testing.T, path string, method AggregationMethod, fine, coarse []Point) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	hdrSize := uint32(binary.Size(Metadata{}) + 2*binary.Size(ArchiveInfo{}))
+	binary.Write(f, binary.BigEndian, Metadata{AggregationMethod: method, MaxRetention: 300, XFilesFactor: 0.5, Count: 2})
+	binary.Write(f, binary.BigEndian, []ArchiveInfo{{Offset: hdrSize, Step: 10, Size: 6}, {Offset: hdrSize + 6*12, Step: 60, Size: 5}})
+	binary.Write(f, binary.BigEndian, append(fine, make([]Point, 6-len(fine))...))
+	binary.Write(f, binary.BigEndian, append(coarse, make([]Point, 5-len(coarse))...))
+}
+
+func Test_File(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "foo.wsp")
+	writeFile(t, path, Max,
+		[]Point{{1000, 1}, {1010, 2}, {1020, math.NaN()}, {400, 9}}, // a ghost from a previous round
+		[]Point{{960, 5}})
+	w, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if len(w.Archives) != 2 || w.AggregationMethod != Max {
+		t.Fatalf("Open: unexpected header %v %v", w.Metadata, w.Archives)
+	}
+
+	spec, err := w.Spec(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Step != 10*time.Second || len(spec.RRAs) != 2 || spec.RRAs[1].Span != 5*time.Minute || spec.RRAs[0].Function != rrd.MAX || spec.RRAs[0].Xff != 0.5 {
+		t.Errorf("Spec: unexpected %v", spec)
+	}
+	rras, last, err := w.RRAs(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !last.Equal(time.Unix(1030, 0)) || !rras[0].Latest().Equal(time.Unix(1030, 0)) || !rras[1].Latest().Equal(time.Unix(1020, 0)) {
+		t.Errorf("RRAs: unexpected latest %v %v %v", last, rras[0].Latest(), rras[1].Latest())
+	}
+	if dps := rras[0].DPs(); len(dps) != 2 || dps[rrd.SlotIndex(time.Unix(1020, 0), 10*time.Second, 6)] != 2 {
+		t.Errorf("RRAs: expected 2 points (no NaN, no ghost), got %v", dps)
+	}
+
+	writeFile(t, path, Sum, nil, nil)
+	if w, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, err := w.Spec(time.Hour); err == nil {
+		t.Errorf("Spec: expected an error for sum")
+	}
+	if rras, last, err = w.RRAs(spec); err != nil || !last.IsZero() || len(rras[0].DPs()) != 0 {
+		t.Errorf("RRAs: expected nothing in an empty file, got %v %v %v", rras, last, err)
+	}
+
+	ioutil.WriteFile(path, []byte("garbage"), 0644)
+	if _, err := Open(path); err == nil {
+		t.Errorf("Open: expected an error for garbage")
+	}
+}
+
+func Test_Create(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spec := &rrd.DSSpec{Step: 10 * time.Second, RRAs: []rrd.RRASpec{
+		{Function: rrd.MAX, Step: time.Minute, Span: 5 * time.Minute},
+		{Function: rrd.MAX, Step: 10 * time.Second, Span: time.Minute, Xff: 0.5},
+	}}
+	var rras []rrd.RoundRobinArchiver
+	for _, rs := range spec.RRAs {
+		rs.Latest, rs.DPs = time.Unix(1200, 0), make(map[int64]float64)
+		size := int64(rs.Span / rs.Step)
+		for _, end := range []int64{1200, 1200 - 2*int64(rs.Step/time.Second)} {
+			rs.DPs[rrd.SlotIndex(time.Unix(end, 0), rs.Step, size)] = float64(end)
+		}
+		rras = append(rras, rrd.NewRoundRobinArchive(rs))
+	}
+	path := filepath.Join(dir, "foo.wsp")
+	if err := Create(path, rras); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.AggregationMethod != Max || w.XFilesFactor != 0.5 || w.MaxRetention != 300 || w.Archives[0].Step != 10 {
+		t.Errorf("Create: unexpected header %v %v", w.Metadata, w.Archives)
+	}
+	got, _ := w.Spec(time.Hour)
+	loaded, last, err := w.RRAs(got)
+	if err != nil || !last.Equal(time.Unix(1200, 0)) {
+		t.Fatalf("RRAs: %v %v", last, err)
+	}
+	if dps := loaded[1].DPs(); len(dps) != 2 || dps[rrd.SlotIndex(time.Unix(1080, 0), time.Minute, 5)] != 1080 {
+		t.Errorf("Create: unexpected points in the 1m archive %v", dps)
+	}
+
+	rras[0] = rrd.NewRoundRobinArchive(rrd.RRASpec{Step: 1500 * time.Millisecond, Span: time.Minute})
+	if err := Create(path, rras); err == nil {
+		t.Errorf("Create: expected an error for a step in fractions of a second")
+	}
+}